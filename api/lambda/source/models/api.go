@@ -27,6 +27,7 @@ type LambdaInput struct {
 	PutIntegration            *PutIntegrationInput            `json:"putIntegration"`
 	UpdateIntegrationSettings *UpdateIntegrationSettingsInput `json:"updateIntegrationSettings"`
 	ListIntegrations          *ListIntegrationsInput          `json:"listIntegrations"`
+	ListIntegrationsPage      *ListIntegrationsInput          `json:"listIntegrationsPage"`
 	DeleteIntegration         *DeleteIntegrationInput         `json:"deleteIntegration"`
 
 	ListLogTypes *ListLogTypesInput `json:"listLogTypes"`
@@ -38,6 +39,13 @@ type LambdaInput struct {
 
 	FullScan     *FullScanInput     `json:"fullScan"`
 	UpdateStatus *UpdateStatusInput `json:"updateStatus"`
+
+	TriggerScan        *TriggerScanInput        `json:"triggerScan"`
+	GetScanStatus      *GetScanStatusInput      `json:"getScanStatus"`
+	UpdateScanProgress *UpdateScanProgressInput `json:"updateScanProgress"`
+
+	RecordBackfill     *RecordBackfillInput     `json:"recordBackfill"`
+	GetBackfillHistory *GetBackfillHistoryInput `json:"getBackfillHistory"`
 }
 
 //
@@ -74,7 +82,8 @@ type PutIntegrationInput struct {
 
 // PutIntegrationSettings are all the settings for the new integration.
 type PutIntegrationSettings struct {
-	IntegrationLabel   string   `json:"integrationLabel" validate:"required,integrationLabel,excludesall='<>&\""`
+	// IntegrationLabel is checked by PutIntegration, to tell the characters allowed when it is invalid
+	IntegrationLabel   string   `json:"integrationLabel" validate:"required,excludesall='<>&\""`
 	IntegrationType    string   `json:"integrationType" validate:"oneof=aws-scan aws-s3 aws-sqs"`
 	UserID             string   `json:"userId" validate:"required,uuid4"`
 	AWSAccountID       string   `genericapi:"redact" json:"awsAccountId" validate:"omitempty,len=12,numeric"`
@@ -91,17 +100,37 @@ type PutIntegrationSettings struct {
 
 //
 // ListIntegrations: Used by the Scheduler to find integrations to scan
+// ListIntegrationsPage: Used to list the integrations a page at a time, e.g. by the UI
 //
 
-// ListIntegrationsInput allows filtering by the IntegrationType field
+// ListIntegrationsInput allows filtering by the IntegrationType and LogType fields, the integrations must match both
 type ListIntegrationsInput struct {
 	IntegrationType *string `json:"integrationType" validate:"omitempty,oneof=aws-scan aws-s3 aws-sqs"`
+	// LogType lists the integrations with the log type in their logTypes or in the logTypes of their sqsConfig
+	LogType *string `json:"logType" validate:"omitempty,min=1"`
+	// Verbose adds the back-fill history to the integrations
+	Verbose bool `json:"verbose"`
+
+	// PageSize and PaginationToken page the integrations of ListIntegrationsPage, ListIntegrations ignores them and
+	// returns all the integrations. The page size defaults to 1000.
+	PageSize int `json:"pageSize" validate:"omitempty,min=1,max=1000"`
+	// PaginationToken is the token of the previous page, the listing starts over without it
+	PaginationToken *string `json:"paginationToken"`
+}
+
+// ListIntegrationsOutput is a page of integrations
+type ListIntegrationsOutput struct {
+	Integrations []*SourceIntegration `json:"integrations"`
+	// PaginationToken is an opaque token to get the next page, it is not set on the last page
+	PaginationToken *string `json:"paginationToken,omitempty"`
 }
 
 // UpdateIntegrationSettingsInput is used to update integration settings.
+//
+// The IntegrationLabel is checked by UpdateIntegrationSettings when it changes, stored labels may predate the check.
 type UpdateIntegrationSettingsInput struct {
 	IntegrationID      string   `json:"integrationId" validate:"required,uuid4"`
-	IntegrationLabel   string   `json:"integrationLabel" validate:"required,integrationLabel,excludesall='<>&\""`
+	IntegrationLabel   string   `json:"integrationLabel" validate:"required,excludesall='<>&\""`
 	CWEEnabled         *bool    `json:"cweEnabled"`
 	RemediationEnabled *bool    `json:"remediationEnabled"`
 	ScanIntervalMins   int      `json:"scanIntervalMins" validate:"omitempty,oneof=60 180 360 720 1440"`
@@ -140,6 +169,70 @@ type FullScanInput struct {
 	Integrations []*SourceIntegrationMetadata
 }
 
+//
+// TriggerScan: Used by operators to start a full scan of an integration and follow its progress
+//
+
+// TriggerScanInput starts a full scan of an aws-scan integration.
+type TriggerScanInput struct {
+	IntegrationID string `json:"integrationId" validate:"required,uuid4"`
+}
+
+// TriggerScanOutput identifies the scan that was started.
+type TriggerScanOutput struct {
+	ScanID string `json:"scanId"`
+}
+
+// GetScanStatusInput is used to get the progress of a scan started with TriggerScan.
+type GetScanStatusInput struct {
+	ScanID string `json:"scanId" validate:"required,uuid4"`
+}
+
+// ScanStatus is the progress of a scan, as recorded by the snapshot pollers.
+type ScanStatus struct {
+	ScanID        string    `json:"scanId"`
+	IntegrationID string    `json:"integrationId"`
+	StartTime     time.Time `json:"startTime"`
+	// Status is scanning until every resource type completed, then ok or error
+	Status string `json:"status"`
+	// ResourceTypes are all the resource types scanned
+	ResourceTypes []string `json:"resourceTypes"`
+	// CompletedResourceTypes are the resource types scanned in all regions
+	CompletedResourceTypes []string `json:"completedResourceTypes"`
+	// Errors are the last poll error of a resource type, by resource type
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// UpdateScanProgressInput is used by the snapshot pollers to record the progress of a scan.
+//
+// A full account scan of a resource type reports the number of regions it scans in,
+// each region scan of the resource type then reports when it is done.
+type UpdateScanProgressInput struct {
+	ScanID       string `json:"scanId" validate:"required,uuid4"`
+	ResourceType string `json:"resourceType" validate:"required"`
+	// NumRegions is set by the full account scan of the resource type
+	NumRegions *int `json:"numRegions,omitempty" validate:"omitempty,min=0"`
+	// RegionDone is set when a region scan polled its last page
+	RegionDone   bool   `json:"regionDone"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+//
+// RecordBackfill: Used by the back-fill jobs and the s3queue ops tool to remember what was replayed
+//
+
+// RecordBackfillInput adds the record of a back-fill to the history of an integration,
+// or updates the record with the same run ID.
+type RecordBackfillInput struct {
+	IntegrationID string         `json:"integrationId" validate:"required,uuid4"`
+	Record        BackfillRecord `json:"record"`
+}
+
+// GetBackfillHistoryInput is used to get the back-fills of an integration, the most recent first.
+type GetBackfillHistoryInput struct {
+	IntegrationID string `json:"integrationId" validate:"required,uuid4"`
+}
+
 //
 // GetIntegrationTemplate: Used by the frontend to provide templates for users
 //
@@ -147,13 +240,17 @@ type FullScanInput struct {
 // GetIntegrationTemplateInput allows specification of what resources should be enabled/disabled in the template
 type GetIntegrationTemplateInput struct {
 	AWSAccountID       string `genericapi:"redact" json:"awsAccountId" validate:"required,len=12,numeric"`
-	IntegrationType    string `json:"integrationType" validate:"oneof=aws-scan aws-s3"`
+	IntegrationType    string `json:"integrationType" validate:"oneof=aws-scan aws-s3 aws-sqs"`
 	IntegrationLabel   string `json:"integrationLabel" validate:"required,integrationLabel"`
 	RemediationEnabled *bool  `json:"remediationEnabled"`
 	CWEEnabled         *bool  `json:"cweEnabled"`
 	S3Bucket           string `json:"s3Bucket" validate:"omitempty,min=1"`
 	S3Prefix           string `json:"s3Prefix" validate:"omitempty,min=1"`
 	KmsKey             string `json:"kmsKey" validate:"omitempty,kmsKeyArn"`
+	// IntegrationID is the aws-sqs integration whose queue the senders are allowed to send to, required for aws-sqs
+	IntegrationID string `json:"integrationId" validate:"omitempty,uuid4"`
+	// TemplateFormat is cloudformation if empty, aws-sqs templates are only available as terraform
+	TemplateFormat string `json:"templateFormat" validate:"omitempty,oneof=cloudformation terraform"`
 }
 
 //
@@ -30,6 +30,36 @@ type SourceIntegration struct {
 	SourceIntegrationMetadata
 	SourceIntegrationStatus
 	SourceIntegrationScanInformation
+	// BackfillHistory is only listed by verbose ListIntegrations calls
+	BackfillHistory []*BackfillRecord `json:"backfillHistory,omitempty"`
+}
+
+// The statuses of a back-fill
+const (
+	BackfillStatusRunning   = "running"
+	BackfillStatusSucceeded = "succeeded"
+	BackfillStatusFailed    = "failed"
+	BackfillStatusCanceled  = "canceled"
+)
+
+// BackfillRecord is a back-fill of the data of an integration, as remembered by the integration
+type BackfillRecord struct {
+	// RunID identifies the back-fill, the ID of a back-fill job or the run ID of the s3queue ops tool
+	RunID     string     `json:"runId" validate:"required,max=128"`
+	StartTime time.Time  `json:"startTime"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+	// Prefixes are the s3 paths listed
+	Prefixes []string `json:"prefixes,omitempty" validate:"max=100"`
+	// ModifiedAfter and ModifiedBefore bound the last modified time of the files replayed, if set
+	ModifiedAfter  *time.Time `json:"modifiedAfter,omitempty"`
+	ModifiedBefore *time.Time `json:"modifiedBefore,omitempty"`
+	NumFiles       uint64     `json:"numFiles"`
+	NumBytes       uint64     `json:"numBytes"`
+	NumFailed      uint64     `json:"numFailed,omitempty"`
+	Status         string     `json:"status" validate:"oneof=running succeeded failed canceled"`
+	ErrorMessage   string     `json:"errorMessage,omitempty"`
+	// Actor is who ran the back-fill, e.g. the ARN of the caller of the ops tool
+	Actor string `json:"actor,omitempty"`
 }
 
 // SourceIntegrationStatus provides information about the status of a source
@@ -19,6 +19,7 @@ package models
  */
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
 
@@ -27,6 +28,8 @@ import (
 )
 
 const (
+	// Labels name the stacks and the IAM roles of the integrations once lowercased with their spaces replaced
+	// by dashes. The longest prefix of those names leaves 39 characters to the label in a role name.
 	integrationLabelMaxLength = 32
 )
 
@@ -47,7 +50,19 @@ func Validator() (*validator.Validate, error) {
 }
 
 func validateIntegrationLabel(fl validator.FieldLevel) bool {
-	value := fl.Field().String()
+	return isValidIntegrationLabel(fl.Field().String())
+}
+
+// ValidateIntegrationLabel returns an error listing the characters allowed in labels if the label is invalid.
+func ValidateIntegrationLabel(label string) error {
+	if !isValidIntegrationLabel(label) {
+		return fmt.Errorf("integration label %q is invalid, it must have 1 to %d characters "+
+			"that are letters, digits, dashes or spaces", label, integrationLabelMaxLength)
+	}
+	return nil
+}
+
+func isValidIntegrationLabel(value string) bool {
 	if len(strings.TrimSpace(value)) == 0 || len(value) > integrationLabelMaxLength {
 		return false
 	}
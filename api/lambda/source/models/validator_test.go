@@ -48,6 +48,14 @@ func TestValidateIntegrationLabelFails(t *testing.T) {
 	require.EqualError(t, err, errorMsg)
 }
 
+func TestValidateIntegrationLabelMessage(t *testing.T) {
+	require.NoError(t, ValidateIntegrationLabel("Prod AWS-2"))
+	for _, label := range []string{"", "  ", "Prod_AWS", "Prödúction", "a-label-longer-than-thirty-two-chars"} {
+		require.EqualError(t, ValidateIntegrationLabel(label), "integration label \""+label+"\" is invalid, "+
+			"it must have 1 to 32 characters that are letters, digits, dashes or spaces")
+	}
+}
+
 func TestValidateNotKmsKey(t *testing.T) {
 	validator, err := Validator()
 	require.NoError(t, err)
@@ -80,3 +88,15 @@ func TestValidateKmsKey(t *testing.T) {
 	})
 	require.NoError(t, err)
 }
+
+func TestValidateListIntegrationsFilters(t *testing.T) {
+	validator, err := Validator()
+	require.NoError(t, err)
+	integrationType, logType := IntegrationTypeAWS3, "AWS.CloudTrail"
+	require.NoError(t, validator.Struct(&ListIntegrationsInput{IntegrationType: &integrationType, LogType: &logType}))
+
+	unknownType := "aws-unknown"
+	require.Error(t, validator.Struct(&ListIntegrationsInput{IntegrationType: &unknownType}))
+	emptyLogType := ""
+	require.Error(t, validator.Struct(&ListIntegrationsInput{LogType: &emptyLogType}))
+}
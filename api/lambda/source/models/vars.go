@@ -26,6 +26,11 @@ const (
 	// IntegrationTypeSqs is integration type for pulling data from an SQS queue.
 	IntegrationTypeSqs = "aws-sqs"
 
+	// TemplateFormatCloudFormation is the format of the integration templates deployed as CloudFormation stacks.
+	TemplateFormatCloudFormation = "cloudformation"
+	// TemplateFormatTerraform is the format of the integration templates applied as Terraform modules.
+	TemplateFormatTerraform = "terraform"
+
 	// StatusError is the string set in the database when an error occurs in a scan.
 	StatusError = "error"
 	// StatusOK is the string set in the database when a scan is successful.
@@ -0,0 +1,248 @@
+package backfillcost
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+const (
+	pageSize = 1000
+
+	// the log processor writes a batch of sqs messages per send and deletes them in batches after reading
+	sqsBatchSize = 10
+)
+
+// Prices are the unit prices of the services involved in a backfill
+type Prices struct {
+	SNSPublishesPerMillion   float64 `json:"snsPublishesPerMillion"`
+	SQSRequestsPerMillion    float64 `json:"sqsRequestsPerMillion"`
+	LambdaRequestsPerMillion float64 `json:"lambdaRequestsPerMillion"`
+	LambdaGBSecond           float64 `json:"lambdaGBSecond"`
+	S3ListsPerThousand       float64 `json:"s3ListsPerThousand"`
+	S3GetsPerThousand        float64 `json:"s3GetsPerThousand"`
+	S3PutsPerThousand        float64 `json:"s3PutsPerThousand"`
+	GlueRequestsPerMillion   float64 `json:"glueRequestsPerMillion"`
+}
+
+// DefaultPrices are the us-east-1 on demand prices
+var DefaultPrices = Prices{
+	SNSPublishesPerMillion:   0.50,
+	SQSRequestsPerMillion:    0.40,
+	LambdaRequestsPerMillion: 0.20,
+	LambdaGBSecond:           0.0000166667,
+	S3ListsPerThousand:       0.005,
+	S3GetsPerThousand:        0.0004,
+	S3PutsPerThousand:        0.005,
+	GlueRequestsPerMillion:   1.00,
+}
+
+// LoadPrices reads a JSON pricing table, prices not in the table keep their default value
+func LoadPrices(r io.Reader) (*Prices, error) {
+	prices := DefaultPrices
+	decoder := jsoniter.ConfigCompatibleWithStandardLibrary.NewDecoder(r)
+	decoder.DisallowUnknownFields() // catch typos, they would silently use the default
+	if err := decoder.Decode(&prices); err != nil {
+		return nil, errors.Wrap(err, "failed to read prices")
+	}
+	return &prices, nil
+}
+
+// Listing is the result of listing the objects of a backfill
+type Listing struct {
+	NumObjects      uint64
+	NumBytes        uint64
+	NumListRequests uint64
+	// Sampled is true if the listing stopped at the sample size before listing all objects
+	Sampled bool
+}
+
+// ListPath lists the objects of an s3 path (e.g., s3://mybucket/myprefix) the way s3queue does without sending anything.
+// If limit is non-zero then the listing stops after that many objects as the backfill would.
+// If sample is non-zero then the listing stops after that many objects and the result is marked as sampled.
+func ListPath(ctx context.Context, s3Client s3iface.S3API, s3Path string, limit, sample uint64) (*Listing, error) {
+	parsedPath, err := s3path.Parse(s3Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit == 0 {
+		limit = math.MaxUint64
+	}
+	stopAt := limit
+	if sample != 0 && sample < limit {
+		stopAt = sample
+	}
+
+	listing := &Listing{}
+	inputParams := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(parsedPath.Bucket),
+		Prefix:  aws.String(parsedPath.Key),
+		MaxKeys: aws.Int64(pageSize),
+	}
+	err = s3Client.ListObjectsV2PagesWithContext(ctx, inputParams, func(page *s3.ListObjectsV2Output, morePages bool) bool {
+		listing.NumListRequests++
+		for i, value := range page.Contents {
+			if aws.Int64Value(value.Size) > 0 { // only objects with size are sent
+				listing.NumObjects++
+				listing.NumBytes += uint64(*value.Size)
+				if listing.NumObjects >= stopAt {
+					listing.Sampled = stopAt < limit && (morePages || i < len(page.Contents)-1)
+					return false
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list %s", s3Path)
+	}
+	return listing, nil
+}
+
+// Extrapolate scales a sampled listing to a total number of objects using the average object size of the sample
+func (l *Listing) Extrapolate(totalObjects uint64) *Listing {
+	if l.NumObjects == 0 || totalObjects <= l.NumObjects {
+		return l
+	}
+	scale := float64(totalObjects) / float64(l.NumObjects)
+	return &Listing{
+		NumObjects:      totalObjects,
+		NumBytes:        uint64(float64(l.NumBytes) * scale),
+		NumListRequests: ceilDiv(totalObjects, pageSize),
+		Sampled:         l.Sampled,
+	}
+}
+
+// Input describes how a backfill will be processed downstream
+type Input struct {
+	Listing
+	// SNS is true if notifications are published to a topic rather than sent to the log processor queue
+	SNS bool
+	// ObjectsPerInvocation is the average number of objects the log processor reads per invocation
+	ObjectsPerInvocation uint64
+	// LambdaMemoryMB is the memory size of the log processor
+	LambdaMemoryMB uint64
+	// MBPerSecond is the average rate the log processor reads input data
+	MBPerSecond float64
+}
+
+// LineItem is the estimated cost of one kind of request
+type LineItem struct {
+	Service     string
+	Description string
+	Quantity    float64
+	Unit        string
+	Cost        float64
+}
+
+// Estimate is an itemized cost estimate
+type Estimate struct {
+	Items []LineItem
+	Total float64
+}
+
+// NewEstimate estimates the cost of a backfill.
+// The per invocation requests (S3 PUTs and Glue requests) are a lower bound since the log processor
+// writes at least one output object and looks up at least one partition per invocation.
+func NewEstimate(input *Input, prices *Prices) (*Estimate, error) {
+	if input.ObjectsPerInvocation == 0 {
+		return nil, errors.New("objects per invocation must be at least 1")
+	}
+	if input.MBPerSecond <= 0 {
+		return nil, errors.New("MB per second must be positive")
+	}
+
+	invocations := ceilDiv(input.NumObjects, input.ObjectsPerInvocation)
+	estimate := &Estimate{}
+	add := func(service, description string, quantity uint64, unit string, cost float64) {
+		estimate.Items = append(estimate.Items, LineItem{
+			Service:     service,
+			Description: description,
+			Quantity:    float64(quantity),
+			Unit:        unit,
+			Cost:        cost,
+		})
+	}
+
+	add("S3", "list requests", input.NumListRequests, "requests",
+		float64(input.NumListRequests)/1000*prices.S3ListsPerThousand)
+	if input.SNS {
+		// delivery from SNS to SQS is free
+		add("SNS", "publishes", input.NumObjects, "requests",
+			float64(input.NumObjects)/1e6*prices.SNSPublishesPerMillion)
+	} else {
+		sends := ceilDiv(input.NumObjects, sqsBatchSize)
+		add("SQS", "send message batches", sends, "requests",
+			float64(sends)/1e6*prices.SQSRequestsPerMillion)
+	}
+	add("SQS", "log processor receives and deletes", 2*invocations, "requests",
+		float64(2*invocations)/1e6*prices.SQSRequestsPerMillion)
+	add("Lambda", "log processor invocations", invocations, "requests",
+		float64(invocations)/1e6*prices.LambdaRequestsPerMillion)
+
+	seconds := float64(input.NumBytes) / (1024 * 1024) / input.MBPerSecond
+	gbSeconds := seconds * float64(input.LambdaMemoryMB) / 1024
+	estimate.Items = append(estimate.Items, LineItem{
+		Service:     "Lambda",
+		Description: "log processor duration",
+		Quantity:    gbSeconds,
+		Unit:        "GB-seconds",
+		Cost:        gbSeconds * prices.LambdaGBSecond,
+	})
+
+	add("S3", "log processor reads", input.NumObjects, "requests",
+		float64(input.NumObjects)/1000*prices.S3GetsPerThousand)
+	add("S3", "log processor writes", invocations, "requests",
+		float64(invocations)/1000*prices.S3PutsPerThousand)
+	add("Glue", "partition updates", invocations, "requests",
+		float64(invocations)/1e6*prices.GlueRequestsPerMillion)
+
+	for _, item := range estimate.Items {
+		estimate.Total += item.Cost
+	}
+	return estimate, nil
+}
+
+// Print writes the estimate as a table
+func (e *Estimate) Print(w io.Writer) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "Service\tDescription\tQuantity\tUnit\tCost (USD)\t")
+	for _, item := range e.Items {
+		fmt.Fprintf(table, "%s\t%s\t%.0f\t%s\t%.4f\t\n", item.Service, item.Description, item.Quantity, item.Unit, item.Cost)
+	}
+	fmt.Fprintf(table, "Total\t\t\t\t%.4f\t\n", e.Total)
+	return table.Flush()
+}
+
+func ceilDiv(n, d uint64) uint64 {
+	return (n + d - 1) / d
+}
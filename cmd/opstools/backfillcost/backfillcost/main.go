@@ -0,0 +1,132 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/backfillcost"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+func main() {
+	opstools.SetUsage("lists the objects of a planned s3queue backfill and estimates its cost")
+	opts := struct {
+		S3Path               *string
+		Limit                *uint64
+		Sample               *uint64
+		TotalObjects         *uint64
+		SNS                  *bool
+		Prices               *string
+		ObjectsPerInvocation *uint64
+		LambdaMemoryMB       *uint64
+		MBPerSecond          *float64
+		Debug                *bool
+		Region               *string
+	}{
+		S3Path: flag.String("s3path", "", "The s3 path of the backfill (e.g., s3://<bucket>/<prefix>)"),
+		Limit:  flag.Uint64("limit", 0, "If non-zero, the backfill is limited to this number of files"),
+		Sample: flag.Uint64("sample", 0,
+			"If non-zero, list only this number of files and extrapolate to -total-objects"),
+		TotalObjects: flag.Uint64("total-objects", 0, "The number of files to extrapolate a sample to"),
+		SNS:          flag.Bool("sns", false, "Estimate for notifications published to an SNS topic rather than sent to the queue"),
+		Prices: flag.String("prices", "",
+			"A JSON file overriding the default (us-east-1) unit prices, e.g. {\"sqsRequestsPerMillion\": 0.40}"),
+		ObjectsPerInvocation: flag.Uint64("objects-per-invocation", 10, "The average number of files per log processor invocation"),
+		LambdaMemoryMB:       flag.Uint64("lambda-memory", 1024, "The memory size in MB of the log processor"),
+		MBPerSecond:          flag.Float64("mb-per-second", 10, "The average rate in MB/sec the log processor reads files"),
+		Debug:                flag.Bool("debug", false, "Enable additional logging"),
+		Region:               flag.String("region", "", "Set the AWS region of the Panther deployment"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+
+	if *opts.S3Path == "" {
+		flag.Usage()
+		log.Fatal("-s3path not set")
+	}
+	if *opts.Sample != 0 && *opts.TotalObjects == 0 {
+		flag.Usage()
+		log.Fatal("-sample requires -total-objects")
+	}
+
+	prices := &backfillcost.DefaultPrices
+	if *opts.Prices != "" {
+		pricesFile, err := os.Open(*opts.Prices)
+		if err != nil {
+			log.Fatal(err)
+		}
+		prices, err = backfillcost.LoadPrices(pricesFile)
+		pricesFile.Close()
+		if err != nil {
+			log.Fatalf("%s: %s", *opts.Prices, err)
+		}
+	}
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region: opts.Region,
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+
+	ctx := context.Background()
+	parsedPath, err := s3path.Parse(*opts.S3Path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s3Region, err := s3manager.GetBucketRegion(ctx, sess, parsedPath.Bucket, aws.StringValue(sess.Config.Region))
+	if err != nil {
+		log.Fatalf("failed to find bucket region for provided path %s: %s", *opts.S3Path, err)
+	}
+	s3Client := s3.New(sess.Copy(&aws.Config{Region: &s3Region}))
+
+	listing, err := backfillcost.ListPath(ctx, s3Client, *opts.S3Path, *opts.Limit, *opts.Sample)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if listing.Sampled {
+		log.Infof("extrapolating %d sampled files (%.2fMB) to %d files",
+			listing.NumObjects, float32(listing.NumBytes)/(1024.0*1024.0), *opts.TotalObjects)
+		listing = listing.Extrapolate(*opts.TotalObjects)
+	}
+	log.Infof("estimating for %d files (%.2fMB)", listing.NumObjects, float32(listing.NumBytes)/(1024.0*1024.0))
+
+	estimate, err := backfillcost.NewEstimate(&backfillcost.Input{
+		Listing:              *listing,
+		SNS:                  *opts.SNS,
+		ObjectsPerInvocation: *opts.ObjectsPerInvocation,
+		LambdaMemoryMB:       *opts.LambdaMemoryMB,
+		MBPerSecond:          *opts.MBPerSecond,
+	}, prices)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := estimate.Print(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,131 @@
+package backfillcost
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+func TestLoadPrices(t *testing.T) {
+	prices, err := LoadPrices(strings.NewReader(`{"sqsRequestsPerMillion": 0.5}`))
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, prices.SQSRequestsPerMillion)
+	assert.Equal(t, DefaultPrices.SNSPublishesPerMillion, prices.SNSPublishesPerMillion)
+	assert.Equal(t, 0.4, DefaultPrices.SQSRequestsPerMillion) // defaults are not modified
+
+	_, err = LoadPrices(strings.NewReader(`{"sqsRequestPerMillion": 0.5}`))
+	assert.Error(t, err)
+}
+
+func TestListPath(t *testing.T) {
+	page := &s3.ListObjectsV2Output{
+		Contents: []*s3.Object{
+			{Key: aws.String("a"), Size: aws.Int64(10)},
+			{Key: aws.String("b"), Size: aws.Int64(0)}, // ignored
+			{Key: aws.String("c"), Size: aws.Int64(20)},
+			{Key: aws.String("d"), Size: aws.Int64(30)},
+		},
+	}
+	s3Client := &testutils.S3Mock{}
+	s3Client.On("ListObjectsV2PagesWithContext", mock.Anything, &s3.ListObjectsV2Input{
+		Bucket:  aws.String("bucket"),
+		Prefix:  aws.String("prefix"),
+		MaxKeys: aws.Int64(pageSize),
+	}, mock.Anything, mock.Anything).Return(page, nil)
+
+	listing, err := ListPath(context.Background(), s3Client, "s3://bucket/prefix", 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, &Listing{NumObjects: 3, NumBytes: 60, NumListRequests: 1}, listing)
+
+	listing, err = ListPath(context.Background(), s3Client, "s3://bucket/prefix", 2, 0)
+	require.NoError(t, err)
+	assert.Equal(t, &Listing{NumObjects: 2, NumBytes: 30, NumListRequests: 1}, listing)
+
+	listing, err = ListPath(context.Background(), s3Client, "s3://bucket/prefix", 0, 2)
+	require.NoError(t, err)
+	assert.Equal(t, &Listing{NumObjects: 2, NumBytes: 30, NumListRequests: 1, Sampled: true}, listing)
+	assert.Equal(t, &Listing{NumObjects: 3000, NumBytes: 45000, NumListRequests: 3, Sampled: true}, listing.Extrapolate(3000))
+
+	_, err = ListPath(context.Background(), s3Client, "http://bucket/prefix", 0, 0)
+	assert.Error(t, err)
+}
+
+func TestNewEstimate(t *testing.T) {
+	input := &Input{
+		Listing: Listing{
+			NumObjects:      1000000,
+			NumBytes:        1024 * 1024 * 1024 * 100, // 100GB
+			NumListRequests: 1000,
+		},
+		ObjectsPerInvocation: 10,
+		LambdaMemoryMB:       1024,
+		MBPerSecond:          10,
+	}
+	prices := &Prices{
+		SNSPublishesPerMillion:   1,
+		SQSRequestsPerMillion:    1,
+		LambdaRequestsPerMillion: 1,
+		LambdaGBSecond:           1,
+		S3ListsPerThousand:       1,
+		S3GetsPerThousand:        1,
+		S3PutsPerThousand:        1,
+		GlueRequestsPerMillion:   1,
+	}
+	estimate, err := NewEstimate(input, prices)
+	require.NoError(t, err)
+	costs := make(map[string]float64)
+	for _, item := range estimate.Items {
+		costs[item.Service+" "+item.Description] = item.Cost
+	}
+	assert.Equal(t, map[string]float64{
+		"S3 list requests":                       1,
+		"SQS send message batches":               0.1,
+		"SQS log processor receives and deletes": 0.2,
+		"Lambda log processor invocations":       0.1,
+		"Lambda log processor duration":          10240,
+		"S3 log processor reads":                 1000,
+		"S3 log processor writes":                100,
+		"Glue partition updates":                 0.1,
+	}, costs)
+	assert.InDelta(t, 11341.5, estimate.Total, 1e-9)
+
+	input.SNS = true
+	estimate, err = NewEstimate(input, prices)
+	require.NoError(t, err)
+	assert.Equal(t, "SNS", estimate.Items[1].Service)
+	assert.Equal(t, 1.0, estimate.Items[1].Cost)
+
+	var out strings.Builder
+	require.NoError(t, estimate.Print(&out))
+	assert.Contains(t, out.String(), "11342.4000")
+
+	input.ObjectsPerInvocation = 0
+	_, err = NewEstimate(input, prices)
+	assert.Error(t, err)
+}
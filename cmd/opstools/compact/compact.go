@@ -0,0 +1,387 @@
+package compact
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/cmd/opstools/lakemigrate"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+)
+
+const (
+	// CompactedPrefix starts the names of compacted objects, a partition with compacted objects is not compacted again
+	CompactedPrefix = "compacted-"
+
+	pageSize = 1000
+)
+
+// newlineMember is a gzip member of a single newline, it terminates objects whose last line has no newline
+// so that it is not joined with the first line of the next object.
+var newlineMember = func() []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, _ = writer.Write([]byte("\n"))
+	_ = writer.Close()
+	return buffer.Bytes()
+}()
+
+type Config struct {
+	Bucket    string
+	Partition lakemigrate.Partition
+	// NumObjects is the number of compacted objects the partition objects are merged into
+	NumObjects int
+	// RunID names the compacted objects and is the backfill run id of their notifications
+	RunID string
+	// NotifyTopicARN if set, notifications for the compacted objects are published to this topic
+	NotifyTopicARN string
+}
+
+// Object is an entry of a manifest
+type Object struct {
+	Key              string `json:"key"`
+	Size             int64  `json:"size"`
+	UncompressedSize int64  `json:"uncompressedSize"`
+	Lines            int64  `json:"lines"`
+}
+
+// Manifest lists the objects of a partition before and after compaction
+type Manifest struct {
+	Partition string   `json:"partition"`
+	Originals []Object `json:"originals"`
+	Compacted []Object `json:"compacted"`
+	// Skipped are the objects under the partition prefix that are not gzip compressed
+	Skipped []Object `json:"skipped,omitempty"`
+}
+
+// Compactor merges the gzip objects of a partition into fewer, larger objects next to them, it never deletes the originals
+type Compactor struct {
+	S3       s3iface.S3API
+	Uploader s3manageriface.UploaderAPI
+	SNS      snsiface.SNSAPI // only needed if notifications are published
+}
+
+// Compact concatenates the gzip members of the partition objects into config.NumObjects objects of similar size.
+// Every compacted object is read back and its decompressed size and line count are checked against its originals.
+// The compacted objects are added alongside the originals, queries over the partition see both until the originals are removed.
+func (c *Compactor) Compact(ctx context.Context, config *Config) (*Manifest, error) {
+	if config.NumObjects < 1 {
+		return nil, errors.New("the number of compacted objects must be at least 1")
+	}
+	if config.RunID == "" {
+		return nil, errors.New("a run id is required")
+	}
+	partition := config.Partition
+	manifest := &Manifest{Partition: partition.ID()}
+	objects, err := c.listObjects(ctx, config.Bucket, partition.Prefix())
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		name := path.Base(object.Key)
+		switch {
+		case strings.HasPrefix(name, CompactedPrefix):
+			return nil, errors.Errorf("partition %s is already compacted (s3://%s/%s)", partition.ID(), config.Bucket, object.Key)
+		case strings.HasSuffix(name, ".gz"):
+			manifest.Originals = append(manifest.Originals, object)
+		default:
+			manifest.Skipped = append(manifest.Skipped, object)
+		}
+	}
+
+	for i, group := range groupBySize(manifest.Originals, config.NumObjects) {
+		key := fmt.Sprintf("%s%s%s-%03d.json.gz", partition.Prefix(), CompactedPrefix, config.RunID, i)
+		originals := make([]*Object, len(group))
+		for j, index := range group {
+			originals[j] = &manifest.Originals[index]
+		}
+		compacted, err := c.compact(ctx, config.Bucket, key, originals)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to compact %s", partition.ID())
+		}
+		manifest.Compacted = append(manifest.Compacted, *compacted)
+	}
+
+	if config.NotifyTopicARN != "" {
+		if err := c.notify(config, manifest.Compacted); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// listObjects returns the objects under a prefix in key order
+func (c *Compactor) listObjects(ctx context.Context, bucket, prefix string) ([]Object, error) {
+	var objects []Object
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(pageSize),
+	}
+	err := c.S3.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, value := range page.Contents {
+			objects = append(objects, Object{
+				Key:  aws.StringValue(value.Key),
+				Size: aws.Int64Value(value.Size),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list s3://%s/%s", bucket, prefix)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+// groupBySize assigns the objects to at most n groups of similar total size, largest objects first.
+// The groups hold object indexes in ascending order.
+func groupBySize(objects []Object, n int) [][]int {
+	if n > len(objects) {
+		n = len(objects)
+	}
+	bySize := make([]int, len(objects))
+	for i := range bySize {
+		bySize[i] = i
+	}
+	sort.SliceStable(bySize, func(i, j int) bool {
+		return objects[bySize[i]].Size > objects[bySize[j]].Size
+	})
+	groups := make([][]int, n)
+	sizes := make([]int64, n)
+	for _, index := range bySize {
+		smallest := 0
+		for i := range sizes {
+			if sizes[i] < sizes[smallest] {
+				smallest = i
+			}
+		}
+		groups[smallest] = append(groups[smallest], index)
+		sizes[smallest] += objects[index].Size
+	}
+	for _, group := range groups {
+		sort.Ints(group)
+	}
+	return groups
+}
+
+// compact uploads the concatenation of the originals to key and verifies it, the line counts of the originals are set.
+func (c *Compactor) compact(ctx context.Context, bucket, key string, originals []*Object) (*Object, error) {
+	compacted := &Object{Key: key}
+	reader, writer := io.Pipe()
+	concatDone := make(chan struct{})
+	go func() {
+		defer close(concatDone)
+		var err error
+		for _, original := range originals {
+			if err = c.concat(ctx, bucket, original, compacted, writer); err != nil {
+				break
+			}
+		}
+		writer.CloseWithError(err) // closes without error if err is nil, otherwise it fails the upload
+	}()
+
+	_, err := c.Uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   reader,
+	})
+	reader.CloseWithError(err) // unblocks the concatenation if the upload failed
+	<-concatDone
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to upload s3://%s/%s", bucket, key)
+	}
+
+	if err := c.verify(ctx, bucket, compacted); err != nil {
+		c.deleteObject(bucket, key)
+		return nil, err
+	}
+	return compacted, nil
+}
+
+// concat writes the gzip members of an original object to w as they are, decompressing them to count its lines
+func (c *Compactor) concat(ctx context.Context, bucket string, original, compacted *Object, w io.Writer) error {
+	output, err := c.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(original.Key),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get s3://%s/%s", bucket, original.Key)
+	}
+	defer output.Body.Close()
+
+	written := &countingWriter{w: w}
+	raw := io.TeeReader(output.Body, written)
+	count, err := countLines(raw)
+	if err != nil {
+		return errors.WithMessagef(err, "s3://%s/%s", bucket, original.Key)
+	}
+	if _, err := io.Copy(ioutil.Discard, raw); err != nil {
+		return errors.Wrapf(err, "failed to read s3://%s/%s", bucket, original.Key)
+	}
+	original.UncompressedSize, original.Lines = count.Size, count.Lines
+	if count.Unterminated {
+		if _, err := written.Write(newlineMember); err != nil {
+			return err
+		}
+		compacted.UncompressedSize++
+	}
+	compacted.Size += written.n
+	compacted.UncompressedSize += count.Size
+	compacted.Lines += count.Lines
+	return nil
+}
+
+// verify reads back a compacted object and checks its sizes and line count
+func (c *Compactor) verify(ctx context.Context, bucket string, compacted *Object) error {
+	output, err := c.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(compacted.Key),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get s3://%s/%s", bucket, compacted.Key)
+	}
+	defer output.Body.Close()
+
+	read := &countingWriter{w: ioutil.Discard}
+	count, err := countLines(io.TeeReader(output.Body, read))
+	if err != nil {
+		return errors.WithMessagef(err, "s3://%s/%s", bucket, compacted.Key)
+	}
+	if read.n != compacted.Size || count.Size != compacted.UncompressedSize || count.Lines != compacted.Lines {
+		return errors.Errorf("s3://%s/%s has %d bytes, %d uncompressed bytes and %d lines, expected %d, %d and %d",
+			bucket, compacted.Key, read.n, count.Size, count.Lines, compacted.Size, compacted.UncompressedSize, compacted.Lines)
+	}
+	return nil
+}
+
+func (c *Compactor) deleteObject(bucket, key string) {
+	// only ever called for a compacted object that failed verification
+	_, err := c.S3.DeleteObjectWithContext(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		zap.L().Warn("failed to delete invalid compacted object", zap.String("key", key), zap.Error(err))
+	}
+}
+
+func (c *Compactor) notify(config *Config, compacted []Object) error {
+	table := config.Partition.Table
+	dataType, err := lakemigrate.DataType(table.Database)
+	if err != nil {
+		return err
+	}
+	for _, object := range compacted {
+		message, err := jsoniter.MarshalToString(notify.NewS3ObjectPutNotification(config.Bucket, object.Key, int(object.Size)))
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal notification")
+		}
+		attributes := notify.NewLogAnalysisSNSMessageAttributes(dataType, table.LogType)
+		notify.SetReplayHints(attributes, &notify.ReplayHints{
+			Replay:            true,
+			OriginalEventTime: config.Partition.Hour,
+			BackfillRunID:     config.RunID,
+		})
+		_, err = c.SNS.Publish(&sns.PublishInput{
+			TopicArn:          aws.String(config.NotifyTopicARN),
+			Message:           aws.String(message),
+			MessageAttributes: attributes,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to notify %s of s3://%s/%s", config.NotifyTopicARN, config.Bucket, object.Key)
+		}
+	}
+	return nil
+}
+
+// lineCount is the decompressed size and number of lines of gzip data
+type lineCount struct {
+	Size  int64
+	Lines int64
+	// Unterminated is set if the last line has no newline, it is counted as a line
+	Unterminated bool
+}
+
+// countLines decompresses all the gzip members of r
+func countLines(r io.Reader) (*lineCount, error) {
+	count := &lineCount{}
+	reader, err := gzip.NewReader(r)
+	if err == io.EOF { // empty object
+		return count, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "not gzip data")
+	}
+	defer reader.Close()
+
+	buffer := make([]byte, 64*1024)
+	var last byte
+	for {
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			count.Size += int64(n)
+			count.Lines += int64(bytes.Count(buffer[:n], []byte("\n")))
+			last = buffer[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decompress")
+		}
+	}
+	if count.Size > 0 && last != '\n' {
+		count.Lines++
+		count.Unterminated = true
+	}
+	return count, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,134 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/google/uuid"
+	jsoniter "github.com/json-iterator/go"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/compact"
+	"github.com/panther-labs/panther/cmd/opstools/lakemigrate"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+)
+
+func main() {
+	opstools.SetUsage("merges the objects of an hourly partition into fewer objects next to them (the originals are kept)")
+	opts := struct {
+		Bucket         *string
+		LogType        *string
+		Database       *string
+		Hour           *string
+		NumObjects     *int
+		RunID          *string
+		NotifyTopic    *string
+		Debug          *bool
+		Region         *string
+		MaxRetries     *int
+		MaxConnections *int
+	}{
+		Bucket:         flag.String("bucket", "", "The bucket of the partition"),
+		LogType:        flag.String("log-type", "", "The log type of the table to compact"),
+		Database:       flag.String("database", pantherdb.LogProcessingDatabase, "The database of the table to compact"),
+		Hour:           flag.String("hour", "", "The partition hour YYYY-MM-DDTHH"),
+		NumObjects:     flag.Int("objects", 1, "The number of compacted objects"),
+		RunID:          flag.String("run-id", "", "Names the compacted objects and tags their notifications (default a new UUID)"),
+		NotifyTopic:    flag.String("notify-topic", "", "If set, notify this topic (name, ARN or URL) of each compacted object as a replay"),
+		Debug:          flag.Bool("debug", false, "Enable additional logging"),
+		Region:         flag.String("region", "", "Set the AWS region to run on"),
+		MaxRetries:     flag.Int("max-retries", 12, "Max retries for AWS requests"),
+		MaxConnections: flag.Int("max-connections", 100, "Max number of connections to AWS"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+	zap.ReplaceGlobals(log.Desugar()) // for the compaction warnings
+
+	if *opts.Bucket == "" || *opts.LogType == "" || *opts.Hour == "" {
+		flag.Usage()
+		log.Fatal("-bucket, -log-type and -hour must be set")
+	}
+	hour, err := time.Parse("2006-01-02T15", *opts.Hour)
+	if err != nil {
+		log.Fatalf("-hour: failed to parse %q as hour (YYYY-MM-DDTHH): %s", *opts.Hour, err)
+	}
+	tables := lakemigrate.LogTypeTables([]string{*opts.LogType}, []string{*opts.Database})
+	if len(tables) == 0 {
+		log.Fatalf("log type %s has no table in %s", *opts.LogType, *opts.Database)
+	}
+	if *opts.RunID == "" {
+		*opts.RunID = uuid.New().String()
+	}
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region:     opts.Region,
+		MaxRetries: opts.MaxRetries,
+		HTTPClient: opstools.NewHTTPClient(*opts.MaxConnections, 0),
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+	if *opts.NotifyTopic != "" {
+		*opts.NotifyTopic = opstools.MustResolveTopicARN(sess, log, "notify-topic", *opts.NotifyTopic, "")
+	}
+	s3Client := s3.New(sess)
+	compactor := &compact.Compactor{
+		S3:       s3Client,
+		Uploader: s3manager.NewUploaderWithClient(s3Client),
+		SNS:      sns.New(sess),
+	}
+
+	startTime := time.Now()
+	manifest, err := compactor.Compact(context.Background(), &compact.Config{
+		Bucket: *opts.Bucket,
+		Partition: lakemigrate.Partition{
+			Table: tables[0],
+			Hour:  hour,
+		},
+		NumObjects:     *opts.NumObjects,
+		RunID:          *opts.RunID,
+		NotifyTopicARN: *opts.NotifyTopic,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	opstools.LogSkipped(log)
+	log.Infof("compacted %d objects of %s into %d objects in %v (run %s)",
+		len(manifest.Originals), manifest.Partition, len(manifest.Compacted), time.Since(startTime), *opts.RunID)
+	for _, skipped := range manifest.Skipped {
+		log.Warnf("skipped s3://%s/%s, it is not gzip compressed", *opts.Bucket, skipped.Key)
+	}
+
+	// the manifest is the only record of which objects the compacted objects replace
+	encoder := jsoniter.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		log.Fatalf("failed to write manifest: %s", err)
+	}
+}
@@ -0,0 +1,324 @@
+package compact
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/cmd/opstools/lakemigrate"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+const (
+	bucket = "bucket"
+	prefix = "logs/aws_cloudtrail/year=2020/month=11/day=01/hour=00/"
+)
+
+var testPartition = lakemigrate.Partition{
+	Table: lakemigrate.Table{
+		Database: pantherdb.LogProcessingDatabase,
+		Name:     "aws_cloudtrail",
+		LogType:  "AWS.CloudTrail",
+	},
+	Hour: time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC),
+}
+
+// memoryS3 keeps objects in memory, it also implements the uploader
+type memoryS3 struct {
+	s3iface.S3API
+	s3manageriface.UploaderAPI
+	mu      sync.Mutex
+	objects map[string][]byte
+	// truncate if set drops the last bytes of uploads
+	truncate int
+}
+
+func newMemoryS3() *memoryS3 {
+	return &memoryS3{objects: make(map[string][]byte)}
+}
+
+func (m *memoryS3) put(key string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = data
+}
+
+func (m *memoryS3) snapshot() map[string][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	objects := make(map[string][]byte, len(m.objects))
+	for key, data := range m.objects {
+		objects[key] = data
+	}
+	return objects
+}
+
+func (m *memoryS3) ListObjectsV2PagesWithContext(_ aws.Context, input *s3.ListObjectsV2Input,
+	f func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+
+	page := &s3.ListObjectsV2Output{}
+	for key, data := range m.snapshot() {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(int64(len(data)))})
+		}
+	}
+	f(page, true)
+	return nil
+}
+
+func (m *memoryS3) GetObjectWithContext(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	data, ok := m.snapshot()[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (m *memoryS3) DeleteObjectWithContext(_ aws.Context, input *s3.DeleteObjectInput,
+	_ ...request.Option) (*s3.DeleteObjectOutput, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, aws.StringValue(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *memoryS3) UploadWithContext(_ aws.Context, input *s3manager.UploadInput,
+	_ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.put(aws.StringValue(input.Key), data[:len(data)-m.truncate])
+	return &s3manager.UploadOutput{}, nil
+}
+
+// gzipMembers compresses each part as a separate gzip member
+func gzipMembers(t *testing.T, parts ...string) []byte {
+	var buffer bytes.Buffer
+	for _, part := range parts {
+		writer := gzip.NewWriter(&buffer)
+		_, err := writer.Write([]byte(part))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+	}
+	return buffer.Bytes()
+}
+
+// decompressedLines returns the lines of a gzip object, it fails on a last line without newline
+func decompressedLines(t *testing.T, data []byte) []string {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.True(t, bytes.HasSuffix(content, []byte("\n")), "compacted data must end with a newline")
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.NoError(t, scanner.Err())
+	return lines
+}
+
+func TestCountLines(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		expected lineCount
+	}{
+		{"empty object", nil, lineCount{}},
+		{"empty member", gzipMembers(t, ""), lineCount{}},
+		{"lines", gzipMembers(t, "a\nb\n"), lineCount{Size: 4, Lines: 2}},
+		{"unterminated", gzipMembers(t, "a\nb"), lineCount{Size: 3, Lines: 2, Unterminated: true}},
+		{"members", gzipMembers(t, "a\n", "b\nc", "\n"), lineCount{Size: 6, Lines: 3}},
+		{"line across members", gzipMembers(t, "a", "b\n"), lineCount{Size: 3, Lines: 1}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			count, err := countLines(bytes.NewReader(tc.data))
+			require.NoError(t, err)
+			assert.Equal(t, &tc.expected, count)
+		})
+	}
+
+	_, err := countLines(strings.NewReader("not gzip"))
+	assert.Error(t, err)
+	truncated := gzipMembers(t, "a\nb\n")
+	_, err = countLines(bytes.NewReader(truncated[:len(truncated)-4]))
+	assert.Error(t, err)
+}
+
+func TestGroupBySize(t *testing.T) {
+	objects := []Object{{Size: 10}, {Size: 1}, {Size: 7}, {Size: 3}, {Size: 5}, {Size: 4}}
+	assert.Equal(t, [][]int{{0}, {2, 3}, {1, 4, 5}}, groupBySize(objects, 3))
+	assert.Equal(t, [][]int{{0, 1, 5}, {2, 3, 4}}, groupBySize(objects, 2))
+	assert.Equal(t, [][]int{{0}, {1}}, groupBySize(objects[:2], 5))
+	assert.Empty(t, groupBySize(nil, 5))
+}
+
+func TestCompact(t *testing.T) {
+	store := newMemoryS3()
+	random := rand.New(rand.NewSource(1))
+	var expectedLines []string
+	for i := 0; i < 40; i++ {
+		var parts []string
+		numMembers := 1 + random.Intn(3)
+		for member := 0; member < numMembers; member++ {
+			var part strings.Builder
+			numLines := random.Intn(50)
+			for line := 0; line < numLines; line++ {
+				fmt.Fprintf(&part, `{"object":%d,"member":%d,"line":%d}`+"\n", i, member, line)
+				expectedLines = append(expectedLines, fmt.Sprintf(`{"object":%d,"member":%d,"line":%d}`, i, member, line))
+			}
+			parts = append(parts, part.String())
+		}
+		if i%7 == 3 { // the last line has no newline
+			parts = append(parts, fmt.Sprintf(`{"object":%d,"last":true}`, i))
+			expectedLines = append(expectedLines, fmt.Sprintf(`{"object":%d,"last":true}`, i))
+		}
+		store.put(fmt.Sprintf("%s20201101T000000Z-%03d.json.gz", prefix, i), gzipMembers(t, parts...))
+	}
+	store.put(prefix+"empty.json.gz", nil)
+	store.put(prefix+"notes.txt", []byte("not data"))
+	originals := store.snapshot()
+
+	snsClient := &testutils.SnsMock{}
+	snsClient.On("Publish", mock.MatchedBy(func(input *sns.PublishInput) bool {
+		attribute := func(name string) string {
+			return aws.StringValue(input.MessageAttributes[name].StringValue)
+		}
+		return aws.StringValue(input.TopicArn) == "topic" &&
+			attribute(notify.LogTypeAttributeName) == "AWS.CloudTrail" &&
+			attribute(notify.DataTypeAttributeName) == string(pantherdb.LogData) &&
+			attribute(notify.ReplayAttributeName) == "true" &&
+			attribute(notify.OriginalEventTimeAttributeName) == "2020-11-01T00:00:00Z" &&
+			attribute(notify.BackfillRunIDAttributeName) == "run" &&
+			strings.Contains(aws.StringValue(input.Message), prefix+CompactedPrefix+"run-")
+	})).Return(&sns.PublishOutput{}, nil).Times(3)
+
+	compactor := &Compactor{S3: store, Uploader: store, SNS: snsClient}
+	manifest, err := compactor.Compact(context.Background(), &Config{
+		Bucket:         bucket,
+		Partition:      testPartition,
+		NumObjects:     3,
+		RunID:          "run",
+		NotifyTopicARN: "topic",
+	})
+	require.NoError(t, err)
+	snsClient.AssertExpectations(t)
+
+	assert.Equal(t, "panther_logs.aws_cloudtrail/2020-11-01T00", manifest.Partition)
+	assert.Len(t, manifest.Originals, 41)
+	assert.Equal(t, []Object{{Key: prefix + "notes.txt", Size: 8}}, manifest.Skipped)
+	require.Len(t, manifest.Compacted, 3)
+
+	// the originals are untouched
+	objects := store.snapshot()
+	for key, data := range originals {
+		assert.Equal(t, data, objects[key], key)
+	}
+	assert.Len(t, objects, len(originals)+3)
+
+	var originalLines int64
+	for _, original := range manifest.Originals {
+		originalLines += original.Lines
+	}
+	assert.Equal(t, int64(len(expectedLines)), originalLines)
+
+	var compactedLines []string
+	var manifestLines int64
+	for i, compacted := range manifest.Compacted {
+		assert.Equal(t, fmt.Sprintf("%scompacted-run-%03d.json.gz", prefix, i), compacted.Key)
+		data := objects[compacted.Key]
+		assert.Equal(t, int64(len(data)), compacted.Size)
+		lines := decompressedLines(t, data)
+		assert.Equal(t, int64(len(lines)), compacted.Lines)
+		compactedLines = append(compactedLines, lines...)
+		manifestLines += compacted.Lines
+	}
+	assert.Equal(t, originalLines, manifestLines)
+	sort.Strings(expectedLines)
+	sort.Strings(compactedLines)
+	assert.Equal(t, expectedLines, compactedLines)
+
+	// a compacted partition is not compacted again
+	_, err = compactor.Compact(context.Background(), &Config{Bucket: bucket, Partition: testPartition, NumObjects: 1, RunID: "again"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "already compacted")
+}
+
+func TestCompactCorruptObject(t *testing.T) {
+	store := newMemoryS3()
+	store.put(prefix+"a.json.gz", gzipMembers(t, "a\n"))
+	store.put(prefix+"b.json.gz", []byte("not gzip"))
+
+	compactor := &Compactor{S3: store, Uploader: store}
+	_, err := compactor.Compact(context.Background(), &Config{Bucket: bucket, Partition: testPartition, NumObjects: 1, RunID: "run"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), prefix+"b.json.gz")
+	assert.Len(t, store.snapshot(), 2)
+}
+
+func TestCompactVerifyFailure(t *testing.T) {
+	store := newMemoryS3()
+	store.put(prefix+"a.json.gz", gzipMembers(t, "a\n"))
+	store.put(prefix+"b.json.gz", gzipMembers(t, "b\n"))
+	store.truncate = 1
+
+	compactor := &Compactor{S3: store, Uploader: store}
+	_, err := compactor.Compact(context.Background(), &Config{Bucket: bucket, Partition: testPartition, NumObjects: 1, RunID: "run"})
+	require.Error(t, err)
+	// the invalid compacted object is deleted
+	assert.Len(t, store.snapshot(), 2)
+}
+
+func TestCompactConfig(t *testing.T) {
+	compactor := &Compactor{S3: newMemoryS3()}
+	_, err := compactor.Compact(context.Background(), &Config{Bucket: bucket, Partition: testPartition, RunID: "run"})
+	assert.Error(t, err)
+	_, err = compactor.Compact(context.Background(), &Config{Bucket: bucket, Partition: testPartition, NumObjects: 1})
+	assert.Error(t, err)
+}
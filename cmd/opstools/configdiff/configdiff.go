@@ -0,0 +1,332 @@
+package configdiff
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/internal/core/logtypesapi"
+	"github.com/panther-labs/panther/pkg/genericapi"
+)
+
+const sourceAPIFunctionName = "panther-source-api"
+
+// GeneratedSourceFields are set by Panther and differ between deployments with the same configuration.
+// They are never compared.
+var GeneratedSourceFields = []string{
+	"integrationId",
+	"createdAtTime",
+	"createdBy",
+	"scanStatus",
+	"eventStatus",
+	"lastEventReceived",
+	"lastScanStartTime",
+	"lastScanEndTime",
+	"lastScanErrorMessage",
+	"sqsConfig.s3Bucket",
+	"sqsConfig.logProcessingRole",
+	"sqsConfig.queueUrl",
+}
+
+// Config is the source and log type configuration of a deployment
+type Config struct {
+	Sources    []*models.SourceIntegration    `json:"sources"`
+	CustomLogs []*logtypesapi.CustomLogRecord `json:"customLogs"`
+}
+
+// Fetch pulls the integrations and custom log types of the deployment the client invokes
+func Fetch(ctx context.Context, lambdaClient lambdaiface.LambdaAPI) (*Config, error) {
+	config := &Config{}
+	input := &models.LambdaInput{
+		ListIntegrations: &models.ListIntegrationsInput{},
+	}
+	if err := genericapi.Invoke(lambdaClient, sourceAPIFunctionName, input, &config.Sources); err != nil {
+		return nil, errors.Wrap(err, "failed to list integrations")
+	}
+	logTypesAPI := &logtypesapi.LogTypesAPILambdaClient{
+		LambdaName: logtypesapi.LambdaName,
+		LambdaAPI:  lambdaClient,
+	}
+	output, err := logTypesAPI.ListCustomLogs(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list custom log types")
+	}
+	if output.Error != nil {
+		return nil, errors.Wrap(output.Error, "failed to list custom log types")
+	}
+	config.CustomLogs = output.CustomLogs
+	return config, nil
+}
+
+// FieldDiff is a field with a different value in each deployment, a missing field has a nil value
+type FieldDiff struct {
+	Field string      `json:"field"`
+	A     interface{} `json:"a"`
+	B     interface{} `json:"b"`
+}
+
+// SourceDiff are the differences of the sources with the same label
+type SourceDiff struct {
+	Label  string       `json:"label"`
+	Fields []*FieldDiff `json:"fields"`
+}
+
+// LogTypeDiff are the differences of the custom log types with the same name
+type LogTypeDiff struct {
+	LogType   string       `json:"logType"`
+	RevisionA int64        `json:"revisionA"`
+	RevisionB int64        `json:"revisionB"`
+	Fields    []*FieldDiff `json:"fields,omitempty"`
+}
+
+// Diff are the differences between the configuration of deployment A and B.
+// Sources are matched by label and custom log types by name.
+type Diff struct {
+	SourcesOnlyInA  []string       `json:"sourcesOnlyInA"`
+	SourcesOnlyInB  []string       `json:"sourcesOnlyInB"`
+	SourcesChanged  []*SourceDiff  `json:"sourcesChanged"`
+	LogTypesOnlyInA []string       `json:"logTypesOnlyInA"`
+	LogTypesOnlyInB []string       `json:"logTypesOnlyInB"`
+	LogTypesChanged []*LogTypeDiff `json:"logTypesChanged"`
+}
+
+// Empty returns true if the configurations are the same
+func (d *Diff) Empty() bool {
+	return len(d.SourcesOnlyInA) == 0 && len(d.SourcesOnlyInB) == 0 && len(d.SourcesChanged) == 0 &&
+		len(d.LogTypesOnlyInA) == 0 && len(d.LogTypesOnlyInB) == 0 && len(d.LogTypesChanged) == 0
+}
+
+// Compare returns the differences between two configurations.
+// Fields matching a pattern of the ignore list (path.Match syntax on dotted field names, e.g. "sqsConfig.*")
+// are masked, so that values which legitimately differ per deployment like ARNs are not reported.
+func Compare(a, b *Config, ignore []string) (*Diff, error) {
+	for _, pattern := range ignore {
+		if _, err := path.Match(pattern, "x"); err != nil {
+			return nil, errors.Wrapf(err, "invalid ignore pattern %q", pattern)
+		}
+	}
+	diff := &Diff{
+		// empty lists instead of nulls keep the output easy to consume
+		SourcesOnlyInA:  []string{},
+		SourcesOnlyInB:  []string{},
+		SourcesChanged:  []*SourceDiff{},
+		LogTypesOnlyInA: []string{},
+		LogTypesOnlyInB: []string{},
+		LogTypesChanged: []*LogTypeDiff{},
+	}
+	if err := diff.compareSources(a.Sources, b.Sources, ignore); err != nil {
+		return nil, err
+	}
+	if err := diff.compareLogTypes(a.CustomLogs, b.CustomLogs, ignore); err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+func (d *Diff) compareSources(a, b []*models.SourceIntegration, ignore []string) error {
+	sourcesA, sourcesB := make(map[string]interface{}), make(map[string]interface{})
+	for _, source := range a {
+		sourcesA[source.IntegrationLabel] = source
+	}
+	for _, source := range b {
+		sourcesB[source.IntegrationLabel] = source
+	}
+	ignore = append(append([]string(nil), GeneratedSourceFields...), ignore...)
+	onlyInA, onlyInB, both := splitKeys(sourcesA, sourcesB)
+	d.SourcesOnlyInA, d.SourcesOnlyInB = append(d.SourcesOnlyInA, onlyInA...), append(d.SourcesOnlyInB, onlyInB...)
+	for _, label := range both {
+		fields, err := compareFields(sourcesA[label], sourcesB[label], ignore)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to compare source %q", label)
+		}
+		if len(fields) > 0 {
+			d.SourcesChanged = append(d.SourcesChanged, &SourceDiff{
+				Label:  label,
+				Fields: fields,
+			})
+		}
+	}
+	return nil
+}
+
+func (d *Diff) compareLogTypes(a, b []*logtypesapi.CustomLogRecord, ignore []string) error {
+	logTypesA, logTypesB := make(map[string]interface{}), make(map[string]interface{})
+	for _, record := range a {
+		logTypesA[record.LogType] = record
+	}
+	for _, record := range b {
+		logTypesB[record.LogType] = record
+	}
+	// the revision is reported on its own, the update time is set by the server and specs are compared as schemas
+	fieldIgnore := append([]string{"revision", "updatedAt", "logSpec"}, ignore...)
+	onlyInA, onlyInB, both := splitKeys(logTypesA, logTypesB)
+	d.LogTypesOnlyInA, d.LogTypesOnlyInB = append(d.LogTypesOnlyInA, onlyInA...), append(d.LogTypesOnlyInB, onlyInB...)
+	for _, logType := range both {
+		recordA := logTypesA[logType].(*logtypesapi.CustomLogRecord)
+		recordB := logTypesB[logType].(*logtypesapi.CustomLogRecord)
+		fields, err := compareFields(recordA, recordB, fieldIgnore)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to compare log type %q", logType)
+		}
+		if !ignored("logSpec", ignore) && !sameSchema(recordA.LogSpec, recordB.LogSpec) {
+			fields = append(fields, &FieldDiff{
+				Field: "logSpec",
+				A:     recordA.LogSpec,
+				B:     recordB.LogSpec,
+			})
+		}
+		if len(fields) > 0 || recordA.Revision != recordB.Revision {
+			d.LogTypesChanged = append(d.LogTypesChanged, &LogTypeDiff{
+				LogType:   logType,
+				RevisionA: recordA.Revision,
+				RevisionB: recordB.Revision,
+				Fields:    fields,
+			})
+		}
+	}
+	return nil
+}
+
+// sameSchema compares log specs ignoring formatting, specs that do not parse are compared as text
+func sameSchema(a, b string) bool {
+	if a == b {
+		return true
+	}
+	var schemaA, schemaB interface{}
+	if yaml.Unmarshal([]byte(a), &schemaA) != nil || yaml.Unmarshal([]byte(b), &schemaB) != nil {
+		return false
+	}
+	return reflect.DeepEqual(schemaA, schemaB)
+}
+
+// splitKeys returns the sorted keys only in a, only in b and in both
+func splitKeys(a, b map[string]interface{}) (onlyInA, onlyInB, both []string) {
+	for key := range a {
+		if _, ok := b[key]; ok {
+			both = append(both, key)
+		} else {
+			onlyInA = append(onlyInA, key)
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			onlyInB = append(onlyInB, key)
+		}
+	}
+	sort.Strings(onlyInA)
+	sort.Strings(onlyInB)
+	sort.Strings(both)
+	return onlyInA, onlyInB, both
+}
+
+// compareFields returns the differences of the JSON fields of two values, nested objects are flattened to dotted names
+func compareFields(a, b interface{}, ignore []string) ([]*FieldDiff, error) {
+	fieldsA, err := flatFields(a)
+	if err != nil {
+		return nil, err
+	}
+	fieldsB, err := flatFields(b)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]interface{}, len(fieldsA))
+	for name := range fieldsA {
+		names[name] = nil
+	}
+	for name := range fieldsB {
+		names[name] = nil
+	}
+	_, _, all := splitKeys(names, names)
+	var diffs []*FieldDiff
+	for _, name := range all {
+		if ignored(name, ignore) || reflect.DeepEqual(fieldsA[name], fieldsB[name]) {
+			continue
+		}
+		diffs = append(diffs, &FieldDiff{
+			Field: name,
+			A:     fieldsA[name],
+			B:     fieldsB[name],
+		})
+	}
+	return diffs, nil
+}
+
+func flatFields(value interface{}) (map[string]interface{}, error) {
+	data, err := jsoniter.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]interface{}
+	if err := jsoniter.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	flatten("", object, fields)
+	return fields, nil
+}
+
+func flatten(prefix string, value interface{}, fields map[string]interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, field := range value {
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			flatten(name, field, fields)
+		}
+	case []interface{}:
+		if len(value) == 0 {
+			return // unset and empty fields are the same
+		}
+		// lists like log types are sets, their order does not matter
+		sorted := append([]interface{}(nil), value...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			si, iok := sorted[i].(string)
+			sj, jok := sorted[j].(string)
+			return iok && jok && strings.Compare(si, sj) < 0
+		})
+		fields[prefix] = sorted
+	case string:
+		if value != "" {
+			fields[prefix] = value
+		}
+	case nil:
+	default:
+		fields[prefix] = value
+	}
+}
+
+func ignored(field string, ignore []string) bool {
+	for _, pattern := range ignore {
+		if match, _ := path.Match(pattern, field); match {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/configdiff"
+)
+
+func main() {
+	opstools.SetUsage("prints the differences of the sources and custom log types of two Panther deployments as JSON")
+	opts := struct {
+		ProfileA *string
+		RegionA  *string
+		ProfileB *string
+		RegionB  *string
+		Ignore   *string
+		ExitCode *bool
+		Debug    *bool
+	}{
+		ProfileA: flag.String("a-profile", "", "The AWS profile of deployment A (defaults to the environment credentials)"),
+		RegionA:  flag.String("a-region", "", "The AWS region of deployment A"),
+		ProfileB: flag.String("b-profile", "", "The AWS profile of deployment B (defaults to the environment credentials)"),
+		RegionB:  flag.String("b-region", "", "The AWS region of deployment B"),
+		Ignore: flag.String("ignore", "",
+			"Comma separated list of fields to mask, with * wildcards (e.g. awsAccountId,logProcessingRole,sqsConfig.*)"),
+		ExitCode: flag.Bool("exit-code", false, "Exit with status 1 if there are differences"),
+		Debug:    flag.Bool("debug", false, "Enable additional logging"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+
+	if *opts.ProfileA == *opts.ProfileB && *opts.RegionA == *opts.RegionB {
+		flag.Usage()
+		log.Fatal("deployments A and B must differ in -a-profile/-b-profile or -a-region/-b-region")
+	}
+	var ignore []string
+	if *opts.Ignore != "" {
+		ignore = strings.Split(*opts.Ignore, ",")
+	}
+
+	ctx := context.Background()
+	configs := make([]*configdiff.Config, 2)
+	for i, deployment := range []struct {
+		name    string
+		profile string
+		region  string
+	}{
+		{"A", *opts.ProfileA, *opts.RegionA},
+		{"B", *opts.ProfileB, *opts.RegionB},
+	} {
+		sess, err := opstools.NewSessionWithOptions(session.Options{
+			Profile:           deployment.profile,
+			Config:            aws.Config{Region: aws.String(deployment.region)},
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			log.Fatalf("failed to build AWS session of deployment %s: %s", deployment.name, err)
+		}
+		if configs[i], err = configdiff.Fetch(ctx, lambda.New(sess)); err != nil {
+			log.Fatalf("failed to fetch the configuration of deployment %s: %s", deployment.name, err)
+		}
+		log.Debugf("deployment %s has %d sources and %d custom log types",
+			deployment.name, len(configs[i].Sources), len(configs[i].CustomLogs))
+	}
+
+	diff, err := configdiff.Compare(configs[0], configs[1], ignore)
+	if err != nil {
+		log.Fatal(err)
+	}
+	encoder := jsoniter.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(diff); err != nil {
+		log.Fatalf("failed to write diff: %s", err)
+	}
+	log.Infof("sources: %d only in A, %d only in B, %d changed; custom log types: %d only in A, %d only in B, %d changed",
+		len(diff.SourcesOnlyInA), len(diff.SourcesOnlyInB), len(diff.SourcesChanged),
+		len(diff.LogTypesOnlyInA), len(diff.LogTypesOnlyInB), len(diff.LogTypesChanged))
+	if *opts.ExitCode && !diff.Empty() {
+		os.Exit(1)
+	}
+}
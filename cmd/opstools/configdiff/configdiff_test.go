@@ -0,0 +1,162 @@
+package configdiff
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/internal/core/logtypesapi"
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+func testSource(id, label, account string, logTypes ...string) *models.SourceIntegration {
+	return &models.SourceIntegration{
+		SourceIntegrationMetadata: models.SourceIntegrationMetadata{
+			AWSAccountID:      account,
+			CreatedAtTime:     time.Now(),
+			IntegrationID:     id,
+			IntegrationLabel:  label,
+			IntegrationType:   models.IntegrationTypeAWS3,
+			S3Bucket:          "bucket",
+			LogTypes:          logTypes,
+			LogProcessingRole: "arn:aws:iam::" + account + ":role/PantherLogProcessingRole-" + label,
+		},
+	}
+}
+
+func testLogType(name string, revision int64, spec string) *logtypesapi.CustomLogRecord {
+	return &logtypesapi.CustomLogRecord{
+		LogType:   name,
+		Revision:  revision,
+		UpdatedAt: time.Now(),
+		CustomLog: logtypesapi.CustomLog{
+			Description: "test",
+			LogSpec:     spec,
+		},
+	}
+}
+
+func TestCompare(t *testing.T) {
+	a := &Config{
+		Sources: []*models.SourceIntegration{
+			testSource("1", "cloudtrail", "111111111111", "AWS.CloudTrail", "AWS.S3ServerAccess"),
+			testSource("2", "only-a", "111111111111", "AWS.VPCFlow"),
+			testSource("3", "same", "111111111111", "AWS.ALB"),
+		},
+		CustomLogs: []*logtypesapi.CustomLogRecord{
+			testLogType("Custom.Same", 1, "version: 0\nfields:\n- name: a\n  type: string\n"),
+			testLogType("Custom.Changed", 2, "version: 0\nfields:\n- name: a\n  type: string\n"),
+			testLogType("Custom.OnlyA", 1, "version: 0"),
+		},
+	}
+	b := &Config{
+		Sources: []*models.SourceIntegration{
+			// generated fields differ, log types are in a different order
+			testSource("4", "cloudtrail", "111111111111", "AWS.S3ServerAccess", "AWS.CloudTrail", "AWS.GuardDuty"),
+			testSource("5", "only-b", "111111111111", "AWS.VPCFlow"),
+			testSource("6", "same", "111111111111", "AWS.ALB"),
+		},
+		CustomLogs: []*logtypesapi.CustomLogRecord{
+			// reformatted spec
+			testLogType("Custom.Same", 1, "version: 0\nfields:\n  - name: a\n    type: string\n"),
+			testLogType("Custom.Changed", 3, "version: 0\nfields:\n- name: b\n  type: string\n"),
+		},
+	}
+
+	diff, err := Compare(a, b, nil)
+	require.NoError(t, err)
+	assert.False(t, diff.Empty())
+	assert.Equal(t, []string{"only-a"}, diff.SourcesOnlyInA)
+	assert.Equal(t, []string{"only-b"}, diff.SourcesOnlyInB)
+	require.Len(t, diff.SourcesChanged, 1)
+	assert.Equal(t, "cloudtrail", diff.SourcesChanged[0].Label)
+	require.Len(t, diff.SourcesChanged[0].Fields, 1)
+	assert.Equal(t, "logTypes", diff.SourcesChanged[0].Fields[0].Field)
+
+	assert.Equal(t, []string{"Custom.OnlyA"}, diff.LogTypesOnlyInA)
+	assert.Empty(t, diff.LogTypesOnlyInB)
+	require.Len(t, diff.LogTypesChanged, 1)
+	changed := diff.LogTypesChanged[0]
+	assert.Equal(t, "Custom.Changed", changed.LogType)
+	assert.Equal(t, int64(2), changed.RevisionA)
+	assert.Equal(t, int64(3), changed.RevisionB)
+	require.Len(t, changed.Fields, 1)
+	assert.Equal(t, "logSpec", changed.Fields[0].Field)
+
+	// the output has lists instead of nulls
+	data, err := jsoniter.MarshalToString(diff)
+	require.NoError(t, err)
+	assert.Contains(t, data, `"logTypesOnlyInB":[]`)
+}
+
+func TestCompareIgnore(t *testing.T) {
+	a := &Config{Sources: []*models.SourceIntegration{testSource("1", "source", "111111111111", "AWS.ALB")}}
+	b := &Config{Sources: []*models.SourceIntegration{testSource("2", "source", "222222222222", "AWS.ALB")}}
+
+	diff, err := Compare(a, b, nil)
+	require.NoError(t, err)
+	require.Len(t, diff.SourcesChanged, 1)
+	fields := diff.SourcesChanged[0].Fields
+	require.Len(t, fields, 2)
+	assert.Equal(t, "awsAccountId", fields[0].Field)
+	assert.Equal(t, "111111111111", fields[0].A)
+	assert.Equal(t, "222222222222", fields[0].B)
+	assert.Equal(t, "logProcessingRole", fields[1].Field)
+
+	diff, err = Compare(a, b, []string{"awsAccountId", "logProcessing*"})
+	require.NoError(t, err)
+	assert.True(t, diff.Empty())
+
+	_, err = Compare(a, b, []string{"["})
+	assert.Error(t, err)
+}
+
+func TestFetch(t *testing.T) {
+	sources, err := jsoniter.Marshal([]*models.SourceIntegration{testSource("1", "source", "111111111111", "AWS.ALB")})
+	require.NoError(t, err)
+	logTypes, err := jsoniter.Marshal(&logtypesapi.ListCustomLogsOutput{
+		CustomLogs: []*logtypesapi.CustomLogRecord{testLogType("Custom.Test", 1, "version: 0")},
+	})
+	require.NoError(t, err)
+	lambdaClient := &testutils.LambdaMock{}
+	lambdaClient.On("Invoke", mock.MatchedBy(func(input *lambda.InvokeInput) bool {
+		return aws.StringValue(input.FunctionName) == sourceAPIFunctionName
+	})).Return(&lambda.InvokeOutput{Payload: sources}, nil)
+	lambdaClient.On("InvokeWithContext", mock.Anything, mock.MatchedBy(func(input *lambda.InvokeInput) bool {
+		return aws.StringValue(input.FunctionName) == logtypesapi.LambdaName
+	}), mock.Anything).Return(&lambda.InvokeOutput{Payload: logTypes}, nil)
+
+	config, err := Fetch(context.Background(), lambdaClient)
+	require.NoError(t, err)
+	lambdaClient.AssertExpectations(t)
+	require.Len(t, config.Sources, 1)
+	assert.Equal(t, "source", config.Sources[0].IntegrationLabel)
+	require.Len(t, config.CustomLogs, 1)
+	assert.Equal(t, "Custom.Test", config.CustomLogs[0].LogType)
+}
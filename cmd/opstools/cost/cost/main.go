@@ -69,7 +69,7 @@ func main() {
 
 	log := opstools.MustBuildLogger(*VERBOSE)
 
-	awsSession := session.Must(session.NewSession())
+	awsSession := session.Must(opstools.NewSession())
 
 	err := validateFlags(awsSession)
 	if err != nil {
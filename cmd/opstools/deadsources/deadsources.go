@@ -0,0 +1,268 @@
+package deadsources
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/glue/glueiface"
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/cmd/opstools/sourcemap"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+)
+
+// Kinds of findings
+const (
+	// KindIdleSource is a source without data for longer than the idle threshold
+	KindIdleSource = "idle-source"
+	// KindUnclaimedTable is a table receiving data although no source has its log type
+	KindUnclaimedTable = "unclaimed-table"
+	// KindMissingTable is a log type of a source that never produced data
+	KindMissingTable = "missing-table"
+)
+
+// Remediations suggested for the kinds of findings
+const (
+	RemediationIdleSource = "disable the source if its bucket or queue was decommissioned, " +
+		"otherwise check its notifications and permissions"
+	RemediationUnclaimedTable = "investigate the writer of the table, no current source has its log type"
+	RemediationMissingTable   = "fix the log types of the source, its data does not have this log type"
+)
+
+// DataDatabases are the databases written by sources, the other databases are written by the rules engine
+var DataDatabases = []string{
+	pantherdb.LogProcessingDatabase,
+	pantherdb.CloudSecurityDatabase,
+}
+
+// Config configures an audit
+type Config struct {
+	// MaxIdle is how long a source can be without data, sources created more recently are not reported
+	MaxIdle time.Duration
+	Now     time.Time
+}
+
+// Finding is a source or a table that needs attention
+type Finding struct {
+	Kind              string     `json:"kind"`
+	IntegrationID     string     `json:"integrationId,omitempty"`
+	IntegrationLabel  string     `json:"integrationLabel,omitempty"`
+	IntegrationType   string     `json:"integrationType,omitempty"`
+	LogType           string     `json:"logType,omitempty"`
+	Table             string     `json:"table,omitempty"` // database.table
+	LastEventReceived *time.Time `json:"lastEventReceived,omitempty"`
+	LatestPartition   *time.Time `json:"latestPartition,omitempty"`
+	Detail            string     `json:"detail"`
+	Remediation       string     `json:"remediation"`
+}
+
+// Report is the outcome of an audit
+type Report struct {
+	Time        time.Time  `json:"time"`
+	MaxIdleDays int        `json:"maxIdleDays"`
+	NumSources  int        `json:"numSources"`
+	NumTables   int        `json:"numTables"`
+	Findings    []*Finding `json:"findings"`
+}
+
+// Audit joins the sources, the events they last received and the latest partitions of the tables of the data
+// databases. It reports the idle sources, the tables with recent data that no source claims and the log types
+// of sources that never produced data. The sources must be all the sources, not a subset.
+func Audit(ctx context.Context, glueClient glueiface.GlueAPI, sources []*sourcemap.Source,
+	config *Config) (*Report, error) {
+
+	tables, err := listTables(ctx, glueClient)
+	if err != nil {
+		return nil, err
+	}
+	auditor := &auditor{
+		glue:   glueClient,
+		now:    config.Now,
+		exists: make(map[string]bool, len(tables)),
+		latest: make(map[string]*time.Time),
+	}
+	for _, table := range tables {
+		auditor.exists[table] = true
+	}
+	report := &Report{
+		Time:        config.Now,
+		MaxIdleDays: int(config.MaxIdle / (24 * time.Hour)),
+		NumSources:  len(sources),
+		NumTables:   len(tables),
+		Findings:    []*Finding{}, // consumers expect an array
+	}
+	cutoff := config.Now.Add(-config.MaxIdle)
+
+	claimed := make(map[string]bool)
+	for _, source := range sources {
+		findings, err := auditor.auditSource(source, cutoff)
+		if err != nil {
+			return nil, err
+		}
+		report.Findings = append(report.Findings, findings...)
+		for _, table := range source.Tables {
+			claimed[table.Database+"."+table.Name] = true
+		}
+	}
+
+	for _, table := range tables {
+		if claimed[table] {
+			continue
+		}
+		latest, err := auditor.latestPartition(table)
+		if err != nil {
+			return nil, err
+		}
+		if latest == nil || latest.Before(cutoff) {
+			continue // not receiving data, e.g. the table of a deleted source
+		}
+		report.Findings = append(report.Findings, &Finding{
+			Kind:            KindUnclaimedTable,
+			Table:           table,
+			LatestPartition: latest,
+			Detail:          fmt.Sprintf("table has data until %s but no source has its log type", formatHour(*latest)),
+			Remediation:     RemediationUnclaimedTable,
+		})
+	}
+	return report, nil
+}
+
+type auditor struct {
+	glue   glueiface.GlueAPI
+	now    time.Time
+	exists map[string]bool       // by database.table
+	latest map[string]*time.Time // by database.table
+}
+
+func (a *auditor) auditSource(source *sourcemap.Source, cutoff time.Time) ([]*Finding, error) {
+	if source.CreatedAtTime.After(cutoff) {
+		return nil, nil // too recent to tell
+	}
+
+	var findings []*Finding
+	var lastPartition *time.Time
+	for _, table := range source.Tables {
+		if !isDataDatabase(table.Database) {
+			continue
+		}
+		name := table.Database + "." + table.Name
+		var latest *time.Time
+		if a.exists[name] {
+			var err error
+			if latest, err = a.latestPartition(name); err != nil {
+				return nil, err
+			}
+		}
+		if latest == nil {
+			finding := newSourceFinding(KindMissingTable, source, RemediationMissingTable)
+			finding.LogType = table.LogType
+			finding.Table = name
+			finding.Detail = fmt.Sprintf("log type %s never produced data", table.LogType)
+			findings = append(findings, finding)
+			continue
+		}
+		if lastPartition == nil || latest.After(*lastPartition) {
+			lastPartition = latest
+		}
+	}
+
+	lastData := source.LastEventReceived
+	if lastData == nil || (lastPartition != nil && lastPartition.After(*lastData)) {
+		lastData = lastPartition
+	}
+	if lastData == nil || lastData.Before(cutoff) {
+		finding := newSourceFinding(KindIdleSource, source, RemediationIdleSource)
+		finding.LastEventReceived = source.LastEventReceived
+		finding.LatestPartition = lastPartition
+		finding.Detail = "source never received data"
+		if lastData != nil {
+			finding.Detail = fmt.Sprintf("source has no data since %s", formatHour(*lastData))
+		}
+		// the idle source first, its log types cannot be fixed before it has data
+		findings = append([]*Finding{finding}, findings...)
+	}
+	return findings, nil
+}
+
+func newSourceFinding(kind string, source *sourcemap.Source, remediation string) *Finding {
+	return &Finding{
+		Kind:             kind,
+		IntegrationID:    source.IntegrationID,
+		IntegrationLabel: source.IntegrationLabel,
+		IntegrationType:  source.IntegrationType,
+		Remediation:      remediation,
+	}
+}
+
+// looks up the latest partition of a table once
+func (a *auditor) latestPartition(table string) (*time.Time, error) {
+	if latest, ok := a.latest[table]; ok {
+		return latest, nil
+	}
+	i := strings.IndexByte(table, '.')
+	database, name := table[:i], table[i+1:]
+	latest, err := sourcemap.LatestPartition(a.glue, database, name, a.now)
+	if err != nil {
+		return nil, err
+	}
+	a.latest[table] = latest
+	return latest, nil
+}
+
+// returns the tables of the data databases as database.table, in order
+func listTables(ctx context.Context, glueClient glueiface.GlueAPI) ([]string, error) {
+	var tables []string
+	for _, database := range DataDatabases {
+		input := &glue.GetTablesInput{DatabaseName: aws.String(database)}
+		err := glueClient.GetTablesPagesWithContext(ctx, input, func(page *glue.GetTablesOutput, _ bool) bool {
+			for _, table := range page.TableList {
+				if aws.StringValue(table.TableType) == "VIRTUAL_VIEW" {
+					continue
+				}
+				tables = append(tables, database+"."+aws.StringValue(table.Name))
+			}
+			return true
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list the tables of %s", database)
+		}
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
+
+func isDataDatabase(database string) bool {
+	for _, dataDatabase := range DataDatabases {
+		if database == dataDatabase {
+			return true
+		}
+	}
+	return false
+}
+
+func formatHour(tm time.Time) string {
+	return tm.UTC().Format("2006-01-02T15")
+}
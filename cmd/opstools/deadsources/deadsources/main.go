@@ -0,0 +1,84 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/deadsources"
+	"github.com/panther-labs/panther/cmd/opstools/sourcehealth"
+	"github.com/panther-labs/panther/cmd/opstools/sourcemap"
+)
+
+func main() {
+	opstools.SetUsage("reports idle sources, tables with data no source claims and log types of sources " +
+		"that never produced data, as JSON")
+	opts := struct {
+		Days   *int
+		Debug  *bool
+		Region *string
+	}{
+		Days:   flag.Int("days", 30, "Report the sources without data in this many days"),
+		Debug:  flag.Bool("debug", false, "Enable additional logging"),
+		Region: flag.String("region", "", "Set the AWS region to run on"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+
+	if *opts.Days <= 0 {
+		log.Fatal("-days must be positive")
+	}
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region: opts.Region,
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+
+	// all the sources, the tables of the others would be unclaimed
+	sources, err := sourcemap.ListSources(lambda.New(sess), &sourcehealth.Filter{}, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report, err := deadsources.Audit(context.Background(), glue.New(sess), sources, &deadsources.Config{
+		MaxIdle: time.Duration(*opts.Days) * 24 * time.Hour,
+		Now:     time.Now().UTC(),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("audited %d sources and %d tables, %d findings", report.NumSources, report.NumTables, len(report.Findings))
+
+	encoder := jsoniter.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Fatal(err)
+	}
+}
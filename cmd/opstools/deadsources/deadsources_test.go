@@ -0,0 +1,165 @@
+package deadsources
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/glue/glueiface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/cmd/opstools/sourcemap"
+	"github.com/panther-labs/panther/internal/log_analysis/awsglue"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+)
+
+var (
+	testNow     = time.Date(2020, 12, 10, 12, 30, 0, 0, time.UTC)
+	testCreated = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+type fakeGlue struct {
+	glueiface.GlueAPI
+	tables     []*glue.TableData
+	partitions map[string][]time.Time // by database.table
+}
+
+func (f *fakeGlue) GetTablesPagesWithContext(_ aws.Context, input *glue.GetTablesInput,
+	fn func(*glue.GetTablesOutput, bool) bool, _ ...request.Option) error {
+
+	page := &glue.GetTablesOutput{}
+	for _, table := range f.tables {
+		if aws.StringValue(table.DatabaseName) == aws.StringValue(input.DatabaseName) {
+			page.TableList = append(page.TableList, table)
+		}
+	}
+	fn(page, true)
+	return nil
+}
+
+// the partition expression is ignored, the latest partition is found with the first lookback
+func (f *fakeGlue) GetPartitions(input *glue.GetPartitionsInput) (*glue.GetPartitionsOutput, error) {
+	output := &glue.GetPartitionsOutput{}
+	for _, tm := range f.partitions[aws.StringValue(input.DatabaseName)+"."+aws.StringValue(input.TableName)] {
+		output.Partitions = append(output.Partitions, &glue.Partition{
+			Values: awsglue.GlueTableHourly.PartitionValuesFromTime(tm),
+		})
+	}
+	return output, nil
+}
+
+func table(database, name, tableType string) *glue.TableData {
+	return &glue.TableData{
+		DatabaseName: aws.String(database),
+		Name:         aws.String(name),
+		TableType:    aws.String(tableType),
+	}
+}
+
+func source(id string, created time.Time, lastEvent *time.Time, logTypes ...string) *sourcemap.Source {
+	integration := &models.SourceIntegration{
+		SourceIntegrationMetadata: models.SourceIntegrationMetadata{
+			IntegrationID:    id,
+			IntegrationLabel: "label-" + id,
+			IntegrationType:  models.IntegrationTypeAWS3,
+			CreatedAtTime:    created,
+			S3Bucket:         "logs-bucket",
+			S3Prefix:         id + "/",
+			LogTypes:         logTypes,
+		},
+	}
+	integration.LastEventReceived = lastEvent
+	return sourcemap.NewSource(integration)
+}
+
+func TestAudit(t *testing.T) {
+	longAgo := testNow.Add(-70 * 24 * time.Hour).Truncate(time.Hour)
+	glueClient := &fakeGlue{
+		tables: []*glue.TableData{
+			table(pantherdb.LogProcessingDatabase, "aws_cloudtrail", "EXTERNAL_TABLE"),
+			table(pantherdb.LogProcessingDatabase, "aws_s3serveraccess", "EXTERNAL_TABLE"),
+			table(pantherdb.LogProcessingDatabase, "apache_accesscombined", "EXTERNAL_TABLE"),
+			table(pantherdb.LogProcessingDatabase, "nginx_access", "EXTERNAL_TABLE"),
+			table(pantherdb.LogProcessingDatabase, "osquery_differential", "EXTERNAL_TABLE"),
+			table(pantherdb.LogProcessingDatabase, "gsuite_reports", "EXTERNAL_TABLE"),
+			table(pantherdb.LogProcessingDatabase, "all_logs", "VIRTUAL_VIEW"),
+		},
+		partitions: map[string][]time.Time{
+			"panther_logs.aws_cloudtrail":        {testNow.Add(-2 * time.Hour)},
+			"panther_logs.aws_s3serveraccess":    {longAgo},
+			"panther_logs.apache_accesscombined": {testNow.Add(-time.Hour)},
+			"panther_logs.osquery_differential":  {testNow.Add(-3 * time.Hour)},
+			"panther_logs.gsuite_reports":        {longAgo}, // a deleted source
+			"panther_logs.all_logs":              {testNow}, // views are not tables of sources
+		},
+	}
+	sources := []*sourcemap.Source{
+		source("active", testCreated, nil, "AWS.CloudTrail"),
+		source("idle", testCreated, &longAgo, "AWS.S3ServerAccess"),
+		source("wrongtype", testCreated, nil, "Apache.AccessCombined", "Nginx.Access"),
+		source("new", testNow.Add(-24*time.Hour), nil, "Juniper.Access"),
+		source("never", testCreated, nil, "Juniper.Access"),
+	}
+
+	report, err := Audit(context.Background(), glueClient, sources, &Config{
+		MaxIdle: 30 * 24 * time.Hour,
+		Now:     testNow,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 30, report.MaxIdleDays)
+	assert.Equal(t, 5, report.NumSources)
+	assert.Equal(t, 6, report.NumTables)
+
+	var kinds []string
+	for _, finding := range report.Findings {
+		kinds = append(kinds, finding.Kind+" "+finding.IntegrationID+finding.Table)
+	}
+	assert.Equal(t, []string{
+		"idle-source idle",
+		"missing-table wrongtypepanther_logs.nginx_access",
+		"idle-source never",
+		"missing-table neverpanther_logs.juniper_access",
+		"unclaimed-table panther_logs.osquery_differential",
+	}, kinds)
+
+	idle := report.Findings[0]
+	assert.Equal(t, "source has no data since 2020-10-01T12", idle.Detail)
+	assert.Equal(t, RemediationIdleSource, idle.Remediation)
+	assert.Equal(t, &longAgo, idle.LastEventReceived)
+	assert.Equal(t, &longAgo, idle.LatestPartition)
+	assert.Equal(t, "source never received data", report.Findings[2].Detail)
+	assert.Equal(t, "Nginx.Access", report.Findings[1].LogType)
+	assert.Equal(t, RemediationMissingTable, report.Findings[1].Remediation)
+	assert.Equal(t, RemediationUnclaimedTable, report.Findings[4].Remediation)
+
+	// the report is JSON with the findings as an array
+	report, err = Audit(context.Background(), &fakeGlue{}, nil, &Config{MaxIdle: time.Hour, Now: testNow})
+	require.NoError(t, err)
+	data, err := jsoniter.MarshalToString(report)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"time":"2020-12-10T12:30:00Z","maxIdleDays":0,"numSources":0,"numTables":0,"findings":[]}`, data)
+}
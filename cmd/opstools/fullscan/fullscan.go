@@ -0,0 +1,78 @@
+package fullscan
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/internal/core/source_api/apifunctions"
+)
+
+// Client is the source-api calls to trigger and follow a scan
+type Client interface {
+	TriggerScan(ctx context.Context, integrationID string) (string, error)
+	GetScanStatus(ctx context.Context, scanID string) (*models.ScanStatus, error)
+}
+
+// LambdaClient calls the source-api lambda
+type LambdaClient struct {
+	Lambda lambdaiface.LambdaAPI
+}
+
+var _ Client = (*LambdaClient)(nil)
+
+func (c *LambdaClient) TriggerScan(ctx context.Context, integrationID string) (string, error) {
+	return apifunctions.TriggerScan(ctx, c.Lambda, integrationID)
+}
+
+func (c *LambdaClient) GetScanStatus(ctx context.Context, scanID string) (*models.ScanStatus, error) {
+	return apifunctions.GetScanStatus(ctx, c.Lambda, scanID)
+}
+
+// Wait gets the status of a scan every interval until it is no longer scanning or ctx is done.
+// It calls onStatus with every status and returns the last one.
+func Wait(ctx context.Context, client Client, scanID string, interval time.Duration,
+	onStatus func(*models.ScanStatus)) (*models.ScanStatus, error) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		status, err := client.GetScanStatus(ctx, scanID)
+		if err != nil {
+			return nil, err
+		}
+		if onStatus != nil {
+			onStatus(status)
+		}
+		if status.Status != models.StatusScanning {
+			return status, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return status, errors.Wrapf(ctx.Err(), "scan %s did not complete, %d of %d resource types completed",
+				scanID, len(status.CompletedResourceTypes), len(status.ResourceTypes))
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/fullscan"
+)
+
+func main() {
+	opstools.SetUsage("triggers a full scan of a Cloud Security source and optionally waits for it to complete")
+	opts := struct {
+		IntegrationID *string
+		ScanID        *string
+		Wait          *bool
+		Timeout       *time.Duration
+		Interval      *time.Duration
+		Debug         *bool
+		Region        *string
+		MaxRetries    *int
+	}{
+		IntegrationID: flag.String("integration", "", "The ID of the aws-scan source to scan"),
+		ScanID:        flag.String("scan-id", "", "Wait for this scan instead of triggering one"),
+		Wait:          flag.Bool("wait", false, "Wait for the scan to complete and exit with status 1 if it failed"),
+		Timeout:       flag.Duration("timeout", time.Hour, "Stop waiting for the scan after this duration"),
+		Interval:      flag.Duration("interval", 30*time.Second, "Check the progress of the scan at this interval"),
+		Debug:         flag.Bool("debug", false, "Enable additional logging"),
+		Region:        flag.String("region", "", "Set the AWS region to run on"),
+		MaxRetries:    flag.Int("max-retries", 12, "Max retries for AWS requests"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+
+	if (*opts.IntegrationID == "") == (*opts.ScanID == "") {
+		flag.Usage()
+		log.Fatal("one of -integration or -scan-id must be set")
+	}
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region:     opts.Region,
+		MaxRetries: opts.MaxRetries,
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+	client := &fullscan.LambdaClient{Lambda: lambda.New(sess)}
+	ctx := context.Background()
+
+	scanID := *opts.ScanID
+	if scanID == "" {
+		// the source-api is invoked synchronously, the read-only guard only knows its mutating calls
+		if opstools.ReadOnly() {
+			log.Infof("read-only: skipped triggering a scan of source %s", *opts.IntegrationID)
+			return
+		}
+		if scanID, err = client.TriggerScan(ctx, *opts.IntegrationID); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("started scan %s of source %s", scanID, *opts.IntegrationID)
+		if !*opts.Wait {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *opts.Timeout)
+	defer cancel()
+	status, err := fullscan.Wait(ctx, client, scanID, *opts.Interval, func(status *models.ScanStatus) {
+		log.Infof("scan %s: %d of %d resource types completed, %d with errors", status.ScanID,
+			len(status.CompletedResourceTypes), len(status.ResourceTypes), len(status.Errors))
+	})
+	if status != nil {
+		encoder := jsoniter.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(status); err != nil {
+			log.Errorf("failed to write status: %s", err)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if status.Status == models.StatusError {
+		os.Exit(1)
+	}
+}
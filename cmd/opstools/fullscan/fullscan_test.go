@@ -0,0 +1,78 @@
+package fullscan
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+)
+
+// fakeClient completes a resource type every time the status is read
+type fakeClient struct {
+	resourceTypes []string
+	numCalls      int
+}
+
+func (c *fakeClient) TriggerScan(_ context.Context, _ string) (string, error) {
+	return "scan", nil
+}
+
+func (c *fakeClient) GetScanStatus(_ context.Context, scanID string) (*models.ScanStatus, error) {
+	completed := c.resourceTypes[:c.numCalls]
+	c.numCalls++
+	status := &models.ScanStatus{
+		ScanID:                 scanID,
+		Status:                 models.StatusScanning,
+		ResourceTypes:          c.resourceTypes,
+		CompletedResourceTypes: completed,
+	}
+	if len(completed) == len(c.resourceTypes) {
+		status.Status = models.StatusOK
+	}
+	return status, nil
+}
+
+func TestWait(t *testing.T) {
+	client := &fakeClient{resourceTypes: []string{"AWS.EC2.Volume", "AWS.IAM.Role"}}
+	var numStatuses int
+	status, err := Wait(context.Background(), client, "scan", time.Millisecond, func(*models.ScanStatus) {
+		numStatuses++
+	})
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusOK, status.Status)
+	assert.Equal(t, 3, numStatuses)
+}
+
+func TestWaitTimeout(t *testing.T) {
+	client := &fakeClient{resourceTypes: []string{"AWS.EC2.Volume", "AWS.IAM.Role"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	status, err := Wait(ctx, client, "scan", time.Hour, nil)
+	require.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.Equal(t, models.StatusScanning, status.Status)
+	assert.Equal(t, "scan scan did not complete, 0 of 2 resource types completed: context deadline exceeded", err.Error())
+}
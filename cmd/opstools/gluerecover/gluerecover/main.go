@@ -24,7 +24,6 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/glue"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pkg/errors"
@@ -89,7 +88,7 @@ func main() {
 		matchPrefix = pantherdb.TableName(optPrefix)
 	}
 
-	sess, err := session.NewSession(&aws.Config{
+	sess, err := opstools.NewSession(&aws.Config{
 		Region:     opts.Region,
 		MaxRetries: opts.MaxRetries,
 		HTTPClient: opstools.NewHTTPClient(*opts.MaxConnections, 0),
@@ -140,6 +139,7 @@ func main() {
 	if err := group.Wait(); err != nil {
 		log.Errorf("recover failed: %s", err)
 	}
+	opstools.LogSkipped(log)
 	log.Info("recover finished")
 }
 
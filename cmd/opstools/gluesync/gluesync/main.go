@@ -23,7 +23,6 @@ import (
 	"flag"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/glue"
 	"golang.org/x/sync/errgroup"
 
@@ -67,7 +66,7 @@ func main() {
 		matchPrefix = pantherdb.TableName(optPrefix)
 	}
 
-	sess, err := session.NewSession(&aws.Config{
+	sess, err := opstools.NewSession(&aws.Config{
 		Region:     opts.Region,
 		MaxRetries: opts.MaxRetries,
 		HTTPClient: opstools.NewHTTPClient(*opts.MaxConnections, 0),
@@ -110,5 +109,6 @@ func main() {
 	if err := group.Wait(); err != nil {
 		log.Fatalf("sync failed: %s", err)
 	}
+	opstools.LogSkipped(log)
 	log.Info("sync complete")
 }
@@ -0,0 +1,296 @@
+package gzipscan
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	pageSize        = 1000
+	checkpointEvery = 1000 // objects
+)
+
+// Failure modes of corrupt objects
+const (
+	FailureEmpty     = "empty"
+	FailureHeader    = "invalid header"
+	FailureCorrupt   = "invalid compressed data"
+	FailureTruncated = "truncated"
+	FailureChecksum  = "checksum mismatch"
+)
+
+// Result is a corrupt object, it has the fields of the lakedelete manifest so the bad keys can be deleted
+type Result struct {
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	Size    int64  `json:"size"`
+	Failure string `json:"failure"`
+	Error   string `json:"error,omitempty"`
+}
+
+type Stats struct {
+	NumScanned      uint64
+	NumBytes        uint64
+	NumFullyChecked uint64
+	NumCorrupt      uint64
+}
+
+// Reporter receives the results of a scan, it is called by one go routine at a time
+type Reporter interface {
+	// Corrupt is called for each corrupt object
+	Corrupt(result *Result) error
+	// Checkpoint is called periodically with the last key such that it and all keys before it are scanned,
+	// a scan resumed after it with Input.StartAfter does not miss any object
+	Checkpoint(startAfter string, stats *Stats) error
+}
+
+type Input struct {
+	Bucket string
+	Prefix string
+	// Suffix selects the keys to check (e.g. ".gz"), empty selects all keys
+	Suffix string
+	// StartAfter resumes a scan after a checkpoint
+	StartAfter string
+	// Concurrency is the number of objects checked concurrently
+	Concurrency int
+	// MaxFullSize is the max size of objects that are fully decompressed,
+	// only the first HeadBytes of larger objects are checked
+	MaxFullSize int64
+	HeadBytes   int64
+}
+
+type object struct {
+	seq  uint64
+	key  string
+	size int64
+}
+
+type checked struct {
+	object *object
+	result *Result // nil if not corrupt
+	full   bool
+}
+
+// Scan lists the objects under a prefix and checks their gzip integrity
+func Scan(ctx context.Context, s3Client s3iface.S3API, input *Input, reporter Reporter, stats *Stats) error {
+	if input.Concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	if input.HeadBytes < 1 {
+		return errors.New("head bytes must be at least 1")
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+	objects := make(chan *object, input.Concurrency)
+	results := make(chan *checked, input.Concurrency)
+
+	group.Go(func() error {
+		defer close(objects)
+		return listObjects(ctx, s3Client, input, objects)
+	})
+
+	workers, workersCtx := errgroup.WithContext(ctx)
+	for i := 0; i < input.Concurrency; i++ {
+		workers.Go(func() error {
+			for obj := range objects {
+				failure, detail, full, err := checkObject(workersCtx, s3Client, input, obj)
+				if err != nil {
+					return err
+				}
+				result := &checked{object: obj, full: full}
+				if failure != "" {
+					result.result = &Result{
+						Bucket:  input.Bucket,
+						Key:     obj.key,
+						Size:    obj.size,
+						Failure: failure,
+					}
+					if detail != nil {
+						result.result.Error = detail.Error()
+					}
+				}
+				select {
+				case results <- result:
+				case <-workersCtx.Done():
+					return workersCtx.Err()
+				}
+			}
+			return nil
+		})
+	}
+	group.Go(func() error {
+		defer close(results)
+		return workers.Wait()
+	})
+
+	group.Go(func() error {
+		return collect(results, reporter, stats)
+	})
+
+	return group.Wait()
+}
+
+func listObjects(ctx context.Context, s3Client s3iface.S3API, input *Input, objects chan<- *object) error {
+	listInput := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(input.Bucket),
+		Prefix:  aws.String(input.Prefix),
+		MaxKeys: aws.Int64(pageSize),
+	}
+	if input.StartAfter != "" {
+		listInput.StartAfter = aws.String(input.StartAfter)
+	}
+	var seq uint64
+	var sendErr error
+	err := s3Client.ListObjectsV2PagesWithContext(ctx, listInput, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, value := range page.Contents {
+			key := aws.StringValue(value.Key)
+			if !strings.HasSuffix(key, input.Suffix) {
+				continue
+			}
+			select {
+			case objects <- &object{seq: seq, key: key, size: aws.Int64Value(value.Size)}:
+				seq++
+			case <-ctx.Done():
+				sendErr = ctx.Err()
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to list s3://%s/%s", input.Bucket, input.Prefix)
+	}
+	return sendErr
+}
+
+// collect reports the results and checkpoints the last key of the listing order all objects up to are checked
+func collect(results <-chan *checked, reporter Reporter, stats *Stats) error {
+	var next uint64 // seq of the next object in listing order not yet checked
+	var lastKey string
+	done := make(map[uint64]string)
+	for result := range results {
+		stats.NumScanned++
+		stats.NumBytes += uint64(result.object.size)
+		if result.full {
+			stats.NumFullyChecked++
+		}
+		if result.result != nil {
+			stats.NumCorrupt++
+			if err := reporter.Corrupt(result.result); err != nil {
+				return err
+			}
+		}
+
+		done[result.object.seq] = result.object.key
+		for key, found := done[next]; found; key, found = done[next] {
+			delete(done, next)
+			lastKey = key
+			next++
+		}
+		if stats.NumScanned%checkpointEvery == 0 && lastKey != "" {
+			if err := reporter.Checkpoint(lastKey, stats); err != nil {
+				return err
+			}
+		}
+	}
+	if lastKey == "" {
+		return nil
+	}
+	return reporter.Checkpoint(lastKey, stats)
+}
+
+func checkObject(ctx context.Context, s3Client s3iface.S3API, input *Input, obj *object) (failure string, detail error,
+	full bool, err error) {
+
+	if obj.size == 0 {
+		return FailureEmpty, nil, true, nil
+	}
+	getInput := &s3.GetObjectInput{
+		Bucket: aws.String(input.Bucket),
+		Key:    aws.String(obj.key),
+	}
+	full = obj.size <= input.MaxFullSize
+	if !full {
+		getInput.Range = aws.String(fmt.Sprintf("bytes=0-%d", input.HeadBytes-1))
+	}
+	output, err := s3Client.GetObjectWithContext(ctx, getInput)
+	if err != nil {
+		return "", nil, false, errors.Wrapf(err, "failed to get s3://%s/%s", input.Bucket, obj.key)
+	}
+	defer output.Body.Close()
+	failure, detail, err = CheckGzip(output.Body, full)
+	if err != nil {
+		return "", nil, false, errors.Wrapf(err, "failed to read s3://%s/%s", input.Bucket, obj.key)
+	}
+	return failure, detail, full, nil
+}
+
+// CheckGzip reads a gzip stream and returns the failure mode if it is corrupt.
+// If full is false the stream is the head of an object and ending before the trailer is not a failure.
+// Errors reading the stream are returned as err, they are not corruption.
+func CheckGzip(r io.Reader, full bool) (failure string, detail, err error) {
+	reader, err := gzip.NewReader(r)
+	switch {
+	case err == nil:
+	case err == io.EOF:
+		return FailureEmpty, nil, nil
+	case err == io.ErrUnexpectedEOF:
+		if !full { // head too short for the header, cannot tell
+			return "", nil, nil
+		}
+		return FailureTruncated, err, nil
+	case err == gzip.ErrHeader:
+		return FailureHeader, err, nil
+	default:
+		return "", nil, err
+	}
+
+	_, err = io.Copy(ioutil.Discard, reader)
+	var corruptErr flate.CorruptInputError
+	switch {
+	case err == nil:
+		return "", nil, nil
+	case err == io.ErrUnexpectedEOF:
+		if !full {
+			return "", nil, nil
+		}
+		return FailureTruncated, err, nil
+	case err == gzip.ErrChecksum:
+		return FailureChecksum, err, nil
+	case err == gzip.ErrHeader: // a following member has a bad header
+		return FailureHeader, err, nil
+	case errors.As(err, &corruptErr):
+		return FailureCorrupt, err, nil
+	default:
+		return "", nil, err
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/gzipscan"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+// checkpoint is the state of a scan saved to resume it
+type checkpoint struct {
+	S3Path     string         `json:"s3path"`
+	StartAfter string         `json:"startAfter"`
+	Stats      gzipscan.Stats `json:"stats"`
+}
+
+// fileReporter appends corrupt objects to the manifest and saves checkpoints to a file
+type fileReporter struct {
+	s3path     string
+	manifest   *os.File
+	encoder    *jsoniter.Encoder
+	checkpoint string
+}
+
+func (r *fileReporter) Corrupt(result *gzipscan.Result) error {
+	return errors.Wrap(r.encoder.Encode(result), "failed to write manifest")
+}
+
+func (r *fileReporter) Checkpoint(startAfter string, stats *gzipscan.Stats) error {
+	// the manifest must have the corrupt objects before the checkpoint skips them on resume
+	if err := r.manifest.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync manifest")
+	}
+	if r.checkpoint == "" {
+		return nil
+	}
+	data, err := jsoniter.Marshal(&checkpoint{
+		S3Path:     r.s3path,
+		StartAfter: startAfter,
+		Stats:      *stats,
+	})
+	if err != nil {
+		return err
+	}
+	// write and rename so an interrupted write does not lose the previous checkpoint
+	tmp := r.checkpoint + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrapf(err, "failed to write %s", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, r.checkpoint), "failed to write %s", r.checkpoint)
+}
+
+func main() {
+	opstools.SetUsage("checks the gzip integrity of s3 objects and writes a manifest of the corrupt ones")
+	opts := struct {
+		S3Path         *string
+		Suffix         *string
+		Concurrency    *int
+		MaxFullSizeMB  *int64
+		HeadBytes      *int64
+		Checkpoint     *string
+		Manifest       *string
+		Debug          *bool
+		Region         *string
+		MaxRetries     *int
+		MaxConnections *int
+	}{
+		S3Path:        flag.String("s3path", "", "The s3 path to scan (e.g., s3://<bucket>/<prefix>)"),
+		Suffix:        flag.String("suffix", ".gz", "Only check keys with this suffix"),
+		Concurrency:   flag.Int("concurrency", 16, "The number of objects checked concurrently"),
+		MaxFullSizeMB: flag.Int64("max-full-size", 64, "Objects up to this size in MB are fully decompressed"),
+		HeadBytes:     flag.Int64("head-bytes", 64*1024, "The number of bytes checked of larger objects"),
+		Checkpoint: flag.String("checkpoint", "",
+			"If set, the progress is saved to this file and a scan of the same path resumes from it"),
+		Manifest:       flag.String("manifest", "", "The file to append the corrupt objects to as JSON lines"),
+		Debug:          flag.Bool("debug", false, "Enable additional logging"),
+		Region:         flag.String("region", "", "Set the AWS region of the bucket"),
+		MaxRetries:     flag.Int("max-retries", 12, "Max retries for AWS requests"),
+		MaxConnections: flag.Int("max-connections", 100, "Max number of connections to AWS"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+
+	if *opts.S3Path == "" || *opts.Manifest == "" {
+		flag.Usage()
+		log.Fatal("-s3path and -manifest must be set")
+	}
+	parsedPath, err := s3path.Parse(*opts.S3Path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	input := &gzipscan.Input{
+		Bucket:      parsedPath.Bucket,
+		Prefix:      parsedPath.Key,
+		Suffix:      *opts.Suffix,
+		Concurrency: *opts.Concurrency,
+		MaxFullSize: *opts.MaxFullSizeMB * 1024 * 1024,
+		HeadBytes:   *opts.HeadBytes,
+	}
+
+	stats := &gzipscan.Stats{}
+	if *opts.Checkpoint != "" {
+		data, err := ioutil.ReadFile(*opts.Checkpoint)
+		switch {
+		case os.IsNotExist(err): // new scan
+		case err != nil:
+			log.Fatal(err)
+		default:
+			var saved checkpoint
+			if err := jsoniter.Unmarshal(data, &saved); err != nil {
+				log.Fatalf("failed to parse %s: %s", *opts.Checkpoint, err)
+			}
+			if saved.S3Path != *opts.S3Path {
+				log.Fatalf("checkpoint %s is for %s", *opts.Checkpoint, saved.S3Path)
+			}
+			input.StartAfter = saved.StartAfter
+			*stats = saved.Stats
+			log.Infof("resuming after %s", saved.StartAfter)
+		}
+	}
+
+	// appending keeps the corrupt objects found before a checkpoint
+	manifest, err := os.OpenFile(*opts.Manifest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer manifest.Close()
+	reporter := &fileReporter{
+		s3path:     *opts.S3Path,
+		manifest:   manifest,
+		encoder:    jsoniter.NewEncoder(manifest),
+		checkpoint: *opts.Checkpoint,
+	}
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region:     opts.Region,
+		MaxRetries: opts.MaxRetries,
+		HTTPClient: opstools.NewHTTPClient(*opts.MaxConnections, 0),
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+
+	startTime := time.Now()
+	err = gzipscan.Scan(context.Background(), s3.New(sess), input, reporter, stats)
+	log.Infof("scanned %d objects (%.2fMB, %d fully decompressed), found %d corrupt in %v",
+		stats.NumScanned, float32(stats.NumBytes)/(1024.0*1024.0), stats.NumFullyChecked, stats.NumCorrupt,
+		time.Since(startTime))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
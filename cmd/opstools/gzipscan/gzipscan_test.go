@@ -0,0 +1,169 @@
+package gzipscan
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+func gzipData(t *testing.T, data string) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	_, err := w.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return b.Bytes()
+}
+
+func TestCheckGzip(t *testing.T) {
+	valid := gzipData(t, `{"foo":"bar"}`)
+	badChecksum := append([]byte{}, valid...)
+	badChecksum[len(badChecksum)-5] ^= 0xff
+
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		full    bool
+		failure string
+	}{
+		{"valid", valid, true, ""},
+		{"empty", nil, true, FailureEmpty},
+		{"not gzip", []byte(`{"foo":"bar"}`), true, FailureHeader},
+		{"truncated", valid[:len(valid)-4], true, FailureTruncated},
+		{"truncated header", valid[:4], true, FailureTruncated},
+		{"checksum", badChecksum, true, FailureChecksum},
+		{"head of valid", valid[:len(valid)-4], false, ""},
+		{"short head", valid[:4], false, ""},
+		{"head not gzip", []byte(`{"foo":"bar"}`), false, FailureHeader},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			failure, _, err := CheckGzip(bytes.NewReader(tc.data), tc.full)
+			require.NoError(t, err)
+			assert.Equal(t, tc.failure, failure)
+		})
+	}
+}
+
+type testReporter struct {
+	corrupt    []*Result
+	startAfter string
+}
+
+func (r *testReporter) Corrupt(result *Result) error {
+	r.corrupt = append(r.corrupt, result)
+	return nil
+}
+
+func (r *testReporter) Checkpoint(startAfter string, _ *Stats) error {
+	r.startAfter = startAfter
+	return nil
+}
+
+func TestScan(t *testing.T) {
+	valid := gzipData(t, `{"foo":"bar"}`)
+	objects := map[string][]byte{
+		"prefix/a.json.gz": valid,
+		"prefix/b.json.gz": valid[:len(valid)-4],
+		"prefix/c.json.gz": valid, // larger than the max full size, only the head is checked
+		"prefix/d.json":    []byte("not checked"),
+	}
+	s3Client := &testutils.S3Mock{}
+	s3Client.On("ListObjectsV2PagesWithContext", mock.Anything, &s3.ListObjectsV2Input{
+		Bucket:     aws.String("bucket"),
+		Prefix:     aws.String("prefix/"),
+		StartAfter: aws.String("prefix/0"),
+		MaxKeys:    aws.Int64(pageSize),
+	}, mock.Anything, mock.Anything).Return(&s3.ListObjectsV2Output{
+		Contents: []*s3.Object{
+			{Key: aws.String("prefix/a.json.gz"), Size: aws.Int64(int64(len(valid)))},
+			{Key: aws.String("prefix/b.json.gz"), Size: aws.Int64(int64(len(valid) - 4))},
+			{Key: aws.String("prefix/c.json.gz"), Size: aws.Int64(1000)},
+			{Key: aws.String("prefix/d.json"), Size: aws.Int64(11)},
+			{Key: aws.String("prefix/e.json.gz"), Size: aws.Int64(0)},
+		},
+	}, nil).Once()
+	for _, key := range []string{"prefix/a.json.gz", "prefix/b.json.gz"} {
+		s3Client.On("GetObjectWithContext", mock.Anything, &s3.GetObjectInput{
+			Bucket: aws.String("bucket"),
+			Key:    aws.String(key),
+		}, mock.Anything).Return(&s3.GetObjectOutput{
+			Body: ioutil.NopCloser(bytes.NewReader(objects[key])),
+		}, nil).Once()
+	}
+	s3Client.On("GetObjectWithContext", mock.Anything, &s3.GetObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("prefix/c.json.gz"),
+		Range:  aws.String("bytes=0-9"),
+	}, mock.Anything).Return(&s3.GetObjectOutput{
+		Body: ioutil.NopCloser(bytes.NewReader(valid[:10])),
+	}, nil).Once()
+
+	reporter := &testReporter{}
+	stats := &Stats{}
+	err := Scan(context.Background(), s3Client, &Input{
+		Bucket:      "bucket",
+		Prefix:      "prefix/",
+		Suffix:      ".gz",
+		StartAfter:  "prefix/0",
+		Concurrency: 2,
+		MaxFullSize: 100,
+		HeadBytes:   10,
+	}, reporter, stats)
+	require.NoError(t, err)
+	s3Client.AssertExpectations(t)
+
+	assert.Equal(t, &Stats{
+		NumScanned:      4,
+		NumBytes:        uint64(2*len(valid) - 4 + 1000),
+		NumFullyChecked: 3,
+		NumCorrupt:      2,
+	}, stats)
+	sort.Slice(reporter.corrupt, func(i, j int) bool { return reporter.corrupt[i].Key < reporter.corrupt[j].Key })
+	require.Len(t, reporter.corrupt, 2)
+	assert.Equal(t, "prefix/b.json.gz", reporter.corrupt[0].Key)
+	assert.Equal(t, FailureTruncated, reporter.corrupt[0].Failure)
+	assert.Equal(t, "prefix/e.json.gz", reporter.corrupt[1].Key)
+	assert.Equal(t, FailureEmpty, reporter.corrupt[1].Failure)
+	assert.Equal(t, "prefix/e.json.gz", reporter.startAfter)
+}
+
+func TestCollectCheckpointsInListingOrder(t *testing.T) {
+	results := make(chan *checked, 3)
+	// checked out of order, the second object is last
+	results <- &checked{object: &object{seq: 0, key: "a"}}
+	results <- &checked{object: &object{seq: 2, key: "c"}}
+	close(results)
+	reporter := &testReporter{}
+	require.NoError(t, collect(results, reporter, &Stats{}))
+	assert.Equal(t, "a", reporter.startAfter) // "b" is not checked, "c" must not be skipped on resume
+}
@@ -0,0 +1,353 @@
+package lakedelete
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/glue/glueiface"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/internal/log_analysis/awsglue"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+	"github.com/panther-labs/panther/pkg/genericapi"
+)
+
+const (
+	sourceAPIFunctionName = "panther-source-api"
+
+	deleteBatchSize = 1000 // max keys per DeleteObjects request
+)
+
+// Table is a table in the data lake
+type Table struct {
+	Database string `json:"database"`
+	Name     string `json:"name"`
+}
+
+// LogTypeTables returns the tables holding the data of a log type, including rule matches and errors
+func LogTypeTables(logType string) (tables []Table) {
+	for _, database := range []string{
+		pantherdb.LogProcessingDatabase,
+		pantherdb.RuleMatchDatabase,
+		pantherdb.RuleErrorsDatabase,
+		pantherdb.CloudSecurityDatabase,
+	} {
+		if pantherdb.IsInDatabase(logType, database) {
+			tables = append(tables, Table{
+				Database: database,
+				Name:     pantherdb.TableName(logType),
+			})
+		}
+	}
+	return tables
+}
+
+// ListIntegrations lists all integrations with the source api
+func ListIntegrations(lambdaClient lambdaiface.LambdaAPI) ([]*models.SourceIntegration, error) {
+	input := &models.LambdaInput{
+		ListIntegrations: &models.ListIntegrationsInput{},
+	}
+	var output []*models.SourceIntegration
+	if err := genericapi.Invoke(lambdaClient, sourceAPIFunctionName, input, &output); err != nil {
+		return nil, errors.Wrap(err, "failed to list integrations")
+	}
+	return output, nil
+}
+
+// IntegrationLogTypes returns the log types of an integration and the other integrations sharing any of them.
+// Processed data are not partitioned by source, deleting the data of a shared log type also deletes
+// the data the other integrations have written to the same partitions.
+func IntegrationLogTypes(integrations []*models.SourceIntegration, integrationID string) (logTypes, sharedWith []string,
+	err error) {
+
+	var integration *models.SourceIntegration
+	for _, candidate := range integrations {
+		if candidate.IntegrationID == integrationID {
+			integration = candidate
+			break
+		}
+	}
+	if integration == nil {
+		return nil, nil, errors.Errorf("integration %s not found", integrationID)
+	}
+	logTypes = integration.RequiredLogTypes()
+
+	for _, other := range integrations {
+		if other == integration {
+			continue
+		}
+		for _, logType := range other.RequiredLogTypes() {
+			if contains(logTypes, logType) {
+				sharedWith = append(sharedWith, fmt.Sprintf("%s (%s)", other.IntegrationLabel, other.IntegrationID))
+				break
+			}
+		}
+	}
+	return logTypes, sharedWith, nil
+}
+
+// Plan is the result of a dry run, the deletion must match it
+type Plan struct {
+	Bucket     string    `json:"bucket"`
+	Tables     []Table   `json:"tables"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	NumObjects uint64    `json:"numObjects"`
+	NumBytes   uint64    `json:"numBytes"`
+}
+
+// Object is an object to delete
+type Object struct {
+	Table Table     `json:"table"`
+	Hour  time.Time `json:"hour"`
+	Key   string    `json:"key"`
+	Size  int64     `json:"size"`
+}
+
+// ListObjects lists the objects of the hourly partitions of the tables in [start, end)
+func ListObjects(ctx context.Context, s3Client s3iface.S3API, bucket string, tables []Table,
+	start, end time.Time) (*Plan, []*Object, error) {
+
+	start, end = start.UTC().Truncate(time.Hour), end.UTC().Truncate(time.Hour)
+	if !start.Before(end) {
+		return nil, nil, errors.Errorf("start %s must be before end %s", start, end)
+	}
+	plan := &Plan{
+		Bucket: bucket,
+		Tables: tables,
+		Start:  start,
+		End:    end,
+	}
+	var objects []*Object
+	for _, table := range tables {
+		for hour := start; hour.Before(end); hour = hour.Add(time.Hour) {
+			prefix := awsglue.PartitionPrefix(table.Database, table.Name, awsglue.GlueTableHourly, hour)
+			input := &s3.ListObjectsV2Input{
+				Bucket: aws.String(bucket),
+				Prefix: aws.String(prefix),
+			}
+			err := s3Client.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+				for _, value := range page.Contents {
+					objects = append(objects, &Object{
+						Table: table,
+						Hour:  hour,
+						Key:   aws.StringValue(value.Key),
+						Size:  aws.Int64Value(value.Size),
+					})
+					plan.NumObjects++
+					plan.NumBytes += uint64(aws.Int64Value(value.Size))
+				}
+				return true
+			})
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "failed to list s3://%s/%s", bucket, prefix)
+			}
+		}
+	}
+	return plan, objects, nil
+}
+
+// CheckPlan returns an error if a listing differs from the plan of the dry run
+func CheckPlan(dryRun, listed *Plan) error {
+	if dryRun.Bucket != listed.Bucket || !dryRun.Start.Equal(listed.Start) || !dryRun.End.Equal(listed.End) {
+		return errors.Errorf("plan is for s3://%s from %s to %s", dryRun.Bucket, dryRun.Start, dryRun.End)
+	}
+	if !equalTables(dryRun.Tables, listed.Tables) {
+		return errors.Errorf("plan is for tables %v", dryRun.Tables)
+	}
+	if dryRun.NumObjects != listed.NumObjects || dryRun.NumBytes != listed.NumBytes {
+		return errors.Errorf("plan has %d objects (%d bytes) but %d objects (%d bytes) are listed, do a new dry run",
+			dryRun.NumObjects, dryRun.NumBytes, listed.NumObjects, listed.NumBytes)
+	}
+	return nil
+}
+
+// ManifestEntry is a line of the manifest of deleted objects
+type ManifestEntry struct {
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+type Stats struct {
+	NumDeletedObjects    uint64
+	NumDeletedBytes      uint64
+	NumDeletedPartitions uint64
+}
+
+// Delete deletes the objects in batches, writing a manifest line for each deleted object,
+// then deletes the Glue partitions left without objects.
+func Delete(ctx context.Context, s3Client s3iface.S3API, glueClient glueiface.GlueAPI, bucket string,
+	objects []*Object, manifest io.Writer, stats *Stats) error {
+
+	encoder := jsoniter.NewEncoder(manifest)
+	var failed error
+	for i := 0; i < len(objects); i += deleteBatchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch := objects[i:min(i+deleteBatchSize, len(objects))]
+		sizes := make(map[string]int64, len(batch))
+		input := &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{
+				Quiet: aws.Bool(false), // we need the deleted keys for the manifest
+			},
+		}
+		for _, object := range batch {
+			sizes[object.Key] = object.Size
+			input.Delete.Objects = append(input.Delete.Objects, &s3.ObjectIdentifier{Key: aws.String(object.Key)})
+		}
+		output, err := s3Client.DeleteObjects(input)
+		if err != nil {
+			return multierr.Append(failed, errors.Wrapf(err, "failed to delete objects in s3://%s", bucket))
+		}
+		for _, deleted := range output.Deleted {
+			key := aws.StringValue(deleted.Key)
+			entry := &ManifestEntry{
+				Bucket:    bucket,
+				Key:       key,
+				Size:      sizes[key],
+				DeletedAt: time.Now().UTC(),
+			}
+			if err := encoder.Encode(entry); err != nil {
+				return multierr.Append(failed, errors.Wrap(err, "failed to write manifest"))
+			}
+			stats.NumDeletedObjects++
+			stats.NumDeletedBytes += uint64(entry.Size)
+		}
+		for _, deleteError := range output.Errors {
+			failed = multierr.Append(failed, errors.Errorf("failed to delete s3://%s/%s: %s",
+				bucket, aws.StringValue(deleteError.Key), aws.StringValue(deleteError.Message)))
+		}
+	}
+
+	for _, partition := range partitions(objects) {
+		if err := deleteEmptyPartition(ctx, s3Client, glueClient, bucket, partition, stats); err != nil {
+			failed = multierr.Append(failed, err)
+		}
+	}
+	return failed
+}
+
+type partition struct {
+	table Table
+	hour  time.Time
+}
+
+func partitions(objects []*Object) []partition {
+	seen := make(map[partition]struct{})
+	var result []partition
+	for _, object := range objects {
+		p := partition{table: object.Table, hour: object.Hour}
+		if _, found := seen[p]; !found {
+			seen[p] = struct{}{}
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func deleteEmptyPartition(ctx context.Context, s3Client s3iface.S3API, glueClient glueiface.GlueAPI, bucket string,
+	p partition, stats *Stats) error {
+
+	prefix := awsglue.PartitionPrefix(p.table.Database, p.table.Name, awsglue.GlueTableHourly, p.hour)
+	empty := true
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(1),
+	}
+	err := s3Client.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		empty = len(page.Contents) == 0
+		return false
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to list s3://%s/%s", bucket, prefix)
+	}
+	if !empty { // objects were written since listing, keep the partition
+		return nil
+	}
+	_, err = awsglue.DeletePartition(glueClient, p.table.Database, p.table.Name,
+		awsglue.GlueTableHourly.PartitionValuesFromTime(p.hour))
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == glue.ErrCodeEntityNotFoundException {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to delete partition %s of %s.%s", p.hour.Format(time.RFC3339),
+			p.table.Database, p.table.Name)
+	}
+	stats.NumDeletedPartitions++
+	return nil
+}
+
+func equalTables(a, b []Table) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sorted := func(tables []Table) []Table {
+		tables = append([]Table(nil), tables...)
+		sort.Slice(tables, func(i, j int) bool {
+			if tables[i].Database != tables[j].Database {
+				return tables[i].Database < tables[j].Database
+			}
+			return tables[i].Name < tables[j].Name
+		})
+		return tables
+	}
+	a, b = sorted(a), sorted(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,236 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/lakedelete"
+	"github.com/panther-labs/panther/pkg/prompt"
+)
+
+func main() {
+	opstools.SetUsage(`deletes the data lake objects of a source or tables in a time range.
+A dry run is always required first, it writes a plan file that must be passed to the deletion with -execute`)
+	opts := struct {
+		Bucket        *string
+		IntegrationID *string
+		Tables        *string
+		AllowShared   *bool
+		Start         *string
+		End           *string
+		Plan          *string
+		Execute       *bool
+		Manifest      *string
+		Debug         *bool
+		Region        *string
+	}{
+		Bucket:        flag.String("bucket", "", "The processed data bucket"),
+		IntegrationID: flag.String("integration-id", "", "Delete the data of the log types of this integration"),
+		Tables:        flag.String("tables", "", "Comma separated list of <database>.<table> to delete the data of"),
+		AllowShared: flag.Bool("allow-shared", false,
+			"Allow deleting the data of log types shared with other integrations, their data in the time range is deleted too"),
+		Start:    flag.String("start", "", "Delete data from this time (YYYY-MM-DD or RFC3339, UTC)"),
+		End:      flag.String("end", "", "Delete data until this time (exclusive, YYYY-MM-DD or RFC3339, UTC)"),
+		Plan:     flag.String("plan", "", "The plan file, written by the dry run and read by the deletion"),
+		Execute:  flag.Bool("execute", false, "Delete the objects of the plan written by a previous dry run"),
+		Manifest: flag.String("manifest", "", "The file to write the deleted objects to for audit (must not exist)"),
+		Debug:    flag.Bool("debug", false, "Enable additional logging"),
+		Region:   flag.String("region", "", "Set the AWS region to run on"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+
+	if *opts.Plan == "" {
+		flag.Usage()
+		log.Fatal("-plan not set")
+	}
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region: opts.Region,
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+	ctx := context.Background()
+	s3Client := s3.New(sess)
+
+	if !*opts.Execute {
+		plan := dryRun(ctx, log, sess, s3Client, opts.Bucket, opts.IntegrationID, opts.Tables, opts.AllowShared,
+			opts.Start, opts.End)
+		if err := writeJSONFile(*opts.Plan, plan); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("dry run found %d objects (%.2fMB), wrote plan to %s, run again with -execute to delete them",
+			plan.NumObjects, float32(plan.NumBytes)/(1024.0*1024.0), *opts.Plan)
+		return
+	}
+
+	if *opts.Manifest == "" {
+		flag.Usage()
+		log.Fatal("-manifest not set")
+	}
+	plan := &lakedelete.Plan{}
+	if err := readJSONFile(*opts.Plan, plan); err != nil {
+		log.Fatal(err)
+	}
+	listed, objects, err := lakedelete.ListObjects(ctx, s3Client, plan.Bucket, plan.Tables, plan.Start, plan.End)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := lakedelete.CheckPlan(plan, listed); err != nil {
+		log.Fatal(err)
+	}
+	if listed.NumObjects == 0 {
+		log.Info("nothing to delete")
+		return
+	}
+
+	confirmation := prompt.Read("Type the number of objects to delete to confirm: ")
+	if confirmation != strconv.FormatUint(listed.NumObjects, 10) {
+		log.Fatalf("confirmation %q does not match %d objects, nothing deleted", confirmation, listed.NumObjects)
+	}
+
+	// never overwrite the manifest of a previous deletion
+	manifest, err := os.OpenFile(*opts.Manifest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	run := opstools.StartRun(sess, log)
+	startTime := time.Now()
+	stats := &lakedelete.Stats{}
+	err = lakedelete.Delete(ctx, s3Client, glue.New(sess), plan.Bucket, objects, manifest, stats)
+	opstools.EndRun(run, log, stats, err)
+	if closeErr := manifest.Close(); closeErr != nil {
+		log.Error(closeErr)
+	}
+	log.Infof("deleted %d objects (%.2fMB) and %d partitions in %v, manifest is %s",
+		stats.NumDeletedObjects, float32(stats.NumDeletedBytes)/(1024.0*1024.0), stats.NumDeletedPartitions,
+		time.Since(startTime), *opts.Manifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func dryRun(ctx context.Context, log *zap.SugaredLogger, sess *session.Session, s3Client *s3.S3,
+	bucket, integrationID, tableNames *string, allowShared *bool, start, end *string) *lakedelete.Plan {
+
+	if *bucket == "" {
+		flag.Usage()
+		log.Fatal("-bucket not set")
+	}
+	if (*integrationID == "") == (*tableNames == "") {
+		flag.Usage()
+		log.Fatal("exactly one of -integration-id or -tables must be set")
+	}
+	startTime, err := parseTime(*start)
+	if err != nil {
+		log.Fatalf("-start: %s", err)
+	}
+	endTime, err := parseTime(*end)
+	if err != nil {
+		log.Fatalf("-end: %s", err)
+	}
+
+	var tables []lakedelete.Table
+	if *integrationID != "" {
+		integrations, err := lakedelete.ListIntegrations(lambda.New(sess))
+		if err != nil {
+			log.Fatal(err)
+		}
+		logTypes, sharedWith, err := lakedelete.IntegrationLogTypes(integrations, *integrationID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(sharedWith) > 0 {
+			if !*allowShared {
+				log.Fatalf("log types of %s are shared with %s, set -allow-shared to delete their data too",
+					*integrationID, strings.Join(sharedWith, ", "))
+			}
+			log.Warnf("deleting the data of %s too", strings.Join(sharedWith, ", "))
+		}
+		for _, logType := range logTypes {
+			tables = append(tables, lakedelete.LogTypeTables(logType)...)
+		}
+	} else {
+		for _, tableName := range strings.Split(*tableNames, ",") {
+			parts := strings.Split(strings.TrimSpace(tableName), ".")
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				log.Fatalf("table %q is not <database>.<table>", tableName)
+			}
+			tables = append(tables, lakedelete.Table{Database: parts[0], Name: parts[1]})
+		}
+	}
+
+	plan, objects, err := lakedelete.ListObjects(ctx, s3Client, *bucket, tables, startTime, endTime)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, object := range objects {
+		log.Debugf("would delete s3://%s/%s", plan.Bucket, object.Key)
+	}
+	return plan
+}
+
+func parseTime(input string) (time.Time, error) {
+	if input == "" {
+		return time.Time{}, errors.New("not set")
+	}
+	if tm, err := time.Parse(time.RFC3339, input); err == nil {
+		return tm, nil
+	}
+	tm, err := time.Parse("2006-01-02", input)
+	if err != nil {
+		return time.Time{}, errors.Errorf("failed to parse %q as YYYY-MM-DD or RFC3339", input)
+	}
+	return tm, nil
+}
+
+func writeJSONFile(path string, value interface{}) error {
+	data, err := jsoniter.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(ioutil.WriteFile(path, data, 0600), "failed to write %s", path)
+}
+
+func readJSONFile(path string, value interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", path)
+	}
+	return errors.Wrapf(jsoniter.Unmarshal(data, value), "failed to parse %s", path)
+}
@@ -0,0 +1,173 @@
+package lakedelete
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/s3"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+var (
+	testStart = time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	testTable = Table{Database: pantherdb.LogProcessingDatabase, Name: "aws_cloudtrail"}
+)
+
+func listInput(prefix string) interface{} {
+	return mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return aws.StringValue(input.Prefix) == prefix
+	})
+}
+
+func TestLogTypeTables(t *testing.T) {
+	assert.Equal(t, []Table{
+		{Database: pantherdb.LogProcessingDatabase, Name: "aws_cloudtrail"},
+		{Database: pantherdb.RuleMatchDatabase, Name: "aws_cloudtrail"},
+		{Database: pantherdb.RuleErrorsDatabase, Name: "aws_cloudtrail"},
+	}, LogTypeTables("AWS.CloudTrail"))
+}
+
+func TestIntegrationLogTypes(t *testing.T) {
+	newIntegration := func(id string, logTypes ...string) *models.SourceIntegration {
+		integration := &models.SourceIntegration{}
+		integration.IntegrationID = id
+		integration.IntegrationLabel = "label-" + id
+		integration.IntegrationType = models.IntegrationTypeAWS3
+		integration.LogTypes = logTypes
+		return integration
+	}
+	integrations := []*models.SourceIntegration{
+		newIntegration("a", "AWS.CloudTrail", "AWS.S3ServerAccess"),
+		newIntegration("b", "AWS.VPCFlow"),
+		newIntegration("c", "AWS.S3ServerAccess"),
+	}
+
+	logTypes, sharedWith, err := IntegrationLogTypes(integrations, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AWS.CloudTrail", "AWS.S3ServerAccess"}, logTypes)
+	assert.Equal(t, []string{"label-c (c)"}, sharedWith)
+
+	logTypes, sharedWith, err = IntegrationLogTypes(integrations, "b")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AWS.VPCFlow"}, logTypes)
+	assert.Empty(t, sharedWith)
+
+	_, _, err = IntegrationLogTypes(integrations, "d")
+	assert.Error(t, err)
+}
+
+func TestListObjectsAndCheckPlan(t *testing.T) {
+	s3Client := &testutils.S3Mock{}
+	s3Client.On("ListObjectsV2PagesWithContext", mock.Anything,
+		listInput("logs/aws_cloudtrail/year=2020/month=11/day=01/hour=00/"), mock.Anything, mock.Anything).
+		Return(&s3.ListObjectsV2Output{
+			Contents: []*s3.Object{
+				{Key: aws.String("logs/aws_cloudtrail/year=2020/month=11/day=01/hour=00/a.json.gz"), Size: aws.Int64(10)},
+				{Key: aws.String("logs/aws_cloudtrail/year=2020/month=11/day=01/hour=00/b.json.gz"), Size: aws.Int64(20)},
+			},
+		}, nil).Once()
+	s3Client.On("ListObjectsV2PagesWithContext", mock.Anything,
+		listInput("logs/aws_cloudtrail/year=2020/month=11/day=01/hour=01/"), mock.Anything, mock.Anything).
+		Return(&s3.ListObjectsV2Output{}, nil).Once()
+
+	plan, objects, err := ListObjects(context.Background(), s3Client, "bucket", []Table{testTable},
+		testStart.Add(time.Minute), testStart.Add(2*time.Hour))
+	require.NoError(t, err)
+	s3Client.AssertExpectations(t)
+	assert.Equal(t, &Plan{
+		Bucket:     "bucket",
+		Tables:     []Table{testTable},
+		Start:      testStart,
+		End:        testStart.Add(2 * time.Hour),
+		NumObjects: 2,
+		NumBytes:   30,
+	}, plan)
+	require.Len(t, objects, 2)
+	assert.Equal(t, testStart, objects[1].Hour)
+
+	listed := *plan
+	assert.NoError(t, CheckPlan(plan, &listed))
+	listed.NumObjects++
+	assert.Error(t, CheckPlan(plan, &listed))
+	listed = *plan
+	listed.Tables = []Table{{Database: pantherdb.RuleMatchDatabase, Name: "aws_cloudtrail"}}
+	assert.Error(t, CheckPlan(plan, &listed))
+
+	_, _, err = ListObjects(context.Background(), s3Client, "bucket", []Table{testTable}, testStart, testStart)
+	assert.Error(t, err)
+}
+
+func TestDelete(t *testing.T) {
+	objects := []*Object{
+		{Table: testTable, Hour: testStart, Key: "a", Size: 10},
+		{Table: testTable, Hour: testStart, Key: "b", Size: 20},
+		{Table: testTable, Hour: testStart.Add(time.Hour), Key: "c", Size: 30},
+	}
+	s3Client := &testutils.S3Mock{}
+	s3Client.On("DeleteObjects", mock.Anything).Return(&s3.DeleteObjectsOutput{
+		Deleted: []*s3.DeletedObject{{Key: aws.String("a")}, {Key: aws.String("c")}},
+		Errors:  []*s3.Error{{Key: aws.String("b"), Message: aws.String("AccessDenied")}},
+	}, nil).Once()
+	// hour 0 still has the object that failed to delete
+	s3Client.On("ListObjectsV2PagesWithContext", mock.Anything,
+		listInput("logs/aws_cloudtrail/year=2020/month=11/day=01/hour=00/"), mock.Anything, mock.Anything).
+		Return(&s3.ListObjectsV2Output{
+			Contents: []*s3.Object{{Key: aws.String("b"), Size: aws.Int64(20)}},
+		}, nil).Once()
+	s3Client.On("ListObjectsV2PagesWithContext", mock.Anything,
+		listInput("logs/aws_cloudtrail/year=2020/month=11/day=01/hour=01/"), mock.Anything, mock.Anything).
+		Return(&s3.ListObjectsV2Output{}, nil).Once()
+	glueClient := &testutils.GlueMock{}
+	glueClient.On("DeletePartition", &glue.DeletePartitionInput{
+		DatabaseName:    aws.String(pantherdb.LogProcessingDatabase),
+		TableName:       aws.String("aws_cloudtrail"),
+		PartitionValues: aws.StringSlice([]string{"2020", "11", "01", "01"}),
+	}).Return(&glue.DeletePartitionOutput{}, nil).Once()
+
+	var manifest bytes.Buffer
+	stats := &Stats{}
+	err := Delete(context.Background(), s3Client, glueClient, "bucket", objects, &manifest, stats)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "s3://bucket/b: AccessDenied")
+	s3Client.AssertExpectations(t)
+	glueClient.AssertExpectations(t)
+	assert.Equal(t, &Stats{NumDeletedObjects: 2, NumDeletedBytes: 40, NumDeletedPartitions: 1}, stats)
+
+	lines := strings.Split(strings.TrimSpace(manifest.String()), "\n")
+	require.Len(t, lines, 2)
+	var entry ManifestEntry
+	require.NoError(t, jsoniter.UnmarshalFromString(lines[1], &entry))
+	assert.Equal(t, "bucket", entry.Bucket)
+	assert.Equal(t, "c", entry.Key)
+	assert.Equal(t, int64(30), entry.Size)
+}
@@ -0,0 +1,265 @@
+package lakeinventory
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/pkg/s3path"
+	"github.com/panther-labs/panther/pkg/workerpool"
+)
+
+// Manifest is the manifest.json of an S3 Inventory report
+type Manifest struct {
+	SourceBucket string `json:"sourceBucket"`
+	FileFormat   string `json:"fileFormat"`
+	FileSchema   string `json:"fileSchema"`
+	Files        []struct {
+		Key  string `json:"key"`
+		Size int64  `json:"size"`
+	} `json:"files"`
+}
+
+// FindInventory returns the manifest of the latest report of an enabled CSV inventory of the bucket,
+// nil if the bucket has none
+func (l *Lister) FindInventory(ctx context.Context, bucket string) (*s3path.Path, error) {
+	input := &s3.ListBucketInventoryConfigurationsInput{
+		Bucket: aws.String(bucket),
+	}
+	for {
+		output, err := l.S3.ListBucketInventoryConfigurationsWithContext(ctx, input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list the inventory configurations of %s", bucket)
+		}
+		for _, config := range output.InventoryConfigurationList {
+			destination := config.Destination.S3BucketDestination
+			if !aws.BoolValue(config.IsEnabled) || aws.StringValue(destination.Format) != s3.InventoryFormatCsv {
+				continue
+			}
+			destinationARN, err := arn.Parse(aws.StringValue(destination.Bucket))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid destination of inventory %s", aws.StringValue(config.Id))
+			}
+			// reports are at destination-prefix/source-bucket/config-ID/YYYY-MM-DDTHH-MMZ/manifest.json
+			base := bucket + "/" + aws.StringValue(config.Id) + "/"
+			if prefix := strings.TrimSuffix(aws.StringValue(destination.Prefix), "/"); prefix != "" {
+				base = prefix + "/" + base
+			}
+			location, err := l.latestManifest(ctx, destinationARN.Resource, base)
+			if err != nil {
+				return nil, err
+			}
+			if location != nil {
+				return location, nil
+			}
+		}
+		if !aws.BoolValue(output.IsTruncated) {
+			return nil, nil
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+}
+
+// latestManifest returns the manifest of the latest report under the prefix, nil if there is no report yet
+func (l *Lister) latestManifest(ctx context.Context, bucket, prefix string) (*s3path.Path, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	var reports []string
+	err := l.S3.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, commonPrefix := range page.CommonPrefixes {
+			// skip the data/ and hive/ folders, the report folders are timestamps
+			if report := aws.StringValue(commonPrefix.Prefix); strings.HasPrefix(report[len(prefix):], "20") {
+				reports = append(reports, report)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list the inventory reports s3://%s/%s", bucket, prefix)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(reports)))
+	for _, report := range reports {
+		// the manifest is written last, a report without it is in progress
+		_, err := l.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(report + "manifest.json"),
+		})
+		if err == nil {
+			return &s3path.Path{Bucket: bucket, Key: report + "manifest.json"}, nil
+		}
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "NotFound" {
+			return nil, errors.Wrapf(err, "failed to check the inventory manifest s3://%s/%smanifest.json", bucket, report)
+		}
+	}
+	return nil, nil
+}
+
+// ReadInventory counts the objects of an inventory report instead of listing the bucket, one file per worker
+func (l *Lister) ReadInventory(ctx context.Context, config *Config, location *s3path.Path,
+	checkpoint Checkpoint) (*Report, error) {
+
+	manifest, err := l.readManifest(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.SourceBucket != config.Bucket {
+		return nil, errors.Errorf("inventory %s is of bucket %s, not %s", location, manifest.SourceBucket, config.Bucket)
+	}
+	if manifest.FileFormat != "CSV" {
+		return nil, errors.Errorf("inventory %s is %s, only CSV is supported", location, manifest.FileFormat)
+	}
+	columns, err := inventoryColumns(manifest.FileSchema)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "inventory %s", location)
+	}
+
+	keys := make([]string, len(manifest.Files))
+	for i, file := range manifest.Files {
+		keys[i] = file.Key
+	}
+	aggregator := NewAggregator(config.LogTypes)
+	pool := workerpool.New(ctx, config.Concurrency, workerpool.FailFast)
+	for _, key := range resume(keys, aggregator, checkpoint) {
+		key := key
+		if pool.Submit(func(ctx context.Context) error {
+			return l.readInventoryFile(ctx, location.Bucket, key, columns, aggregator, checkpoint)
+		}) != nil {
+			break // the pool stopped, Wait returns why
+		}
+	}
+	if err := pool.Wait(); err != nil {
+		return nil, err
+	}
+	report := aggregator.Report(config.Bucket, SourceInventory)
+	report.Inventory = location.String()
+	return report, nil
+}
+
+func (l *Lister) readManifest(ctx context.Context, location *s3path.Path) (*Manifest, error) {
+	output, err := l.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(location.Bucket),
+		Key:    aws.String(location.Key),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get inventory manifest %s", location)
+	}
+	defer output.Body.Close()
+	manifest := &Manifest{}
+	if err := jsoniter.NewDecoder(output.Body).Decode(manifest); err != nil {
+		return nil, errors.Wrapf(err, "failed to read inventory manifest %s", location)
+	}
+	return manifest, nil
+}
+
+// inventoryFields are the positions of the fields of the inventory rows, deleteMarker is -1 if absent
+type inventoryFields struct {
+	key, size, deleteMarker int
+}
+
+func inventoryColumns(schema string) (*inventoryFields, error) {
+	fields := &inventoryFields{key: -1, size: -1, deleteMarker: -1}
+	for i, column := range strings.Split(schema, ",") {
+		switch strings.TrimSpace(column) {
+		case "Key":
+			fields.key = i
+		case "Size":
+			fields.size = i
+		case "IsDeleteMarker":
+			fields.deleteMarker = i
+		}
+	}
+	if fields.key < 0 || fields.size < 0 {
+		return nil, errors.Errorf("schema %q must have the Key and Size fields", schema)
+	}
+	return fields, nil
+}
+
+func (l *Lister) readInventoryFile(ctx context.Context, bucket, key string, fields *inventoryFields,
+	aggregator *Aggregator, checkpoint Checkpoint) error {
+
+	if err := l.Throttle.Wait(ctx, 0); err != nil {
+		return err
+	}
+	output, err := l.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get inventory file s3://%s/%s", bucket, key)
+	}
+	defer output.Body.Close()
+	gzipReader, err := gzip.NewReader(output.Body)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read inventory file s3://%s/%s", bucket, key)
+	}
+	u := aggregator.newUnit()
+	if err := u.countInventory(csv.NewReader(gzipReader), fields); err != nil {
+		return errors.WithMessagef(err, "inventory file s3://%s/%s", bucket, key)
+	}
+	zap.L().Debug("read inventory file", zap.String("key", key), zap.Int("rows", len(u.counts.Rows)))
+	return l.done(key, u, checkpoint)
+}
+
+func (u *unit) countInventory(reader *csv.Reader, fields *inventoryFields) error {
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "invalid CSV")
+		}
+		if len(record) <= fields.key || len(record) <= fields.size || len(record) <= fields.deleteMarker {
+			return errors.Errorf("line with %d fields is missing fields", len(record))
+		}
+		if fields.deleteMarker >= 0 && record[fields.deleteMarker] == "true" {
+			continue
+		}
+		// keys are URL encoded
+		key, err := url.QueryUnescape(record[fields.key])
+		if err != nil {
+			return errors.Wrapf(err, "invalid key %q", record[fields.key])
+		}
+		size, err := strconv.ParseInt(record[fields.size], 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "invalid size of %s", key)
+		}
+		u.count(key, size)
+	}
+}
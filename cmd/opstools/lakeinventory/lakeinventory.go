@@ -0,0 +1,370 @@
+package lakeinventory
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/cmd/opstools/lakemigrate"
+	"github.com/panther-labs/panther/internal/log_analysis/awsglue"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+	"github.com/panther-labs/panther/pkg/workerpool"
+)
+
+// Sources of the object counts of a report
+const (
+	SourceListing   = "listing"
+	SourceInventory = "inventory"
+)
+
+// TotalMonth is the month column of the per database totals in CSV reports
+const TotalMonth = "total"
+
+// Databases are the databases with data in the lake bucket
+var Databases = []string{
+	pantherdb.LogProcessingDatabase,
+	pantherdb.RuleMatchDatabase,
+	pantherdb.RuleErrorsDatabase,
+	pantherdb.CloudSecurityDatabase,
+}
+
+// Row counts the objects of a table in a month
+type Row struct {
+	Database   string `json:"database"`
+	Table      string `json:"table"`
+	LogType    string `json:"logType,omitempty"` // empty for tables of unknown log types
+	Month      string `json:"month"`             // YYYY-MM
+	NumObjects uint64 `json:"numObjects"`
+	NumBytes   uint64 `json:"numBytes"`
+}
+
+// key identifies the table and month of the row
+func (r Row) key() Row {
+	r.NumObjects, r.NumBytes = 0, 0
+	return r
+}
+
+// Total counts the objects of a database
+type Total struct {
+	Database   string `json:"database"`
+	NumObjects uint64 `json:"numObjects"`
+	NumBytes   uint64 `json:"numBytes"`
+}
+
+// Report is the inventory of a lake bucket
+type Report struct {
+	Bucket string `json:"bucket"`
+	Source string `json:"source"`
+	// Inventory is the manifest of the inventory report counted
+	Inventory string `json:"inventory,omitempty"`
+	// NumOther counts the objects outside table partitions, they are not in the rows
+	NumOther  uint64  `json:"numOther"`
+	Rows      []Row   `json:"rows"`
+	Databases []Total `json:"databases"`
+}
+
+// WriteCSV writes the rows followed by the database totals, with TotalMonth as month and without table
+func (r *Report) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{"database", "table", "logType", "month", "numObjects", "numBytes"})
+	for _, row := range r.Rows {
+		_ = out.Write([]string{row.Database, row.Table, row.LogType, row.Month,
+			strconv.FormatUint(row.NumObjects, 10), strconv.FormatUint(row.NumBytes, 10)})
+	}
+	for _, total := range r.Databases {
+		_ = out.Write([]string{total.Database, "", "", TotalMonth,
+			strconv.FormatUint(total.NumObjects, 10), strconv.FormatUint(total.NumBytes, 10)})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// Counts are the counts of a unit of work, a table prefix or an inventory file
+type Counts struct {
+	Rows     []Row  `json:"rows"`
+	NumOther uint64 `json:"numOther,omitempty"`
+}
+
+// Checkpoint records the counts of the completed units of work
+// so an interrupted inventory can resume without counting them again
+type Checkpoint interface {
+	// Counts returns the counts of a unit completed by a previous run
+	Counts(id string) (*Counts, bool)
+	Done(id string, counts *Counts) error
+}
+
+// Aggregator sums the objects per table and month, it is safe for concurrent use
+type Aggregator struct {
+	logTypes map[string]string // database.table -> log type
+
+	mu       sync.Mutex
+	rows     map[Row]*Row // keyed by the row without counts
+	numOther uint64
+}
+
+// NewAggregator returns an aggregator keying the tables of the log types by log type
+func NewAggregator(logTypes []string) *Aggregator {
+	a := &Aggregator{
+		logTypes: make(map[string]string),
+		rows:     make(map[Row]*Row),
+	}
+	for _, table := range lakemigrate.LogTypeTables(logTypes, Databases) {
+		a.logTypes[table.Database+"."+table.Name] = table.LogType
+	}
+	return a
+}
+
+// Count returns the row of an object of the lake bucket or false if it is not in a table partition
+func (a *Aggregator) Count(key string, size int64) (Row, bool) {
+	partition, err := awsglue.PartitionFromS3Object("", key)
+	if err != nil {
+		return Row{}, false
+	}
+	columns := partition.GetPartitionColumnsInfo()
+	database, table := partition.GetDatabase(), partition.GetTable()
+	return Row{
+		Database:   database,
+		Table:      table,
+		LogType:    a.logTypes[database+"."+table],
+		Month:      columns[0].Value + "-" + columns[1].Value,
+		NumObjects: 1,
+		NumBytes:   uint64(size),
+	}, true
+}
+
+// Add sums the counts of a unit of work
+func (a *Aggregator) Add(counts *Counts) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.numOther += counts.NumOther
+	for _, row := range counts.Rows {
+		if sum, ok := a.rows[row.key()]; ok {
+			sum.NumObjects += row.NumObjects
+			sum.NumBytes += row.NumBytes
+			continue
+		}
+		sum := row
+		a.rows[row.key()] = &sum
+	}
+}
+
+// Report returns the rows sorted by database, table and month and the database totals
+func (a *Aggregator) Report(bucket, source string) *Report {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	report := &Report{
+		Bucket:   bucket,
+		Source:   source,
+		NumOther: a.numOther,
+		Rows:     make([]Row, 0, len(a.rows)),
+	}
+	totals := make(map[string]*Total)
+	for _, row := range a.rows {
+		report.Rows = append(report.Rows, *row)
+		total, ok := totals[row.Database]
+		if !ok {
+			total = &Total{Database: row.Database}
+			totals[row.Database] = total
+		}
+		total.NumObjects += row.NumObjects
+		total.NumBytes += row.NumBytes
+	}
+	sort.Slice(report.Rows, func(i, j int) bool {
+		ri, rj := &report.Rows[i], &report.Rows[j]
+		if ri.Database != rj.Database {
+			return ri.Database < rj.Database
+		}
+		if ri.Table != rj.Table {
+			return ri.Table < rj.Table
+		}
+		return ri.Month < rj.Month
+	})
+	for _, total := range totals {
+		report.Databases = append(report.Databases, *total)
+	}
+	sort.Slice(report.Databases, func(i, j int) bool {
+		return report.Databases[i].Database < report.Databases[j].Database
+	})
+	return report
+}
+
+// unit counts the objects of a unit of work, the rows are merged so the checkpoint stays small
+type unit struct {
+	aggregator *Aggregator
+	index      map[Row]int // position of a row in counts
+	counts     Counts
+}
+
+func (a *Aggregator) newUnit() *unit {
+	return &unit{
+		aggregator: a,
+		index:      make(map[Row]int),
+	}
+}
+
+func (u *unit) count(key string, size int64) {
+	row, ok := u.aggregator.Count(key, size)
+	if !ok {
+		u.counts.NumOther++
+		return
+	}
+	if i, ok := u.index[row.key()]; ok {
+		u.counts.Rows[i].NumObjects++
+		u.counts.Rows[i].NumBytes += row.NumBytes
+		return
+	}
+	u.index[row.key()] = len(u.counts.Rows)
+	u.counts.Rows = append(u.counts.Rows, row)
+}
+
+// Config configures an inventory
+type Config struct {
+	Bucket string
+	// Concurrency is the number of table prefixes or inventory files read at a time
+	Concurrency int
+	// LogTypes are the log types the tables are keyed by, tables of other log types have no log type
+	LogTypes []string
+}
+
+// Lister counts the objects of the lake bucket
+type Lister struct {
+	S3 s3iface.S3API
+	// Throttle if set limits the rate of list requests
+	Throttle *lakemigrate.Throttle
+
+	mu sync.Mutex // serializes checkpoint updates
+}
+
+// List lists the lake bucket one table prefix at a time per worker.
+// Objects outside table prefixes are not listed.
+func (l *Lister) List(ctx context.Context, config *Config, checkpoint Checkpoint) (*Report, error) {
+	var prefixes []string
+	for _, database := range Databases {
+		tablePrefixes, err := l.tablePrefixes(ctx, config.Bucket, database)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, tablePrefixes...)
+	}
+
+	aggregator := NewAggregator(config.LogTypes)
+	pool := workerpool.New(ctx, config.Concurrency, workerpool.FailFast)
+	for _, prefix := range resume(prefixes, aggregator, checkpoint) {
+		prefix := prefix
+		if pool.Submit(func(ctx context.Context) error {
+			return l.listPrefix(ctx, config.Bucket, prefix, aggregator, checkpoint)
+		}) != nil {
+			break // the pool stopped, Wait returns why
+		}
+	}
+	if err := pool.Wait(); err != nil {
+		return nil, err
+	}
+	return aggregator.Report(config.Bucket, SourceListing), nil
+}
+
+// tablePrefixes returns the prefixes of the tables of a database with objects
+func (l *Lister) tablePrefixes(ctx context.Context, bucket, database string) ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(awsglue.DataPrefix(database) + "/"),
+		Delimiter: aws.String("/"),
+	}
+	var prefixes []string
+	if err := l.Throttle.Wait(ctx, 0); err != nil {
+		return nil, err
+	}
+	var throttleErr error
+	err := l.S3.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, prefix := range page.CommonPrefixes {
+			prefixes = append(prefixes, aws.StringValue(prefix.Prefix))
+		}
+		throttleErr = l.Throttle.Wait(ctx, 0) // for the next page
+		return throttleErr == nil
+	})
+	if err == nil {
+		err = throttleErr
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list the tables of %s", database)
+	}
+	return prefixes, nil
+}
+
+func (l *Lister) listPrefix(ctx context.Context, bucket, prefix string, aggregator *Aggregator, checkpoint Checkpoint) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	u := aggregator.newUnit()
+	if err := l.Throttle.Wait(ctx, 0); err != nil {
+		return err
+	}
+	var throttleErr error
+	err := l.S3.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			u.count(aws.StringValue(object.Key), aws.Int64Value(object.Size))
+		}
+		throttleErr = l.Throttle.Wait(ctx, 0)
+		return throttleErr == nil
+	})
+	if err == nil {
+		err = throttleErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to list s3://%s/%s", bucket, prefix)
+	}
+	zap.L().Debug("listed table", zap.String("prefix", prefix), zap.Int("rows", len(u.counts.Rows)))
+	return l.done(prefix, u, checkpoint)
+}
+
+// resume adds the counts of the units completed by a previous run and returns the others,
+// the checkpoint is only read before the units run
+func resume(ids []string, aggregator *Aggregator, checkpoint Checkpoint) (pending []string) {
+	for _, id := range ids {
+		if counts, ok := checkpoint.Counts(id); ok {
+			aggregator.Add(counts)
+			continue
+		}
+		pending = append(pending, id)
+	}
+	return pending
+}
+
+// done adds the counts of a completed unit after they are checkpointed
+func (l *Lister) done(id string, u *unit, checkpoint Checkpoint) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := checkpoint.Done(id, &u.counts); err != nil {
+		return err
+	}
+	u.aggregator.Add(&u.counts)
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/lakeinventory"
+	"github.com/panther-labs/panther/cmd/opstools/lakemigrate"
+	"github.com/panther-labs/panther/cmd/opstools/sourcehealth"
+	"github.com/panther-labs/panther/cmd/opstools/sourcemap"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+// checkpointLine is a completed unit of work in the checkpoint file
+type checkpointLine struct {
+	ID     string                `json:"id"`
+	Counts *lakeinventory.Counts `json:"counts"`
+}
+
+// fileCheckpoint appends the counts of completed units to a file, one JSON object per line
+type fileCheckpoint struct {
+	file *os.File
+	done map[string]*lakeinventory.Counts
+}
+
+func openCheckpoint(path string) (*fileCheckpoint, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &fileCheckpoint{
+		file: file,
+		done: make(map[string]*lakeinventory.Counts),
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024) // a table has a line per month
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var line checkpointLine
+		if err := jsoniter.Unmarshal(scanner.Bytes(), &line); err != nil {
+			// the last line is incomplete if the previous run was killed while writing it
+			zap.S().Warnf("ignoring invalid line of checkpoint %s: %s", path, err)
+			continue
+		}
+		checkpoint.done[line.ID] = line.Counts
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	return checkpoint, nil
+}
+
+func (c *fileCheckpoint) Counts(id string) (*lakeinventory.Counts, bool) {
+	counts, ok := c.done[id]
+	return counts, ok
+}
+
+func (c *fileCheckpoint) Done(id string, counts *lakeinventory.Counts) error {
+	line, err := jsoniter.Marshal(&checkpointLine{ID: id, Counts: counts})
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.file, "%s\n", line); err != nil {
+		return errors.Wrapf(err, "failed to write checkpoint %s", c.file.Name())
+	}
+	return c.file.Sync()
+}
+
+// nopCheckpoint does not resume
+type nopCheckpoint struct{}
+
+func (nopCheckpoint) Counts(string) (*lakeinventory.Counts, bool) {
+	return nil, false
+}
+
+func (nopCheckpoint) Done(string, *lakeinventory.Counts) error {
+	return nil
+}
+
+func main() {
+	opstools.SetUsage("counts the objects and bytes of the data lake bucket per table and month, " +
+		"from its S3 Inventory if it has one, otherwise by listing it")
+	opts := struct {
+		Bucket            *string
+		LogTypes          *string
+		Manifest          *string
+		List              *bool
+		Checkpoint        *string
+		Format            *string
+		Out               *string
+		Concurrency       *int
+		RequestsPerSecond *float64
+		Debug             *bool
+		Region            *string
+		MaxRetries        *int
+	}{
+		Bucket: flag.String("bucket", "", "The processed data bucket"),
+		LogTypes: flag.String("log-types", "",
+			"Comma separated list of log types to key the tables by, in addition to the log types of the sources"),
+		Manifest:          flag.String("manifest", "", "Count this S3 Inventory report (s3://bucket/key/manifest.json)"),
+		List:              flag.Bool("list", false, "List the bucket even if it has an S3 Inventory"),
+		Checkpoint:        flag.String("checkpoint", "", "If set, the file recording the counted prefixes, an inventory with it resumes"),
+		Format:            flag.String("format", "csv", "The report format, csv or json"),
+		Out:               flag.String("out", "", "Write the report to this file instead of stdout"),
+		Concurrency:       flag.Int("concurrency", 10, "The number of table prefixes or inventory files read at a time"),
+		RequestsPerSecond: flag.Float64("requests-per-second", 20, "If non-zero, limit the list and get requests to this rate"),
+		Debug:             flag.Bool("debug", false, "Enable additional logging"),
+		Region:            flag.String("region", "", "Set the AWS region to run on"),
+		MaxRetries:        flag.Int("max-retries", 12, "Max retries for AWS requests"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+	zap.ReplaceGlobals(log.Desugar())
+
+	if *opts.Bucket == "" {
+		flag.Usage()
+		log.Fatal("-bucket must be set")
+	}
+	if *opts.Format != "csv" && *opts.Format != "json" {
+		log.Fatal("-format must be csv or json")
+	}
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region:     opts.Region,
+		MaxRetries: opts.MaxRetries,
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+
+	// all the sources, so that the tables of every configured log type are keyed by log type
+	sources, err := sourcemap.ListSources(lambda.New(sess), &sourcehealth.Filter{}, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config := &lakeinventory.Config{
+		Bucket:      *opts.Bucket,
+		Concurrency: *opts.Concurrency,
+		LogTypes:    logTypes(sources, *opts.LogTypes),
+	}
+
+	var checkpoint lakeinventory.Checkpoint = nopCheckpoint{}
+	if *opts.Checkpoint != "" {
+		fc, err := openCheckpoint(*opts.Checkpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fc.file.Close()
+		checkpoint = fc
+	}
+
+	lister := &lakeinventory.Lister{
+		S3: s3.New(sess),
+	}
+	if *opts.RequestsPerSecond > 0 {
+		lister.Throttle = &lakemigrate.Throttle{RequestsPerSecond: *opts.RequestsPerSecond}
+	}
+
+	ctx := context.Background()
+	startTime := time.Now()
+	report, err := inventory(ctx, lister, config, *opts.Manifest, *opts.List, checkpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("counted %d rows from the %s of s3://%s in %v", len(report.Rows), report.Source, report.Bucket,
+		time.Since(startTime))
+
+	out := io.Writer(os.Stdout)
+	if *opts.Out != "" {
+		file, err := os.Create(*opts.Out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		out = file
+	}
+	if err := writeReport(out, report, *opts.Format); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// inventory counts a given inventory report, the latest inventory report of the bucket or the listing of the bucket
+func inventory(ctx context.Context, lister *lakeinventory.Lister, config *lakeinventory.Config, manifest string,
+	list bool, checkpoint lakeinventory.Checkpoint) (*lakeinventory.Report, error) {
+
+	if list {
+		return lister.List(ctx, config, checkpoint)
+	}
+	var location *s3path.Path
+	if manifest != "" {
+		path, err := s3path.Parse(manifest)
+		if err != nil {
+			return nil, errors.WithMessage(err, "-manifest")
+		}
+		location = &path
+	} else {
+		found, err := lister.FindInventory(ctx, config.Bucket)
+		if err != nil {
+			return nil, err
+		}
+		if found == nil {
+			zap.S().Infof("s3://%s has no CSV inventory, listing it", config.Bucket)
+			return lister.List(ctx, config, checkpoint)
+		}
+		location = found
+	}
+	zap.S().Infof("counting inventory %s", location)
+	return lister.ReadInventory(ctx, config, location, checkpoint)
+}
+
+func logTypes(sources []*sourcemap.Source, extra string) (logTypes []string) {
+	seen := make(map[string]bool)
+	add := func(logType string) {
+		if logType != "" && !seen[logType] {
+			seen[logType] = true
+			logTypes = append(logTypes, logType)
+		}
+	}
+	for _, source := range sources {
+		for _, logType := range source.LogTypes {
+			add(logType)
+		}
+	}
+	for _, logType := range strings.Split(extra, ",") {
+		add(strings.TrimSpace(logType))
+	}
+	return logTypes
+}
+
+func writeReport(w io.Writer, report *lakeinventory.Report, format string) error {
+	if format == "csv" {
+		return report.WriteCSV(w)
+	}
+	encoder := jsoniter.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
@@ -0,0 +1,308 @@
+package lakeinventory
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+const (
+	cloudTrailNov = "logs/aws_cloudtrail/year=2020/month=11/day=01/hour=00/"
+	cloudTrailDec = "logs/aws_cloudtrail/year=2020/month=12/day=31/hour=23/"
+	matchesNov    = "rules/aws_cloudtrail/year=2020/month=11/day=02/hour=05/"
+	customNov     = "logs/custom_foo/year=2020/month=11/day=01/hour=00/"
+)
+
+// fakeS3 serves objects of several buckets, a list page has at most two objects
+type fakeS3 struct {
+	s3iface.S3API
+	objects        map[string][]byte // bucket/key
+	inventories    []*s3.InventoryConfiguration
+	mu             sync.Mutex
+	listedPrefixes []string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte)}
+}
+
+func (f *fakeS3) put(bucket, key string, size int) {
+	f.objects[bucket+"/"+key] = make([]byte, size)
+}
+
+func (f *fakeS3) ListObjectsV2PagesWithContext(_ aws.Context, input *s3.ListObjectsV2Input,
+	fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+
+	f.mu.Lock()
+	f.listedPrefixes = append(f.listedPrefixes, aws.StringValue(input.Prefix))
+	f.mu.Unlock()
+
+	bucketPrefix := aws.StringValue(input.Bucket) + "/"
+	prefix, delimiter := aws.StringValue(input.Prefix), aws.StringValue(input.Delimiter)
+	var keys []string
+	commonPrefixes := make(map[string]bool)
+	for path := range f.objects {
+		if !strings.HasPrefix(path, bucketPrefix+prefix) {
+			continue
+		}
+		key := strings.TrimPrefix(path, bucketPrefix)
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			commonPrefixes[key[:len(prefix)+i+1]] = true
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	page := &s3.ListObjectsV2Output{}
+	for commonPrefix := range commonPrefixes {
+		page.CommonPrefixes = append(page.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(commonPrefix)})
+	}
+	for i, key := range keys {
+		page.Contents = append(page.Contents, &s3.Object{
+			Key:  aws.String(key),
+			Size: aws.Int64(int64(len(f.objects[bucketPrefix+key]))),
+		})
+		if len(page.Contents) == 2 && i < len(keys)-1 {
+			if !fn(page, false) {
+				return nil
+			}
+			page = &s3.ListObjectsV2Output{}
+		}
+	}
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeS3) ListBucketInventoryConfigurationsWithContext(_ aws.Context, _ *s3.ListBucketInventoryConfigurationsInput,
+	_ ...request.Option) (*s3.ListBucketInventoryConfigurationsOutput, error) {
+
+	return &s3.ListBucketInventoryConfigurationsOutput{
+		InventoryConfigurationList: f.inventories,
+		IsTruncated:                aws.Bool(false),
+	}, nil
+}
+
+func (f *fakeS3) HeadObjectWithContext(_ aws.Context, input *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	data, ok := f.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New("NotFound", "not found", nil)
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+func (f *fakeS3) GetObjectWithContext(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	data, ok := f.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+type memCheckpoint map[string]*Counts
+
+func (c memCheckpoint) Counts(id string) (*Counts, bool) {
+	counts, ok := c[id]
+	return counts, ok
+}
+
+func (c memCheckpoint) Done(id string, counts *Counts) error {
+	c[id] = counts
+	return nil
+}
+
+func testLake() *fakeS3 {
+	s3Client := newFakeS3()
+	s3Client.put("lake", cloudTrailNov+"a.json.gz", 10)
+	s3Client.put("lake", cloudTrailNov+"b.json.gz", 20)
+	s3Client.put("lake", cloudTrailNov+"c.json.gz", 30)
+	s3Client.put("lake", cloudTrailDec+"a.json.gz", 40)
+	s3Client.put("lake", matchesNov+"a.json.gz", 5)
+	s3Client.put("lake", customNov+"a.json.gz", 7)
+	s3Client.put("lake", "logs/aws_cloudtrail/README", 1)
+	s3Client.put("lake", "athena/results.csv", 100)
+	return s3Client
+}
+
+var testConfig = &Config{
+	Bucket:      "lake",
+	Concurrency: 2,
+	LogTypes:    []string{"AWS.CloudTrail", "AWS.S3ServerAccess"},
+}
+
+var testRows = []Row{
+	{Database: pantherdb.LogProcessingDatabase, Table: "aws_cloudtrail", LogType: "AWS.CloudTrail", Month: "2020-11",
+		NumObjects: 3, NumBytes: 60},
+	{Database: pantherdb.LogProcessingDatabase, Table: "aws_cloudtrail", LogType: "AWS.CloudTrail", Month: "2020-12",
+		NumObjects: 1, NumBytes: 40},
+	{Database: pantherdb.LogProcessingDatabase, Table: "custom_foo", Month: "2020-11", NumObjects: 1, NumBytes: 7},
+	{Database: pantherdb.RuleMatchDatabase, Table: "aws_cloudtrail", LogType: "AWS.CloudTrail", Month: "2020-11",
+		NumObjects: 1, NumBytes: 5},
+}
+
+var testTotals = []Total{
+	{Database: pantherdb.LogProcessingDatabase, NumObjects: 5, NumBytes: 107},
+	{Database: pantherdb.RuleMatchDatabase, NumObjects: 1, NumBytes: 5},
+}
+
+func TestList(t *testing.T) {
+	s3Client := testLake()
+	lister := &Lister{S3: s3Client}
+	checkpoint := memCheckpoint{}
+	report, err := lister.List(context.Background(), testConfig, checkpoint)
+	require.NoError(t, err)
+	assert.Equal(t, &Report{
+		Bucket:    "lake",
+		Source:    SourceListing,
+		NumOther:  1, // the README, athena/ is not a database prefix
+		Rows:      testRows,
+		Databases: testTotals,
+	}, report)
+	assert.Len(t, checkpoint, 3)
+
+	// resuming a completed inventory only lists the table prefixes
+	s3Client.listedPrefixes = nil
+	resumed, err := lister.List(context.Background(), testConfig, checkpoint)
+	require.NoError(t, err)
+	assert.Equal(t, report, resumed)
+	assert.ElementsMatch(t, []string{"logs/", "rules/", "rule_errors/", "cloud_security/"}, s3Client.listedPrefixes)
+}
+
+func TestListResume(t *testing.T) {
+	s3Client := testLake()
+	lister := &Lister{S3: s3Client}
+	checkpoint := memCheckpoint{
+		"logs/custom_foo/": &Counts{Rows: []Row{
+			{Database: pantherdb.LogProcessingDatabase, Table: "custom_foo", Month: "2020-10", NumObjects: 2, NumBytes: 3},
+		}},
+	}
+	report, err := lister.List(context.Background(), testConfig, checkpoint)
+	require.NoError(t, err)
+	assert.NotContains(t, s3Client.listedPrefixes, "logs/custom_foo/")
+	assert.Equal(t, Row{Database: pantherdb.LogProcessingDatabase, Table: "custom_foo", Month: "2020-10",
+		NumObjects: 2, NumBytes: 3}, report.Rows[2])
+	assert.Len(t, report.Rows, 4)
+}
+
+func gzipCSV(t *testing.T, lines ...string) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+func TestReadInventory(t *testing.T) {
+	s3Client := newFakeS3()
+	s3Client.inventories = []*s3.InventoryConfiguration{
+		{
+			Id:        aws.String("weekly-parquet"),
+			IsEnabled: aws.Bool(true),
+			Destination: &s3.InventoryDestination{S3BucketDestination: &s3.InventoryS3BucketDestination{
+				Bucket: aws.String("arn:aws:s3:::reports"),
+				Format: aws.String(s3.InventoryFormatParquet),
+			}},
+		},
+		{
+			Id:        aws.String("daily"),
+			IsEnabled: aws.Bool(true),
+			Destination: &s3.InventoryDestination{S3BucketDestination: &s3.InventoryS3BucketDestination{
+				Bucket: aws.String("arn:aws:s3:::reports"),
+				Format: aws.String(s3.InventoryFormatCsv),
+				Prefix: aws.String("inventory"),
+			}},
+		},
+	}
+	s3Client.objects["reports/inventory/lake/daily/2020-11-01T00-00Z/manifest.json"] = []byte(`{
+		"sourceBucket": "lake",
+		"fileFormat": "CSV",
+		"fileSchema": "Bucket, Key, Size, IsDeleteMarker",
+		"files": [{"key": "inventory/lake/daily/data/1.csv.gz"}, {"key": "inventory/lake/daily/data/2.csv.gz"}]
+	}`)
+	s3Client.objects["reports/inventory/lake/daily/data/1.csv.gz"] = gzipCSV(t,
+		`"lake","`+cloudTrailNov+`a.json.gz","10","false"`,
+		`"lake","`+cloudTrailNov+`b.json.gz","20","false"`,
+		`"lake","`+cloudTrailNov+`deleted.json.gz","","true"`,
+		`"lake","athena/query%20results.csv","100","false"`,
+	)
+	s3Client.objects["reports/inventory/lake/daily/data/2.csv.gz"] = gzipCSV(t,
+		`"lake","`+cloudTrailNov+`c.json.gz","30","false"`,
+		`"lake","`+cloudTrailDec+`a.json.gz","40","false"`,
+		`"lake","`+matchesNov+`a.json.gz","5","false"`,
+		`"lake","`+customNov+`a.json.gz","7","false"`,
+		`"lake","logs/aws_cloudtrail/README","1","false"`,
+	)
+	// the manifest of the latest report is not written yet
+	s3Client.objects["reports/inventory/lake/daily/2020-11-02T00-00Z/manifest.checksum"] = nil
+	s3Client.objects["reports/inventory/lake/daily/hive/dt=2020-11-01-00-00/symlink.txt"] = nil
+
+	lister := &Lister{S3: s3Client}
+	location, err := lister.FindInventory(context.Background(), "lake")
+	require.NoError(t, err)
+	require.Equal(t, &s3path.Path{Bucket: "reports", Key: "inventory/lake/daily/2020-11-01T00-00Z/manifest.json"}, location)
+
+	checkpoint := memCheckpoint{}
+	report, err := lister.ReadInventory(context.Background(), testConfig, location, checkpoint)
+	require.NoError(t, err)
+	assert.Equal(t, &Report{
+		Bucket:    "lake",
+		Source:    SourceInventory,
+		Inventory: "s3://reports/inventory/lake/daily/2020-11-01T00-00Z/manifest.json",
+		NumOther:  2,
+		Rows:      testRows,
+		Databases: testTotals,
+	}, report)
+	assert.Len(t, checkpoint, 2)
+
+	location, err = lister.FindInventory(context.Background(), "other")
+	require.NoError(t, err)
+	assert.Nil(t, location)
+}
+
+func TestWriteCSV(t *testing.T) {
+	report := &Report{
+		Rows:      testRows[:1],
+		Databases: testTotals[:1],
+	}
+	var buffer bytes.Buffer
+	require.NoError(t, report.WriteCSV(&buffer))
+	assert.Equal(t, `database,table,logType,month,numObjects,numBytes
+panther_logs,aws_cloudtrail,AWS.CloudTrail,2020-11,3,60
+panther_logs,,,total,5,107
+`, buffer.String())
+}
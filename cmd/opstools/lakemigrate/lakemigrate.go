@@ -0,0 +1,462 @@
+package lakemigrate
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/glue/glueiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/panther-labs/panther/internal/log_analysis/awsglue"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+)
+
+const (
+	// MaxCopySize is the largest object CopyObject can copy, larger objects are copied in parts
+	MaxCopySize = 5 * 1024 * 1024 * 1024
+	// DefaultPartSize is the part size of multipart copies
+	DefaultPartSize = 512 * 1024 * 1024
+
+	pageSize = 1000
+)
+
+// Table is a table of a log type
+type Table struct {
+	Database string `json:"database"`
+	Name     string `json:"name"`
+	LogType  string `json:"logType"`
+}
+
+// LogTypeTables returns the tables of the log types in the databases, skipping databases a log type is not in
+func LogTypeTables(logTypes, databases []string) (tables []Table) {
+	for _, logType := range logTypes {
+		for _, database := range databases {
+			if pantherdb.IsInDatabase(logType, database) {
+				tables = append(tables, Table{
+					Database: database,
+					Name:     pantherdb.TableName(logType),
+					LogType:  logType,
+				})
+			}
+		}
+	}
+	return tables
+}
+
+// Partition is an hourly partition of a table
+type Partition struct {
+	Table Table
+	Hour  time.Time
+}
+
+// ID identifies the partition in checkpoints
+func (p *Partition) ID() string {
+	return fmt.Sprintf("%s.%s/%s", p.Table.Database, p.Table.Name, p.Hour.Format("2006-01-02T15"))
+}
+
+// Prefix is the key prefix of the partition objects
+func (p *Partition) Prefix() string {
+	return awsglue.PartitionPrefix(p.Table.Database, p.Table.Name, awsglue.GlueTableHourly, p.Hour)
+}
+
+// Checkpoint records the migrated partitions so an interrupted migration can resume
+type Checkpoint interface {
+	IsDone(partitionID string) bool
+	Done(partitionID string) error
+}
+
+type Config struct {
+	SourceBucket string
+	DestBucket   string
+	// DestKMSKeyID if set encrypts the copies with this KMS key, otherwise the destination bucket default is used
+	DestKMSKeyID string
+	Tables       []Table
+	// Start and End (exclusive) are truncated to the hour
+	Start time.Time
+	End   time.Time
+	// Concurrency is the number of concurrent copies within a partition
+	Concurrency int
+	PartSize    int64
+	// NotifyTopicARN if set, notifications for the copied objects are published to this topic
+	NotifyTopicARN string
+}
+
+type Stats struct {
+	NumPartitions        uint64
+	NumSkippedPartitions uint64 // done in a previous run
+	NumObjects           uint64
+	NumSkippedObjects    uint64 // already in the destination
+	NumBytes             uint64
+}
+
+// Migrator copies partitions between buckets, it never deletes objects
+type Migrator struct {
+	S3   s3iface.S3API
+	Glue glueiface.GlueAPI
+	SNS  snsiface.SNSAPI // only needed if notifications are published
+	// Throttle if set limits the rate of copies
+	Throttle *Throttle
+
+	mu sync.Mutex // protects stats updates by concurrent copies
+}
+
+// Migrate copies the partitions one at a time, after a partition is copied and verified,
+// its Glue partition location is moved to the destination bucket.
+func (m *Migrator) Migrate(ctx context.Context, config *Config, checkpoint Checkpoint, stats *Stats) error {
+	if config.SourceBucket == config.DestBucket {
+		return errors.New("source and destination buckets must be different")
+	}
+	if config.Concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	if config.PartSize < 5*1024*1024 || config.PartSize > MaxCopySize {
+		return errors.New("part size must be between 5MB and 5GB")
+	}
+	start, end := config.Start.UTC().Truncate(time.Hour), config.End.UTC().Truncate(time.Hour)
+	if !start.Before(end) {
+		return errors.Errorf("start %s must be before end %s", start, end)
+	}
+
+	for _, table := range config.Tables {
+		for hour := start; hour.Before(end); hour = hour.Add(time.Hour) {
+			partition := &Partition{Table: table, Hour: hour}
+			if checkpoint.IsDone(partition.ID()) {
+				stats.NumSkippedPartitions++
+				continue
+			}
+			if err := m.migratePartition(ctx, config, partition, stats); err != nil {
+				return errors.WithMessagef(err, "failed to migrate %s", partition.ID())
+			}
+			if err := checkpoint.Done(partition.ID()); err != nil {
+				return err
+			}
+			stats.NumPartitions++
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) migratePartition(ctx context.Context, config *Config, partition *Partition, stats *Stats) error {
+	sources, err := m.listObjects(ctx, config.SourceBucket, partition.Prefix())
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	existing, err := m.listObjects(ctx, config.DestBucket, partition.Prefix())
+	if err != nil {
+		return err
+	}
+
+	var copied []string
+	objects := make(chan string)
+	group, groupCtx := errgroup.WithContext(ctx)
+	for i := 0; i < config.Concurrency; i++ {
+		group.Go(func() error {
+			for key := range objects {
+				if err := m.copyObject(groupCtx, config, key, sources[key]); err != nil {
+					return err
+				}
+				m.mu.Lock()
+				copied = append(copied, key)
+				stats.NumObjects++
+				stats.NumBytes += uint64(sources[key])
+				m.mu.Unlock()
+			}
+			return nil
+		})
+	}
+	group.Go(func() error {
+		defer close(objects)
+		for key, size := range sources {
+			if existingSize, found := existing[key]; found && existingSize == size { // copied by a previous run
+				m.mu.Lock()
+				stats.NumSkippedObjects++
+				m.mu.Unlock()
+				continue
+			}
+			select {
+			case objects <- key:
+			case <-groupCtx.Done():
+				return groupCtx.Err()
+			}
+		}
+		return nil
+	})
+	if err := group.Wait(); err != nil {
+		return err
+	}
+
+	if err := m.verify(ctx, config, partition, sources); err != nil {
+		return err
+	}
+	if err := m.updateGluePartition(config, partition); err != nil {
+		return err
+	}
+	if config.NotifyTopicARN != "" {
+		return m.notify(config, partition, copied, sources)
+	}
+	return nil
+}
+
+// listObjects returns the sizes of the objects under a prefix by key
+func (m *Migrator) listObjects(ctx context.Context, bucket, prefix string) (map[string]int64, error) {
+	objects := make(map[string]int64)
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(pageSize),
+	}
+	err := m.S3.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, value := range page.Contents {
+			objects[aws.StringValue(value.Key)] = aws.Int64Value(value.Size)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list s3://%s/%s", bucket, prefix)
+	}
+	return objects, nil
+}
+
+func (m *Migrator) copyObject(ctx context.Context, config *Config, key string, size int64) error {
+	if err := m.Throttle.Wait(ctx, size); err != nil {
+		return err
+	}
+	copySource := url.PathEscape(config.SourceBucket + "/" + key)
+	var sse, kmsKeyID *string
+	if config.DestKMSKeyID != "" {
+		sse, kmsKeyID = aws.String(s3.ServerSideEncryptionAwsKms), aws.String(config.DestKMSKeyID)
+	}
+
+	if size <= MaxCopySize {
+		_, err := m.S3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:               aws.String(config.DestBucket),
+			Key:                  aws.String(key),
+			CopySource:           aws.String(copySource),
+			ServerSideEncryption: sse,
+			SSEKMSKeyId:          kmsKeyID,
+		})
+		return errors.Wrapf(err, "failed to copy s3://%s/%s", config.SourceBucket, key)
+	}
+
+	upload, err := m.S3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(config.DestBucket),
+		Key:                  aws.String(key),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to start multipart copy of s3://%s/%s", config.SourceBucket, key)
+	}
+	var parts []*s3.CompletedPart
+	for offset, partNumber := int64(0), int64(1); offset < size; offset, partNumber = offset+config.PartSize, partNumber+1 {
+		last := offset + config.PartSize - 1
+		if last >= size {
+			last = size - 1
+		}
+		part, err := m.S3.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(config.DestBucket),
+			Key:             aws.String(key),
+			CopySource:      aws.String(copySource),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, last)),
+			PartNumber:      aws.Int64(partNumber),
+			UploadId:        upload.UploadId,
+		})
+		if err != nil {
+			m.abortUpload(config, key, upload.UploadId)
+			return errors.Wrapf(err, "failed to copy part %d of s3://%s/%s", partNumber, config.SourceBucket, key)
+		}
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       part.CopyPartResult.ETag,
+			PartNumber: aws.Int64(partNumber),
+		})
+	}
+	_, err = m.S3.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(config.DestBucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		m.abortUpload(config, key, upload.UploadId)
+		return errors.Wrapf(err, "failed to complete multipart copy of s3://%s/%s", config.SourceBucket, key)
+	}
+	return nil
+}
+
+func (m *Migrator) abortUpload(config *Config, key string, uploadID *string) {
+	// not canceled with the copy, the parts would be billed until the bucket lifecycle removes them
+	_, err := m.S3.AbortMultipartUploadWithContext(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(config.DestBucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		zap.L().Warn("failed to abort multipart copy", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// verify checks every source object is in the destination with the same size
+func (m *Migrator) verify(ctx context.Context, config *Config, partition *Partition, sources map[string]int64) error {
+	copies, err := m.listObjects(ctx, config.DestBucket, partition.Prefix())
+	if err != nil {
+		return err
+	}
+	var numMissing int
+	for key, size := range sources {
+		if copySize, found := copies[key]; !found || copySize != size {
+			numMissing++
+		}
+	}
+	if numMissing > 0 {
+		return errors.Errorf("%d of %d objects are missing in s3://%s/%s",
+			numMissing, len(sources), config.DestBucket, partition.Prefix())
+	}
+	return nil
+}
+
+func (m *Migrator) updateGluePartition(config *Config, partition *Partition) error {
+	values := awsglue.GlueTableHourly.PartitionValuesFromTime(partition.Hour)
+	output, err := awsglue.GetPartition(m.Glue, partition.Table.Database, partition.Table.Name, values)
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == glue.ErrCodeEntityNotFoundException {
+			// gluerecover creates missing partitions from the objects
+			zap.L().Warn("no glue partition to update", zap.String("partition", partition.ID()))
+			return nil
+		}
+		return errors.Wrapf(err, "failed to get glue partition %s", partition.ID())
+	}
+	descriptor := output.Partition.StorageDescriptor
+	location := aws.StringValue(descriptor.Location)
+	sourcePrefix, destPrefix := "s3://"+config.SourceBucket+"/", "s3://"+config.DestBucket+"/"
+	if !strings.HasPrefix(location, sourcePrefix) {
+		if strings.HasPrefix(location, destPrefix) { // moved by a previous run
+			return nil
+		}
+		return errors.Errorf("glue partition %s location %s is not in the source bucket", partition.ID(), location)
+	}
+	descriptor.Location = aws.String(destPrefix + strings.TrimPrefix(location, sourcePrefix))
+	_, err = awsglue.UpdatePartition(m.Glue, partition.Table.Database, partition.Table.Name, values,
+		descriptor, output.Partition.Parameters)
+	return errors.Wrapf(err, "failed to update glue partition %s", partition.ID())
+}
+
+func (m *Migrator) notify(config *Config, partition *Partition, keys []string, sizes map[string]int64) error {
+	dataType, err := DataType(partition.Table.Database)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		message, err := jsoniter.MarshalToString(notify.NewS3ObjectPutNotification(config.DestBucket, key, int(sizes[key])))
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal notification")
+		}
+		_, err = m.SNS.Publish(&sns.PublishInput{
+			TopicArn:          aws.String(config.NotifyTopicARN),
+			Message:           aws.String(message),
+			MessageAttributes: notify.NewLogAnalysisSNSMessageAttributes(dataType, partition.Table.LogType),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to notify %s of s3://%s/%s", config.NotifyTopicARN, config.DestBucket, key)
+		}
+	}
+	return nil
+}
+
+// DataType returns the data type of the tables in a database
+func DataType(database string) (pantherdb.DataType, error) {
+	for _, dataType := range []pantherdb.DataType{
+		pantherdb.LogData,
+		pantherdb.RuleData,
+		pantherdb.RuleErrors,
+		pantherdb.CloudSecurity,
+	} {
+		if pantherdb.DatabaseName(dataType) == database {
+			return dataType, nil
+		}
+	}
+	return "", errors.Errorf("no data type for database %s", database)
+}
+
+// Throttle limits the rate of requests and bytes, it is safe for concurrent use
+type Throttle struct {
+	// RequestsPerSecond and BytesPerSecond are unlimited if zero
+	RequestsPerSecond float64
+	BytesPerSecond    float64
+
+	mu   sync.Mutex
+	next time.Time // when the next request can start
+}
+
+// Wait blocks until a request of size bytes can start, a nil throttle does not block
+func (t *Throttle) Wait(ctx context.Context, size int64) error {
+	if t == nil {
+		return nil
+	}
+	var interval time.Duration
+	if t.RequestsPerSecond > 0 {
+		interval = time.Duration(float64(time.Second) / t.RequestsPerSecond)
+	}
+	if t.BytesPerSecond > 0 {
+		if bytesInterval := time.Duration(float64(size) / t.BytesPerSecond * float64(time.Second)); bytesInterval > interval {
+			interval = bytesInterval
+		}
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	start := t.next
+	t.next = t.next.Add(interval) // reserve the slot
+	t.mu.Unlock()
+
+	if !start.After(now) {
+		return nil
+	}
+	timer := time.NewTimer(start.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/lakemigrate"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+)
+
+// fileCheckpoint appends the ids of migrated partitions to a file, one per line
+type fileCheckpoint struct {
+	file *os.File
+	done map[string]bool
+}
+
+func openCheckpoint(path string) (*fileCheckpoint, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &fileCheckpoint{
+		file: file,
+		done: make(map[string]bool),
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			checkpoint.done[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	return checkpoint, nil
+}
+
+func (c *fileCheckpoint) IsDone(partitionID string) bool {
+	return c.done[partitionID]
+}
+
+func (c *fileCheckpoint) Done(partitionID string) error {
+	c.done[partitionID] = true
+	if _, err := fmt.Fprintln(c.file, partitionID); err != nil {
+		return errors.Wrapf(err, "failed to write checkpoint %s", c.file.Name())
+	}
+	return c.file.Sync()
+}
+
+func main() {
+	opstools.SetUsage("copies data lake partitions to a new bucket and moves their Glue partitions to it (source data are kept)")
+	opts := struct {
+		SourceBucket      *string
+		DestBucket        *string
+		DestKMSKey        *string
+		LogTypes          *string
+		Databases         *string
+		Start             *string
+		End               *string
+		Checkpoint        *string
+		Concurrency       *int
+		PartSizeMB        *int64
+		RequestsPerSecond *float64
+		MBPerSecond       *float64
+		NotifyTopic       *string
+		Debug             *bool
+		Region            *string
+		MaxRetries        *int
+		MaxConnections    *int
+	}{
+		SourceBucket: flag.String("source-bucket", "", "The bucket to copy from"),
+		DestBucket:   flag.String("dest-bucket", "", "The bucket to copy to"),
+		DestKMSKey:   flag.String("dest-kms-key", "", "If set, encrypt the copies with this KMS key (otherwise the bucket default)"),
+		LogTypes:     flag.String("log-types", "", "Comma separated list of log types to migrate"),
+		Databases: flag.String("databases", strings.Join([]string{
+			pantherdb.LogProcessingDatabase,
+			pantherdb.RuleMatchDatabase,
+			pantherdb.RuleErrorsDatabase,
+			pantherdb.CloudSecurityDatabase,
+		}, ","), "Comma separated list of databases to migrate the log types tables of"),
+		Start:             flag.String("start", "", "Migrate partitions from this date YYYY-MM-DD"),
+		End:               flag.String("end", "", "Migrate partitions until this date YYYY-MM-DD (exclusive)"),
+		Checkpoint:        flag.String("checkpoint", "", "The file recording migrated partitions, a migration with it resumes"),
+		Concurrency:       flag.Int("concurrency", 20, "The number of concurrent copies"),
+		PartSizeMB:        flag.Int64("part-size", lakemigrate.DefaultPartSize/(1024*1024), "The part size in MB of multipart copies"),
+		RequestsPerSecond: flag.Float64("requests-per-second", 0, "If non-zero, limit the copies to this rate"),
+		MBPerSecond:       flag.Float64("mb-per-second", 0, "If non-zero, limit the copied data to this rate"),
+		NotifyTopic:       flag.String("notify-topic", "", "If set, publish a notification for each copied object to this topic"),
+		Debug:             flag.Bool("debug", false, "Enable additional logging"),
+		Region:            flag.String("region", "", "Set the AWS region to run on"),
+		MaxRetries:        flag.Int("max-retries", 12, "Max retries for AWS requests"),
+		MaxConnections:    flag.Int("max-connections", 100, "Max number of connections to AWS"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+	zap.ReplaceGlobals(log.Desugar()) // for the migration warnings
+
+	if *opts.SourceBucket == "" || *opts.DestBucket == "" || *opts.LogTypes == "" || *opts.Checkpoint == "" {
+		flag.Usage()
+		log.Fatal("-source-bucket, -dest-bucket, -log-types and -checkpoint must be set")
+	}
+	start, err := parseDate(*opts.Start)
+	if err != nil {
+		log.Fatalf("-start: %s", err)
+	}
+	end, err := parseDate(*opts.End)
+	if err != nil {
+		log.Fatalf("-end: %s", err)
+	}
+
+	config := &lakemigrate.Config{
+		SourceBucket:   *opts.SourceBucket,
+		DestBucket:     *opts.DestBucket,
+		DestKMSKeyID:   *opts.DestKMSKey,
+		Tables:         lakemigrate.LogTypeTables(strings.Split(*opts.LogTypes, ","), strings.Split(*opts.Databases, ",")),
+		Start:          start,
+		End:            end,
+		Concurrency:    *opts.Concurrency,
+		PartSize:       *opts.PartSizeMB * 1024 * 1024,
+		NotifyTopicARN: *opts.NotifyTopic,
+	}
+
+	checkpoint, err := openCheckpoint(*opts.Checkpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer checkpoint.file.Close()
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region:     opts.Region,
+		MaxRetries: opts.MaxRetries,
+		HTTPClient: opstools.NewHTTPClient(*opts.MaxConnections, 0),
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+	migrator := &lakemigrate.Migrator{
+		S3:   s3.New(sess),
+		Glue: glue.New(sess),
+		SNS:  sns.New(sess),
+	}
+	if *opts.RequestsPerSecond > 0 || *opts.MBPerSecond > 0 {
+		migrator.Throttle = &lakemigrate.Throttle{
+			RequestsPerSecond: *opts.RequestsPerSecond,
+			BytesPerSecond:    *opts.MBPerSecond * 1024 * 1024,
+		}
+	}
+
+	startTime := time.Now()
+	stats := &lakemigrate.Stats{}
+	err = migrator.Migrate(context.Background(), config, checkpoint, stats)
+	opstools.LogSkipped(log)
+	log.Infof("migrated %d partitions (%d done before), copied %d objects (%.2fMB, %d already copied) in %v",
+		stats.NumPartitions, stats.NumSkippedPartitions, stats.NumObjects, float32(stats.NumBytes)/(1024.0*1024.0),
+		stats.NumSkippedObjects, time.Since(startTime))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func parseDate(input string) (time.Time, error) {
+	const layoutDate = "2006-01-02"
+	tm, err := time.Parse(layoutDate, input)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "failed to parse %q as date (YYYY-MM-DD)", input)
+	}
+	return tm, nil
+}
@@ -0,0 +1,197 @@
+package lakemigrate
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+const (
+	prefix = "logs/aws_cloudtrail/year=2020/month=11/day=01/hour=00/"
+)
+
+var testStart = time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+
+type testCheckpoint map[string]bool
+
+func (c testCheckpoint) IsDone(partitionID string) bool {
+	return c[partitionID]
+}
+
+func (c testCheckpoint) Done(partitionID string) error {
+	c[partitionID] = true
+	return nil
+}
+
+func listInput(bucket string) interface{} {
+	return mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return aws.StringValue(input.Bucket) == bucket && aws.StringValue(input.Prefix) == prefix
+	})
+}
+
+func listOutput(sizes map[string]int64) *s3.ListObjectsV2Output {
+	output := &s3.ListObjectsV2Output{}
+	for key, size := range sizes {
+		output.Contents = append(output.Contents, &s3.Object{Key: aws.String(prefix + key), Size: aws.Int64(size)})
+	}
+	return output
+}
+
+func TestLogTypeTables(t *testing.T) {
+	assert.Equal(t, []Table{
+		{Database: pantherdb.LogProcessingDatabase, Name: "aws_cloudtrail", LogType: "AWS.CloudTrail"},
+		{Database: pantherdb.RuleMatchDatabase, Name: "aws_cloudtrail", LogType: "AWS.CloudTrail"},
+	}, LogTypeTables([]string{"AWS.CloudTrail"}, []string{
+		pantherdb.LogProcessingDatabase,
+		pantherdb.RuleMatchDatabase,
+		pantherdb.CloudSecurityDatabase,
+	}))
+}
+
+func TestMigrate(t *testing.T) {
+	s3Client := &testutils.S3Mock{}
+	glueClient := &testutils.GlueMock{}
+	snsClient := &testutils.SnsMock{}
+
+	s3Client.On("ListObjectsV2PagesWithContext", mock.Anything, listInput("old"), mock.Anything, mock.Anything).
+		Return(listOutput(map[string]int64{"a.json.gz": 10, "b.json.gz": 20}), nil).Once()
+	// a was copied by a previous run
+	s3Client.On("ListObjectsV2PagesWithContext", mock.Anything, listInput("new"), mock.Anything, mock.Anything).
+		Return(listOutput(map[string]int64{"a.json.gz": 10}), nil).Once()
+	s3Client.On("CopyObjectWithContext", mock.Anything, &s3.CopyObjectInput{
+		Bucket:               aws.String("new"),
+		Key:                  aws.String(prefix + "b.json.gz"),
+		CopySource:           aws.String("old%2F" + "logs%2Faws_cloudtrail%2Fyear=2020%2Fmonth=11%2Fday=01%2Fhour=00%2Fb.json.gz"),
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAwsKms),
+		SSEKMSKeyId:          aws.String("key"),
+	}, mock.Anything).Return(&s3.CopyObjectOutput{}, nil).Once()
+	// verification
+	s3Client.On("ListObjectsV2PagesWithContext", mock.Anything, listInput("new"), mock.Anything, mock.Anything).
+		Return(listOutput(map[string]int64{"a.json.gz": 10, "b.json.gz": 20}), nil).Once()
+
+	partitionValues := aws.StringSlice([]string{"2020", "11", "01", "00"})
+	glueClient.On("GetPartition", &glue.GetPartitionInput{
+		DatabaseName:    aws.String(pantherdb.LogProcessingDatabase),
+		TableName:       aws.String("aws_cloudtrail"),
+		PartitionValues: partitionValues,
+	}).Return(&glue.GetPartitionOutput{
+		Partition: &glue.Partition{
+			StorageDescriptor: &glue.StorageDescriptor{Location: aws.String("s3://old/" + prefix)},
+		},
+	}, nil).Once()
+	glueClient.On("UpdatePartition", mock.MatchedBy(func(input *glue.UpdatePartitionInput) bool {
+		return aws.StringValue(input.PartitionInput.StorageDescriptor.Location) == "s3://new/"+prefix
+	})).Return(&glue.UpdatePartitionOutput{}, nil).Once()
+
+	snsClient.On("Publish", mock.MatchedBy(func(input *sns.PublishInput) bool {
+		return aws.StringValue(input.TopicArn) == "topic" &&
+			aws.StringValue(input.MessageAttributes["id"].StringValue) == "AWS.CloudTrail" &&
+			aws.StringValue(input.MessageAttributes["type"].StringValue) == string(pantherdb.LogData)
+	})).Return(&sns.PublishOutput{}, nil).Once()
+
+	migrator := &Migrator{S3: s3Client, Glue: glueClient, SNS: snsClient}
+	checkpoint := testCheckpoint{}
+	stats := &Stats{}
+	err := migrator.Migrate(context.Background(), &Config{
+		SourceBucket:   "old",
+		DestBucket:     "new",
+		DestKMSKeyID:   "key",
+		Tables:         LogTypeTables([]string{"AWS.CloudTrail"}, []string{pantherdb.LogProcessingDatabase}),
+		Start:          testStart,
+		End:            testStart.Add(time.Hour),
+		Concurrency:    2,
+		PartSize:       DefaultPartSize,
+		NotifyTopicARN: "topic",
+	}, checkpoint, stats)
+	require.NoError(t, err)
+	s3Client.AssertExpectations(t)
+	glueClient.AssertExpectations(t)
+	snsClient.AssertExpectations(t)
+	assert.Equal(t, &Stats{NumPartitions: 1, NumObjects: 1, NumSkippedObjects: 1, NumBytes: 20}, stats)
+	assert.Equal(t, testCheckpoint{"panther_logs.aws_cloudtrail/2020-11-01T00": true}, checkpoint)
+
+	// resuming skips the partition
+	stats = &Stats{}
+	err = migrator.Migrate(context.Background(), &Config{
+		SourceBucket: "old",
+		DestBucket:   "new",
+		Tables:       LogTypeTables([]string{"AWS.CloudTrail"}, []string{pantherdb.LogProcessingDatabase}),
+		Start:        testStart,
+		End:          testStart.Add(time.Hour),
+		Concurrency:  2,
+		PartSize:     DefaultPartSize,
+	}, checkpoint, stats)
+	require.NoError(t, err)
+	assert.Equal(t, &Stats{NumSkippedPartitions: 1}, stats)
+}
+
+func TestMultipartCopy(t *testing.T) {
+	const size = MaxCopySize + 1
+	s3Client := &testutils.S3Mock{}
+	s3Client.On("CreateMultipartUploadWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return(&s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil).Once()
+	s3Client.On("UploadPartCopyWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return(&s3.UploadPartCopyOutput{CopyPartResult: &s3.CopyPartResult{ETag: aws.String("etag")}}, nil)
+	s3Client.On("CompleteMultipartUploadWithContext", mock.Anything, mock.MatchedBy(func(input *s3.CompleteMultipartUploadInput) bool {
+		return len(input.MultipartUpload.Parts) == 3
+	}), mock.Anything).Return(&s3.CompleteMultipartUploadOutput{}, nil).Once()
+
+	migrator := &Migrator{S3: s3Client}
+	err := migrator.copyObject(context.Background(), &Config{
+		SourceBucket: "old",
+		DestBucket:   "new",
+		PartSize:     MaxCopySize / 2,
+	}, "key", size)
+	require.NoError(t, err)
+	s3Client.AssertExpectations(t)
+	// the last part has the remaining byte
+	lastPart := s3Client.Calls[3].Arguments.Get(1).(*s3.UploadPartCopyInput)
+	assert.Equal(t, "bytes=5368709120-5368709120", aws.StringValue(lastPart.CopySourceRange))
+}
+
+func TestThrottle(t *testing.T) {
+	var throttle *Throttle
+	assert.NoError(t, throttle.Wait(context.Background(), 100)) // nil does not throttle
+
+	throttle = &Throttle{BytesPerSecond: 1000}
+	start := time.Now()
+	require.NoError(t, throttle.Wait(context.Background(), 20))
+	require.NoError(t, throttle.Wait(context.Background(), 20))
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	// the slot reserved by the first request is a second away
+	throttle = &Throttle{BytesPerSecond: 1000}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.NoError(t, throttle.Wait(ctx, 1000))
+	assert.Error(t, throttle.Wait(ctx, 1))
+}
@@ -19,6 +19,7 @@ package opstools
  */
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -31,10 +32,13 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/hashicorp/go-cleanhttp"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	"github.com/panther-labs/panther/cmd/opstools/runlog"
 	"github.com/panther-labs/panther/pkg/awscfn"
 	"github.com/panther-labs/panther/tools/cfnstacks"
 )
@@ -53,6 +57,7 @@ func MustBuildLogger(debug bool) *zap.SugaredLogger {
 	if err != nil {
 		log.Fatalf("failed to build logger: %s", err)
 	}
+	DefaultGuard.Log = logger.Sugar()
 	return logger.Sugar()
 }
 
@@ -74,6 +79,50 @@ func SetUsage(banner string, args ...interface{}) {
 	}
 }
 
+// StartRun records the start of the tool run for audit in the destination set by runlog.DestinationEnv.
+// The run is recorded in runlog.DefaultDir if the destination is unreachable, it exits if it cannot be recorded at all.
+func StartRun(sess *session.Session, log *zap.SugaredLogger) *runlog.Run {
+	return StartRunWithID(sess, log, "")
+}
+
+// StartRunWithID is StartRun recording the run with an ID, e.g. the ID of a back-fill run. A new ID is used if empty.
+func StartRunWithID(sess *session.Session, log *zap.SugaredLogger, id string) *runlog.Run {
+	store, err := runlog.NewStore(sess, os.Getenv(runlog.DestinationEnv))
+	if err != nil {
+		log.Fatalf("%s: %s", runlog.DestinationEnv, err)
+	}
+	run := &runlog.Run{
+		Record:   runlog.Record{ID: id},
+		Store:    store,
+		Fallback: &runlog.FileStore{Dir: runlog.DefaultDir()},
+		OnFallback: func(err error) {
+			log.Warnf("recorded run in %s: %s", runlog.DefaultDir(), err)
+		},
+	}
+	if err := run.Start(context.Background(), sts.New(sess), filepath.Base(os.Args[0]), os.Args[1:]); err != nil {
+		log.Fatalf("failed to record run: %s", err)
+	}
+	return run
+}
+
+// FindRun returns the record of a run started since a time from the runlog.DestinationEnv destination or
+// runlog.DefaultDir, nil if neither has it
+func FindRun(ctx context.Context, sess *session.Session, id string, since time.Time) (*runlog.Record, error) {
+	store, err := runlog.NewStore(sess, os.Getenv(runlog.DestinationEnv))
+	if err != nil {
+		return nil, errors.Wrap(err, runlog.DestinationEnv)
+	}
+	return runlog.FindRecord(ctx, id, since, store, &runlog.FileStore{Dir: runlog.DefaultDir()})
+}
+
+// EndRun records the outcome of a run started by StartRun, stats is any value that marshals to JSON
+func EndRun(run *runlog.Run, log *zap.SugaredLogger, stats interface{}, runErr error) {
+	LogSkipped(log)
+	if err := run.End(context.Background(), stats, runErr); err != nil {
+		log.Errorf("failed to record the end of run %s: %s", run.Record.ID, err)
+	}
+}
+
 // ValidatePantherVersion checks that the compiled version matches deployed version, if not log.Fatal()
 func ValidatePantherVersion(sess *session.Session, log *zap.SugaredLogger, masterStack, compiledVersion string) {
 	cfnClient := cloudformation.New(sess)
@@ -0,0 +1,348 @@
+package partitiongaps
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/glue/glueiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/panther-labs/panther/internal/log_analysis/awsglue"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+	"github.com/panther-labs/panther/pkg/metrics"
+)
+
+const (
+	// LagMetric is the time from the newest partition to the newest S3 data in the window, in seconds
+	LagMetric = "PartitionLag"
+	// MissingMetric is the number of time bins in the window with S3 data but no partition
+	MissingMetric = "MissingPartitions"
+
+	maxMetricsPerPut = 20
+)
+
+// DefaultDatabases are the Panther databases with tables partitioned by time
+var DefaultDatabases = []string{
+	pantherdb.LogProcessingDatabase,
+	pantherdb.CloudSecurityDatabase,
+	pantherdb.RuleMatchDatabase,
+	pantherdb.RuleErrorsDatabase,
+}
+
+type Config struct {
+	Databases []string
+	// Window is how far back partitions and S3 data are checked, the S3 listing is bounded to it
+	Window time.Duration
+	// MaxLag flags tables whose newest partition is older than the newest S3 data by more than this
+	MaxLag time.Duration
+	// Concurrency is the number of tables checked in parallel
+	Concurrency int
+	Now         time.Time
+}
+
+// TableReport is the state of the recent partitions of a table
+type TableReport struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	Timebin  string `json:"timebin,omitempty"`
+	// LatestPartition is the newest partition in the window, nil if there is none
+	LatestPartition *time.Time `json:"latestPartition"`
+	// LatestData is the newest time bin in the window with S3 data, nil if there is none
+	LatestData *time.Time `json:"latestData"`
+	// LagSeconds is the time from LatestPartition (or the window start) to LatestData
+	LagSeconds float64 `json:"lagSeconds"`
+	// MissingPartitions are the time bins with S3 data but no partition
+	MissingPartitions []time.Time `json:"missingPartitions,omitempty"`
+	Flagged           bool        `json:"flagged"`
+	Reasons           []string    `json:"reasons,omitempty"`
+	Error             string      `json:"error,omitempty"`
+}
+
+type Report struct {
+	GeneratedAt time.Time      `json:"generatedAt"`
+	WindowStart time.Time      `json:"windowStart"`
+	NumTables   int            `json:"numTables"`
+	NumFlagged  int            `json:"numFlagged"`
+	NumErrors   int            `json:"numErrors"`
+	Tables      []*TableReport `json:"tables"`
+}
+
+// Finder finds the tables with missing recent partitions
+type Finder struct {
+	Glue glueiface.GlueAPI
+	S3   s3iface.S3API
+}
+
+// Find checks every table of the databases, errors checking a table are reported in its TableReport
+func (f *Finder) Find(ctx context.Context, config *Config) (*Report, error) {
+	now := config.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	now = now.UTC()
+	report := &Report{
+		GeneratedAt: now,
+		WindowStart: now.Add(-config.Window),
+		Tables:      []*TableReport{},
+	}
+	var tables []*glue.TableData
+	for _, database := range config.Databases {
+		input := &glue.GetTablesInput{DatabaseName: aws.String(database)}
+		err := f.Glue.GetTablesPagesWithContext(ctx, input, func(page *glue.GetTablesOutput, _ bool) bool {
+			tables = append(tables, page.TableList...)
+			return true
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list the tables of %s", database)
+		}
+	}
+
+	concurrency := config.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var mu sync.Mutex
+	semaphore := make(chan struct{}, concurrency)
+	group, ctx := errgroup.WithContext(ctx)
+	for _, table := range tables {
+		table := table
+		semaphore <- struct{}{}
+		group.Go(func() error {
+			defer func() {
+				<-semaphore
+			}()
+			tableReport := f.checkTable(ctx, table, report.WindowStart, now, config.MaxLag)
+			mu.Lock()
+			defer mu.Unlock()
+			report.Tables = append(report.Tables, tableReport)
+			return ctx.Err()
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(report.Tables, func(i, j int) bool {
+		a, b := report.Tables[i], report.Tables[j]
+		if a.Database != b.Database {
+			return a.Database < b.Database
+		}
+		return a.Table < b.Table
+	})
+	for _, table := range report.Tables {
+		report.NumTables++
+		if table.Flagged {
+			report.NumFlagged++
+		}
+		if table.Error != "" {
+			report.NumErrors++
+		}
+	}
+	return report, nil
+}
+
+func (f *Finder) checkTable(ctx context.Context, table *glue.TableData, windowStart, now time.Time,
+	maxLag time.Duration) *TableReport {
+
+	report := &TableReport{
+		Database: aws.StringValue(table.DatabaseName),
+		Table:    aws.StringValue(table.Name),
+	}
+	if len(table.PartitionKeys) == 0 {
+		return report // not partitioned, e.g. views
+	}
+	bin, err := awsglue.TimebinFromTable(table)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Timebin = timebinName(bin)
+	start := bin.Truncate(windowStart)
+	partitions, err := f.partitionsSince(ctx, report.Database, report.Table, bin, start)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	if table.StorageDescriptor == nil || table.StorageDescriptor.Location == nil {
+		report.Error = "table has no location"
+		return report
+	}
+	bucket, prefix, err := awsglue.ParseS3URL(*table.StorageDescriptor.Location)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	for tm := start; !tm.After(now); tm = bin.Next(tm) {
+		if partitions[tm] {
+			report.LatestPartition = timePtr(tm)
+		}
+		hasData, err := f.hasData(ctx, bucket, path.Join(prefix, bin.PartitionPathS3(tm))+"/")
+		if err != nil {
+			report.Error = err.Error()
+			return report
+		}
+		if !hasData {
+			continue
+		}
+		report.LatestData = timePtr(tm)
+		if !partitions[tm] {
+			report.MissingPartitions = append(report.MissingPartitions, tm)
+		}
+	}
+
+	if report.LatestData != nil {
+		from := start
+		if report.LatestPartition != nil {
+			from = *report.LatestPartition
+		}
+		if lag := report.LatestData.Sub(from); lag > 0 {
+			report.LagSeconds = lag.Seconds()
+			if lag > maxLag {
+				report.Reasons = append(report.Reasons, "newest partition lags newest S3 data")
+			}
+		}
+	}
+	if len(report.MissingPartitions) > 0 {
+		report.Reasons = append(report.Reasons, "S3 data without partitions")
+	}
+	report.Flagged = len(report.Reasons) > 0
+	return report
+}
+
+// partitionsSince returns the times of the partitions from start
+func (f *Finder) partitionsSince(ctx context.Context, database, table string, bin awsglue.GlueTableTimebin,
+	start time.Time) (map[time.Time]bool, error) {
+
+	partitions := make(map[time.Time]bool)
+	input := &glue.GetPartitionsInput{
+		DatabaseName: aws.String(database),
+		TableName:    aws.String(table),
+		// partitions after the bin before start
+		Expression: aws.String(bin.PartitionsAfter(start.Add(-time.Nanosecond))),
+	}
+	err := f.Glue.GetPartitionsPagesWithContext(ctx, input, func(page *glue.GetPartitionsOutput, _ bool) bool {
+		for _, partition := range page.Partitions {
+			if tm, err := awsglue.PartitionTimeFromValues(partition.Values); err == nil {
+				partitions[tm] = true
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get partitions of %s.%s", database, table)
+	}
+	return partitions, nil
+}
+
+// hasData returns true if there is a non-empty object under the prefix
+func (f *Finder) hasData(ctx context.Context, bucket, prefix string) (bool, error) {
+	// a small page avoids listing a whole partition, more pages are listed only if the objects are empty
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(100),
+	}
+	hasData := false
+	err := f.S3.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			if aws.Int64Value(object.Size) > 0 {
+				hasData = true
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to list s3://%s/%s", bucket, prefix)
+	}
+	return hasData, nil
+}
+
+// PutMetrics puts the lag and the number of missing partitions of every table checked without error
+func PutMetrics(ctx context.Context, cw cloudwatchiface.CloudWatchAPI, report *Report) error {
+	var data []*cloudwatch.MetricDatum
+	for _, table := range report.Tables {
+		if table.Error != "" || table.Timebin == "" {
+			continue
+		}
+		dimensions := []*cloudwatch.Dimension{
+			{Name: aws.String("Database"), Value: aws.String(table.Database)},
+			{Name: aws.String("Table"), Value: aws.String(table.Table)},
+		}
+		data = append(data,
+			&cloudwatch.MetricDatum{
+				MetricName: aws.String(LagMetric),
+				Dimensions: dimensions,
+				Timestamp:  aws.Time(report.GeneratedAt),
+				Unit:       aws.String(cloudwatch.StandardUnitSeconds),
+				Value:      aws.Float64(table.LagSeconds),
+			},
+			&cloudwatch.MetricDatum{
+				MetricName: aws.String(MissingMetric),
+				Dimensions: dimensions,
+				Timestamp:  aws.Time(report.GeneratedAt),
+				Unit:       aws.String(cloudwatch.StandardUnitCount),
+				Value:      aws.Float64(float64(len(table.MissingPartitions))),
+			},
+		)
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxMetricsPerPut {
+			n = maxMetricsPerPut
+		}
+		_, err := cw.PutMetricDataWithContext(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(metrics.Namespace),
+			MetricData: data[:n],
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to put partition metrics")
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func timebinName(bin awsglue.GlueTableTimebin) string {
+	switch bin {
+	case awsglue.GlueTableHourly:
+		return "hourly"
+	case awsglue.GlueTableDaily:
+		return "daily"
+	default:
+		return "monthly"
+	}
+}
+
+func timePtr(tm time.Time) *time.Time {
+	return &tm
+}
@@ -0,0 +1,126 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/s3"
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/partitiongaps"
+)
+
+func main() {
+	opstools.SetUsage("reports the tables whose recent S3 data has missing or lagging Glue partitions")
+	opts := struct {
+		Databases      *string
+		Window         *time.Duration
+		MaxLag         *time.Duration
+		Concurrency    *int
+		Metrics        *bool
+		ExitCode       *bool
+		Debug          *bool
+		Region         *string
+		MaxRetries     *int
+		MaxConnections *int
+	}{
+		Databases: flag.String("databases", strings.Join(partitiongaps.DefaultDatabases, ","),
+			"Comma separated list of the databases to check"),
+		Window:         flag.Duration("window", 24*time.Hour, "Check the partitions and S3 data of this duration before now"),
+		MaxLag:         flag.Duration("max-lag", 2*time.Hour, "Flag tables whose newest partition lags the newest S3 data by more than this"),
+		Concurrency:    flag.Int("concurrency", 10, "The number of tables to check in parallel"),
+		Metrics:        flag.Bool("metrics", false, "Put the lag and missing partitions of each table as CloudWatch metrics"),
+		ExitCode:       flag.Bool("exit-code", false, "Exit with status 1 if any table is flagged"),
+		Debug:          flag.Bool("debug", false, "Enable additional logging"),
+		Region:         flag.String("region", "", "Set the AWS region to run on"),
+		MaxRetries:     flag.Int("max-retries", 12, "Max retries for AWS requests"),
+		MaxConnections: flag.Int("max-connections", 100, "Max number of connections to AWS"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+
+	var databases []string
+	for _, database := range strings.Split(*opts.Databases, ",") {
+		if database = strings.TrimSpace(database); database != "" {
+			databases = append(databases, database)
+		}
+	}
+	if len(databases) == 0 || *opts.Window <= 0 {
+		flag.Usage()
+		log.Fatal("-databases and -window must be set")
+	}
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region:     opts.Region,
+		MaxRetries: opts.MaxRetries,
+		HTTPClient: opstools.NewHTTPClient(*opts.MaxConnections, 0),
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+	ctx := context.Background()
+	finder := &partitiongaps.Finder{
+		Glue: glue.New(sess),
+		S3:   s3.New(sess),
+	}
+	startTime := time.Now()
+	report, err := finder.Find(ctx, &partitiongaps.Config{
+		Databases:   databases,
+		Window:      *opts.Window,
+		MaxLag:      *opts.MaxLag,
+		Concurrency: *opts.Concurrency,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("checked %d tables in %v, %d flagged, %d failed", report.NumTables, time.Since(startTime),
+		report.NumFlagged, report.NumErrors)
+	for _, table := range report.Tables {
+		switch {
+		case table.Error != "":
+			log.Warnf("%s.%s: %s", table.Database, table.Table, table.Error)
+		case table.Flagged:
+			log.Warnf("%s.%s: %s", table.Database, table.Table, strings.Join(table.Reasons, ", "))
+		}
+	}
+	if *opts.Metrics {
+		if err := partitiongaps.PutMetrics(ctx, cloudwatch.New(sess), report); err != nil {
+			log.Error(err)
+		}
+	}
+
+	encoder := jsoniter.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Fatalf("failed to write report: %s", err)
+	}
+	if *opts.ExitCode && report.NumFlagged > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,235 @@
+package partitiongaps
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/glue/glueiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/awsglue"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+)
+
+var testNow = time.Date(2020, 12, 10, 12, 30, 0, 0, time.UTC)
+
+type fakeGlue struct {
+	glueiface.GlueAPI
+	tables     []*glue.TableData
+	partitions map[string][]time.Time // by table name
+}
+
+func (f *fakeGlue) GetTablesPagesWithContext(_ aws.Context, input *glue.GetTablesInput,
+	fn func(*glue.GetTablesOutput, bool) bool, _ ...request.Option) error {
+
+	page := &glue.GetTablesOutput{}
+	for _, table := range f.tables {
+		if aws.StringValue(table.DatabaseName) == aws.StringValue(input.DatabaseName) {
+			page.TableList = append(page.TableList, table)
+		}
+	}
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeGlue) GetPartitionsPagesWithContext(_ aws.Context, input *glue.GetPartitionsInput,
+	fn func(*glue.GetPartitionsOutput, bool) bool, _ ...request.Option) error {
+
+	page := &glue.GetPartitionsOutput{}
+	for _, tm := range f.partitions[aws.StringValue(input.TableName)] {
+		page.Partitions = append(page.Partitions, &glue.Partition{
+			Values: awsglue.GlueTableHourly.PartitionValuesFromTime(tm),
+		})
+	}
+	fn(page, true)
+	return nil
+}
+
+// fakeS3 has an object in each of the prefixes
+type fakeS3 struct {
+	s3iface.S3API
+	mu       sync.Mutex
+	prefixes map[string]int64 // object size by prefix
+	listed   []string
+}
+
+func (f *fakeS3) ListObjectsV2PagesWithContext(_ aws.Context, input *s3.ListObjectsV2Input,
+	fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	prefix := aws.StringValue(input.Bucket) + "/" + aws.StringValue(input.Prefix)
+	f.listed = append(f.listed, prefix)
+	page := &s3.ListObjectsV2Output{}
+	if size, ok := f.prefixes[prefix]; ok {
+		page.Contents = append(page.Contents, &s3.Object{Key: aws.String(aws.StringValue(input.Prefix) + "0.json.gz"), Size: &size})
+	}
+	fn(page, true)
+	return nil
+}
+
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	inputs []*cloudwatch.PutMetricDataInput
+}
+
+func (f *fakeCloudWatch) PutMetricDataWithContext(_ aws.Context, input *cloudwatch.PutMetricDataInput,
+	_ ...request.Option) (*cloudwatch.PutMetricDataOutput, error) {
+
+	f.inputs = append(f.inputs, input)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func hourlyTable(database, name string) *glue.TableData {
+	return &glue.TableData{
+		DatabaseName: aws.String(database),
+		Name:         aws.String(name),
+		PartitionKeys: []*glue.Column{
+			{Name: aws.String("year")}, {Name: aws.String("month")}, {Name: aws.String("day")}, {Name: aws.String("hour")},
+		},
+		StorageDescriptor: &glue.StorageDescriptor{
+			Location: aws.String(fmt.Sprintf("s3://bucket/%s/%s", strings.TrimPrefix(database, "panther_"), name)),
+		},
+	}
+}
+
+func hours(from time.Time, n int) (hours []time.Time) {
+	for i := 0; i < n; i++ {
+		hours = append(hours, from.Add(time.Duration(i)*time.Hour))
+	}
+	return hours
+}
+
+func dataPrefixes(table string, hours []time.Time) map[string]int64 {
+	prefixes := make(map[string]int64)
+	for _, hour := range hours {
+		prefixes["bucket/logs/"+table+"/"+awsglue.GlueTableHourly.PartitionPathS3(hour)] = 10
+	}
+	return prefixes
+}
+
+func TestFind(t *testing.T) {
+	windowStart := time.Date(2020, 12, 10, 6, 0, 0, 0, time.UTC) // 7 hours up to 12:00
+	glueClient := &fakeGlue{
+		tables: []*glue.TableData{
+			hourlyTable(pantherdb.LogProcessingDatabase, "healthy"),
+			hourlyTable(pantherdb.LogProcessingDatabase, "lagging"),
+			hourlyTable(pantherdb.LogProcessingDatabase, "gap"),
+			hourlyTable(pantherdb.LogProcessingDatabase, "idle"),
+			{DatabaseName: aws.String(pantherdb.LogProcessingDatabase), Name: aws.String("bad"),
+				PartitionKeys: []*glue.Column{{Name: aws.String("dt")}}},
+			hourlyTable(pantherdb.RuleMatchDatabase, "other_db"), // not checked
+		},
+		partitions: map[string][]time.Time{
+			"healthy": hours(windowStart, 7),
+			"lagging": hours(windowStart, 3),
+			"gap":     append(hours(windowStart, 2), hours(windowStart.Add(3*time.Hour), 4)...),
+			"idle":    {windowStart.Add(-48 * time.Hour)},
+		},
+	}
+	s3Client := &fakeS3{prefixes: make(map[string]int64)}
+	for table, hours := range map[string][]time.Time{
+		"healthy": hours(windowStart, 7),
+		"lagging": hours(windowStart, 7),
+		"gap":     hours(windowStart, 7),
+	} {
+		for prefix, size := range dataPrefixes(table, hours) {
+			s3Client.prefixes[prefix] = size
+		}
+	}
+	s3Client.prefixes["bucket/logs/idle/"+awsglue.GlueTableHourly.PartitionPathS3(windowStart)] = 0 // empty objects are not data
+
+	finder := &Finder{Glue: glueClient, S3: s3Client}
+	report, err := finder.Find(context.Background(), &Config{
+		Databases:   []string{pantherdb.LogProcessingDatabase},
+		Window:      6*time.Hour + 30*time.Minute,
+		MaxLag:      2 * time.Hour,
+		Concurrency: 2,
+		Now:         testNow,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 5, report.NumTables)
+	assert.Equal(t, 2, report.NumFlagged)
+	assert.Equal(t, 1, report.NumErrors)
+	assert.Len(t, s3Client.listed, 4*7) // only the window is listed
+
+	tables := make(map[string]*TableReport)
+	for _, table := range report.Tables {
+		tables[table.Table] = table
+	}
+	assert.Equal(t, "bad", report.Tables[0].Table) // sorted
+
+	healthy := tables["healthy"]
+	assert.False(t, healthy.Flagged)
+	assert.Equal(t, "hourly", healthy.Timebin)
+	assert.Equal(t, windowStart.Add(6*time.Hour), *healthy.LatestPartition)
+	assert.Equal(t, windowStart.Add(6*time.Hour), *healthy.LatestData)
+	assert.Zero(t, healthy.LagSeconds)
+
+	lagging := tables["lagging"]
+	assert.True(t, lagging.Flagged)
+	assert.Equal(t, (4 * time.Hour).Seconds(), lagging.LagSeconds)
+	assert.Equal(t, hours(windowStart.Add(3*time.Hour), 4), lagging.MissingPartitions)
+	assert.Len(t, lagging.Reasons, 2)
+
+	gap := tables["gap"]
+	assert.True(t, gap.Flagged)
+	assert.Zero(t, gap.LagSeconds)
+	assert.Equal(t, []time.Time{windowStart.Add(2 * time.Hour)}, gap.MissingPartitions)
+	assert.Equal(t, []string{"S3 data without partitions"}, gap.Reasons)
+
+	idle := tables["idle"]
+	assert.False(t, idle.Flagged)
+	assert.Nil(t, idle.LatestPartition)
+	assert.Nil(t, idle.LatestData)
+
+	assert.Contains(t, tables["bad"].Error, "cannot determine the table time bin")
+
+	cw := &fakeCloudWatch{}
+	require.NoError(t, PutMetrics(context.Background(), cw, report))
+	require.Len(t, cw.inputs, 1)
+	assert.Len(t, cw.inputs[0].MetricData, 8) // 2 per table without error
+	assert.Equal(t, "Panther", aws.StringValue(cw.inputs[0].Namespace))
+}
+
+func TestPutMetricsBatches(t *testing.T) {
+	report := &Report{GeneratedAt: testNow}
+	for i := 0; i < 15; i++ {
+		report.Tables = append(report.Tables, &TableReport{Database: "db", Table: fmt.Sprint(i), Timebin: "hourly"})
+	}
+	cw := &fakeCloudWatch{}
+	require.NoError(t, PutMetrics(context.Background(), cw, report))
+	require.Len(t, cw.inputs, 2)
+	assert.Len(t, cw.inputs[0].MetricData, 20)
+	assert.Len(t, cw.inputs[1].MetricData, 10)
+}
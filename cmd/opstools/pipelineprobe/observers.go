@@ -0,0 +1,235 @@
+package pipelineprobe
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena/athenaiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/cmd/opstools/snstail"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+	"github.com/panther-labs/panther/pkg/awsathena"
+)
+
+const receiveWaitSeconds = 20
+
+// QueueObserver looks for the marker in the processed files notified to a temporary queue subscribed to the
+// processed data topic
+type QueueObserver struct {
+	sqsClient sqsiface.SQSAPI
+	s3Client  s3iface.S3API
+	tail      *snstail.Tail
+}
+
+// NewQueueObserver subscribes a temporary queue to the processed data topic, for the notifications of the log type
+// if not empty. It must be created before the canary is published, so that the notification of its data is received.
+func NewQueueObserver(sqsClient sqsiface.SQSAPI, snsClient snsiface.SNSAPI, s3Client s3iface.S3API,
+	topicARN, logType string) (*QueueObserver, error) {
+
+	filterPolicy := map[string][]string{
+		notify.DataTypeAttributeName: {string(pantherdb.LogData)},
+	}
+	if logType != "" {
+		filterPolicy[notify.LogTypeAttributeName] = []string{logType}
+	}
+	policy, err := jsoniter.MarshalToString(filterPolicy)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal filter policy")
+	}
+	tail, err := snstail.Setup(sqsClient, snsClient, topicARN, policy)
+	if err != nil {
+		return nil, err
+	}
+	return &QueueObserver{
+		sqsClient: sqsClient,
+		s3Client:  s3Client,
+		tail:      tail,
+	}, nil
+}
+
+// Name describes the observer in reports
+func (o *QueueObserver) Name() string {
+	return "queue " + o.tail.QueueURL
+}
+
+// Observe reads the files of the notifications received, since is not used as only new notifications are received
+func (o *QueueObserver) Observe(ctx context.Context, marker string, _ time.Time) error {
+	for {
+		output, err := o.sqsClient.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(o.tail.QueueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(receiveWaitSeconds),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Wrapf(err, "failed to receive from %s", o.tail.QueueURL)
+		}
+		if len(output.Messages) == 0 {
+			continue
+		}
+		deleteInput := &sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(o.tail.QueueURL),
+		}
+		for i, message := range output.Messages {
+			found, err := o.search(ctx, message, []byte(marker))
+			if err != nil || found {
+				return err
+			}
+			deleteInput.Entries = append(deleteInput.Entries, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+		}
+		// the notifications of other files are not searched again
+		if _, err := o.sqsClient.DeleteMessageBatchWithContext(ctx, deleteInput); err != nil && ctx.Err() == nil {
+			return errors.Wrapf(err, "failed to delete messages from %s", o.tail.QueueURL)
+		}
+	}
+}
+
+// returns true if a file of the notification of a message contains the marker
+func (o *QueueObserver) search(ctx context.Context, message *sqs.Message, marker []byte) (bool, error) {
+	var entity events.SNSEntity
+	if err := jsoniter.UnmarshalFromString(aws.StringValue(message.Body), &entity); err != nil {
+		return false, errors.Wrapf(err, "message %s is not an SNS notification", aws.StringValue(message.MessageId))
+	}
+	notification, err := notify.ParseNotification([]byte(entity.Message))
+	if err != nil {
+		return false, errors.Wrapf(err, "message %s is not an S3 notification", aws.StringValue(message.MessageId))
+	}
+	for _, record := range notification.Records {
+		key, err := notify.DecodeObjectKey(record.S3.Object.Key)
+		if err != nil {
+			return false, errors.Wrapf(err, "message %s has an invalid key", aws.StringValue(message.MessageId))
+		}
+		found, err := o.searchFile(ctx, record.S3.Bucket.Name, key, marker)
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+func (o *QueueObserver) searchFile(ctx context.Context, bucket, key string, marker []byte) (bool, error) {
+	output, err := o.s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get s3://%s/%s", bucket, key)
+	}
+	defer output.Body.Close()
+	var reader io.Reader = output.Body
+	if strings.HasSuffix(key, ".gz") {
+		gzipReader, err := gzip.NewReader(output.Body)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to read s3://%s/%s", bucket, key)
+		}
+		reader = gzipReader
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read s3://%s/%s", bucket, key)
+	}
+	return bytes.Contains(data, marker), nil
+}
+
+// Cleanup unsubscribes and deletes the temporary queue
+func (o *QueueObserver) Cleanup() error {
+	return o.tail.Cleanup()
+}
+
+// AthenaObserver polls a table with Athena queries until a row has the marker in a column
+type AthenaObserver struct {
+	Client    athenaiface.AthenaAPI
+	Workgroup string
+	Database  string
+	Table     string
+	// Column is the column the marker of the canary is in, e.g. a string field of the log type
+	Column       string
+	PollInterval time.Duration
+}
+
+// Name describes the observer in reports
+func (o *AthenaObserver) Name() string {
+	return fmt.Sprintf("athena %s.%s", o.Database, o.Table)
+}
+
+// Observe queries the partitions from the hour before since, the event time of the canary must be the probe time
+func (o *AthenaObserver) Observe(ctx context.Context, marker string, since time.Time) error {
+	for {
+		found, err := o.query(marker, since)
+		if err != nil || found {
+			return err
+		}
+		select {
+		case <-time.After(o.PollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (o *AthenaObserver) query(marker string, since time.Time) (bool, error) {
+	sql := fmt.Sprintf(`SELECT 1 FROM "%s"."%s" WHERE (%s) AND strpos("%s", '%s') > 0 LIMIT 1`,
+		o.Database, o.Table, partitionFilter(since.Add(-time.Hour), time.Now()), o.Column,
+		strings.ReplaceAll(marker, "'", "''"))
+	output, err := awsathena.RunQuery(o.Client, o.Workgroup, o.Database, sql)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to query %s.%s", o.Database, o.Table)
+	}
+	// first row is the header
+	return len(output.ResultSet.Rows) > 1, nil
+}
+
+// returns the condition selecting the hourly partitions from start to end
+func partitionFilter(start, end time.Time) string {
+	var hours []string
+	for hour := start.UTC().Truncate(time.Hour); !hour.After(end); hour = hour.Add(time.Hour) {
+		hours = append(hours, fmt.Sprintf("(year=%d AND month=%d AND day=%d AND hour=%d)",
+			hour.Year(), hour.Month(), hour.Day(), hour.Hour()))
+	}
+	return strings.Join(hours, " OR ")
+}
+
+// Cleanup has nothing to remove, queries leave no resources
+func (o *AthenaObserver) Cleanup() error {
+	return nil
+}
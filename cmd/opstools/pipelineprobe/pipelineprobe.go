@@ -0,0 +1,234 @@
+package pipelineprobe
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+const (
+	// CanaryPrefix is the name prefix of canary objects, the canaries left by killed probes are found by it
+	CanaryPrefix = "panther-probe-"
+	// ProbeIDPlaceholder is replaced with the probe ID in canary templates
+	ProbeIDPlaceholder = "{{probe}}"
+	// TimePlaceholder is replaced with the probe time (RFC3339) in canary templates
+	TimePlaceholder = "{{now}}"
+)
+
+// Input configures a probe
+type Input struct {
+	// Prefix is where the canary is written, as <prefix>panther-probe-<probe ID>.json
+	Prefix s3path.Path
+	// Template is the canary log line, it must be parsed by a log type of the source owning Prefix.
+	// The placeholders are replaced, the probe ID is the marker of the canary unless Marker is set.
+	Template string
+	// Existing is an object to notify instead of writing a canary, Marker must be set with it
+	Existing *s3path.Path
+	// Marker is looked for in the processed data, the probe ID if empty
+	Marker string
+	// Timeout is how long the probe waits for the canary to be observed
+	Timeout time.Duration
+}
+
+// Report is the outcome of a probe
+type Report struct {
+	ProbeID   string     `json:"probeID"`
+	Canary    string     `json:"canary"`
+	Observer  string     `json:"observer"`
+	Published time.Time  `json:"published"`
+	Observed  *time.Time `json:"observed,omitempty"`
+	// LatencySeconds is the time from publishing the notification of the canary to observing it
+	LatencySeconds float64 `json:"latencySeconds,omitempty"`
+	// Error is why the pipeline is not healthy
+	Error   string `json:"error,omitempty"`
+	Healthy bool   `json:"healthy"`
+}
+
+// Observer watches the processed data for the canary of a probe
+type Observer interface {
+	// Name describes the observer in reports
+	Name() string
+	// Observe returns nil once the marker is observed in data processed after since, the error of ctx if it is done
+	Observe(ctx context.Context, marker string, since time.Time) error
+	// Cleanup removes the resources of the observer, it is safe to call more than once
+	Cleanup() error
+}
+
+// Run writes the canary, publishes its notification marked with the probe ID as back-fill run ID and waits for
+// the observer to see it in the processed data. The canary and the resources of the observer are removed
+// whatever the outcome. A canary that is not observed in time is an unhealthy report, not an error.
+func Run(ctx context.Context, s3Client s3iface.S3API, destination backfill.Destination, observer Observer,
+	input *Input) (report *Report, err error) {
+
+	probeID := backfill.NewRunID()
+	report = &Report{
+		ProbeID:  probeID,
+		Observer: observer.Name(),
+	}
+	defer func() {
+		err = multierr.Append(err, observer.Cleanup())
+	}()
+
+	marker := input.Marker
+	if marker == "" {
+		marker = probeID
+	}
+	var object *backfill.Object
+	if input.Existing != nil {
+		object, err = headObject(ctx, s3Client, *input.Existing)
+	} else {
+		object, err = writeCanary(ctx, s3Client, input, probeID)
+		if object != nil {
+			defer func() {
+				err = multierr.Append(err, deleteCanary(s3Client, object))
+			}()
+		}
+	}
+	if err != nil {
+		return report, err
+	}
+	report.Canary = fmt.Sprintf("s3://%s/%s", object.Bucket, object.Key)
+
+	publisher := &backfill.Publisher{
+		Destination: destination,
+		RunID:       probeID,
+	}
+	report.Published = time.Now().UTC()
+	if err := publisher.PublishObjects(ctx, []backfill.Object{*object}); err != nil {
+		return report, errors.Wrapf(err, "failed to publish the notification of %s", report.Canary)
+	}
+	zap.S().Infof("published the notification of %s, waiting for %s", report.Canary, observer.Name())
+
+	observeCtx, cancel := context.WithTimeout(ctx, input.Timeout)
+	defer cancel()
+	switch observeErr := observer.Observe(observeCtx, marker, report.Published); {
+	case observeErr == nil:
+		observed := time.Now().UTC()
+		report.Observed = &observed
+		report.LatencySeconds = observed.Sub(report.Published).Seconds()
+		report.Healthy = true
+	case errors.Is(observeErr, context.DeadlineExceeded) && ctx.Err() == nil:
+		report.Error = fmt.Sprintf("the canary was not observed within %s", input.Timeout)
+	default:
+		report.Error = observeErr.Error()
+		return report, observeErr
+	}
+	return report, nil
+}
+
+// Canary returns the content of a canary for a template, a single line
+func Canary(template, probeID string, now time.Time) []byte {
+	replacer := strings.NewReplacer(ProbeIDPlaceholder, probeID, TimePlaceholder, now.UTC().Format(time.RFC3339))
+	return []byte(strings.TrimSpace(replacer.Replace(template)) + "\n")
+}
+
+func writeCanary(ctx context.Context, s3Client s3iface.S3API, input *Input, probeID string) (*backfill.Object, error) {
+	now := time.Now()
+	content := Canary(input.Template, probeID, now)
+	key := input.Prefix.Key + CanaryPrefix + probeID + ".json"
+	output, err := s3Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(input.Prefix.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(content),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to write canary s3://%s/%s", input.Prefix.Bucket, key)
+	}
+	return &backfill.Object{
+		Bucket:       input.Prefix.Bucket,
+		Key:          key,
+		ETag:         notify.NormalizeETag(aws.StringValue(output.ETag)),
+		Size:         int64(len(content)),
+		LastModified: now.UTC(),
+	}, nil
+}
+
+func headObject(ctx context.Context, s3Client s3iface.S3API, path s3path.Path) (*backfill.Object, error) {
+	output, err := s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(path.Bucket),
+		Key:    aws.String(path.Key),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s", path)
+	}
+	return &backfill.Object{
+		Bucket:       path.Bucket,
+		Key:          path.Key,
+		ETag:         notify.NormalizeETag(aws.StringValue(output.ETag)),
+		Size:         aws.Int64Value(output.ContentLength),
+		LastModified: aws.TimeValue(output.LastModified),
+	}, nil
+}
+
+// the canary is deleted without the context of the run, so that it is deleted when the run is canceled
+func deleteCanary(s3Client s3iface.S3API, object *backfill.Object) error {
+	_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(object.Bucket),
+		Key:    aws.String(object.Key),
+	})
+	return errors.Wrapf(err, "failed to delete canary s3://%s/%s", object.Bucket, object.Key)
+}
+
+// CleanupCanaries deletes the canaries under a prefix written before a time, e.g. by probes that were killed.
+// Canaries of running probes must not be deleted, the time must be before the start of any running probe.
+func CleanupCanaries(ctx context.Context, s3Client s3iface.S3API, prefix s3path.Path, before time.Time) (int, error) {
+	var canaries []string
+	listInput := &backfill.ListInput{
+		Bucket: prefix.Bucket,
+		Prefix: prefix.Key + CanaryPrefix,
+		Match: func(object *s3.Object) bool {
+			return aws.TimeValue(object.LastModified).Before(before)
+		},
+	}
+	err := backfill.List(ctx, s3Client, listInput, func(object *s3.Object) bool {
+		canaries = append(canaries, aws.StringValue(object.Key))
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	numDeleted := 0
+	for _, key := range canaries {
+		_, deleteErr := s3Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(prefix.Bucket),
+			Key:    aws.String(key),
+		})
+		if deleteErr != nil {
+			err = multierr.Append(err, errors.Wrapf(deleteErr, "failed to delete canary s3://%s/%s", prefix.Bucket, key))
+			continue
+		}
+		numDeleted++
+	}
+	return numDeleted, err
+}
@@ -0,0 +1,216 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sts"
+	jsoniter "github.com/json-iterator/go"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/pipelineprobe"
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+type options struct {
+	Prefix       *string
+	Canary       *string
+	Key          *string
+	Expect       *string
+	Queue        *string
+	Topic        *string
+	LogType      *string
+	Observer     *string
+	AthenaColumn *string
+	Workgroup    *string
+	Timeout      *time.Duration
+	Debug        *bool
+	Region       *string
+}
+
+func main() {
+	opstools.SetUsage("probes the log processing pipeline end to end, writing a canary object to a source, " +
+		"notifying it and waiting for its data to be processed (exits with 1 if the pipeline is not healthy)")
+	opts := options{
+		Prefix: flag.String("prefix", "", "The s3://bucket/prefix/ of a source the canary is written to"),
+		Canary: flag.String("canary", "",
+			"The log line of the canary, {{probe}} is replaced with the probe ID and {{now}} with the time (RFC3339)"),
+		Key:    flag.String("key", "", "An existing s3://bucket/key to notify instead of writing a canary, requires -expect"),
+		Expect: flag.String("expect", "", "The text to look for in the processed data, the probe ID if not set"),
+		Queue:  flag.String("queue", "panther-input-data-notifications-queue", "The queue of the log processor"),
+		Topic: flag.String("topic", "panther-processed-data-notifications",
+			"The topic of the processed data notifications (name, ARN or console URL)"),
+		LogType:      flag.String("log-type", "", "The log type of the canary, e.g. Custom.Probe"),
+		Observer:     flag.String("observer", "queue", "How the processed canary is observed: queue or athena"),
+		AthenaColumn: flag.String("athena.column", "", "The column of the log type the marker is in, for -observer athena"),
+		Workgroup:    flag.String("workgroup", "Panther", "The Athena workgroup, for -observer athena"),
+		Timeout:      flag.Duration("timeout", 10*time.Minute, "How long to wait for the canary to be processed"),
+		Debug:        flag.Bool("debug", false, "Enable additional logging"),
+		Region:       flag.String("region", "", "Set the AWS region to run on"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+	input := mustBuildInput(log, &opts)
+
+	if opstools.ReadOnly() {
+		log.Fatal("pipelineprobe writes a canary and subscribes a temporary queue, it cannot run read-only")
+	}
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region: opts.Region,
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+	s3Client := s3.New(sess)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		caught := <-sig
+		log.Infof("caught %v, cleaning up", caught)
+		cancel() // the probe stops and cleans up
+	}()
+
+	// canaries left by killed probes, older than any running probe
+	if input.Existing == nil {
+		numDeleted, err := pipelineprobe.CleanupCanaries(ctx, s3Client, input.Prefix, time.Now().Add(-2*input.Timeout))
+		if err != nil {
+			log.Warnf("failed to delete old canaries: %s", err)
+		}
+		if numDeleted > 0 {
+			log.Infof("deleted %d canaries of previous probes", numDeleted)
+		}
+	}
+
+	destination := mustBuildDestination(sess, log, *opts.Queue)
+	// last, the temporary queue of the observer is removed by the run
+	observer := mustBuildObserver(sess, log, &opts)
+	report, err := pipelineprobe.Run(ctx, s3Client, destination, observer, input)
+	if report != nil {
+		if encodeErr := jsoniter.NewEncoder(os.Stdout).Encode(report); encodeErr != nil {
+			log.Errorf("failed to print report: %s", encodeErr)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !report.Healthy {
+		log.Errorf("pipeline is not healthy: %s", report.Error)
+		os.Exit(1)
+	}
+	log.Infof("canary observed in %.1fs", report.LatencySeconds)
+}
+
+func mustBuildInput(log *zap.SugaredLogger, opts *options) *pipelineprobe.Input {
+	input := &pipelineprobe.Input{
+		Template: *opts.Canary,
+		Marker:   *opts.Expect,
+		Timeout:  *opts.Timeout,
+	}
+	switch {
+	case *opts.Key != "":
+		existing, err := s3path.Parse(*opts.Key)
+		if err != nil {
+			log.Fatalf("-key: %s", err)
+		}
+		if *opts.Expect == "" {
+			log.Fatal("-expect must be set with -key")
+		}
+		input.Existing = &existing
+	case *opts.Prefix != "" && *opts.Canary != "":
+		prefix, err := s3path.Parse(*opts.Prefix)
+		if err != nil {
+			log.Fatalf("-prefix: %s", err)
+		}
+		input.Prefix = prefix
+	default:
+		flag.Usage()
+		log.Fatal("either -prefix and -canary or -key must be set")
+	}
+	if *opts.Timeout <= 0 {
+		log.Fatal("-timeout must be positive")
+	}
+	return input
+}
+
+func mustBuildObserver(sess *session.Session, log *zap.SugaredLogger, opts *options) pipelineprobe.Observer {
+	switch *opts.Observer {
+	case "queue":
+		topicARN := opstools.MustResolveTopicARN(sess, log, "topic", *opts.Topic, "")
+		observer, err := pipelineprobe.NewQueueObserver(sqs.New(sess), sns.New(sess), s3.New(sess), topicARN, *opts.LogType)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return observer
+	case "athena":
+		if *opts.LogType == "" || *opts.AthenaColumn == "" {
+			log.Fatal("-log-type and -athena.column must be set with -observer athena")
+		}
+		return &pipelineprobe.AthenaObserver{
+			Client:       athena.New(sess),
+			Workgroup:    *opts.Workgroup,
+			Database:     pantherdb.DatabaseName(pantherdb.LogData),
+			Table:        pantherdb.TableName(*opts.LogType),
+			Column:       *opts.AthenaColumn,
+			PollInterval: 30 * time.Second,
+		}
+	default:
+		log.Fatalf("unknown -observer %q, expected queue or athena", *opts.Observer)
+		return nil
+	}
+}
+
+func mustBuildDestination(sess *session.Session, log *zap.SugaredLogger, queue string) backfill.Destination {
+	sqsClient := sqs.New(sess)
+	queueURL, err := sqsClient.GetQueueUrl(&sqs.GetQueueUrlInput{
+		QueueName: aws.String(queue),
+	})
+	if err != nil {
+		log.Fatalf("could not get queue url for %s: %s", queue, err)
+	}
+	identity, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.Fatalf("failed to get caller identity: %s", err)
+	}
+	return &backfill.SQSDestination{
+		SQS:      sqsClient,
+		QueueURL: aws.StringValue(queueURL.QueueUrl),
+		// the account id is taken from this arn to assume role for reading in the log processor
+		TopicARN: backfill.FakeTopicARN(aws.StringValue(identity.Account)),
+	}
+}
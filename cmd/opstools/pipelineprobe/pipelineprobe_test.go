@@ -0,0 +1,305 @@
+package pipelineprobe
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+const testBucket = "input"
+
+// a bucket in memory
+type fakeS3 struct {
+	s3iface.S3API
+	mu       sync.Mutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:  make(map[string][]byte),
+		modified: make(map[string]time.Time),
+	}
+}
+
+func (f *fakeS3) put(key string, data []byte, modified time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = data
+	f.modified[key] = modified
+}
+
+func (f *fakeS3) get(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[key]
+	return data, ok
+}
+
+func (f *fakeS3) PutObjectWithContext(_ aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.put(aws.StringValue(input.Key), data, time.Now())
+	return &s3.PutObjectOutput{ETag: aws.String(`"etag"`)}, nil
+}
+
+func (f *fakeS3) HeadObjectWithContext(_ aws.Context, input *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	data, ok := f.get(aws.StringValue(input.Key))
+	if !ok {
+		return nil, awserr.New("NotFound", "not found", nil)
+	}
+	return &s3.HeadObjectOutput{ETag: aws.String(`"etag"`), ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+func (f *fakeS3) GetObjectWithContext(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	data, ok := f.get(aws.StringValue(input.Key))
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, aws.StringValue(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObjectWithContext(_ aws.Context, input *s3.DeleteObjectInput,
+	_ ...request.Option) (*s3.DeleteObjectOutput, error) {
+
+	return f.DeleteObject(input)
+}
+
+func (f *fakeS3) ListObjectsV2PagesWithContext(_ aws.Context, input *s3.ListObjectsV2Input,
+	fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+
+	f.mu.Lock()
+	page := &s3.ListObjectsV2Output{}
+	for key, data := range f.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			page.Contents = append(page.Contents, &s3.Object{
+				Key:          aws.String(key),
+				Size:         aws.Int64(int64(len(data))),
+				LastModified: aws.Time(f.modified[key]),
+			})
+		}
+	}
+	f.mu.Unlock()
+	sort.Slice(page.Contents, func(i, j int) bool {
+		return *page.Contents[i].Key < *page.Contents[j].Key
+	})
+	fn(page, true)
+	return nil
+}
+
+// observes the canary in the files notified to the destination, as if the pipeline processed them
+type fakeObserver struct {
+	s3          *fakeS3
+	destination *backfill.RecordingDestination
+	// if set the canary is never observed
+	broken    bool
+	cleanedUp bool
+}
+
+func (o *fakeObserver) Name() string {
+	return "fake"
+}
+
+func (o *fakeObserver) Observe(ctx context.Context, marker string, _ time.Time) error {
+	for _, notification := range notifications(o.destination) {
+		data, _ := o.s3.get(notification.Event.Records[0].S3.Object.Key)
+		if !o.broken && bytes.Contains(data, []byte(marker)) {
+			return nil
+		}
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (o *fakeObserver) Cleanup() error {
+	o.cleanedUp = true
+	return nil
+}
+
+func notifications(destination *backfill.RecordingDestination) (all []*backfill.Notification) {
+	for _, batch := range destination.Batches() {
+		all = append(all, batch...)
+	}
+	return all
+}
+
+func testInput() *Input {
+	return &Input{
+		Prefix:   s3path.Path{Bucket: testBucket, Key: "logs/"},
+		Template: `{"probe":"{{probe}}","time":"{{now}}"}`,
+		Timeout:  time.Second,
+	}
+}
+
+func TestRun(t *testing.T) {
+	s3Client := newFakeS3()
+	destination := &backfill.RecordingDestination{}
+	observer := &fakeObserver{s3: s3Client, destination: destination}
+
+	report, err := Run(context.Background(), s3Client, destination, observer, testInput())
+	require.NoError(t, err)
+	assert.True(t, report.Healthy)
+	assert.Empty(t, report.Error)
+	require.NotNil(t, report.Observed)
+	assert.GreaterOrEqual(t, report.LatencySeconds, float64(0))
+	assert.Equal(t, "s3://input/logs/panther-probe-"+report.ProbeID+".json", report.Canary)
+
+	// the notification is marked with the probe
+	published := notifications(destination)
+	require.Len(t, published, 1)
+	assert.Equal(t, report.ProbeID, published[0].Attributes[notify.BackfillRunIDAttributeName])
+	assert.Equal(t, "etag", published[0].Event.Records[0].S3.Object.ETag)
+
+	// everything is cleaned up
+	assert.Empty(t, s3Client.objects)
+	assert.True(t, observer.cleanedUp)
+}
+
+func TestRunTimeout(t *testing.T) {
+	s3Client := newFakeS3()
+	destination := &backfill.RecordingDestination{}
+	observer := &fakeObserver{s3: s3Client, destination: destination, broken: true}
+	input := testInput()
+	input.Timeout = 10 * time.Millisecond
+
+	report, err := Run(context.Background(), s3Client, destination, observer, input)
+	require.NoError(t, err) // an unhealthy pipeline is reported
+	assert.False(t, report.Healthy)
+	assert.Equal(t, "the canary was not observed within 10ms", report.Error)
+	assert.Nil(t, report.Observed)
+	assert.Empty(t, s3Client.objects)
+	assert.True(t, observer.cleanedUp)
+
+	// canceled probes clean up too
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	observer.cleanedUp = false
+	_, err = Run(ctx, s3Client, destination, observer, testInput())
+	require.Error(t, err)
+	assert.Empty(t, s3Client.objects)
+	assert.True(t, observer.cleanedUp)
+}
+
+func TestRunExisting(t *testing.T) {
+	s3Client := newFakeS3()
+	s3Client.put("logs/existing.json", []byte(`{"id":"marker"}`), time.Now())
+	destination := &backfill.RecordingDestination{}
+	observer := &fakeObserver{s3: s3Client, destination: destination}
+	input := testInput()
+	input.Existing = &s3path.Path{Bucket: testBucket, Key: "logs/existing.json"}
+	input.Marker = "marker"
+
+	report, err := Run(context.Background(), s3Client, destination, observer, input)
+	require.NoError(t, err)
+	assert.True(t, report.Healthy)
+	assert.Equal(t, "s3://input/logs/existing.json", report.Canary)
+	assert.Len(t, s3Client.objects, 1) // existing objects are not deleted
+
+	input.Existing.Key = "logs/missing.json"
+	_, err = Run(context.Background(), s3Client, destination, observer, input)
+	require.Error(t, err)
+}
+
+func TestCanary(t *testing.T) {
+	now := time.Date(2020, 12, 1, 10, 30, 0, 0, time.FixedZone("PST", -8*3600))
+	canary := Canary(`{"probe":"{{probe}}","time":"{{now}}"}`+"\n", "ID", now)
+	assert.Equal(t, `{"probe":"ID","time":"2020-12-01T18:30:00Z"}`+"\n", string(canary))
+}
+
+func TestCleanupCanaries(t *testing.T) {
+	s3Client := newFakeS3()
+	now := time.Now()
+	s3Client.put("logs/panther-probe-old.json", []byte("old"), now.Add(-time.Hour))
+	s3Client.put("logs/panther-probe-running.json", []byte("running"), now)
+	s3Client.put("logs/data.json", []byte("data"), now.Add(-time.Hour))
+
+	numDeleted, err := CleanupCanaries(context.Background(), s3Client, s3path.Path{Bucket: testBucket, Key: "logs/"},
+		now.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, numDeleted)
+	assert.Len(t, s3Client.objects, 2)
+	_, ok := s3Client.get("logs/panther-probe-old.json")
+	assert.False(t, ok)
+}
+
+func TestQueueObserverSearch(t *testing.T) {
+	s3Client := newFakeS3()
+	var processed bytes.Buffer
+	writer := gzip.NewWriter(&processed)
+	_, err := writer.Write([]byte(`{"probe":"marker","p_log_type":"Custom.Probe"}` + "\n"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	s3Client.put("logs/custom_probe/year=2020/month=12/day=01/hour=18/file.json.gz", processed.Bytes(), time.Now())
+
+	notification, err := jsoniter.MarshalToString(notify.NewS3ObjectPutNotification("processed",
+		"logs/custom_probe/year=2020/month=12/day=01/hour=18/file.json.gz", processed.Len()))
+	require.NoError(t, err)
+	body, err := jsoniter.MarshalToString(map[string]string{"Type": "Notification", "Message": notification})
+	require.NoError(t, err)
+	message := &sqs.Message{Body: aws.String(body)}
+
+	observer := &QueueObserver{s3Client: s3Client}
+	found, err := observer.search(context.Background(), message, []byte("marker"))
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = observer.search(context.Background(), message, []byte("other"))
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	_, err = observer.search(context.Background(), &sqs.Message{Body: aws.String("not json")}, []byte("marker"))
+	require.Error(t, err)
+}
+
+func TestPartitionFilter(t *testing.T) {
+	start := time.Date(2020, 12, 31, 23, 30, 0, 0, time.UTC)
+	assert.Equal(t, "(year=2020 AND month=12 AND day=31 AND hour=23) OR (year=2021 AND month=1 AND day=1 AND hour=0)",
+		partitionFilter(start, start.Add(time.Hour)))
+}
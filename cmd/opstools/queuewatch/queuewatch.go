@@ -0,0 +1,263 @@
+package queuewatch
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// the age of the oldest message is not a queue attribute, it is only published as a metric
+	oldestAgeMetric = "ApproximateAgeOfOldestMessage"
+	// SQS metrics are published every minute with a few minutes of delay
+	oldestAgeWindow = 15 * time.Minute
+
+	snapshotVisibilityTimeout = 60 // seconds, messages not purged are visible again after this
+	maxEmptyReceives          = 3  // short polling can return no messages from a non-empty queue
+)
+
+// DefaultQueues are the Panther queues watched if none are given
+var DefaultQueues = []string{
+	"panther-input-data-notifications-queue",
+	"panther-input-data-notifications-queue-dlq",
+	"panther-rules-engine-queue-dlq",
+	"panther-datacatalog-updater-dlq",
+	"panther-alerts-queue-dlq",
+	"panther-alert-processor-queue-dlq",
+	"panther-aws-events-queue-dlq",
+	"panther-resources-queue-dlq",
+	"panther-snapshot-queue-dlq",
+	"panther-remediation-queue-dlq",
+	"panther-layer-manager-queue-dlq",
+}
+
+// Thresholds that are zero are not checked
+type Thresholds struct {
+	MaxDepth     int64
+	MaxOldestAge time.Duration
+}
+
+// Breaches returns the thresholds the queue status exceeds
+func (t *Thresholds) Breaches(status *Status) (breaches []string) {
+	if t.MaxDepth > 0 && status.Visible > t.MaxDepth {
+		breaches = append(breaches, fmt.Sprintf("depth %d > %d", status.Visible, t.MaxDepth))
+	}
+	if t.MaxOldestAge > 0 && status.OldestAge != nil && *status.OldestAge > t.MaxOldestAge {
+		breaches = append(breaches, fmt.Sprintf("oldest message age %v > %v", *status.OldestAge, t.MaxOldestAge))
+	}
+	return breaches
+}
+
+// Status is the state of a queue at a poll
+type Status struct {
+	Queue    string    `json:"queue"`
+	Time     time.Time `json:"time"`
+	Visible  int64     `json:"visible"`
+	InFlight int64     `json:"inFlight"`
+	Delayed  int64     `json:"delayed"`
+	// OldestAge is nil if there is no recent metric datapoint (e.g., the queue was empty)
+	OldestAge *time.Duration `json:"oldestAge,omitempty"`
+	Breaches  []string       `json:"breaches,omitempty"`
+}
+
+// Watcher polls the status of queues
+type Watcher struct {
+	SQS        sqsiface.SQSAPI
+	CloudWatch cloudwatchiface.CloudWatchAPI // if nil, the age of the oldest message is not polled
+	Thresholds Thresholds
+
+	queueURLs map[string]string
+}
+
+// Poll returns the status of the queues, in the same order
+func (w *Watcher) Poll(ctx context.Context, queues []string, now time.Time) ([]*Status, error) {
+	statuses := make([]*Status, 0, len(queues))
+	for _, queue := range queues {
+		status, err := w.poll(ctx, queue, now)
+		if err != nil {
+			return nil, err
+		}
+		status.Breaches = w.Thresholds.Breaches(status)
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (w *Watcher) poll(ctx context.Context, queue string, now time.Time) (*Status, error) {
+	queueURL, err := w.QueueURL(queue)
+	if err != nil {
+		return nil, err
+	}
+	output, err := w.SQS.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(queueURL),
+		AttributeNames: aws.StringSlice([]string{
+			sqs.QueueAttributeNameApproximateNumberOfMessages,
+			sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+			sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed,
+		}),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get attributes of %s", queue)
+	}
+	status := &Status{Queue: queue, Time: now}
+	for name, value := range map[string]*int64{
+		sqs.QueueAttributeNameApproximateNumberOfMessages:           &status.Visible,
+		sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible: &status.InFlight,
+		sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed:    &status.Delayed,
+	} {
+		if *value, err = strconv.ParseInt(aws.StringValue(output.Attributes[name]), 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s of %s", name, queue)
+		}
+	}
+
+	if w.CloudWatch != nil {
+		if status.OldestAge, err = w.oldestAge(ctx, queue, now); err != nil {
+			return nil, err
+		}
+	}
+	return status, nil
+}
+
+// oldestAge returns the latest value of the oldest message age metric
+func (w *Watcher) oldestAge(ctx context.Context, queue string, now time.Time) (*time.Duration, error) {
+	output, err := w.CloudWatch.GetMetricStatisticsWithContext(ctx, &cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/SQS"),
+		MetricName: aws.String(oldestAgeMetric),
+		Dimensions: []*cloudwatch.Dimension{
+			{Name: aws.String("QueueName"), Value: aws.String(queue)},
+		},
+		StartTime:  aws.Time(now.Add(-oldestAgeWindow)),
+		EndTime:    aws.Time(now),
+		Period:     aws.Int64(60),
+		Statistics: aws.StringSlice([]string{cloudwatch.StatisticMaximum}),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s of %s", oldestAgeMetric, queue)
+	}
+	var latest *cloudwatch.Datapoint
+	for _, datapoint := range output.Datapoints {
+		if latest == nil || aws.TimeValue(datapoint.Timestamp).After(aws.TimeValue(latest.Timestamp)) {
+			latest = datapoint
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+	age := time.Duration(aws.Float64Value(latest.Maximum)) * time.Second
+	return &age, nil
+}
+
+// QueueURL resolves the url of a queue by name
+func (w *Watcher) QueueURL(queue string) (string, error) {
+	if queueURL, ok := w.queueURLs[queue]; ok {
+		return queueURL, nil
+	}
+	output, err := w.SQS.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String(queue)})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get url of queue %s", queue)
+	}
+	if w.queueURLs == nil {
+		w.queueURLs = make(map[string]string)
+	}
+	w.queueURLs[queue] = aws.StringValue(output.QueueUrl)
+	return w.queueURLs[queue], nil
+}
+
+// PrintTable writes the statuses as a table, breached queues are marked
+func PrintTable(w io.Writer, statuses []*Status) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TIME\tQUEUE\tVISIBLE\tIN FLIGHT\tDELAYED\tOLDEST\tALERT")
+	for _, status := range statuses {
+		oldest := "-"
+		if status.OldestAge != nil {
+			oldest = status.OldestAge.String()
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%d\t%s\t%s\n", status.Time.Format("15:04:05"), status.Queue,
+			status.Visible, status.InFlight, status.Delayed, oldest, strings.Join(status.Breaches, ", "))
+	}
+	return table.Flush()
+}
+
+// Confirm asks to type the queue name, anything else is a refusal
+func Confirm(r io.Reader, w io.Writer, queue string, numMessages int64) error {
+	fmt.Fprintf(w, "This deletes all %d messages of %s, type the queue name to confirm: ", numMessages, queue)
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "failed to read confirmation")
+	}
+	if strings.TrimSpace(line) != queue {
+		return errors.Errorf("confirmation %q does not match %s, not purging", strings.TrimSpace(line), queue)
+	}
+	return nil
+}
+
+// Snapshot writes up to max messages of a queue as JSON lines, it returns the number of messages written.
+// The messages are received without being deleted, they are visible again after a minute.
+func Snapshot(ctx context.Context, sqsClient sqsiface.SQSAPI, queueURL string, max int, w io.Writer) (int, error) {
+	encoder := jsoniter.NewEncoder(w)
+	var numMessages, numEmpty int
+	for numMessages < max && numEmpty < maxEmptyReceives {
+		batchSize := max - numMessages
+		if batchSize > 10 {
+			batchSize = 10
+		}
+		output, err := sqsClient.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(queueURL),
+			MaxNumberOfMessages:   aws.Int64(int64(batchSize)),
+			VisibilityTimeout:     aws.Int64(snapshotVisibilityTimeout),
+			AttributeNames:        aws.StringSlice([]string{sqs.QueueAttributeNameAll}),
+			MessageAttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameAll}),
+		})
+		if err != nil {
+			return numMessages, errors.Wrapf(err, "failed to receive messages from %s", queueURL)
+		}
+		if len(output.Messages) == 0 {
+			numEmpty++
+			continue
+		}
+		for _, message := range output.Messages {
+			if err := encoder.Encode(message); err != nil {
+				return numMessages, errors.Wrap(err, "failed to write snapshot")
+			}
+			numMessages++
+		}
+	}
+	return numMessages, nil
+}
+
+// Purge deletes all the messages of a queue
+func Purge(ctx context.Context, sqsClient sqsiface.SQSAPI, queueURL string) error {
+	_, err := sqsClient.PurgeQueueWithContext(ctx, &sqs.PurgeQueueInput{QueueUrl: aws.String(queueURL)})
+	return errors.Wrapf(err, "failed to purge %s", queueURL)
+}
@@ -0,0 +1,215 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	jsoniter "github.com/json-iterator/go"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/queuewatch"
+)
+
+// CLI commands
+const watchCmd = "watch"
+const purgeCmd = "purge"
+
+func main() {
+	opstools.SetUsage("%s|%s [flags] (watches the depth and age of queues or purges a queue after saving a sample of it)",
+		watchCmd, purgeCmd)
+	if len(os.Args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch cmd := os.Args[1]; cmd {
+	case watchCmd:
+		watch(os.Args[2:])
+	case purgeCmd:
+		purge(os.Args[2:])
+	default:
+		flag.Usage()
+		opstools.MustBuildLogger(false).Fatalf("invalid command %q", cmd)
+	}
+}
+
+func newSession(log *zap.SugaredLogger, region *string) *session.Session {
+	sess, err := opstools.NewSession(&aws.Config{
+		Region: region,
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+	return sess
+}
+
+func watch(args []string) {
+	opstools.SetUsage("%s polls the depth and age of queues and exits non-zero when a threshold is exceeded", watchCmd)
+	opts := struct {
+		Queues   *string
+		Interval *time.Duration
+		Count    *int
+		MaxDepth *int64
+		MaxAge   *time.Duration
+		NoAge    *bool
+		JSON     *bool
+		Debug    *bool
+		Region   *string
+	}{
+		Queues:   flag.String("queues", strings.Join(queuewatch.DefaultQueues, ","), "Comma separated list of queue names"),
+		Interval: flag.Duration("interval", 30*time.Second, "The interval between polls"),
+		Count:    flag.Int("count", 0, "Stop after this many polls (0 polls until interrupted)"),
+		MaxDepth: flag.Int64("max-depth", 0, "If non-zero, exit non-zero when a queue has more visible messages"),
+		MaxAge:   flag.Duration("max-age", 0, "If non-zero, exit non-zero when the oldest message of a queue is older"),
+		NoAge:    flag.Bool("no-age", false, "Do not get the oldest message age from CloudWatch"),
+		JSON:     flag.Bool("json", false, "Print each status as a JSON line"),
+		Debug:    flag.Bool("debug", false, "Enable additional logging"),
+		Region:   flag.String("region", "", "Set the AWS region to run on"),
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+	sess := newSession(log, opts.Region)
+	watcher := &queuewatch.Watcher{
+		SQS: sqs.New(sess),
+		Thresholds: queuewatch.Thresholds{
+			MaxDepth:     *opts.MaxDepth,
+			MaxOldestAge: *opts.MaxAge,
+		},
+	}
+	if !*opts.NoAge {
+		watcher.CloudWatch = cloudwatch.New(sess)
+	}
+	queues := strings.Split(*opts.Queues, ",")
+
+	encoder := jsoniter.NewEncoder(os.Stdout)
+	ticker := time.NewTicker(*opts.Interval)
+	defer ticker.Stop()
+	for poll := 1; ; poll++ {
+		statuses, err := watcher.Poll(context.Background(), queues, time.Now().UTC())
+		if err != nil {
+			log.Fatal(err)
+		}
+		var breached bool
+		for _, status := range statuses {
+			breached = breached || len(status.Breaches) > 0
+			if *opts.JSON {
+				if err := encoder.Encode(status); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+		if !*opts.JSON {
+			if err := queuewatch.PrintTable(os.Stdout, statuses); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if breached {
+			os.Exit(1)
+		}
+		if poll == *opts.Count {
+			return
+		}
+		<-ticker.C
+	}
+}
+
+func purge(args []string) {
+	opstools.SetUsage("%s saves a sample of the messages of a queue to a file and deletes all its messages", purgeCmd)
+	opts := struct {
+		Queue    *string
+		Sample   *int
+		Snapshot *string
+		Debug    *bool
+		Region   *string
+	}{
+		Queue:    flag.String("queue", "", "The name of the queue to purge"),
+		Sample:   flag.Int("sample", 100, "The number of messages saved before purging"),
+		Snapshot: flag.String("snapshot", "", "The file the sample is saved to as JSON lines (default <queue>-<time>.jsonl)"),
+		Debug:    flag.Bool("debug", false, "Enable additional logging"),
+		Region:   flag.String("region", "", "Set the AWS region to run on"),
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+	if *opts.Queue == "" {
+		flag.Usage()
+		log.Fatal("-queue must be set")
+	}
+	if *opts.Snapshot == "" {
+		*opts.Snapshot = fmt.Sprintf("%s-%s.jsonl", *opts.Queue, time.Now().UTC().Format("20060102T150405Z"))
+	}
+
+	sess := newSession(log, opts.Region)
+	sqsClient := sqs.New(sess)
+	watcher := &queuewatch.Watcher{SQS: sqsClient}
+	ctx := context.Background()
+	statuses, err := watcher.Poll(ctx, []string{*opts.Queue}, time.Now().UTC())
+	if err != nil {
+		log.Fatal(err)
+	}
+	status := statuses[0]
+	if err := queuewatch.Confirm(os.Stdin, os.Stderr, *opts.Queue, status.Visible+status.InFlight+status.Delayed); err != nil {
+		log.Fatal(err)
+	}
+
+	// never overwrite a previous snapshot
+	file, err := os.OpenFile(*opts.Snapshot, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatalf("failed to create snapshot: %s", err)
+	}
+	queueURL, err := watcher.QueueURL(*opts.Queue)
+	if err != nil {
+		log.Fatal(err)
+	}
+	numMessages, err := queuewatch.Snapshot(ctx, sqsClient, queueURL, *opts.Sample, file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatalf("not purging, failed to snapshot %s: %s", *opts.Queue, err)
+	}
+	log.Infof("saved %d messages of %s to %s", numMessages, *opts.Queue, *opts.Snapshot)
+
+	if err := queuewatch.Purge(ctx, sqsClient, queueURL); err != nil {
+		log.Fatal(err)
+	}
+	opstools.LogSkipped(log)
+	log.Infof("purged %s", *opts.Queue)
+}
@@ -0,0 +1,207 @@
+package queuewatch
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+const queueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/panther-input-data-notifications-queue-dlq"
+
+var testNow = time.Date(2020, 11, 10, 12, 0, 0, 0, time.UTC)
+
+func duration(d time.Duration) *time.Duration {
+	return &d
+}
+
+func queueAttributes(visible, inFlight, delayed string) *sqs.GetQueueAttributesOutput {
+	return &sqs.GetQueueAttributesOutput{
+		Attributes: map[string]*string{
+			sqs.QueueAttributeNameApproximateNumberOfMessages:           aws.String(visible),
+			sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible: aws.String(inFlight),
+			sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed:    aws.String(delayed),
+		},
+	}
+}
+
+func messages(first, n int) *sqs.ReceiveMessageOutput {
+	output := &sqs.ReceiveMessageOutput{}
+	for i := first; i < first+n; i++ {
+		output.Messages = append(output.Messages, &sqs.Message{
+			MessageId: aws.String(fmt.Sprintf("id-%d", i)),
+			Body:      aws.String(fmt.Sprintf(`{"n":%d}`, i)),
+		})
+	}
+	return output
+}
+
+func TestBreaches(t *testing.T) {
+	status := &Status{Visible: 100, OldestAge: duration(time.Hour)}
+	assert.Empty(t, (&Thresholds{}).Breaches(status))
+	assert.Empty(t, (&Thresholds{MaxDepth: 100, MaxOldestAge: time.Hour}).Breaches(status))
+	assert.Equal(t, []string{"depth 100 > 99", "oldest message age 1h0m0s > 59m0s"},
+		(&Thresholds{MaxDepth: 99, MaxOldestAge: 59 * time.Minute}).Breaches(status))
+	// an unknown age never breaches
+	assert.Empty(t, (&Thresholds{MaxOldestAge: time.Second}).Breaches(&Status{}))
+}
+
+func TestPoll(t *testing.T) {
+	sqsClient := &testutils.SqsMock{}
+	cloudwatchClient := &testutils.CloudWatchMock{}
+	const queue = "panther-input-data-notifications-queue-dlq"
+
+	// the url is resolved once
+	sqsClient.On("GetQueueUrl", &sqs.GetQueueUrlInput{QueueName: aws.String(queue)}).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String(queueURL)}, nil).Once()
+	sqsClient.On("GetQueueAttributesWithContext", mock.Anything, mock.MatchedBy(func(input *sqs.GetQueueAttributesInput) bool {
+		return aws.StringValue(input.QueueUrl) == queueURL
+	}), mock.Anything).Return(queueAttributes("120", "3", "0"), nil).Twice()
+	cloudwatchClient.On("GetMetricStatisticsWithContext", mock.Anything, mock.MatchedBy(func(input *cloudwatch.GetMetricStatisticsInput) bool {
+		return aws.StringValue(input.MetricName) == "ApproximateAgeOfOldestMessage" &&
+			aws.StringValue(input.Dimensions[0].Value) == queue &&
+			aws.TimeValue(input.EndTime).Equal(testNow)
+	}), mock.Anything).Return(&cloudwatch.GetMetricStatisticsOutput{
+		Datapoints: []*cloudwatch.Datapoint{
+			{Timestamp: aws.Time(testNow.Add(-5 * time.Minute)), Maximum: aws.Float64(600)},
+			{Timestamp: aws.Time(testNow.Add(-3 * time.Minute)), Maximum: aws.Float64(720)},
+			{Timestamp: aws.Time(testNow.Add(-4 * time.Minute)), Maximum: aws.Float64(660)},
+		},
+	}, nil).Once()
+	cloudwatchClient.On("GetMetricStatisticsWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return(&cloudwatch.GetMetricStatisticsOutput{}, nil).Once()
+
+	watcher := &Watcher{
+		SQS:        sqsClient,
+		CloudWatch: cloudwatchClient,
+		Thresholds: Thresholds{MaxDepth: 100},
+	}
+	statuses, err := watcher.Poll(context.Background(), []string{queue}, testNow)
+	require.NoError(t, err)
+	assert.Equal(t, []*Status{{
+		Queue:     queue,
+		Time:      testNow,
+		Visible:   120,
+		InFlight:  3,
+		OldestAge: duration(12 * time.Minute),
+		Breaches:  []string{"depth 120 > 100"},
+	}}, statuses)
+
+	// no datapoints in the window
+	statuses, err = watcher.Poll(context.Background(), []string{queue}, testNow.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Nil(t, statuses[0].OldestAge)
+	sqsClient.AssertExpectations(t)
+	cloudwatchClient.AssertExpectations(t)
+
+	var out strings.Builder
+	require.NoError(t, PrintTable(&out, statuses))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, []string{"13:00:00", queue, "120", "3", "0", "-", "depth", "120", ">", "100"}, strings.Fields(lines[1]))
+}
+
+func TestPollInvalidAttributes(t *testing.T) {
+	sqsClient := &testutils.SqsMock{}
+	sqsClient.On("GetQueueUrl", mock.Anything).Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String(queueURL)}, nil).Once()
+	sqsClient.On("GetQueueAttributesWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return(queueAttributes("1", "", "0"), nil).Once()
+	_, err := (&Watcher{SQS: sqsClient}).Poll(context.Background(), []string{"queue"}, testNow)
+	assert.Error(t, err)
+}
+
+func TestConfirm(t *testing.T) {
+	var prompt strings.Builder
+	require.NoError(t, Confirm(strings.NewReader("panther-queue-dlq\n"), &prompt, "panther-queue-dlq", 42))
+	assert.Contains(t, prompt.String(), "42 messages of panther-queue-dlq")
+	// without a trailing newline
+	assert.NoError(t, Confirm(strings.NewReader(" panther-queue-dlq"), &prompt, "panther-queue-dlq", 42))
+
+	assert.Error(t, Confirm(strings.NewReader("y\n"), &prompt, "panther-queue-dlq", 42))
+	assert.Error(t, Confirm(strings.NewReader("panther-queue\n"), &prompt, "panther-queue-dlq", 42))
+	assert.Error(t, Confirm(strings.NewReader(""), &prompt, "panther-queue-dlq", 42))
+}
+
+func TestSnapshot(t *testing.T) {
+	sqsClient := &testutils.SqsMock{}
+	receive := func(maxMessages int64) interface{} {
+		return mock.MatchedBy(func(input *sqs.ReceiveMessageInput) bool {
+			return aws.StringValue(input.QueueUrl) == queueURL && aws.Int64Value(input.MaxNumberOfMessages) == maxMessages
+		})
+	}
+	sqsClient.On("ReceiveMessageWithContext", mock.Anything, receive(10), mock.Anything).Return(messages(0, 10), nil).Once()
+	// short polling returns fewer or no messages
+	sqsClient.On("ReceiveMessageWithContext", mock.Anything, receive(10), mock.Anything).Return(messages(0, 0), nil).Once()
+	sqsClient.On("ReceiveMessageWithContext", mock.Anything, receive(10), mock.Anything).Return(messages(10, 4), nil).Once()
+	sqsClient.On("ReceiveMessageWithContext", mock.Anything, receive(10), mock.Anything).Return(messages(14, 10), nil).Once()
+	sqsClient.On("ReceiveMessageWithContext", mock.Anything, receive(1), mock.Anything).Return(messages(24, 1), nil).Once()
+
+	var out strings.Builder
+	numMessages, err := Snapshot(context.Background(), sqsClient, queueURL, 25, &out)
+	require.NoError(t, err)
+	sqsClient.AssertExpectations(t)
+	assert.Equal(t, 25, numMessages)
+
+	scanner := bufio.NewScanner(strings.NewReader(out.String()))
+	var i int
+	for ; scanner.Scan(); i++ {
+		var message sqs.Message
+		require.NoError(t, jsoniter.UnmarshalFromString(scanner.Text(), &message))
+		assert.Equal(t, fmt.Sprintf(`{"n":%d}`, i), aws.StringValue(message.Body))
+	}
+	assert.Equal(t, 25, i)
+
+	// a queue with fewer messages than the sample
+	sqsClient = &testutils.SqsMock{}
+	sqsClient.On("ReceiveMessageWithContext", mock.Anything, receive(10), mock.Anything).Return(messages(0, 3), nil).Once()
+	sqsClient.On("ReceiveMessageWithContext", mock.Anything, receive(10), mock.Anything).Return(messages(0, 0), nil).Times(3)
+	numMessages, err = Snapshot(context.Background(), sqsClient, queueURL, 100, &strings.Builder{})
+	require.NoError(t, err)
+	sqsClient.AssertExpectations(t)
+	assert.Equal(t, 3, numMessages)
+
+	sqsClient = &testutils.SqsMock{}
+	sqsClient.On("ReceiveMessageWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return((*sqs.ReceiveMessageOutput)(nil), errors.New("denied")).Once()
+	_, err = Snapshot(context.Background(), sqsClient, queueURL, 100, &strings.Builder{})
+	assert.Error(t, err)
+}
+
+func TestPurge(t *testing.T) {
+	sqsClient := &testutils.SqsMock{}
+	sqsClient.On("PurgeQueueWithContext", mock.Anything, &sqs.PurgeQueueInput{QueueUrl: aws.String(queueURL)}, mock.Anything).
+		Return(&sqs.PurgeQueueOutput{}, nil).Once()
+	require.NoError(t, Purge(context.Background(), sqsClient, queueURL))
+	sqsClient.AssertExpectations(t)
+}
@@ -0,0 +1,172 @@
+package opstools
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"flag"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"go.uber.org/zap"
+)
+
+// ReadOnlyEnv forces every opstool into read-only mode when set to true, whatever its flags
+const ReadOnlyEnv = "PANTHER_OPSTOOLS_READ_ONLY"
+
+// The flag is registered by every tool that imports this package
+var readOnlyFlag = flag.Bool("read-only", false,
+	"Log and count the AWS calls that would change anything instead of making them, also set by "+ReadOnlyEnv+"=true")
+
+// ReadOnly returns true if the tool runs in read-only mode, set by -read-only or ReadOnlyEnv
+func ReadOnly() bool {
+	if *readOnlyFlag {
+		return true
+	}
+	readOnly, _ := strconv.ParseBool(os.Getenv(ReadOnlyEnv))
+	return readOnly
+}
+
+// mutatingPrefixes are the prefixes of the names of the AWS operations that change anything
+var mutatingPrefixes = []string{
+	"Abort", "Add", "BatchCreate", "BatchDelete", "BatchPut", "BatchUpdate", "BatchWrite", "Change", "Complete",
+	"Copy", "Create", "Delete", "Publish", "Purge", "Put", "Remove", "Restore", "Send", "Set", "Subscribe",
+	"Tag", "Unsubscribe", "Untag", "Update", "Upload",
+}
+
+// IsMutating returns true if an AWS request changes anything.
+// Lambda functions invoked asynchronously are deliveries, they are mutating too.
+func IsMutating(r *request.Request) bool {
+	if r.Operation == nil {
+		return false
+	}
+	if input, ok := r.Params.(*lambda.InvokeInput); ok {
+		return input.InvocationType != nil && *input.InvocationType == lambda.InvocationTypeEvent
+	}
+	for _, prefix := range mutatingPrefixes {
+		if strings.HasPrefix(r.Operation.Name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadOnlyGuard skips the mutating AWS calls of the sessions it guards while it is enabled.
+// A skipped call is logged and counted, and completes without error with an empty output.
+type ReadOnlyGuard struct {
+	// Enabled returns true if calls are skipped, it is checked on every call
+	Enabled func() bool
+	// Log is the logger of the skipped calls, zap.S() if nil
+	Log *zap.SugaredLogger
+
+	mu      sync.Mutex
+	skipped map[string]int
+}
+
+// DefaultGuard guards the sessions built by NewSession, it is enabled by -read-only or ReadOnlyEnv
+var DefaultGuard = &ReadOnlyGuard{Enabled: ReadOnly}
+
+// NewSession is session.NewSession guarded by DefaultGuard, every tool builds its sessions with it
+func NewSession(configs ...*aws.Config) (*session.Session, error) {
+	sess, err := session.NewSession(configs...)
+	if err != nil {
+		return nil, err
+	}
+	return DefaultGuard.Guard(sess), nil
+}
+
+// NewSessionWithOptions is session.NewSessionWithOptions guarded by DefaultGuard
+func NewSessionWithOptions(opts session.Options) (*session.Session, error) {
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return DefaultGuard.Guard(sess), nil
+}
+
+// Guard installs the guard on a session, the clients built from the session or its copies are guarded
+func (g *ReadOnlyGuard) Guard(sess *session.Session) *session.Session {
+	sess.Handlers.Validate.PushFrontNamed(request.NamedHandler{
+		Name: "opstools.ReadOnlyGuard",
+		Fn:   g.skip,
+	})
+	return sess
+}
+
+func (g *ReadOnlyGuard) skip(r *request.Request) {
+	if !IsMutating(r) || g.Enabled == nil || !g.Enabled() {
+		return
+	}
+	action := r.ClientInfo.ServiceID + "." + r.Operation.Name
+	g.mu.Lock()
+	if g.skipped == nil {
+		g.skipped = make(map[string]int)
+	}
+	g.skipped[action]++
+	g.mu.Unlock()
+
+	log := g.Log
+	if log == nil {
+		log = zap.S()
+	}
+	log.Infof("read-only: skipped %s", action)
+	log.Debugf("read-only: %s input %s", action, awsutil.Prettify(r.Params))
+
+	// The handlers of a request are its own copy, clearing them completes it with its empty output.
+	// The request is never built, signed or sent.
+	r.Handlers.Build.Clear()
+	r.Handlers.Sign.Clear()
+	r.Handlers.Send.Clear()
+	r.Handlers.ValidateResponse.Clear()
+	r.Handlers.UnmarshalMeta.Clear()
+	r.Handlers.Unmarshal.Clear()
+	r.Handlers.UnmarshalError.Clear()
+	r.Handlers.CompleteAttempt.Clear()
+}
+
+// Skipped returns the number of skipped calls by service and operation, e.g. SQS.SendMessageBatch
+func (g *ReadOnlyGuard) Skipped() map[string]int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	skipped := make(map[string]int, len(g.skipped))
+	for action, n := range g.skipped {
+		skipped[action] = n
+	}
+	return skipped
+}
+
+// LogSkipped logs the calls skipped by DefaultGuard, tools call it before they exit
+func LogSkipped(log *zap.SugaredLogger) {
+	skipped := DefaultGuard.Skipped()
+	actions := make([]string, 0, len(skipped))
+	for action := range skipped {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	for _, action := range actions {
+		log.Infof("read-only: skipped %d %s calls", skipped[action], action)
+	}
+}
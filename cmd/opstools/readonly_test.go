@@ -0,0 +1,181 @@
+package opstools
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// guardedSession returns a session sending to a server counting the requests it receives
+func guardedSession(t *testing.T, guard *ReadOnlyGuard) (*session.Session, *int64) {
+	var numRequests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&numRequests, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	require.NoError(t, err)
+	return guard.Guard(sess), &numRequests
+}
+
+func TestReadOnlyGuard(t *testing.T) {
+	guard := &ReadOnlyGuard{Enabled: func() bool { return true }}
+	sess, numRequests := guardedSession(t, guard)
+	queueURL := aws.String("https://sqs.us-east-1.amazonaws.com/123456789012/queue")
+
+	// every mutating call of the tools, and their clients from copies of the session
+	_, err := sqs.New(sess).SendMessageBatch(&sqs.SendMessageBatchInput{
+		QueueUrl: queueURL,
+		Entries:  []*sqs.SendMessageBatchRequestEntry{{Id: aws.String("1"), MessageBody: aws.String("{}")}},
+	})
+	require.NoError(t, err)
+	_, err = sqs.New(sess.Copy()).SetQueueAttributes(&sqs.SetQueueAttributesInput{
+		QueueUrl:   queueURL,
+		Attributes: map[string]*string{"VisibilityTimeout": aws.String("60")},
+	})
+	require.NoError(t, err)
+	_, err = sqs.New(sess).PurgeQueue(&sqs.PurgeQueueInput{QueueUrl: queueURL})
+	require.NoError(t, err)
+	_, err = sns.New(sess).Publish(&sns.PublishInput{TopicArn: aws.String("arn:aws:sns:us-east-1:123456789012:topic"),
+		Message: aws.String("{}")})
+	require.NoError(t, err)
+	_, err = s3.New(sess).DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String("bucket"),
+		Delete: &s3.Delete{Objects: []*s3.ObjectIdentifier{{Key: aws.String("key")}}},
+	})
+	require.NoError(t, err)
+	_, err = s3.New(sess).PutObject(&s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+	require.NoError(t, err)
+	_, err = glue.New(sess).UpdatePartition(&glue.UpdatePartitionInput{
+		DatabaseName:       aws.String("db"),
+		TableName:          aws.String("table"),
+		PartitionValueList: []*string{aws.String("2020")},
+		PartitionInput:     &glue.PartitionInput{Values: []*string{aws.String("2020")}},
+	})
+	require.NoError(t, err)
+	_, err = eventbridge.New(sess).PutEvents(&eventbridge.PutEventsInput{
+		Entries: []*eventbridge.PutEventsRequestEntry{{Detail: aws.String("{}")}},
+	})
+	require.NoError(t, err)
+	_, err = cloudwatch.New(sess).PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String("Panther"),
+		MetricData: []*cloudwatch.MetricDatum{{MetricName: aws.String("metric"), Value: aws.Float64(1)}},
+	})
+	require.NoError(t, err)
+	_, err = dynamodb.New(sess).PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("table"),
+		Item:      map[string]*dynamodb.AttributeValue{"id": {S: aws.String("id")}},
+	})
+	require.NoError(t, err)
+	_, err = lambda.New(sess).Invoke(&lambda.InvokeInput{
+		FunctionName:   aws.String("function"),
+		InvocationType: aws.String(lambda.InvocationTypeEvent),
+	})
+	require.NoError(t, err)
+
+	assert.Zero(t, atomic.LoadInt64(numRequests), "a mutating call was sent")
+	assert.Equal(t, map[string]int{
+		"CloudWatch.PutMetricData": 1,
+		"DynamoDB.PutItem":         1,
+		"EventBridge.PutEvents":    1,
+		"Glue.UpdatePartition":     1,
+		"Lambda.Invoke":            1,
+		"S3.DeleteObjects":         1,
+		"S3.PutObject":             1,
+		"SNS.Publish":              1,
+		"SQS.PurgeQueue":           1,
+		"SQS.SendMessageBatch":     1,
+		"SQS.SetQueueAttributes":   1,
+	}, guard.Skipped())
+
+	// calls that do not change anything are sent
+	_, _ = s3.New(sess).ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String("bucket")})
+	_, _ = lambda.New(sess).Invoke(&lambda.InvokeInput{FunctionName: aws.String("function")})
+	assert.Equal(t, int64(2), atomic.LoadInt64(numRequests))
+}
+
+func TestReadOnlyGuardDisabled(t *testing.T) {
+	guard := &ReadOnlyGuard{Enabled: func() bool { return false }}
+	sess, numRequests := guardedSession(t, guard)
+	_, _ = sns.New(sess).Publish(&sns.PublishInput{TopicArn: aws.String("arn:aws:sns:us-east-1:123456789012:topic"),
+		Message: aws.String("{}")})
+	assert.Equal(t, int64(1), atomic.LoadInt64(numRequests))
+	assert.Empty(t, guard.Skipped())
+}
+
+func TestReadOnly(t *testing.T) {
+	require.NoError(t, os.Setenv(ReadOnlyEnv, "true"))
+	assert.True(t, ReadOnly())
+	require.NoError(t, os.Setenv(ReadOnlyEnv, "false"))
+	assert.False(t, ReadOnly())
+	require.NoError(t, os.Unsetenv(ReadOnlyEnv))
+	assert.False(t, ReadOnly())
+}
+
+// The tools must build their sessions with NewSession, the sessions of the SDK are not guarded
+func TestToolsUseGuardedSessions(t *testing.T) {
+	unguarded := regexp.MustCompile(`\bsession\.(NewSession|NewSessionWithOptions|New)\(`)
+	err := filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == "testutils" {
+			return filepath.SkipDir // sessions of local test services
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") || path == "readonly.go" {
+			return nil
+		}
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		assert.False(t, unguarded.Match(src), "%s builds an AWS session without opstools.NewSession", path)
+		return nil
+	})
+	require.NoError(t, err)
+}
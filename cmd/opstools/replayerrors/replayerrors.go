@@ -0,0 +1,264 @@
+package replayerrors
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/stats"
+)
+
+// Metadata keys of an error object that records a single failed original object.
+// When an error object has no such metadata its body is read as error records.
+const (
+	MetadataSourceBucket = "source-bucket"
+	MetadataSourceKey    = "source-key"
+	MetadataErrorType    = "error-type"
+	MetadataLogType      = "log-type"
+)
+
+// ErrorRecord references an original object the log processor failed to process.
+// Error objects hold one JSON record per line and may be gzip compressed.
+// Note that the log processor does not write an error output yet, it only logs the objects it failed to classify.
+type ErrorRecord struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	Size      int64  `json:"size,omitempty"`
+	ErrorType string `json:"errorType,omitempty"`
+	LogType   string `json:"logType,omitempty"`
+}
+
+// Stats are the counters of a replay.
+// Snapshots have the counters numErrorObjects, numRecords, numSkipped, numDuplicates, numReplayed and the publish
+// counters numSent, numSentBatches, numSentBytes, numRetries and numRetriedBatches.
+type Stats struct {
+	NumErrorObjects *stats.Counter // error objects read
+	NumRecords      *stats.Counter // error records read
+	NumSkipped      *stats.Counter // records that did not match the filters
+	NumDuplicates   *stats.Counter // records of an original already referenced by another record
+	NumReplayed     *stats.Counter // unique originals sent (would be, in dry run mode)
+	NumRetries      *stats.Counter // throttled or transient send failures that were retried
+	Publish         *backfill.PublishStats
+
+	collector *stats.Collector
+}
+
+func NewStats() *Stats {
+	collector := stats.NewCollector()
+	return &Stats{
+		NumErrorObjects: collector.Counter("numErrorObjects"),
+		NumRecords:      collector.Counter("numRecords"),
+		NumSkipped:      collector.Counter("numSkipped"),
+		NumDuplicates:   collector.Counter("numDuplicates"),
+		NumReplayed:     collector.Counter("numReplayed"),
+		NumRetries:      collector.Counter("numRetries"),
+		Publish:         backfill.NewPublishStats(collector), // shares numRetries
+		collector:       collector,
+	}
+}
+
+// Snapshot returns the current values of the counters
+func (s *Stats) Snapshot() *stats.Snapshot {
+	return s.collector.Snapshot()
+}
+
+type Input struct {
+	// ErrorBucket and ErrorPrefix locate the error objects
+	ErrorBucket string
+	ErrorPrefix string
+	// ErrorTypes and LogTypes limit the replay to records of these types, all records match if empty
+	ErrorTypes []string
+	LogTypes   []string
+}
+
+// Replayer re-drives the original objects referenced by the error output of the log processor
+type Replayer struct {
+	S3 s3iface.S3API
+	// Publisher sends the notifications, its RunID tags them as a replay downstream.
+	// A dry run publishes to a backfill.RecordingDestination.
+	Publisher *backfill.Publisher
+	Stats     *Stats
+}
+
+// Replay reads all error records under the error prefix and sends a notification for each unique original object.
+// It returns the originals in the order they were first referenced.
+func (r *Replayer) Replay(ctx context.Context, input *Input) ([]*ErrorRecord, error) {
+	match := newRecordMatcher(input.ErrorTypes, input.LogTypes)
+	seen := make(map[string]struct{})
+	var originals []*ErrorRecord
+	var readErr error
+	listInput := &backfill.ListInput{
+		Bucket: input.ErrorBucket,
+		Prefix: input.ErrorPrefix,
+	}
+	err := backfill.List(ctx, r.S3, listInput, func(object *s3.Object) bool {
+		key := aws.StringValue(object.Key)
+		records, err := r.readErrorRecords(ctx, input.ErrorBucket, key)
+		if err != nil {
+			readErr = err
+			return false
+		}
+		r.Stats.NumErrorObjects.Inc()
+		for _, record := range records {
+			r.Stats.NumRecords.Inc()
+			if record.Bucket == "" || record.Key == "" {
+				zap.L().Warn("skipping error record without original object", zap.String("errorObject", key))
+				r.Stats.NumSkipped.Inc()
+				continue
+			}
+			if !match(record) {
+				r.Stats.NumSkipped.Inc()
+				continue
+			}
+			id := record.Bucket + "/" + record.Key
+			if _, ok := seen[id]; ok {
+				r.Stats.NumDuplicates.Inc()
+				continue
+			}
+			seen[id] = struct{}{}
+			originals = append(originals, record)
+		}
+		return true
+	})
+	if readErr != nil {
+		return nil, readErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return originals, r.publish(ctx, originals)
+}
+
+func (r *Replayer) publish(ctx context.Context, originals []*ErrorRecord) error {
+	// the originals are replayed now, there is no original event time to keep
+	now := time.Now().UTC()
+	for start := 0; start < len(originals); start += backfill.SendBatchSize {
+		end := start + backfill.SendBatchSize
+		if end > len(originals) {
+			end = len(originals)
+		}
+		batch := make([]*events.S3Event, 0, end-start)
+		for _, record := range originals[start:end] {
+			batch = append(batch, backfill.NewNotification(record.Bucket, &s3.Object{
+				Key:          aws.String(record.Key),
+				Size:         aws.Int64(record.Size),
+				LastModified: aws.Time(now),
+			}))
+		}
+		if err := r.Publisher.Publish(ctx, batch); err != nil {
+			return err
+		}
+		r.Stats.NumReplayed.Add(uint64(len(batch)))
+	}
+	return nil
+}
+
+func (r *Replayer) readErrorRecords(ctx context.Context, bucket, key string) ([]*ErrorRecord, error) {
+	output, err := r.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get s3://%s/%s", bucket, key)
+	}
+	defer output.Body.Close()
+
+	if record := metadataRecord(output.Metadata); record != nil {
+		return []*ErrorRecord{record}, nil
+	}
+	records, err := ReadErrorRecords(output.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read error records of s3://%s/%s", bucket, key)
+	}
+	return records, nil
+}
+
+// ReadErrorRecords reads JSON error records, one per line, from a plain or gzip compressed stream
+func ReadErrorRecords(r io.Reader) ([]*ErrorRecord, error) {
+	buffered := bufio.NewReader(r)
+	if magic, _ := buffered.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+	} else {
+		r = buffered
+	}
+	var records []*ErrorRecord
+	decoder := jsoniter.NewDecoder(r)
+	for decoder.More() {
+		record := &ErrorRecord{}
+		if err := decoder.Decode(record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// metadataRecord returns the record of an error object that has the original in its metadata, nil otherwise
+func metadataRecord(metadata map[string]*string) *ErrorRecord {
+	// the SDK canonicalizes the header names of user metadata (e.g. Source-Bucket)
+	values := make(map[string]string, len(metadata))
+	for name, value := range metadata {
+		values[strings.ToLower(name)] = aws.StringValue(value)
+	}
+	if values[MetadataSourceBucket] == "" || values[MetadataSourceKey] == "" {
+		return nil
+	}
+	return &ErrorRecord{
+		Bucket:    values[MetadataSourceBucket],
+		Key:       values[MetadataSourceKey],
+		ErrorType: values[MetadataErrorType],
+		LogType:   values[MetadataLogType],
+	}
+}
+
+func newRecordMatcher(errorTypes, logTypes []string) func(record *ErrorRecord) bool {
+	contains := func(values []string, value string) bool {
+		if len(values) == 0 {
+			return true
+		}
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+	return func(record *ErrorRecord) bool {
+		return contains(errorTypes, record.ErrorType) && contains(logTypes, record.LogType)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/google/uuid"
+	jsoniter "github.com/json-iterator/go"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/replayerrors"
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/awsretry"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+func main() {
+	opstools.SetUsage("re-sends notifications for the original objects referenced by the log processor error output")
+	opts := struct {
+		ErrorPath   *string
+		ErrorTypes  *string
+		LogTypes    *string
+		Queue       *string
+		Destination *string
+		Target      *string
+		Account     *string
+		RunID       *string
+		DryRun      *bool
+		Debug       *bool
+		Region      *string
+		MaxRetries  *int
+	}{
+		ErrorPath:   flag.String("error-path", "", "The s3 path of the error output (e.g., s3://<bucket>/<prefix>)"),
+		ErrorTypes:  flag.String("error-types", "", "If set, only replay records of these comma separated error types"),
+		LogTypes:    flag.String("log-types", "", "If set, only replay records of these comma separated log types"),
+		Queue:       flag.String("queue", "panther-input-data-notifications-queue", "The name or URL of the queue"),
+		Destination: flag.String("destination", backfill.DestinationSQS, "Where to send notifications: sqs, sns, eventbridge or lambda"),
+		Target:      flag.String("target", "", "The topic (name, ARN or URL), event bus or function of the destination"),
+		Account:     flag.String("account", "", "The Panther AWS account id (optional, defaults to session account)"),
+		RunID:       flag.String("run-id", "", "Tags the notifications of this replay downstream (default a new UUID)"),
+		DryRun:      flag.Bool("dry-run", false, "Print the original objects without sending notifications"),
+		Debug:       flag.Bool("debug", false, "Enable additional logging"),
+		Region:      flag.String("region", "", "Set the AWS region to run on"),
+		MaxRetries:  flag.Int("max-retries", 12, "Max retries for AWS requests"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+	zap.ReplaceGlobals(log.Desugar())
+
+	if *opts.ErrorPath == "" {
+		flag.Usage()
+		log.Fatal("-error-path must be set")
+	}
+	errorPath, err := s3path.Parse(*opts.ErrorPath)
+	if err != nil {
+		log.Fatalf("-error-path: %s", err)
+	}
+	if *opts.RunID == "" {
+		*opts.RunID = uuid.New().String()
+	}
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region:     opts.Region,
+		MaxRetries: opts.MaxRetries,
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+	if *opts.Account == "" {
+		identity, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		if err != nil {
+			log.Fatalf("failed to get caller identity: %s", err)
+		}
+		opts.Account = identity.Account
+	}
+	options := &backfill.DestinationOptions{
+		Kind:      *opts.Destination,
+		Target:    *opts.Target,
+		AccountID: *opts.Account,
+	}
+	switch {
+	case *opts.DryRun:
+		options.Kind = backfill.DestinationDryRun
+	case options.Kind == backfill.DestinationSQS:
+		options.Target = *opts.Queue
+	case options.Kind == backfill.DestinationSNS:
+		options.Target = opstools.MustResolveTopicARN(sess, log, "target", options.Target, options.AccountID)
+	}
+
+	stats := replayerrors.NewStats()
+	replayer := &replayerrors.Replayer{
+		S3:        s3.New(sess),
+		Publisher: newPublisher(sess, options, *opts.RunID, stats, log),
+		Stats:     stats,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		log.Warnf("caught %v, stopping", <-sig)
+		cancel()
+	}()
+
+	startTime := time.Now()
+	originals, err := replayer.Replay(ctx, &replayerrors.Input{
+		ErrorBucket: errorPath.Bucket,
+		ErrorPrefix: errorPath.Key,
+		ErrorTypes:  splitList(*opts.ErrorTypes),
+		LogTypes:    splitList(*opts.LogTypes),
+	})
+	snapshot := stats.Snapshot()
+	if data, err := jsoniter.MarshalToString(snapshot); err == nil {
+		log.Debugf("stats: %s", data)
+	}
+	if err != nil {
+		log.Fatalf("%s, replayed %d unique objects", err, snapshot.Counter("numReplayed"))
+	}
+	if *opts.DryRun {
+		encoder := jsoniter.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(originals); err != nil {
+			log.Fatalf("failed to write originals: %s", err)
+		}
+		log.Infof("would replay %d unique objects from %d error records (%d duplicates, %d skipped)",
+			len(originals), snapshot.Counter("numRecords"), snapshot.Counter("numDuplicates"), snapshot.Counter("numSkipped"))
+		return
+	}
+	opstools.LogSkipped(log)
+	log.Infof("replayed %d unique objects from %d error records (%d duplicates, %d skipped) to %s in %v (run %s)",
+		snapshot.Counter("numReplayed"), snapshot.Counter("numRecords"), snapshot.Counter("numDuplicates"),
+		snapshot.Counter("numSkipped"), options.Kind+" "+options.Target, time.Since(startTime), *opts.RunID)
+}
+
+// a dry run publishes to a recording destination
+func newPublisher(sess *session.Session, options *backfill.DestinationOptions, runID string,
+	stats *replayerrors.Stats, log *zap.SugaredLogger) *backfill.Publisher {
+
+	destination, err := backfill.NewDestination(sess, options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &backfill.Publisher{
+		Destination: destination,
+		RunID:       runID,
+		Retryer: &awsretry.Retryer{
+			OnRetry: func(err error, class awsretry.Class, wait time.Duration) {
+				log.Debugf("retrying send (%s) in %v: %s", class, wait, err)
+			},
+		},
+		Stats: stats.Publish,
+	}
+}
+
+func splitList(list string) (values []string) {
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
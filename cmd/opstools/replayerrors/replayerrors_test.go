@@ -0,0 +1,223 @@
+package replayerrors
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
+)
+
+const (
+	errorBucket = "errors"
+	errorPrefix = "failed/"
+)
+
+type errorObject struct {
+	body     []byte
+	metadata map[string]*string
+}
+
+// fakeS3 serves the error objects of a bucket in a single page
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string]errorObject
+}
+
+func (f *fakeS3) ListObjectsV2PagesWithContext(_ aws.Context, input *s3.ListObjectsV2Input,
+	fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+
+	page := &s3.ListObjectsV2Output{}
+	for key, object := range f.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(int64(len(object.body)) + 1)})
+		}
+	}
+	sort.Slice(page.Contents, func(i, j int) bool {
+		return *page.Contents[i].Key < *page.Contents[j].Key
+	})
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeS3) GetObjectWithContext(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	object, ok := f.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	return &s3.GetObjectOutput{
+		Body:     ioutil.NopCloser(bytes.NewReader(object.body)),
+		Metadata: object.metadata,
+	}, nil
+}
+
+func jsonLines(t *testing.T, records ...ErrorRecord) []byte {
+	var buffer bytes.Buffer
+	for i := range records {
+		line, err := jsoniter.Marshal(&records[i])
+		require.NoError(t, err)
+		buffer.Write(line)
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes()
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+func testS3(t *testing.T) *fakeS3 {
+	return &fakeS3{
+		objects: map[string]errorObject{
+			errorPrefix + "1.json": {
+				body: jsonLines(t,
+					ErrorRecord{Bucket: "logs", Key: "a.json", Size: 10, ErrorType: "classification", LogType: "AWS.CloudTrail"},
+					ErrorRecord{Bucket: "logs", Key: "b.json", ErrorType: "classification", LogType: "AWS.S3ServerAccess"},
+					ErrorRecord{Bucket: "logs", Key: "a.json", ErrorType: "classification", LogType: "AWS.CloudTrail"},
+				),
+			},
+			errorPrefix + "2.json.gz": {
+				body: gzipped(t, jsonLines(t,
+					ErrorRecord{Bucket: "logs", Key: "c.json", ErrorType: "read", LogType: "AWS.CloudTrail"},
+					ErrorRecord{Bucket: "logs", Key: "a.json", ErrorType: "classification", LogType: "AWS.CloudTrail"},
+					ErrorRecord{ErrorType: "classification"}, // no original
+				)),
+			},
+			errorPrefix + "3": {
+				metadata: map[string]*string{
+					"Source-Bucket": aws.String("logs"),
+					"Source-Key":    aws.String("d.json"),
+					"Error-Type":    aws.String("classification"),
+					"Log-Type":      aws.String("AWS.CloudTrail"),
+				},
+			},
+			"other/4.json": {
+				body: jsonLines(t, ErrorRecord{Bucket: "logs", Key: "e.json"}),
+			},
+		},
+	}
+}
+
+func keys(originals []*ErrorRecord) (keys []string) {
+	for _, record := range originals {
+		keys = append(keys, record.Bucket+"/"+record.Key)
+	}
+	return keys
+}
+
+func TestReplay(t *testing.T) {
+	sqsClient := &awsfake.SQSSink{}
+	replayer := &Replayer{
+		S3: testS3(t),
+		Publisher: &backfill.Publisher{
+			Destination: &backfill.SQSDestination{
+				SQS:      sqsClient,
+				QueueURL: "queue",
+				TopicARN: backfill.FakeTopicARN("123456789012"),
+			},
+			RunID: "run",
+		},
+		Stats: NewStats(),
+	}
+	originals, err := replayer.Replay(context.Background(), &Input{
+		ErrorBucket: errorBucket,
+		ErrorPrefix: errorPrefix,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"logs/a.json", "logs/b.json", "logs/c.json", "logs/d.json"}, keys(originals))
+
+	snapshot := replayer.Stats.Snapshot()
+	assert.Equal(t, uint64(3), snapshot.Counter("numErrorObjects"))
+	assert.Equal(t, uint64(7), snapshot.Counter("numRecords"))
+	assert.Equal(t, uint64(2), snapshot.Counter("numDuplicates"))
+	assert.Equal(t, uint64(1), snapshot.Counter("numSkipped"))
+	assert.Equal(t, uint64(4), snapshot.Counter("numReplayed"))
+
+	messages := sqsClient.Messages()
+	require.Len(t, messages, 4)
+	for i, message := range messages {
+		var snsNotification events.SNSEntity
+		require.NoError(t, jsoniter.UnmarshalFromString(*message.MessageBody, &snsNotification))
+		var s3Notification events.S3Event
+		require.NoError(t, jsoniter.UnmarshalFromString(snsNotification.Message, &s3Notification))
+		record := s3Notification.Records[0].S3
+		assert.Equal(t, keys(originals)[i], record.Bucket.Name+"/"+record.Object.Key)
+		assert.Equal(t, originals[i].Size, record.Object.Size)
+		assert.Equal(t, "true", *message.MessageAttributes[notify.ReplayAttributeName].StringValue)
+		assert.Equal(t, "run", *message.MessageAttributes[notify.BackfillRunIDAttributeName].StringValue)
+	}
+}
+
+func TestReplayFilters(t *testing.T) {
+	destination := &backfill.RecordingDestination{}
+	replayer := &Replayer{
+		S3:        testS3(t),
+		Publisher: &backfill.Publisher{Destination: destination},
+		Stats:     NewStats(),
+	}
+	originals, err := replayer.Replay(context.Background(), &Input{
+		ErrorBucket: errorBucket,
+		ErrorPrefix: errorPrefix,
+		ErrorTypes:  []string{"classification"},
+		LogTypes:    []string{"AWS.CloudTrail"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"logs/a.json", "logs/d.json"}, keys(originals))
+	assert.Equal(t, uint64(2), replayer.Stats.Snapshot().Counter("numReplayed"))
+	notifications := destination.Notifications() // dry run
+	require.Len(t, notifications, 2)
+	assert.Equal(t, "logs", notifications[0].Event.Records[0].S3.Bucket.Name)
+	assert.Equal(t, "a.json", notifications[0].Event.Records[0].S3.Object.Key)
+}
+
+func TestReplayReadFailure(t *testing.T) {
+	s3Client := testS3(t)
+	s3Client.objects[errorPrefix+"0.json"] = errorObject{body: []byte(`{"bucket":`)}
+	replayer := &Replayer{
+		S3:        s3Client,
+		Publisher: &backfill.Publisher{Destination: &backfill.RecordingDestination{}},
+		Stats:     NewStats(),
+	}
+	_, err := replayer.Replay(context.Background(), &Input{ErrorBucket: errorBucket, ErrorPrefix: errorPrefix})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to read error records of s3://errors/failed/0.json")
+}
@@ -19,22 +19,95 @@ package requeue
  */
 
 import (
+	"context"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/pkg/awsretry"
+	"github.com/panther-labs/panther/pkg/progress"
+	"github.com/panther-labs/panther/pkg/stats"
 )
 
 const (
 	waitTimeSeconds          = 20
 	messageBatchSize         = 10
 	visibilityTimeoutSeconds = 2 * waitTimeSeconds
+	// messages we leave in the source queue (filtered or dry run) are hidden for this long so they
+	// are not received again by this run, they are made visible again when the run ends
+	holdVisibilityTimeoutSeconds = 15 * 60
+	progressInterval             = 10 * time.Second // log a line this often to show progress
 )
 
+// Stats are the counters of a requeue run.
+// Snapshots have the counters numReceived, numRequeued, numSkipped, numFailed and numRetries.
+type Stats struct {
+	NumReceived *stats.Counter // unique messages received from the source queue
+	NumRequeued *stats.Counter // sent to the destination and deleted from the source queue (would be, in dry run mode)
+	NumSkipped  *stats.Counter // did not match the filters, left in the source queue
+	NumFailed   *stats.Counter // failed to send, left in the source queue
+	NumRetries  *stats.Counter // throttled or transient send failures that were retried
+
+	collector *stats.Collector
+}
+
+func NewStats() *Stats {
+	collector := stats.NewCollector()
+	return &Stats{
+		NumReceived: collector.Counter("numReceived"),
+		NumRequeued: collector.Counter("numRequeued"),
+		NumSkipped:  collector.Counter("numSkipped"),
+		NumFailed:   collector.Counter("numFailed"),
+		NumRetries:  collector.Counter("numRetries"),
+		collector:   collector,
+	}
+}
+
+// Snapshot returns the current values of the counters
+func (s *Stats) Snapshot() *stats.Snapshot {
+	return s.collector.Snapshot()
+}
+
+type Options struct {
+	// ToQueueName is the queue to move messages to, exclusive with ToTopicARN
+	ToQueueName string
+	// ToTopicARN is the SNS topic to publish messages to, exclusive with ToQueueName
+	ToTopicARN string
+	// Limit stops after this many messages have been requeued, 0 means no limit
+	Limit uint64
+	// DryRun logs the messages that would be moved but leaves them in the source queue
+	DryRun bool
+	// AttributeFilter only moves messages with this message attribute, either "name" or "name=value"
+	AttributeFilter string
+	// BodyFilter only moves messages whose body contains this string
+	BodyFilter string
+}
+
 func Requeue(sqsClient sqsiface.SQSAPI, region, fromQueueName, toQueueName string) error {
+	return RequeueWithOptions(sqsClient, nil, region, fromQueueName, &Options{ToQueueName: toQueueName}, NewStats())
+}
+
+// RequeueWithOptions moves messages from a (dead letter) queue to another queue or an SNS topic.
+// Messages are deleted from the source queue only after they were sent successfully, so a failure
+// may cause duplicates (at-least-once) but never lose messages.
+func RequeueWithOptions(sqsClient sqsiface.SQSAPI, snsClient snsiface.SNSAPI,
+	region, fromQueueName string, opts *Options, stats *Stats) error {
+
+	if (opts.ToQueueName == "") == (opts.ToTopicARN == "") {
+		return errors.New("exactly one of a destination queue or topic must be set")
+	}
+	if opts.ToTopicARN != "" && snsClient == nil {
+		return errors.New("an SNS client is required to publish to a topic")
+	}
+
 	fromQueueURL, err := sqsClient.GetQueueUrl(&sqs.GetQueueUrlInput{
 		QueueName: &fromQueueName,
 	})
@@ -42,67 +115,315 @@ func Requeue(sqsClient sqsiface.SQSAPI, region, fromQueueName, toQueueName strin
 		return errors.Wrapf(err, "cannot find source queue %s in region %s", fromQueueName, region)
 	}
 
-	toQueueURL, err := sqsClient.GetQueueUrl(&sqs.GetQueueUrlInput{
-		QueueName: &toQueueName,
-	})
-	if err != nil {
-		return errors.Wrapf(err, "cannot find destination queue %s in region %s", toQueueName, region)
+	r := &requeuer{
+		sqsClient:    sqsClient,
+		snsClient:    snsClient,
+		opts:         opts,
+		stats:        stats,
+		fromQueue:    fromQueueName,
+		fromQueueURL: fromQueueURL.QueueUrl,
+		seen:         make(map[string]bool),
+		held:         make(map[string]string),
 	}
-
-	zap.S().Debugf("Moving messages from %s to %s", fromQueueName, toQueueName)
-	totalMessages := 0
-	for {
-		resp, err := sqsClient.ReceiveMessage(&sqs.ReceiveMessageInput{
-			WaitTimeSeconds:     aws.Int64(waitTimeSeconds),
-			MaxNumberOfMessages: aws.Int64(messageBatchSize),
-			VisibilityTimeout:   aws.Int64(visibilityTimeoutSeconds),
-			QueueUrl:            fromQueueURL.QueueUrl,
+	destination := opts.ToTopicARN
+	if opts.ToQueueName != "" {
+		toQueueURL, err := sqsClient.GetQueueUrl(&sqs.GetQueueUrlInput{
+			QueueName: &opts.ToQueueName,
 		})
-
 		if err != nil {
-			return errors.Wrapf(err, "failure receiving messages to move from %s", fromQueueName)
+			return errors.Wrapf(err, "cannot find destination queue %s in region %s", opts.ToQueueName, region)
 		}
+		r.toQueueURL = toQueueURL.QueueUrl
+		destination = opts.ToQueueName
+	}
+
+	zap.S().Debugf("Moving messages from %s to %s", fromQueueName, destination)
+	r.retryer = &awsretry.Retryer{
+		OnRetry: func(err error, class awsretry.Class, wait time.Duration) {
+			stats.NumRetries.Inc()
+			zap.S().Debugf("retrying %s failure in %v: %v", class, wait, err)
+		},
+	}
+	r.progress = progress.New("requeued messages", opts.Limit, progressInterval, progress.ZapOutput(zap.L()))
+	r.progress.Start()
+	err = r.run()
+	r.progress.Stop()
+	// always make the messages we held back available again, even if we failed
+	if releaseErr := r.release(); releaseErr != nil && err == nil {
+		err = releaseErr
+	}
+	if err == nil {
+		zap.S().Debugf("Successfully requeued %d messages.", stats.NumRequeued.Value())
+	}
+	return err
+}
+
+type requeuer struct {
+	sqsClient    sqsiface.SQSAPI
+	snsClient    snsiface.SNSAPI
+	opts         *Options
+	stats        *Stats
+	fromQueue    string
+	fromQueueURL *string
+	toQueueURL   *string
+	seen         map[string]bool   // message id -> true, for all messages received
+	held         map[string]string // message id -> receipt handle, for the messages left in the source queue
+	progress     *progress.Reporter
+	retryer      *awsretry.Retryer
+}
 
-		messages := resp.Messages
-		numberOfMessages := len(messages)
-		totalMessages += numberOfMessages
-		if numberOfMessages == 0 {
-			zap.S().Debugf("Successfully requeued %d messages.", totalMessages)
+func (r *requeuer) run() error {
+	for !r.limitReached() {
+		resp, err := r.sqsClient.ReceiveMessage(&sqs.ReceiveMessageInput{
+			WaitTimeSeconds:       aws.Int64(waitTimeSeconds),
+			MaxNumberOfMessages:   aws.Int64(messageBatchSize),
+			VisibilityTimeout:     aws.Int64(visibilityTimeoutSeconds),
+			QueueUrl:              r.fromQueueURL,
+			AttributeNames:        []*string{aws.String(sqs.MessageSystemAttributeNameMessageGroupId)},
+			MessageAttributeNames: []*string{aws.String("All")},
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failure receiving messages to move from %s", r.fromQueue)
+		}
+		if len(resp.Messages) == 0 {
 			return nil
 		}
 
-		zap.S().Debugf("Moving %d message(s)...", numberOfMessages)
+		var toMove, toHold []*sqs.Message
+		for _, message := range resp.Messages {
+			messageID := aws.StringValue(message.MessageId)
+			// messages held longer than holdVisibilityTimeoutSeconds are received again, they are held again
+			if r.seen[messageID] {
+				toHold = append(toHold, message)
+				continue
+			}
+			r.seen[messageID] = true
+			r.stats.NumReceived.Inc()
+			if !r.matches(message) {
+				r.stats.NumSkipped.Inc()
+				toHold = append(toHold, message)
+				continue
+			}
+			if r.limitReached() || uint64(len(toMove)) >= r.remaining() {
+				toHold = append(toHold, message) // don't lose them for the full visibility timeout
+				continue
+			}
+			if r.opts.DryRun {
+				zap.S().Infof("would requeue message %s: %s", messageID, aws.StringValue(message.Body))
+				r.stats.NumRequeued.Inc()
+				r.progress.Add(1)
+				toHold = append(toHold, message)
+				continue
+			}
+			toMove = append(toMove, message)
+		}
 
-		var sendMessageBatchRequestEntries []*sqs.SendMessageBatchRequestEntry
-		for index, element := range messages {
-			sendMessageBatchRequestEntries = append(sendMessageBatchRequestEntries, &sqs.SendMessageBatchRequestEntry{
-				Id:          aws.String(strconv.Itoa(index)),
-				MessageBody: element.Body,
-			})
+		if err = r.hold(toHold); err != nil {
+			return err
+		}
+		if len(toMove) == 0 {
+			continue
 		}
 
-		_, err = sqsClient.SendMessageBatch(&sqs.SendMessageBatchInput{
-			Entries:  sendMessageBatchRequestEntries,
-			QueueUrl: toQueueURL.QueueUrl,
-		})
+		zap.S().Debugf("Moving %d message(s)...", len(toMove))
+		sent, err := r.send(toMove)
 		if err != nil {
-			return errors.Wrapf(err, "failure moving messages to %s", toQueueName)
+			return err
+		}
+		if err = r.delete(sent); err != nil {
+			return err
+		}
+		r.stats.NumRequeued.Add(uint64(len(sent)))
+		r.progress.Add(uint64(len(sent)))
+	}
+	return nil
+}
+
+func (r *requeuer) limitReached() bool {
+	return r.opts.Limit > 0 && r.stats.NumRequeued.Value() >= r.opts.Limit
+}
+
+func (r *requeuer) remaining() uint64 {
+	if r.opts.Limit == 0 {
+		return messageBatchSize
+	}
+	return r.opts.Limit - r.stats.NumRequeued.Value()
+}
+
+func (r *requeuer) matches(message *sqs.Message) bool {
+	if r.opts.BodyFilter != "" && !strings.Contains(aws.StringValue(message.Body), r.opts.BodyFilter) {
+		return false
+	}
+	if r.opts.AttributeFilter != "" {
+		name, value, hasValue := parseAttributeFilter(r.opts.AttributeFilter)
+		attribute, found := message.MessageAttributes[name]
+		if !found {
+			return false
+		}
+		if hasValue && aws.StringValue(attribute.StringValue) != value {
+			return false
 		}
+	}
+	return true
+}
+
+func parseAttributeFilter(filter string) (name, value string, hasValue bool) {
+	index := strings.Index(filter, "=")
+	if index < 0 {
+		return filter, "", false
+	}
+	return filter[:index], filter[index+1:], true
+}
 
-		var deleteMessageBatchRequestEntries []*sqs.DeleteMessageBatchRequestEntry
-		for index, element := range messages {
-			deleteMessageBatchRequestEntries = append(deleteMessageBatchRequestEntries, &sqs.DeleteMessageBatchRequestEntry{
-				Id:            aws.String(strconv.Itoa(index)),
-				ReceiptHandle: element.ReceiptHandle,
+// send returns the messages that were successfully sent, failures are counted and the messages are left in the queue
+func (r *requeuer) send(messages []*sqs.Message) (sent []*sqs.Message, err error) {
+	if r.toQueueURL == nil {
+		for _, message := range messages {
+			input := &sns.PublishInput{
+				TopicArn:          &r.opts.ToTopicARN,
+				Message:           message.Body,
+				MessageAttributes: snsMessageAttributes(message.MessageAttributes),
+			}
+			err := r.retryer.Do(context.Background(), func() error {
+				_, err := r.snsClient.Publish(input)
+				return err
 			})
+			if err != nil {
+				zap.S().Warnf("failure publishing message %s to %s: %v",
+					aws.StringValue(message.MessageId), r.opts.ToTopicARN, err)
+				r.stats.NumFailed.Inc()
+				continue
+			}
+			sent = append(sent, message)
+		}
+		return sent, nil
+	}
+
+	entries := make([]*sqs.SendMessageBatchRequestEntry, len(messages))
+	for index, message := range messages {
+		entries[index] = &sqs.SendMessageBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(index)),
+			MessageBody:       message.Body,
+			MessageAttributes: message.MessageAttributes,
+		}
+		// needed to requeue to FIFO queues, content based de-duplication needs to be enabled on them
+		if groupID, found := message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]; found {
+			entries[index].MessageGroupId = groupID
+		}
+	}
+	input := &sqs.SendMessageBatchInput{
+		Entries:  entries,
+		QueueUrl: r.toQueueURL,
+	}
+	var output *sqs.SendMessageBatchOutput
+	err = r.retryer.Do(context.Background(), func() (sendErr error) {
+		output, sendErr = r.sqsClient.SendMessageBatch(input)
+		return sendErr
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failure moving messages to %s", r.opts.ToQueueName)
+	}
+	failed := make(map[string]bool, len(output.Failed))
+	for _, failure := range output.Failed {
+		failed[aws.StringValue(failure.Id)] = true
+		zap.S().Warnf("failure moving message to %s: %s", r.opts.ToQueueName, aws.StringValue(failure.Message))
+	}
+	for index, message := range messages {
+		if failed[strconv.Itoa(index)] {
+			r.stats.NumFailed.Inc()
+			continue
+		}
+		sent = append(sent, message)
+	}
+	return sent, nil
+}
+
+func (r *requeuer) delete(messages []*sqs.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(messages))
+	for index, message := range messages {
+		entries[index] = &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(index)),
+			ReceiptHandle: message.ReceiptHandle,
 		}
+	}
+	output, err := r.sqsClient.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+		Entries:  entries,
+		QueueUrl: r.fromQueueURL,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failure deleting moved messages from %s", r.fromQueue)
+	}
+	if len(output.Failed) > 0 { // these will be received again and sent twice
+		return errors.Errorf("failure deleting %d moved messages from %s: %s",
+			len(output.Failed), r.fromQueue, aws.StringValue(output.Failed[0].Message))
+	}
+	return nil
+}
 
-		_, err = sqsClient.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
-			Entries:  deleteMessageBatchRequestEntries,
-			QueueUrl: fromQueueURL.QueueUrl,
+// hold hides messages we leave in the source queue until the end of the run
+func (r *requeuer) hold(messages []*sqs.Message) error {
+	for _, message := range messages {
+		r.held[aws.StringValue(message.MessageId)] = aws.StringValue(message.ReceiptHandle)
+	}
+	return r.changeVisibility(messages, holdVisibilityTimeoutSeconds)
+}
+
+// release makes the messages we held visible again
+func (r *requeuer) release() error {
+	messages := make([]*sqs.Message, 0, len(r.held))
+	for messageID, receiptHandle := range r.held {
+		messages = append(messages, &sqs.Message{
+			MessageId:     aws.String(messageID),
+			ReceiptHandle: aws.String(receiptHandle),
 		})
-		if err != nil {
-			return errors.Wrapf(err, "failure deleting moved messages from %s", fromQueueName)
+	}
+	r.held = make(map[string]string)
+	for len(messages) > 0 {
+		n := len(messages)
+		if n > messageBatchSize {
+			n = messageBatchSize
+		}
+		if err := r.changeVisibility(messages[:n], 0); err != nil {
+			return err
+		}
+		messages = messages[n:]
+	}
+	return nil
+}
+
+func (r *requeuer) changeVisibility(messages []*sqs.Message, timeoutSeconds int64) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, len(messages))
+	for index, message := range messages {
+		entries[index] = &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(index)),
+			ReceiptHandle:     message.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(timeoutSeconds),
+		}
+	}
+	_, err := r.sqsClient.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{
+		Entries:  entries,
+		QueueUrl: r.fromQueueURL,
+	})
+	return errors.Wrapf(err, "failure changing visibility of messages in %s", r.fromQueue)
+}
+
+func snsMessageAttributes(attributes map[string]*sqs.MessageAttributeValue) map[string]*sns.MessageAttributeValue {
+	if len(attributes) == 0 {
+		return nil
+	}
+	snsAttributes := make(map[string]*sns.MessageAttributeValue, len(attributes))
+	for name, value := range attributes {
+		snsAttributes[name] = &sns.MessageAttributeValue{
+			DataType:    value.DataType,
+			StringValue: value.StringValue,
+			BinaryValue: value.BinaryValue,
 		}
 	}
+	return snsAttributes
 }
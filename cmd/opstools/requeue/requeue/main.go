@@ -25,25 +25,33 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	jsoniter "github.com/json-iterator/go"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	"github.com/panther-labs/panther/cmd/opstools"
 	"github.com/panther-labs/panther/cmd/opstools/requeue"
 	"github.com/panther-labs/panther/pkg/prompt"
 )
 
 const (
-	banner = "moves messages from one sqs queue to another"
+	banner = "moves messages from one sqs queue to another queue or sns topic"
 )
 
 var (
 	REGION      = flag.String("region", "", "The AWS region where the queues exists (optional, defaults to session env vars)")
 	FROMQ       = flag.String("from.q", "", "The name of the queue to copy from (defaults to -to.q value with '-dlq' appended)")
 	TOQ         = flag.String("to.q", "", "The name of the queue to copy to")
+	TOTOPIC     = flag.String("to.topic", "", "The SNS topic (name, ARN or URL) to publish to instead of a queue (needs -from.q)")
+	LIMIT       = flag.Uint64("limit", 0, "If non-zero, then limit the number of messages to move to this number")
+	DRYRUN      = flag.Bool("dryrun", false, "If true, log the messages that would be moved but leave them in the source queue")
+	ATTRIBUTE   = flag.String("filter.attribute", "", "Only move messages with this message attribute, either 'name' or 'name=value'")
+	BODY        = flag.String("filter.body", "", "Only move messages whose body contains this string")
 	INTERACTIVE = flag.Bool("interactive", true, "If true, prompt for required flags if not set")
 	VERBOSE     = flag.Bool("verbose", false, "Enable verbose logging")
 
@@ -86,7 +94,7 @@ func main() {
 
 	logInit() // must be done after parsing flags
 
-	sess, err := session.NewSession()
+	sess, err := opstools.NewSession()
 	if err != nil {
 		log.Fatal(err)
 		return
@@ -98,8 +106,32 @@ func main() {
 
 	promptFlags()
 	validateFlags()
+	if *TOTOPIC != "" {
+		*TOTOPIC = opstools.MustResolveTopicARN(sess, logger, "to.topic", *TOTOPIC, "")
+	}
 
-	err = requeue.Requeue(sqs.New(sess), *sess.Config.Region, *FROMQ, *TOQ)
+	opts := &requeue.Options{
+		ToQueueName:     *TOQ,
+		ToTopicARN:      *TOTOPIC,
+		Limit:           *LIMIT,
+		DryRun:          *DRYRUN,
+		AttributeFilter: *ATTRIBUTE,
+		BodyFilter:      *BODY,
+	}
+	run := opstools.StartRun(sess, logger)
+	stats := requeue.NewStats()
+	startTime := time.Now()
+	err = requeue.RequeueWithOptions(sqs.New(sess), sns.New(sess), *sess.Config.Region, *FROMQ, opts, stats)
+	snapshot := stats.Snapshot()
+	opstools.EndRun(run, logger, snapshot, err)
+	logger.Infof("received %d, requeued %d, skipped %d, failed %d messages from %s in %v with %d retries (dry run: %v)",
+		snapshot.Counter("numReceived"), snapshot.Counter("numRequeued"), snapshot.Counter("numSkipped"),
+		snapshot.Counter("numFailed"), *FROMQ, time.Since(startTime), snapshot.Counter("numRetries"), *DRYRUN)
+	if *VERBOSE {
+		if data, err := jsoniter.MarshalToString(snapshot.WithRates(nil)); err == nil {
+			logger.Infof("stats: %s", data)
+		}
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -110,7 +142,7 @@ func promptFlags() {
 		return
 	}
 
-	if *TOQ == "" {
+	if *TOQ == "" && *TOTOPIC == "" {
 		*TOQ = prompt.Read("Please enter target queue name to requeue events from associated dead letter queue: ",
 			prompt.NonemptyValidator)
 	}
@@ -126,8 +158,16 @@ func validateFlags() {
 		}
 	}()
 
-	if *TOQ == "" {
-		err = errors.New("-to.q not set")
+	if *TOQ == "" && *TOTOPIC == "" {
+		err = errors.New("-to.q or -to.topic not set")
+		return
+	}
+	if *TOQ != "" && *TOTOPIC != "" {
+		err = errors.New("only one of -to.q or -to.topic can be set")
+		return
+	}
+	if *TOTOPIC != "" && *FROMQ == "" {
+		err = errors.New("-from.q must be set with -to.topic")
 		return
 	}
 
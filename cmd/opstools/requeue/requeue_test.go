@@ -0,0 +1,203 @@
+package requeue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+const (
+	testFromQueue = "fromQueue"
+	testToQueue   = "toQueue"
+)
+
+func testMessages(n int) (messages []*sqs.Message) {
+	for i := 0; i < n; i++ {
+		id := strconv.Itoa(i)
+		messages = append(messages, &sqs.Message{
+			MessageId:     aws.String(id),
+			ReceiptHandle: aws.String("handle-" + id),
+			Body:          aws.String("body-" + id),
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				"id": {DataType: aws.String("String"), StringValue: aws.String("type-" + id)},
+			},
+		})
+	}
+	return messages
+}
+
+// newMockSQS returns a mock receiving messages from testFromQueue, toQueue is only resolved if it is not empty
+func newMockSQS(toQueue string, messages []*sqs.Message) *testutils.SqsMock {
+	sqsClient := &testutils.SqsMock{}
+	sqsClient.On("GetQueueUrl", &sqs.GetQueueUrlInput{QueueName: aws.String(testFromQueue)}).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String(testFromQueue)}, nil)
+	if toQueue != "" {
+		sqsClient.On("GetQueueUrl", &sqs.GetQueueUrlInput{QueueName: aws.String(toQueue)}).
+			Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String(toQueue)}, nil)
+	}
+	sqsClient.On("ReceiveMessage", mock.Anything).Return(&sqs.ReceiveMessageOutput{Messages: messages}, nil).Once()
+	sqsClient.On("ReceiveMessage", mock.Anything).Return(&sqs.ReceiveMessageOutput{}, nil).Once()
+	return sqsClient
+}
+
+func TestRequeue(t *testing.T) {
+	messages := testMessages(3)
+	sqsClient := newMockSQS(testToQueue, messages)
+	sqsClient.On("SendMessageBatch", mock.Anything).Return(&sqs.SendMessageBatchOutput{}, nil).Once()
+	sqsClient.On("DeleteMessageBatch", mock.Anything).Return(&sqs.DeleteMessageBatchOutput{}, nil).Once()
+
+	stats := NewStats()
+	err := RequeueWithOptions(sqsClient, nil, "region", testFromQueue, &Options{ToQueueName: testToQueue}, stats)
+	require.NoError(t, err)
+	sqsClient.AssertExpectations(t)
+	assert.Equal(t, map[string]uint64{"numReceived": 3, "numRequeued": 3}, counters(stats))
+
+	// attributes are preserved
+	send := findCall(t, sqsClient, "SendMessageBatch").(*sqs.SendMessageBatchInput)
+	require.Len(t, send.Entries, 3)
+	assert.Equal(t, messages[0].MessageAttributes, send.Entries[0].MessageAttributes)
+}
+
+func TestRequeuePartialSendFailure(t *testing.T) {
+	messages := testMessages(3)
+	sqsClient := newMockSQS(testToQueue, messages)
+	sqsClient.On("SendMessageBatch", mock.Anything).Return(&sqs.SendMessageBatchOutput{
+		Failed: []*sqs.BatchResultErrorEntry{{Id: aws.String("1"), Message: aws.String("failed")}},
+	}, nil).Once()
+	sqsClient.On("DeleteMessageBatch", mock.Anything).Return(&sqs.DeleteMessageBatchOutput{}, nil).Once()
+
+	stats := NewStats()
+	err := RequeueWithOptions(sqsClient, nil, "region", testFromQueue, &Options{ToQueueName: testToQueue}, stats)
+	require.NoError(t, err)
+	sqsClient.AssertExpectations(t)
+	assert.Equal(t, map[string]uint64{"numReceived": 3, "numRequeued": 2, "numFailed": 1}, counters(stats))
+
+	// the failed message must not be deleted
+	deleted := findCall(t, sqsClient, "DeleteMessageBatch").(*sqs.DeleteMessageBatchInput)
+	require.Len(t, deleted.Entries, 2)
+	assert.Equal(t, "handle-0", *deleted.Entries[0].ReceiptHandle)
+	assert.Equal(t, "handle-2", *deleted.Entries[1].ReceiptHandle)
+}
+
+func TestRequeueThrottledSend(t *testing.T) {
+	messages := testMessages(3)
+	sqsClient := newMockSQS(testToQueue, messages)
+	throttled := awserr.New("RequestThrottled", "rate exceeded", nil)
+	sqsClient.On("SendMessageBatch", mock.Anything).Return((*sqs.SendMessageBatchOutput)(nil), throttled).Once()
+	sqsClient.On("SendMessageBatch", mock.Anything).Return(&sqs.SendMessageBatchOutput{}, nil).Once()
+	sqsClient.On("DeleteMessageBatch", mock.Anything).Return(&sqs.DeleteMessageBatchOutput{}, nil).Once()
+
+	stats := NewStats()
+	err := RequeueWithOptions(sqsClient, nil, "region", testFromQueue, &Options{ToQueueName: testToQueue}, stats)
+	require.NoError(t, err)
+	sqsClient.AssertExpectations(t)
+	assert.Equal(t, map[string]uint64{"numReceived": 3, "numRequeued": 3, "numRetries": 1}, counters(stats))
+}
+
+func TestRequeueFilterAndLimit(t *testing.T) {
+	messages := testMessages(3)
+	sqsClient := newMockSQS(testToQueue, messages)
+	sqsClient.On("SendMessageBatch", mock.Anything).Return(&sqs.SendMessageBatchOutput{}, nil).Once()
+	sqsClient.On("DeleteMessageBatch", mock.Anything).Return(&sqs.DeleteMessageBatchOutput{}, nil).Once()
+	sqsClient.On("ChangeMessageVisibilityBatch", mock.Anything).Return(&sqs.ChangeMessageVisibilityBatchOutput{}, nil)
+
+	opts := &Options{
+		ToQueueName:     testToQueue,
+		AttributeFilter: "id=type-1",
+	}
+	stats := NewStats()
+	err := RequeueWithOptions(sqsClient, nil, "region", testFromQueue, opts, stats)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"numReceived": 3, "numRequeued": 1, "numSkipped": 2}, counters(stats))
+	send := findCall(t, sqsClient, "SendMessageBatch").(*sqs.SendMessageBatchInput)
+	require.Len(t, send.Entries, 1)
+	assert.Equal(t, "body-1", *send.Entries[0].MessageBody)
+
+	// the skipped messages are released at the end
+	release := sqsClient.Calls[len(sqsClient.Calls)-1].Arguments.Get(0).(*sqs.ChangeMessageVisibilityBatchInput)
+	assert.Len(t, release.Entries, 2)
+	assert.Equal(t, int64(0), *release.Entries[0].VisibilityTimeout)
+}
+
+func TestRequeueDryRun(t *testing.T) {
+	messages := testMessages(3)
+	sqsClient := newMockSQS(testToQueue, messages)
+	sqsClient.On("ChangeMessageVisibilityBatch", mock.Anything).Return(&sqs.ChangeMessageVisibilityBatchOutput{}, nil)
+
+	stats := NewStats()
+	opts := &Options{ToQueueName: testToQueue, DryRun: true, Limit: 2}
+	err := RequeueWithOptions(sqsClient, nil, "region", testFromQueue, opts, stats)
+	require.NoError(t, err)
+	sqsClient.AssertNotCalled(t, "SendMessageBatch", mock.Anything)
+	sqsClient.AssertNotCalled(t, "DeleteMessageBatch", mock.Anything)
+	assert.Equal(t, map[string]uint64{"numReceived": 3, "numRequeued": 2}, counters(stats))
+}
+
+func TestRequeueToTopic(t *testing.T) {
+	messages := testMessages(2)
+	sqsClient := newMockSQS("", messages)
+	sqsClient.On("DeleteMessageBatch", mock.Anything).Return(&sqs.DeleteMessageBatchOutput{}, nil).Once()
+	snsClient := &testutils.SnsMock{}
+	snsClient.On("Publish", mock.Anything).Return(&sns.PublishOutput{}, nil).Times(2)
+
+	stats := NewStats()
+	opts := &Options{ToTopicARN: "arn:aws:sns:us-east-1:123456789012:topic"}
+	err := RequeueWithOptions(sqsClient, snsClient, "region", testFromQueue, opts, stats)
+	require.NoError(t, err)
+	sqsClient.AssertExpectations(t)
+	snsClient.AssertExpectations(t)
+	assert.Equal(t, map[string]uint64{"numReceived": 2, "numRequeued": 2}, counters(stats))
+
+	publish := snsClient.Calls[0].Arguments.Get(0).(*sns.PublishInput)
+	assert.Equal(t, "body-0", *publish.Message)
+	assert.Equal(t, "type-0", *publish.MessageAttributes["id"].StringValue)
+}
+
+// counters returns the non-zero counters of the stats snapshot
+func counters(stats *Stats) map[string]uint64 {
+	values := make(map[string]uint64)
+	for name, value := range stats.Snapshot().Counters {
+		if value != 0 {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// findCall returns the input of the first call of the method
+func findCall(t *testing.T, sqsClient *testutils.SqsMock, method string) interface{} {
+	for _, call := range sqsClient.Calls {
+		if call.Method == method {
+			return call.Arguments.Get(0)
+		}
+	}
+	require.Failf(t, "method not called", "%s was not called", method)
+	return nil
+}
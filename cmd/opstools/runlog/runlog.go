@@ -0,0 +1,389 @@
+package runlog
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/google/uuid"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+const (
+	// DestinationEnv configures where runs are recorded: s3://<bucket>/<prefix>, dynamodb://<table> or a directory.
+	// Runs are recorded in DefaultDir if it is not set.
+	DestinationEnv = "PANTHER_OPSTOOLS_RUNLOG"
+
+	dynamoDBScheme = "dynamodb://"
+	redacted       = "REDACTED"
+)
+
+// The states of a run
+const (
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+)
+
+// flag names containing any of these have their values redacted
+var secretFlagNames = []string{"secret", "password", "passphrase", "token", "credential", "api-key", "apikey"}
+
+// Record is the audit record of an opstools run
+type Record struct {
+	ID   string `json:"id"`
+	Tool string `json:"tool"`
+	// Args are the command line arguments with the values of secret flags redacted
+	Args []string `json:"args"`
+	// Caller is the ARN of the AWS identity that ran the tool
+	Caller    string              `json:"caller"`
+	Account   string              `json:"account"`
+	State     string              `json:"state"`
+	StartTime time.Time           `json:"startTime"`
+	EndTime   *time.Time          `json:"endTime,omitempty"`
+	Stats     jsoniter.RawMessage `json:"stats,omitempty"`
+	Error     string              `json:"error,omitempty"`
+}
+
+// Store keeps run records, a record is written when a run starts and replaced when it ends
+type Store interface {
+	Put(ctx context.Context, record *Record) error
+	// List returns the records of the runs started since a time, in no particular order
+	List(ctx context.Context, since time.Time) ([]*Record, error)
+}
+
+// DefaultDir is the local directory runs are recorded in if the destination is not set or unreachable
+func DefaultDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	return filepath.Join(home, ".panther", "opstools-runs")
+}
+
+// NewStore returns the store of a destination, see DestinationEnv
+func NewStore(sess *session.Session, destination string) (Store, error) {
+	switch {
+	case strings.HasPrefix(destination, "s3://"):
+		path, err := s3path.Parse(destination)
+		if err != nil {
+			return nil, err
+		}
+		return &S3Store{S3: s3.New(sess), Bucket: path.Bucket, Prefix: path.Key}, nil
+	case strings.HasPrefix(destination, dynamoDBScheme):
+		table := strings.TrimPrefix(destination, dynamoDBScheme)
+		if table == "" {
+			return nil, errors.Errorf("no table in %q", destination)
+		}
+		return &DynamoDBStore{DB: dynamodb.New(sess), TableName: table}, nil
+	case destination != "":
+		return &FileStore{Dir: destination}, nil
+	default:
+		return &FileStore{Dir: DefaultDir()}, nil
+	}
+}
+
+// Run records an opstools run, it is recorded by Start and completed by End
+type Run struct {
+	Record Record
+	Store  Store
+	// Fallback stores the record if Store fails, e.g. when the destination is unreachable
+	Fallback Store
+	// OnFallback is called with the error of Store when the record is stored in Fallback instead
+	OnFallback func(err error)
+}
+
+// Start records the start of a run. Failing to get the caller identity is not an error, the caller is then "unknown".
+// The record ID is a new UUID unless Record.ID is set, e.g. to the ID of a back-fill run.
+// It returns an error only if the record could not be stored in either store.
+func (r *Run) Start(ctx context.Context, stsClient stsiface.STSAPI, tool string, args []string) error {
+	id := r.Record.ID
+	if id == "" {
+		id = uuid.New().String()
+	}
+	r.Record = Record{
+		ID:        id,
+		Tool:      tool,
+		Args:      RedactArgs(args),
+		Caller:    "unknown",
+		State:     StateRunning,
+		StartTime: time.Now().UTC(),
+	}
+	if identity, err := stsClient.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{}); err == nil {
+		r.Record.Caller = aws.StringValue(identity.Arn)
+		r.Record.Account = aws.StringValue(identity.Account)
+	}
+	return r.put(ctx)
+}
+
+// End records the outcome of a run, stats is any value that marshals to JSON (e.g. a stats snapshot)
+func (r *Run) End(ctx context.Context, stats interface{}, runErr error) error {
+	endTime := time.Now().UTC()
+	r.Record.EndTime = &endTime
+	r.Record.State = StateSucceeded
+	if runErr != nil {
+		r.Record.State = StateFailed
+		r.Record.Error = runErr.Error()
+	}
+	if stats != nil {
+		data, err := jsoniter.Marshal(stats)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal run stats")
+		}
+		r.Record.Stats = data
+	}
+	return r.put(ctx)
+}
+
+func (r *Run) put(ctx context.Context) error {
+	err := r.Store.Put(ctx, &r.Record)
+	if err == nil || r.Fallback == nil {
+		return err
+	}
+	if fallbackErr := r.Fallback.Put(ctx, &r.Record); fallbackErr != nil {
+		return multierr.Append(err, fallbackErr)
+	}
+	if r.OnFallback != nil {
+		r.OnFallback(err)
+	}
+	return nil
+}
+
+// RedactArgs replaces the values of flags whose names look like secrets, both as -flag=value and -flag value
+func RedactArgs(args []string) []string {
+	redactedArgs := make([]string, len(args))
+	copy(redactedArgs, args)
+	for i := 0; i < len(redactedArgs); i++ {
+		arg := redactedArgs[i]
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.ToLower(strings.TrimLeft(arg, "-"))
+		if pos := strings.Index(name, "="); pos >= 0 {
+			if isSecretFlag(name[:pos]) {
+				redactedArgs[i] = arg[:strings.Index(arg, "=")+1] + redacted
+			}
+			continue
+		}
+		if isSecretFlag(name) && i+1 < len(redactedArgs) && !strings.HasPrefix(redactedArgs[i+1], "-") {
+			i++
+			redactedArgs[i] = redacted
+		}
+	}
+	return redactedArgs
+}
+
+func isSecretFlag(name string) bool {
+	for _, secret := range secretFlagNames {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// FindRecord returns the record of a run started since a time from the first store that has it, nil if none has it
+func FindRecord(ctx context.Context, id string, since time.Time, stores ...Store) (*Record, error) {
+	for _, store := range stores {
+		records, err := store.List(ctx, since)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if record.ID == id {
+				return record, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// SortRecords sorts records by start time, most recent first
+func SortRecords(records []*Record) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].StartTime.After(records[j].StartTime)
+	})
+}
+
+// S3Store keeps each record in an object under a daily prefix
+type S3Store struct {
+	S3     s3iface.S3API
+	Bucket string
+	Prefix string
+}
+
+func (s *S3Store) key(record *Record) string {
+	return s.Prefix + record.StartTime.UTC().Format("2006/01/02/") + record.ID + ".json"
+}
+
+func (s *S3Store) Put(ctx context.Context, record *Record) error {
+	data, err := jsoniter.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal run record")
+	}
+	key := s.key(record)
+	_, err = s.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      &s.Bucket,
+		Key:         &key,
+		Body:        strings.NewReader(string(data)),
+		ContentType: aws.String("application/json"),
+	})
+	return errors.Wrapf(err, "failed to put s3://%s/%s", s.Bucket, key)
+}
+
+func (s *S3Store) List(ctx context.Context, since time.Time) ([]*Record, error) {
+	var keys []string
+	input := &s3.ListObjectsV2Input{
+		Bucket: &s.Bucket,
+		Prefix: &s.Prefix,
+		// the daily prefixes sort in time order
+		StartAfter: aws.String(s.Prefix + since.UTC().Format("2006/01/02/")),
+	}
+	err := s.S3.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list s3://%s/%s", s.Bucket, s.Prefix)
+	}
+	var records []*Record
+	for _, key := range keys {
+		output, err := s.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: &s.Bucket, Key: aws.String(key)})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get s3://%s/%s", s.Bucket, key)
+		}
+		record := &Record{}
+		err = jsoniter.NewDecoder(output.Body).Decode(record)
+		output.Body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read s3://%s/%s", s.Bucket, key)
+		}
+		if !record.StartTime.Before(since) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// DynamoDBStore keeps the records in a table with the string hash key "id"
+type DynamoDBStore struct {
+	DB        dynamodbiface.DynamoDBAPI
+	TableName string
+}
+
+func (d *DynamoDBStore) Put(ctx context.Context, record *Record) error {
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal run record")
+	}
+	_, err = d.DB.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: &d.TableName,
+		Item:      item,
+	})
+	return errors.Wrapf(err, "failed to put run record into %s", d.TableName)
+}
+
+func (d *DynamoDBStore) List(ctx context.Context, since time.Time) ([]*Record, error) {
+	input := &dynamodb.ScanInput{
+		TableName:        &d.TableName,
+		FilterExpression: aws.String("startTime >= :since"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			// start times are stored in UTC, RFC3339 strings sort in time order
+			":since": {S: aws.String(since.UTC().Format(time.RFC3339Nano))},
+		},
+	}
+	var records []*Record
+	var unmarshalErr error
+	err := d.DB.ScanPagesWithContext(ctx, input, func(page *dynamodb.ScanOutput, _ bool) bool {
+		for _, item := range page.Items {
+			record := &Record{}
+			if unmarshalErr = dynamodbattribute.UnmarshalMap(item, record); unmarshalErr != nil {
+				return false
+			}
+			records = append(records, record)
+		}
+		return true
+	})
+	if err == nil {
+		err = errors.Wrap(unmarshalErr, "failed to unmarshal run record")
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to scan %s", d.TableName)
+	}
+	return records, nil
+}
+
+// FileStore keeps each record in a JSON file of a local directory
+type FileStore struct {
+	Dir string
+}
+
+func (f *FileStore) Put(_ context.Context, record *Record) error {
+	if err := os.MkdirAll(f.Dir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create %s", f.Dir)
+	}
+	data, err := jsoniter.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal run record")
+	}
+	path := filepath.Join(f.Dir, record.ID+".json")
+	return errors.Wrapf(ioutil.WriteFile(path, data, 0600), "failed to write %s", path)
+}
+
+func (f *FileStore) List(_ context.Context, since time.Time) ([]*Record, error) {
+	paths, err := filepath.Glob(filepath.Join(f.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", path)
+		}
+		record := &Record{}
+		if err := jsoniter.Unmarshal(data, record); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", path)
+		}
+		if !record.StartTime.Before(since) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/runlog"
+)
+
+const listRunsCommand = "list-runs"
+
+func main() {
+	opstools.SetUsage(`%s lists the recent runs of the opstools recorded in $%s and locally in %s`,
+		listRunsCommand, runlog.DestinationEnv, runlog.DefaultDir())
+	opts := struct {
+		Since  *time.Duration
+		Tool   *string
+		JSON   *bool
+		Debug  *bool
+		Region *string
+	}{
+		Since:  flag.Duration("since", 7*24*time.Hour, "List the runs started in this duration before now"),
+		Tool:   flag.String("tool", "", "If set, only list the runs of this tool"),
+		JSON:   flag.Bool("json", false, "Print the records as JSON instead of a table"),
+		Debug:  flag.Bool("debug", false, "Enable additional logging"),
+		Region: flag.String("region", "", "Set the AWS region to run on"),
+	}
+	if len(os.Args) < 2 || os.Args[1] != listRunsCommand {
+		flag.Usage()
+		os.Exit(2)
+	}
+	_ = flag.CommandLine.Parse(os.Args[2:]) // exits on error
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region: opts.Region,
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+	store, err := runlog.NewStore(sess, os.Getenv(runlog.DestinationEnv))
+	if err != nil {
+		log.Fatalf("%s: %s", runlog.DestinationEnv, err)
+	}
+
+	ctx := context.Background()
+	since := time.Now().Add(-*opts.Since)
+	records, err := store.List(ctx, since)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// runs are recorded locally when the destination is unreachable
+	if _, isLocal := store.(*runlog.FileStore); !isLocal {
+		local, err := (&runlog.FileStore{Dir: runlog.DefaultDir()}).List(ctx, since)
+		if err != nil {
+			log.Fatal(err)
+		}
+		records = mergeRecords(records, local)
+	}
+	var filtered []*runlog.Record
+	for _, record := range records {
+		if *opts.Tool == "" || record.Tool == *opts.Tool {
+			filtered = append(filtered, record)
+		}
+	}
+	runlog.SortRecords(filtered)
+
+	if *opts.JSON {
+		encoder := jsoniter.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(filtered); err != nil {
+			log.Fatalf("failed to write records: %s", err)
+		}
+		return
+	}
+	printRecords(filtered)
+}
+
+// mergeRecords returns the records of both lists, a run in both keeps its ended record
+func mergeRecords(records, other []*runlog.Record) []*runlog.Record {
+	byID := make(map[string]int, len(records))
+	for i, record := range records {
+		byID[record.ID] = i
+	}
+	for _, record := range other {
+		i, ok := byID[record.ID]
+		if !ok {
+			byID[record.ID] = len(records)
+			records = append(records, record)
+			continue
+		}
+		if records[i].EndTime == nil {
+			records[i] = record
+		}
+	}
+	return records
+}
+
+func printRecords(records []*runlog.Record) {
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "START\tTOOL\tSTATE\tDURATION\tCALLER\tARGS\tERROR")
+	for _, record := range records {
+		duration := "-"
+		if record.EndTime != nil {
+			duration = record.EndTime.Sub(record.StartTime).Round(time.Second).String()
+		}
+		errMessage := record.Error
+		if errMessage == "" {
+			errMessage = "-"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", record.StartTime.Format(time.RFC3339), record.Tool,
+			record.State, duration, record.Caller, strings.Join(record.Args, " "), errMessage)
+	}
+	_ = table.Flush()
+}
@@ -0,0 +1,156 @@
+package runlog
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSTS struct {
+	stsiface.STSAPI
+	err error
+}
+
+func (f *fakeSTS) GetCallerIdentityWithContext(aws.Context, *sts.GetCallerIdentityInput, ...request.Option) (
+	*sts.GetCallerIdentityOutput, error) {
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &sts.GetCallerIdentityOutput{
+		Account: aws.String("123456789012"),
+		Arn:     aws.String("arn:aws:iam::123456789012:user/operator"),
+	}, nil
+}
+
+type failingStore struct {
+	Store
+}
+
+func (failingStore) Put(context.Context, *Record) error {
+	return errors.New("unreachable")
+}
+
+func tempStore(t *testing.T) *FileStore {
+	dir, err := ioutil.TempDir("", "runlog")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	return &FileStore{Dir: dir}
+}
+
+func TestRedactArgs(t *testing.T) {
+	args := []string{"-queue", "q", "-api-token", "t0ken", "--Password=p", "-token=", "-limit=10", "-client-secret"}
+	assert.Equal(t,
+		[]string{"-queue", "q", "-api-token", redacted, "--Password=" + redacted, "-token=" + redacted, "-limit=10", "-client-secret"},
+		RedactArgs(args))
+	assert.Equal(t, "t0ken", args[3]) // not modified
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	store := tempStore(t)
+	run := &Run{Store: store}
+	require.NoError(t, run.Start(ctx, &fakeSTS{}, "requeue", []string{"-to.q", "q"}))
+
+	records, err := store.List(ctx, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, StateRunning, records[0].State)
+	assert.Equal(t, "arn:aws:iam::123456789012:user/operator", records[0].Caller)
+	assert.Equal(t, "123456789012", records[0].Account)
+	assert.Nil(t, records[0].EndTime)
+
+	require.NoError(t, run.End(ctx, map[string]uint64{"numRequeued": 3}, errors.New("failed")))
+	records, err = store.List(ctx, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	require.Len(t, records, 1) // replaced
+	assert.Equal(t, run.Record.ID, records[0].ID)
+	assert.Equal(t, StateFailed, records[0].State)
+	assert.Equal(t, "failed", records[0].Error)
+	assert.NotNil(t, records[0].EndTime)
+	assert.JSONEq(t, `{"numRequeued":3}`, string(records[0].Stats))
+
+	records, err = store.List(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func TestRunFallback(t *testing.T) {
+	ctx := context.Background()
+	fallback := tempStore(t)
+	var fallbackErr error
+	run := &Run{
+		Store:    failingStore{},
+		Fallback: fallback,
+		OnFallback: func(err error) {
+			fallbackErr = err
+		},
+	}
+	require.NoError(t, run.Start(ctx, &fakeSTS{err: errors.New("denied")}, "lakedelete", nil))
+	assert.EqualError(t, fallbackErr, "unreachable")
+
+	records, err := fallback.List(ctx, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "unknown", records[0].Caller)
+
+	run.Fallback = failingStore{}
+	assert.Error(t, run.End(ctx, nil, nil))
+}
+
+func TestFindRecord(t *testing.T) {
+	ctx := context.Background()
+	store, other := tempStore(t), tempStore(t)
+	run := &Run{Record: Record{ID: "backfill-1"}, Store: store}
+	require.NoError(t, run.Start(ctx, &fakeSTS{}, "s3queue", nil))
+	assert.Equal(t, "backfill-1", run.Record.ID) // the preset ID is kept
+
+	since := time.Now().Add(-time.Minute)
+	record, err := FindRecord(ctx, "backfill-1", since, other, store)
+	require.NoError(t, err)
+	require.NotNil(t, record)
+	assert.Equal(t, "s3queue", record.Tool)
+
+	record, err = FindRecord(ctx, "backfill-2", since, other, store)
+	require.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestSortRecords(t *testing.T) {
+	now := time.Now()
+	records := []*Record{{ID: "a", StartTime: now.Add(-time.Hour)}, {ID: "b", StartTime: now}, {ID: "c", StartTime: now.Add(-time.Minute)}}
+	SortRecords(records)
+	assert.Equal(t, "b", records[0].ID)
+	assert.Equal(t, "c", records[1].ID)
+	assert.Equal(t, "a", records[2].ID)
+}
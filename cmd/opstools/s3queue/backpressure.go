@@ -0,0 +1,176 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultNotifyBuffer is the number of listed files queued for the writers if the profile does not set it
+const defaultNotifyBuffer = 1000
+
+// latencyBuckets are the upper bounds of the publish latency histogram, percentiles are rounded up to them
+var latencyBuckets = [...]time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+// latencyHistogram counts latencies by bucket, so that the percentiles of millions of batches take no memory
+type latencyHistogram struct {
+	counts [len(latencyBuckets) + 1]uint64 // the last bucket counts the latencies above all the bounds
+	total  uint64
+}
+
+func (h *latencyHistogram) add(latency time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool {
+		return latency <= latencyBuckets[i]
+	})
+	h.counts[i]++
+	h.total++
+}
+
+// percentile returns the bound of the bucket of a percentile (0-1), the last bound if it is above all of them
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p * float64(h.total)))
+	var n uint64
+	for i, count := range h.counts {
+		n += count
+		if n >= rank && i < len(latencyBuckets) {
+			return latencyBuckets[i]
+		}
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+// backpressure tracks whether the listing or the sending is the bottleneck of a run: the depth of the notify
+// channel, the times the listers waited for room in it and the latency of the sends of the writers.
+// It is safe for concurrent use.
+type backpressure struct {
+	notifyChan chan listedObject
+	stats      *Stats
+	logger     *zap.Logger
+
+	mu       sync.Mutex
+	interval latencyHistogram // the sends since the previous report
+	run      latencyHistogram
+	blocked  uint64 // NumListerBlocked at the previous report
+}
+
+// published records the latency of the send of a batch, including its retries
+func (b *backpressure) published(latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.interval.add(latency)
+	b.run.add(latency)
+}
+
+// report sets the gauges of the stats and logs the backpressure since the previous report. It only logs at info
+// level if the listers waited for the writers, more writers (or a larger buffer for bursts) would then help.
+func (b *backpressure) report() {
+	b.mu.Lock()
+	interval, run := b.interval, b.run
+	b.interval = latencyHistogram{}
+	blocked := b.stats.NumListerBlocked.Value()
+	numBlocked := blocked - b.blocked
+	b.blocked = blocked
+	b.mu.Unlock()
+
+	depth := len(b.notifyChan)
+	b.stats.NotifyDepth.Set(int64(depth))
+	b.stats.PublishLatencyP50.Set(run.percentile(0.5).Milliseconds())
+	b.stats.PublishLatencyP90.Set(run.percentile(0.9).Milliseconds())
+	b.stats.PublishLatencyP99.Set(run.percentile(0.99).Milliseconds())
+	log := b.logger.Debug
+	if numBlocked > 0 {
+		log = b.logger.Info
+	}
+	log("backpressure",
+		zap.Int("notifyDepth", depth),
+		zap.Int("notifyBuffer", cap(b.notifyChan)),
+		zap.Int64("concurrency", b.stats.Concurrency.Value()),
+		zap.Uint64("listerBlocked", numBlocked),
+		zap.Uint64("batchesSent", interval.total),
+		zap.Duration("sendP50", interval.percentile(0.5)),
+		zap.Duration("sendP90", interval.percentile(0.9)),
+		zap.Duration("sendP99", interval.percentile(0.99)))
+}
+
+// start reports every interval until the returned function is called, which reports a last time
+func (b *backpressure) start(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.report()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		b.report()
+	}
+}
+
+// enqueue passes a listed file to the writers, counting the times and the time the lister waits for room in the
+// channel. It returns false if ctx is done first.
+func enqueue(ctx context.Context, notifyChan chan listedObject, listed listedObject, stats *Stats) bool {
+	select {
+	case notifyChan <- listed:
+		return true
+	default:
+	}
+	stats.NumListerBlocked.Inc()
+	start := time.Now()
+	defer func() {
+		stats.ListerBlockedMillis.Add(uint64(time.Since(start).Milliseconds()))
+	}()
+	select {
+	case notifyChan <- listed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
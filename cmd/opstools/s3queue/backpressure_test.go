@@ -0,0 +1,74 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var histogram latencyHistogram
+	assert.Equal(t, time.Duration(0), histogram.percentile(0.5))
+	for i := 0; i < 90; i++ {
+		histogram.add(20 * time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		histogram.add(time.Second)
+	}
+	histogram.add(time.Hour)
+	assert.Equal(t, 25*time.Millisecond, histogram.percentile(0.5))
+	assert.Equal(t, 25*time.Millisecond, histogram.percentile(0.9))
+	assert.Equal(t, time.Second, histogram.percentile(0.99))
+	assert.Equal(t, time.Minute, histogram.percentile(1)) // above all the buckets
+}
+
+func TestBackpressure(t *testing.T) {
+	stats := NewStats()
+	notifyChan := make(chan listedObject, 2)
+	monitor := &backpressure{notifyChan: notifyChan, stats: stats, logger: zap.NewNop()}
+	assert.True(t, enqueue(context.Background(), notifyChan, listedObject{}, stats))
+	assert.True(t, enqueue(context.Background(), notifyChan, listedObject{}, stats))
+	assert.Equal(t, uint64(0), stats.NumListerBlocked.Value())
+
+	// the lister waits for a writer once the buffer is full
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-notifyChan
+	}()
+	assert.True(t, enqueue(context.Background(), notifyChan, listedObject{}, stats))
+	assert.Equal(t, uint64(1), stats.NumListerBlocked.Value())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, enqueue(ctx, notifyChan, listedObject{}, stats))
+	assert.Equal(t, uint64(2), stats.NumListerBlocked.Value())
+
+	monitor.published(40 * time.Millisecond)
+	monitor.published(200 * time.Millisecond)
+	monitor.report()
+	assert.Equal(t, int64(2), stats.NotifyDepth.Value())
+	assert.Equal(t, int64(50), stats.PublishLatencyP50.Value())
+	assert.Equal(t, int64(250), stats.PublishLatencyP99.Value())
+	assert.Equal(t, uint64(0), monitor.interval.total) // the interval starts over
+	assert.Equal(t, uint64(2), monitor.run.total)
+}
@@ -0,0 +1,281 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/lambdalogger"
+	"github.com/panther-labs/panther/pkg/stats"
+)
+
+const (
+	// the max keys of a BatchGetItem and the max requests of a BatchWriteItem
+	bookmarkGetBatchSize   = 100
+	bookmarkWriteBatchSize = 25
+	// the attempts at the unprocessed items of a batch, DynamoDB returns them when throttled
+	bookmarkMaxAttempts = 5
+	bookmarkRetryDelay  = 100 * time.Millisecond
+)
+
+// Bookmarks stand for a destination, they skip the files already sent to it and record the files it was sent in a
+// DynamoDB table, so that re-running a back-fill after a partial failure does not notify the files twice.
+// The table has the string hash key "id", the hash of the scope, bucket and key of a file. Its items expire at
+// "expiresAt" if TTL is enabled on the table. It is safe for concurrent use.
+//
+// Files are skipped as they are sent, they are counted as sent by the stats of the publisher and as skipped by
+// NumSkipped. A notification is skipped only if all its files are bookmarked.
+type Bookmarks struct {
+	Destination backfill.Destination
+	DB          dynamodbiface.DynamoDBAPI
+	TableName   string
+	// Scope separates the bookmarks of different destinations in a table, e.g. the description of the destination
+	Scope string
+	// RunID is recorded with the bookmarks of the files sent
+	RunID string
+	// TTL is how long a file is bookmarked, forever if 0
+	TTL time.Duration
+	// DryRun only skips the bookmarked files, the files sent are not bookmarked
+	DryRun bool
+	// NumSkipped if not nil counts the files skipped
+	NumSkipped *stats.Counter
+}
+
+func (b *Bookmarks) MaxBatchSize() int {
+	return b.Destination.MaxBatchSize()
+}
+
+func (b *Bookmarks) MaxPayloadBytes() int {
+	return b.Destination.MaxPayloadBytes()
+}
+
+// Send sends the notifications with files not bookmarked, and bookmarks their files once they are sent.
+// Failing to bookmark is only logged, the files are then notified again by a re-run.
+func (b *Bookmarks) Send(ctx context.Context, batch []*backfill.Notification) error {
+	bookmarked, err := b.lookup(ctx, batch)
+	if err != nil {
+		return err
+	}
+	pending := make([]*backfill.Notification, 0, len(batch))
+	for _, notification := range batch {
+		if !b.allBookmarked(notification, bookmarked) {
+			pending = append(pending, notification)
+			continue
+		}
+		if b.NumSkipped != nil {
+			b.NumSkipped.Add(uint64(len(notification.Event.Records)))
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	sendErr := b.Destination.Send(ctx, pending)
+	sent := pending
+	if sendErr != nil {
+		var unsent *backfill.UnsentError
+		if !errors.As(sendErr, &unsent) {
+			return sendErr
+		}
+		sent = without(pending, unsent.Unsent)
+	}
+	if !b.DryRun {
+		if err := b.record(ctx, sent); err != nil {
+			lambdalogger.FromContext(ctx).Warn("failed to bookmark sent files, a re-run sends them again", zap.Error(err))
+		}
+	}
+	return sendErr
+}
+
+// returns the IDs of the bookmarked files of the notifications
+func (b *Bookmarks) lookup(ctx context.Context, batch []*backfill.Notification) (map[string]bool, error) {
+	var keys []map[string]*dynamodb.AttributeValue
+	seen := make(map[string]bool)
+	for _, notification := range batch {
+		for i := range notification.Event.Records {
+			// the keys of a BatchGetItem must be distinct
+			if id := b.id(&notification.Event.Records[i].S3); !seen[id] {
+				seen[id] = true
+				keys = append(keys, map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}})
+			}
+		}
+	}
+	bookmarked := make(map[string]bool)
+	for start := 0; start < len(keys); start += bookmarkGetBatchSize {
+		end := start + bookmarkGetBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		request := map[string]*dynamodb.KeysAndAttributes{
+			b.TableName: {Keys: keys[start:end], ProjectionExpression: aws.String("id")},
+		}
+		for attempt := 1; len(request) > 0; attempt++ {
+			if attempt > bookmarkMaxAttempts {
+				return nil, errors.Errorf("failed to read bookmarks from %s, throttled", b.TableName)
+			}
+			if err := bookmarkBackoff(ctx, attempt); err != nil {
+				return nil, err
+			}
+			output, err := b.DB.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{RequestItems: request})
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read bookmarks from %s", b.TableName)
+			}
+			for _, item := range output.Responses[b.TableName] {
+				bookmarked[aws.StringValue(item["id"].S)] = true
+			}
+			request = output.UnprocessedKeys
+		}
+	}
+	return bookmarked, nil
+}
+
+// bookmarks the files of the notifications
+func (b *Bookmarks) record(ctx context.Context, notifications []*backfill.Notification) error {
+	item := map[string]*dynamodb.AttributeValue{
+		"scope": {S: aws.String(b.Scope)},
+		"runId": {S: aws.String(b.RunID)},
+	}
+	if b.TTL > 0 {
+		item["expiresAt"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(b.TTL).Unix(), 10))}
+	}
+	var requests []*dynamodb.WriteRequest
+	seen := make(map[string]bool)
+	for _, notification := range notifications {
+		for i := range notification.Event.Records {
+			// the items of a BatchWriteItem must be distinct
+			id := b.id(&notification.Event.Records[i].S3)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			fileItem := map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}}
+			for name, value := range item {
+				fileItem[name] = value
+			}
+			requests = append(requests, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: fileItem}})
+		}
+	}
+	return b.write(ctx, requests)
+}
+
+// Reset deletes the bookmarks of the scope so that the files are sent again, it returns the number deleted
+func (b *Bookmarks) Reset(ctx context.Context) (int, error) {
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(b.TableName),
+		ProjectionExpression:     aws.String("id"),
+		FilterExpression:         aws.String("#scope = :scope"),
+		ExpressionAttributeNames: map[string]*string{"#scope": aws.String("scope")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":scope": {S: aws.String(b.Scope)},
+		},
+	}
+	var requests []*dynamodb.WriteRequest
+	err := b.DB.ScanPagesWithContext(ctx, input, func(page *dynamodb.ScanOutput, _ bool) bool {
+		for _, item := range page.Items {
+			requests = append(requests, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: item}})
+		}
+		return true
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to scan the bookmarks of %s", b.TableName)
+	}
+	return len(requests), b.write(ctx, requests)
+}
+
+// writes the requests in batches, retrying the unprocessed ones
+func (b *Bookmarks) write(ctx context.Context, requests []*dynamodb.WriteRequest) error {
+	for start := 0; start < len(requests); start += bookmarkWriteBatchSize {
+		end := start + bookmarkWriteBatchSize
+		if end > len(requests) {
+			end = len(requests)
+		}
+		request := map[string][]*dynamodb.WriteRequest{b.TableName: requests[start:end]}
+		for attempt := 1; len(request) > 0; attempt++ {
+			if attempt > bookmarkMaxAttempts {
+				return errors.Errorf("failed to write bookmarks to %s, throttled", b.TableName)
+			}
+			if err := bookmarkBackoff(ctx, attempt); err != nil {
+				return err
+			}
+			output, err := b.DB.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{RequestItems: request})
+			if err != nil {
+				return errors.Wrapf(err, "failed to write bookmarks to %s", b.TableName)
+			}
+			request = output.UnprocessedItems
+		}
+	}
+	return nil
+}
+
+// returns the ID of the bookmark of a file in the scope
+func (b *Bookmarks) id(object *events.S3Entity) string {
+	hash := sha256.Sum256([]byte(b.Scope + "\x00" + object.Bucket.Name + "\x00" + object.Object.Key))
+	return hex.EncodeToString(hash[:])
+}
+
+// waits before the retries of the unprocessed items of a batch, exponentially longer
+func bookmarkBackoff(ctx context.Context, attempt int) error {
+	if attempt == 1 {
+		return nil
+	}
+	timer := time.NewTimer(bookmarkRetryDelay << uint(attempt-2))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// returns true if all the files of a notification are bookmarked
+func (b *Bookmarks) allBookmarked(notification *backfill.Notification, bookmarked map[string]bool) bool {
+	for i := range notification.Event.Records {
+		if !bookmarked[b.id(&notification.Event.Records[i].S3)] {
+			return false
+		}
+	}
+	return true
+}
+
+// returns the notifications not in others, in order
+func without(notifications, others []*backfill.Notification) []*backfill.Notification {
+	excluded := make(map[*backfill.Notification]bool, len(others))
+	for _, notification := range others {
+		excluded[notification] = true
+	}
+	var rest []*backfill.Notification
+	for _, notification := range notifications {
+		if !excluded[notification] {
+			rest = append(rest, notification)
+		}
+	}
+	return rest
+}
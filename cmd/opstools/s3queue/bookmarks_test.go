@@ -0,0 +1,203 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+)
+
+const testBookmarkTable = "bookmarks"
+
+// bookmarkDB keeps the items of a table by id, the first calls of a batch leave a request unprocessed if throttled
+type bookmarkDB struct {
+	dynamodbiface.DynamoDBAPI
+	throttled bool
+
+	mu       sync.Mutex
+	items    map[string]map[string]*dynamodb.AttributeValue
+	numCalls int
+}
+
+func (db *bookmarkDB) BatchGetItemWithContext(_ aws.Context, input *dynamodb.BatchGetItemInput,
+	_ ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.numCalls++
+	output := &dynamodb.BatchGetItemOutput{Responses: make(map[string][]map[string]*dynamodb.AttributeValue)}
+	keys := input.RequestItems[testBookmarkTable].Keys
+	if db.throttled && len(keys) > 1 {
+		output.UnprocessedKeys = map[string]*dynamodb.KeysAndAttributes{testBookmarkTable: {Keys: keys[1:]}}
+		keys = keys[:1]
+	}
+	for _, key := range keys {
+		if item, ok := db.items[aws.StringValue(key["id"].S)]; ok {
+			output.Responses[testBookmarkTable] = append(output.Responses[testBookmarkTable], item)
+		}
+	}
+	return output, nil
+}
+
+func (db *bookmarkDB) BatchWriteItemWithContext(_ aws.Context, input *dynamodb.BatchWriteItemInput,
+	_ ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.numCalls++
+	output := &dynamodb.BatchWriteItemOutput{}
+	requests := input.RequestItems[testBookmarkTable]
+	if db.throttled && len(requests) > 1 {
+		output.UnprocessedItems = map[string][]*dynamodb.WriteRequest{testBookmarkTable: requests[1:]}
+		requests = requests[:1]
+	}
+	if db.items == nil {
+		db.items = make(map[string]map[string]*dynamodb.AttributeValue)
+	}
+	for _, writeRequest := range requests {
+		if writeRequest.PutRequest != nil {
+			db.items[aws.StringValue(writeRequest.PutRequest.Item["id"].S)] = writeRequest.PutRequest.Item
+		} else {
+			delete(db.items, aws.StringValue(writeRequest.DeleteRequest.Key["id"].S))
+		}
+	}
+	return output, nil
+}
+
+func (db *bookmarkDB) ScanPagesWithContext(_ aws.Context, input *dynamodb.ScanInput,
+	fn func(*dynamodb.ScanOutput, bool) bool, _ ...request.Option) error {
+
+	db.mu.Lock()
+	page := &dynamodb.ScanOutput{}
+	scope := aws.StringValue(input.ExpressionAttributeValues[":scope"].S)
+	for id, item := range db.items {
+		if aws.StringValue(item["scope"].S) == scope {
+			page.Items = append(page.Items, map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}})
+		}
+	}
+	db.mu.Unlock()
+	fn(page, true)
+	return nil
+}
+
+func testBookmarks(db *bookmarkDB, scope string) (*Bookmarks, *backfill.RecordingDestination) {
+	destination := &backfill.RecordingDestination{BatchSize: 10}
+	return &Bookmarks{
+		Destination: destination,
+		DB:          db,
+		TableName:   testBookmarkTable,
+		Scope:       scope,
+		RunID:       "run",
+	}, destination
+}
+
+func TestBookmarksSkipSentFiles(t *testing.T) {
+	s3Client := testS3(6)
+	db := &bookmarkDB{}
+
+	// the first run stops after sending 3 files
+	bookmarks, destination := testBookmarks(db, "sqs queue")
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), bookmarks, nil, 1, Limit{Files: 3}, nil, nil, nil,
+		NewStats())
+	require.NoError(t, err)
+	require.Len(t, destination.Notifications(), 3)
+	require.Len(t, db.items, 3)
+	for _, item := range db.items {
+		assert.Equal(t, "sqs queue", aws.StringValue(item["scope"].S))
+		assert.Equal(t, "run", aws.StringValue(item["runId"].S))
+		assert.Nil(t, item["expiresAt"]) // no TTL
+	}
+
+	// the re-run only sends the others
+	bookmarks, destination = testBookmarks(db, "sqs queue")
+	stats := NewStats()
+	bookmarks.NumSkipped = stats.NumBookmarked
+	err = S3QueueTo(context.Background(), "run", testSources(s3Client), bookmarks, nil, 1, Limit{}, nil, nil, nil, stats)
+	require.NoError(t, err)
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 3)
+	for i, notification := range notifications {
+		assert.Equal(t, s3Client.Spec.Key(i+3), notification.Event.Records[0].S3.Object.Key)
+	}
+	assert.Equal(t, uint64(3), stats.Snapshot().Counter("numBookmarked"))
+	assert.Len(t, db.items, 6)
+
+	// another destination has its own bookmarks
+	bookmarks, destination = testBookmarks(db, "sns topic")
+	err = S3QueueTo(context.Background(), "run", testSources(s3Client), bookmarks, nil, 1, Limit{}, nil, nil, nil, NewStats())
+	require.NoError(t, err)
+	assert.Len(t, destination.Notifications(), 6)
+	assert.Len(t, db.items, 12)
+
+	// a reset sends them again
+	bookmarks, destination = testBookmarks(db, "sqs queue")
+	numDeleted, err := bookmarks.Reset(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 6, numDeleted)
+	assert.Len(t, db.items, 6)
+	err = S3QueueTo(context.Background(), "run", testSources(s3Client), bookmarks, nil, 1, Limit{}, nil, nil, nil, NewStats())
+	require.NoError(t, err)
+	assert.Len(t, destination.Notifications(), 6)
+}
+
+func TestBookmarksUnsent(t *testing.T) {
+	db := &bookmarkDB{throttled: true}
+	var batch []*backfill.Notification
+	for _, key := range []string{"a.json.gz", "b.json.gz", "c.json.gz", "d.json.gz"} {
+		batch = append(batch, &backfill.Notification{
+			Event: (&backfill.Object{Bucket: testBucket, Key: key}).Notification(),
+		})
+	}
+
+	// only the notifications sent are bookmarked, the unprocessed requests are retried
+	bookmarks, _ := testBookmarks(db, "sqs queue")
+	unsent := &backfill.UnsentError{Unsent: batch[2:3]}
+	bookmarks.Destination = &unsentDestination{err: unsent}
+	err := bookmarks.Send(context.Background(), batch)
+	assert.Equal(t, unsent, err)
+	assert.Len(t, db.items, 3)
+	assert.Greater(t, db.numCalls, 2)
+
+	// a dry run does not bookmark
+	bookmarks, destination := testBookmarks(db, "dry run")
+	bookmarks.DryRun = true
+	require.NoError(t, bookmarks.Send(context.Background(), batch))
+	assert.Len(t, destination.Notifications(), 4)
+	assert.Len(t, db.items, 3)
+}
+
+// fails to send some notifications of every batch
+type unsentDestination struct {
+	backfill.RecordingDestination
+	err *backfill.UnsentError
+}
+
+func (d *unsentDestination) Send(context.Context, []*backfill.Notification) error {
+	return d.err
+}
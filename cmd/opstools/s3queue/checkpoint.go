@@ -0,0 +1,281 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+// Checkpoint is the position of a run such that every file before it was sent but the Failed ranges, a run given it
+// resumes after it and sends the failed ranges again first. Files are listed in order, source after source.
+type Checkpoint struct {
+	RunID string `json:"runId"`
+	// Sources are the paths of the run, a run resuming must have the same
+	Sources []string `json:"sources"`
+	// Source is the index of the source being listed, the sources before it were sent
+	Source int `json:"source"`
+	// StartAfter is the last key of the source such that it and the keys before it were sent
+	StartAfter string `json:"startAfter,omitempty"`
+	// Failed are the ranges of keys before the position that failed to send and were gone past
+	Failed []FailedRange `json:"failed,omitempty"`
+	// Complete is true if all the files of the sources were sent
+	Complete bool `json:"complete,omitempty"`
+	// NumFiles and NumBytes count the files sent, including by the runs resumed
+	NumFiles  uint64    `json:"numFiles"`
+	NumBytes  uint64    `json:"numBytes"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// FailedRange is a range of the keys of a source that failed to send
+type FailedRange struct {
+	// Source is the index of the source of the keys
+	Source int `json:"source"`
+	// StartAfter is the key before the range, the range starts at the first key of the source if empty.
+	// It moves up to Last as the keys of the range are sent again.
+	StartAfter string `json:"startAfter,omitempty"`
+	// Last is the last key of the range
+	Last string `json:"last"`
+}
+
+func (r *FailedRange) sent() bool {
+	return r.StartAfter == r.Last
+}
+
+// NewCheckpoint returns the checkpoint of a run starting from the beginning
+func NewCheckpoint(runID string, sources []*Source) *Checkpoint {
+	checkpoint := &Checkpoint{RunID: runID}
+	for _, source := range sources {
+		checkpoint.Sources = append(checkpoint.Sources, source.Path.String())
+	}
+	return checkpoint
+}
+
+// Validate checks the checkpoint is of a run of the sources
+func (c *Checkpoint) Validate(sources []*Source) error {
+	if len(c.Sources) != len(sources) {
+		return errors.Errorf("checkpoint of run %s has %d paths, not %d", c.RunID, len(c.Sources), len(sources))
+	}
+	for i, source := range sources {
+		if path := source.Path.String(); c.Sources[i] != path {
+			return errors.Errorf("checkpoint of run %s has path %s instead of %s", c.RunID, c.Sources[i], path)
+		}
+	}
+	if c.Source < 0 || c.Source >= len(sources) {
+		return errors.Errorf("checkpoint of run %s has invalid source %d", c.RunID, c.Source)
+	}
+	for _, failed := range c.Failed {
+		if failed.Source < 0 || failed.Source > c.Source || failed.Last == "" {
+			return errors.Errorf("checkpoint of run %s has invalid failed range %+v", c.RunID, failed)
+		}
+	}
+	return nil
+}
+
+// CheckpointStore saves the checkpoints of a run
+type CheckpointStore interface {
+	Save(ctx context.Context, checkpoint *Checkpoint) error
+}
+
+// Checkpointing saves the checkpoint of a run as it advances and resumes a run from a checkpoint
+type Checkpointing struct {
+	Store CheckpointStore
+	// Interval is the min time between saves, the last checkpoint is always saved
+	Interval time.Duration
+	// Checkpoint is where the run starts, from NewCheckpoint or the checkpoint of the run resumed
+	Checkpoint *Checkpoint
+}
+
+// FileCheckpoint is a local file storing the checkpoint of a run
+type FileCheckpoint string
+
+// Save replaces the file so that it always has a complete checkpoint
+func (f FileCheckpoint) Save(_ context.Context, checkpoint *Checkpoint) error {
+	data, err := jsoniter.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := string(f)
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "failed to save checkpoint")
+	}
+	defer os.Remove(tmp.Name()) // after a failure
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to save checkpoint %s", path)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "failed to save checkpoint %s", path)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrapf(err, "failed to save checkpoint %s", path)
+	}
+	return nil
+}
+
+// Load reads the checkpoint of the file
+func (f FileCheckpoint) Load() (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read checkpoint")
+	}
+	checkpoint := &Checkpoint{}
+	if err := jsoniter.Unmarshal(data, checkpoint); err != nil {
+		return nil, errors.Wrapf(err, "invalid checkpoint %s", f)
+	}
+	return checkpoint, nil
+}
+
+// batchEnd is the position of the last file of a batch and the totals of the batch
+type batchEnd struct {
+	source   int
+	key      string
+	numFiles uint64
+	numBytes uint64
+	// startAfter is the key before the first file of the batch, the batch is a range of keys of the source
+	startAfter string
+	// retry is the index plus one of the failed range of the checkpoint the batch is of, zero if of the listing
+	retry int
+	// failed is true if the batch failed to send
+	failed bool
+}
+
+// checkpointer advances the checkpoint past the batches sent or failed. Batches are sent concurrently, a batch done
+// before the batches listed ahead of it does not move the checkpoint until they are done too, so that a run resuming
+// never skips files that were not sent. The batches that failed are kept as failed ranges to send again, the batches
+// of a failed range sent again move the range instead of the position. It is safe for concurrent use.
+type checkpointer struct {
+	store    CheckpointStore
+	interval time.Duration
+
+	mu         sync.Mutex
+	checkpoint Checkpoint
+	next       uint64              // the sequence number of the first batch not done
+	done       map[uint64]batchEnd // the batches done after it
+	savedAt    time.Time
+	saveErr    error
+}
+
+// newCheckpointer returns nil if checkpointing is nil, the methods of a nil checkpointer do nothing
+func newCheckpointer(checkpointing *Checkpointing) *checkpointer {
+	if checkpointing == nil {
+		return nil
+	}
+	tracker := &checkpointer{
+		store:      checkpointing.Store,
+		interval:   checkpointing.Interval,
+		checkpoint: *checkpointing.Checkpoint,
+		done:       make(map[uint64]batchEnd),
+		savedAt:    time.Now(),
+	}
+	// the failed ranges move as they are sent again, the lister reads the ones of the run resumed
+	tracker.checkpoint.Failed = append([]FailedRange(nil), checkpointing.Checkpoint.Failed...)
+	return tracker
+}
+
+// Sent records the batch with the sequence number, the numbers of batches follow the listing order from zero
+func (c *checkpointer) Sent(ctx context.Context, seq uint64, end batchEnd) {
+	c.record(ctx, seq, end)
+}
+
+// Failed records the batch with the sequence number that failed to send, the checkpoint moves past it and keeps its
+// keys as a failed range
+func (c *checkpointer) Failed(ctx context.Context, seq uint64, end batchEnd) {
+	end.failed = true
+	c.record(ctx, seq, end)
+}
+
+func (c *checkpointer) record(ctx context.Context, seq uint64, end batchEnd) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done[seq] = end
+	advanced := false
+	for end, ok := c.done[c.next]; ok; end, ok = c.done[c.next] {
+		delete(c.done, c.next)
+		c.next++
+		c.advance(&end)
+		advanced = true
+	}
+	if advanced && time.Since(c.savedAt) >= c.interval {
+		c.save(ctx)
+	}
+}
+
+func (c *checkpointer) advance(end *batchEnd) {
+	if end.retry > 0 {
+		c.checkpoint.Failed[end.retry-1].StartAfter = end.key
+	} else {
+		c.checkpoint.Source, c.checkpoint.StartAfter = end.source, end.key
+	}
+	if end.failed {
+		c.checkpoint.Failed = append(c.checkpoint.Failed, FailedRange{
+			Source:     end.source,
+			StartAfter: end.startAfter,
+			Last:       end.key,
+		})
+		return
+	}
+	c.checkpoint.NumFiles += end.numFiles
+	c.checkpoint.NumBytes += end.numBytes
+}
+
+// Finish saves the last checkpoint, complete if all the files were sent, and returns the first save error
+func (c *checkpointer) Finish(ctx context.Context, complete bool) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkpoint.Complete = complete && len(c.failed()) == 0
+	c.save(ctx)
+	return c.saveErr
+}
+
+// save failures are not retried, the next save has a more recent checkpoint
+func (c *checkpointer) save(ctx context.Context) {
+	c.checkpoint.UpdatedAt = time.Now().UTC()
+	checkpoint := c.checkpoint // a copy, the stores may keep it
+	checkpoint.Failed = c.failed()
+	if err := c.store.Save(ctx, &checkpoint); err != nil && c.saveErr == nil {
+		c.saveErr = err
+	}
+	c.savedAt = time.Now()
+}
+
+// returns a copy of the failed ranges not sent again yet
+func (c *checkpointer) failed() []FailedRange {
+	var failed []FailedRange
+	for _, failedRange := range c.checkpoint.Failed {
+		if !failedRange.sent() {
+			failed = append(failed, failedRange)
+		}
+	}
+	return failed
+}
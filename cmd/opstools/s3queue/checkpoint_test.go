@@ -0,0 +1,234 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+)
+
+type memoryCheckpoints struct {
+	mu    sync.Mutex
+	saved []Checkpoint
+}
+
+func (m *memoryCheckpoints) Save(_ context.Context, checkpoint *Checkpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.saved = append(m.saved, *checkpoint)
+	return nil
+}
+
+func (m *memoryCheckpoints) last() *Checkpoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	last := m.saved[len(m.saved)-1]
+	return &last
+}
+
+func TestCheckpointer(t *testing.T) {
+	store := &memoryCheckpoints{}
+	tracker := newCheckpointer(&Checkpointing{
+		Store:      store,
+		Checkpoint: &Checkpoint{RunID: "run", Sources: []string{"s3://a/", "s3://b/"}},
+	})
+	ctx := context.Background()
+	// the second batch is sent first, the checkpoint cannot move past the first one
+	tracker.Sent(ctx, 1, batchEnd{source: 0, key: "b", numFiles: 2, numBytes: 20})
+	assert.Empty(t, store.saved)
+	tracker.Sent(ctx, 0, batchEnd{source: 0, key: "a", numFiles: 1, numBytes: 10})
+	require.Len(t, store.saved, 1)
+	assert.Equal(t, 0, store.last().Source)
+	assert.Equal(t, "b", store.last().StartAfter)
+	assert.Equal(t, uint64(3), store.last().NumFiles)
+	assert.Equal(t, uint64(30), store.last().NumBytes)
+
+	tracker.Sent(ctx, 3, batchEnd{source: 1, key: "d", numFiles: 1, numBytes: 1})
+	require.NoError(t, tracker.Finish(ctx, false))
+	require.Len(t, store.saved, 2)
+	assert.Equal(t, "b", store.last().StartAfter) // batch 2 was not sent
+	assert.False(t, store.last().Complete)
+
+	var nilTracker *checkpointer
+	nilTracker.Sent(ctx, 0, batchEnd{})
+	assert.NoError(t, nilTracker.Finish(ctx, true))
+}
+
+func TestCheckpointerFailed(t *testing.T) {
+	store := &memoryCheckpoints{}
+	tracker := newCheckpointer(&Checkpointing{
+		Store:      store,
+		Checkpoint: &Checkpoint{RunID: "run", Sources: []string{"s3://a/"}},
+	})
+	ctx := context.Background()
+	// a failed batch does not hold back the batches after it
+	tracker.Failed(ctx, 0, batchEnd{source: 0, startAfter: "", key: "k0000", numFiles: 1, numBytes: 10})
+	const numBatches = 1000
+	for seq := uint64(numBatches); seq > 0; seq-- {
+		tracker.Sent(ctx, seq, batchEnd{source: 0, startAfter: fmt.Sprintf("k%04d", seq-1), key: fmt.Sprintf("k%04d", seq),
+			numFiles: 1, numBytes: 10})
+	}
+	assert.Empty(t, tracker.done)
+	require.NoError(t, tracker.Finish(ctx, true))
+	checkpoint := store.last()
+	assert.Equal(t, fmt.Sprintf("k%04d", numBatches), checkpoint.StartAfter)
+	assert.Equal(t, uint64(numBatches), checkpoint.NumFiles)
+	assert.Equal(t, []FailedRange{{Source: 0, Last: "k0000"}}, checkpoint.Failed)
+	assert.False(t, checkpoint.Complete) // until the failed range is sent again
+
+	// a resumed run sends the failed range again, its batches move the range and not the position
+	tracker = newCheckpointer(&Checkpointing{Store: store, Checkpoint: checkpoint})
+	tracker.Failed(ctx, 0, batchEnd{source: 0, key: "k0000", numFiles: 1, retry: 1})
+	tracker.Sent(ctx, 1, batchEnd{source: 0, key: "k1001", numFiles: 1})
+	require.NoError(t, tracker.Finish(ctx, true))
+	assert.Equal(t, "k1001", store.last().StartAfter)
+	assert.Equal(t, []FailedRange{{Source: 0, Last: "k0000"}}, store.last().Failed)
+	assert.Equal(t, []FailedRange{{Source: 0, Last: "k0000"}}, checkpoint.Failed) // the resumed checkpoint is not changed
+	tracker = newCheckpointer(&Checkpointing{Store: store, Checkpoint: store.last()})
+	tracker.Sent(ctx, 0, batchEnd{source: 0, key: "k0000", numFiles: 1, retry: 1})
+	require.NoError(t, tracker.Finish(ctx, true))
+	assert.Empty(t, store.last().Failed)
+	assert.Equal(t, uint64(numBatches+2), store.last().NumFiles)
+	assert.True(t, store.last().Complete)
+}
+
+func TestS3QueueResumeFailed(t *testing.T) {
+	s3Client := testS3(100)
+	sources := testSources(s3Client)
+	store := &memoryCheckpoints{}
+
+	// the batch of the 43rd file fails, the run goes on past it
+	destination := &keyFailingDestination{
+		RecordingDestination: backfill.RecordingDestination{BatchSize: 5},
+		key:                  s3Client.Spec.Key(42),
+	}
+	profile := &Profile{ErrorThreshold: &ErrorThreshold{Count: 5}}
+	err := S3QueueTo(context.Background(), "run", sources, destination, profile, 8, Limit{}, nil, &Checkpointing{
+		Store:      store,
+		Checkpoint: NewCheckpoint("run", sources),
+	}, nil, NewStats())
+	require.Error(t, err)
+	checkpoint := store.last()
+	assert.Equal(t, s3Client.Spec.Key(99), checkpoint.StartAfter)
+	assert.Equal(t, uint64(95), checkpoint.NumFiles)
+	assert.Equal(t, []FailedRange{{Source: 0, StartAfter: s3Client.Spec.Key(39), Last: s3Client.Spec.Key(44)}}, checkpoint.Failed)
+	assert.False(t, checkpoint.Complete)
+	require.NoError(t, checkpoint.Validate(sources))
+
+	// the resumed run only sends the files of the failed batch
+	recording := &backfill.RecordingDestination{BatchSize: 5}
+	err = S3QueueTo(context.Background(), "run", sources, recording, nil, 2, Limit{}, nil, &Checkpointing{
+		Store:      store,
+		Checkpoint: checkpoint,
+	}, nil, NewStats())
+	require.NoError(t, err)
+	var keys []string
+	for _, notification := range recording.Notifications() {
+		keys = append(keys, notification.Event.Records[0].S3.Object.Key)
+	}
+	assert.Equal(t, []string{s3Client.Spec.Key(40), s3Client.Spec.Key(41), s3Client.Spec.Key(42), s3Client.Spec.Key(43),
+		s3Client.Spec.Key(44)}, keys)
+	checkpoint = store.last()
+	assert.Empty(t, checkpoint.Failed)
+	assert.Equal(t, uint64(100), checkpoint.NumFiles)
+	assert.True(t, checkpoint.Complete)
+}
+
+func TestS3QueueResume(t *testing.T) {
+	s3Client := testS3(10)
+	sources := testSources(s3Client)
+	store := &memoryCheckpoints{}
+
+	// the first run stops at the limit
+	destination := &backfill.RecordingDestination{BatchSize: 3}
+	err := S3QueueTo(context.Background(), "run", sources, destination, nil, 2, Limit{Files: 5}, nil, &Checkpointing{
+		Store:      store,
+		Checkpoint: NewCheckpoint("run", sources),
+	}, nil, NewStats())
+	require.NoError(t, err)
+	checkpoint := store.last()
+	assert.Equal(t, s3Client.Spec.Key(4), checkpoint.StartAfter)
+	assert.Equal(t, uint64(5), checkpoint.NumFiles)
+	assert.False(t, checkpoint.Complete)
+	require.NoError(t, checkpoint.Validate(sources))
+
+	// the second run resumes after the files sent
+	destination = &backfill.RecordingDestination{BatchSize: 3}
+	stats := NewStats()
+	err = S3QueueTo(context.Background(), "run", sources, destination, nil, 2, Limit{}, nil, &Checkpointing{
+		Store:      store,
+		Checkpoint: checkpoint,
+	}, nil, stats)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), stats.NumFiles.Value())
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 5)
+	keys := make([]string, len(notifications))
+	for i, notification := range notifications {
+		keys[i] = notification.Event.Records[0].S3.Object.Key
+	}
+	sort.Strings(keys) // the batches are sent concurrently in any order
+	for i, key := range keys {
+		assert.Equal(t, s3Client.Spec.Key(5+i), key)
+	}
+	checkpoint = store.last()
+	assert.Equal(t, s3Client.Spec.Key(9), checkpoint.StartAfter)
+	assert.Equal(t, uint64(10), checkpoint.NumFiles)
+	assert.True(t, checkpoint.Complete)
+}
+
+func TestCheckpointValidate(t *testing.T) {
+	sources := testSources(testS3(1))
+	checkpoint := NewCheckpoint("run", sources)
+	require.NoError(t, checkpoint.Validate(sources))
+	checkpoint.Sources[0] = "s3://other/"
+	assert.Error(t, checkpoint.Validate(sources))
+	assert.Error(t, NewCheckpoint("run", nil).Validate(sources))
+}
+
+func TestFileCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := FileCheckpoint(filepath.Join(dir, "run.json"))
+	_, err = file.Load()
+	require.Error(t, err)
+	checkpoint := &Checkpoint{RunID: "run", Sources: []string{"s3://a/b"}, StartAfter: "b/c", NumFiles: 1}
+	require.NoError(t, file.Save(context.Background(), checkpoint))
+	checkpoint.StartAfter = "b/d"
+	require.NoError(t, file.Save(context.Background(), checkpoint))
+	loaded, err := file.Load()
+	require.NoError(t, err)
+	assert.Equal(t, checkpoint, loaded)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1) // no temporary files left
+}
@@ -0,0 +1,164 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// rampInterval is how long the sends must go without throttling before the adaptive concurrency adds a writer
+	rampInterval = 10 * time.Second
+	// backoffInterval is the least time between two decreases, the sends in flight when the concurrency is halved are
+	// still throttled and must not halve it again
+	backoffInterval = time.Second
+)
+
+// adaptiveConcurrency limits the writers sending at once with AIMD: the limit is halved when a send is throttled
+// and a writer is added back after every rampInterval without throttling, up to the concurrency of the run.
+// It sets the Concurrency and MinConcurrency gauges of the stats. It is safe for concurrent use.
+type adaptiveConcurrency struct {
+	max    int
+	stats  *Stats
+	logger *zap.Logger
+	now    func() time.Time
+
+	mu            sync.Mutex
+	limit         int
+	active        int
+	changed       chan struct{} // closed and replaced when a writer may start, a slot was released or added
+	lastThrottled time.Time
+	lastDecrease  time.Time
+}
+
+func newAdaptiveConcurrency(concurrency int, stats *Stats, logger *zap.Logger) *adaptiveConcurrency {
+	c := &adaptiveConcurrency{
+		max:     concurrency,
+		stats:   stats,
+		logger:  logger,
+		now:     time.Now,
+		limit:   concurrency,
+		changed: make(chan struct{}),
+	}
+	stats.Concurrency.Set(int64(concurrency))
+	stats.MinConcurrency.Set(int64(concurrency))
+	return c
+}
+
+// acquire waits for the limit to allow one more writer to send, it returns an error if ctx is done first.
+// A nil adaptiveConcurrency does not limit the writers.
+func (c *adaptiveConcurrency) acquire(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	for {
+		c.mu.Lock()
+		if c.active < c.limit {
+			c.active++
+			c.mu.Unlock()
+			return nil
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release ends the send of a writer that acquired a slot
+func (c *adaptiveConcurrency) release() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active--
+	c.broadcast()
+}
+
+// throttled halves the limit, at most once per backoffInterval, the writers above it finish their sends first
+func (c *adaptiveConcurrency) throttled() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.lastThrottled = now
+	if c.limit == 1 || now.Sub(c.lastDecrease) < backoffInterval {
+		return
+	}
+	c.limit /= 2
+	c.lastDecrease = now
+	c.stats.Concurrency.Set(int64(c.limit))
+	if int64(c.limit) < c.stats.MinConcurrency.Value() {
+		c.stats.MinConcurrency.Set(int64(c.limit))
+	}
+	c.logger.Info("sends are throttled, backing off", zap.Int("concurrency", c.limit))
+}
+
+// adjust adds a writer if there was no throttling for rampInterval, it is called every rampInterval
+func (c *adaptiveConcurrency) adjust() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if c.limit == c.max || now.Sub(c.lastThrottled) < rampInterval {
+		return
+	}
+	c.limit++
+	c.stats.Concurrency.Set(int64(c.limit))
+	c.broadcast()
+	c.logger.Debug("no throttling, ramping up", zap.Int("concurrency", c.limit))
+}
+
+// wakes up the writers waiting for a slot, c.mu must be held
+func (c *adaptiveConcurrency) broadcast() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// start adjusts the limit every rampInterval until the returned function is called
+func (c *adaptiveConcurrency) start() (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(rampInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.adjust()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,99 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
+)
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	stats := NewStats()
+	writers := newAdaptiveConcurrency(4, stats, zap.NewNop())
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	writers.now = func() time.Time { return now }
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		require.NoError(t, writers.acquire(ctx))
+	}
+
+	// a throttled send halves the limit once, the sends in flight throttled with it do not halve it again
+	writers.throttled()
+	writers.throttled()
+	assert.Equal(t, int64(2), stats.Concurrency.Value())
+	now = now.Add(backoffInterval)
+	writers.throttled()
+	assert.Equal(t, int64(1), stats.Concurrency.Value())
+	assert.Equal(t, int64(1), stats.MinConcurrency.Value())
+
+	// a writer waits for the writers above the limit to finish
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- writers.acquire(ctx)
+	}()
+	for i := 0; i < 3; i++ {
+		writers.release()
+	}
+	select {
+	case <-acquired:
+		t.Fatal("acquired a writer above the limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	writers.release()
+	require.NoError(t, <-acquired)
+
+	// a writer is added back after every interval without throttling
+	writers.adjust()
+	assert.Equal(t, int64(1), stats.Concurrency.Value())
+	for i := 0; i < 5; i++ {
+		now = now.Add(rampInterval)
+		writers.adjust()
+	}
+	assert.Equal(t, int64(4), stats.Concurrency.Value()) // up to the concurrency of the run
+	assert.Equal(t, int64(1), stats.MinConcurrency.Value())
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, writers.acquire(ctx))
+	}
+	assert.Error(t, writers.acquire(canceled))
+}
+
+func TestS3QueueToAdaptiveConcurrency(t *testing.T) {
+	const numObjects = 30
+	sqsClient := &awsfake.SQSSink{Failures: awsfake.Failures{ThrottleEvery: 2}}
+	destination := &backfill.SQSDestination{SQS: sqsClient, QueueURL: "queue", TopicARN: backfill.FakeTopicARN(testAccount)}
+	profile := &Profile{AdaptiveConcurrency: true}
+
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", testSources(testS3(numObjects)), destination, profile, 8, Limit{},
+		nil, nil, nil, stats)
+	require.NoError(t, err)
+	assert.Len(t, sqsClient.Messages(), numObjects)
+	assert.Less(t, stats.MinConcurrency.Value(), int64(8))
+}
@@ -0,0 +1,303 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/awsretry"
+	"github.com/panther-labs/panther/pkg/lambdalogger"
+)
+
+const (
+	deadLetterSuffix = ".ndjson"
+	// defaultDeadLettersPerFile is the max number of dead letters of a file if DeadLetters.PerFile is not set
+	defaultDeadLettersPerFile = 1000
+	// maxDeadLetterBytes is the max size of a line of dead letters, above the payload limits of the destinations
+	maxDeadLetterBytes = 1024 * 1024
+)
+
+// DeadLetter is a notification rejected by a destination, a line of the dead letters of a run
+type DeadLetter struct {
+	Message    string            `json:"message"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error"`
+}
+
+// DeadLetters is a destination keeping the notifications its destination rejected with a permanent error, e.g. a
+// message too large or invalid attributes, so that they can be sent again with Redrive without listing their files.
+// They are written as NDJSON, a DeadLetter per line, in files <run id>-<n>.ndjson of a location as the files fill up
+// and on Close. It is safe for concurrent use.
+type DeadLetters struct {
+	Destination backfill.Destination
+	Location    *ManifestLocation
+	RunID       string
+	// PerFile is the max number of dead letters of a file, defaultDeadLettersPerFile if zero
+	PerFile int
+
+	mu          sync.Mutex
+	buffer      bytes.Buffer
+	numBuffered int
+	numFiles    int
+	numWritten  uint64
+}
+
+func (d *DeadLetters) MaxBatchSize() int {
+	return d.Destination.MaxBatchSize()
+}
+
+func (d *DeadLetters) MaxPayloadBytes() int {
+	return d.Destination.MaxPayloadBytes()
+}
+
+// Send sends a batch to the destination and keeps the notifications it rejected with a permanent error. The error is
+// returned as is, the files of the batch are still counted as failed. Failing to write the dead letters is only
+// logged, they are written again with the next ones.
+func (d *DeadLetters) Send(ctx context.Context, batch []*backfill.Notification) error {
+	err := d.Destination.Send(ctx, batch)
+	if err == nil || ctx.Err() != nil || awsretry.Classify(err) != awsretry.Permanent {
+		return err // sent, stopped or to be retried
+	}
+	rejected := batch
+	var unsent *backfill.UnsentError
+	if errors.As(err, &unsent) {
+		rejected = unsent.Unsent
+	}
+	if writeErr := d.add(ctx, rejected, err); writeErr != nil {
+		lambdalogger.FromContext(ctx).Error("failed to write dead letters", zap.Error(writeErr))
+	}
+	return err
+}
+
+// Close writes the dead letters not yet written, it must be called once the run ended
+func (d *DeadLetters) Close(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.flush(ctx)
+}
+
+// Count returns the number of dead letters written
+func (d *DeadLetters) Count() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.numWritten
+}
+
+func (d *DeadLetters) add(ctx context.Context, notifications []*backfill.Notification, cause error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	perFile := d.PerFile
+	if perFile <= 0 {
+		perFile = defaultDeadLettersPerFile
+	}
+	for _, notification := range notifications {
+		line, err := jsoniter.Marshal(&DeadLetter{
+			Message:    notification.Message,
+			Attributes: notification.Attributes,
+			Error:      cause.Error(),
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal dead letter")
+		}
+		d.buffer.Write(line)
+		d.buffer.WriteByte('\n')
+		if d.numBuffered++; d.numBuffered >= perFile {
+			if err := d.flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writes the buffered dead letters to a new file, they stay buffered if it fails. d.mu must be held.
+func (d *DeadLetters) flush(ctx context.Context) error {
+	if d.numBuffered == 0 {
+		return nil
+	}
+	name := fmt.Sprintf("%s-%04d%s", d.RunID, d.numFiles+1, deadLetterSuffix)
+	if err := d.Location.put(ctx, name, "application/x-ndjson", d.buffer.Bytes()); err != nil {
+		return err
+	}
+	d.numFiles++
+	d.numWritten += uint64(d.numBuffered)
+	d.buffer.Reset()
+	d.numBuffered = 0
+	return nil
+}
+
+// Redrive sends the dead letters of a location again, e.g. once the cause of their rejection is fixed, without
+// listing their files. The notifications are sent as they were kept, with the replay attributes of their run, in the
+// order of the names of their files. The batches that fail again are counted and the redrive goes on, it returns
+// their errors at the end. Malformed lines are logged with their line number and counted.
+func Redrive(ctx context.Context, location *ManifestLocation, destination backfill.Destination, profile *Profile,
+	stats *Stats) error {
+
+	names, err := location.list(ctx, deadLetterSuffix)
+	if err != nil {
+		return err
+	}
+	lambdalogger.FromContext(ctx).Info("redriving dead letters", zap.Int("numFiles", len(names)))
+	publisher := &backfill.Publisher{Destination: destination, Stats: stats.Publish}
+	profile.Apply(publisher) // the rate limits and attempts, the notifications are not packed or signed again
+	var errs MultiError
+	for _, name := range names {
+		if ctx.Err() != nil {
+			errs.Add(classify(ErrCanceled, ctx.Err()))
+			break
+		}
+		errs.Add(redriveFile(ctx, location, name, publisher, stats))
+	}
+	return errs.Err()
+}
+
+// sends the dead letters of a file in batches of the size of the destination
+func redriveFile(ctx context.Context, location *ManifestLocation, name string, publisher *backfill.Publisher,
+	stats *Stats) error {
+
+	reader, err := location.open(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	var errs MultiError
+	batch := make([]*backfill.Notification, 0, publisher.Destination.MaxBatchSize())
+	send := func() {
+		numFiles := 0
+		for _, notification := range batch {
+			numFiles += len(notification.Event.Records)
+		}
+		if err := publisher.PublishNotifications(ctx, batch); err != nil {
+			lambdalogger.FromContext(ctx).Warn("failed to redrive dead letters", zap.String("file", name), zap.Error(err))
+			stats.NumFailedBatches.Inc()
+			stats.NumFailedFiles.Add(uint64(numFiles))
+			errs.Add(classify(ErrPublish, err))
+		} else {
+			stats.NumSentFiles.Add(uint64(numFiles))
+		}
+		batch = batch[:0]
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, maxDeadLetterBytes)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		notification, err := deadLetterNotification(scanner.Bytes())
+		if err != nil {
+			lambdalogger.FromContext(ctx).Warn("malformed dead letter", zap.String("file", name), zap.Int("line", lineNum), zap.Error(err))
+			stats.NumMalformed.Inc()
+			continue
+		}
+		stats.NumFiles.Add(uint64(len(notification.Event.Records)))
+		if batch = append(batch, notification); len(batch) == cap(batch) {
+			send()
+		}
+	}
+	if len(batch) > 0 {
+		send()
+	}
+	errs.Add(errors.Wrapf(scanner.Err(), "failed to read %s", name))
+	return errs.Err()
+}
+
+// returns the notification of a line of dead letters, with its event for the destinations that use it
+func deadLetterNotification(line []byte) (*backfill.Notification, error) {
+	var letter DeadLetter
+	if err := jsoniter.Unmarshal(line, &letter); err != nil {
+		return nil, err
+	}
+	event := &events.S3Event{}
+	if err := jsoniter.UnmarshalFromString(letter.Message, event); err != nil {
+		return nil, err
+	}
+	if len(event.Records) == 0 {
+		return nil, errors.New("the message has no records")
+	}
+	for i := range event.Records {
+		// the event has the keys as listed, the message the keys encoded as by S3
+		key, err := notify.DecodeObjectKey(event.Records[i].S3.Object.Key)
+		if err != nil {
+			return nil, err
+		}
+		event.Records[i].S3.Object.Key = key
+	}
+	return &backfill.Notification{Event: event, Message: letter.Message, Attributes: letter.Attributes}, nil
+}
+
+// returns the names of the files of the location with a suffix, sorted, not the ones of its sub-directories
+func (l *ManifestLocation) list(ctx context.Context, suffix string) ([]string, error) {
+	var names []string
+	if l.S3 == nil {
+		paths, err := filepath.Glob(filepath.Join(l.Dir, "*"+suffix))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list %s", l.Dir)
+		}
+		for _, path := range paths {
+			names = append(names, filepath.Base(path))
+		}
+		return names, nil // sorted by Glob
+	}
+	input := &s3.ListObjectsV2Input{Bucket: &l.Bucket, Prefix: &l.Prefix, Delimiter: aws.String("/")}
+	err := l.S3.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			if name := strings.TrimPrefix(aws.StringValue(object.Key), l.Prefix); strings.HasSuffix(name, suffix) {
+				names = append(names, name)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list s3://%s/%s", l.Bucket, l.Prefix)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// opens a file of the location
+func (l *ManifestLocation) open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if l.S3 == nil {
+		file, err := os.Open(filepath.Join(l.Dir, name))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open %s", name)
+		}
+		return file, nil
+	}
+	key := l.Prefix + name
+	output, err := l.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: &l.Bucket, Key: &key})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get s3://%s/%s", l.Bucket, key)
+	}
+	return output.Body, nil
+}
@@ -0,0 +1,98 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/awsretry"
+)
+
+// rejects the notifications of its sends with an error
+type rejectingDestination struct {
+	backfill.RecordingDestination
+	err error
+}
+
+func (d *rejectingDestination) Send(_ context.Context, batch []*backfill.Notification) error {
+	return &backfill.UnsentError{Unsent: batch[1:], Err: d.err} // the first one was sent
+}
+
+func testEvents(keys ...string) []*events.S3Event {
+	var batch []*events.S3Event
+	for _, key := range keys {
+		batch = append(batch, backfill.NewNotification(testBucket, &s3.Object{Key: aws.String(key), Size: aws.Int64(1)}))
+	}
+	return batch
+}
+
+func TestDeadLetters(t *testing.T) {
+	location := &ManifestLocation{Dir: t.TempDir()}
+	destination := &rejectingDestination{err: awserr.New(sns.ErrCodeInvalidParameterException, "invalid attribute", nil)}
+	deadLetters := &DeadLetters{Destination: destination, Location: location, RunID: "run", PerFile: 2}
+	publisher := &backfill.Publisher{Destination: deadLetters, RunID: "run"}
+	ctx := context.Background()
+
+	err := publisher.Publish(ctx, testEvents("sent", "a b+c.json", "d.json", "e.json"))
+	require.Error(t, err)
+	assert.Equal(t, uint64(2), deadLetters.Count()) // the third is buffered until Close
+	destination.err = awserr.New(sns.ErrCodeThrottledException, "slow down", nil)
+	publisher.Retryer = &awsretry.Retryer{MaxAttempts: 2, InitialInterval: time.Millisecond}
+	require.Error(t, publisher.Publish(ctx, testEvents("sent", "throttled")))
+	require.NoError(t, deadLetters.Close(ctx))
+	assert.Equal(t, uint64(3), deadLetters.Count()) // throttled sends are retried, not rejected
+	names, err := location.list(ctx, deadLetterSuffix)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"run-0001.ndjson", "run-0002.ndjson"}, names)
+	data, err := ioutil.ReadFile(filepath.Join(location.Dir, names[0]))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "invalid attribute")
+
+	// the dead letters are sent again as they were
+	recorded := &backfill.RecordingDestination{}
+	stats := NewStats()
+	require.NoError(t, Redrive(ctx, location, recorded, nil, stats))
+	notifications := recorded.Notifications()
+	require.Len(t, notifications, 3)
+	assert.Equal(t, "a b+c.json", notifications[0].Event.Records[0].S3.Object.Key)
+	assert.Equal(t, "run", notifications[0].Attributes[notify.BackfillRunIDAttributeName])
+	assert.Equal(t, uint64(3), stats.NumSentFiles.Value())
+
+	// the batches failing again are counted
+	stats = NewStats()
+	err = Redrive(ctx, location, &rejectingDestination{err: errors.New("still invalid")}, nil, stats)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrPublish))
+	assert.Equal(t, uint64(2), stats.NumFailedBatches.Value())
+}
@@ -0,0 +1,155 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/cmd/opstools/sourcemap"
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/lambdalogger"
+)
+
+// maxUnresolvedPrefixes bounds the prefixes a dry run keeps, the files of the others are still counted
+const maxUnresolvedPrefixes = 1000
+
+// errNoSource is the cause of the files no source reads
+var errNoSource = errors.New("no source reads the file")
+
+// DryRun stands for a destination, it logs the notifications that would be sent to it instead of sending them.
+// The batches are split to the limits of the destination so they are the ones a real run would send.
+// It is safe for concurrent use.
+type DryRun struct {
+	Destination backfill.Destination
+	// Target describes the destination in the logs
+	Target string
+	// Tables and Sources resolve the log types of the files, the files of the data lake by their table in Tables and
+	// the others by the sources reading them. The files not resolved are reported by Unresolved.
+	Tables  LogTypeMap
+	Sources []*sourcemap.Source
+	// Failed if not nil gets the files no source reads
+	Failed *FailedKeys
+	// LogTypes if not nil counts the files by log type, e.g. the LogTypes of the stats of the run
+	LogTypes *LogTypeStats
+
+	mu            sync.Mutex
+	numUnresolved uint64
+	unresolved    map[string]*UnresolvedPrefix
+}
+
+// UnresolvedPrefix is a prefix with files no source reads, the processing of their notifications would fail
+type UnresolvedPrefix struct {
+	Bucket   string `json:"bucket"`
+	Prefix   string `json:"prefix"`
+	NumFiles uint64 `json:"numFiles"`
+	// Example is the first file of the prefix
+	Example string `json:"example"`
+}
+
+func (d *DryRun) MaxBatchSize() int {
+	return d.Destination.MaxBatchSize()
+}
+
+func (d *DryRun) MaxPayloadBytes() int {
+	return d.Destination.MaxPayloadBytes()
+}
+
+func (d *DryRun) Send(ctx context.Context, batch []*backfill.Notification) error {
+	for _, notification := range batch {
+		var logTypes, keys []string
+		for i := range notification.Event.Records {
+			s3Object := &notification.Event.Records[i].S3
+			keys = append(keys, s3Object.Object.Key) // as listed, the message has them encoded as S3 does
+			fileLogTypes := d.resolve(s3Object.Bucket.Name, s3Object.Object.Key)
+			if d.LogTypes != nil {
+				d.LogTypes.Add(fileLogTypes, uint64(s3Object.Object.Size))
+			}
+			logTypes = append(logTypes, fileLogTypes...)
+		}
+		lambdalogger.FromContext(ctx).Info("dry run, not sending",
+			zap.String("target", d.Target),
+			zap.Strings("keys", keys),
+			zap.String("message", notification.Message),
+			zap.Any("attributes", notification.Attributes),
+			zap.Strings("logTypes", logTypes))
+	}
+	return nil
+}
+
+// resolve returns the log type of the table of a file or the log types of the sources reading it, it records the
+// file if there are none
+func (d *DryRun) resolve(bucket, key string) (logTypes []string) {
+	if logType := d.Tables.LogType(bucket, key); logType != "" {
+		return []string{logType}
+	}
+	for _, source := range d.Sources {
+		if source.Owns(bucket, key) {
+			logTypes = append(logTypes, source.LogTypes...)
+		}
+	}
+	if len(logTypes) > 0 {
+		return logTypes
+	}
+
+	d.Failed.Add(bucket, key, errNoSource)
+	prefix := path.Dir(key) + "/"
+	if prefix == "./" {
+		prefix = ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.numUnresolved++
+	if d.unresolved == nil {
+		d.unresolved = make(map[string]*UnresolvedPrefix)
+	}
+	if unresolved, ok := d.unresolved[bucket+"/"+prefix]; ok {
+		unresolved.NumFiles++
+	} else if len(d.unresolved) < maxUnresolvedPrefixes {
+		d.unresolved[bucket+"/"+prefix] = &UnresolvedPrefix{
+			Bucket:   bucket,
+			Prefix:   prefix,
+			NumFiles: 1,
+			Example:  key,
+		}
+	}
+	return nil
+}
+
+// Unresolved returns the number of files no source reads and their prefixes, the prefixes with the most files first
+func (d *DryRun) Unresolved() (uint64, []*UnresolvedPrefix) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prefixes := make([]*UnresolvedPrefix, 0, len(d.unresolved))
+	for _, unresolved := range d.unresolved {
+		prefixes = append(prefixes, unresolved)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].NumFiles != prefixes[j].NumFiles {
+			return prefixes[i].NumFiles > prefixes[j].NumFiles
+		}
+		return prefixes[i].Bucket+"/"+prefixes[i].Prefix < prefixes[j].Bucket+"/"+prefixes[j].Prefix
+	})
+	return d.numUnresolved, prefixes
+}
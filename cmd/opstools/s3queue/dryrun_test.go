@@ -0,0 +1,171 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/panther-labs/panther/cmd/opstools/sourcemap"
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+)
+
+func TestS3QueueDryRun(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	s3Client := testS3(5)
+	destination := &backfill.RecordingDestination{BatchSize: 2}
+	stats := NewStats()
+	dryRun := &DryRun{
+		Destination: destination,
+		Target:      "sqs " + testQueueName,
+		Sources: []*sourcemap.Source{
+			{S3Bucket: testBucket, S3Prefix: testKey + "/", LogTypes: []string{"AWS.CloudTrail"}},
+			{S3Bucket: "other", LogTypes: []string{"AWS.VPCFlow"}},
+		},
+		LogTypes: stats.LogTypes,
+	}
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), dryRun, nil, 1, Limit{}, nil, nil, nil, stats)
+	require.NoError(t, err)
+	assert.Empty(t, destination.Batches())
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(5), snapshot.Counter("numFiles"))
+	assert.Equal(t, uint64(5), snapshot.Counter("numSent"))
+	assert.Equal(t, uint64(3), snapshot.Counter("numSentBatches")) // the batches of the destination
+
+	entries := logs.FilterMessage("dry run, not sending").AllUntimed()
+	require.Len(t, entries, 5)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "sqs "+testQueueName, fields["target"])
+	assert.Equal(t, []interface{}{s3Client.Spec.Key(0)}, fields["keys"])
+	assert.Contains(t, fields["message"], notify.EncodeObjectKey(s3Client.Spec.Key(0)))
+	assert.Equal(t, []interface{}{"AWS.CloudTrail"}, fields["logTypes"])
+	assert.Equal(t, "true", fields["attributes"].(map[string]string)[notify.ReplayAttributeName])
+	numUnresolved, prefixes := dryRun.Unresolved()
+	assert.Equal(t, uint64(0), numUnresolved)
+	assert.Empty(t, prefixes)
+	assert.Equal(t, []LogTypeCount{
+		{LogType: "AWS.CloudTrail", NumFiles: 5, NumBytes: snapshot.Counter("numBytes")},
+	}, stats.LogTypes.Counts())
+}
+
+func TestDryRunUnresolved(t *testing.T) {
+	core, _ := observer.New(zap.InfoLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	var output bytes.Buffer
+	dryRun := &DryRun{
+		Destination: &backfill.RecordingDestination{},
+		Sources: []*sourcemap.Source{
+			{S3Bucket: testBucket, S3Prefix: "cloudtrail/", LogTypes: []string{"AWS.CloudTrail"}},
+		},
+		Failed:   NewFailedKeys(&output),
+		LogTypes: &LogTypeStats{},
+	}
+	var batch []*backfill.Notification
+	for _, key := range []string{"cloudtrail/a.json.gz", "vpc/2020/b.json.gz", "vpc/2020/a.json.gz", "c.json.gz"} {
+		batch = append(batch, &backfill.Notification{
+			Event: (&backfill.Object{Bucket: testBucket, Key: key}).Notification(),
+		})
+	}
+	require.NoError(t, dryRun.Send(context.Background(), batch))
+	numUnresolved, prefixes := dryRun.Unresolved()
+	assert.Equal(t, uint64(3), numUnresolved)
+	assert.Equal(t, []*UnresolvedPrefix{
+		{Bucket: testBucket, Prefix: "vpc/2020/", NumFiles: 2, Example: "vpc/2020/b.json.gz"},
+		{Bucket: testBucket, Prefix: "", NumFiles: 1, Example: "c.json.gz"},
+	}, prefixes)
+	assert.Equal(t, "s3://"+testBucket+"/vpc/2020/b.json.gz # no source reads the file\n"+
+		"s3://"+testBucket+"/vpc/2020/a.json.gz # no source reads the file\n"+
+		"s3://"+testBucket+"/c.json.gz # no source reads the file\n", output.String())
+	assert.Equal(t, []LogTypeCount{
+		{LogType: UnknownLogType, NumFiles: 3},
+		{LogType: "AWS.CloudTrail", NumFiles: 1},
+	}, dryRun.LogTypes.Counts())
+}
+
+func TestLogTypeGroupID(t *testing.T) {
+	groupID := LogTypeGroupID(LogTypeMap{"aws_vpcflow": "AWS.VPCFlow"}, []*sourcemap.Source{
+		{S3Bucket: testBucket, S3Prefix: "cloudtrail/", LogTypes: []string{"AWS.CloudTrail"}},
+	})
+	assert.Equal(t, "AWS.CloudTrail", groupID(testBucket, "cloudtrail/file.gz"))
+	assert.Equal(t, testBucket+"/vpc", groupID(testBucket, "vpc/file.gz"))
+	assert.Equal(t, "AWS.VPCFlow", groupID(testBucket, "logs/aws_vpcflow/year=2020/month=01/day=02/hour=03/file.gz"))
+}
+
+func TestLogTypesGroup(t *testing.T) {
+	group := LogTypesGroup(nil, []*sourcemap.Source{
+		{S3Bucket: testBucket, S3Prefix: "cloudtrail/", LogTypes: []string{"AWS.CloudTrail", "AWS.CloudTrailDigest"}},
+		{S3Bucket: testBucket, S3Prefix: "vpc/", LogTypes: []string{"AWS.VPCFlow"}},
+	})
+	assert.Equal(t, "AWS.CloudTrail,AWS.CloudTrailDigest", group(testBucket, "cloudtrail/file.gz"))
+	assert.Equal(t, "AWS.VPCFlow", group(testBucket, "vpc/file.gz"))
+	assert.Equal(t, UnknownLogType, group(testBucket, "other/file.gz"))
+}
+
+func TestLogTypeMap(t *testing.T) {
+	file, err := ioutil.TempFile("", "logtypes")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("# the tables of the old deployment\naws_cloudtrail = AWS.CloudTrail\n\naws_vpcflow=AWS.VPCFlow\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	tables := LogTypeMap{}
+	require.NoError(t, tables.Set("custom_mylogs=Custom.MyLogs"))
+	require.NoError(t, tables.Set(file.Name()))
+	assert.Equal(t, "aws_cloudtrail=AWS.CloudTrail,aws_vpcflow=AWS.VPCFlow,custom_mylogs=Custom.MyLogs", tables.String())
+	assert.Error(t, tables.Set("=AWS.CloudTrail"))
+	assert.Error(t, tables.Set("aws_cloudtrail="))
+	assert.Error(t, tables.Set("no-such-file"))
+
+	assert.Equal(t, "Custom.MyLogs", tables.LogType(testBucket, "logs/custom_mylogs/year=2020/month=01/day=02/file.gz"))
+	assert.Equal(t, "", tables.LogType(testBucket, "logs/other/year=2020/month=01/day=02/file.gz"))
+	assert.Equal(t, "", tables.LogType(testBucket, "custom_mylogs/file.gz"))
+
+	// the files of the tables are resolved without sources
+	dryRun := &DryRun{
+		Destination: &backfill.RecordingDestination{},
+		Tables:      tables,
+		LogTypes:    &LogTypeStats{},
+	}
+	var batch []*backfill.Notification
+	for _, key := range []string{"logs/aws_cloudtrail/year=2020/month=01/day=02/a.json.gz", "other/b.json.gz"} {
+		batch = append(batch, &backfill.Notification{
+			Event: (&backfill.Object{Bucket: testBucket, Key: key}).Notification(),
+		})
+	}
+	require.NoError(t, dryRun.Send(context.Background(), batch))
+	numUnresolved, _ := dryRun.Unresolved()
+	assert.Equal(t, uint64(1), numUnresolved)
+	assert.Equal(t, []LogTypeCount{
+		{LogType: "AWS.CloudTrail", NumFiles: 1},
+		{LogType: UnknownLogType, NumFiles: 1},
+	}, dryRun.LogTypes.Counts())
+}
@@ -0,0 +1,201 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+
+	"github.com/panther-labs/panther/pkg/awsutils"
+)
+
+// The errors of a back-fill are classified by what failed, so that callers can decide what to do about them.
+// errors.Is matches the class of an error, errors.As and errors.Is still find its cause, e.g. the AWS error.
+// The errors of several paths in Preflight, and of both the listing and the sends of a run, are aggregated with
+// multierr, errors.Is and errors.As look into every one of them. The errors of a run are counted by message in a
+// MultiError, so that many batches failing the same way do not hide a different failure.
+//
+// The back-fill does not resolve log types, the log processor classifies the files it is notified of.
+// Reaching the limit of files or bytes ends a run without an error, see Stats.LimitReached.
+var (
+	// ErrBadPath is returned for s3 paths that do not parse, the input must be fixed
+	ErrBadPath = errors.New("bad s3 path")
+	// ErrListAccessDenied is returned if finding the region of a bucket or listing it was denied,
+	// the permissions of the caller must be fixed
+	ErrListAccessDenied = errors.New("access denied listing s3")
+	// ErrBucketOwner is returned by Preflight if a bucket is not owned by the expected account,
+	// e.g. it was deleted and re-created by another account
+	ErrBucketOwner = errors.New("bucket not owned by the expected account")
+	// ErrPublish is returned if notifications could not be sent after retries, the files already listed
+	// may have been sent, see the publish counters of the run
+	ErrPublish = errors.New("failed to publish notifications")
+	// ErrVerify is returned if the files of a batch could not be headed before it was sent with a Verifier,
+	// the batch was not sent
+	ErrVerify = errors.New("failed to verify files")
+	// ErrSampleFailed is returned if too many of the sampled files cannot be read by the log processor
+	ErrSampleFailed = errors.New("sampled files failed")
+	// ErrCanceled is returned if the context of a run was canceled, e.g. on SIGINT. The listing stopped and the files
+	// listed before were sent, the stats of the run count how far it got. errors.Is also matches context.Canceled.
+	ErrCanceled = errors.New("back-fill canceled")
+)
+
+// Error is an error of one of the classes above
+type Error struct {
+	Class error
+	Err   error
+}
+
+// Error returns the message of the cause, the class is not part of it
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the cause
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the class of the error
+func (e *Error) Is(target error) bool {
+	return target == e.Class
+}
+
+// returns err with a class, nil if err is nil
+func classify(class, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Class: class, Err: err}
+}
+
+// returns err with the ErrListAccessDenied class if s3 denied access
+func classifyList(err error) error {
+	var failure awserr.RequestFailure
+	if awsutils.IsAnyError(err, "AccessDenied") || errors.As(err, &failure) && failure.StatusCode() == http.StatusForbidden {
+		return classify(ErrListAccessDenied, err)
+	}
+	return err
+}
+
+// maxDistinctErrors bounds the distinct errors a MultiError keeps, the others are only counted
+const maxDistinctErrors = 100
+
+// MultiError is the errors of a run counted by message, e.g. the failures of the lister and of the publishers.
+// It keeps the first maxDistinctErrors distinct errors, errors.Is and errors.As look into every one of them and
+// Errors returns them, so multierr.Errors splits it too. It is not safe for concurrent use.
+type MultiError struct {
+	errs       []error
+	counts     map[string]int // by message
+	numErrors  int
+	numDropped int // errors with a message not kept
+}
+
+// Add counts the errors of err, the errors combined by multierr and the errors of a MultiError one by one
+func (e *MultiError) Add(err error) {
+	if other, ok := err.(*MultiError); ok {
+		for _, err := range other.errs {
+			e.add(err, other.counts[err.Error()])
+		}
+		e.numErrors += other.numDropped
+		e.numDropped += other.numDropped
+		return
+	}
+	for _, err := range multierr.Errors(err) {
+		e.add(err, 1)
+	}
+}
+
+func (e *MultiError) add(err error, count int) {
+	e.numErrors += count
+	message := err.Error()
+	if _, ok := e.counts[message]; !ok {
+		if len(e.errs) == maxDistinctErrors {
+			e.numDropped += count
+			return
+		}
+		if e.counts == nil {
+			e.counts = make(map[string]int)
+		}
+		e.errs = append(e.errs, err)
+	}
+	e.counts[message] += count
+}
+
+// Err returns nil if no error was added, the error itself if only one was and the MultiError otherwise
+func (e *MultiError) Err() error {
+	switch e.numErrors {
+	case 0:
+		return nil
+	case 1:
+		return e.errs[0]
+	default:
+		return e
+	}
+}
+
+// Errors returns the distinct errors in the order they were added, the first of every message
+func (e *MultiError) Errors() []error {
+	return append([]error(nil), e.errs...)
+}
+
+// Count returns the number of errors with the message of err
+func (e *MultiError) Count(err error) int {
+	return e.counts[err.Error()]
+}
+
+// Error lists the distinct messages with their counts, e.g. "3 errors: send failed (2 times); list failed"
+func (e *MultiError) Error() string {
+	messages := make([]string, 0, len(e.errs)+1)
+	for _, err := range e.errs {
+		message := err.Error()
+		if count := e.counts[message]; count > 1 {
+			message = fmt.Sprintf("%s (%d times)", message, count)
+		}
+		messages = append(messages, message)
+	}
+	if e.numDropped > 0 {
+		messages = append(messages, fmt.Sprintf("%d more errors", e.numDropped))
+	}
+	return fmt.Sprintf("%d errors: %s", e.numErrors, strings.Join(messages, "; "))
+}
+
+// Is returns true if any of the errors matches target
+func (e *MultiError) Is(target error) bool {
+	for _, err := range e.errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors matching target
+func (e *MultiError) As(target interface{}) bool {
+	for _, err := range e.errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
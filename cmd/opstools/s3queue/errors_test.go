@@ -0,0 +1,229 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/multierr"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
+)
+
+var errorClasses = []error{ErrBadPath, ErrListAccessDenied, ErrBucketOwner, ErrPublish, ErrSampleFailed}
+
+// asserts that err is of exactly one class, and that the cause is still found
+func assertClass(t *testing.T, class, err error) {
+	t.Helper()
+	require.Error(t, err)
+	for _, other := range errorClasses {
+		assert.Equal(t, other == class, errors.Is(err, other), "errors.Is(%q, %q)", err, other)
+	}
+	var classified *Error
+	require.True(t, errors.As(err, &classified))
+	assert.Equal(t, class, classified.Class)
+	assert.Equal(t, classified.Err.Error(), classified.Error()) // the class is not part of the message
+}
+
+func accessDenied() error {
+	return awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "request")
+}
+
+func TestErrorsPreflight(t *testing.T) {
+	clients := newS3Clients(
+		func(bucket string) (string, error) {
+			if bucket == "denied" {
+				return "", accessDenied()
+			}
+			return "", errors.New("no such bucket")
+		},
+		func(region string) s3iface.S3API {
+			return awsfake.NewS3(awsfake.ListingSpec{Bucket: region})
+		},
+	)
+
+	_, err := clients.Preflight([]string{"not-a-path"})
+	assertClass(t, ErrBadPath, err)
+
+	_, err = clients.Preflight([]string{"s3://denied/"})
+	assertClass(t, ErrListAccessDenied, err)
+	var awsErr awserr.RequestFailure
+	require.True(t, errors.As(err, &awsErr))
+	assert.Equal(t, http.StatusForbidden, awsErr.StatusCode())
+
+	_, err = clients.Preflight([]string{"s3://missing/"})
+	require.Error(t, err)
+	var classified *Error
+	assert.False(t, errors.As(err, &classified)) // not classified
+
+	// the aggregate of several paths has the classes of all of them
+	_, err = clients.Preflight([]string{"not-a-path", "s3://denied/", "s3://missing/"})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrBadPath))
+	assert.True(t, errors.Is(err, ErrListAccessDenied))
+	assert.False(t, errors.Is(err, ErrPublish))
+}
+
+func TestErrorsList(t *testing.T) {
+	s3Client := testS3(10)
+	s3Client.Spec.FailAtPage = 1
+	s3Client.Spec.FailErr = accessDenied()
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), &backfill.RecordingDestination{}, nil,
+		1, Limit{}, nil, nil, nil, NewStats())
+	assertClass(t, ErrListAccessDenied, err)
+	assert.Contains(t, err.Error(), "failed to list "+testS3Path)
+
+	// other listing failures are not classified
+	s3Client = testS3(10)
+	s3Client.Spec.FailAtPage = 1
+	err = S3QueueTo(context.Background(), "run", testSources(s3Client), &backfill.RecordingDestination{}, nil,
+		1, Limit{}, nil, nil, nil, NewStats())
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, ErrListAccessDenied))
+}
+
+func TestErrorsPublish(t *testing.T) {
+	sqsClient := &awsfake.SQSSink{Failures: awsfake.Failures{Err: errors.New("send failed")}}
+	err := s3Queue(context.Background(), testSources(testS3(10)), sqsClient, testAccount, testQueueName, 1, Limit{}, nil, NewStats())
+	assertClass(t, ErrPublish, err)
+	assert.Contains(t, err.Error(), "send failed")
+}
+
+func TestErrorsSample(t *testing.T) {
+	s3Client := &sampledS3{S3: testS3(100), content: []byte("not gzip\n")}
+	err := s3Queue(context.Background(), testSources(s3Client.S3), &awsfake.SQSSink{}, testAccount, testQueueName,
+		1, Limit{}, testSampler(s3Client), NewStats())
+	assertClass(t, ErrSampleFailed, err)
+}
+
+func TestMultiError(t *testing.T) {
+	var errs MultiError
+	assert.NoError(t, errs.Err())
+	errs.Add(nil)
+	assert.NoError(t, errs.Err())
+
+	sendFailed := classify(ErrPublish, errors.New("send failed"))
+	errs.Add(sendFailed)
+	assert.Equal(t, sendFailed, errs.Err()) // a single error is returned as is
+
+	errs.Add(multierr.Combine(classify(ErrPublish, errors.New("send failed")), classify(ErrBadPath, errors.New("bad"))))
+	err := errs.Err()
+	require.Error(t, err)
+	assert.Equal(t, "3 errors: send failed (2 times); bad", err.Error())
+	assert.True(t, errors.Is(err, ErrPublish))
+	assert.True(t, errors.Is(err, ErrBadPath))
+	assert.False(t, errors.Is(err, ErrListAccessDenied))
+	var classified *Error
+	require.True(t, errors.As(err, &classified))
+	assert.Equal(t, ErrPublish, classified.Class)
+	assert.Len(t, errs.Errors(), 2) // the distinct errors
+	assert.Equal(t, 2, errs.Count(sendFailed))
+
+	// the counts of a MultiError add up
+	var combined MultiError
+	combined.Add(errors.New("bad"))
+	combined.Add(&errs)
+	assert.Equal(t, "4 errors: bad (2 times); send failed (2 times)", combined.Error())
+
+	// the distinct errors are bounded, the others are counted
+	var many MultiError
+	for i := 0; i < maxDistinctErrors+5; i++ {
+		many.Add(fmt.Errorf("error %d", i))
+	}
+	many.Add(errors.New("error 0"))
+	assert.Len(t, many.Errors(), maxDistinctErrors)
+	assert.Equal(t, 2, many.Count(errors.New("error 0")))
+	assert.True(t, strings.HasPrefix(many.Error(), fmt.Sprintf("%d errors: error 0 (2 times); error 1; ", maxDistinctErrors+6)))
+	assert.True(t, strings.HasSuffix(many.Error(), "; 5 more errors"))
+}
+
+// fails the batches smaller than the batch size, e.g. the last batch of a run
+type shortBatchFailingDestination struct {
+	backfill.RecordingDestination
+}
+
+func (d *shortBatchFailingDestination) Send(ctx context.Context, batch []*backfill.Notification) error {
+	if len(batch) < d.MaxBatchSize() {
+		return errors.New("short batch failed")
+	}
+	return d.RecordingDestination.Send(ctx, batch)
+}
+
+// fails every batch once the given number of sends are in flight, the batch of the first file differently
+type concurrentFailingDestination struct {
+	backfill.RecordingDestination
+	firstKey string
+	inFlight sync.WaitGroup
+}
+
+func (d *concurrentFailingDestination) Send(_ context.Context, batch []*backfill.Notification) error {
+	d.inFlight.Done()
+	d.inFlight.Wait()
+	if batch[0].Event.Records[0].S3.Object.Key == d.firstKey {
+		return errors.New("bad key")
+	}
+	return errors.New("send failed")
+}
+
+func TestErrorsAggregated(t *testing.T) {
+	// the listing fails after the first page, then the last batch of the files listed fails to send
+	s3Client := testS3(20)
+	s3Client.Spec.PageSize = 7
+	s3Client.Spec.FailAtPage = 2
+	s3Client.Spec.FailErr = accessDenied()
+	destination := &shortBatchFailingDestination{backfill.RecordingDestination{BatchSize: 5}}
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), destination, nil, 1, Limit{}, nil, nil, nil, NewStats())
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrListAccessDenied))
+	assert.True(t, errors.Is(err, ErrPublish))
+	var listAndSend *MultiError
+	require.True(t, errors.As(err, &listAndSend))
+	assert.Len(t, listAndSend.Errors(), 2)
+	assert.Contains(t, err.Error(), "short batch failed")
+	assert.Len(t, destination.Notifications(), 5)
+
+	// publishers failing together report every failure, counted by message
+	s3Client = testS3(15)
+	failing := &concurrentFailingDestination{
+		RecordingDestination: backfill.RecordingDestination{BatchSize: 5},
+		firstKey:             s3Client.Spec.Key(0),
+	}
+	failing.inFlight.Add(3)
+	err = S3QueueTo(context.Background(), "run", testSources(s3Client), failing, nil, 3, Limit{}, nil, nil, nil, NewStats())
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrPublish))
+	var errs *MultiError
+	require.True(t, errors.As(err, &errs))
+	// the publisher wraps the errors of a batch with the notifications it failed to send
+	assert.Equal(t, 1, errs.Count(errors.New("failed to send 5 of 5 notifications: bad key")))
+	assert.Equal(t, 2, errs.Count(errors.New("failed to send 5 of 5 notifications: send failed")))
+	assert.Contains(t, err.Error(), "3 errors: ")
+	assert.Contains(t, err.Error(), "send failed (2 times)")
+}
@@ -0,0 +1,77 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+
+	"github.com/panther-labs/panther/cmd/opstools/backfillcost"
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+)
+
+// listPageSize is the number of keys of a list request, to approximate the list requests of an estimate
+const listPageSize = 1000
+
+// EstimateRun lists the sources as S3QueueTo does without sending anything, so that a run can be confirmed before it
+// sends. The notifications are packed and batched for the limits of destination and counted in stats as the run would
+// send them, with the profile but without its rate limits or Verifier. It returns the listing of the files for a
+// backfillcost estimate, its list requests approximated from the files listed.
+func EstimateRun(ctx context.Context, runID string, sources []*Source, destination backfill.Destination, profile *Profile,
+	limit Limit, stats *Stats) (*backfillcost.Listing, error) {
+
+	err := S3QueueTo(ctx, runID, withOwnPartitionLimits(sources), &discardDestination{Destination: destination},
+		profile.withoutLimits(), 1, limit, nil, nil, nil, stats)
+	if err != nil {
+		return nil, err
+	}
+	numListed := stats.NumFiles.Value() + stats.NumSkipped.Value() + stats.NumSizeFiltered.Value() +
+		stats.NumUnretrievable.Value() + stats.NumInvalidKeys.Value() + stats.NumPartitionLimited.Value()
+	return &backfillcost.Listing{
+		NumObjects:      stats.NumFiles.Value(),
+		NumBytes:        stats.NumBytes.Value(),
+		NumListRequests: uint64(len(sources)) + numListed/listPageSize,
+	}, nil
+}
+
+// discardDestination batches the notifications for its destination but drops them
+type discardDestination struct {
+	backfill.Destination
+}
+
+func (d *discardDestination) Send(_ context.Context, _ []*backfill.Notification) error {
+	return nil
+}
+
+// returns copies of the sources with partition limits of their own, the files an estimate lists must not take the
+// room of the files of the run
+func withOwnPartitionLimits(sources []*Source) []*Source {
+	limits := make(map[*PartitionLimit]*PartitionLimit)
+	copies := make([]*Source, len(sources))
+	for i, source := range sources {
+		copied := *source
+		if source.Partitions != nil {
+			if limits[source.Partitions] == nil {
+				limits[source.Partitions] = &PartitionLimit{PerPartition: source.Partitions.PerPartition}
+			}
+			copied.Partitions = limits[source.Partitions]
+		}
+		copies[i] = &copied
+	}
+	return copies
+}
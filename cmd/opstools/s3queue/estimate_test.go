@@ -0,0 +1,57 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+)
+
+func TestEstimateRun(t *testing.T) {
+	s3Client := testS3(25)
+	destination := &backfill.RecordingDestination{BatchSize: 10}
+	// the rate limit would hold the estimate for minutes
+	profile := &Profile{PackRecords: 5, MaxSendsPerSecond: 0.001}
+	sources := testSources(s3Client)
+	sources[0].Partitions = &PartitionLimit{PerPartition: 20}
+
+	stats := NewStats()
+	listing, err := EstimateRun(context.Background(), "run", sources, destination, profile, Limit{}, stats)
+	require.NoError(t, err)
+	assert.Empty(t, destination.Notifications()) // nothing was sent
+	assert.Equal(t, uint64(20), listing.NumObjects)
+	assert.Equal(t, stats.NumBytes.Value(), listing.NumBytes)
+	assert.Equal(t, uint64(1), listing.NumListRequests)
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(4), snapshot.Counter("numSent")) // the notifications packed as the run would
+	assert.Equal(t, uint64(2), snapshot.Counter("numSentBatches"))
+	assert.Equal(t, uint64(5), stats.NumPartitionLimited.Value())
+	assert.Equal(t, 0.001, profile.MaxSendsPerSecond)
+
+	// the estimate did not take the room of the partitions of the run
+	stats = NewStats()
+	err = S3QueueTo(context.Background(), "run", sources, destination, nil, 1, Limit{}, nil, nil, nil, stats)
+	require.NoError(t, err)
+	assert.Len(t, destination.Notifications(), 20)
+}
@@ -0,0 +1,89 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+// keyListComment starts the comment at the end of a line of a key list
+const keyListComment = " #"
+
+// errNotSent is the cause of the files of batches skipped after a batch failed
+var errNotSent = errors.New("not sent, the run stopped at a failed batch")
+
+// FailedKeys writes the files that failed to a key list, with the error as the comment of their line, so that
+// a run of the list re-drives them. The lines of every call are written at once, so an unbuffered file has every
+// failure even if the process dies. It is safe for concurrent use, the methods of a nil FailedKeys do nothing.
+type FailedKeys struct {
+	w io.Writer
+
+	mu       sync.Mutex
+	numFiles uint64
+	err      error
+}
+
+// NewFailedKeys returns a FailedKeys writing to w
+func NewFailedKeys(w io.Writer) *FailedKeys {
+	return &FailedKeys{w: w}
+}
+
+// Add writes the line of a failed file
+func (f *FailedKeys) Add(bucket, key string, cause error) {
+	f.AddObjects([]backfill.Object{{Bucket: bucket, Key: key}}, cause)
+}
+
+// AddObjects writes the lines of failed objects, e.g. the files of a batch that failed to send
+func (f *FailedKeys) AddObjects(objects []backfill.Object, cause error) {
+	if f == nil || len(objects) == 0 {
+		return
+	}
+	comment := keyListComment + " " + strings.Join(strings.Fields(cause.Error()), " ") + "\n"
+	var lines strings.Builder
+	for i := range objects {
+		lines.WriteString(s3path.Scheme + objects[i].Bucket + "/" + objects[i].Key + comment)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return
+	}
+	if _, err := io.WriteString(f.w, lines.String()); err != nil {
+		f.err = errors.Wrap(err, "failed to write failed files")
+		return
+	}
+	f.numFiles += uint64(len(objects))
+}
+
+// Result returns the number of files written and the first write error
+func (f *FailedKeys) Result() (uint64, error) {
+	if f == nil {
+		return 0, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.numFiles, f.err
+}
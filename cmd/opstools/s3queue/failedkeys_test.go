@@ -0,0 +1,95 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
+)
+
+func TestFailedKeys(t *testing.T) {
+	var output bytes.Buffer
+	failed := NewFailedKeys(&output)
+	failed.Add("bucket", "a/b.json.gz", errors.New("send\nfailed"))
+	failed.AddObjects([]backfill.Object{{Bucket: "bucket", Key: "c"}, {Bucket: "other", Key: "d"}}, errors.New("throttled"))
+	failed.AddObjects(nil, errors.New("nothing"))
+	assert.Equal(t, "s3://bucket/a/b.json.gz # send failed\ns3://bucket/c # throttled\ns3://other/d # throttled\n", output.String())
+	numFailed, err := failed.Result()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), numFailed)
+
+	// the first write error stops the writes
+	failed = NewFailedKeys(failingWriter{})
+	failed.Add("bucket", "a", errors.New("failed"))
+	failed.Add("bucket", "b", errors.New("failed"))
+	numFailed, err = failed.Result()
+	require.Error(t, err)
+	assert.Equal(t, uint64(0), numFailed)
+
+	// a nil FailedKeys records nothing
+	failed = nil
+	failed.Add("bucket", "a", errors.New("failed"))
+	numFailed, err = failed.Result()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), numFailed)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestS3QueueToFailedKeys(t *testing.T) {
+	s3Client := testS3(25)
+	destination := &backfill.SQSDestination{
+		SQS:      &awsfake.SQSSink{Failures: awsfake.Failures{Err: errors.New("send failed")}},
+		QueueURL: "url",
+		TopicARN: backfill.FakeTopicARN(testAccount),
+	}
+	var output bytes.Buffer
+	failed := NewFailedKeys(&output)
+
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), destination, nil, 1, Limit{}, nil, nil, failed, NewStats())
+	require.Error(t, err)
+	numFailed, err := failed.Result()
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, numFailed, uint64(10)) // the failed batch and the batches skipped after it
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	require.Len(t, lines, int(numFailed))
+	assert.True(t, strings.HasPrefix(lines[0], testKeyPath(s3Client, 0)+" # "))
+	assert.Contains(t, lines[0], "send failed")
+
+	// the output is a key list re-driving the failed files
+	recording := &backfill.RecordingDestination{}
+	stats := NewStats()
+	err = S3QueueKeys(context.Background(), "run", testKeyList(s3Client, lines...), recording, nil, 1, Limit{}, nil, stats)
+	require.NoError(t, err)
+	assert.Len(t, recording.Notifications(), int(numFailed))
+	assert.Equal(t, uint64(0), stats.Snapshot().Counter("numMalformed"))
+}
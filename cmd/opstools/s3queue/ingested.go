@@ -0,0 +1,147 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+// IngestedKeys is a list of the files already ingested, e.g. queried with Athena after an outage, so that a re-drive
+// only sends the listed files missing from it. Its lines are s3 paths of files (s3://bucket/key), optionally quoted as
+// in a CSV, blank lines, lines starting with # and malformed lines such as headers are skipped.
+//
+// The list is merged with the listing as it goes so that it takes no memory whatever its size: it must be sorted by
+// bucket then key, the order of the listing of sources sorted by SortSources. It is not safe for concurrent use,
+// the sources must be listed one at a time and in key order.
+type IngestedKeys struct {
+	scanner    *bufio.Scanner
+	lineNum    int
+	next       *s3path.Path // the next file of the list, nil at its end
+	err        error
+	numMissing uint64
+	numExtra   uint64
+}
+
+// NewIngestedKeys reads the list of r as the listing goes
+func NewIngestedKeys(r io.Reader) *IngestedKeys {
+	k := &IngestedKeys{scanner: bufio.NewScanner(r)}
+	k.advance()
+	return k
+}
+
+// Ingested returns true if a listed file is in the list, else it counts it as missing. The files of the list before
+// it were not listed, they are counted as extra. Once the list fails to read every file is reported ingested, so that
+// nothing is sent past the error returned by Err.
+func (k *IngestedKeys) Ingested(bucket, key string) bool {
+	for k.err == nil && k.next != nil {
+		switch c := comparePaths(k.next.Bucket, k.next.Key, bucket, key); {
+		case c < 0:
+			k.numExtra++
+			k.advance()
+		case c == 0:
+			k.advance()
+			for k.err == nil && k.next != nil && k.next.Bucket == bucket && k.next.Key == key {
+				k.advance() // a file ingested twice
+			}
+			return true
+		default:
+			k.numMissing++
+			return false
+		}
+	}
+	if k.err != nil {
+		return true
+	}
+	k.numMissing++
+	return false
+}
+
+// Finish counts the rest of the list as extra once the listing completed, and returns the error of the list
+func (k *IngestedKeys) Finish() error {
+	for k.err == nil && k.next != nil {
+		k.numExtra++
+		k.advance()
+	}
+	return k.err
+}
+
+// Err returns the error that stopped the reading of the list, nil for a nil list
+func (k *IngestedKeys) Err() error {
+	if k == nil {
+		return nil
+	}
+	return k.err
+}
+
+// Counts returns the listed files missing from the list and the files of the list that were not listed
+func (k *IngestedKeys) Counts() (numMissing, numExtra uint64) {
+	return k.numMissing, k.numExtra
+}
+
+// reads the next file of the list, checking that it is sorted
+func (k *IngestedKeys) advance() {
+	previous := k.next
+	k.next = nil
+	for k.scanner.Scan() {
+		k.lineNum++
+		line := strings.Trim(strings.TrimSpace(k.scanner.Text()), `"`)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		path, err := s3path.Parse(line)
+		if err == nil && (path.Key == "" || strings.HasSuffix(path.Key, "/")) {
+			err = errors.Errorf("s3 path %q is not a file", line)
+		}
+		if err != nil {
+			zap.L().Warn("skipping malformed ingested keys line", zap.Int("line", k.lineNum), zap.Error(err))
+			continue
+		}
+		if previous != nil && comparePaths(path.Bucket, path.Key, previous.Bucket, previous.Key) < 0 {
+			k.err = errors.Errorf("the ingested keys are not sorted by bucket and key at line %d", k.lineNum)
+			return
+		}
+		k.next = &path
+		return
+	}
+	k.err = errors.Wrap(k.scanner.Err(), "failed to read the ingested keys")
+}
+
+// compares files by bucket then key, as IngestedKeys are sorted
+func comparePaths(bucket, key, otherBucket, otherKey string) int {
+	if bucket != otherBucket {
+		return strings.Compare(bucket, otherBucket)
+	}
+	return strings.Compare(key, otherKey)
+}
+
+// SortSources sorts the sources by bucket then prefix, so that they are listed in the order of IngestedKeys.
+// The prefixes of the sources must not overlap.
+func SortSources(sources []*Source) {
+	sort.SliceStable(sources, func(i, j int) bool {
+		return comparePaths(sources[i].Path.Bucket, sources[i].Path.Key, sources[j].Path.Bucket, sources[j].Path.Key) < 0
+	})
+}
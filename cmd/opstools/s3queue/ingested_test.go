@@ -0,0 +1,102 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+func TestIngestedKeys(t *testing.T) {
+	// the buckets must be valid bucket names, the lines of other paths are skipped as malformed
+	list := strings.Join([]string{
+		`"path"`, // the header of an Athena CSV
+		`"s3://bucket-a/1"`,
+		"s3://bucket-a/3",
+		"s3://bucket-a/3", // ingested twice
+		"",
+		"s3://bucket-b/0",
+	}, "\n")
+	ingested := NewIngestedKeys(strings.NewReader(list))
+	assert.False(t, ingested.Ingested("bucket-a", "0"))
+	assert.True(t, ingested.Ingested("bucket-a", "1"))
+	assert.False(t, ingested.Ingested("bucket-a", "2"))
+	assert.True(t, ingested.Ingested("bucket-a", "3"))
+	assert.False(t, ingested.Ingested("bucket-a", "4"))
+	require.NoError(t, ingested.Finish())
+	numMissing, numExtra := ingested.Counts()
+	assert.Equal(t, uint64(3), numMissing)
+	assert.Equal(t, uint64(1), numExtra) // s3://bucket-b/0 was not listed
+
+	// nothing is sent past a list out of order
+	ingested = NewIngestedKeys(strings.NewReader("s3://bucket-a/2\ns3://bucket-a/1\n"))
+	assert.False(t, ingested.Ingested("bucket-a", "0"))
+	assert.True(t, ingested.Ingested("bucket-a", "2"))
+	assert.True(t, ingested.Ingested("bucket-a", "3"))
+	assert.Error(t, ingested.Err())
+	err := ingested.Finish()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2")
+}
+
+func TestSortSources(t *testing.T) {
+	sources := []*Source{
+		{Path: s3path.Path{Bucket: "b", Key: "a/"}},
+		{Path: s3path.Path{Bucket: "a", Key: "z/"}},
+		{Path: s3path.Path{Bucket: "a", Key: "b/"}},
+	}
+	SortSources(sources)
+	assert.Equal(t, "a/b/", sources[0].Path.Bucket+"/"+sources[0].Path.Key)
+	assert.Equal(t, "a/z/", sources[1].Path.Bucket+"/"+sources[1].Path.Key)
+	assert.Equal(t, "b/a/", sources[2].Path.Bucket+"/"+sources[2].Path.Key)
+}
+
+func TestS3QueueToIngested(t *testing.T) {
+	s3Client := testS3(6)
+	var list []string
+	for i := 0; i < 6; i += 2 {
+		list = append(list, s3path.Path{Bucket: testBucket, Key: s3Client.Spec.Key(i)}.String())
+	}
+	list = append(list, "s3://"+testBucket+"/~after/the/listing")
+	ingested := NewIngestedKeys(strings.NewReader(strings.Join(list, "\n")))
+	sources := testSources(s3Client)
+	sources[0].Ingested = ingested
+	destination := &backfill.RecordingDestination{}
+
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", sources, destination, nil, 1, Limit{}, nil, nil, nil, stats)
+	require.NoError(t, err)
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 3)
+	for i, notification := range notifications {
+		assert.Equal(t, s3Client.Spec.Key(2*i+1), notification.Event.Records[0].S3.Object.Key) // only the missing files
+	}
+	assert.Equal(t, uint64(3), stats.NumIngested.Value())
+	require.NoError(t, ingested.Finish())
+	numMissing, numExtra := ingested.Counts()
+	assert.Equal(t, uint64(3), numMissing)
+	assert.Equal(t, uint64(1), numExtra)
+}
@@ -19,6 +19,7 @@ package s3queue
  */
 
 import (
+	"context"
 	"os"
 	"strings"
 	"testing"
@@ -83,10 +84,13 @@ func TestIntegrationS3queue(t *testing.T) {
 	err = testutils.CreateQueue(sqsClient, toq)
 	require.NoError(t, err)
 
-	stats := &Stats{}
-	err = S3Queue(awsSession, fakeAccountID, s3Path, s3Region, toq, concurrency, numberOfFiles, stats)
+	stats := NewStats()
+	sources, err := NewS3Clients(awsSession).Preflight([]string{s3Path})
 	require.NoError(t, err)
-	assert.Equal(t, numberOfFiles, (int)(stats.NumFiles))
+	assert.Equal(t, s3Region, sources[0].Region)
+	err = S3Queue(context.Background(), awsSession, fakeAccountID, sources, toq, concurrency, Limit{Files: numberOfFiles}, nil, stats)
+	require.NoError(t, err)
+	assert.Equal(t, numberOfFiles, (int)(stats.NumFiles.Value()))
 
 	numberSentMessages, err := testutils.CountMessagesInQueue(sqsClient, toq, messageBatchSize, visibilityTimeoutSeconds)
 	assert.NoError(t, err)
@@ -0,0 +1,314 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5" // nolint: gosec
+	"encoding/csv"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/lambdalogger"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+// Inventory is an S3 Inventory report listing the files of the sources instead of ListObjectsV2, for buckets too
+// large to list. Only CSV reports are read, gzip compressed as S3 writes them. The data files are checked against
+// the checksums of the manifest before any of their files is sent.
+type Inventory struct {
+	// Manifest is the manifest.json of the report, the data files are in the same bucket
+	Manifest s3path.Path
+	// S3 reads the report, in the region of its bucket
+	S3 s3iface.S3API
+	// RequireLastModified fails a report without the LastModifiedDate field, e.g. to select the files by date
+	RequireLastModified bool
+}
+
+// InventoryManifest is the manifest.json of an S3 Inventory report
+type InventoryManifest struct {
+	SourceBucket string `json:"sourceBucket"`
+	FileFormat   string `json:"fileFormat"`
+	FileSchema   string `json:"fileSchema"`
+	Files        []struct {
+		Key         string `json:"key"`
+		Size        int64  `json:"size"`
+		MD5Checksum string `json:"MD5checksum"`
+	} `json:"files"`
+}
+
+// inventoryFields are the positions of the fields of the rows of a report, -1 if absent
+type inventoryFields struct {
+	key, size, lastModified, eTag, storageClass, isLatest, isDeleteMarker int
+}
+
+func newInventoryFields(schema string) (*inventoryFields, error) {
+	fields := &inventoryFields{-1, -1, -1, -1, -1, -1, -1}
+	for i, column := range strings.Split(schema, ",") {
+		switch strings.TrimSpace(column) {
+		case "Key":
+			fields.key = i
+		case "Size":
+			fields.size = i
+		case "LastModifiedDate":
+			fields.lastModified = i
+		case "ETag":
+			fields.eTag = i
+		case "StorageClass":
+			fields.storageClass = i
+		case "IsLatest":
+			fields.isLatest = i
+		case "IsDeleteMarker":
+			fields.isDeleteMarker = i
+		}
+	}
+	if fields.key < 0 || fields.size < 0 {
+		return nil, errors.Errorf("schema %q must have the Key and Size fields", schema)
+	}
+	return fields, nil
+}
+
+// S3QueueInventory is S3QueueTo listing the sources from an S3 Inventory report, the sources must be of the bucket
+// of the report. The files of the report are sent in its order, the run is not checkpointed.
+func S3QueueInventory(ctx context.Context, runID string, inventory *Inventory, sources []*Source,
+	destination backfill.Destination, profile *Profile, concurrency int, limit Limit, sampler *Sampler,
+	failed *FailedKeys, stats *Stats) error {
+
+	list := func(ctx context.Context, notifyChan chan listedObject) error {
+		return inventory.list(ctx, sources, limit, sampler, failed, notifyChan, stats)
+	}
+	return queueObjects(ctx, runID, list, destination, profile, concurrency, limit, nil, failed, stats, runProgress{})
+}
+
+// read the data files of the report and send the files of the sources to notifyChan until the limit is reached or
+// ctx is done
+func (inv *Inventory) list(ctx context.Context, sources []*Source, limit Limit, sampler *Sampler, failed *FailedKeys,
+	notifyChan chan listedObject, stats *Stats) error {
+
+	defer close(notifyChan)
+
+	manifest, fields, err := inv.readManifest(ctx)
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		if source.Path.Bucket != manifest.SourceBucket {
+			return classify(ErrBadPath, errors.Errorf("inventory %s is of bucket %s, not of %s",
+				inv.Manifest, manifest.SourceBucket, source.Path))
+		}
+	}
+	taken := &limiter{Limit: limit, stats: stats}
+	for _, file := range manifest.Files {
+		if limit.reached(stats) || ctx.Err() != nil {
+			return nil // stopped by the limit, a failed send or a cancel, the caller reports it
+		}
+		data, err := inv.download(ctx, file.Key, file.MD5Checksum)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		err = inv.readFile(ctx, data, fields, sources, taken, sampler, failed, notifyChan, stats)
+		data.Close()
+		if err != nil {
+			return errors.WithMessagef(err, "inventory file s3://%s/%s", inv.Manifest.Bucket, file.Key)
+		}
+	}
+	return nil
+}
+
+func (inv *Inventory) readManifest(ctx context.Context) (*InventoryManifest, *inventoryFields, error) {
+	output, err := inv.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(inv.Manifest.Bucket),
+		Key:    aws.String(inv.Manifest.Key),
+	})
+	if err != nil {
+		return nil, nil, classifyList(errors.Wrapf(err, "failed to get inventory manifest %s", inv.Manifest))
+	}
+	defer output.Body.Close()
+	manifest := &InventoryManifest{}
+	if err := jsoniter.NewDecoder(output.Body).Decode(manifest); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to read inventory manifest %s", inv.Manifest)
+	}
+	if manifest.FileFormat != s3.InventoryFormatCsv {
+		return nil, nil, errors.Errorf("inventory %s is %s, only CSV is supported", inv.Manifest, manifest.FileFormat)
+	}
+	fields, err := newInventoryFields(manifest.FileSchema)
+	if err != nil {
+		return nil, nil, errors.WithMessagef(err, "inventory %s", inv.Manifest)
+	}
+	if inv.RequireLastModified && fields.lastModified < 0 {
+		return nil, nil, errors.Errorf("inventory %s has no LastModifiedDate field to select the files by", inv.Manifest)
+	}
+	return manifest, fields, nil
+}
+
+// downloads a data file of the report to a temporary file and checks its checksum, the file is removed when closed
+func (inv *Inventory) download(ctx context.Context, key, checksum string) (io.ReadCloser, error) {
+	if checksum == "" {
+		return nil, errors.Errorf("inventory %s has no checksum for s3://%s/%s", inv.Manifest, inv.Manifest.Bucket, key)
+	}
+	output, err := inv.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(inv.Manifest.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, classifyList(errors.Wrapf(err, "failed to get inventory file s3://%s/%s", inv.Manifest.Bucket, key))
+	}
+	defer output.Body.Close()
+	file, err := ioutil.TempFile("", "s3queue-inventory-")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create a temporary file for the inventory")
+	}
+	data := &tempFile{File: file}
+	hash := md5.New() // nolint: gosec // the checksums of inventory reports are MD5
+	if _, err := io.Copy(io.MultiWriter(file, hash), output.Body); err != nil {
+		data.Close()
+		return nil, errors.Wrapf(err, "failed to download inventory file s3://%s/%s", inv.Manifest.Bucket, key)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, checksum) {
+		data.Close()
+		return nil, errors.Errorf("inventory file s3://%s/%s has checksum %s, not %s of the manifest",
+			inv.Manifest.Bucket, key, sum, checksum)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		data.Close()
+		return nil, errors.Wrap(err, "failed to read the downloaded inventory file")
+	}
+	lambdalogger.FromContext(ctx).Debug("downloaded inventory file", zap.String("key", key))
+	return data, nil
+}
+
+// tempFile is removed when closed
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// sends the files of the sources in the rows of a data file, the current versions that are not delete markers
+func (inv *Inventory) readFile(ctx context.Context, data io.Reader, fields *inventoryFields, sources []*Source,
+	limit *limiter, sampler *Sampler, failed *FailedKeys, notifyChan chan listedObject, stats *Stats) error {
+
+	gzipReader, err := gzip.NewReader(data)
+	if err != nil {
+		return errors.Wrap(err, "not gzip compressed")
+	}
+	reader := csv.NewReader(gzipReader)
+	reader.FieldsPerRecord = -1
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "invalid CSV")
+		}
+		object, err := fields.object(row)
+		if err != nil {
+			return err
+		}
+		if object == nil {
+			continue
+		}
+		index := inventorySource(sources, aws.StringValue(object.Key))
+		if index < 0 || !sources[index].selects(object, failed, stats, lambdalogger.FromContext(ctx)) {
+			continue
+		}
+		at := listPosition{source: index}
+		more, err := enqueueListed(ctx, &at, sources[index], object, limit, sampler, notifyChan, stats)
+		if !more {
+			return err
+		}
+	}
+}
+
+// returns the object of a row, nil if it is not the current version or a delete marker
+func (f *inventoryFields) object(row []string) (*s3.Object, error) {
+	field := func(i int) string {
+		if i < 0 || i >= len(row) {
+			return ""
+		}
+		return row[i]
+	}
+	if len(row) <= f.key || len(row) <= f.size {
+		return nil, errors.Errorf("row with %d fields is missing fields", len(row))
+	}
+	if field(f.isDeleteMarker) == "true" || field(f.isLatest) == "false" {
+		return nil, nil
+	}
+	key, err := notify.DecodeObjectKey(row[f.key]) // keys are URL encoded
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid key %q", row[f.key])
+	}
+	size, err := strconv.ParseInt(row[f.size], 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid size of %s", key)
+	}
+	object := &s3.Object{
+		Key:  aws.String(key),
+		Size: aws.Int64(size),
+	}
+	if lastModified := field(f.lastModified); lastModified != "" {
+		modified, err := time.Parse(time.RFC3339, lastModified)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid last modified date of %s", key)
+		}
+		object.LastModified = aws.Time(modified)
+	}
+	if eTag := field(f.eTag); eTag != "" {
+		object.ETag = aws.String(eTag)
+	}
+	if storageClass := field(f.storageClass); storageClass != "" {
+		object.StorageClass = aws.String(storageClass)
+	}
+	return object, nil
+}
+
+// returns the index of the first source with the key under its path, -1 if the key is of no source
+func inventorySource(sources []*Source, key string) int {
+	for i, source := range sources {
+		if strings.HasPrefix(key, source.Path.Key) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,182 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5" // nolint: gosec
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+const (
+	inventoryBucket = "inventories"
+	inventorySchema = "Bucket, Key, Size, LastModifiedDate, ETag, StorageClass, IsLatest, IsDeleteMarker"
+)
+
+// inventoryS3 serves the objects of an inventory report by s3 path
+type inventoryS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+}
+
+func (s *inventoryS3) GetObjectWithContext(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	body, ok := s.objects["s3://"+aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchKey, "not found", nil), http.StatusNotFound, "")
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+}
+
+// returns a fake serving a CSV report with a gzip data file per element of files, and the report
+func testInventory(t *testing.T, schema string, files ...string) (*inventoryS3, *Inventory) {
+	s3Client := &inventoryS3{objects: make(map[string][]byte)}
+	var manifestFiles []string
+	for i, rows := range files {
+		key := fmt.Sprintf("%s/config/data/%d.csv.gz", testBucket, i)
+		data := gzipData(t, rows)
+		s3Client.objects["s3://"+inventoryBucket+"/"+key] = data
+		checksum := md5.Sum(data) // nolint: gosec
+		manifestFiles = append(manifestFiles, fmt.Sprintf(`{"key":%q,"size":%d,"MD5checksum":%q}`,
+			key, len(data), hex.EncodeToString(checksum[:])))
+	}
+	manifest := s3path.Path{Bucket: inventoryBucket, Key: testBucket + "/config/2020-12-01T00-00Z/manifest.json"}
+	s3Client.objects[manifest.String()] = []byte(fmt.Sprintf(
+		`{"sourceBucket":%q,"fileFormat":"CSV","fileSchema":%q,"files":[%s]}`,
+		testBucket, schema, strings.Join(manifestFiles, ",")))
+	return s3Client, &Inventory{Manifest: manifest, S3: s3Client}
+}
+
+func inventorySources() []*Source {
+	return []*Source{{Path: s3path.Path{Bucket: testBucket, Key: testKey + "/"}, Region: "us-west-2"}}
+}
+
+func TestS3QueueInventory(t *testing.T) {
+	_, inventory := testInventory(t, inventorySchema,
+		`"foo","bar/a.json.gz","10","2020-12-01T10:00:00.000Z","etag-a","STANDARD","true","false"
+"foo","bar/b+c%2Bd%C3%A9.json.gz","20","2020-12-01T11:00:00.000Z","etag-b","STANDARD","true","false"
+"foo","bar/deleted.json.gz","0","2020-12-01T11:00:00.000Z","","","true","true"
+"foo","bar/old.json.gz","30","2020-11-01T11:00:00.000Z","etag-old","STANDARD","false","false"
+`,
+		`"foo","other/c.json.gz","40","2020-12-01T12:00:00.000Z","etag-c","STANDARD","true","false"
+"foo","bar/empty.json.gz","0","2020-12-01T12:00:00.000Z","etag-e","STANDARD","true","false"
+"foo","bar/frozen.json.gz","50","2020-12-01T12:00:00.000Z","etag-f","GLACIER","true","false"
+"foo","bar/d.json.gz","60","2020-12-01T13:00:00.000Z","etag-d","STANDARD_IA","true","false"
+`)
+	var output bytes.Buffer
+	destination := &backfill.RecordingDestination{BatchSize: 10}
+	stats := NewStats()
+	err := S3QueueInventory(context.Background(), "run", inventory, inventorySources(), destination, nil, 1, Limit{}, nil,
+		NewFailedKeys(&output), stats)
+	require.NoError(t, err)
+
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 3)
+	var keys []string
+	for _, notification := range notifications {
+		record := notification.Event.Records[0]
+		assert.Equal(t, testBucket, record.S3.Bucket.Name)
+		assert.Equal(t, "us-west-2", record.AWSRegion)
+		keys = append(keys, record.S3.Object.Key)
+	}
+	assert.Equal(t, []string{"bar/a.json.gz", "bar/b c+dé.json.gz", "bar/d.json.gz"}, keys)
+	record := notifications[1].Event.Records[0]
+	assert.Equal(t, int64(20), record.S3.Object.Size)
+	assert.Equal(t, "etag-b", record.S3.Object.ETag)
+	assert.Equal(t, time.Date(2020, 12, 1, 11, 0, 0, 0, time.UTC), record.EventTime)
+
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(3), snapshot.Counter("numFiles"))
+	assert.Equal(t, uint64(90), snapshot.Counter("numBytes"))
+	assert.Equal(t, uint64(1), snapshot.Counter("numSizeFiltered"))
+	assert.Equal(t, uint64(1), snapshot.Counter("numUnretrievable"))
+	assert.True(t, strings.HasPrefix(output.String(), "s3://foo/bar/frozen.json.gz # storage class GLACIER"))
+
+	// the filters of the sources apply, the limit stops reading the report
+	sources := inventorySources()
+	sources[0].Match = func(object *s3.Object) bool {
+		return aws.TimeValue(object.LastModified).After(time.Date(2020, 12, 1, 10, 30, 0, 0, time.UTC))
+	}
+	destination = &backfill.RecordingDestination{BatchSize: 10}
+	stats = NewStats()
+	err = S3QueueInventory(context.Background(), "run", inventory, sources, destination, nil, 1, Limit{Files: 1}, nil, nil,
+		stats)
+	require.NoError(t, err)
+	require.Len(t, destination.Notifications(), 1)
+	assert.Equal(t, "bar/b c+dé.json.gz", destination.Notifications()[0].Event.Records[0].S3.Object.Key)
+	assert.Equal(t, uint64(1), stats.Snapshot().Counter("numSkipped"))
+}
+
+func TestS3QueueInventoryChecksum(t *testing.T) {
+	s3Client, inventory := testInventory(t, inventorySchema,
+		`"foo","bar/a.json.gz","10","2020-12-01T10:00:00.000Z","etag-a","STANDARD","true","false"`+"\n")
+	dataFile := "s3://" + inventoryBucket + "/" + testBucket + "/config/data/0.csv.gz"
+	s3Client.objects[dataFile] = gzipData(t, `"foo","bar/tampered.json.gz","10","2020-12-01T10:00:00.000Z","","","true","false"`)
+
+	destination := &backfill.RecordingDestination{BatchSize: 10}
+	err := S3QueueInventory(context.Background(), "run", inventory, inventorySources(), destination, nil, 1, Limit{}, nil,
+		nil, NewStats())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum")
+	assert.Empty(t, destination.Notifications())
+}
+
+func TestS3QueueInventoryErrors(t *testing.T) {
+	queue := func(inventory *Inventory, sources []*Source) error {
+		return S3QueueInventory(context.Background(), "run", inventory, sources, &backfill.RecordingDestination{}, nil, 1,
+			Limit{}, nil, nil, NewStats())
+	}
+
+	s3Client, inventory := testInventory(t, "Bucket, Key, Size")
+	other := []*Source{{Path: s3path.Path{Bucket: "other", Key: testKey + "/"}}}
+	assert.True(t, errors.Is(queue(inventory, other), ErrBadPath))
+
+	inventory.RequireLastModified = true
+	err := queue(inventory, inventorySources())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "LastModifiedDate")
+
+	s3Client.objects[inventory.Manifest.String()] = []byte(`{"sourceBucket":"foo","fileFormat":"ORC","fileSchema":"","files":[]}`)
+	err = queue(inventory, inventorySources())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "only CSV is supported")
+
+	_, inventory = testInventory(t, "Bucket, Size")
+	err = queue(inventory, inventorySources())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Key and Size")
+}
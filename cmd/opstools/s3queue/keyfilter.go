@@ -0,0 +1,108 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RegexpPrefix marks key patterns that are regular expressions, other patterns are globs
+const RegexpPrefix = "re:"
+
+// KeyFilter selects object keys with include and exclude patterns, excludes win over includes.
+// Glob patterns (path.Match syntax) match a key or any of its parent prefixes, so "logs/aws_cloudtrail" and
+// "logs/*_cloudtrail/" select every key under logs/aws_cloudtrail/. Regular expressions ("re:" prefix) are
+// unanchored and match anywhere in the key.
+type KeyFilter struct {
+	include []keyPattern
+	exclude []keyPattern
+}
+
+type keyPattern func(key string) bool
+
+// NewKeyFilter compiles the patterns of a key filter, it fails on the first invalid pattern
+func NewKeyFilter(include, exclude []string) (*KeyFilter, error) {
+	filter := &KeyFilter{}
+	var err error
+	if filter.include, err = compileKeyPatterns(include); err != nil {
+		return nil, errors.WithMessage(err, "invalid include pattern")
+	}
+	if filter.exclude, err = compileKeyPatterns(exclude); err != nil {
+		return nil, errors.WithMessage(err, "invalid exclude pattern")
+	}
+	return filter, nil
+}
+
+// Match returns true if the key matches no exclude pattern and any include pattern, or there are none
+func (f *KeyFilter) Match(key string) bool {
+	for _, match := range f.exclude {
+		if match(key) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, match := range f.include {
+		if match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileKeyPatterns(patterns []string) ([]keyPattern, error) {
+	compiled := make([]keyPattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, RegexpPrefix) {
+			re, err := regexp.Compile(strings.TrimPrefix(pattern, RegexpPrefix))
+			if err != nil {
+				return nil, errors.Wrapf(err, "%q", pattern)
+			}
+			compiled = append(compiled, re.MatchString)
+			continue
+		}
+		if _, err := path.Match(pattern, "x"); err != nil {
+			return nil, errors.Wrapf(err, "%q", pattern)
+		}
+		compiled = append(compiled, globPattern(strings.TrimSuffix(pattern, "/")))
+	}
+	return compiled, nil
+}
+
+// matches the key or any of its parent prefixes, with or without their trailing slash
+func globPattern(pattern string) keyPattern {
+	return func(key string) bool {
+		for key != "" {
+			if match, _ := path.Match(pattern, key); match {
+				return true
+			}
+			i := strings.LastIndexByte(key, '/')
+			if i < 0 {
+				return false
+			}
+			key = key[:i]
+		}
+		return false
+	}
+}
@@ -0,0 +1,61 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyFilter(t *testing.T) {
+	filter, err := NewKeyFilter(
+		[]string{"logs/aws_cloudtrail/", "logs/*_vpcflow", "re:^logs/gcp_[a-z]+/2020/"},
+		[]string{"logs/aws_cloudtrail/2020/01", "re:\\.tmp$"},
+	)
+	require.NoError(t, err)
+	for key, expect := range map[string]bool{
+		"logs/aws_cloudtrail/2020/02/01/file.gz":     true,
+		"logs/aws_cloudtrail/2020/01/01/file.gz":     false, // excludes win
+		"logs/aws_cloudtrail/2020/02/01/file.gz.tmp": false,
+		"logs/aws_vpcflow/file.gz":                   true,
+		"logs/aws_s3serveraccess/file.gz":            false,
+		"logs/gcp_audit/2020/file.gz":                true,
+		"logs/gcp_audit/2021/file.gz":                false,
+		"logs/aws_cloudtrail_other/file.gz":          false,
+	} {
+		assert.Equal(t, expect, filter.Match(key), key)
+	}
+
+	// no includes select all the keys not excluded
+	filter, err = NewKeyFilter(nil, []string{"logs/aws_s3serveraccess"})
+	require.NoError(t, err)
+	assert.True(t, filter.Match("logs/aws_cloudtrail/file.gz"))
+	assert.False(t, filter.Match("logs/aws_s3serveraccess/file.gz"))
+}
+
+func TestKeyFilterInvalid(t *testing.T) {
+	_, err := NewKeyFilter([]string{"logs/["}, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "include")
+	_, err = NewKeyFilter(nil, []string{"re:logs/("})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exclude")
+}
@@ -0,0 +1,183 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/lambdalogger"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+// KeyList is a list of files to send instead of listing sources, e.g. the files of missing partitions found by a query.
+// Its lines are s3 paths of files (s3://bucket/key), blank lines and lines starting with # are ignored, as is the text
+// after a space and #, e.g. the errors of -failed-output.
+// Malformed lines are logged with their line number and counted, they do not stop the run.
+type KeyList struct {
+	Reader io.Reader
+	// Clients get the files of the list in the region of their buckets
+	Clients *S3Clients
+	// Head gets the size, ETag and last modified time of every file with HeadObject, else they are not notified.
+	// Without them notifications have no original event time, files that do not exist are only skipped if headed.
+	Head bool
+	// Keys selects the files by key before they are headed, all files are selected if nil
+	Keys *KeyFilter
+	// Filter selects the files by last modified time, the files are headed if it is set
+	Filter *backfill.Filter
+	// Partitions if set caps the files sent per partition
+	Partitions *PartitionLimit
+}
+
+// OpenKeyList opens a key list in a local file, an s3 path or stdin if name is "-"
+func OpenKeyList(clients *S3Clients, name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	if !strings.HasPrefix(name, s3path.Scheme) {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open key list")
+		}
+		return file, nil
+	}
+	path, err := s3path.Parse(name)
+	if err != nil {
+		return nil, classify(ErrBadPath, err)
+	}
+	client, _, err := clients.ForBucket(path.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	output, err := client.GetObject(&s3.GetObjectInput{
+		Bucket:              &path.Bucket,
+		Key:                 &path.Key,
+		RequestPayer:        requestPayer(clients.RequesterPays),
+		ExpectedBucketOwner: bucketOwner(clients.ExpectedBucketOwner),
+	})
+	if err != nil {
+		return nil, classifyList(errors.Wrapf(err, "failed to read key list %s", name))
+	}
+	return output.Body, nil
+}
+
+// read the files of the list and send to notifyChan until the limit is reached or ctx is done
+func (l *KeyList) list(ctx context.Context, limit Limit, notifyChan chan listedObject, stats *Stats) error {
+	defer close(notifyChan)
+
+	head := l.Head || l.Filter != nil
+	match := func(*s3.Object) bool { return true }
+	if l.Filter != nil {
+		var err error
+		if match, err = l.Filter.Matcher(); err != nil {
+			return err
+		}
+	}
+	scanner := bufio.NewScanner(l.Reader)
+	for lineNum := 1; !limit.reached(stats) && scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.Index(line, keyListComment); i >= 0 {
+			line = line[:i] // e.g. the error of a line of -failed-output
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		path, err := s3path.Parse(line)
+		if err == nil && (path.Key == "" || strings.HasSuffix(path.Key, "/")) {
+			err = errors.Errorf("s3 path %q is not a file", line)
+		}
+		if err != nil {
+			lambdalogger.FromContext(ctx).Warn("malformed key list line", zap.Int("line", lineNum), zap.Error(err))
+			stats.NumMalformed.Inc()
+			continue
+		}
+		if l.Keys != nil && !l.Keys.Match(path.Key) {
+			stats.NumSkipped.Inc()
+			continue
+		}
+		object := &s3.Object{Key: aws.String(path.Key)}
+		var region string // only known if headed
+		if head {
+			var found bool
+			if region, found, err = l.Clients.head(ctx, path, object); err != nil {
+				if ctx.Err() != nil {
+					return nil // stopped by a failed send or a cancel, the caller reports it
+				}
+				return err
+			}
+			if !found {
+				lambdalogger.FromContext(ctx).Warn("file of key list not found", zap.Int("line", lineNum), zap.Stringer("path", path))
+				stats.NumMissing.Inc()
+				continue
+			}
+			if !match(object) {
+				stats.NumSkipped.Inc()
+				continue
+			}
+		}
+		if l.Partitions != nil && !l.Partitions.Take(path.Bucket, path.Key) {
+			stats.NumPartitionLimited.Inc()
+			continue
+		}
+		record := backfill.NewObject(path.Bucket, object)
+		record.Region = region
+		if !enqueue(ctx, notifyChan, listedObject{object: record}, stats) {
+			return nil
+		}
+		stats.NumFiles.Inc()
+		stats.NumBytes.Add(uint64(aws.Int64Value(object.Size)))
+	}
+	return errors.Wrap(scanner.Err(), "failed to read key list")
+}
+
+// sets the attributes of the object of the path and returns the region of its bucket, found is false if it does not exist
+func (c *S3Clients) head(ctx context.Context, path s3path.Path, object *s3.Object) (region string, found bool, err error) {
+	client, region, err := c.ForBucket(path.Bucket)
+	if err != nil {
+		return "", false, err
+	}
+	output, err := client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:              &path.Bucket,
+		Key:                 &path.Key,
+		RequestPayer:        requestPayer(c.RequesterPays),
+		ExpectedBucketOwner: bucketOwner(c.ExpectedBucketOwner),
+	})
+	if err != nil {
+		var failure awserr.RequestFailure
+		if errors.As(err, &failure) && failure.StatusCode() == http.StatusNotFound {
+			return "", false, nil
+		}
+		return "", false, classifyList(errors.Wrapf(err, "failed to head %s", path))
+	}
+	object.Size, object.ETag, object.LastModified = output.ContentLength, output.ETag, output.LastModified
+	return region, true, nil
+}
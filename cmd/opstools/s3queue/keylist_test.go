@@ -0,0 +1,143 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
+)
+
+func testKeyList(s3Client *awsfake.S3, lines ...string) *KeyList {
+	return &KeyList{
+		Reader: strings.NewReader(strings.Join(lines, "\n")),
+		Clients: newS3Clients(
+			func(string) (string, error) { return "us-east-1", nil },
+			func(string) s3iface.S3API { return s3Client },
+		),
+	}
+}
+
+func testKeyPath(s3Client *awsfake.S3, i int) string {
+	return "s3://" + s3Client.Spec.Bucket + "/" + s3Client.Spec.Key(i)
+}
+
+func TestS3QueueKeys(t *testing.T) {
+	s3Client := testS3(5)
+	lines := []string{
+		testKeyPath(s3Client, 1),
+		"",
+		"# comment",
+		"not an s3 path",
+		testKeyPath(s3Client, 3),
+		"s3://" + testBucket + "/" + testKey + "/",
+		testKeyPath(s3Client, 4),
+	}
+	destination := &backfill.RecordingDestination{BatchSize: 10}
+
+	stats := NewStats()
+	err := S3QueueKeys(context.Background(), "run", testKeyList(s3Client, lines...), destination, nil, 1, Limit{}, nil, stats)
+	require.NoError(t, err)
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 3)
+	for i, index := range []int{1, 3, 4} {
+		record := notifications[i].Event.Records[0]
+		assert.Equal(t, testBucket, record.S3.Bucket.Name)
+		assert.Equal(t, s3Client.Spec.Key(index), record.S3.Object.Key)
+		assert.Equal(t, int64(0), record.S3.Object.Size) // not headed
+	}
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(3), snapshot.Counter("numFiles"))
+	assert.Equal(t, uint64(2), snapshot.Counter("numMalformed"))
+
+	// the limit stops reading the list
+	destination = &backfill.RecordingDestination{BatchSize: 10}
+	stats = NewStats()
+	err = S3QueueKeys(context.Background(), "run", testKeyList(s3Client, lines...), destination, nil, 1, Limit{Files: 1}, nil, stats)
+	require.NoError(t, err)
+	assert.Len(t, destination.Notifications(), 1)
+	assert.Equal(t, uint64(0), stats.Snapshot().Counter("numMalformed"))
+}
+
+func TestS3QueueRequesterPays(t *testing.T) {
+	s3Client := testS3(3)
+	s3Client.Spec.RequesterPays = true
+
+	// s3 denies the listing unless it is billed to the caller
+	destination := &backfill.RecordingDestination{BatchSize: 10}
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), destination, nil, 1, Limit{}, nil, nil, nil, NewStats())
+	assert.True(t, errors.Is(err, ErrListAccessDenied))
+	sources := testSources(s3Client)
+	sources[0].RequesterPays = true
+	err = S3QueueTo(context.Background(), "run", sources, destination, nil, 1, Limit{}, nil, nil, nil, NewStats())
+	require.NoError(t, err)
+	assert.Len(t, destination.Notifications(), 3)
+
+	// and the heads of a key list
+	keys := testKeyList(s3Client, testKeyPath(s3Client, 1))
+	keys.Head = true
+	err = S3QueueKeys(context.Background(), "run", keys, destination, nil, 1, Limit{}, nil, NewStats())
+	assert.True(t, errors.Is(err, ErrListAccessDenied))
+	keys = testKeyList(s3Client, testKeyPath(s3Client, 1))
+	keys.Head, keys.Clients.RequesterPays = true, true
+	destination = &backfill.RecordingDestination{BatchSize: 10}
+	err = S3QueueKeys(context.Background(), "run", keys, destination, nil, 1, Limit{}, nil, NewStats())
+	require.NoError(t, err)
+	assert.Len(t, destination.Notifications(), 1)
+}
+
+func TestS3QueueKeysHead(t *testing.T) {
+	s3Client := testS3(5) // the objects of the hour are a second apart
+	keys := testKeyList(s3Client,
+		testKeyPath(s3Client, 0),
+		testKeyPath(s3Client, 2),
+		"s3://"+testBucket+"/"+testKey+"/missing.json.gz",
+		testKeyPath(s3Client, 4),
+	)
+	var err error
+	keys.Keys, err = NewKeyFilter(nil, []string{`re:/000000\.`})
+	require.NoError(t, err)
+	keys.Filter = &backfill.Filter{ModifiedBefore: s3Client.Spec.Start.Add(4 * time.Second)}
+	destination := &backfill.RecordingDestination{BatchSize: 10}
+
+	stats := NewStats()
+	err = S3QueueKeys(context.Background(), "run", keys, destination, nil, 1, Limit{}, nil, stats)
+	require.NoError(t, err)
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 1)
+	record, object := notifications[0].Event.Records[0], s3Client.Spec.Object(2)
+	assert.Equal(t, aws.StringValue(object.Key), record.S3.Object.Key)
+	assert.Equal(t, aws.Int64Value(object.Size), record.S3.Object.Size)
+	assert.Equal(t, aws.TimeValue(object.LastModified), record.EventTime)
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(1), snapshot.Counter("numFiles"))
+	assert.Equal(t, uint64(aws.Int64Value(object.Size)), snapshot.Counter("numBytes"))
+	assert.Equal(t, uint64(2), snapshot.Counter("numSkipped"))
+	assert.Equal(t, uint64(1), snapshot.Counter("numMissing"))
+}
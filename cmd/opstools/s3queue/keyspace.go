@@ -0,0 +1,344 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+// The key space of sources is analyzed with single page listings. A prefix is counted if its objects fit a page,
+// larger prefixes are split at the delimiter into sub-prefixes, a sample of which is counted and the rest estimated
+// from the sample. The largest prefixes are split until the shards can be balanced or the list call budget is spent.
+const (
+	keySpacePageSize         = 1000
+	defaultKeySpaceSamples   = 5
+	defaultKeySpaceListCalls = 200
+)
+
+// KeySpaceOptions bound the analysis of the key space of sources
+type KeySpaceOptions struct {
+	// Listers is the number of listers the shards are balanced across
+	Listers int
+	// MaxListCalls is the budget of list calls of the analysis (default 200)
+	MaxListCalls int
+	// SamplesPerPrefix is the max number of sub-prefixes of a split prefix that are counted (default 5),
+	// the objects of the others are estimated from the counted ones
+	SamplesPerPrefix int
+	// Delimiter separates the levels of the keys (default /)
+	Delimiter string
+}
+
+// Shard is a prefix of a recommended shard list
+type Shard struct {
+	Path s3path.Path
+	// Objects is the number of objects under the prefix, a lower bound or an estimate unless Counted
+	Objects int64
+	// Counted is true if all the objects under the prefix were listed
+	Counted bool
+
+	source *Source
+	// objects that are not under a sub-prefix would be lost by a split
+	unsplittable bool
+}
+
+// Lister is the shards balanced to a lister, each lister is an s3queue run with the shards as -s3path
+type Lister struct {
+	Shards  []*Shard
+	Objects int64
+}
+
+// KeySpace is the recommended shard list of a key space analysis
+type KeySpace struct {
+	// Shards are all the shards in key order, they cover the sources without overlapping
+	Shards  []*Shard
+	Listers []*Lister
+	// Objects is the estimated number of objects of the sources
+	Objects int64
+	// Coverage is the fraction of the estimated objects that were counted, the rest is extrapolated from samples
+	Coverage  float64
+	ListCalls int
+	// BudgetExhausted is true if the analysis stopped at the list call budget rather than at balanced shards
+	BudgetExhausted bool
+}
+
+type keySpaceAnalysis struct {
+	ctx       context.Context
+	options   KeySpaceOptions
+	listCalls int
+	exhausted bool
+}
+
+// AnalyzeKeySpace samples the key space of the sources and recommends shards balancing the objects across listers
+func AnalyzeKeySpace(ctx context.Context, sources []*Source, options KeySpaceOptions) (*KeySpace, error) {
+	if options.Listers < 1 {
+		return nil, errors.New("at least one lister is required")
+	}
+	if options.MaxListCalls == 0 {
+		options.MaxListCalls = defaultKeySpaceListCalls
+	}
+	if options.MaxListCalls < len(sources) {
+		return nil, errors.Errorf("a budget of %d list calls cannot count %d sources", options.MaxListCalls, len(sources))
+	}
+	if options.SamplesPerPrefix < 1 {
+		options.SamplesPerPrefix = defaultKeySpaceSamples
+	}
+	if options.Delimiter == "" {
+		options.Delimiter = "/"
+	}
+
+	analysis := &keySpaceAnalysis{
+		ctx:     ctx,
+		options: options,
+	}
+	shards := make([]*Shard, 0, len(sources))
+	for _, source := range sources {
+		shard := &Shard{
+			Path:   source.Path,
+			source: source,
+		}
+		if err := analysis.count(shard); err != nil {
+			return nil, err
+		}
+		shards = append(shards, shard)
+	}
+	for {
+		i := analysis.nextSplit(shards)
+		if i == -1 {
+			break
+		}
+		if analysis.listCalls >= options.MaxListCalls {
+			analysis.exhausted = true
+			break
+		}
+		split, err := analysis.split(shards[i])
+		if err != nil {
+			return nil, err
+		}
+		if split != nil {
+			shards = append(shards[:i], append(split, shards[i+1:]...)...)
+		}
+	}
+	return analysis.keySpace(shards), nil
+}
+
+// returns the index of the largest shard worth splitting, -1 if the shards are balanced or cannot be split
+func (a *keySpaceAnalysis) nextSplit(shards []*Shard) int {
+	if a.options.Listers == 1 || a.exhausted {
+		return -1
+	}
+	largest := -1
+	var total int64
+	for i, shard := range shards {
+		total += shard.Objects
+		if shard.Counted || shard.unsplittable { // counted shards are listed in a single call
+			continue
+		}
+		if largest == -1 || shard.Objects > shards[largest].Objects {
+			largest = i
+		}
+	}
+	// shards of at most half the work of a lister balance well enough
+	if largest == -1 || shards[largest].Objects*2*int64(a.options.Listers) <= total {
+		return -1
+	}
+	return largest
+}
+
+// counts the objects of a shard with a single page listing
+func (a *keySpaceAnalysis) count(shard *Shard) error {
+	output, err := shard.source.S3.ListObjectsV2WithContext(a.ctx, &s3.ListObjectsV2Input{
+		Bucket:              aws.String(shard.Path.Bucket),
+		Prefix:              aws.String(shard.Path.Key),
+		MaxKeys:             aws.Int64(keySpacePageSize),
+		RequestPayer:        requestPayer(shard.source.RequesterPays),
+		ExpectedBucketOwner: bucketOwner(shard.source.ExpectedBucketOwner),
+	})
+	a.listCalls++
+	if err != nil {
+		return classifyList(errors.Wrapf(err, "failed to list %s", shard.Path))
+	}
+	shard.Objects = countObjects(output.Contents)
+	shard.Counted = !aws.BoolValue(output.IsTruncated)
+	return nil
+}
+
+// splits a shard into its sub-prefixes, a sample of which is counted. It returns nil if the shard cannot be split.
+func (a *keySpaceAnalysis) split(shard *Shard) ([]*Shard, error) {
+	var prefixes []string
+	var numObjects int64
+	complete := false
+	input := &s3.ListObjectsV2Input{
+		Bucket:              aws.String(shard.Path.Bucket),
+		Prefix:              aws.String(shard.Path.Key),
+		Delimiter:           aws.String(a.options.Delimiter),
+		MaxKeys:             aws.Int64(keySpacePageSize),
+		RequestPayer:        requestPayer(shard.source.RequesterPays),
+		ExpectedBucketOwner: bucketOwner(shard.source.ExpectedBucketOwner),
+	}
+	err := shard.source.S3.ListObjectsV2PagesWithContext(a.ctx, input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		a.listCalls++
+		for _, prefix := range page.CommonPrefixes {
+			prefixes = append(prefixes, aws.StringValue(prefix.Prefix))
+		}
+		numObjects += countObjects(page.Contents)
+		complete = last
+		return a.listCalls < a.options.MaxListCalls
+	})
+	if err != nil {
+		return nil, classifyList(errors.Wrapf(err, "failed to list %s", shard.Path))
+	}
+	if !complete {
+		a.exhausted = true // a partial list of sub-prefixes does not cover the shard
+		return nil, nil
+	}
+	if len(prefixes) == 0 {
+		// all the objects are directly under the prefix, and they were all listed
+		shard.Objects, shard.Counted, shard.unsplittable = numObjects, true, true
+		return nil, nil
+	}
+	if numObjects > 0 {
+		shard.unsplittable = true
+		return nil, nil
+	}
+
+	split := make([]*Shard, len(prefixes))
+	for i, prefix := range prefixes {
+		split[i] = &Shard{
+			Path:   s3path.Path{Bucket: shard.Path.Bucket, Key: prefix},
+			source: shard.source,
+		}
+	}
+	// count evenly spaced sub-prefixes, keys often grow in time order so that the first ones are not typical
+	numSamples := a.options.SamplesPerPrefix
+	if numSamples > len(split) {
+		numSamples = len(split)
+	}
+	if budget := a.options.MaxListCalls - a.listCalls; numSamples > budget {
+		numSamples = budget
+	}
+	var sampled int64
+	for i := 0; i < numSamples; i++ {
+		if err := a.count(split[i*len(split)/numSamples]); err != nil {
+			return nil, err
+		}
+		sampled += split[i*len(split)/numSamples].Objects
+	}
+	estimate := shard.Objects / int64(len(split)) // only the lower bound of the shard is known without samples
+	if numSamples > 0 {
+		estimate = (sampled + int64(numSamples) - 1) / int64(numSamples)
+	}
+	for _, sub := range split {
+		if sub.Objects == 0 && !sub.Counted {
+			sub.Objects = estimate
+		}
+	}
+	return split, nil
+}
+
+// balances the shards across the listers, largest shard first to the lister with the least objects
+func (a *keySpaceAnalysis) keySpace(shards []*Shard) *KeySpace {
+	keySpace := &KeySpace{
+		Shards:          shards,
+		ListCalls:       a.listCalls,
+		BudgetExhausted: a.exhausted,
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].Path.String() < shards[j].Path.String()
+	})
+	var counted int64
+	for _, shard := range shards {
+		keySpace.Objects += shard.Objects
+		if shard.Counted {
+			counted += shard.Objects
+		}
+	}
+	keySpace.Coverage = 1
+	if keySpace.Objects > 0 {
+		keySpace.Coverage = float64(counted) / float64(keySpace.Objects)
+	}
+
+	bySize := append([]*Shard(nil), shards...)
+	sort.SliceStable(bySize, func(i, j int) bool {
+		return bySize[i].Objects > bySize[j].Objects
+	})
+	listers := make([]*Lister, a.options.Listers)
+	for i := range listers {
+		listers[i] = &Lister{}
+	}
+	for _, shard := range bySize {
+		least := listers[0]
+		for _, lister := range listers[1:] {
+			if lister.Objects < least.Objects {
+				least = lister
+			}
+		}
+		least.Shards = append(least.Shards, shard)
+		least.Objects += shard.Objects
+	}
+	for _, lister := range listers {
+		if len(lister.Shards) == 0 {
+			continue // fewer shards than listers
+		}
+		sort.Slice(lister.Shards, func(i, j int) bool {
+			return lister.Shards[i].Path.String() < lister.Shards[j].Path.String()
+		})
+		keySpace.Listers = append(keySpace.Listers, lister)
+	}
+	return keySpace
+}
+
+// the objects that are sent, see backfill.List
+func countObjects(objects []*s3.Object) (n int64) {
+	for _, object := range objects {
+		if aws.Int64Value(object.Size) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Print writes the shards of every lister as the -s3path of its s3queue run, with the estimates as comments
+func (k *KeySpace) Print(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# ~%d objects in %d shards for %d listers, %.0f%% counted with %d list calls\n",
+		k.Objects, len(k.Shards), len(k.Listers), 100*k.Coverage, k.ListCalls)
+	if err == nil && k.BudgetExhausted {
+		_, err = fmt.Fprintln(w, "# the list call budget was exhausted, the shards may not be balanced")
+	}
+	for i, lister := range k.Listers {
+		if err != nil {
+			return err
+		}
+		paths := make([]string, len(lister.Shards))
+		for j, shard := range lister.Shards {
+			paths[j] = shard.Path.String()
+		}
+		_, err = fmt.Fprintf(w, "# lister %d: ~%d objects\n-s3path %s\n", i+1, lister.Objects, strings.Join(paths, ","))
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
+)
+
+// two days of 100 objects per hour
+func testKeySpace() []*Source {
+	return testSources(awsfake.NewS3(awsfake.ListingSpec{
+		Bucket:         testBucket,
+		Prefix:         testKey + "/",
+		Start:          time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Hours:          48,
+		ObjectsPerHour: 100,
+		MinSize:        1,
+		MaxSize:        1000,
+	}))
+}
+
+func TestAnalyzeKeySpace(t *testing.T) {
+	keySpace, err := AnalyzeKeySpace(context.Background(), testKeySpace(), KeySpaceOptions{Listers: 4, MaxListCalls: 100})
+	require.NoError(t, err)
+	// the days are split into hours, 5 of which are counted per day
+	require.Len(t, keySpace.Shards, 48)
+	assert.Equal(t, "s3://foo/bar/year=2020/month=01/day=01/hour=00/", keySpace.Shards[0].Path.String())
+	assert.Equal(t, "s3://foo/bar/year=2020/month=01/day=02/hour=23/", keySpace.Shards[47].Path.String())
+	assert.Equal(t, int64(4800), keySpace.Objects)
+	assert.InDelta(t, 10*100/4800.0, keySpace.Coverage, 0.001)
+	assert.Equal(t, 1+3*(1+1)+(1+2)+2*(1+5), keySpace.ListCalls)
+	assert.False(t, keySpace.BudgetExhausted)
+	require.Len(t, keySpace.Listers, 4)
+	for _, lister := range keySpace.Listers {
+		assert.Equal(t, int64(1200), lister.Objects)
+		assert.Len(t, lister.Shards, 12)
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, keySpace.Print(&out))
+	assert.Contains(t, out.String(), "# ~4800 objects in 48 shards for 4 listers, 21% counted with 22 list calls\n")
+	assert.Contains(t, out.String(), "# lister 1: ~1200 objects\n-s3path s3://foo/bar/year=2020/month=01/day=01/hour=00/,")
+}
+
+func TestAnalyzeKeySpaceBudget(t *testing.T) {
+	keySpace, err := AnalyzeKeySpace(context.Background(), testKeySpace(), KeySpaceOptions{Listers: 4, MaxListCalls: 5})
+	require.NoError(t, err)
+	assert.True(t, keySpace.BudgetExhausted)
+	assert.Equal(t, 5, keySpace.ListCalls)
+	require.Len(t, keySpace.Shards, 1)
+	assert.Equal(t, "s3://foo/bar/year=2020/", keySpace.Shards[0].Path.String())
+	assert.False(t, keySpace.Shards[0].Counted)
+	assert.Zero(t, keySpace.Coverage)
+
+	var out bytes.Buffer
+	require.NoError(t, keySpace.Print(&out))
+	assert.Contains(t, out.String(), "the list call budget was exhausted")
+
+	_, err = AnalyzeKeySpace(context.Background(), testKeySpace(), KeySpaceOptions{Listers: 4, MaxListCalls: -1})
+	require.Error(t, err)
+}
+
+func TestAnalyzeKeySpaceSmall(t *testing.T) {
+	// a source that fits a listing page is not split
+	keySpace, err := AnalyzeKeySpace(context.Background(), testSources(testS3(10)), KeySpaceOptions{Listers: 4})
+	require.NoError(t, err)
+	require.Len(t, keySpace.Shards, 1)
+	assert.True(t, keySpace.Shards[0].Counted)
+	assert.Equal(t, int64(10), keySpace.Objects)
+	assert.Equal(t, float64(1), keySpace.Coverage)
+	assert.Len(t, keySpace.Listers, 1) // the other listers have nothing to list
+	assert.Equal(t, 1, keySpace.ListCalls)
+}
@@ -0,0 +1,139 @@
+//go:build localstack
+// +build localstack
+
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/cmd/opstools/testutils"
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+)
+
+// Run with: mage test:localstack (or go test -tags localstack), set LOCALSTACK_ENDPOINT to use a running LocalStack
+func TestLocalStackS3Queue(t *testing.T) {
+	localStack, err := testutils.StartLocalStack("s3", "sqs")
+	if errors.Is(err, testutils.ErrNoLocalStack) {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, localStack.Stop())
+	}()
+
+	const (
+		bucket     = "panther-test-s3queue"
+		queueName  = "panther-test-s3queue-input"
+		numObjects = 25 // 2 full batches and a partial one
+	)
+	sess := localStack.Session()
+	s3Client := s3.New(sess)
+	sqsClient := sqs.New(sess)
+
+	_, err = s3Client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(bucket)})
+	require.NoError(t, err)
+	sizes := make(map[string]int64)
+	for i := 0; i < numObjects; i++ {
+		key := fmt.Sprintf("logs/aws_cloudtrail/year=2020/month=12/day=01/hour=%02d/20201201T%02d0000Z-%d.json.gz", i%3, i%3, i)
+		body := bytes.Repeat([]byte("x"), i+1)
+		_, err = s3Client.PutObject(&s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String(key), Body: bytes.NewReader(body)})
+		require.NoError(t, err)
+		sizes[key] = int64(len(body))
+	}
+	// empty objects are not sent
+	_, err = s3Client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String("logs/aws_cloudtrail/year=2020/month=12/day=01/hour=00/empty.json.gz"),
+		Body:   bytes.NewReader(nil),
+	})
+	require.NoError(t, err)
+
+	queue, err := sqsClient.CreateQueue(&sqs.CreateQueueInput{QueueName: aws.String(queueName)})
+	require.NoError(t, err)
+
+	stats := NewStats()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	sources, err := NewS3Clients(sess).Preflight([]string{"s3://" + bucket + "/logs/"})
+	require.NoError(t, err)
+	err = S3Queue(ctx, sess, testAccount, sources, queueName, 2, Limit{}, nil, stats)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(numObjects), stats.NumFiles.Value())
+
+	var runID string
+	received := make(map[string]bool)
+	for len(received) < numObjects && ctx.Err() == nil {
+		output, err := sqsClient.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              queue.QueueUrl,
+			MaxNumberOfMessages:   aws.Int64(10),
+			WaitTimeSeconds:       aws.Int64(1),
+			MessageAttributeNames: []*string{aws.String("All")},
+		})
+		require.NoError(t, err)
+		for _, message := range output.Messages {
+			var snsEntity events.SNSEntity
+			require.NoError(t, jsoniter.UnmarshalFromString(aws.StringValue(message.Body), &snsEntity))
+			assert.Equal(t, backfill.FakeTopicARN(testAccount), snsEntity.TopicArn)
+
+			notification, err := notify.ParseNotification([]byte(snsEntity.Message))
+			require.NoError(t, err)
+			require.Len(t, notification.Records, 1)
+			record := notification.Records[0]
+			assert.Equal(t, bucket, record.S3.Bucket.Name)
+			key, err := notify.DecodeObjectKey(record.S3.Object.Key)
+			require.NoError(t, err)
+			size, found := sizes[key]
+			require.True(t, found, key)
+			assert.Equal(t, size, record.S3.Object.Size)
+			assert.NotEmpty(t, record.S3.Object.ETag)
+			assert.False(t, received[key], "duplicate %s", key)
+			received[key] = true
+
+			attributes := message.MessageAttributes
+			require.Contains(t, attributes, notify.ReplayAttributeName)
+			assert.Equal(t, "true", aws.StringValue(attributes[notify.ReplayAttributeName].StringValue))
+			require.Contains(t, attributes, notify.OriginalEventTimeAttributeName)
+			originalEventTime := aws.StringValue(attributes[notify.OriginalEventTimeAttributeName].StringValue)
+			_, err = time.Parse(time.RFC3339, originalEventTime)
+			assert.NoError(t, err)
+			require.Contains(t, attributes, notify.BackfillRunIDAttributeName)
+			if runID == "" {
+				runID = aws.StringValue(attributes[notify.BackfillRunIDAttributeName].StringValue)
+			}
+			assert.Equal(t, runID, aws.StringValue(attributes[notify.BackfillRunIDAttributeName].StringValue))
+		}
+	}
+	assert.Len(t, received, numObjects)
+}
@@ -0,0 +1,187 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/cmd/opstools/sourcemap"
+	"github.com/panther-labs/panther/internal/log_analysis/awsglue"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+)
+
+// UnknownLogType counts the files whose log type cannot be resolved, the files no source reads
+const UnknownLogType = "unknown"
+
+// GroupByLogType is the FIFO message group strategy of LogTypeGroupID, next to the ones of backfill.FIFOGroupIDs
+const GroupByLogType = "log-type"
+
+// LogTypeMap is the log types of the tables of the data lake by table name, e.g. aws_cloudtrail=AWS.CloudTrail.
+// It resolves the log types of the files of the tables without the source API, e.g. where it cannot be invoked.
+// It is a flag.Value of table=LogType pairs or of a file of them, one per line.
+type LogTypeMap map[string]string
+
+func (m LogTypeMap) String() string {
+	pairs := make([]string, 0, len(m))
+	for table, logType := range m {
+		pairs = append(pairs, table+"="+logType)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set adds a table=LogType pair, or the pairs of a file if value is not a pair. The lines of a file starting with #
+// are comments.
+func (m LogTypeMap) Set(value string) error {
+	if strings.Contains(value, "=") {
+		return m.add(value)
+	}
+	file, err := os.Open(value)
+	if err != nil {
+		return errors.Wrap(err, "failed to open the log type map")
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := m.add(line); err != nil {
+			return errors.Wrapf(err, "line %d of %s", lineNum, value)
+		}
+	}
+	return errors.Wrapf(scanner.Err(), "failed to read %s", value)
+}
+
+func (m LogTypeMap) add(pair string) error {
+	table, logType := pair, ""
+	if i := strings.IndexByte(pair, '='); i >= 0 {
+		table, logType = strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+	}
+	if table == "" || logType == "" {
+		return errors.Errorf("%q is not a table=LogType pair", pair)
+	}
+	m[table] = logType
+	return nil
+}
+
+// LogType returns the log type of the table of a file of the data lake, e.g. logs/aws_cloudtrail/year=2020/...,
+// empty if the file is not of a table of the map
+func (m LogTypeMap) LogType(bucket, key string) string {
+	if len(m) == 0 {
+		return ""
+	}
+	partition, err := awsglue.PartitionFromS3Object(bucket, key)
+	if err != nil {
+		return ""
+	}
+	return m[partition.GetTable()]
+}
+
+// LogTypeGroupID returns the FIFO message group of a file as the log type of its table in tables, or the first log
+// type of the sources reading it. The other files are grouped by prefix.
+func LogTypeGroupID(tables LogTypeMap, sources []*sourcemap.Source) func(bucket, key string) string {
+	return func(bucket, key string) string {
+		if logType := tables.LogType(bucket, key); logType != "" {
+			return logType
+		}
+		for _, source := range sources {
+			if source.Owns(bucket, key) && len(source.LogTypes) > 0 {
+				return source.LogTypes[0]
+			}
+		}
+		return notify.PrefixMessageGroupID(bucket, key)
+	}
+}
+
+// LogTypesGroup returns the log type of the table of a file in tables or the log types of the first source reading it
+// as its group, so that only the files of the same log types are packed into a notification. The files not resolved
+// are grouped together.
+func LogTypesGroup(tables LogTypeMap, sources []*sourcemap.Source) func(bucket, key string) string {
+	return func(bucket, key string) string {
+		if logType := tables.LogType(bucket, key); logType != "" {
+			return logType
+		}
+		for _, source := range sources {
+			if source.Owns(bucket, key) {
+				return strings.Join(source.LogTypes, ",")
+			}
+		}
+		return UnknownLogType
+	}
+}
+
+// LogTypeCount is the number of files and bytes of a log type
+type LogTypeCount struct {
+	LogType  string `json:"logType"`
+	NumFiles uint64 `json:"numFiles"`
+	NumBytes uint64 `json:"numBytes"`
+}
+
+// LogTypeStats counts the files and bytes by log type where log types are resolved, i.e. in dry runs.
+// A file read by several sources counts for each of their log types. It is safe for concurrent use.
+type LogTypeStats struct {
+	mu     sync.Mutex
+	counts map[string]*LogTypeCount
+}
+
+// Add counts a file for its log types, UnknownLogType if there are none
+func (s *LogTypeStats) Add(logTypes []string, size uint64) {
+	if len(logTypes) == 0 {
+		logTypes = []string{UnknownLogType}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts == nil {
+		s.counts = make(map[string]*LogTypeCount)
+	}
+	for _, logType := range logTypes {
+		count, ok := s.counts[logType]
+		if !ok {
+			count = &LogTypeCount{LogType: logType}
+			s.counts[logType] = count
+		}
+		count.NumFiles++
+		count.NumBytes += size
+	}
+}
+
+// Counts returns the counts of every log type, the log types with the most files first
+func (s *LogTypeStats) Counts() []LogTypeCount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make([]LogTypeCount, 0, len(s.counts))
+	for _, count := range s.counts {
+		counts = append(counts, *count)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].NumFiles != counts[j].NumFiles {
+			return counts[i].NumFiles > counts[j].NumFiles
+		}
+		return counts[i].LogType < counts[j].LogType
+	})
+	return counts
+}
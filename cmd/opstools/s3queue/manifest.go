@@ -0,0 +1,232 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/awsutils"
+	"github.com/panther-labs/panther/pkg/metrics"
+	"github.com/panther-labs/panther/pkg/s3path"
+	"github.com/panther-labs/panther/pkg/stats"
+)
+
+// Metrics of a run, they have the dimensions Tool and RunID
+const (
+	FilesQueuedMetric = "BackfillFilesQueued"
+	BytesQueuedMetric = "BackfillBytesQueued"
+	RetriesMetric     = "BackfillRetries"
+)
+
+// Manifest describes what a run did, it is written at the end of the run under its run ID
+type Manifest struct {
+	RunID        string            `json:"runId"`
+	StartTime    time.Time         `json:"startTime"`
+	EndTime      time.Time         `json:"endTime"`
+	Sources      []*ManifestSource `json:"sources"`
+	Keys         string            `json:"keys,omitempty"`
+	Destination  string            `json:"destination"`
+	Profile      string            `json:"profile,omitempty"`
+	Limit        uint64            `json:"limit,omitempty"`
+	LimitBytes   uint64            `json:"limitBytes,omitempty"`
+	LimitReached string            `json:"limitReached,omitempty"` // the limit that stopped the listing, see Stats.LimitReached
+	Filter       *backfill.Filter  `json:"filter,omitempty"`
+	Include      []string          `json:"include,omitempty"`
+	Exclude      []string          `json:"exclude,omitempty"`
+	Stats        *stats.Snapshot   `json:"stats"`
+	LogTypes     []LogTypeCount    `json:"logTypes,omitempty"`
+	Sample       *SampleResult     `json:"sample,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	// RequesterPays is true if the requests of the run to requester-pays buckets were billed to its account
+	RequesterPays bool `json:"requesterPays,omitempty"`
+}
+
+type ManifestSource struct {
+	Path   string `json:"path"`
+	Region string `json:"region"`
+}
+
+// NewManifestSources returns the manifest entries of sources
+func NewManifestSources(sources []*Source) []*ManifestSource {
+	manifestSources := make([]*ManifestSource, 0, len(sources))
+	for _, source := range sources {
+		manifestSources = append(manifestSources, &ManifestSource{Path: source.Path.String(), Region: source.Region})
+	}
+	return manifestSources
+}
+
+// ManifestLocation is where manifests are kept, as <run id>.json under an s3 prefix or in a local directory.
+// The dead letters of runs are kept in locations too, see DeadLetters.
+type ManifestLocation struct {
+	S3     s3iface.S3API
+	Bucket string
+	Prefix string
+	// Dir is used if S3 is nil
+	Dir string
+}
+
+// NewManifestLocation returns the location of an s3 path (s3://bucket/prefix/) or a local directory
+func NewManifestLocation(sess client.ConfigProvider, location string) (*ManifestLocation, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return &ManifestLocation{Dir: location}, nil
+	}
+	path, err := s3path.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	prefix := path.Key
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &ManifestLocation{S3: s3.New(sess), Bucket: path.Bucket, Prefix: prefix}, nil
+}
+
+func (l *ManifestLocation) Write(ctx context.Context, manifest *Manifest) error {
+	data, err := jsoniter.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal manifest")
+	}
+	return l.put(ctx, manifest.RunID+".json", "application/json", data)
+}
+
+// writes a file of the location, e.g. the manifest or the dead letters of a run
+func (l *ManifestLocation) put(ctx context.Context, name, contentType string, data []byte) error {
+	if l.S3 == nil {
+		if err := os.MkdirAll(l.Dir, 0700); err != nil {
+			return errors.Wrapf(err, "failed to create %s", l.Dir)
+		}
+		path := filepath.Join(l.Dir, name)
+		return errors.Wrapf(ioutil.WriteFile(path, data, 0600), "failed to write %s", path)
+	}
+	key := l.Prefix + name
+	_, err := l.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      &l.Bucket,
+		Key:         &key,
+		Body:        strings.NewReader(string(data)),
+		ContentType: aws.String(contentType),
+	})
+	return errors.Wrapf(err, "failed to put s3://%s/%s", l.Bucket, key)
+}
+
+// Read returns the manifest of a run, nil if there is none
+func (l *ManifestLocation) Read(ctx context.Context, runID string) (*Manifest, error) {
+	var data []byte
+	if l.S3 == nil {
+		path := filepath.Join(l.Dir, runID+".json")
+		var err error
+		if data, err = ioutil.ReadFile(path); err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, errors.Wrapf(err, "failed to read %s", path)
+		}
+	} else {
+		key := l.Prefix + runID + ".json"
+		output, err := l.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: &l.Bucket, Key: &key})
+		if err != nil {
+			if awsutils.IsAnyError(err, s3.ErrCodeNoSuchKey) {
+				return nil, nil
+			}
+			return nil, errors.Wrapf(err, "failed to get s3://%s/%s", l.Bucket, key)
+		}
+		defer output.Body.Close()
+		if data, err = ioutil.ReadAll(output.Body); err != nil {
+			return nil, errors.Wrapf(err, "failed to read s3://%s/%s", l.Bucket, key)
+		}
+	}
+	manifest := &Manifest{}
+	if err := jsoniter.Unmarshal(data, manifest); err != nil {
+		return nil, errors.Wrapf(err, "invalid manifest of run %s", runID)
+	}
+	return manifest, nil
+}
+
+// PutRunMetrics puts the totals of a run, with the run ID as a dimension so that overlapping runs can be told apart
+func PutRunMetrics(ctx context.Context, cw cloudwatchiface.CloudWatchAPI, runID string, snapshot *stats.Snapshot) error {
+	dimensions := []*cloudwatch.Dimension{
+		{Name: aws.String("Tool"), Value: aws.String("s3queue")},
+		{Name: aws.String("RunID"), Value: aws.String(runID)},
+	}
+	datum := func(name, unit string, value uint64) *cloudwatch.MetricDatum {
+		return &cloudwatch.MetricDatum{
+			MetricName: aws.String(name),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(snapshot.Time),
+			Unit:       aws.String(unit),
+			Value:      aws.Float64(float64(value)),
+		}
+	}
+	_, err := cw.PutMetricDataWithContext(ctx, &cloudwatch.PutMetricDataInput{
+		Namespace: aws.String(metrics.Namespace),
+		MetricData: []*cloudwatch.MetricDatum{
+			datum(FilesQueuedMetric, cloudwatch.StandardUnitCount, snapshot.Counter("numSent")),
+			datum(BytesQueuedMetric, cloudwatch.StandardUnitBytes, snapshot.Counter("numBytes")),
+			datum(RetriesMetric, cloudwatch.StandardUnitCount, snapshot.Counter("numRetries")),
+		},
+	})
+	return errors.Wrapf(err, "failed to put metrics of run %s", runID)
+}
+
+// NewBackfillRecord returns the record of a run for the back-fill history of an integration, the run is still
+// running if the manifest has no end time. The actor is who ran it, e.g. the ARN of the caller.
+func NewBackfillRecord(manifest *Manifest, actor string) *models.BackfillRecord {
+	record := &models.BackfillRecord{
+		RunID:        manifest.RunID,
+		StartTime:    manifest.StartTime,
+		Status:       models.BackfillStatusRunning,
+		ErrorMessage: manifest.Error,
+		Actor:        actor,
+	}
+	for _, source := range manifest.Sources {
+		record.Prefixes = append(record.Prefixes, source.Path)
+	}
+	if manifest.Stats != nil {
+		record.NumFiles = manifest.Stats.Counter("numSent")
+		record.NumBytes = manifest.Stats.Counter("numBytes")
+	}
+	if manifest.EndTime.IsZero() {
+		return record
+	}
+	record.EndTime = &manifest.EndTime
+	switch {
+	case manifest.Error == "":
+		record.Status = models.BackfillStatusSucceeded
+	case strings.Contains(manifest.Error, context.Canceled.Error()):
+		record.Status = models.BackfillStatusCanceled
+	default:
+		record.Status = models.BackfillStatusFailed
+	}
+	return record
+}
@@ -0,0 +1,144 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	inputs []*cloudwatch.PutMetricDataInput
+	err    error
+}
+
+func (f *fakeCloudWatch) PutMetricDataWithContext(_ aws.Context, input *cloudwatch.PutMetricDataInput,
+	_ ...request.Option) (*cloudwatch.PutMetricDataOutput, error) {
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.inputs = append(f.inputs, input)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	location, err := NewManifestLocation(nil, dir)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	stats := NewStats()
+	stats.NumFiles.Add(3)
+	sources := []*Source{{Path: s3path.Path{Bucket: testBucket, Key: testKey}, Region: "us-west-2"}}
+	manifest := &Manifest{
+		RunID:       "run",
+		StartTime:   time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC),
+		EndTime:     time.Date(2020, 12, 1, 1, 0, 0, 0, time.UTC),
+		Sources:     NewManifestSources(sources),
+		Destination: "sqs queue",
+		Stats:       stats.Snapshot(),
+	}
+	require.NoError(t, location.Write(ctx, manifest))
+
+	read, err := location.Read(ctx, "run")
+	require.NoError(t, err)
+	require.NotNil(t, read)
+	assert.Equal(t, manifest.EndTime, read.EndTime)
+	assert.Equal(t, []*ManifestSource{{Path: "s3://foo/bar", Region: "us-west-2"}}, read.Sources)
+	assert.Equal(t, uint64(3), read.Stats.Counter("numFiles"))
+
+	read, err = location.Read(ctx, "other")
+	require.NoError(t, err)
+	assert.Nil(t, read)
+}
+
+func TestNewBackfillRecord(t *testing.T) {
+	stats := NewStats()
+	stats.Publish.NumSent.Add(3)
+	stats.NumBytes.Add(300)
+	manifest := &Manifest{
+		RunID:     "run",
+		StartTime: time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC),
+		Sources:   []*ManifestSource{{Path: "s3://foo/bar", Region: "us-west-2"}},
+	}
+	record := NewBackfillRecord(manifest, "arn:aws:iam::123456789012:user/ops")
+	assert.Equal(t, &models.BackfillRecord{
+		RunID:     "run",
+		StartTime: manifest.StartTime,
+		Prefixes:  []string{"s3://foo/bar"},
+		Status:    models.BackfillStatusRunning,
+		Actor:     "arn:aws:iam::123456789012:user/ops",
+	}, record)
+
+	manifest.EndTime = manifest.StartTime.Add(time.Hour)
+	manifest.Stats = stats.Snapshot()
+	record = NewBackfillRecord(manifest, "")
+	assert.Equal(t, models.BackfillStatusSucceeded, record.Status)
+	assert.Equal(t, manifest.EndTime, *record.EndTime)
+	assert.Equal(t, uint64(3), record.NumFiles)
+	assert.Equal(t, uint64(300), record.NumBytes)
+
+	manifest.Error = "failed to send 10 of 10 notifications: AccessDenied"
+	assert.Equal(t, models.BackfillStatusFailed, NewBackfillRecord(manifest, "").Status)
+	manifest.Error = context.Canceled.Error()
+	assert.Equal(t, models.BackfillStatusCanceled, NewBackfillRecord(manifest, "").Status)
+}
+
+func TestNewManifestLocation(t *testing.T) {
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+	location, err := NewManifestLocation(sess, "s3://bucket/manifests")
+	require.NoError(t, err)
+	assert.Equal(t, "bucket", location.Bucket)
+	assert.Equal(t, "manifests/", location.Prefix)
+	assert.NotNil(t, location.S3)
+}
+
+func TestPutRunMetrics(t *testing.T) {
+	stats := NewStats()
+	stats.Publish.NumSent.Add(10)
+	stats.NumBytes.Add(1000)
+	cw := &fakeCloudWatch{}
+	require.NoError(t, PutRunMetrics(context.Background(), cw, "run", stats.Snapshot()))
+	require.Len(t, cw.inputs, 1)
+	data := cw.inputs[0].MetricData
+	require.Len(t, data, 3)
+	assert.Equal(t, FilesQueuedMetric, aws.StringValue(data[0].MetricName))
+	assert.Equal(t, 10.0, aws.Float64Value(data[0].Value))
+	assert.Equal(t, 1000.0, aws.Float64Value(data[1].Value))
+	assert.Equal(t, "RunID", aws.StringValue(data[0].Dimensions[1].Name))
+	assert.Equal(t, "run", aws.StringValue(data[0].Dimensions[1].Value))
+}
@@ -0,0 +1,158 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/pkg/stats"
+)
+
+// ProgressNamespace is the CloudWatch namespace of the progress metrics of runs
+const ProgressNamespace = "Panther/Backfill"
+
+// Progress metrics of a run, they have the dimensions Topic and RunID. The counts are the increase since the last
+// put, the latencies are the percentiles of the run so far in milliseconds.
+const (
+	FilesListedMetric       = "FilesListed"
+	FilesPublishedMetric    = "FilesPublished"
+	BytesListedMetric       = "BytesListed"
+	FailedFilesMetric       = "FailedFiles"
+	PublishLatencyP50Metric = "PublishLatencyP50"
+	PublishLatencyP90Metric = "PublishLatencyP90"
+	PublishLatencyP99Metric = "PublishLatencyP99"
+)
+
+const (
+	maxMetricData  = 20 // the max data of a PutMetricData call
+	putMetricsTime = 30 * time.Second
+)
+
+// ProgressMetrics puts the progress of a run as CloudWatch metrics, so that unattended runs can have dashboards and
+// alarms. Failures to put them are logged, they never fail the run.
+type ProgressMetrics struct {
+	CloudWatch cloudwatchiface.CloudWatchAPI
+	Topic      string // the topic or queue of the run
+	RunID      string
+	Stats      *Stats
+
+	mu   sync.Mutex
+	last *stats.Snapshot // the counters of the last put
+}
+
+// Start puts the metrics every interval until stop is called, stop puts the last ones
+func (m *ProgressMetrics) Start(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.put()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		m.put()
+	}
+}
+
+// puts the metrics with a context of its own, the last ones are put once the run is cancelled
+func (m *ProgressMetrics) put() {
+	ctx, cancel := context.WithTimeout(context.Background(), putMetricsTime)
+	defer cancel()
+	if err := m.Put(ctx); err != nil {
+		zap.L().Warn("failed to put the progress metrics of the run", zap.Error(err))
+	}
+}
+
+// Put puts the increase of the counters since the last put and the publish latencies, in batches of the max data of
+// a call. After a failure the next put has the increase since the last put that succeeded.
+func (m *ProgressMetrics) Put(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snapshot := m.Stats.Snapshot()
+	last := m.last
+	if last == nil {
+		last = &stats.Snapshot{}
+	}
+
+	dimensions := []*cloudwatch.Dimension{
+		{Name: aws.String("Topic"), Value: aws.String(m.Topic)},
+		{Name: aws.String("RunID"), Value: aws.String(m.RunID)},
+	}
+	var data []*cloudwatch.MetricDatum
+	datum := func(name, unit string, value float64) {
+		data = append(data, &cloudwatch.MetricDatum{
+			MetricName: aws.String(name),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(snapshot.Time),
+			Unit:       aws.String(unit),
+			Value:      aws.Float64(value),
+		})
+	}
+	increase := func(name, counter, unit string) {
+		datum(name, unit, float64(snapshot.Counter(counter)-last.Counter(counter)))
+	}
+	increase(FilesListedMetric, "numFiles", cloudwatch.StandardUnitCount)
+	increase(FilesPublishedMetric, "numSentFiles", cloudwatch.StandardUnitCount)
+	increase(BytesListedMetric, "numBytes", cloudwatch.StandardUnitBytes)
+	increase(FailedFilesMetric, "numFailedFiles", cloudwatch.StandardUnitCount)
+	if snapshot.Gauge("publishLatencyP50") > 0 { // no batch was sent yet
+		for _, latency := range []struct{ name, gauge string }{
+			{PublishLatencyP50Metric, "publishLatencyP50"},
+			{PublishLatencyP90Metric, "publishLatencyP90"},
+			{PublishLatencyP99Metric, "publishLatencyP99"},
+		} {
+			datum(latency.name, cloudwatch.StandardUnitMilliseconds, float64(snapshot.Gauge(latency.gauge)))
+		}
+	}
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxMetricData {
+			n = maxMetricData
+		}
+		_, err := m.CloudWatch.PutMetricDataWithContext(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(ProgressNamespace),
+			MetricData: data[:n],
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to put the progress metrics of run %s", m.RunID)
+		}
+		data = data[n:]
+	}
+	m.last = snapshot
+	return nil
+}
@@ -0,0 +1,92 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func metricValues(input *cloudwatch.PutMetricDataInput) map[string]float64 {
+	values := make(map[string]float64)
+	for _, datum := range input.MetricData {
+		values[aws.StringValue(datum.MetricName)] = aws.Float64Value(datum.Value)
+	}
+	return values
+}
+
+func TestProgressMetrics(t *testing.T) {
+	stats := NewStats()
+	cw := &fakeCloudWatch{}
+	metrics := &ProgressMetrics{CloudWatch: cw, Topic: "topic", RunID: "run", Stats: stats}
+
+	stats.NumFiles.Add(10)
+	stats.NumBytes.Add(1000)
+	stats.NumSentFiles.Add(8)
+	require.NoError(t, metrics.Put(context.Background()))
+	require.Len(t, cw.inputs, 1)
+	assert.Equal(t, ProgressNamespace, aws.StringValue(cw.inputs[0].Namespace))
+	assert.Equal(t, map[string]float64{
+		FilesListedMetric:    10,
+		FilesPublishedMetric: 8,
+		BytesListedMetric:    1000,
+		FailedFilesMetric:    0,
+	}, metricValues(cw.inputs[0])) // no latency before a batch is sent
+	dimensions := cw.inputs[0].MetricData[0].Dimensions
+	assert.Equal(t, "Topic", aws.StringValue(dimensions[0].Name))
+	assert.Equal(t, "topic", aws.StringValue(dimensions[0].Value))
+	assert.Equal(t, "RunID", aws.StringValue(dimensions[1].Name))
+	assert.Equal(t, "run", aws.StringValue(dimensions[1].Value))
+
+	// a failed put does not lose the increase
+	stats.NumFiles.Add(5)
+	cw.err = errors.New("throttled")
+	assert.Error(t, metrics.Put(context.Background()))
+	cw.err = nil
+	stats.NumFiles.Add(1)
+	stats.NumFailedFiles.Add(2)
+	stats.PublishLatencyP50.Set(20)
+	stats.PublishLatencyP90.Set(40)
+	stats.PublishLatencyP99.Set(80)
+	require.NoError(t, metrics.Put(context.Background()))
+	require.Len(t, cw.inputs, 2)
+	assert.Equal(t, map[string]float64{
+		FilesListedMetric:       6,
+		FilesPublishedMetric:    0,
+		BytesListedMetric:       0,
+		FailedFilesMetric:       2,
+		PublishLatencyP50Metric: 20,
+		PublishLatencyP90Metric: 40,
+		PublishLatencyP99Metric: 80,
+	}, metricValues(cw.inputs[1]))
+	assert.Equal(t, cloudwatch.StandardUnitMilliseconds, aws.StringValue(cw.inputs[1].MetricData[4].Unit))
+
+	// stop puts the last increase
+	stats.NumSentFiles.Add(3)
+	metrics.Start(time.Hour)()
+	require.Len(t, cw.inputs, 3)
+	assert.Equal(t, 3.0, metricValues(cw.inputs[2])[FilesPublishedMetric])
+}
@@ -0,0 +1,73 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strings"
+	"sync"
+)
+
+// the partition segments of Panther keys, in order
+var partitionSegments = []string{"year=", "month=", "day=", "hour="}
+
+// PartitionLimit caps the files sent per partition of Panther keys, e.g. to send a few files of every hour of a table
+// rather than the first files of its first hour. It is safe for concurrent use, the sources of a run share it.
+type PartitionLimit struct {
+	PerPartition int
+
+	mu     sync.Mutex
+	counts map[string]int // the files taken by bucket and partition
+}
+
+// Take returns true and counts the file if its partition has room for it
+func (p *PartitionLimit) Take(bucket, key string) bool {
+	partition := bucket + "/" + Partition(key)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.counts == nil {
+		p.counts = make(map[string]int)
+	}
+	if p.counts[partition] >= p.PerPartition {
+		return false
+	}
+	p.counts[partition]++
+	return true
+}
+
+// Partition returns the prefix of a key up to its deepest partition segment, e.g. logs/table/year=2020/month=01/day=02/
+// for logs/table/year=2020/month=01/day=02/file.json.gz. It returns "" for keys without a year= directory, they share
+// a partition of their bucket.
+func Partition(key string) string {
+	dirs := strings.Split(key, "/")
+	dirs = dirs[:len(dirs)-1] // not the file name
+	for i, dir := range dirs {
+		if !strings.HasPrefix(dir, partitionSegments[0]) {
+			continue
+		}
+		end := i + 1
+		for _, segment := range partitionSegments[1:] {
+			if end == len(dirs) || !strings.HasPrefix(dirs[end], segment) {
+				break
+			}
+			end++
+		}
+		return strings.Join(dirs[:end], "/") + "/"
+	}
+	return ""
+}
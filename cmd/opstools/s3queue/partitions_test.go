@@ -0,0 +1,80 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
+)
+
+func TestPartition(t *testing.T) {
+	for key, partition := range map[string]string{
+		"logs/table/year=2020/month=01/day=02/hour=03/file.json.gz": "logs/table/year=2020/month=01/day=02/hour=03/",
+		"logs/table/year=2020/month=01/day=02/file.json.gz":         "logs/table/year=2020/month=01/day=02/",
+		"year=2020/month=01/extra/file.json.gz":                     "year=2020/month=01/",
+		"logs/table/day=02/file.json.gz":                            "",
+		"logs/year=2020.json.gz":                                    "",
+		"file.json.gz":                                              "",
+	} {
+		assert.Equal(t, partition, Partition(key), key)
+	}
+}
+
+func TestS3QueuePartitionLimit(t *testing.T) {
+	s3Client := awsfake.NewS3(awsfake.ListingSpec{
+		Bucket:         testBucket,
+		Prefix:         testKey + "/",
+		Start:          time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Hours:          3,
+		ObjectsPerHour: 5,
+		MinSize:        1,
+		MaxSize:        1000,
+	})
+	sources := testSources(s3Client)
+	sources[0].Partitions = &PartitionLimit{PerPartition: 2}
+	sources[0].Shuffle = true
+	destination := &backfill.RecordingDestination{BatchSize: 10}
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", sources, destination, nil, 1, Limit{}, nil, nil, nil, stats)
+	require.NoError(t, err)
+
+	perPartition := make(map[string]int)
+	for _, notification := range destination.Notifications() {
+		perPartition[Partition(notification.Event.Records[0].S3.Object.Key)]++
+	}
+	assert.Equal(t, map[string]int{
+		testKey + "/year=2020/month=01/day=01/hour=00/": 2,
+		testKey + "/year=2020/month=01/day=01/hour=01/": 2,
+		testKey + "/year=2020/month=01/day=01/hour=02/": 2,
+	}, perPartition)
+	assert.Equal(t, uint64(9), stats.Snapshot().Counter("numPartitionLimited"))
+
+	// keys without partitions share one of their bucket
+	limit := &PartitionLimit{PerPartition: 1}
+	assert.True(t, limit.Take(testBucket, "a.json.gz"))
+	assert.False(t, limit.Take(testBucket, "other/b.json.gz"))
+	assert.True(t, limit.Take("other", "a.json.gz"))
+}
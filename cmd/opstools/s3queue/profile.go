@@ -0,0 +1,284 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/cmd/opstools/lakemigrate"
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/awsretry"
+)
+
+// Profile configures how notifications are sent for a kind of downstream subscriber
+type Profile struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// PackRecords is the max number of S3 records in a notification, a notification per file if below 2
+	PackRecords int `json:"packRecords,omitempty"`
+	// PackGroup if set only packs the files of the same group together, e.g. of the same log types with
+	// LogTypesGroup. It is set by the caller, not by the JSON of the profile.
+	PackGroup func(bucket, key string) string `json:"-"`
+	// MaxSendsPerSecond limits the rate of sends to the destination, unlimited if zero
+	MaxSendsPerSecond float64 `json:"maxSendsPerSecond,omitempty"`
+	// MaxNotificationsPerSecond limits the rate of notifications to the destination, unlimited if zero
+	MaxNotificationsPerSecond float64 `json:"maxNotificationsPerSecond,omitempty"`
+	// MaxSendAttempts limits the attempts of a throttled or failing send before the run fails, if zero sends are
+	// retried with backoff for up to awsretry.DefaultMaxElapsedTime
+	MaxSendAttempts int `json:"maxSendAttempts,omitempty"`
+	// ErrorThreshold is how many files may fail to send before the run stops, e.g. "100" or "0.5%", a run stops at
+	// the first failure if nil. A run going on past failures still fails at the end.
+	ErrorThreshold *ErrorThreshold `json:"errorThreshold,omitempty"`
+	// NotifyBuffer is the number of listed files queued for the writers, 1000 if zero. A larger buffer absorbs
+	// slow sends for longer at the cost of memory, it does not make the writers faster.
+	NotifyBuffer int `json:"notifyBuffer,omitempty"`
+	// AdaptiveConcurrency halves the writers sending at once when the sends are throttled and adds them back one at
+	// a time after every 10s without throttling, up to the concurrency of the run
+	AdaptiveConcurrency bool `json:"adaptiveConcurrency,omitempty"`
+	// NoAttributes sends plain S3 notifications, without the replay message attributes
+	NoAttributes bool `json:"noAttributes,omitempty"`
+	// CompressAbove if positive compresses the messages larger than this many bytes and marks them with the
+	// compressed schema version attribute, so it needs the message attributes
+	CompressAbove int `json:"compressAbove,omitempty"`
+	// SigningSecret is the Secrets Manager secret whose current key signs the notifications, unsigned if empty
+	SigningSecret string `json:"signingSecret,omitempty"`
+	// WarnInternalSubscribers warns if Panther subscribes to the topic the notifications are published to
+	WarnInternalSubscribers bool `json:"warnInternalSubscribers,omitempty"`
+	// Verifier if set heads the files of every batch before it is sent. It is set by the caller, not by the JSON of
+	// the profile.
+	Verifier *Verifier `json:"-"`
+
+	signer *notify.Signer
+}
+
+// DefaultProfile is used if no profile is given
+const DefaultProfile = "default"
+
+// Profiles are the built-in profiles by name, a new kind of subscriber only needs an entry here
+var Profiles = map[string]*Profile{
+	DefaultProfile: {
+		Name:        DefaultProfile,
+		Description: "A notification per file with the replay attributes, for the Panther log processor",
+	},
+	"snowflake": {
+		Name: "snowflake",
+		Description: "Plain S3 notifications packed 100 files at a time at 10 sends per second, " +
+			"for Snowpipe auto-ingest subscribed to the topic",
+		PackRecords:             100,
+		MaxSendsPerSecond:       10,
+		NoAttributes:            true,
+		WarnInternalSubscribers: true,
+	},
+}
+
+// ProfileNames returns the names of the built-in profiles, sorted
+func ProfileNames() []string {
+	names := make([]string, 0, len(Profiles))
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadProfile returns the built-in profile of a name or reads a profile from a JSON file,
+// the default profile if nameOrPath is empty
+func LoadProfile(nameOrPath string) (*Profile, error) {
+	if nameOrPath == "" {
+		nameOrPath = DefaultProfile
+	}
+	if profile, ok := Profiles[nameOrPath]; ok {
+		copied := *profile // loading the signer must not change the built-in profile
+		return &copied, nil
+	}
+	if !strings.HasSuffix(nameOrPath, ".json") {
+		return nil, errors.Errorf("unknown profile %q, use one of %s or a .json file",
+			nameOrPath, strings.Join(ProfileNames(), ", "))
+	}
+	data, err := ioutil.ReadFile(nameOrPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read profile")
+	}
+	profile := &Profile{}
+	if err := jsoniter.Unmarshal(data, profile); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse profile %s", nameOrPath)
+	}
+	if profile.PackRecords < 0 || profile.MaxSendsPerSecond < 0 || profile.MaxNotificationsPerSecond < 0 ||
+		profile.MaxSendAttempts < 0 || profile.NotifyBuffer < 0 || profile.CompressAbove < 0 {
+
+		return nil, errors.Errorf("profile %s has negative limits", nameOrPath)
+	}
+	if profile.Name == "" {
+		profile.Name = nameOrPath
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// Validate returns an error if the options of the profile do not go together
+func (p *Profile) Validate() error {
+	if p.CompressAbove > 0 && p.NoAttributes {
+		return errors.Errorf("profile %s compresses messages without the attributes marking them compressed", p.Name)
+	}
+	return nil
+}
+
+// ValidateDestination returns an error if the profile cannot send to a kind of destination, see
+// backfill.DestinationOptions. The log processor reads the sqs, lambda and processor destinations, it does not decode
+// compressed messages.
+func (p *Profile) ValidateDestination(kind string) error {
+	if p == nil || p.CompressAbove <= 0 {
+		return nil
+	}
+	switch kind {
+	case backfill.DestinationSQS, backfill.DestinationLambda, backfill.DestinationProcessor:
+		return errors.Errorf("profile %s compresses messages, the log processor reading the %s destination cannot decode them",
+			p.Name, kind)
+	}
+	return nil
+}
+
+// Apply configures a publisher for the profile, a nil profile leaves it as is
+func (p *Profile) Apply(publisher *backfill.Publisher) {
+	if p == nil {
+		return
+	}
+	publisher.PackRecords = p.PackRecords
+	publisher.PackGroup = p.PackGroup
+	publisher.NoAttributes = p.NoAttributes
+	publisher.CompressAbove = p.CompressAbove
+	publisher.Signer = p.signer
+	if p.MaxSendsPerSecond > 0 {
+		publisher.Throttle = &lakemigrate.Throttle{RequestsPerSecond: p.MaxSendsPerSecond}
+	}
+	if p.MaxSendAttempts > 0 {
+		if publisher.Retryer == nil {
+			publisher.Retryer = &awsretry.Retryer{}
+		}
+		publisher.Retryer.MaxAttempts = p.MaxSendAttempts
+	}
+	if p.MaxNotificationsPerSecond > 0 {
+		// the size of the sends is their number of notifications
+		publisher.NotificationThrottle = &lakemigrate.Throttle{BytesPerSecond: p.MaxNotificationsPerSecond}
+	}
+}
+
+// returns the verifier of the profile, nil if the files are not verified
+func (p *Profile) verifier() *Verifier {
+	if p == nil {
+		return nil
+	}
+	return p.Verifier
+}
+
+// returns a copy of the profile sending as fast as possible without verifying the files, for EstimateRun
+func (p *Profile) withoutLimits() *Profile {
+	if p == nil {
+		return nil
+	}
+	copied := *p
+	copied.MaxSendsPerSecond, copied.MaxNotificationsPerSecond = 0, 0
+	copied.AdaptiveConcurrency, copied.Verifier = false, nil
+	return &copied
+}
+
+// returns the error threshold of the profile, the zero threshold if there is none
+func (p *Profile) errorThreshold() ErrorThreshold {
+	if p == nil || p.ErrorThreshold == nil {
+		return ErrorThreshold{}
+	}
+	return *p.ErrorThreshold
+}
+
+// returns true if the profile adapts the concurrency of the writers to throttling
+func (p *Profile) adaptiveConcurrency() bool {
+	return p != nil && p.AdaptiveConcurrency
+}
+
+// returns the size of the notify channel of the profile, defaultNotifyBuffer if it has none
+func (p *Profile) notifyBuffer() int {
+	if p == nil || p.NotifyBuffer <= 0 {
+		return defaultNotifyBuffer
+	}
+	return p.NotifyBuffer
+}
+
+// LoadSigner fetches the signing key of the profile, it must be called before Apply for signed notifications
+func (p *Profile) LoadSigner(client secretsmanageriface.SecretsManagerAPI) error {
+	if p.SigningSecret == "" {
+		return nil
+	}
+	signer, err := notify.LoadSigner(client, p.SigningSecret)
+	if err != nil {
+		return err
+	}
+	p.signer = signer
+	return nil
+}
+
+// Panther resources are named panther-..., e.g. the log processing queue
+const internalResourcePrefix = "panther-"
+
+// InternalSubscriptions returns the subscriptions of a topic by Panther queues and functions,
+// these receive every notification published to the topic
+func InternalSubscriptions(snsClient snsiface.SNSAPI, topicARN string) ([]*sns.Subscription, error) {
+	var internal []*sns.Subscription
+	input := &sns.ListSubscriptionsByTopicInput{TopicArn: &topicARN}
+	for {
+		page, err := snsClient.ListSubscriptionsByTopic(input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list the subscriptions of %s", topicARN)
+		}
+		for _, subscription := range page.Subscriptions {
+			if isInternalEndpoint(aws.StringValue(subscription.Endpoint)) {
+				internal = append(internal, subscription)
+			}
+		}
+		if page.NextToken == nil {
+			return internal, nil
+		}
+		input.NextToken = page.NextToken
+	}
+}
+
+// the endpoint of queues and functions is their ARN, other endpoints (e.g. https) are not Panther resources
+func isInternalEndpoint(endpoint string) bool {
+	endpointARN, err := arn.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	name := endpointARN.Resource
+	if endpointARN.Service == "lambda" {
+		name = strings.TrimPrefix(name, "function:")
+	}
+	return strings.HasPrefix(name, internalResourcePrefix)
+}
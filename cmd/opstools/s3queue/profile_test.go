@@ -0,0 +1,176 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/testutils"
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
+)
+
+func TestLoadProfile(t *testing.T) {
+	profile, err := LoadProfile("")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultProfile, profile.Name)
+
+	profile, err = LoadProfile("snowflake")
+	require.NoError(t, err)
+	assert.True(t, profile.NoAttributes)
+	assert.True(t, profile.WarnInternalSubscribers)
+	profile.SigningSecret = "secret"
+	assert.Empty(t, Profiles["snowflake"].SigningSecret) // built-in profiles are copied
+
+	_, err = LoadProfile("nope")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "use one of default, snowflake")
+
+	path := filepath.Join(t.TempDir(), "datadog.json")
+	data := `{"packRecords":10,"maxSendsPerSecond":5,"errorThreshold":"1%","notifyBuffer":50}`
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0600))
+	profile, err = LoadProfile(path)
+	require.NoError(t, err)
+	assert.Equal(t, &Profile{Name: path, PackRecords: 10, MaxSendsPerSecond: 5, ErrorThreshold: &ErrorThreshold{Percent: 1},
+		NotifyBuffer: 50}, profile)
+	assert.Equal(t, 50, profile.notifyBuffer())
+	assert.Equal(t, defaultNotifyBuffer, (*Profile)(nil).notifyBuffer())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"packRecords":-1}`), 0600))
+	_, err = LoadProfile(path)
+	require.Error(t, err)
+
+	// compressed messages are only marked by their attributes
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"compressAbove":1024,"noAttributes":true}`), 0600))
+	_, err = LoadProfile(path)
+	require.Error(t, err)
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"compressAbove":1024}`), 0600))
+	profile, err = LoadProfile(path)
+	require.NoError(t, err)
+	publisher := &backfill.Publisher{}
+	profile.Apply(publisher)
+	assert.Equal(t, 1024, publisher.CompressAbove)
+
+	// only the subscribers of topics and buses decode compressed messages, not the log processor
+	for _, kind := range []string{backfill.DestinationSQS, backfill.DestinationLambda, backfill.DestinationProcessor} {
+		assert.Error(t, profile.ValidateDestination(kind), kind)
+	}
+	assert.NoError(t, profile.ValidateDestination(backfill.DestinationSNS))
+	assert.NoError(t, profile.ValidateDestination(backfill.DestinationEventBridge))
+	assert.NoError(t, (&Profile{}).ValidateDestination(backfill.DestinationSQS))
+}
+
+func TestS3QueueToProfile(t *testing.T) {
+	s3Client := testS3(7)
+	destination := &backfill.RecordingDestination{}
+	profile := &Profile{PackRecords: 3, NoAttributes: true}
+
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), destination, profile, 1, Limit{}, nil, nil, nil, stats)
+	require.NoError(t, err)
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 3)
+	assert.Len(t, notifications[0].Event.Records, 3)
+	assert.Len(t, notifications[2].Event.Records, 1)
+	for _, notification := range notifications {
+		assert.Empty(t, notification.Attributes[notify.ReplayAttributeName])
+	}
+	assert.Equal(t, uint64(3), stats.Snapshot().Counter("numSent"))
+	assert.Equal(t, uint64(7), stats.Snapshot().Counter("numFiles"))
+
+	// signed notifications
+	key := notify.SigningKey{Version: "v1", Secret: []byte("secret")}
+	profile.signer = &notify.Signer{Key: key}
+	destination = &backfill.RecordingDestination{}
+	err = S3QueueTo(context.Background(), "run", testSources(s3Client), destination, profile, 1, Limit{}, nil, nil, nil, NewStats())
+	require.NoError(t, err)
+	verifier := &notify.Verifier{Keys: []notify.SigningKey{key}}
+	for _, notification := range destination.Notifications() {
+		signature := notification.Attributes[notify.SignatureAttributeName]
+		require.NotEmpty(t, signature)
+		assert.NoError(t, verifier.Verify(notification.Message, signature))
+	}
+}
+
+func TestS3QueueToMaxNotificationsPerSecond(t *testing.T) {
+	s3Client := testS3(5)
+	destination := &backfill.RecordingDestination{BatchSize: 1}
+	profile := &Profile{MaxNotificationsPerSecond: 50}
+
+	// the rate is shared by all the workers, the 5th notification waits for the 4 before it
+	start := time.Now()
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), destination, profile, 4, Limit{}, nil, nil, nil, NewStats())
+	require.NoError(t, err)
+	assert.Len(t, destination.Notifications(), 5)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(70*time.Millisecond))
+}
+
+func TestS3QueueToMaxSendAttempts(t *testing.T) {
+	sqsClient := &awsfake.SQSSink{Failures: awsfake.Failures{ThrottleEvery: 1}}
+	destination := &backfill.SQSDestination{SQS: sqsClient, QueueURL: "queue", TopicARN: backfill.FakeTopicARN(testAccount)}
+	profile := &Profile{MaxSendAttempts: 2}
+
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", testSources(testS3(1)), destination, profile, 1, Limit{}, nil, nil, nil, stats)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrPublish))
+	assert.Equal(t, 2, sqsClient.Calls())
+	assert.Equal(t, uint64(1), stats.NumRetries.Value())
+	assert.Equal(t, uint64(1), stats.NumFailedBatches.Value())
+}
+
+func TestInternalSubscriptions(t *testing.T) {
+	const topicARN = "arn:aws:sns:us-east-1:" + testAccount + ":topic"
+	snsClient := &testutils.SnsMock{}
+	snsClient.On("ListSubscriptionsByTopic", mock.Anything).Return(&sns.ListSubscriptionsByTopicOutput{
+		Subscriptions: []*sns.Subscription{
+			{Endpoint: aws.String("arn:aws:sqs:us-east-1:" + testAccount + ":panther-input-data-notifications-queue")},
+			{Endpoint: aws.String("arn:aws:sqs:us-east-1:" + testAccount + ":snowpipe-queue")},
+		},
+		NextToken: aws.String("next"),
+	}, nil).Once()
+	snsClient.On("ListSubscriptionsByTopic", &sns.ListSubscriptionsByTopicInput{
+		TopicArn:  aws.String(topicARN),
+		NextToken: aws.String("next"),
+	}).Return(&sns.ListSubscriptionsByTopicOutput{
+		Subscriptions: []*sns.Subscription{
+			{Endpoint: aws.String("arn:aws:lambda:us-east-1:" + testAccount + ":function:panther-log-processor")},
+			{Endpoint: aws.String("https://example.com/panther-hook")},
+		},
+	}, nil).Once()
+
+	internal, err := InternalSubscriptions(snsClient, topicARN)
+	require.NoError(t, err)
+	require.Len(t, internal, 2)
+	assert.Contains(t, aws.StringValue(internal[0].Endpoint), "panther-input-data-notifications-queue")
+	assert.Contains(t, aws.StringValue(internal[1].Endpoint), "function:panther-log-processor")
+	snsClient.AssertExpectations(t)
+}
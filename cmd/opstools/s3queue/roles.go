@@ -0,0 +1,73 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+// RunRoles are the credentials of the roles assumed by a run, nil for a role not set so that the session is used
+type RunRoles struct {
+	// S3 lists and reads the buckets, e.g. of a log archive account
+	S3 *credentials.Credentials
+	// SNS publishes to the topics of the destination, e.g. of the Panther account
+	SNS *credentials.Credentials
+}
+
+// AssumeRunRoles returns the credentials of the roles of a run assumed with stsClient, the roles with an empty ARN are
+// not assumed. The roles are only assumed once their credentials are used.
+func AssumeRunRoles(stsClient stsiface.STSAPI, s3RoleARN, snsRoleARN, runID string) *RunRoles {
+	roles := &RunRoles{}
+	if s3RoleARN != "" {
+		roles.S3 = AssumeRole(stsClient, s3RoleARN, runID)
+	}
+	if snsRoleARN != "" {
+		roles.SNS = AssumeRole(stsClient, snsRoleARN, runID)
+	}
+	return roles
+}
+
+// AssumeRole returns the credentials of a role assumed with stsClient by a run, they are refreshed before they expire
+// so that a run can outlast the max session duration of the role
+func AssumeRole(stsClient stsiface.STSAPI, roleARN, runID string) *credentials.Credentials {
+	return stscreds.NewCredentialsWithClient(stsClient, roleARN, func(provider *stscreds.AssumeRoleProvider) {
+		provider.RoleSessionName = RoleSessionName(runID)
+		provider.ExpiryWindow = time.Minute
+	})
+}
+
+// the max length of a role session name and the characters it may not have
+const maxRoleSessionName = 64
+
+var invalidRoleSessionChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// RoleSessionName returns the session name of the roles assumed by a run, so that CloudTrail ties their calls to the
+// run. The characters of the run ID that session names cannot have, e.g. colons, are replaced by dashes.
+func RoleSessionName(runID string) string {
+	name := "s3queue-" + invalidRoleSessionChars.ReplaceAllString(runID, "-")
+	if len(name) > maxRoleSessionName {
+		name = name[:maxRoleSessionName]
+	}
+	return name
+}
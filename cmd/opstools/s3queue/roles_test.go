@@ -0,0 +1,100 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// an STS fake assuming any role, the access key of a role is its ARN
+type fakeSTS struct {
+	stsiface.STSAPI
+
+	mu      sync.Mutex
+	assumed []*sts.AssumeRoleInput
+}
+
+func (f *fakeSTS) AssumeRoleWithContext(_ aws.Context, input *sts.AssumeRoleInput, _ ...request.Option) (
+	*sts.AssumeRoleOutput, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.assumed = append(f.assumed, input)
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     input.RoleArn,
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}}, nil
+}
+
+func TestRoleSessionName(t *testing.T) {
+	valid := regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+	for runID, expected := range map[string]string{
+		"01ERW9X3T2ZJ3Q8W1V3GHJ0Z6K":     "s3queue-01ERW9X3T2ZJ3Q8W1V3GHJ0Z6K",
+		"backfill:2020-11-01":            "s3queue-backfill-2020-11-01",
+		"a b/c*d+e=f,g.h@i_j":            "s3queue-a-b-c-d+e=f,g.h@i_j",
+		"émigré":                         "s3queue--migr-",
+		strings.Repeat("x", 100):         "s3queue-" + strings.Repeat("x", 56),
+		strings.Repeat(":", 30) + "tail": "s3queue-" + strings.Repeat("-", 30) + "tail",
+	} {
+		name := RoleSessionName(runID)
+		assert.Equal(t, expected, name, runID)
+		assert.Regexp(t, valid, name, runID)
+	}
+}
+
+func TestAssumeRunRoles(t *testing.T) {
+	const s3Role = "arn:aws:iam::111111111111:role/LogArchiveRead"
+	const snsRole = "arn:aws:iam::222222222222:role/PantherPublish"
+	stsClient := &fakeSTS{}
+
+	// each role has its own credentials
+	roles := AssumeRunRoles(stsClient, s3Role, snsRole, "run:1")
+	require.NotNil(t, roles.S3)
+	require.NotNil(t, roles.SNS)
+	assert.Empty(t, stsClient.assumed) // not assumed until used
+	s3Creds, err := roles.S3.Get()
+	require.NoError(t, err)
+	snsCreds, err := roles.SNS.Get()
+	require.NoError(t, err)
+	assert.Equal(t, s3Role, s3Creds.AccessKeyID)
+	assert.Equal(t, snsRole, snsCreds.AccessKeyID)
+	require.Len(t, stsClient.assumed, 2)
+	for _, input := range stsClient.assumed {
+		assert.Equal(t, "s3queue-run-1", aws.StringValue(input.RoleSessionName))
+	}
+
+	// a role not set is not assumed, the session is used
+	roles = AssumeRunRoles(stsClient, s3Role, "", "run")
+	assert.NotNil(t, roles.S3)
+	assert.Nil(t, roles.SNS)
+	assert.Equal(t, &RunRoles{}, AssumeRunRoles(stsClient, "", "", "run"))
+}
@@ -0,0 +1,219 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/lambdalogger"
+	"github.com/panther-labs/panther/pkg/progress"
+)
+
+// ProgressFunc is called with the stats of a run as it progresses, from a goroutine of the run
+type ProgressFunc func(stats *Stats)
+
+// Input is a back-fill run of Run, to send the files of s3 paths from automation instead of the command line
+type Input struct {
+	// Session makes the S3 clients and the destination when they are not set
+	Session *session.Session
+	// Clients resolve the buckets of Paths, NewS3Clients of the Session if nil
+	Clients *S3Clients
+	// Paths are the s3 paths to send the files of, checked with Preflight
+	Paths []string
+	// Sources are sent instead of Paths if set, e.g. the sources of a Preflight of the caller
+	Sources []*Source
+	// Keys are sent instead of Sources or Paths if set, the files of a key list are not listed
+	Keys *KeyList
+	// Checkpointing starts the run at its checkpoint and saves checkpoints as files are sent, it cannot be set with Keys
+	Checkpointing *Checkpointing
+	// Topic is the ARN of the topic to send to if Destination is nil
+	Topic       string
+	Destination backfill.Destination
+	// Filter and KeyFilter select the files of Paths to send, all the files are sent if both are nil
+	Filter    *backfill.Filter
+	KeyFilter *KeyFilter
+	// RunID identifies the notifications of the run downstream, a new one if empty
+	RunID       string
+	Profile     *Profile // the default profile if nil
+	Concurrency int      // 1 if not set
+	Limit       Limit
+	Sampler     *Sampler
+	Failed      *FailedKeys
+	// Progress is called every ProgressInterval and once more when the run ends, the progress is logged if nil
+	Progress         ProgressFunc
+	ProgressInterval time.Duration // 10 seconds if not set
+	// Logger logs the run with its run ID, paths and topic as fields, the logger of the context if nil, see
+	// lambdalogger.FromContext. Every line of the run has them, so that the runs of several callers in one process can
+	// be told apart.
+	Logger *zap.Logger
+	// Stats counts the run, NewStats if nil
+	Stats *Stats
+}
+
+// Run sends the files of the input to its destination, for callers that do not shell out to the command.
+// It returns the stats of the run, counted so far if it failed. The errors are classified as described for
+// ErrBadPath and the other classes of errors. See S3QueueTo for how a run is checkpointed, canceled and fails.
+func Run(ctx context.Context, input Input) (*Stats, error) {
+	stats := input.Stats
+	if stats == nil {
+		stats = NewStats()
+	}
+	list, sources, err := input.lister(stats)
+	if err != nil {
+		return stats, err
+	}
+	destination, err := input.destination()
+	if err != nil {
+		return stats, err
+	}
+	runID := input.RunID
+	if runID == "" {
+		runID = backfill.NewRunID()
+	}
+	concurrency := input.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	reporting := runProgress{interval: input.ProgressInterval} // logged if there is no Progress
+	if input.Progress != nil {
+		reporting.output = func(_ progress.Report) {
+			input.Progress(stats)
+		}
+	}
+	ctx = lambdalogger.Context(ctx, input.logger(ctx, runID, sources))
+	err = queueObjects(ctx, runID, list, destination, input.Profile, concurrency, input.Limit, input.Checkpointing,
+		input.Failed, stats, reporting)
+	return stats, err
+}
+
+// returns the listing of the files of the input and the sources it lists, nil if it sends a key list
+func (input *Input) lister(stats *Stats) (func(context.Context, chan listedObject) error, []*Source, error) {
+	if input.Keys != nil {
+		if input.Checkpointing != nil {
+			return nil, nil, errors.New("a key list cannot be checkpointed")
+		}
+		list := func(ctx context.Context, notifyChan chan listedObject) error {
+			return input.Keys.list(ctx, input.Limit, notifyChan, stats)
+		}
+		return list, nil, nil
+	}
+	sources, err := input.sources()
+	if err != nil {
+		return nil, nil, err
+	}
+	var start *Checkpoint
+	if input.Checkpointing != nil {
+		start = input.Checkpointing.Checkpoint
+	}
+	list := func(ctx context.Context, notifyChan chan listedObject) error {
+		return listSources(ctx, sources, start, input.Limit, input.Sampler, input.Failed, notifyChan, stats)
+	}
+	return list, sources, nil
+}
+
+// returns the Logger of the input with the fields of the run
+func (input *Input) logger(ctx context.Context, runID string, sources []*Source) *zap.Logger {
+	logger := input.Logger
+	if logger == nil {
+		logger = lambdalogger.FromContext(ctx)
+	}
+	fields := []zap.Field{zap.String("runID", runID)}
+	if len(sources) > 0 {
+		paths := make([]string, len(sources))
+		for i, source := range sources {
+			paths[i] = source.Path.String()
+		}
+		fields = append(fields, zap.Strings("paths", paths))
+	}
+	if input.Topic != "" {
+		fields = append(fields, zap.String("topic", input.Topic))
+	}
+	return logger.With(fields...)
+}
+
+// returns the Sources of the input, or the sources of its Paths selecting the files of its filters
+func (input *Input) sources() ([]*Source, error) {
+	if input.Sources != nil {
+		return input.Sources, nil
+	}
+	if len(input.Paths) == 0 {
+		return nil, classify(ErrBadPath, errors.New("no s3 paths to send"))
+	}
+	clients := input.Clients
+	if clients == nil {
+		if input.Session == nil {
+			return nil, errors.New("no session or clients to list the s3 paths with")
+		}
+		clients = NewS3Clients(input.Session)
+	}
+	sources, err := clients.Preflight(input.Paths)
+	if err != nil {
+		return nil, err
+	}
+	match, err := NewMatch(input.Filter, input.KeyFilter)
+	if err != nil {
+		return nil, err
+	}
+	for _, source := range sources {
+		source.Match = match
+	}
+	return sources, nil
+}
+
+// NewMatch returns the Match of sources selecting the files of the filter and key patterns, nil if they select all
+// files. Either may be nil.
+func NewMatch(filter *backfill.Filter, keyFilter *KeyFilter) (func(*s3.Object) bool, error) {
+	if filter == nil && keyFilter == nil {
+		return nil, nil
+	}
+	if filter == nil {
+		filter = &backfill.Filter{}
+	}
+	matchFilter, err := filter.Matcher()
+	if err != nil {
+		return nil, err
+	}
+	return func(object *s3.Object) bool {
+		return matchFilter(object) && (keyFilter == nil || keyFilter.Match(aws.StringValue(object.Key)))
+	}, nil
+}
+
+// returns the Destination of the input, or its Topic
+func (input *Input) destination() (backfill.Destination, error) {
+	if input.Destination != nil {
+		return input.Destination, nil
+	}
+	if input.Topic == "" {
+		return nil, errors.New("no topic or destination to send to")
+	}
+	if input.Session == nil {
+		return nil, errors.New("no session to send to the topic with")
+	}
+	return backfill.NewDestination(input.Session, &backfill.DestinationOptions{
+		Kind:   backfill.DestinationSNS,
+		Target: input.Topic,
+	})
+}
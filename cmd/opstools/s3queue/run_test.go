@@ -0,0 +1,119 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+)
+
+func TestRun(t *testing.T) {
+	s3Client := testS3(5)
+	clients := newS3Clients(
+		func(bucket string) (string, error) { return "us-east-1", nil },
+		func(region string) s3iface.S3API { return s3Client },
+	)
+	keyFilter, err := NewKeyFilter(nil, []string{s3Client.Spec.Key(1)})
+	require.NoError(t, err)
+	destination := &backfill.RecordingDestination{BatchSize: 2}
+	var numReports int32
+	stats, err := Run(context.Background(), Input{
+		Clients:     clients,
+		Paths:       []string{testS3Path},
+		Destination: destination,
+		KeyFilter:   keyFilter,
+		RunID:       "run",
+		Progress: func(stats *Stats) {
+			atomic.AddInt32(&numReports, 1)
+		},
+	})
+	require.NoError(t, err)
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 4)
+	assert.Equal(t, s3Client.Spec.Key(0), notifications[0].Event.Records[0].S3.Object.Key)
+	assert.Equal(t, s3Client.Spec.Key(2), notifications[1].Event.Records[0].S3.Object.Key)
+	assert.Equal(t, uint64(4), stats.NumSentFiles.Value())
+	assert.Equal(t, uint64(1), stats.NumSkipped.Value())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&numReports)) // the final report, the run is shorter than the interval
+}
+
+func TestRunLogger(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	s3Client := testS3(3)
+	_, err := Run(context.Background(), Input{
+		Sources:     testSources(s3Client),
+		Destination: &backfill.RecordingDestination{BatchSize: 2},
+		Concurrency: 2,
+		RunID:       "run",
+		Logger:      zap.New(core),
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, logs.FilterMessage("starting back-fill").All())
+	require.NotEmpty(t, logs.FilterMessageSnippet("queued files").All()) // the progress is logged without a Progress
+	for _, entry := range logs.All() {
+		fields := entry.ContextMap()
+		assert.Equal(t, "run", fields["runID"], entry.Message)
+		assert.Contains(t, fields, "paths", entry.Message)
+	}
+	listing := logs.FilterMessage("listing").All()
+	require.Len(t, listing, 1)
+	assert.Equal(t, testS3Path, listing[0].ContextMap()["path"])
+}
+
+func TestRunErrors(t *testing.T) {
+	_, err := Run(context.Background(), Input{Destination: &backfill.RecordingDestination{}})
+	assert.True(t, errors.Is(err, ErrBadPath))
+
+	clients := newS3Clients(
+		func(bucket string) (string, error) { return "us-east-1", nil },
+		func(region string) s3iface.S3API { return testS3(1) },
+	)
+	_, err = Run(context.Background(), Input{
+		Clients:     clients,
+		Paths:       []string{"foo"},
+		Destination: &backfill.RecordingDestination{},
+	})
+	assert.True(t, errors.Is(err, ErrBadPath))
+
+	// the paths cannot be resolved without a session or clients
+	_, err = Run(context.Background(), Input{Paths: []string{testS3Path}, Destination: &backfill.RecordingDestination{}})
+	assert.Error(t, err)
+
+	_, err = Run(context.Background(), Input{Sources: testSources(testS3(1)), Topic: "arn:aws:sns:us-east-1:123456789012:topic"})
+	assert.Error(t, err)
+
+	_, err = Run(context.Background(), Input{Sources: testSources(testS3(1))})
+	assert.Error(t, err)
+
+	_, err = Run(context.Background(), Input{
+		Keys:          testKeyList(testS3(1)),
+		Checkpointing: &Checkpointing{},
+		Destination:   &backfill.RecordingDestination{},
+	})
+	assert.Error(t, err)
+}
@@ -19,230 +19,823 @@ package s3queue
  */
 
 import (
-	"fmt"
-	"log"
-	"math"
-	"net/url"
-	"strconv"
+	"context"
+	"math/rand"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
-	jsoniter "github.com/json-iterator/go"
 	"github.com/pkg/errors"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 
-	"github.com/panther-labs/panther/pkg/awsbatch/sqsbatch"
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/awsretry"
+	"github.com/panther-labs/panther/pkg/lambdalogger"
+	"github.com/panther-labs/panther/pkg/progress"
+	"github.com/panther-labs/panther/pkg/s3path"
+	"github.com/panther-labs/panther/pkg/stats"
+	"github.com/panther-labs/panther/pkg/workerpool"
 )
 
 const (
-	pageSize             = 1000
-	fakeTopicArnTemplate = "arn:aws:sns:us-east-1:%s:panther-fake-s3queue-topic" // account is added for sqs messages
-	progressNotify       = 5000                                                  // log a line every this many to show progress
+	progressInterval = 10 * time.Second // log a line this often to show progress
 )
 
+// Stats are the counters of a back-fill, they are safe for concurrent use. The listers count the files listed in
+// NumFiles and NumBytes while the writers count the files published in NumSentFiles and those that failed to send in
+// NumFailedFiles, so a run that failed midway is not taken for having sent everything it listed.
+// Snapshots have the counters numFiles, numBytes, numSentFiles, numSkipped, numSizeFiltered, numMalformed, numMissing,
+// numUnretrievable, numInvalidKeys, numBookmarked, numIngested, numPartitionLimited, numVerifyMissing, numVerifyFailed,
+// numFailedBatches, numFailedFiles, numListerBlocked, listerBlockedMillis and the publish counters numSent,
+// numSentBatches, numSentBytes, numRetries and numRetriedBatches. The gauges notifyDepth and publishLatencyP50,
+// publishLatencyP90, publishLatencyP99 (milliseconds) are updated as the backpressure of the run is reported,
+// concurrency and minConcurrency as the writers are throttled.
 type Stats struct {
-	NumFiles uint64
-	NumBytes uint64
+	NumFiles            *stats.Counter
+	NumBytes            *stats.Counter
+	NumSentFiles        *stats.Counter // files of the batches sent, numSent counts notifications which may pack several
+	NumSkipped          *stats.Counter // files not selected by the Match of their source or the filters of a key list
+	NumSizeFiltered     *stats.Counter // files outside the MinSize and MaxSize of their source, including empty files
+	NumMalformed        *stats.Counter // lines of a key list that are not s3 paths of files
+	NumMissing          *stats.Counter // files of a key list that do not exist
+	NumUnretrievable    *stats.Counter // files skipped in a storage class that needs a restore, see Source.IncludeGlacier
+	NumInvalidKeys      *stats.Counter // files skipped with keys that cannot be sent, see backfill.ValidateKey
+	NumBookmarked       *stats.Counter // files of the batches sent that were skipped as already sent, see Bookmarks
+	NumIngested         *stats.Counter // files skipped as already ingested, see Source.Ingested
+	NumPartitionLimited *stats.Counter // files skipped once their partition reached its PartitionLimit
+	NumVerifyMissing    *stats.Counter // files deleted since they were listed, skipped by the Verifier of the profile
+	NumVerifyFailed     *stats.Counter // files of the batches not sent as the Verifier failed to head them
+	NumRetries          *stats.Counter // throttled or transient send failures that were retried
+	NumFailedBatches    *stats.Counter // batches that failed or panicked, their files may not have been sent
+	NumFailedFiles      *stats.Counter // files of the batches that failed to send, including those tolerated
+	// NumListerBlocked and ListerBlockedMillis count the waits of the listers for room in the notify buffer,
+	// the writers were behind
+	NumListerBlocked    *stats.Counter
+	ListerBlockedMillis *stats.Counter
+	NotifyDepth         *stats.Gauge // listed files waiting for a writer, at the last report
+	// PublishLatencyP50, P90 and P99 are percentiles of the send latency of the batches of the run in milliseconds,
+	// rounded up to the buckets of a histogram
+	PublishLatencyP50 *stats.Gauge
+	PublishLatencyP90 *stats.Gauge
+	PublishLatencyP99 *stats.Gauge
+	Concurrency       *stats.Gauge // writers allowed to send at once, lowered while throttled with adaptive concurrency
+	MinConcurrency    *stats.Gauge // the lowest Concurrency of the run
+	Publish           *backfill.PublishStats
+	LogTypes          *LogTypeStats // the files by log type, counted by a DryRun given them
+
+	collector    *stats.Collector
+	limitReached atomic.Value // the limit that stopped the listing
 }
 
-func S3Queue(sess *session.Session, account, s3path, s3region, queueName string,
-	concurrency int, limit uint64, stats *Stats) (err error) {
+func NewStats() *Stats {
+	collector := stats.NewCollector()
+	return &Stats{
+		NumFiles:            collector.Counter("numFiles"),
+		NumBytes:            collector.Counter("numBytes"),
+		NumSentFiles:        collector.Counter("numSentFiles"),
+		NumSkipped:          collector.Counter("numSkipped"),
+		NumSizeFiltered:     collector.Counter("numSizeFiltered"),
+		NumMalformed:        collector.Counter("numMalformed"),
+		NumMissing:          collector.Counter("numMissing"),
+		NumUnretrievable:    collector.Counter("numUnretrievable"),
+		NumInvalidKeys:      collector.Counter("numInvalidKeys"),
+		NumBookmarked:       collector.Counter("numBookmarked"),
+		NumIngested:         collector.Counter("numIngested"),
+		NumPartitionLimited: collector.Counter("numPartitionLimited"),
+		NumVerifyMissing:    collector.Counter("numVerifyMissing"),
+		NumVerifyFailed:     collector.Counter("numVerifyFailed"),
+		NumRetries:          collector.Counter("numRetries"),
+		NumFailedBatches:    collector.Counter("numFailedBatches"),
+		NumFailedFiles:      collector.Counter("numFailedFiles"),
+		NumListerBlocked:    collector.Counter("numListerBlocked"),
+		ListerBlockedMillis: collector.Counter("listerBlockedMillis"),
+		NotifyDepth:         collector.Gauge("notifyDepth"),
+		PublishLatencyP50:   collector.Gauge("publishLatencyP50"),
+		PublishLatencyP90:   collector.Gauge("publishLatencyP90"),
+		PublishLatencyP99:   collector.Gauge("publishLatencyP99"),
+		Concurrency:         collector.Gauge("concurrency"),
+		MinConcurrency:      collector.Gauge("minConcurrency"),
+		Publish:             backfill.NewPublishStats(collector), // shares numRetries
+		LogTypes:            &LogTypeStats{},
+		collector:           collector,
+	}
+}
 
-	return s3Queue(s3.New(sess.Copy(&aws.Config{Region: &s3region})), sqs.New(sess),
-		account, s3path, queueName, concurrency, limit, stats)
+// Snapshot returns the current values of the counters
+func (s *Stats) Snapshot() *stats.Snapshot {
+	return s.collector.Snapshot()
 }
 
-func s3Queue(s3Client s3iface.S3API, sqsClient sqsiface.SQSAPI, account, s3path, queueName string,
-	concurrency int, limit uint64, stats *Stats) (failed error) {
+// LimitReached returns the limit that stopped the listing, LimitFiles or LimitBytes, empty if none did
+func (s *Stats) LimitReached() string {
+	reached, _ := s.limitReached.Load().(string)
+	return reached
+}
 
-	queueURL, err := sqsClient.GetQueueUrl(&sqs.GetQueueUrlInput{
-		QueueName: &queueName,
-	})
-	if err != nil {
-		return errors.Wrapf(err, "could not get queue url for %s", queueName)
+// What stopped the listing of a run, see Stats.LimitReached
+const (
+	LimitFiles = "files"
+	LimitBytes = "bytes"
+)
+
+// Limit stops the listing of a run after a number of files or bytes, whichever is reached first. The file that
+// reaches the byte limit is still sent, files are not split. Zero values do not limit the run.
+type Limit struct {
+	Files uint64
+	Bytes uint64
+}
+
+// reached returns true if the files listed reached the limit and records which limit it was
+func (l Limit) reached(stats *Stats) bool {
+	reached := ""
+	switch {
+	case l.Files > 0 && stats.NumFiles.Value() >= l.Files:
+		reached = LimitFiles
+	case l.Bytes > 0 && stats.NumBytes.Value() >= l.Bytes:
+		reached = LimitBytes
+	default:
+		return false
 	}
+	stats.limitReached.Store(reached)
+	return true
+}
+
+// limiter enforces a Limit across concurrent listers, a file is taken before it is sent so that the listers
+// together send no more files than the limit
+type limiter struct {
+	Limit
+	stats    *Stats
+	numFiles uint64 // taken, updated atomically
+	numBytes uint64 // taken, updated atomically
+}
 
-	// the account id is taken from this arn to assume role for reading in the log processor
-	topicARN := fmt.Sprintf(fakeTopicArnTemplate, account)
+// take returns false if the limit was reached before the file, the file that reaches the byte limit is taken
+func (l *limiter) take(size uint64) bool {
+	numFiles := atomic.AddUint64(&l.numFiles, 1)
+	numBytes := atomic.AddUint64(&l.numBytes, size) - size
+	switch {
+	case l.Files > 0 && numFiles > l.Files:
+		l.stats.limitReached.Store(LimitFiles)
+	case l.Bytes > 0 && numBytes >= l.Bytes:
+		l.stats.limitReached.Store(LimitBytes)
+	default:
+		return true
+	}
+	return false
+}
 
-	errChan := make(chan error)
-	notifyChan := make(chan *events.S3Event, 1000)
+// Source is an s3 path to list with a client in the region of its bucket
+type Source struct {
+	Path   s3path.Path
+	Region string
+	S3     s3iface.S3API
+	// Match selects the files to send, e.g. from a backfill.Filter. All the files of the sizes below are sent if nil.
+	// The files of the sizes below it does not select are counted as skipped.
+	Match func(object *s3.Object) bool
+	// MinSize and MaxSize are the sizes of the files to send in bytes, the others are counted as size filtered.
+	// MinSize defaults to 1, empty files are never sent, there is no max if MaxSize is 0.
+	MinSize uint64
+	MaxSize uint64
+	// Delimiter if set lists only the files at the level of Path, e.g. the files next to the shards of ShardSources
+	Delimiter string
+	// IncludeGlacier sends the files in the GLACIER and DEEP_ARCHIVE storage classes, e.g. with restores in flight.
+	// They are skipped otherwise, the log processor would fail to read them.
+	IncludeGlacier bool
+	// RequesterPays lists a requester-pays bucket, the requests are billed to the account of the caller
+	RequesterPays bool
+	// ExpectedBucketOwner if set is the account the bucket must belong to, the requests to it are denied otherwise
+	ExpectedBucketOwner string
+	// Partitions if set caps the files sent per partition, the sources of a run may share it
+	Partitions *PartitionLimit
+	// Shuffle sends the selected files of every listed page in random order, they are not sent in key order
+	Shuffle bool
+	// Ingested if set skips the files already ingested, only the files missing from it are sent. The sources must
+	// not be shuffled and must be sorted with SortSources.
+	Ingested *IngestedKeys
+}
 
-	var queueWg sync.WaitGroup
-	for i := 0; i < concurrency; i++ {
-		queueWg.Add(1)
-		go func() {
-			queueNotifications(sqsClient, topicARN, queueURL.QueueUrl, notifyChan, errChan)
-			queueWg.Done()
-		}()
+// returns the RequestPayer of the requests to requester-pays buckets, nil otherwise
+func requestPayer(requesterPays bool) *string {
+	if !requesterPays {
+		return nil
 	}
+	return aws.String(s3.RequestPayerRequester)
+}
 
-	queueWg.Add(1)
-	go func() {
-		listPath(s3Client, s3path, limit, notifyChan, errChan, stats)
-		queueWg.Done()
-	}()
+// returns the ExpectedBucketOwner of the requests to a bucket, nil if any owner is accepted
+func bucketOwner(account string) *string {
+	if account == "" {
+		return nil
+	}
+	return aws.String(account)
+}
 
-	var errorWg sync.WaitGroup
-	errorWg.Add(1)
-	go func() {
-		for err := range errChan { // return last error
-			failed = err
-		}
-		errorWg.Done()
-	}()
+// returns true if the object is within the MinSize and MaxSize of the source
+func (s *Source) matchSize(object *s3.Object) bool {
+	minSize := s.MinSize
+	if minSize == 0 {
+		minSize = 1
+	}
+	size := aws.Int64Value(object.Size)
+	return size >= 0 && uint64(size) >= minSize && (s.MaxSize == 0 || uint64(size) <= s.MaxSize)
+}
 
-	queueWg.Wait()
-	close(errChan)
-	errorWg.Wait()
+// isUnretrievable returns true if an object must be restored before it can be read
+func isUnretrievable(object *s3.Object) bool {
+	switch aws.StringValue(object.StorageClass) {
+	case s3.ObjectStorageClassGlacier, s3.ObjectStorageClassDeepArchive:
+		return true
+	default:
+		return false
+	}
+}
 
-	return failed
+// S3Clients resolves the regions of buckets and caches a client per region, it is safe for concurrent use
+type S3Clients struct {
+	// RequesterPays lists, heads and gets the files of requester-pays buckets at the expense of the caller,
+	// without it s3 denies access to them. It is set on the sources of Preflight.
+	RequesterPays bool
+	// ExpectedBucketOwner if set is the account the buckets must belong to, e.g. not a re-created bucket of another
+	// account. Preflight checks the buckets of the sources, the other requests are denied by s3.
+	ExpectedBucketOwner string
+
+	locate    func(bucket string) (string, error)
+	newClient func(region string) s3iface.S3API
+
+	mu      sync.Mutex
+	regions map[string]string        // by bucket
+	clients map[string]s3iface.S3API // by region
 }
 
-// Given an s3path (e.g., s3://mybucket/myprefix) list files and send to notifyChan
-func listPath(s3Client s3iface.S3API, s3path string, limit uint64,
-	notifyChan chan *events.S3Event, errChan chan error, stats *Stats) {
+// NewS3Clients returns clients of the session, the configs are applied to all clients (e.g. credentials)
+func NewS3Clients(sess *session.Session, configs ...*aws.Config) *S3Clients {
+	locator := s3.New(sess, configs...)
+	return newS3Clients(
+		func(bucket string) (string, error) {
+			return bucketRegion(locator, bucket)
+		},
+		func(region string) s3iface.S3API {
+			return s3.New(sess.Copy(configs...), &aws.Config{Region: &region})
+		},
+	)
+}
 
-	if limit == 0 {
-		limit = math.MaxUint64
+func newS3Clients(locate func(bucket string) (string, error), newClient func(region string) s3iface.S3API) *S3Clients {
+	return &S3Clients{
+		locate:    locate,
+		newClient: newClient,
+		regions:   make(map[string]string),
+		clients:   make(map[string]s3iface.S3API),
 	}
+}
 
-	defer func() {
-		close(notifyChan) // signal to reader that we are done
-	}()
+// ForBucket returns a client in the region of a bucket and the region
+func (c *S3Clients) ForBucket(bucket string) (s3iface.S3API, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	region, ok := c.regions[bucket]
+	if !ok {
+		var err error
+		if region, err = c.locate(bucket); err != nil {
+			return nil, "", classifyList(errors.Wrapf(err, "failed to find bucket region for %s", bucket))
+		}
+		c.regions[bucket] = region
+	}
+	client, ok := c.clients[region]
+	if !ok {
+		client = c.newClient(region)
+		c.clients[region] = client
+	}
+	return client, region, nil
+}
 
-	parsedPath, err := url.Parse(s3path)
+// Preflight parses the paths and resolves the regions of their buckets before anything is sent,
+// the error reports every path that failed. Paths that do not parse are ErrBadPath errors.
+func (c *S3Clients) Preflight(s3Paths []string) ([]*Source, error) {
+	var sources []*Source
+	var err error
+	for _, s3Path := range s3Paths {
+		path, parseErr := s3path.Parse(s3Path)
+		if parseErr != nil {
+			err = multierr.Append(err, classify(ErrBadPath, parseErr))
+			continue
+		}
+		client, region, locateErr := c.ForBucket(path.Bucket)
+		if locateErr != nil {
+			err = multierr.Append(err, errors.WithMessage(locateErr, s3Path))
+			continue
+		}
+		if ownerErr := c.checkOwner(client, path.Bucket); ownerErr != nil {
+			err = multierr.Append(err, errors.WithMessage(ownerErr, s3Path))
+			continue
+		}
+		sources = append(sources, &Source{
+			Path:                path,
+			Region:              region,
+			S3:                  client,
+			RequesterPays:       c.RequesterPays,
+			ExpectedBucketOwner: c.ExpectedBucketOwner,
+		})
+	}
 	if err != nil {
-		errChan <- errors.Errorf("bad s3 url: %s,", err)
-		return
+		return nil, err
 	}
+	return sources, nil
+}
 
-	if parsedPath.Scheme != "s3" {
-		errChan <- errors.Errorf("not s3 protocol (expecting s3://): %s,", s3path)
-		return
+// returns an ErrBucketOwner error if the bucket is not owned by the expected account, nil if any owner is accepted
+func (c *S3Clients) checkOwner(s3Client s3iface.S3API, bucket string) error {
+	if c.ExpectedBucketOwner == "" {
+		return nil
+	}
+	_, err := s3Client.HeadBucket(&s3.HeadBucketInput{
+		Bucket:              &bucket,
+		ExpectedBucketOwner: &c.ExpectedBucketOwner,
+	})
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() == http.StatusForbidden {
+		return classify(ErrBucketOwner, errors.Errorf("bucket %s is not owned by account %s, or access to it is denied",
+			bucket, c.ExpectedBucketOwner))
 	}
+	return errors.Wrapf(err, "failed to check the owner of bucket %s", bucket)
+}
 
-	bucket := parsedPath.Host
-	if bucket == "" {
-		errChan <- errors.Errorf("missing bucket: %s,", s3path)
-		return
+func bucketRegion(s3Client s3iface.S3API, bucket string) (string, error) {
+	location, err := s3Client.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: &bucket})
+	if err != nil {
+		return "", err
 	}
-	var prefix string
-	if len(parsedPath.Path) > 0 {
-		prefix = parsedPath.Path[1:] // remove leading '/'
+	// Method may return nil if region is us-east-1,https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketLocation.html
+	// and https://docs.aws.amazon.com/general/latest/gr/rande.html#s3_region
+	if location.LocationConstraint == nil || *location.LocationConstraint == "" {
+		return endpoints.UsEast1RegionID, nil
 	}
+	return *location.LocationConstraint, nil
+}
 
-	// list files w/pagination
-	inputParams := &s3.ListObjectsV2Input{
-		Bucket:  aws.String(bucket),
-		Prefix:  aws.String(prefix),
-		MaxKeys: aws.Int64(pageSize),
-	}
-	err = s3Client.ListObjectsV2Pages(inputParams, func(page *s3.ListObjectsV2Output, morePages bool) bool {
-		for _, value := range page.Contents {
-			if *value.Size > 0 { // we only care about objects with size
-				stats.NumFiles++
-				if stats.NumFiles%progressNotify == 0 {
-					log.Printf("listed %d files ...", stats.NumFiles)
-				}
-				stats.NumBytes += (uint64)(*value.Size)
-				notifyChan <- &events.S3Event{
-					Records: []events.S3EventRecord{
-						{
-							S3: events.S3Entity{
-								Bucket: events.S3Bucket{
-									Name: bucket,
-								},
-								Object: events.S3Object{
-									Key:  *value.Key,
-									Size: *value.Size,
-								},
-							},
-						},
-					},
-				}
-				if stats.NumFiles >= limit {
-					break
-				}
-			}
-		}
-		return stats.NumFiles < limit // "To stop iterating, return false from the fn function."
+// S3Queue lists the objects of the sources, each in the region of its bucket, and sends notifications to the queue
+// in the session region. The sources are listed one after the other into the same stats, the limit applies to all
+// sources together and a listing error stops the run with the path that failed. If sampler is not nil it checks
+// a sample of the objects before they are sent, the run is aborted if too many samples fail.
+// The errors are classified as described for ErrBadPath and the other classes of errors.
+// It is kept for compatibility, Run takes the same and more as an Input.
+func S3Queue(ctx context.Context, sess *session.Session, account string, sources []*Source, queueName string,
+	concurrency int, limit Limit, sampler *Sampler, stats *Stats) (err error) {
+
+	return s3Queue(ctx, sources, sqs.New(sess), account, queueName, concurrency, limit, sampler, stats)
+}
+
+func s3Queue(ctx context.Context, sources []*Source, sqsClient sqsiface.SQSAPI, account, queueName string,
+	concurrency int, limit Limit, sampler *Sampler, stats *Stats) error {
+
+	queueURL, err := sqsClient.GetQueueUrl(&sqs.GetQueueUrlInput{
+		QueueName: &queueName,
 	})
 	if err != nil {
-		errChan <- err
+		return classify(ErrPublish, errors.Wrapf(err, "could not get queue url for %s", queueName))
+	}
+	destination := &backfill.SQSDestination{
+		SQS:      sqsClient,
+		QueueURL: aws.StringValue(queueURL.QueueUrl),
+		// the account id is taken from this arn to assume role for reading in the log processor
+		TopicARN: backfill.FakeTopicARN(account),
 	}
+	_, err = Run(ctx, Input{
+		Sources:     sources,
+		Destination: destination,
+		Concurrency: concurrency,
+		Limit:       limit,
+		Sampler:     sampler,
+		Stats:       stats,
+	})
+	return err
+}
+
+// S3QueueTo is S3Queue sending the notifications to any back-fill destination, e.g. a topic or the log processor.
+// The run ID identifies the notifications of the run downstream, see backfill.NewRunID.
+// The profile configures the notifications for the subscribers of the destination, the default profile if nil.
+// If checkpointing is not nil the run starts at its checkpoint and saves checkpoints as files are sent.
+// Canceling ctx stops the listing, the files already listed are sent and an ErrCanceled error is returned.
+// The first failed batch stops the run unless the error threshold of the profile tolerates it, the run then goes on
+// and fails at the end with the number of files that failed to send.
+// If failed is not nil the files of the batches that failed or were not sent after a failure are written to it,
+// along with the files skipped in a storage class that needs a restore, see Source.IncludeGlacier.
+// It is kept for compatibility, it runs the Input of its arguments with Run.
+func S3QueueTo(ctx context.Context, runID string, sources []*Source, destination backfill.Destination, profile *Profile,
+	concurrency int, limit Limit, sampler *Sampler, checkpointing *Checkpointing, failed *FailedKeys, stats *Stats) error {
+
+	_, err := Run(ctx, Input{
+		RunID:         runID,
+		Sources:       sources,
+		Destination:   destination,
+		Profile:       profile,
+		Concurrency:   concurrency,
+		Limit:         limit,
+		Sampler:       sampler,
+		Checkpointing: checkpointing,
+		Failed:        failed,
+		Stats:         stats,
+	})
+	return err
 }
 
-// post message per file as-if it was an S3 notification
-func queueNotifications(sqsClient sqsiface.SQSAPI, topicARN string, queueURL *string,
-	notifyChan chan *events.S3Event, errChan chan error) {
+// S3QueueKeys is S3QueueTo sending the files of a key list instead of listing sources, it is not checkpointed.
+// It is kept for compatibility, it runs the Input of its arguments with Run.
+func S3QueueKeys(ctx context.Context, runID string, keys *KeyList, destination backfill.Destination, profile *Profile,
+	concurrency int, limit Limit, failed *FailedKeys, stats *Stats) error {
+
+	_, err := Run(ctx, Input{
+		RunID:       runID,
+		Keys:        keys,
+		Destination: destination,
+		Profile:     profile,
+		Concurrency: concurrency,
+		Limit:       limit,
+		Failed:      failed,
+		Stats:       stats,
+	})
+	return err
+}
+
+// runProgress is how the progress of a run is reported, the zero value logs it every progressInterval
+type runProgress struct {
+	output   progress.Output
+	interval time.Duration
+}
 
-	sendMessageBatchInput := &sqs.SendMessageBatchInput{
-		QueueUrl: queueURL,
+func (r runProgress) withDefaults(logger *zap.Logger) runProgress {
+	if r.output == nil {
+		r.output = progress.ZapOutput(logger)
 	}
+	if r.interval <= 0 {
+		r.interval = progressInterval
+	}
+	return r
+}
 
-	// we have 1 file per notification to limit blast radius in case of failure.
-	const (
-		batchTimeout = time.Minute
-		batchSize    = 10
-	)
-	var failed bool
-	for s3Notification := range notifyChan {
-		if failed { // drain channel
-			continue
+// sends the objects of list in batches, list must close notifyChan when done. The run logs with the logger of ctx,
+// see lambdalogger.FromContext.
+func queueObjects(ctx context.Context, runID string, list func(context.Context, chan listedObject) error,
+	destination backfill.Destination, profile *Profile, concurrency int, limit Limit, checkpointing *Checkpointing,
+	failed *FailedKeys, stats *Stats, reporting runProgress) error {
+
+	logger := lambdalogger.FromContext(ctx)
+	logger.Info("starting back-fill", zap.String("runID", runID))
+
+	// a failed batch beyond the error threshold, or a panicking batch, stops the listing and the batches not yet sent.
+	// Canceling ctx only stops the listing, the batches already listed are sent so that the run ends at a checkpoint.
+	// The writers still log with the logger of ctx.
+	pool := workerpool.New(lambdalogger.Context(context.Background(), logger), concurrency, workerpool.FailFast)
+	listCtx, stopListing := context.WithCancel(pool.Context())
+	defer stopListing()
+	if ctx.Err() != nil {
+		stopListing() // canceled before the run started, there is nothing listed to drain
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			stopListing()
+		case <-listCtx.Done():
 		}
+	}()
+	reporting = reporting.withDefaults(logger)
+	reporter := progress.New("queued files", limit.Files, reporting.interval, reporting.output)
+	reporter.Start()
+	defer reporter.Stop()
+	stats.Concurrency.Set(int64(concurrency))
+	var writers *adaptiveConcurrency // nil unless the profile adapts the concurrency to throttling
+	if profile.adaptiveConcurrency() {
+		writers = newAdaptiveConcurrency(concurrency, stats, logger)
+		defer writers.start()()
+	}
+	publisher := &backfill.Publisher{
+		Destination: destination,
+		RunID:       runID,
+		Retryer: &awsretry.Retryer{
+			OnRetry: func(err error, class awsretry.Class, wait time.Duration) {
+				logger.Debug("retrying send", zap.Stringer("class", class), zap.Duration("wait", wait), zap.Error(err))
+				if class == awsretry.Throttled {
+					writers.throttled()
+				}
+			},
+		},
+		Stats: stats.Publish,
+	}
+	profile.Apply(publisher)
+	tracker := newCheckpointer(checkpointing)
+	verifier := profile.verifier()
+	tolerance := &errorTolerance{threshold: profile.errorThreshold(), keys: failed, stats: stats}
+	// the objects are queued as compact records, their notifications are only built when sent
+	notifyChan := make(chan listedObject, profile.notifyBuffer())
+	monitor := &backpressure{notifyChan: notifyChan, stats: stats, logger: logger}
+	stopMonitor := monitor.start(reporting.interval)
+	listErr := make(chan error, 1)
+	go func() {
+		listErr <- list(listCtx, notifyChan)
+	}()
 
-		zap.L().Debug("sending file to SQS",
-			zap.String("bucket", s3Notification.Records[0].S3.Bucket.Name),
-			zap.String("key", s3Notification.Records[0].S3.Object.Key))
-
-		ctnJSON, err := jsoniter.MarshalToString(s3Notification)
-		if err != nil {
-			errChan <- errors.Wrapf(err, "failed to marshal %#v", s3Notification)
-			failed = true
-			continue
+	batchListed(notifyChan, destination.MaxBatchSize(), tracker, func(batch *objectBatch) bool {
+		if pool.Submit(queueNotifications(publisher, verifier, batch, reporter, tracker, tolerance, monitor, writers)) != nil {
+			failed.AddObjects(batch.objects, errNotSent) // error is reported by Wait
+			return false
 		}
+		return true
+	})
+
+	err := pool.Wait()
+	stopMonitor()
+	poolStats := pool.Stats()
+	logger.Debug("back-fill batches",
+		zap.Uint64("sent", poolStats.Succeeded),
+		zap.Uint64("failed", poolStats.Failed),
+		zap.Uint64("skipped", poolStats.Skipped))
+	stats.NumFailedBatches.Add(poolStats.Failed)
+	var panicErr *workerpool.PanicError
+	if errors.As(err, &panicErr) {
+		logger.Error("publishing a batch panicked", zap.ByteString("stack", panicErr.Stack))
+	}
+	var errs MultiError // the errors of the lister and of every publisher, not only the first
+	errs.Add(<-listErr)
+	errs.Add(err)
+	if errs.Err() == nil && ctx.Err() != nil {
+		errs.Add(classify(ErrCanceled, ctx.Err())) // the files listed before were sent
+	}
+	errs.Add(classify(ErrPublish, tolerance.result()))
+	complete := errs.Err() == nil && stats.LimitReached() == ""
+	errs.Add(tracker.Finish(context.Background(), complete))
+	return errs.Err()
+}
 
-		// make it look like an SNS notification
-		snsNotification := events.SNSEntity{
-			Type:     "Notification",
-			TopicArn: topicARN, // this is needed by the log processor to get account associated with the S3 object
-			Message:  ctnJSON,
+// listedObject is an object and the index of its source
+type listedObject struct {
+	object backfill.Object
+	source int
+	// after is the key of the object listed before it from the source, or the key the listing started after
+	after string
+	// retry is the index plus one of the failed range of the checkpoint listed again, zero if of the listing
+	retry int
+	// rangeEnd has no object, the failed range of retry was listed again up to its last key
+	rangeEnd bool
+}
+
+// listPosition is the position of the listing of a source, listPath moves it past the objects sent to notifyChan
+type listPosition struct {
+	source int
+	after  string
+	until  string
+	retry  int
+}
+
+// batches the listed objects in listing order and submits the batches until submit returns false. With a checkpoint
+// a batch only has the objects listed one after the other from a source, so that a batch that fails is a range of keys.
+func batchListed(notifyChan chan listedObject, batchSize int, tracker *checkpointer, submit func(*objectBatch) bool) {
+	batch := newBatch(0, batchSize)
+	for listed := range notifyChan {
+		if len(batch.objects) == batchSize || len(batch.objects) > 0 && tracker != nil && !batch.continues(listed) {
+			if !submit(batch) {
+				return // the pool stopped, the lister stops too
+			}
+			batch = newBatch(batch.seq+1, batchSize)
 		}
-		message, err := jsoniter.MarshalToString(snsNotification)
-		if err != nil {
-			errChan <- errors.Wrapf(err, "failed to marshal %#v", snsNotification)
-			failed = true
+		if listed.rangeEnd {
+			// the files of the range that are gone since it failed are not looked for again
+			tracker.Sent(context.Background(), batch.seq, batchEnd{source: listed.source, key: listed.after, retry: listed.retry})
+			batch = newBatch(batch.seq+1, batchSize)
 			continue
 		}
+		batch.add(listed)
+	}
+	if len(batch.objects) > 0 {
+		submit(batch)
+	}
+}
 
-		sendMessageBatchInput.Entries = append(sendMessageBatchInput.Entries, &sqs.SendMessageBatchRequestEntry{
-			Id:          aws.String(strconv.Itoa(len(sendMessageBatchInput.Entries))),
-			MessageBody: &message,
-		})
-		if len(sendMessageBatchInput.Entries)%batchSize == 0 {
-			_, err = sqsbatch.SendMessageBatch(sqsClient, batchTimeout, sendMessageBatchInput)
-			if err != nil {
-				errChan <- errors.Wrapf(err, "failed to send %#v", sendMessageBatchInput)
-				failed = true
-				continue
+// objectBatch is a batch of objects with its sequence number in listing order
+type objectBatch struct {
+	seq     uint64
+	objects []backfill.Object
+	end     batchEnd
+}
+
+func newBatch(seq uint64, size int) *objectBatch {
+	return &objectBatch{
+		seq:     seq,
+		objects: make([]backfill.Object, 0, size),
+	}
+}
+
+func (b *objectBatch) add(listed listedObject) {
+	if len(b.objects) == 0 {
+		b.end.startAfter, b.end.retry = listed.after, listed.retry
+	}
+	b.objects = append(b.objects, listed.object)
+	b.end.source, b.end.key = listed.source, listed.object.Key
+	b.end.numFiles++
+	b.end.numBytes += uint64(listed.object.Size)
+}
+
+// returns true if the listed object is the one listed after the last object of the batch
+func (b *objectBatch) continues(listed listedObject) bool {
+	return !listed.rangeEnd && listed.source == b.end.source && listed.retry == b.end.retry && listed.after == b.end.key
+}
+
+// list the sources in order and send files to notifyChan until the limit is reached or ctx is done.
+// If start is not nil its failed ranges are listed again first, then the listing starts at its position.
+func listSources(ctx context.Context, sources []*Source, start *Checkpoint, limit Limit, sampler *Sampler,
+	failed *FailedKeys, notifyChan chan listedObject, stats *Stats) error {
+
+	defer func() {
+		close(notifyChan) // signal to reader that we are done
+	}()
+
+	taken := &limiter{Limit: limit, stats: stats}
+	if start != nil {
+		for i, failedRange := range start.Failed {
+			at := listPosition{source: failedRange.Source, after: failedRange.StartAfter, until: failedRange.Last, retry: i + 1}
+			if err := listPath(ctx, at, sources[at.source], taken, sampler, failed, notifyChan, stats); err != nil {
+				return err
 			}
-			sendMessageBatchInput.Entries = make([]*sqs.SendMessageBatchRequestEntry, 0, batchSize) // reset
+			if ctx.Err() != nil || limit.reached(stats) {
+				return nil
+			}
+			if !enqueue(ctx, notifyChan, listedObject{source: at.source, after: at.until, retry: at.retry, rangeEnd: true}, stats) {
+				return nil
+			}
+		}
+	}
+	for i, source := range sources {
+		if limit.reached(stats) {
+			return nil
+		}
+		at := listPosition{source: i}
+		if start != nil {
+			if i < start.Source {
+				continue // sent by the runs resumed
+			}
+			if i == start.Source {
+				at.after = start.StartAfter
+			}
+		}
+		if err := listPath(ctx, at, source, taken, sampler, failed, notifyChan, stats); err != nil {
+			return err
 		}
+		if ctx.Err() != nil {
+			return nil // stopped by a failed send or a cancel, the caller reports it
+		}
+	}
+	return nil
+}
+
+// list the files of a source from a position, up to its until key if set, and send to notifyChan until the limit is
+// reached or ctx is done
+func listPath(ctx context.Context, at listPosition, source *Source, limit *limiter, sampler *Sampler,
+	failed *FailedKeys, notifyChan chan listedObject, stats *Stats) error {
+
+	logger := lambdalogger.FromContext(ctx).With(zap.Stringer("path", source.Path))
+	logger.Debug("listing", zap.String("region", source.Region), zap.String("startAfter", at.after),
+		zap.String("until", at.until))
+	listInput := &backfill.ListInput{
+		Bucket:              source.Path.Bucket,
+		Prefix:              source.Path.Key,
+		StartAfter:          at.after,
+		Until:               at.until,
+		Delimiter:           source.Delimiter,
+		ExpectedBucketOwner: source.ExpectedBucketOwner,
+		Match: func(object *s3.Object) bool {
+			return source.selects(object, failed, stats, logger)
+		},
+	}
+	if source.RequesterPays {
+		listInput.RequestPayer = s3.RequestPayerRequester
+	}
+	if source.Shuffle {
+		listInput.Shuffle = rand.Shuffle // nolint: gosec
+	}
+	var sampleErr error
+	err := backfill.List(ctx, source.S3, listInput, func(object *s3.Object) bool {
+		var more bool
+		more, sampleErr = enqueueListed(ctx, &at, source, object, limit, sampler, notifyChan, stats)
+		return more
+	})
+	if sampleErr != nil {
+		return sampleErr
+	}
+	if err := source.Ingested.Err(); err != nil {
+		return err // the files after the error were not sent
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil // stopped by a failed send or a cancel, the caller reports it
 	}
+	return classifyList(err)
+}
 
-	// send remaining
-	if !failed && len(sendMessageBatchInput.Entries) > 0 {
-		_, err := sqsbatch.SendMessageBatch(sqsClient, batchTimeout, sendMessageBatchInput)
+// returns true if a listed file of the source is to be sent, the others are counted by why they are skipped.
+// The files that cannot be read without a restore are written to failed unless the source includes them.
+// The files with keys that cannot be sent are only logged, their keys would break the lines of failed.
+func (s *Source) selects(object *s3.Object, failed *FailedKeys, stats *Stats, logger *zap.Logger) bool {
+	if !s.matchSize(object) {
+		stats.NumSizeFiltered.Inc()
+		return false
+	}
+	if s.Match != nil && !s.Match(object) {
+		stats.NumSkipped.Inc()
+		return false
+	}
+	if !s.IncludeGlacier && isUnretrievable(object) {
+		stats.NumUnretrievable.Inc()
+		failed.Add(s.Path.Bucket, aws.StringValue(object.Key),
+			errors.Errorf("storage class %s cannot be read without a restore", aws.StringValue(object.StorageClass)))
+		return false
+	}
+	if err := backfill.ValidateKey(aws.StringValue(object.Key)); err != nil {
+		stats.NumInvalidKeys.Inc()
+		logger.Warn("skipping file", zap.String("bucket", s.Path.Bucket), zap.Error(err))
+		return false
+	}
+	if s.Ingested != nil && s.Ingested.Ingested(s.Path.Bucket, aws.StringValue(object.Key)) {
+		stats.NumIngested.Inc()
+		return false
+	}
+	if s.Partitions != nil && !s.Partitions.Take(s.Path.Bucket, aws.StringValue(object.Key)) {
+		stats.NumPartitionLimited.Inc()
+		return false
+	}
+	return true
+}
+
+// sends a selected file of the source to notifyChan if the limit allows, more is false once the listing must stop.
+// The records of the files share the bucket and region strings of the source, the position moves past the file sent.
+func enqueueListed(ctx context.Context, at *listPosition, source *Source, object *s3.Object, limit *limiter, sampler *Sampler,
+	notifyChan chan listedObject, stats *Stats) (more bool, err error) {
+
+	if !limit.take(uint64(*object.Size)) {
+		return false, nil
+	}
+	if sampler != nil {
+		if err := sampler.Sample(ctx, source.Path.Bucket, object); err != nil {
+			return false, err
+		}
+	}
+	record := backfill.NewObject(source.Path.Bucket, object)
+	record.Region = source.Region
+	if !enqueue(ctx, notifyChan, listedObject{object: record, source: at.source, after: at.after, retry: at.retry}, stats) {
+		return false, nil
+	}
+	at.after = record.Key
+	stats.NumFiles.Inc()
+	stats.NumBytes.Add(uint64(*object.Size))
+	return !limit.reached(stats), nil
+}
+
+// returns a work item posting a message per file as-if it was an S3 notification, the files are headed first if
+// verifier is not nil
+func queueNotifications(publisher *backfill.Publisher, verifier *Verifier, batch *objectBatch, reporter *progress.Reporter,
+	tracker *checkpointer, tolerance *errorTolerance, monitor *backpressure, writers *adaptiveConcurrency) workerpool.Func {
+
+	return func(ctx context.Context) error {
+		objects := batch.objects
+		if verifier != nil {
+			var err error
+			if objects, err = verifier.verify(ctx, objects, tolerance.stats); err != nil {
+				if err := tolerance.unverified(batch.objects, err); err != nil {
+					return classify(ErrVerify, err)
+				}
+				lambdalogger.FromContext(ctx).Warn("failed to verify a batch, going on", zap.Int("numFiles", len(batch.objects)), zap.Error(err))
+				tolerance.stats.NumFailedBatches.Inc()
+				tracker.Failed(ctx, batch.seq, batch.end)
+				return nil
+			}
+		}
+		err := writers.acquire(ctx) // waits while the sends are throttled
+		if err == nil {
+			start := time.Now()
+			err = publisher.PublishObjects(ctx, objects)
+			monitor.published(time.Since(start))
+			writers.release()
+		}
 		if err != nil {
-			errChan <- errors.Wrapf(err, "failed to send %#v", sendMessageBatchInput)
+			if err := tolerance.failed(objects, err); err != nil {
+				return classify(ErrPublish, err)
+			}
+			lambdalogger.FromContext(ctx).Warn("failed to send a batch, going on", zap.Int("numFiles", len(objects)), zap.Error(err))
+			tolerance.stats.NumFailedBatches.Inc()
+			tracker.Failed(ctx, batch.seq, batch.end) // a resumed run sends the keys of the batch again
+			return nil
 		}
+		tolerance.sent(len(objects))
+		tolerance.stats.NumSentFiles.Add(uint64(len(objects)))
+		reporter.Add(uint64(len(objects)))
+		tracker.Sent(ctx, batch.seq, batch.end)
+		return nil
 	}
 }
@@ -19,44 +19,155 @@ package main
  */
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sts"
+	jsoniter "github.com/json-iterator/go"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/backfillcost"
+	"github.com/panther-labs/panther/cmd/opstools/runlog"
 	"github.com/panther-labs/panther/cmd/opstools/s3queue"
+	"github.com/panther-labs/panther/cmd/opstools/sourcehealth"
+	"github.com/panther-labs/panther/cmd/opstools/sourcemap"
+	"github.com/panther-labs/panther/internal/core/source_api/apifunctions"
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
 	"github.com/panther-labs/panther/pkg/prompt"
+	"github.com/panther-labs/panther/pkg/s3path"
 )
 
 const (
 	banner = "lists s3 objects and posts s3 notifications to log processor queue"
+
+	checkpointInterval = 5 * time.Second
+	// processorConcurrency is the default -concurrency of the processor destination, every writer waits for an
+	// invocation of the log processor to process its batch
+	processorConcurrency = 5
+	metricsInterval      = time.Minute // how often the -progress-metrics are put
+
+	// the log processor of the cost estimate of -confirm, as the defaults of backfillcost
+	estimateObjectsPerInvocation = 10
+	estimateLambdaMemoryMB       = 1024
+	estimateMBPerSecond          = 10
 )
 
 var (
 	REGION      = flag.String("region", "", "The Panther AWS region (optional, defaults to session env vars) where the queue exists.")
 	ACCOUNT     = flag.String("account", "", "The Panther AWS account id (optional, defaults to session account)")
-	S3PATH      = flag.String("s3path", "", "The s3 path to list (e.g., s3://<bucket>/<prefix>).")
-	CONCURRENCY = flag.Int("concurrency", 50, "The number of concurrent sqs writer go routines")
+	S3PATH      = flag.String("s3path", "", "Comma separated s3 paths to list (e.g., s3://<bucket>/<prefix>) in any region.")
+	KEYS        = flag.String("keys", "", "Send the s3 paths of this file, s3 object or - (stdin) instead of listing -s3path")
+	INVENTORY   = flag.String("inventory", "", "List -s3path from the CSV S3 Inventory report of this manifest.json s3 path, not s3")
+	KEYSHEAD    = flag.Bool("keys.head", false, "Head the files of -keys for their size and modified time (implied by -after, -before)")
+	VERIFY      = flag.Bool("verify", false, "If true, head every file before it is sent and skip the files deleted since the listing")
+	CONCURRENCY = flag.Int("concurrency", 50, "The number of concurrent writer go routines (default 5 for the processor)")
+	ADAPTIVE    = flag.Bool("adaptive-concurrency", false, "If true, back off the writers while sends are throttled, up to -concurrency")
+	PACK        = flag.Int("records-per-message", 0, "If non-zero, pack up to this many files of the same log types into a notification")
+	COMPRESS    = flag.Int("compress-above", 0, "If non-zero, gzip the messages above this many bytes (sns or eventbridge subscribers only)")
+	NOTIFYBUF   = flag.Int("notify-buffer", 0, "If non-zero, the number of listed files queued for the writers (default 1000)")
+	MAXRATE     = flag.Float64("max-per-second", 0, "If non-zero, the max notifications sent per second by all the writers together")
+	MAXATTEMPTS = flag.Int("max-attempts", 0, "If non-zero, the max attempts of a throttled or failing send (default retry for a minute)")
+	MAXERRORS   = flag.String("error-threshold", "", "Stop once more than this many files (or percent, e.g. 1%) failed to send (default 0)")
 	LIMIT       = flag.Uint64("limit", 0, "If non-zero, then limit the number of files to this number.")
-	TOQ         = flag.String("queue", "panther-input-data-notifications-queue", "The name of the log processor queue to send notifications.")
+	PARTLIMIT   = flag.Int("limit-per-partition", 0, "If non-zero, send at most this many files per year=/month=/day=/hour= partition")
+	INGESTED    = flag.String("ingested", "", "Only send the listed files missing from this list of files already ingested (sorted)")
+	SHUFFLE     = flag.Bool("shuffle", false, "If true, send the files of every listed page in random order (not with -checkpoint)")
+	AFTER       = flag.String("after", "", "If set, skip files last modified before this time (RFC3339 or YYYY-MM-DD)")
+	BEFORE      = flag.String("before", "", "If set, skip files last modified at or after this time (RFC3339 or YYYY-MM-DD)")
+	TOQ         = flag.String("queue", "panther-input-data-notifications-queue", "The queue (name or URL in any region) to send to")
+	DESTINATION = flag.String("destination", backfill.DestinationSQS, "Send to: sqs, sns, eventbridge, lambda, processor or dry-run")
+	TARGET      = flag.String("target", "", "The topic (name, ARN or URL, several comma separated), event bus or function of the destination")
+	CANARY      = flag.Bool("canary", false, "If true, publish an s3:TestEvent to the sns -target before listing to check it is allowed")
+	FIFOGROUP   = flag.String("fifo.group", backfill.GroupByPrefix, "Group the files sent to a FIFO topic by prefix, bucket, table or log-type")
+	CHECKPOINT  = flag.String("checkpoint", "", "If set, save the position of the run to this local file as files are sent")
+	RESUME      = flag.Bool("resume", false, "Resume the run of -checkpoint after the files it sent, with the same -s3path")
+	DRYRUN      = flag.Bool("dry-run", false, "List and log the notifications with the log types of their files without sending them")
+	CONFIRM     = flag.Bool("confirm", false, "If true, list the files and print what the run would send and cost, then send if answered yes")
+	FORCE       = flag.Bool("force", false, "If true, send without waiting for a yes after the estimate of -confirm")
+	BOOKMARKS   = flag.String("bookmark-table", "", "If set, skip files already sent to the destination, bookmarked in this DynamoDB table")
+	BOOKMARKTTL = flag.Duration("bookmark-ttl", 30*24*time.Hour, "How long files are bookmarked if the table expires items at expiresAt")
+	RESETBOOKS  = flag.Bool("reset-bookmarks", false, "If true, delete the bookmarks of the destination before sending")
+	DEADLETTER  = flag.String("dead-letter", "", "If set, write the notifications the destination rejected to this local directory or s3 path")
+	REDRIVE     = flag.String("redrive-from", "", "Send the notifications of this -dead-letter directory or s3 path again, not listed files")
+	FAILEDOUT   = flag.String("failed-output", "", "If set, append the files that failed to this local file, a key list for -keys")
+	PROFILE     = flag.String("profile", s3queue.DefaultProfile, "How to send notifications for the subscribers of the destination: "+
+		strings.Join(s3queue.ProfileNames(), ", ")+" or a JSON profile file")
+	SIGNSECRET  = flag.String("sign-secret", "", "Sign notifications with the current key of this Secrets Manager secret (optional)")
+	ENDPOINT    = flag.String("endpoint", "", "Use this AWS endpoint for all services, e.g. http://localhost:4566 for LocalStack (optional)")
+	SAMPLE      = flag.Float64("sample", 0, "If non-zero, check this fraction of the files (e.g. 0.001) can be read before sending them")
+	SAMPLEROLE  = flag.String("sample.role", "", "The role to read the sampled files with, e.g. the log processing role (optional)")
+	SAMPLERATE  = flag.Float64("sample.maxfailures", 0.01, "Abort if more than this fraction of the sampled files fail")
+	SAMPLEMIN   = flag.Uint64("sample.min", 10, "The number of samples before the failure rate is checked")
+	SAMPLEWARN  = flag.Bool("sample.warn", false, "If true, warn instead of aborting when too many sampled files fail")
+	SAMPLEGZIP  = flag.Bool("sample.gzip", true, "If true, sampled files must be gzip compressed")
+	SAMPLEJSON  = flag.Bool("sample.json", true, "If true, the first line of sampled files must be JSON")
+	GLACIER     = flag.Bool("include-glacier", false, "If true, send the files in GLACIER or DEEP_ARCHIVE, e.g. if they were restored")
+	REQPAYS     = flag.Bool("requester-pays", false, "If true, list and read requester-pays buckets, billing the requests to the caller")
+	OWNER       = flag.String("expected-bucket-owner", "", "If set, refuse to list or read buckets not owned by this account id")
+	OWNACCOUNT  = flag.Bool("expected-bucket-owner.account", false, "If true, refuse to list or read buckets not owned by -account")
+	S3ROLE      = flag.String("s3-role-arn", "", "The role to list and read the buckets with, e.g. of a log archive account (optional)")
+	SNSROLE     = flag.String("sns-role-arn", "", "The role to publish to the sns -target with, e.g. of the Panther account (optional)")
+	LISTERS     = flag.Int("listers", 1, "If above 1, list the prefixes one level below -s3path with this many concurrent listers")
+	KEYSPACE    = flag.Int("keyspace", 0, "If non-zero, print -s3path shards balancing the files across this many runs and exit")
+	KEYSPACEMAX = flag.Int("keyspace.budget", 200, "The max number of list calls of -keyspace")
+	RUNID       = flag.String("run-id", "", "Identifies this run in logs, records, manifests, metrics and notifications (default a new ULID)")
+	MANIFEST    = flag.String("manifest", "", "If set, write a manifest of the run to this s3 path or local directory")
+	SUMMARY     = flag.String("json-summary", "", "If set, write the totals of the run as JSON to this local file or - (stdout)")
+	INTEGRATION = flag.String("integration", "", "If set, record the run in the back-fill history of the integration with this ID")
+	METRICS     = flag.Bool("metrics", false, "If true, put the totals of the run as CloudWatch metrics with a RunID dimension")
+	PROGMETRICS = flag.Bool("progress-metrics", false, "If true, put the progress of the run as CloudWatch metrics every minute")
+	SOURCESFILE = flag.String("sources-file", "", "Resolve log types with the sources of this JSON or YAML file, not the source API")
+	LOGTYPEAPI  = flag.Bool("log-type-fallback", false, "If true, resolve the files not in -log-type-map with the source API or -sources-file")
+	DUMPSOURCES = flag.String("dump-sources", "", "Write the sources of the source API to this file for -sources-file and exit")
+	DESCRIBE    = flag.String("describe-run", "", "Print what the run with this ID did, from its run record and -manifest, and exit")
 	INTERACTIVE = flag.Bool("interactive", true, "If true, prompt for required flags if not set")
 	VERBOSE     = flag.Bool("verbose", false, "Enable verbose logging")
 
-	logger *zap.SugaredLogger
+	INCLUDE    patternList
+	EXCLUDE    patternList
+	LIMITBYTES byteSize
+	MINSIZE    byteSize = 1 // empty files are never sent
+	MAXSIZE    byteSize
+	LOGTYPEMAP = s3queue.LogTypeMap{}
+
+	logger    *zap.SugaredLogger
+	filter    *backfill.Filter      // the last modified window of -after and -before, nil if neither is set
+	keyFilter *s3queue.KeyFilter    // the patterns of -include and -exclude, nil if there are none
+	match     func(*s3.Object) bool // selects the files of filter and keyFilter, nil if all are selected
+	failed    *s3queue.FailedKeys   // the files written to -failed-output, nil if it is not set
+	actor     string                // the ARN of the caller, resolved when the run is recorded in the history of an integration
+
+	logTypeSources []*sourcemap.Source     // the sources resolving log types, listed once by listSources
+	partitions     *s3queue.PartitionLimit // the cap of -limit-per-partition shared by the sources, nil if it is not set
+
+	fanOut   *backfill.FanOutDestination // the destination of the sns topics of -target if there are several
+	ingested *s3queue.IngestedKeys       // the files of -ingested, nil if it is not set
+
+	deadLetters *s3queue.DeadLetters // the notifications rejected by the destination, nil if -dead-letter is not set
 )
 
 func usage() {
@@ -68,6 +179,54 @@ func usage() {
 
 func init() {
 	flag.Usage = usage
+	flag.Var(&INCLUDE, "include", "Only send files with keys matching this pattern (repeatable), a glob matching the key "+
+		"or a parent prefix (e.g. logs/aws_cloudtrail/) or a regular expression prefixed with "+s3queue.RegexpPrefix)
+	flag.Var(&EXCLUDE, "exclude", "Skip files with keys matching this pattern (repeatable), as -include but excludes win")
+	flag.Var(&LIMITBYTES, "limit-bytes", "If non-zero, stop listing once the files reach this size (e.g. 50GB), with -limit the first reached")
+	flag.Var(&MINSIZE, "min-size", "Skip files smaller than this size (e.g. 1KB), at least 1 byte")
+	flag.Var(&MAXSIZE, "max-size", "If non-zero, skip files larger than this size (e.g. 100MB), e.g. the outputs of compactions")
+	flag.Var(LOGTYPEMAP, "log-type-map", "Resolve the log type of the files of a table of the data lake as table=LogType "+
+		"(repeatable) or with the pairs of this file, without the source API (see -log-type-fallback)")
+}
+
+// patternList is a repeatable flag
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *patternList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// byteSize is a flag of a size in bytes with an optional unit, e.g. 50GB. The units are powers of 1024.
+type byteSize uint64
+
+var byteUnits = []struct {
+	suffix string
+	size   uint64
+}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+func (s *byteSize) String() string {
+	return strconv.FormatUint(uint64(*s), 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	number, unit := strings.ToUpper(strings.TrimSpace(value)), uint64(1)
+	for _, byteUnit := range byteUnits {
+		if strings.HasSuffix(number, byteUnit.suffix) {
+			number, unit = strings.TrimSpace(strings.TrimSuffix(number, byteUnit.suffix)), byteUnit.size
+			break
+		}
+	}
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return errors.Errorf("%q is not a size, e.g. 50GB", value)
+	}
+	*s = byteSize(size * float64(unit))
+	return nil
 }
 
 func logInit() {
@@ -90,12 +249,19 @@ func logInit() {
 	logger = rawLogger.Sugar()
 }
 
+// every log line of a run has its ID
+func logRunID(runID string) {
+	rawLogger := zap.L().With(zap.String("runID", runID))
+	zap.ReplaceGlobals(rawLogger)
+	logger = rawLogger.Sugar()
+}
+
 func main() {
 	flag.Parse()
 
 	logInit() // must be done after parsing flags
 
-	sess, err := session.NewSession()
+	sess, err := opstools.NewSession()
 	if err != nil {
 		logger.Fatal(err)
 		return
@@ -106,12 +272,463 @@ func main() {
 	} else {
 		REGION = sess.Config.Region
 	}
+	if *ENDPOINT != "" {
+		sess.Config.Endpoint = ENDPOINT
+		sess.Config.S3ForcePathStyle = aws.Bool(true) // bucket host names do not resolve on local endpoints
+	}
+
+	if dumpSources(sess) {
+		return
+	}
+	if *DESCRIBE != "" {
+		describeRun(sess, *DESCRIBE)
+		return
+	}
 
 	promptFlags()
 	validateFlags()
+	runID, resume := resolveRunID()
+	logRunID(runID)
+
+	roles := assumeRoles(sess, runID)
+	sources := preflight(sess, roles)
+	if *KEYSPACE > 0 {
+		analyzeKeySpace(sources)
+		return
+	}
+
+	resolveAccount(sess)
+	failed = openFailedOutput()
+	profile := loadProfile(sess, roles)
+	destination, to := newDestination(sess, runID, profile, roles)
+	confirmRun(runID, sources, destination, profile, to)
+	stats := s3queue.NewStats()
+	dryRun := newDryRun(sess, profile, destination, to, stats)
+	if dryRun != nil {
+		destination = dryRun
+	}
+	destination = withBookmarks(sess, withDeadLetters(sess, destination, runID), to, runID, dryRun != nil, stats)
+
+	startTime := time.Now()
+	logPlan(sources, to)
+
+	checkpointing := newCheckpointing(runID, sources, resume)
+	sampler := newSampler(sess, roles)
+	run := opstools.StartRunWithID(sess, logger, runID)
+	recordHistory(sess, &s3queue.Manifest{RunID: runID, StartTime: startTime.UTC(), Sources: s3queue.NewManifestSources(sources)})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		caught := <-sig // wait for it
+		logger.Warnf("caught %v, stopping the listing and waiting for the listed files to be sent", caught)
+		cancel()
+		caught = <-sig
+		logger.Fatalf("caught %v again, exiting without waiting, the last checkpoint may be behind", caught)
+	}()
+
+	stopMetrics := startProgressMetrics(sess, runID, to, stats)
+	err = send(ctx, sess, roles, runID, sources, destination, profile, sampler, checkpointing, stats)
+	stopMetrics()
+	snapshot := stats.Snapshot().WithRates(nil)
+	opstools.EndRun(run, logger, snapshot, err)
+	if *VERBOSE {
+		if data, err := jsoniter.MarshalToString(snapshot); err == nil {
+			logger.Infof("stats: %s", data)
+		}
+	}
+	logSampleResult(sampler)
+	manifest := &s3queue.Manifest{
+		RunID:         runID,
+		StartTime:     startTime.UTC(),
+		EndTime:       time.Now().UTC(),
+		Sources:       s3queue.NewManifestSources(sources),
+		Keys:          *KEYS,
+		Destination:   to,
+		Profile:       profile.Name,
+		Limit:         *LIMIT,
+		LimitBytes:    uint64(LIMITBYTES),
+		LimitReached:  stats.LimitReached(),
+		Filter:        filter,
+		Include:       INCLUDE,
+		Exclude:       EXCLUDE,
+		Stats:         snapshot,
+		LogTypes:      stats.LogTypes.Counts(),
+		RequesterPays: *REQPAYS,
+	}
+	recordRun(sess, manifest, sampler, err)
+	logResult(manifest, dryRun, err)
+}
+
+// puts the progress of the run as CloudWatch metrics if -progress-metrics is set, until stop is called
+func startProgressMetrics(sess *session.Session, runID, to string, stats *s3queue.Stats) (stop func()) {
+	if !*PROGMETRICS {
+		return func() {}
+	}
+	metrics := &s3queue.ProgressMetrics{
+		CloudWatch: cloudwatch.New(sess),
+		Topic:      to[strings.LastIndexAny(to, " :")+1:], // the name of the topic or queue
+		RunID:      runID,
+		Stats:      stats,
+	}
+	logger.Infof("putting the progress of the run in the CloudWatch namespace %s every %v", s3queue.ProgressNamespace, metricsInterval)
+	return metrics.Start(metricsInterval)
+}
+
+// lists the sources without sending anything if -confirm is set, prints the files the run would send and what they
+// would cost, and exits unless the answer is yes or -force is set
+func confirmRun(runID string, sources []*s3queue.Source, destination backfill.Destination, profile *s3queue.Profile,
+	to string) {
+
+	if !*CONFIRM || *DRYRUN {
+		return
+	}
+	if !*INTERACTIVE && !*FORCE {
+		logger.Fatal("-confirm needs -interactive to answer or -force")
+	}
+	logger.Infof("listing the files to send to %s before sending them, see -confirm", to)
+	stats := s3queue.NewStats()
+	limit := s3queue.Limit{Files: *LIMIT, Bytes: uint64(LIMITBYTES)}
+	listing, err := s3queue.EstimateRun(context.Background(), runID, sources, destination, profile, limit, stats)
+	if err != nil {
+		logger.Fatalf("failed to list the files to confirm: %s", err)
+	}
+	estimate, err := backfillcost.NewEstimate(&backfillcost.Input{
+		Listing:              *listing,
+		SNS:                  *DESTINATION == backfill.DestinationSNS,
+		ObjectsPerInvocation: estimateObjectsPerInvocation,
+		LambdaMemoryMB:       estimateLambdaMemoryMB,
+		MBPerSecond:          estimateMBPerSecond,
+	}, &backfillcost.DefaultPrices)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	snapshot := stats.Snapshot()
+	// stderr, not to mix with the -json-summary written to stdout
+	fmt.Fprintf(os.Stderr, "The run would send %d files (%.2fMB) in %d notifications of %d batches to %s\n",
+		listing.NumObjects, float32(listing.NumBytes)/(1024.0*1024.0), snapshot.Counter("numSent"),
+		snapshot.Counter("numSentBatches"), to)
+	fmt.Fprintln(os.Stderr, "Estimated cost, with the log processor reading the files:")
+	if err := estimate.Print(os.Stderr); err != nil {
+		logger.Fatal(err)
+	}
+	if *FORCE {
+		logger.Info("sending without confirmation, see -force")
+		return
+	}
+	if answer := prompt.Read("Type yes to send them: "); answer != "yes" {
+		logger.Fatalf("not confirmed (%q), nothing was sent", answer)
+	}
+}
 
-	s3Region := getS3Region(sess, *S3PATH)
+// sends the files of -keys or lists the sources, from -inventory if set, or sends the dead letters of -redrive-from
+func send(ctx context.Context, sess *session.Session, roles *s3queue.RunRoles, runID string, sources []*s3queue.Source,
+	destination backfill.Destination, profile *s3queue.Profile, sampler *s3queue.Sampler,
+	checkpointing *s3queue.Checkpointing, stats *s3queue.Stats) error {
 
+	if *REDRIVE != "" {
+		return redrive(ctx, sess, destination, profile, stats)
+	}
+	limit := s3queue.Limit{Files: *LIMIT, Bytes: uint64(LIMITBYTES)}
+	if *KEYS == "" && *LISTERS > 1 {
+		return s3queue.S3QueueSharded(ctx, runID, sources, *LISTERS, destination, profile, *CONCURRENCY, limit, sampler, failed,
+			stats)
+	}
+	if *INVENTORY != "" {
+		inventory, err := newInventory(sess, roles)
+		if err != nil {
+			return err
+		}
+		return s3queue.S3QueueInventory(ctx, runID, inventory, sources, destination, profile, *CONCURRENCY, limit, sampler,
+			failed, stats)
+	}
+	if *KEYS == "" {
+		return s3queue.S3QueueTo(ctx, runID, sources, destination, profile, *CONCURRENCY, limit, sampler, checkpointing, failed,
+			stats)
+	}
+	clients := newS3Clients(sess, roles)
+	reader, err := s3queue.OpenKeyList(clients, *KEYS)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	keys := &s3queue.KeyList{
+		Reader:     reader,
+		Clients:    clients,
+		Head:       *KEYSHEAD,
+		Keys:       keyFilter,
+		Filter:     filter,
+		Partitions: partitions,
+	}
+	return s3queue.S3QueueKeys(ctx, runID, keys, destination, profile, *CONCURRENCY, limit, failed, stats)
+}
+
+// sends the dead letters of -redrive-from again
+func redrive(ctx context.Context, sess *session.Session, destination backfill.Destination, profile *s3queue.Profile,
+	stats *s3queue.Stats) error {
+
+	location, err := s3queue.NewManifestLocation(sess, *REDRIVE)
+	if err != nil {
+		return err
+	}
+	return s3queue.Redrive(ctx, location, destination, profile, stats)
+}
+
+// returns the destination keeping the notifications it rejects in -dead-letter, the destination if it is not set
+func withDeadLetters(sess *session.Session, destination backfill.Destination, runID string) backfill.Destination {
+	if *DEADLETTER == "" || *DRYRUN {
+		return destination
+	}
+	location, err := s3queue.NewManifestLocation(sess, *DEADLETTER)
+	if err != nil {
+		logger.Fatalf("invalid -dead-letter: %s", err)
+	}
+	deadLetters = &s3queue.DeadLetters{Destination: destination, Location: location, RunID: runID}
+	return deadLetters
+}
+
+// returns the destination skipping the files already sent to it with -bookmark-table, the destination if it is not
+// set. The bookmarks of the destination are deleted first with -reset-bookmarks.
+func withBookmarks(sess *session.Session, destination backfill.Destination, to, runID string, dryRun bool,
+	stats *s3queue.Stats) backfill.Destination {
+
+	if *BOOKMARKS == "" {
+		return destination
+	}
+	bookmarks := &s3queue.Bookmarks{
+		Destination: destination,
+		DB:          dynamodb.New(sess),
+		TableName:   *BOOKMARKS,
+		Scope:       to,
+		RunID:       runID,
+		TTL:         *BOOKMARKTTL,
+		DryRun:      dryRun,
+		NumSkipped:  stats.NumBookmarked,
+	}
+	if !*RESETBOOKS {
+		return bookmarks
+	}
+	if dryRun {
+		logger.Infof("dry run, not deleting the bookmarks of %s, sending as if they were", to)
+		return destination
+	}
+	numDeleted, err := bookmarks.Reset(context.Background())
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.Infof("deleted %d bookmarks of %s from %s", numDeleted, to, *BOOKMARKS)
+	return bookmarks
+}
+
+// returns the report of -inventory, read with a client in the region of its bucket
+func newInventory(sess *session.Session, roles *s3queue.RunRoles) (*s3queue.Inventory, error) {
+	manifest, err := s3path.Parse(*INVENTORY)
+	if err != nil {
+		return nil, err
+	}
+	client, _, err := newS3Clients(sess, roles).ForBucket(manifest.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	return &s3queue.Inventory{
+		Manifest:            manifest,
+		S3:                  client,
+		RequireLastModified: filter != nil,
+	}, nil
+}
+
+// logs the totals of a run, exiting if it failed
+func logResult(manifest *s3queue.Manifest, dryRun *s3queue.DryRun, err error) {
+	logUnresolved(dryRun)
+	logLogTypes(manifest.LogTypes)
+	logFailed()
+	snapshot, to, elapsed := manifest.Stats, manifest.Destination, manifest.EndTime.Sub(manifest.StartTime)
+	numFiles, numMB := snapshot.Counter("numFiles"), float32(snapshot.Counter("numBytes"))/(1024.0*1024.0)
+	numSent, numFailed := snapshot.Counter("numSentFiles"), snapshot.Counter("numFailedFiles") // of the files listed
+	if manifest.LimitReached != "" {
+		logger.Infof("stopped listing at the limit of %s, the files after it were not sent", manifest.LimitReached)
+	}
+	if numSkipped := snapshot.Counter("numSkipped"); numSkipped > 0 {
+		logger.Infof("skipped %d files not selected by -after, -before, -include or -exclude", numSkipped)
+	}
+	if numSizeFiltered := snapshot.Counter("numSizeFiltered"); numSizeFiltered > 0 {
+		logger.Infof("skipped %d empty files or files outside -min-size and -max-size", numSizeFiltered)
+	}
+	if numUnretrievable := snapshot.Counter("numUnretrievable"); numUnretrievable > 0 {
+		logger.Warnf("skipped %d files in GLACIER or DEEP_ARCHIVE, restore them and use -include-glacier to send them",
+			numUnretrievable)
+	}
+	if numBookmarked := snapshot.Counter("numBookmarked"); numBookmarked > 0 {
+		logger.Infof("skipped %d files already sent to %s, see -bookmark-table", numBookmarked, to)
+	}
+	if numLimited := snapshot.Counter("numPartitionLimited"); numLimited > 0 {
+		logger.Infof("skipped %d files beyond -limit-per-partition %d", numLimited, *PARTLIMIT)
+	}
+	if numMissing := snapshot.Counter("numVerifyMissing"); numMissing > 0 {
+		logger.Infof("skipped %d files deleted since they were listed, see -verify", numMissing)
+	}
+	if numUnverified := snapshot.Counter("numVerifyFailed"); numUnverified > 0 {
+		logger.Warnf("%d files were not sent as they could not be verified, see -verify", numUnverified)
+	}
+	if minConcurrency := snapshot.Gauge("minConcurrency"); minConcurrency > 0 && minConcurrency < int64(*CONCURRENCY) {
+		logger.Infof("backed off to %d writers as sends were throttled, ending at %d of -concurrency %d",
+			minConcurrency, snapshot.Gauge("concurrency"), *CONCURRENCY)
+	}
+	logIngested(snapshot.Counter("numIngested"), err == nil && manifest.LimitReached == "")
+	logFanOut()
+	logDeadLetters()
+	if numInvalidKeys := snapshot.Counter("numInvalidKeys"); numInvalidKeys > 0 {
+		logger.Warnf("skipped %d files with control characters in their keys, see the warnings above", numInvalidKeys)
+	}
+	switch {
+	case errors.Is(err, s3queue.ErrCanceled):
+		logger.Fatalf("canceled after sending %d of the %d files listed (%.2fMB) to %s in %v%s",
+			numSent, numFiles, numMB, to, elapsed, resumeHint())
+	case err != nil:
+		logger.Fatalf("%s, sent %d and failed to send %d of the %d files listed (%.2fMB) for %s in %v%s",
+			err, numSent, numFailed, numFiles, numMB, to, elapsed, requesterPaysHint(err))
+	case dryRun != nil:
+		logger.Infof("dry run, would have sent %d files (%.2fMB) to %s (%s), listed in %v",
+			numFiles, numMB, to, *REGION, elapsed)
+	default:
+		logger.Infof("sent %d of the %d files listed (%.2fMB) to %s (%s) in %v with %d retries of %d batches",
+			numSent, numFiles, numMB, to, *REGION, elapsed, snapshot.Counter("numRetries"), snapshot.Counter("numRetriedBatches"))
+	}
+}
+
+// logs how the listing compared with -ingested, the files of the list after the last listed file are only counted if
+// the listing completed
+func logIngested(numIngested uint64, complete bool) {
+	if ingested == nil {
+		return
+	}
+	if complete {
+		if err := ingested.Finish(); err != nil {
+			logger.Warnf("failed to read the rest of -ingested: %s", err)
+		}
+	}
+	numMissing, numExtra := ingested.Counts()
+	logger.Infof("compared the files with -ingested: %d already ingested were skipped, %d missing were sent, "+
+		"%d ingested were not listed", numIngested, numMissing, numExtra)
+}
+
+// opens the list of -ingested, in a local file, an s3 path or stdin
+func openIngested(clients *s3queue.S3Clients) *s3queue.IngestedKeys {
+	reader, err := s3queue.OpenKeyList(clients, *INGESTED)
+	if err != nil {
+		logger.Fatalf("failed to open -ingested: %s", err)
+	}
+	return s3queue.NewIngestedKeys(reader) // read until the run exits
+}
+
+// logs the notifications written to -dead-letter
+func logDeadLetters() {
+	if deadLetters == nil {
+		return
+	}
+	if numDeadLetters := deadLetters.Count(); numDeadLetters > 0 {
+		logger.Warnf("wrote %d notifications rejected by the destination to %s, send them again with -redrive-from",
+			numDeadLetters, *DEADLETTER)
+	}
+}
+
+// logs what the run is about to do if -verbose
+func logPlan(sources []*s3queue.Source, to string) {
+	if !*VERBOSE {
+		return
+	}
+	for _, source := range sources {
+		logger.Infof("sending files from %s in %s to %s in %s", source.Path, source.Region, to, *REGION)
+	}
+	if *LIMIT > 0 {
+		logger.Infof("sending at most %d files", *LIMIT)
+	}
+	if LIMITBYTES > 0 {
+		logger.Infof("sending files until they reach %.2fMB", float32(LIMITBYTES)/(1024.0*1024.0))
+	}
+}
+
+// resolves the region of every bucket before sending anything, the sources only match the files selected by the flags
+func preflight(sess *session.Session, roles *s3queue.RunRoles) []*s3queue.Source {
+	clients := newS3Clients(sess, roles)
+	sources, err := clients.Preflight(splitPaths(*S3PATH))
+	if err != nil {
+		logger.Fatalf("failed to resolve the s3 paths: %s", err)
+	}
+	if *INGESTED != "" {
+		ingested = openIngested(clients)
+		s3queue.SortSources(sources) // in the order of the list
+	}
+	if *PARTLIMIT > 0 {
+		partitions = &s3queue.PartitionLimit{PerPartition: *PARTLIMIT}
+	}
+	for _, source := range sources {
+		source.Match = match
+		source.IncludeGlacier = *GLACIER
+		source.MinSize, source.MaxSize = uint64(MINSIZE), uint64(MAXSIZE)
+		source.Partitions, source.Shuffle, source.Ingested = partitions, *SHUFFLE, ingested
+	}
+	return sources
+}
+
+// returns nil unless -failed-output. The file is appended so the failures of resumed runs add up, it is written
+// unbuffered so it has every failure even if the run is killed.
+func openFailedOutput() *s3queue.FailedKeys {
+	if *FAILEDOUT == "" {
+		return nil
+	}
+	file, err := os.OpenFile(*FAILEDOUT, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		logger.Fatalf("failed to open -failed-output: %s", err)
+	}
+	return s3queue.NewFailedKeys(file)
+}
+
+// logs the files written to -failed-output and how to re-drive them
+func logFailed() {
+	numFailed, err := failed.Result()
+	if err != nil {
+		logger.Errorf("-failed-output %s is incomplete: %s", *FAILEDOUT, err)
+	}
+	if numFailed > 0 {
+		logger.Warnf("wrote %d failed files to %s, re-drive them with -keys %s", numFailed, *FAILEDOUT, *FAILEDOUT)
+	}
+}
+
+// returns how to resume the run if it is checkpointed
+func resumeHint() string {
+	if *CHECKPOINT == "" || *DRYRUN {
+		return ""
+	}
+	return fmt.Sprintf(", continue with -resume -checkpoint %s", *CHECKPOINT)
+}
+
+// suggests -requester-pays if s3 denied access, requester-pays buckets deny the requests not billed to the caller
+func requesterPaysHint(err error) string {
+	if *REQPAYS || !errors.Is(err, s3queue.ErrListAccessDenied) {
+		return ""
+	}
+	return ", if the bucket is requester-pays retry with -requester-pays"
+}
+
+// returns the clients of the session, with the credentials of -s3-role-arn if set. With -requester-pays they list and
+// read requester-pays buckets and with -expected-bucket-owner they refuse the buckets of other accounts.
+func newS3Clients(sess *session.Session, roles *s3queue.RunRoles, configs ...*aws.Config) *s3queue.S3Clients {
+	if roles.S3 != nil {
+		configs = append([]*aws.Config{{Credentials: roles.S3}}, configs...) // e.g. -sample.role wins
+	}
+	clients := s3queue.NewS3Clients(sess, configs...)
+	clients.RequesterPays = *REQPAYS
+	clients.ExpectedBucketOwner = *OWNER
+	if *OWNACCOUNT {
+		clients.ExpectedBucketOwner = resolveAccount(sess)
+	}
+	return clients
+}
+
+// sets -account to the account of the caller if not set, and returns it
+func resolveAccount(sess *session.Session) string {
 	if *ACCOUNT == "" {
 		identity, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
 		if err != nil {
@@ -119,33 +736,514 @@ func main() {
 		}
 		ACCOUNT = identity.Account
 	}
+	return *ACCOUNT
+}
 
-	startTime := time.Now()
-	if *VERBOSE {
-		if *LIMIT > 0 {
-			logger.Infof("sending %d files from %s in %s to %s in %s",
-				LIMIT, *S3PATH, s3Region, *TOQ, *REGION)
+// returns the credentials of -s3-role-arn and -sns-role-arn, nil for the roles not set. The roles are assumed before
+// the run starts and the assumed identities are logged for audits.
+func assumeRoles(sess *session.Session, runID string) *s3queue.RunRoles {
+	roles := s3queue.AssumeRunRoles(sts.New(sess), *S3ROLE, *SNSROLE, runID)
+	checkRole(sess, *S3ROLE, roles.S3)
+	checkRole(sess, *SNSROLE, roles.SNS)
+	return roles
+}
+
+// exits unless the credentials of a role can be used, nothing is checked if they are nil
+func checkRole(sess *session.Session, roleARN string, creds *credentials.Credentials) {
+	if creds == nil {
+		return
+	}
+	identity, err := sts.New(sess, &aws.Config{Credentials: creds}).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		logger.Fatalf("failed to assume %s: %v", roleARN, err)
+	}
+	logger.Infof("assumed %s as %s", roleARN, aws.StringValue(identity.Arn))
+}
+
+// returns the ID of the run and the checkpoint to resume it from, nil unless -resume
+func resolveRunID() (string, *s3queue.Checkpoint) {
+	if !*RESUME {
+		if *RUNID != "" {
+			return *RUNID, nil
+		}
+		return backfill.NewRunID(), nil
+	}
+	checkpoint, err := s3queue.FileCheckpoint(*CHECKPOINT).Load()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if *RUNID != "" && *RUNID != checkpoint.RunID {
+		logger.Fatalf("-checkpoint is of run %s, not -run-id %s", checkpoint.RunID, *RUNID)
+	}
+	if checkpoint.Complete {
+		logger.Infof("run %s is complete, it sent %d files", checkpoint.RunID, checkpoint.NumFiles)
+		os.Exit(0)
+	}
+	return checkpoint.RunID, checkpoint
+}
+
+// returns nil unless -checkpoint. Dry runs start at the checkpoint but do not move it.
+func newCheckpointing(runID string, sources []*s3queue.Source, resume *s3queue.Checkpoint) *s3queue.Checkpointing {
+	if *CHECKPOINT == "" {
+		return nil
+	}
+	store := s3queue.FileCheckpoint(*CHECKPOINT)
+	checkpointing := &s3queue.Checkpointing{
+		Store:      store,
+		Interval:   checkpointInterval,
+		Checkpoint: s3queue.NewCheckpoint(runID, sources),
+	}
+	if resume != nil {
+		if err := resume.Validate(sources); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Infof("resuming after s3://%s/%s, %d files were sent, %d failed ranges are sent again",
+			sources[resume.Source].Path.Bucket, resume.StartAfter, resume.NumFiles, len(resume.Failed))
+		checkpointing.Checkpoint = resume
+	} else if previous, err := store.Load(); err == nil && !previous.Complete {
+		logger.Fatalf("-checkpoint %s is of the incomplete run %s, -resume it or remove the file", *CHECKPOINT, previous.RunID)
+	}
+	if *DRYRUN {
+		checkpointing.Store = discardCheckpoints{}
+	}
+	return checkpointing
+}
+
+type discardCheckpoints struct{}
+
+func (discardCheckpoints) Save(context.Context, *s3queue.Checkpoint) error {
+	return nil
+}
+
+// returns nil unless -dry-run, the dry run stands for the destination and the sources resolve the log types of the files
+func newDryRun(sess *session.Session, profile *s3queue.Profile, destination backfill.Destination, to string,
+	stats *s3queue.Stats) *s3queue.DryRun {
+
+	if !*DRYRUN {
+		return nil
+	}
+	profile.MaxSendsPerSecond, profile.MaxNotificationsPerSecond = 0, 0 // nothing is sent
+	sources := listSources(sess)
+	return &s3queue.DryRun{
+		Destination: destination,
+		Target:      to,
+		Tables:      LOGTYPEMAP,
+		Sources:     sources,
+		Failed:      failed,
+		LogTypes:    stats.LogTypes,
+	}
+}
+
+// writes the summary of the run to -json-summary if set
+func writeSummary(summary *s3queue.Summary) {
+	if *SUMMARY == "" {
+		return
+	}
+	data, err := jsoniter.Marshal(summary)
+	if err != nil {
+		logger.Errorf("failed to marshal the summary of the run: %s", err)
+		return
+	}
+	data = append(data, '\n')
+	if *SUMMARY == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = ioutil.WriteFile(*SUMMARY, data, 0600)
+	}
+	if err != nil {
+		logger.Errorf("failed to write the summary of the run to %s: %s", *SUMMARY, err)
+	}
+}
+
+// logs the files and bytes of every log type resolved by a dry run, the log types with the most files first
+func logLogTypes(counts []s3queue.LogTypeCount) {
+	if len(counts) == 0 {
+		return
+	}
+	logger.Infof("%-40s %12s %12s", "log type", "files", "MB")
+	for _, count := range counts {
+		logger.Infof("%-40s %12d %12.2f", count.LogType, count.NumFiles, float32(count.NumBytes)/(1024.0*1024.0))
+	}
+}
+
+// warns of the files of a dry run no source reads, their log types cannot be resolved
+func logUnresolved(dryRun *s3queue.DryRun) {
+	if dryRun == nil {
+		return
+	}
+	numUnresolved, prefixes := dryRun.Unresolved()
+	if numUnresolved == 0 {
+		return
+	}
+	logger.Warnf("%d files are not read by any source, their log type cannot be resolved", numUnresolved)
+	for _, prefix := range prefixes {
+		logger.Warnf("s3://%s/%s has %d files without log type, e.g. %s",
+			prefix.Bucket, prefix.Prefix, prefix.NumFiles, prefix.Example)
+	}
+}
+
+// logs the failures of every topic of -target, if there are several
+func logFanOut() {
+	if fanOut == nil {
+		return
+	}
+	for target, numFailed := range fanOut.Failures() {
+		if numFailed > 0 {
+			logger.Warnf("%d notifications failed to send to %s, counting every retry", numFailed, target)
+		}
+	}
+}
+
+func logSampleResult(sampler *s3queue.Sampler) {
+	if sampler == nil {
+		return
+	}
+	result := sampler.Result()
+	logger.Infof("sampled %d files, %d failed (%.2f%%), %d inconclusive",
+		result.NumSampled, result.NumFailed, 100*result.FailureRate(), result.NumInconclusive)
+	for _, failure := range result.Failures {
+		logger.Warnf("sample s3://%s/%s failed: %s %s", failure.Bucket, failure.Key, failure.Reason, failure.Error)
+	}
+}
+
+// writes the manifest and the summary and puts the metrics of a run if enabled, failures are logged
+func recordRun(sess *session.Session, manifest *s3queue.Manifest, sampler *s3queue.Sampler, runErr error) {
+	ctx := context.Background()
+	if deadLetters != nil {
+		if err := deadLetters.Close(ctx); err != nil {
+			logger.Errorf("failed to write the dead letters of the run: %s", err)
+		}
+	}
+	if sampler != nil {
+		result := sampler.Result()
+		manifest.Sample = &result
+	}
+	if runErr != nil {
+		manifest.Error = runErr.Error()
+	}
+	recordHistory(sess, manifest)
+	writeSummary(s3queue.NewSummary(manifest, runErr))
+	if *MANIFEST != "" {
+		location, err := s3queue.NewManifestLocation(sess, *MANIFEST)
+		if err == nil {
+			err = location.Write(ctx, manifest)
+		}
+		if err != nil {
+			logger.Errorf("failed to write the manifest of the run: %s", err)
+		}
+	}
+	if *METRICS {
+		if err := s3queue.PutRunMetrics(ctx, cloudwatch.New(sess), manifest.RunID, manifest.Stats); err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// adds or updates the record of the run in the back-fill history of the integration, if set.
+// Read-only and dry runs send nothing, they are not recorded.
+func recordHistory(sess *session.Session, manifest *s3queue.Manifest) {
+	if *INTEGRATION == "" || opstools.ReadOnly() || *DRYRUN {
+		return
+	}
+	if actor == "" {
+		identity, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		if err != nil {
+			logger.Warnf("failed to get caller identity: %s", err)
 		} else {
-			logger.Infof("sending files from %s in %s to %s in %s",
-				*S3PATH, s3Region, *TOQ, *REGION)
+			actor = aws.StringValue(identity.Arn)
 		}
 	}
+	record := s3queue.NewBackfillRecord(manifest, actor)
+	if err := apifunctions.RecordBackfill(context.Background(), lambda.New(sess), *INTEGRATION, record); err != nil {
+		logger.Warnf("failed to record the run in the backfill history of %s: %s", *INTEGRATION, err)
+	}
+}
 
-	stats := &s3queue.Stats{}
-	go func() {
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
-		caught := <-sig // wait for it
-		logger.Fatalf("caught %v, sent %d files (%.2fMB) to %s in %v",
-			caught, stats.NumFiles, float32(stats.NumBytes)/(1024.0*1024.0), *TOQ, time.Since(startTime))
-	}()
+// prints the run record and manifest of a run as JSON
+func describeRun(sess *session.Session, runID string) {
+	ctx := context.Background()
+	// runs are recorded when they start, a ULID has the start time
+	since := time.Now().Add(-90 * 24 * time.Hour)
+	if startTime, ok := backfill.RunIDTime(runID); ok {
+		since = startTime.Add(-time.Minute)
+	}
+	description := struct {
+		Run      *runlog.Record    `json:"run"`
+		Manifest *s3queue.Manifest `json:"manifest,omitempty"`
+	}{}
+	var err error
+	if description.Run, err = opstools.FindRun(ctx, sess, runID, since); err != nil {
+		logger.Fatalf("failed to find the record of run %s: %s", runID, err)
+	}
+	if *MANIFEST != "" {
+		location, err := s3queue.NewManifestLocation(sess, *MANIFEST)
+		if err == nil {
+			description.Manifest, err = location.Read(ctx, runID)
+		}
+		if err != nil {
+			logger.Fatalf("failed to read the manifest of run %s: %s", runID, err)
+		}
+	}
+	if description.Run == nil && description.Manifest == nil {
+		logger.Fatalf("run %s not found since %s", runID, since.Format(time.RFC3339))
+	}
+	encoder := jsoniter.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(&description); err != nil {
+		logger.Fatal(err)
+	}
+}
+
+// prints the shards of the sources for -keyspace runs
+func analyzeKeySpace(sources []*s3queue.Source) {
+	keySpace, err := s3queue.AnalyzeKeySpace(context.Background(), sources, s3queue.KeySpaceOptions{
+		Listers:      *KEYSPACE,
+		MaxListCalls: *KEYSPACEMAX,
+	})
+	if err != nil {
+		logger.Fatalf("%s%s", err, requesterPaysHint(err))
+	}
+	if err := keySpace.Print(os.Stdout); err != nil {
+		logger.Fatal(err)
+	}
+}
 
-	err = s3queue.S3Queue(sess, *ACCOUNT, *S3PATH, s3Region, *TOQ, *CONCURRENCY, *LIMIT, stats)
+func loadProfile(sess *session.Session, roles *s3queue.RunRoles) *s3queue.Profile {
+	profile, err := s3queue.LoadProfile(*PROFILE)
 	if err != nil {
 		logger.Fatal(err)
-	} else {
-		logger.Infof("sent %d files (%.2fMB) to %s (%s) in %v",
-			stats.NumFiles, float32(stats.NumBytes)/(1024.0*1024.0), *TOQ, *REGION, time.Since(startTime))
+	}
+	if profile.Name != s3queue.DefaultProfile {
+		logger.Infof("using the %s profile: %s", profile.Name, profile.Description)
+	}
+	if *SIGNSECRET != "" {
+		profile.SigningSecret = *SIGNSECRET
+	}
+	if *MAXRATE > 0 {
+		profile.MaxNotificationsPerSecond = *MAXRATE
+	}
+	if *MAXATTEMPTS > 0 {
+		profile.MaxSendAttempts = *MAXATTEMPTS
+	}
+	if *NOTIFYBUF > 0 {
+		profile.NotifyBuffer = *NOTIFYBUF
+	}
+	if *PACK > 0 {
+		// the log types resolve the sources reading the files, a notification is only read by one of them
+		profile.PackRecords, profile.PackGroup = *PACK, s3queue.LogTypesGroup(LOGTYPEMAP, listSources(sess))
+	}
+	if *COMPRESS > 0 {
+		profile.CompressAbove = *COMPRESS
+		if err := profile.Validate(); err != nil {
+			logger.Fatalf("invalid -compress-above: %s", err)
+		}
+	}
+	if *ADAPTIVE {
+		profile.AdaptiveConcurrency = true
+	}
+	if *VERIFY {
+		profile.Verifier = &s3queue.Verifier{Clients: newS3Clients(sess, roles)}
+	}
+	if *MAXERRORS != "" {
+		threshold, err := s3queue.ParseErrorThreshold(*MAXERRORS)
+		if err != nil {
+			logger.Fatalf("invalid -error-threshold: %s", err)
+		}
+		profile.ErrorThreshold = &threshold
+	}
+	if err := profile.LoadSigner(secretsmanager.New(sess)); err != nil {
+		logger.Fatal(err)
+	}
+	if profile.SigningSecret != "" {
+		logger.Infof("signing notifications with the current key of %s", profile.SigningSecret)
+	}
+	return profile
+}
+
+// returns the destination of the flags and a description of it for logging
+func newDestination(sess *session.Session, runID string, profile *s3queue.Profile, roles *s3queue.RunRoles) (
+	backfill.Destination, string) {
+
+	if err := profile.ValidateDestination(*DESTINATION); err != nil {
+		logger.Fatalf("invalid -destination: %s", err)
+	}
+	targets, destinationSess := []string{*TARGET}, sess
+	switch *DESTINATION {
+	case backfill.DestinationSQS:
+		targets = []string{*TOQ}
+	case backfill.DestinationSNS:
+		if roles.SNS != nil {
+			destinationSess = sess.Copy(&aws.Config{Credentials: roles.SNS})
+		}
+		targets = strings.Split(*TARGET, ",") // e.g. the input topics of two deployments during a migration
+		for i, target := range targets {
+			targets[i] = opstools.MustResolveTopicARN(destinationSess, logger, "target", strings.TrimSpace(target), *ACCOUNT)
+			checkTopic(destinationSess, targets[i], runID)
+			if profile.WarnInternalSubscribers {
+				warnInternalSubscribers(destinationSess, profile, targets[i])
+			}
+		}
+	case backfill.DestinationProcessor:
+		// the log processor is invoked directly, the notifications reach no other subscriber of its topic
+		if profile.NoAttributes {
+			logger.Fatalf("the processor destination needs the replay attributes, the %s profile sends none", profile.Name)
+		}
+		if !flagSet("concurrency") {
+			*CONCURRENCY = processorConcurrency
+		}
+	}
+	destinations := make([]backfill.Destination, len(targets))
+	for i, target := range targets {
+		destinations[i] = newTargetDestination(sess, destinationSess, target)
+	}
+	to := *DESTINATION + " " + strings.Join(targets, ",")
+	if len(destinations) == 1 {
+		return destinations[0], to
+	}
+	logger.Infof("sending every notification to the %d topics %s", len(targets), strings.Join(targets, ", "))
+	fanOut = &backfill.FanOutDestination{Destinations: destinations, Targets: targets}
+	return fanOut, to
+}
+
+// returns the destination of a target of -destination, sent to with destinationSess
+func newTargetDestination(sess, destinationSess *session.Session, target string) backfill.Destination {
+	var groupID func(bucket, key string) string
+	if *DESTINATION == backfill.DestinationSNS && strings.HasSuffix(target, ".fifo") {
+		groupID = newGroupID(sess)
+		logger.Infof("%s is a FIFO topic, grouping the files by %s", target, *FIFOGROUP)
+	}
+	destination, err := backfill.NewDestination(destinationSess, &backfill.DestinationOptions{
+		Kind:      *DESTINATION,
+		Target:    target,
+		AccountID: *ACCOUNT,
+		GroupID:   groupID,
+	})
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return destination
+}
+
+// aborts before listing if the topic does not exist or cannot be used, -canary also checks it can be published to.
+// Dry runs only read the topic.
+func checkTopic(sess *session.Session, topicARN, runID string) {
+	snsClient := topicClient(sess, topicARN)
+	if err := s3queue.CheckTopic(snsClient, topicARN); err != nil {
+		logger.Fatal(err)
+	}
+	if !*CANARY {
+		return
+	}
+	if *DRYRUN {
+		logger.Infof("dry run, not publishing the canary to %s", topicARN)
+		return
+	}
+	if err := s3queue.PublishCanary(snsClient, topicARN, runID); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Infof("published a canary s3:TestEvent to %s", topicARN)
+}
+
+// returns a client in the region of a topic, which may not be the region of the session
+func topicClient(sess *session.Session, topicARN string) *sns.SNS {
+	if topic, err := arn.Parse(topicARN); err == nil {
+		return sns.New(sess, &aws.Config{Region: &topic.Region})
+	}
+	return sns.New(sess)
+}
+
+// returns the message group strategy of -fifo.group
+func newGroupID(sess *session.Session) func(bucket, key string) string {
+	if *FIFOGROUP != s3queue.GroupByLogType {
+		return backfill.FIFOGroupIDs[*FIFOGROUP]
+	}
+	return s3queue.LogTypeGroupID(LOGTYPEMAP, listSources(sess))
+}
+
+// returns the sources resolving log types, from -sources-file if set so that the source API is not invoked
+func listSources(sess *session.Session) []*sourcemap.Source {
+	if logTypeSources != nil {
+		return logTypeSources
+	}
+	if len(LOGTYPEMAP) > 0 && !*LOGTYPEAPI {
+		logger.Infof("resolving log types with the %d tables of -log-type-map only", len(LOGTYPEMAP))
+		logTypeSources = []*sourcemap.Source{}
+		return logTypeSources
+	}
+	if *SOURCESFILE != "" {
+		sources, err := sourcemap.ReadSourcesFile(*SOURCESFILE)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Infof("resolving log types with the %d sources of %s", len(sources), *SOURCESFILE)
+		logTypeSources = sources
+		return sources
+	}
+	sources, err := sourcemap.ListSources(lambda.New(sess), &sourcehealth.Filter{}, false)
+	if err != nil {
+		logger.Fatalf("failed to list the sources resolving log types: %s", err)
+	}
+	logTypeSources = sources
+	return sources
+}
+
+// writes the sources of the source API to -dump-sources for -sources-file, returns false if there is nothing to dump
+func dumpSources(sess *session.Session) bool {
+	if *DUMPSOURCES == "" {
+		return false
+	}
+	if *SOURCESFILE != "" {
+		logger.Warnf("-sources-file wins over -dump-sources, %s is used and nothing is dumped", *SOURCESFILE)
+		return false
+	}
+	sources := listSources(sess)
+	if err := sourcemap.WriteSourcesFile(*DUMPSOURCES, sources); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Infof("wrote the log types of %d sources to %s", len(sources), *DUMPSOURCES)
+	return true
+}
+
+// returns true if a flag was set on the command line
+func flagSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// the notifications of the profile are meant for external subscribers, Panther subscribers would process them too
+func warnInternalSubscribers(sess *session.Session, profile *s3queue.Profile, topicARN string) {
+	internal, err := s3queue.InternalSubscriptions(topicClient(sess, topicARN), topicARN)
+	if err != nil {
+		logger.Warnf("could not check the subscribers of %s: %s", topicARN, err)
+		return
+	}
+	for _, subscription := range internal {
+		logger.Warnf("%s is subscribed to %s and will also receive the %s notifications",
+			aws.StringValue(subscription.Endpoint), topicARN, profile.Name)
+	}
+}
+
+// returns nil if sampling is disabled
+func newSampler(sess *session.Session, roles *s3queue.RunRoles) *s3queue.Sampler {
+	if *SAMPLE <= 0 {
+		return nil
+	}
+	var configs []*aws.Config
+	if *SAMPLEROLE != "" {
+		configs = append(configs, &aws.Config{Credentials: stscreds.NewCredentials(sess, *SAMPLEROLE)})
+	}
+	return &s3queue.Sampler{
+		Clients:        newS3Clients(sess, roles, configs...),
+		Fraction:       *SAMPLE,
+		MaxFailureRate: *SAMPLERATE,
+		MinSamples:     *SAMPLEMIN,
+		WarnOnly:       *SAMPLEWARN,
+		RequireGzip:    *SAMPLEGZIP,
+		RequireJSON:    *SAMPLEJSON,
 	}
 }
 
@@ -154,11 +1252,11 @@ func promptFlags() {
 		return
 	}
 
-	if *S3PATH == "" {
+	if *S3PATH == "" && *KEYS == "" && *REDRIVE == "" {
 		*S3PATH = prompt.Read("Please enter the s3 path to read from (e.g., s3://<bucket>/<prefix>): ", prompt.NonemptyValidator)
 	}
 
-	if *TOQ == "" {
+	if *DESTINATION == backfill.DestinationSQS && *TOQ == "" {
 		*TOQ = prompt.Read("Please enter queue name to write to: ", prompt.NonemptyValidator)
 	}
 }
@@ -173,32 +1271,154 @@ func validateFlags() {
 		}
 	}()
 
-	if *S3PATH == "" {
-		err = errors.New("-s3path not set")
+	if *S3PATH == "" && *KEYS == "" && *REDRIVE == "" {
+		err = errors.New("-s3path, -keys or -redrive-from not set")
+		return
+	}
+	if err = validateKeys(); err != nil {
 		return
 	}
-	if *TOQ == "" {
+	if *DESTINATION == backfill.DestinationSQS && *TOQ == "" {
 		err = errors.New("-queue not set")
 		return
 	}
+	if _, ok := backfill.FIFOGroupIDs[*FIFOGROUP]; !ok && *FIFOGROUP != s3queue.GroupByLogType {
+		err = errors.Errorf("invalid -fifo.group %q, expected prefix, bucket, table or log-type", *FIFOGROUP)
+		return
+	}
+	if *INVENTORY != "" && (*KEYS != "" || *LISTERS > 1 || *CHECKPOINT != "" || *CONFIRM) {
+		err = errors.New("-inventory sends the files in the order of the report, not with -keys, -listers, -checkpoint or -confirm")
+		return
+	}
+	if *LISTERS > 1 && (*KEYS != "" || *CHECKPOINT != "") {
+		err = errors.New("-listers lists -s3path in no particular order, it cannot be used with -keys or -checkpoint")
+		return
+	}
+	if *OWNER != "" && *OWNACCOUNT {
+		err = errors.New("-expected-bucket-owner and -expected-bucket-owner.account cannot be used together")
+		return
+	}
+	for _, role := range []string{*S3ROLE, *SNSROLE} {
+		if parsed, parseErr := arn.Parse(role); role != "" && (parseErr != nil || parsed.Service != "iam") {
+			err = errors.Errorf("%q is not a role ARN", role)
+			return
+		}
+	}
+	if *SNSROLE != "" && *DESTINATION != backfill.DestinationSNS {
+		err = errors.New("-sns-role-arn needs -destination sns")
+		return
+	}
+	if *BOOKMARKS == "" && (*RESETBOOKS || flagSet("bookmark-ttl")) || *BOOKMARKTTL < 0 {
+		err = errors.New("-reset-bookmarks and -bookmark-ttl need -bookmark-table, the TTL must not be negative")
+		return
+	}
+	if *RESUME && *CHECKPOINT == "" {
+		err = errors.New("-resume needs -checkpoint")
+		return
+	}
+	if *RUNID != "" {
+		if err = backfill.ValidateRunID(*RUNID); err != nil {
+			return
+		}
+	}
+	if MINSIZE == 0 || MAXSIZE > 0 && MAXSIZE < MINSIZE {
+		err = errors.New("-min-size must be at least 1 byte and at most -max-size")
+		return
+	}
+	if *MAXRATE < 0 || *MAXATTEMPTS < 0 || *NOTIFYBUF < 0 || *PACK < 0 || *COMPRESS < 0 {
+		err = errors.New("-max-per-second, -max-attempts, -notify-buffer, -records-per-message and -compress-above " +
+			"must not be negative")
+		return
+	}
+	if err = validateOrder(); err != nil {
+		return
+	}
+	if *SAMPLE < 0 || *SAMPLE > 1 {
+		err = errors.New("-sample must be a fraction between 0 and 1")
+		return
+	}
+	if filter, err = parseFilter(*AFTER, *BEFORE); err != nil {
+		return
+	}
+	if len(INCLUDE) > 0 || len(EXCLUDE) > 0 {
+		if keyFilter, err = s3queue.NewKeyFilter(INCLUDE, EXCLUDE); err != nil {
+			return
+		}
+	}
+	match, err = s3queue.NewMatch(filter, keyFilter)
 }
 
-func getS3Region(sess *session.Session, s3Path string) string {
-	parsedPath, err := url.Parse(s3Path)
-	if err != nil {
-		logger.Fatalf("failed to find bucket region for provided path %s: %s", s3Path, err)
+// checks the flags that do not apply to -keys are not set with it
+// validates the flags that change what is listed and in which order
+func validateOrder() error {
+	switch {
+	case *PARTLIMIT < 0 || *SHUFFLE && (*CHECKPOINT != "" || *KEYS != "" || *INVENTORY != ""):
+		return errors.New("-limit-per-partition must not be negative, -shuffle only shuffles listings and is not checkpointed")
+	case *REDRIVE != "" && (*S3PATH != "" || *KEYS != "" || *INVENTORY != "" || *CONFIRM):
+		return errors.New("-redrive-from sends the notifications of its files, not with -s3path, -keys, -inventory or -confirm")
+	case *INGESTED != "" && (*SHUFFLE || *CHECKPOINT != "" || *KEYS != "" || *INVENTORY != "" || *LISTERS > 1 || *CONFIRM):
+		return errors.New("-ingested is merged with a single listing in key order, not with -shuffle, -checkpoint, -keys, " +
+			"-inventory, -listers or -confirm")
 	}
+	return nil
+}
 
-	input := &s3.GetBucketLocationInput{Bucket: aws.String(parsedPath.Host)}
-	location, err := s3.New(sess).GetBucketLocation(input)
+func validateKeys() error {
+	switch {
+	case *KEYS == "":
+		return nil
+	case *S3PATH != "":
+		return errors.New("-s3path and -keys are exclusive")
+	case *CHECKPOINT != "":
+		return errors.New("runs of -keys are not checkpointed")
+	case *SAMPLE > 0:
+		return errors.New("-sample needs -s3path")
+	case *KEYSPACE > 0:
+		return errors.New("-keyspace needs -s3path")
+	case *CONFIRM:
+		return errors.New("-confirm lists -s3path, the key list is only read once")
+	case flagSet("min-size") || flagSet("max-size"):
+		return errors.New("-min-size and -max-size need -s3path")
+	}
+	return nil
+}
+
+// returns the last modified window of the after and before times, nil if both are empty
+func parseFilter(after, before string) (*backfill.Filter, error) {
+	if after == "" && before == "" {
+		return nil, nil
+	}
+	var window backfill.Filter
+	var err error
+	if after != "" {
+		if window.ModifiedAfter, err = parseTime(after); err != nil {
+			return nil, errors.WithMessage(err, "invalid -after")
+		}
+	}
+	if before != "" {
+		if window.ModifiedBefore, err = parseTime(before); err != nil {
+			return nil, errors.WithMessage(err, "invalid -before")
+		}
+	}
+	return &window, nil
+}
+
+func parseTime(input string) (time.Time, error) {
+	if tm, err := time.Parse(time.RFC3339, input); err == nil {
+		return tm, nil
+	}
+	tm, err := time.Parse("2006-01-02", input)
 	if err != nil {
-		logger.Fatalf("failed to find bucket region for provided path %s: %s", s3Path, err)
+		return time.Time{}, errors.Errorf("failed to parse %q as RFC3339 or YYYY-MM-DD", input)
 	}
+	return tm, nil
+}
 
-	// Method may return nil if region is us-east-1,https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketLocation.html
-	// and https://docs.aws.amazon.com/general/latest/gr/rande.html#s3_region
-	if location.LocationConstraint == nil {
-		return endpoints.UsEast1RegionID
+func splitPaths(list string) (paths []string) {
+	for _, path := range strings.Split(list, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
 	}
-	return *location.LocationConstraint
+	return paths
 }
@@ -19,16 +19,27 @@ package s3queue
  */
 
 import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	"github.com/aws/aws-sdk-go/service/sqs"
-	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/s3path"
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
 )
 
 const (
@@ -39,105 +50,540 @@ const (
 	testQueueName = "testQueue"
 )
 
-func TestS3Queue(t *testing.T) {
-	s3Client := &mockS3{}
-	page := &s3.ListObjectsV2Output{
-		Contents: []*s3.Object{
-			{
-				Size: aws.Int64(1), // 1 object of some size
-				Key:  aws.String(testKey),
-			},
+// a bucket with n objects under testS3Path
+func testS3(n int) *awsfake.S3 {
+	return awsfake.NewS3(awsfake.ListingSpec{
+		Bucket:         testBucket,
+		Prefix:         testKey + "/",
+		Start:          time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Hours:          1,
+		ObjectsPerHour: n,
+		MinSize:        1,
+		MaxSize:        1000,
+	})
+}
+
+func testSources(s3Client *awsfake.S3) []*Source {
+	return []*Source{
+		{
+			Path: s3path.Path{Bucket: s3Client.Spec.Bucket, Key: testKey},
+			S3:   s3Client,
 		},
 	}
-	s3Client.On("ListObjectsV2Pages", mock.Anything, mock.Anything).Return(page, nil).Once()
-	sqsClient := &mockSQS{}
-	sqsClient.On("GetQueueUrl", mock.Anything).Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String("arn")}, nil).Once()
-	sqsClient.On("SendMessageBatch", mock.Anything).Return(&sqs.SendMessageBatchOutput{}, nil).Once()
+}
+
+func TestS3Queue(t *testing.T) {
+	s3Client := testS3(1)
+	sqsClient := &awsfake.SQSSink{}
 
-	stats := &Stats{}
-	err := s3Queue(s3Client, sqsClient, testAccount, testS3Path, testQueueName, 1, 0, stats)
+	stats := NewStats()
+	err := s3Queue(context.Background(), testSources(s3Client), sqsClient, testAccount, testQueueName, 1, Limit{}, nil, stats)
 	require.NoError(t, err)
-	s3Client.AssertExpectations(t)
-	sqsClient.AssertExpectations(t)
-	assert.Equal(t, uint64(1), stats.NumFiles)
+	assert.Equal(t, uint64(1), stats.NumFiles.Value())
+	assert.Equal(t, 1, sqsClient.Calls())
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(1), snapshot.Counter("numFiles"))
+	assert.Equal(t, uint64(aws.Int64Value(s3Client.Spec.Object(0).Size)), snapshot.Counter("numBytes"))
+	assert.Equal(t, uint64(0), snapshot.Counter("numRetries"))
+	assert.Equal(t, uint64(1), snapshot.Counter("numSent"))
+	assert.Equal(t, uint64(1), snapshot.Counter("numSentBatches"))
+
+	// replay hints
+	messages := sqsClient.Messages()
+	require.Len(t, messages, 1)
+	attributes := messages[0].MessageAttributes
+	assert.Equal(t, "true", aws.StringValue(attributes[notify.ReplayAttributeName].StringValue))
+	assert.NotEmpty(t, aws.StringValue(attributes[notify.BackfillRunIDAttributeName].StringValue))
+}
+
+func TestS3QueueTo(t *testing.T) {
+	s3Client := testS3(7)
+	destination := &backfill.RecordingDestination{BatchSize: 3}
+
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), destination, nil, 1, Limit{}, nil, nil, nil, stats)
+	require.NoError(t, err)
+	batches := destination.Batches()
+	require.Len(t, batches, 3) // batches are the size of the destination
+	assert.Len(t, batches[2], 1)
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 7)
+	for i, notification := range notifications {
+		assert.Equal(t, s3Client.Spec.Key(i), notification.Event.Records[0].S3.Object.Key)
+		assert.Equal(t, "true", notification.Attributes[notify.ReplayAttributeName])
+		assert.Equal(t, "run", notification.Attributes[notify.BackfillRunIDAttributeName])
+	}
+	assert.Equal(t, uint64(7), stats.Snapshot().Counter("numSent"))
+}
+
+func TestStatsConcurrentWriters(t *testing.T) {
+	// several writers count into the same stats while the lister counts, run with -race.
+	// A tolerated failed batch is counted apart from the files published.
+	s3Client := testS3(100)
+	destination := &keyFailingDestination{
+		RecordingDestination: backfill.RecordingDestination{BatchSize: 5},
+		key:                  s3Client.Spec.Key(42),
+	}
+	profile := &Profile{ErrorThreshold: &ErrorThreshold{Count: 5}}
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), destination, profile, 8, Limit{}, nil, nil, nil, stats)
+	require.Error(t, err)
+	assert.Len(t, destination.Notifications(), 95)
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(100), snapshot.Counter("numFiles"))
+	assert.Equal(t, uint64(95), snapshot.Counter("numSentFiles"))
+	assert.Equal(t, uint64(5), snapshot.Counter("numFailedFiles"))
+	assert.Equal(t, uint64(95), snapshot.Counter("numSent"))
+	assert.Equal(t, uint64(1), snapshot.Counter("numFailedBatches"))
 }
 
 func TestS3QueueLimit(t *testing.T) {
 	// list 2 objects but limit send to 1
-	s3Client := &mockS3{}
-	page := &s3.ListObjectsV2Output{
-		Contents: []*s3.Object{ // 2 objects
-			{
-				Size: aws.Int64(1),
-				Key:  aws.String(testKey),
-			},
-			{
-				Size: aws.Int64(1),
-				Key:  aws.String(testKey),
-			},
-		},
-	}
-	s3Client.On("ListObjectsV2Pages", mock.Anything, mock.Anything).Return(page, nil).Once()
-	sqsClient := &mockSQS{}
-	sqsClient.On("GetQueueUrl", mock.Anything).Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String("arn")}, nil).Once()
-	sqsClient.On("SendMessageBatch", mock.Anything).Return(&sqs.SendMessageBatchOutput{}, nil).Once()
+	s3Client := testS3(2)
+	sqsClient := &awsfake.SQSSink{}
+
+	stats := NewStats()
+	err := s3Queue(context.Background(), testSources(s3Client), sqsClient, testAccount, testQueueName, 1, Limit{Files: 1}, nil, stats)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.NumFiles.Value())
+	assert.Len(t, sqsClient.Messages(), 1)
+	assert.Equal(t, LimitFiles, stats.LimitReached())
+}
+
+func TestS3QueueLimitBytes(t *testing.T) {
+	s3Client := testS3(10)
+	// the file crossing the limit is still sent
+	limit := uint64(aws.Int64Value(s3Client.Spec.Object(0).Size)+aws.Int64Value(s3Client.Spec.Object(1).Size)) + 1
+	sqsClient := &awsfake.SQSSink{}
+
+	stats := NewStats()
+	err := s3Queue(context.Background(), testSources(s3Client), sqsClient, testAccount, testQueueName, 1, Limit{Bytes: limit}, nil, stats)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), stats.NumFiles.Value())
+	assert.Len(t, sqsClient.Messages(), 3)
+	assert.GreaterOrEqual(t, stats.NumBytes.Value(), limit)
+	assert.Equal(t, LimitBytes, stats.LimitReached())
+
+	// the first limit reached stops the listing
+	stats = NewStats()
+	err = s3Queue(context.Background(), testSources(s3Client), &awsfake.SQSSink{}, testAccount, testQueueName, 1,
+		Limit{Files: 2, Bytes: limit}, nil, stats)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.NumFiles.Value())
+	assert.Equal(t, LimitFiles, stats.LimitReached())
 
-	stats := &Stats{}
-	err := s3Queue(s3Client, sqsClient, testAccount, testS3Path, testQueueName, 1, 1, stats)
+	// a run listing every file reaches no limit
+	stats = NewStats()
+	err = s3Queue(context.Background(), testSources(s3Client), &awsfake.SQSSink{}, testAccount, testQueueName, 1,
+		Limit{Files: 20, Bytes: 1 << 40}, nil, stats)
 	require.NoError(t, err)
-	s3Client.AssertExpectations(t)
-	sqsClient.AssertExpectations(t)
-	assert.Equal(t, uint64(1), stats.NumFiles)
+	assert.Equal(t, uint64(10), stats.NumFiles.Value())
+	assert.Empty(t, stats.LimitReached())
 }
 
 func TestS3QueueBatch(t *testing.T) {
-	var contents []*s3.Object
-	for i := 0; i < (2*10)+1; i++ { // batch size is 10, so 2 full batches and one partial
-		contents = append(contents, &s3.Object{
-			Size: aws.Int64(1), // 1 object of some size
-			Key:  aws.String(testKey),
-		})
+	const numObjects = (2 * 10) + 1 // batch size is 10, so 2 full batches and one partial
+	s3Client := testS3(numObjects)
+	sqsClient := &awsfake.SQSSink{}
+
+	stats := NewStats()
+	err := s3Queue(context.Background(), testSources(s3Client), sqsClient, testAccount, testQueueName, 1, Limit{}, nil, stats)
+	require.NoError(t, err)
+	assert.Equal(t, 3, sqsClient.Calls())
+	assert.Len(t, sqsClient.Messages(), numObjects)
+	assert.Equal(t, uint64(numObjects), stats.NumFiles.Value())
+}
+
+func TestS3QueueThrottled(t *testing.T) {
+	const numObjects = 30
+	s3Client := testS3(numObjects)
+	sqsClient := &awsfake.SQSSink{Failures: awsfake.Failures{ThrottleEvery: 2}}
+
+	stats := NewStats()
+	err := s3Queue(context.Background(), testSources(s3Client), sqsClient, testAccount, testQueueName, 1, Limit{}, nil, stats)
+	require.NoError(t, err)
+	assert.Len(t, sqsClient.Messages(), numObjects) // every throttled batch was resent
+	assert.Equal(t, uint64(sqsClient.Calls()-3), stats.NumRetries.Value())
+	assert.Equal(t, stats.NumRetries.Value(), stats.Snapshot().Counter("numRetriedBatches")) // each was retried once
+}
+
+func TestS3QueueSendFailure(t *testing.T) {
+	const numObjects = 5000 // more than the notification buffer, the lister must stop after the failure
+	s3Client := testS3(numObjects)
+	sqsClient := &awsfake.SQSSink{Failures: awsfake.Failures{Err: errors.New("send failed")}}
+
+	stats := NewStats()
+	err := s3Queue(context.Background(), testSources(s3Client), sqsClient, testAccount, testQueueName, 1, Limit{}, nil, stats)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "send failed")
+	assert.Equal(t, 1, sqsClient.Calls()) // fail fast, no batch is sent after the first failure
+	assert.Less(t, stats.NumFiles.Value(), uint64(numObjects))
+}
+
+// publishes numOK messages, then panics
+type panickingSNS struct {
+	snsiface.SNSAPI
+	mu        sync.Mutex
+	numOK     int
+	published int
+}
+
+func (c *panickingSNS) PublishWithContext(_ aws.Context, input *sns.PublishInput,
+	_ ...request.Option) (*sns.PublishOutput, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.published == c.numOK {
+		_ = *input.MessageAttributes["missing"].StringValue // nil pointer dereference
 	}
-	s3Client := &mockS3{}
-	page := &s3.ListObjectsV2Output{
-		Contents: contents,
+	c.published++
+	return &sns.PublishOutput{}, nil
+}
+
+func TestS3QueuePanic(t *testing.T) {
+	const numObjects = 5000 // more than the notification buffer, the lister must stop after the panic
+	s3Client := testS3(numObjects)
+	snsClient := &panickingSNS{numOK: 25}
+	destination := &backfill.SNSDestination{SNS: snsClient, TopicARN: backfill.FakeTopicARN(testAccount)}
+
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), destination, nil, 1, Limit{}, nil, nil, nil, stats)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "work item panicked: runtime error: invalid memory address or nil pointer dereference")
+	assert.Equal(t, 25, snsClient.published)
+	// the batch that panicked after 5 messages is not counted as sent
+	assert.Equal(t, uint64(20), stats.Publish.NumSent.Value())
+	assert.Equal(t, uint64(2), stats.Publish.NumBatches.Value())
+	assert.Equal(t, uint64(1), stats.NumFailedBatches.Value())
+	assert.Less(t, stats.NumFiles.Value(), uint64(numObjects))
+}
+
+func TestS3QueueListFailure(t *testing.T) {
+	s3Client := testS3(10)
+	s3Client.Spec.FailAtPage = 1
+	sqsClient := &awsfake.SQSSink{}
+
+	stats := NewStats()
+	err := s3Queue(context.Background(), testSources(s3Client), sqsClient, testAccount, testQueueName, 1, Limit{}, nil, stats)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to list "+testS3Path)
+	assert.Zero(t, sqsClient.Calls())
+}
+
+func TestS3QueueCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s3Client := testS3(1)
+	sqsClient := &awsfake.SQSSink{}
+
+	stats := NewStats()
+	err := s3Queue(ctx, testSources(s3Client), sqsClient, testAccount, testQueueName, 1, Limit{}, nil, stats)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.True(t, errors.Is(err, ErrCanceled))
+	assert.Zero(t, sqsClient.Calls()) // nothing sent
+}
+
+// cancelingDestination cancels the run at its first send
+type cancelingDestination struct {
+	*backfill.RecordingDestination
+	once   sync.Once
+	cancel context.CancelFunc
+}
+
+func (d *cancelingDestination) Send(ctx context.Context, batch []*backfill.Notification) error {
+	d.once.Do(d.cancel)
+	return d.RecordingDestination.Send(ctx, batch)
+}
+
+func TestS3QueueCanceledDrains(t *testing.T) {
+	const numObjects = 5000 // more than the listing queues ahead of the sends
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	destination := &cancelingDestination{RecordingDestination: &backfill.RecordingDestination{BatchSize: 1}, cancel: cancel}
+
+	// the listing stops and the files listed before the cancel are still sent
+	stats := NewStats()
+	err := S3QueueTo(ctx, "run", testSources(testS3(numObjects)), destination, nil, 1, Limit{}, nil, nil, nil, stats)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrCanceled))
+	numFiles := stats.NumFiles.Value()
+	assert.Less(t, numFiles, uint64(numObjects))
+	assert.Len(t, destination.Notifications(), int(numFiles))
+	assert.Equal(t, numFiles, stats.Snapshot().Counter("numSent"))
+}
+
+func TestS3QueueSources(t *testing.T) {
+	other := awsfake.NewS3(awsfake.ListingSpec{
+		Bucket:         "other",
+		Prefix:         testKey + "/",
+		Start:          time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Hours:          1,
+		ObjectsPerHour: 5,
+		MinSize:        1,
+		MaxSize:        1000,
+	})
+	sources := append(testSources(testS3(3)), testSources(other)...)
+	sqsClient := &awsfake.SQSSink{}
+
+	stats := NewStats()
+	err := s3Queue(context.Background(), sources, sqsClient, testAccount, testQueueName, 1, Limit{}, nil, stats)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(8), stats.NumFiles.Value())
+	messages := sqsClient.Messages()
+	require.Len(t, messages, 8)
+	assert.Contains(t, *messages[0].MessageBody, testBucket)
+	assert.Contains(t, *messages[7].MessageBody, "other")
+
+	// the limit applies to all sources
+	stats = NewStats()
+	err = s3Queue(context.Background(), sources, &awsfake.SQSSink{}, testAccount, testQueueName, 1, Limit{Files: 4}, nil, stats)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), stats.NumFiles.Value())
+}
+
+func TestS3QueueSourcesListFailure(t *testing.T) {
+	failing := awsfake.NewS3(awsfake.ListingSpec{
+		Bucket:         "other",
+		Prefix:         testKey + "/",
+		Start:          time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Hours:          1,
+		ObjectsPerHour: 5,
+		MinSize:        1,
+		MaxSize:        1000,
+		FailAtPage:     1,
+	})
+	sources := append(testSources(testS3(3)), testSources(failing)...)
+	destination := &backfill.RecordingDestination{BatchSize: 10}
+
+	// the files of the paths before the failing one are sent and the error names the failing path
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", sources, destination, nil, 1, Limit{}, nil, nil, nil, stats)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to list s3://other/"+testKey)
+	assert.NotContains(t, err.Error(), testS3Path)
+	assert.Len(t, destination.Notifications(), 3)
+	assert.Equal(t, uint64(3), stats.NumFiles.Value())
+}
+
+func TestS3QueueMatch(t *testing.T) {
+	s3Client := testS3(10) // the objects of the hour are a second apart
+	start := s3Client.Spec.Start
+	filter := backfill.Filter{ModifiedAfter: start.Add(3 * time.Second), ModifiedBefore: start.Add(7 * time.Second)}
+	match, err := filter.Matcher()
+	require.NoError(t, err)
+	sources := testSources(s3Client)
+	sources[0].Match = match
+	destination := &backfill.RecordingDestination{BatchSize: 10}
+
+	stats := NewStats()
+	err = S3QueueTo(context.Background(), "run", sources, destination, nil, 1, Limit{}, nil, nil, nil, stats)
+	require.NoError(t, err)
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 4)
+	for i, notification := range notifications {
+		assert.Equal(t, s3Client.Spec.Key(i+3), notification.Event.Records[0].S3.Object.Key)
 	}
-	s3Client.On("ListObjectsV2Pages", mock.Anything, mock.Anything).Return(page, nil).Once()
-	sqsClient := &mockSQS{}
-	sqsClient.On("GetQueueUrl", mock.Anything).Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String("arn")}, nil).Once()
-	sqsClient.On("SendMessageBatch", mock.Anything).Return(&sqs.SendMessageBatchOutput{}, nil).Times(3)
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(4), snapshot.Counter("numFiles"))
+	assert.Equal(t, uint64(6), snapshot.Counter("numSkipped"))
+}
+
+func TestS3QueueSize(t *testing.T) {
+	s3Client := testS3(20) // of 1 to 1000 bytes
+	sources := testSources(s3Client)
+	sources[0].MinSize, sources[0].MaxSize = 200, 800
+	destination := &backfill.RecordingDestination{BatchSize: 10}
 
-	stats := &Stats{}
-	err := s3Queue(s3Client, sqsClient, testAccount, testS3Path, testQueueName, 1, 0, stats)
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", sources, destination, nil, 1, Limit{}, nil, nil, nil, stats)
 	require.NoError(t, err)
-	s3Client.AssertExpectations(t)
-	sqsClient.AssertExpectations(t)
-	assert.Equal(t, uint64(len(contents)), stats.NumFiles)
+	var expected []string
+	for i := 0; i < 20; i++ {
+		if size := aws.Int64Value(s3Client.Spec.Object(i).Size); size >= 200 && size <= 800 {
+			expected = append(expected, s3Client.Spec.Key(i))
+		}
+	}
+	require.NotEmpty(t, expected)
+	require.Less(t, len(expected), 20)
+	var keys []string
+	for _, notification := range destination.Notifications() {
+		keys = append(keys, notification.Event.Records[0].S3.Object.Key)
+	}
+	assert.Equal(t, expected, keys)
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(len(expected)), snapshot.Counter("numFiles"))
+	assert.Equal(t, uint64(20-len(expected)), snapshot.Counter("numSizeFiltered"))
+	assert.Equal(t, uint64(0), snapshot.Counter("numSkipped"))
 }
 
-type mockS3 struct {
-	s3iface.S3API
-	mock.Mock
+func TestS3QueueGlacier(t *testing.T) {
+	s3Client := testS3(6)
+	s3Client.Spec.StorageClasses = map[int]string{
+		1: s3.ObjectStorageClassGlacier,
+		2: s3.ObjectStorageClassStandardIa,
+		4: s3.ObjectStorageClassDeepArchive,
+	}
+
+	// the files that need a restore are skipped and written to the failed keys
+	var output bytes.Buffer
+	destination := &backfill.RecordingDestination{BatchSize: 10}
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), destination, nil, 1, Limit{}, nil, nil,
+		NewFailedKeys(&output), stats)
+	require.NoError(t, err)
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 4)
+	for i, index := range []int{0, 2, 3, 5} {
+		assert.Equal(t, s3Client.Spec.Key(index), notifications[i].Event.Records[0].S3.Object.Key)
+	}
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(4), snapshot.Counter("numFiles"))
+	assert.Equal(t, uint64(2), snapshot.Counter("numUnretrievable"))
+	assert.Equal(t, uint64(0), snapshot.Counter("numSkipped"))
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "s3://"+testBucket+"/"+s3Client.Spec.Key(1)+" # storage class GLACIER"))
+	assert.True(t, strings.HasPrefix(lines[1], "s3://"+testBucket+"/"+s3Client.Spec.Key(4)+" # storage class DEEP_ARCHIVE"))
+
+	// they are sent if included
+	sources := testSources(s3Client)
+	sources[0].IncludeGlacier = true
+	destination = &backfill.RecordingDestination{BatchSize: 10}
+	stats = NewStats()
+	err = S3QueueTo(context.Background(), "run", sources, destination, nil, 1, Limit{}, nil, nil, nil, stats)
+	require.NoError(t, err)
+	assert.Len(t, destination.Notifications(), 6)
+	assert.Equal(t, uint64(0), stats.Snapshot().Counter("numUnretrievable"))
+}
+
+func TestS3QueueNotificationDetails(t *testing.T) {
+	s3Client := testS3(2)
+	sources := testSources(s3Client)
+	sources[0].Region = "eu-west-1"
+	destination := &backfill.RecordingDestination{BatchSize: 10}
+	err := S3QueueTo(context.Background(), "run", sources, destination, nil, 1, Limit{}, nil, nil, nil, NewStats())
+	require.NoError(t, err)
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 2)
+	for i, notification := range notifications {
+		// the listing has what subscribers of real S3 notifications rely on
+		record, object := notification.Event.Records[0], s3Client.Spec.Object(i)
+		assert.Equal(t, "eu-west-1", record.AWSRegion)
+		assert.Equal(t, aws.TimeValue(object.LastModified), record.EventTime)
+		assert.Equal(t, notify.NormalizeETag(aws.StringValue(object.ETag)), record.S3.Object.ETag)
+		assert.Contains(t, notification.Message, `"awsRegion":"eu-west-1"`)
+	}
 }
 
-func (m *mockS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, f func(page *s3.ListObjectsV2Output, morePages bool) bool) error {
-	args := m.Called(input, f)
-	f(args.Get(0).(*s3.ListObjectsV2Output), false)
-	return args.Error(1)
+func TestS3QueueInvalidKeys(t *testing.T) {
+	s3Client := testS3(5)
+	s3Client.Spec.KeySuffixes = map[int]string{
+		1: " copy+1 日志",
+		3: "\x00",
+		4: "\u0085", // a C1 control character
+	}
+	destination := &backfill.RecordingDestination{BatchSize: 10}
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), destination, nil, 1, Limit{}, nil, nil, nil, stats)
+	require.NoError(t, err)
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 3)
+	for i, index := range []int{0, 1, 2} {
+		assert.Equal(t, s3Client.Spec.Key(index), notifications[i].Event.Records[0].S3.Object.Key)
+	}
+	assert.Contains(t, notifications[1].Message, notify.EncodeObjectKey(s3Client.Spec.Key(1)))
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(3), snapshot.Counter("numFiles"))
+	assert.Equal(t, uint64(2), snapshot.Counter("numInvalidKeys"))
 }
 
-type mockSQS struct {
-	sqsiface.SQSAPI
-	mock.Mock
+func TestS3ClientsPreflight(t *testing.T) {
+	regions := map[string]string{
+		"us-bucket": "us-east-1",
+		"eu-bucket": "eu-west-1",
+		"eu-other":  "eu-west-1",
+	}
+	var numLocated int
+	clients := newS3Clients(
+		func(bucket string) (string, error) {
+			numLocated++
+			region, ok := regions[bucket]
+			if !ok {
+				return "", errors.New("access denied")
+			}
+			return region, nil
+		},
+		func(region string) s3iface.S3API {
+			return awsfake.NewS3(awsfake.ListingSpec{Bucket: region})
+		},
+	)
+
+	sources, err := clients.Preflight([]string{"s3://us-bucket/a/", "s3://eu-bucket/b/", "s3://eu-other/", "s3://eu-bucket/c/"})
+	require.NoError(t, err)
+	require.Len(t, sources, 4)
+	assert.Equal(t, "us-east-1", sources[0].Region)
+	assert.Equal(t, "a/", sources[0].Path.Key)
+	assert.Equal(t, "eu-west-1", sources[1].Region)
+	assert.Same(t, sources[1].S3, sources[2].S3) // one client per region
+	assert.Same(t, sources[1].S3, sources[3].S3)
+	assert.NotSame(t, sources[0].S3, sources[1].S3)
+	assert.Equal(t, 3, numLocated) // once per bucket
+
+	// every failed path is reported, nothing is returned
+	sources, err = clients.Preflight([]string{"s3://us-bucket/", "s3://denied-1/", "not-a-path", "s3://denied-2/x"})
+	require.Error(t, err)
+	assert.Nil(t, sources)
+	assert.Contains(t, err.Error(), "s3://denied-1/: failed to find bucket region for denied-1: access denied")
+	assert.Contains(t, err.Error(), "s3://denied-2/x: failed to find bucket region for denied-2")
+	assert.Contains(t, err.Error(), `"not-a-path"`)
 }
 
-// nolint (golint)
-func (m *mockSQS) GetQueueUrl(input *sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput, error) {
-	args := m.Called(input)
-	return args.Get(0).(*sqs.GetQueueUrlOutput), args.Error(1)
+func TestS3ClientsPreflightOwner(t *testing.T) {
+	s3Client := testS3(3)
+	s3Client.Spec.Owner = testAccount
+	clients := newS3Clients(
+		func(string) (string, error) { return "us-east-1", nil },
+		func(string) s3iface.S3API { return s3Client },
+	)
+
+	// the sources expect the owner, their listing is denied if the bucket changes hands
+	clients.ExpectedBucketOwner = testAccount
+	sources, err := clients.Preflight([]string{testS3Path})
+	require.NoError(t, err)
+	require.Len(t, sources, 1)
+	assert.Equal(t, testAccount, sources[0].ExpectedBucketOwner)
+	destination := &backfill.RecordingDestination{BatchSize: 10}
+	err = S3QueueTo(context.Background(), "run", sources, destination, nil, 1, Limit{}, nil, nil, nil, NewStats())
+	require.NoError(t, err)
+	assert.Len(t, destination.Notifications(), 3)
+	s3Client.Spec.Owner = "111111111111"
+	err = S3QueueTo(context.Background(), "run", sources, destination, nil, 1, Limit{}, nil, nil, nil, NewStats())
+	assert.True(t, errors.Is(err, ErrListAccessDenied))
+
+	// a bucket of another account fails the preflight
+	sources, err = clients.Preflight([]string{testS3Path})
+	assert.Nil(t, sources)
+	assertClass(t, ErrBucketOwner, err)
+	assert.Contains(t, err.Error(), testS3Path+": bucket foo is not owned by account "+testAccount)
 }
 
-func (m *mockSQS) SendMessageBatch(input *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
-	args := m.Called(input)
-	return args.Get(0).(*sqs.SendMessageBatchOutput), args.Error(1)
+func BenchmarkS3Queue(b *testing.B) {
+	spec := awsfake.ListingSpec{
+		Bucket:         testBucket,
+		Prefix:         testKey + "/",
+		Start:          time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Hours:          1000,
+		ObjectsPerHour: 1000, // one million keys
+		MinSize:        1,
+		MaxSize:        100 * 1024 * 1024,
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sqsClient := &awsfake.SQSSink{}
+		stats := NewStats()
+		err := s3Queue(context.Background(), testSources(awsfake.NewS3(spec)), sqsClient, testAccount, testQueueName, 50, Limit{}, nil, stats)
+		require.NoError(b, err)
+		require.Len(b, sqsClient.Messages(), spec.NumObjects())
+	}
 }
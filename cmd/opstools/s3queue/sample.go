@@ -0,0 +1,241 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/pkg/lambdalogger"
+)
+
+const (
+	defaultSampleReadSize = 64 * 1024
+	maxSampleExamples     = 10
+)
+
+// Reasons sampled objects fail
+const (
+	SampleFailureRead        = "read failed"
+	SampleFailureNotGzip     = "not gzip"
+	SampleFailureCorrupt     = "invalid compressed data"
+	SampleFailureInvalidJSON = "first line is not JSON"
+)
+
+// Sampler reads the head of a fraction of the listed objects to check they can be read and processed,
+// before they are notified. It is safe for concurrent use.
+type Sampler struct {
+	// Clients read the samples, e.g. with the credentials of the log processing role
+	Clients *S3Clients
+	// Fraction of the objects to sample (e.g. 0.001), objects are picked by a hash of their key
+	Fraction float64
+	// MaxFailureRate is the fraction of failed samples above which the run is aborted (or a warning logged)
+	MaxFailureRate float64
+	// MinSamples is the number of samples taken before the failure rate is checked
+	MinSamples uint64
+	// ReadSize is the number of bytes read from the start of the objects, defaults to 64KB
+	ReadSize int64
+	// WarnOnly logs a warning instead of aborting when the failure rate is exceeded
+	WarnOnly bool
+	// RequireGzip fails samples without the gzip magic bytes
+	RequireGzip bool
+	// RequireJSON fails samples whose first line is not valid JSON
+	RequireJSON bool
+
+	warned bool // guarded by mu
+	mu     sync.Mutex
+	result SampleResult
+}
+
+// SampleResult is the summary of the samples of a run
+type SampleResult struct {
+	NumSampled uint64 `json:"numSampled"`
+	NumFailed  uint64 `json:"numFailed"`
+	// NumInconclusive samples had no complete first line in the bytes read, they are not failures
+	NumInconclusive uint64 `json:"numInconclusive"`
+	// Failures are examples of failed samples, at most 10
+	Failures []SampleFailure `json:"failures,omitempty"`
+}
+
+type SampleFailure struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// FailureRate is the fraction of failed samples
+func (r *SampleResult) FailureRate() float64 {
+	if r.NumSampled == 0 {
+		return 0
+	}
+	return float64(r.NumFailed) / float64(r.NumSampled)
+}
+
+// Result returns a copy of the current result
+func (s *Sampler) Result() SampleResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := s.result
+	result.Failures = append([]SampleFailure(nil), s.result.Failures...)
+	return result
+}
+
+// Sample checks the object if it is picked for sampling.
+// It returns an ErrSampleFailed error if the run should be aborted because too many samples failed.
+func (s *Sampler) Sample(ctx context.Context, bucket string, object *s3.Object) error {
+	key := aws.StringValue(object.Key)
+	if !s.picks(key) {
+		return nil
+	}
+	failure := s.check(ctx, bucket, object)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.result.NumSampled++
+	switch {
+	case failure == nil:
+	case failure.Reason == "":
+		s.result.NumInconclusive++
+	default:
+		s.result.NumFailed++
+		if len(s.result.Failures) < maxSampleExamples {
+			s.result.Failures = append(s.result.Failures, *failure)
+		}
+		lambdalogger.FromContext(ctx).Debug("sample failed", zap.String("bucket", bucket), zap.String("key", key),
+			zap.String("reason", failure.Reason), zap.String("error", failure.Error))
+	}
+	if s.result.NumSampled < s.MinSamples || s.result.FailureRate() <= s.MaxFailureRate {
+		return nil
+	}
+	err := classify(ErrSampleFailed, errors.Errorf(
+		"%d of %d sampled objects failed, above the max failure rate of %.2f%% (e.g. s3://%s/%s: %s)",
+		s.result.NumFailed, s.result.NumSampled, 100*s.MaxFailureRate,
+		s.result.Failures[0].Bucket, s.result.Failures[0].Key, s.result.Failures[0].Reason))
+	if !s.WarnOnly {
+		return err
+	}
+	if !s.warned {
+		s.warned = true
+		lambdalogger.FromContext(ctx).Warn(err.Error())
+	}
+	return nil
+}
+
+// picks returns true for the fraction of keys with the lowest hashes, so the same keys are sampled on every run
+func (s *Sampler) picks(key string) bool {
+	if s.Fraction <= 0 {
+		return false
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	return float64(hash.Sum32()) < s.Fraction*(math.MaxUint32+1)
+}
+
+// check returns the failure of a sample, a failure without a reason if inconclusive, nil if it passed
+func (s *Sampler) check(ctx context.Context, bucket string, object *s3.Object) *SampleFailure {
+	key := aws.StringValue(object.Key)
+	failure := func(reason string, err error) *SampleFailure {
+		f := &SampleFailure{Bucket: bucket, Key: key, Reason: reason}
+		if err != nil {
+			f.Error = err.Error()
+		}
+		return f
+	}
+	s3Client, _, err := s.Clients.ForBucket(bucket)
+	if err != nil {
+		return failure(SampleFailureRead, err)
+	}
+	readSize := s.ReadSize
+	if readSize <= 0 {
+		readSize = defaultSampleReadSize
+	}
+	output, err := s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:              &bucket,
+		Key:                 &key,
+		Range:               aws.String(fmt.Sprintf("bytes=0-%d", readSize-1)),
+		RequestPayer:        requestPayer(s.Clients.RequesterPays),
+		ExpectedBucketOwner: bucketOwner(s.Clients.ExpectedBucketOwner),
+	})
+	if err != nil {
+		return failure(SampleFailureRead, err)
+	}
+	defer output.Body.Close()
+	head, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return failure(SampleFailureRead, err)
+	}
+	reason, inconclusive, err := CheckHead(head, aws.Int64Value(object.Size) > readSize, s.RequireGzip, s.RequireJSON)
+	switch {
+	case reason != "":
+		return failure(reason, err)
+	case inconclusive:
+		return failure("", nil)
+	default:
+		return nil
+	}
+}
+
+// CheckHead checks the first bytes of an object and returns the reason it cannot be processed.
+// If truncated is true the head is not the whole object, then a first line longer than the head is inconclusive.
+func CheckHead(head []byte, truncated, requireGzip, requireJSON bool) (reason string, inconclusive bool, err error) {
+	var r io.Reader = bytes.NewReader(head)
+	if len(head) >= 2 && head[0] == 0x1f && head[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			if err == io.ErrUnexpectedEOF && truncated {
+				return "", true, nil
+			}
+			return SampleFailureCorrupt, false, err
+		}
+		r = gzipReader
+	} else if requireGzip {
+		return SampleFailureNotGzip, false, nil
+	}
+	line, err := bufio.NewReader(r).ReadBytes('\n')
+	switch {
+	case err == nil:
+	case err == io.EOF && !truncated: // the whole object is one line
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		if truncated {
+			return "", true, nil
+		}
+		return SampleFailureCorrupt, false, err
+	default:
+		return SampleFailureCorrupt, false, err
+	}
+	if requireJSON && !jsoniter.Valid(bytes.TrimSpace(line)) {
+		return SampleFailureInvalidJSON, false, nil
+	}
+	return "", false, nil
+}
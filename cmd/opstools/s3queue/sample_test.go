@@ -0,0 +1,166 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
+)
+
+// sampledS3 lists a spec and serves the same content for every object
+type sampledS3 struct {
+	*awsfake.S3
+	content []byte
+	ranges  []string
+}
+
+func (s *sampledS3) GetObjectWithContext(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	s.ranges = append(s.ranges, aws.StringValue(input.Range))
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(s.content))}, nil
+}
+
+func gzipData(t testing.TB, data string) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+func testSampler(s3Client s3iface.S3API) *Sampler {
+	return &Sampler{
+		Clients: newS3Clients(
+			func(string) (string, error) { return "us-east-1", nil },
+			func(string) s3iface.S3API { return s3Client },
+		),
+		Fraction:       1,
+		MaxFailureRate: 0.1,
+		MinSamples:     5,
+		ReadSize:       1024,
+		RequireGzip:    true,
+		RequireJSON:    true,
+	}
+}
+
+func TestCheckHead(t *testing.T) {
+	valid := gzipData(t, `{"a":1}`+"\n"+`{"a":2}`+"\n")
+	reason, inconclusive, err := CheckHead(valid, false, true, true)
+	assert.Empty(t, reason)
+	assert.False(t, inconclusive)
+	assert.NoError(t, err)
+
+	// a single line without a newline
+	reason, _, _ = CheckHead(gzipData(t, `{"a":1}`), false, true, true)
+	assert.Empty(t, reason)
+
+	reason, _, _ = CheckHead([]byte(`{"a":1}`+"\n"), false, true, true)
+	assert.Equal(t, SampleFailureNotGzip, reason)
+	reason, _, _ = CheckHead([]byte(`{"a":1}`+"\n"), false, false, true)
+	assert.Empty(t, reason)
+
+	reason, _, _ = CheckHead(gzipData(t, "2020-12-01 plain text\n"), false, true, true)
+	assert.Equal(t, SampleFailureInvalidJSON, reason)
+	reason, _, _ = CheckHead(gzipData(t, "2020-12-01 plain text\n"), false, true, false)
+	assert.Empty(t, reason)
+
+	corrupt := append([]byte(nil), valid...)
+	for i := 10; i < len(corrupt); i++ {
+		corrupt[i] = 0xff
+	}
+	reason, _, err = CheckHead(corrupt, false, true, true)
+	assert.Equal(t, SampleFailureCorrupt, reason)
+	assert.Error(t, err)
+
+	// the head of a long first line
+	long := gzipData(t, `{"a":"`+strings.Repeat("x", 100000)+`"}`+"\n")
+	reason, inconclusive, _ = CheckHead(long[:100], true, true, true)
+	assert.Empty(t, reason)
+	assert.True(t, inconclusive)
+	reason, _, _ = CheckHead(long[:100], false, true, true) // the whole object is truncated
+	assert.Equal(t, SampleFailureCorrupt, reason)
+}
+
+func TestSamplerPicks(t *testing.T) {
+	sampler := &Sampler{Fraction: 0.01}
+	var picked int
+	for i := 0; i < 100000; i++ {
+		if sampler.picks(fmt.Sprintf("%s/%d.json.gz", testKey, i)) {
+			picked++
+		}
+	}
+	assert.InDelta(t, 1000, picked, 200)
+	assert.Equal(t, sampler.picks("key"), sampler.picks("key")) // deterministic
+	assert.False(t, (&Sampler{}).picks("key"))
+}
+
+func TestS3QueueSampled(t *testing.T) {
+	s3Client := &sampledS3{S3: testS3(20), content: gzipData(t, `{"a":1}`+"\n")}
+	sampler := testSampler(s3Client)
+	sqsClient := &awsfake.SQSSink{}
+
+	err := s3Queue(context.Background(), testSources(s3Client.S3), sqsClient, testAccount, testQueueName, 1, Limit{}, sampler, NewStats())
+	require.NoError(t, err)
+	assert.Len(t, sqsClient.Messages(), 20)
+	result := sampler.Result()
+	assert.Equal(t, uint64(20), result.NumSampled)
+	assert.Zero(t, result.NumFailed)
+	assert.Equal(t, "bytes=0-1023", s3Client.ranges[0])
+}
+
+func TestS3QueueSampleFailures(t *testing.T) {
+	s3Client := &sampledS3{S3: testS3(100), content: []byte("not gzip\n")}
+	sampler := testSampler(s3Client)
+	stats := NewStats()
+
+	err := s3Queue(context.Background(), testSources(s3Client.S3), &awsfake.SQSSink{}, testAccount, testQueueName, 1, Limit{}, sampler, stats)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "5 of 5 sampled objects failed, above the max failure rate of 10.00%")
+	assert.Contains(t, err.Error(), SampleFailureNotGzip)
+	assert.Equal(t, uint64(4), stats.NumFiles.Value()) // aborted at the first check
+	result := sampler.Result()
+	assert.Equal(t, uint64(5), result.NumFailed)
+	require.Len(t, result.Failures, 5)
+	assert.Equal(t, testS3(100).Spec.Key(0), result.Failures[0].Key)
+
+	// warn only
+	sampler = testSampler(s3Client)
+	sampler.WarnOnly = true
+	sqsClient := &awsfake.SQSSink{}
+	err = s3Queue(context.Background(), testSources(s3Client.S3), sqsClient, testAccount, testQueueName, 1, Limit{}, sampler, NewStats())
+	require.NoError(t, err)
+	assert.Len(t, sqsClient.Messages(), 100)
+	result = sampler.Result()
+	assert.Equal(t, uint64(100), result.NumFailed)
+	assert.Len(t, result.Failures, maxSampleExamples)
+}
@@ -0,0 +1,123 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/lambdalogger"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+// shardDelimiter separates the levels of the keys the shards are split at
+const shardDelimiter = "/"
+
+// ShardSources splits every source into a shard per common prefix one level below its path, e.g. the
+// AWSLogs/<account>/ prefixes of s3://bucket/AWSLogs/, and a shard of the files at the level of its path.
+// The shards keep the region, client, Match, RequesterPays and ExpectedBucketOwner of their source.
+func ShardSources(ctx context.Context, sources []*Source) ([]*Source, error) {
+	var shards []*Source
+	for _, source := range sources {
+		topLevel := *source
+		topLevel.Delimiter = shardDelimiter
+		shards = append(shards, &topLevel)
+		listInput := &s3.ListObjectsV2Input{
+			Bucket:              aws.String(source.Path.Bucket),
+			Prefix:              aws.String(source.Path.Key),
+			Delimiter:           aws.String(shardDelimiter),
+			RequestPayer:        requestPayer(source.RequesterPays),
+			ExpectedBucketOwner: bucketOwner(source.ExpectedBucketOwner),
+		}
+		err := source.S3.ListObjectsV2PagesWithContext(ctx, listInput, func(page *s3.ListObjectsV2Output, _ bool) bool {
+			for _, commonPrefix := range page.CommonPrefixes {
+				shard := *source
+				shard.Path = s3path.Path{Bucket: source.Path.Bucket, Key: aws.StringValue(commonPrefix.Prefix)}
+				shards = append(shards, &shard)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, classifyList(errors.Wrapf(err, "failed to list the prefixes of %s", source.Path))
+		}
+	}
+	return shards, nil
+}
+
+// S3QueueSharded is S3QueueTo listing the shards of the sources with concurrent listers, see ShardSources.
+// The files of the shards are sent in no particular order, so the run is not checkpointed.
+func S3QueueSharded(ctx context.Context, runID string, sources []*Source, listers int, destination backfill.Destination,
+	profile *Profile, concurrency int, limit Limit, sampler *Sampler, failed *FailedKeys, stats *Stats) error {
+
+	shards, err := ShardSources(ctx, sources)
+	if err != nil {
+		return err
+	}
+	lambdalogger.FromContext(ctx).Info("listing shards", zap.Int("shards", len(shards)), zap.Int("listers", listers))
+	list := func(ctx context.Context, notifyChan chan listedObject) error {
+		return listShards(ctx, shards, listers, limit, sampler, failed, notifyChan, stats)
+	}
+	return queueObjects(ctx, runID, list, destination, profile, concurrency, limit, nil, failed, stats, runProgress{})
+}
+
+// list the shards with concurrent listers and send files to notifyChan until the limit is reached or ctx is done.
+// A listing error stops the other listers, the errors are the ones of the shards that failed.
+func listShards(ctx context.Context, shards []*Source, listers int, limit Limit, sampler *Sampler, failed *FailedKeys,
+	notifyChan chan listedObject, stats *Stats) error {
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	next := make(chan int, len(shards))
+	for i := range shards {
+		next <- i
+	}
+	close(next)
+
+	taken := &limiter{Limit: limit, stats: stats}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs MultiError
+	for n := 0; n < listers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if ctx.Err() != nil || limit.reached(stats) {
+					return
+				}
+				if err := listPath(ctx, listPosition{source: i}, shards[i], taken, sampler, failed, notifyChan, stats); err != nil {
+					mu.Lock()
+					errs.Add(err)
+					mu.Unlock()
+					stop()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(notifyChan) // signal to reader that we are done, once all the listers are
+	return errs.Err()
+}
@@ -0,0 +1,95 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/s3path"
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
+)
+
+// a bucket with 5 objects an hour in the day=01/ and day=02/ prefixes of the month
+func testShardedS3() (*awsfake.S3, []*Source) {
+	s3Client := awsfake.NewS3(awsfake.ListingSpec{
+		Bucket:         testBucket,
+		Prefix:         testKey + "/",
+		Start:          time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Hours:          48,
+		ObjectsPerHour: 5,
+		MinSize:        1,
+		MaxSize:        1000,
+	})
+	sources := []*Source{
+		{
+			Path: s3path.Path{Bucket: testBucket, Key: testKey + "/year=2020/month=01/"},
+			S3:   s3Client,
+		},
+	}
+	return s3Client, sources
+}
+
+func TestShardSources(t *testing.T) {
+	_, sources := testShardedS3()
+	shards, err := ShardSources(context.Background(), sources)
+	require.NoError(t, err)
+	require.Len(t, shards, 3)
+	assert.Equal(t, sources[0].Path, shards[0].Path)
+	assert.Equal(t, "/", shards[0].Delimiter) // the files next to the prefixes
+	assert.Equal(t, testKey+"/year=2020/month=01/day=01/", shards[1].Path.Key)
+	assert.Equal(t, testKey+"/year=2020/month=01/day=02/", shards[2].Path.Key)
+	assert.Empty(t, shards[2].Delimiter)
+	assert.Equal(t, sources[0].S3, shards[2].S3)
+}
+
+func TestS3QueueSharded(t *testing.T) {
+	s3Client, sources := testShardedS3()
+	destination := &backfill.RecordingDestination{}
+	stats := NewStats()
+	err := S3QueueSharded(context.Background(), "run", sources, 3, destination, nil, 2, Limit{}, nil, nil, stats)
+	require.NoError(t, err)
+	keys := make(map[string]bool)
+	for _, notification := range destination.Notifications() {
+		keys[notification.Event.Records[0].S3.Object.Key] = true
+	}
+	require.Len(t, keys, s3Client.Spec.NumObjects())
+	for i := 0; i < s3Client.Spec.NumObjects(); i++ {
+		assert.True(t, keys[s3Client.Spec.Key(i)], s3Client.Spec.Key(i))
+	}
+	assert.Equal(t, uint64(s3Client.Spec.NumObjects()), stats.NumSentFiles.Value())
+	assert.Empty(t, stats.LimitReached())
+}
+
+func TestS3QueueShardedLimit(t *testing.T) {
+	_, sources := testShardedS3()
+	destination := &backfill.RecordingDestination{}
+	stats := NewStats()
+	// the listers together stop at the limit
+	err := S3QueueSharded(context.Background(), "run", sources, 3, destination, nil, 2, Limit{Files: 7}, nil, nil, stats)
+	require.NoError(t, err)
+	assert.Len(t, destination.Notifications(), 7)
+	assert.Equal(t, uint64(7), stats.NumFiles.Value())
+	assert.Equal(t, LimitFiles, stats.LimitReached())
+}
@@ -0,0 +1,107 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The status of a run in its summary
+const (
+	StatusCompleted = "completed"
+	StatusCanceled  = "canceled"
+	StatusFailed    = "failed"
+)
+
+// Summary is the outcome of a run as a single JSON document, for automation that should not parse the logs
+type Summary struct {
+	RunID  string `json:"runId"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Destination is the kind of destination, Target is the topic ARN, queue, event bus or function sent to
+	Destination     string    `json:"destination"`
+	Target          string    `json:"target"`
+	StartTime       time.Time `json:"startTime"`
+	EndTime         time.Time `json:"endTime"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	NumFiles        uint64    `json:"numFiles"`     // listed
+	NumSentFiles    uint64    `json:"numSentFiles"` // published
+	NumBytes        uint64    `json:"numBytes"`
+	NumSkipped      uint64    `json:"numSkipped"`
+	NumFailedFiles  uint64    `json:"numFailedFiles"`
+	NumRetries      uint64    `json:"numRetries"`
+	// NumVerifyMissing are the files deleted since they were listed and NumVerifyFailed the files that could not be
+	// verified, with a Verifier. The files that failed to send are in NumFailedFiles.
+	NumVerifyMissing uint64 `json:"numVerifyMissing,omitempty"`
+	NumVerifyFailed  uint64 `json:"numVerifyFailed,omitempty"`
+	// Concurrency is the number of writers sending at once at the end of the run and MinConcurrency the lowest it
+	// went, below the -concurrency of the run if its sends were throttled with an adaptive concurrency
+	Concurrency    int64 `json:"concurrency,omitempty"`
+	MinConcurrency int64 `json:"minConcurrency,omitempty"`
+	// RequesterPays is true if the listing of requester-pays buckets was billed to the account of the run
+	RequesterPays bool `json:"requesterPays,omitempty"`
+	// LimitReached is the limit that stopped the listing, files or bytes, empty if none did
+	LimitReached string `json:"limitReached,omitempty"`
+	// FilesPerSecond is the rate of the files published over the whole run
+	FilesPerSecond float64 `json:"filesPerSecond"`
+}
+
+// NewSummary returns the summary of a run from its manifest and the error it returned
+func NewSummary(manifest *Manifest, err error) *Summary {
+	destination, target := manifest.Destination, ""
+	if i := strings.IndexByte(destination, ' '); i >= 0 {
+		destination, target = destination[:i], destination[i+1:]
+	}
+	summary := &Summary{
+		RunID:           manifest.RunID,
+		Status:          StatusCompleted,
+		Destination:     destination,
+		Target:          target,
+		StartTime:       manifest.StartTime,
+		EndTime:         manifest.EndTime,
+		DurationSeconds: manifest.EndTime.Sub(manifest.StartTime).Seconds(),
+		LimitReached:    manifest.LimitReached,
+		RequesterPays:   manifest.RequesterPays,
+	}
+	switch {
+	case errors.Is(err, ErrCanceled):
+		summary.Status, summary.Error = StatusCanceled, err.Error()
+	case err != nil:
+		summary.Status, summary.Error = StatusFailed, err.Error()
+	}
+	if snapshot := manifest.Stats; snapshot != nil {
+		summary.NumFiles = snapshot.Counter("numFiles")
+		summary.NumSentFiles = snapshot.Counter("numSentFiles")
+		summary.NumBytes = snapshot.Counter("numBytes")
+		summary.NumSkipped = snapshot.Counter("numSkipped")
+		summary.NumFailedFiles = snapshot.Counter("numFailedFiles")
+		summary.NumRetries = snapshot.Counter("numRetries")
+		summary.NumVerifyMissing = snapshot.Counter("numVerifyMissing")
+		summary.NumVerifyFailed = snapshot.Counter("numVerifyFailed")
+		summary.Concurrency = snapshot.Gauge("concurrency")
+		summary.MinConcurrency = snapshot.Gauge("minConcurrency")
+	}
+	if summary.DurationSeconds > 0 {
+		summary.FilesPerSecond = float64(summary.NumSentFiles) / summary.DurationSeconds
+	}
+	return summary
+}
@@ -0,0 +1,71 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+)
+
+func TestNewSummary(t *testing.T) {
+	s3Client := testS3(7)
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), &backfill.RecordingDestination{}, nil,
+		1, Limit{}, nil, nil, nil, stats)
+	require.NoError(t, err)
+	start := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	manifest := &Manifest{
+		RunID:       "run",
+		StartTime:   start,
+		EndTime:     start.Add(2 * time.Second),
+		Destination: "sns arn:aws:sns:us-east-1:012345678912:topic",
+		Stats:       stats.Snapshot(),
+	}
+
+	summary := NewSummary(manifest, nil)
+	assert.Equal(t, &Summary{
+		RunID:           "run",
+		Status:          StatusCompleted,
+		Destination:     "sns",
+		Target:          "arn:aws:sns:us-east-1:012345678912:topic",
+		StartTime:       manifest.StartTime,
+		EndTime:         manifest.EndTime,
+		DurationSeconds: 2,
+		NumFiles:        7,
+		NumSentFiles:    7,
+		NumBytes:        stats.NumBytes.Value(),
+		Concurrency:     1,
+		FilesPerSecond:  3.5,
+	}, summary)
+
+	summary = NewSummary(manifest, classify(ErrCanceled, context.Canceled))
+	assert.Equal(t, StatusCanceled, summary.Status)
+	assert.Equal(t, context.Canceled.Error(), summary.Error)
+
+	summary = NewSummary(manifest, classify(ErrPublish, errors.New("send failed")))
+	assert.Equal(t, StatusFailed, summary.Status)
+	assert.Equal(t, "send failed", summary.Error)
+}
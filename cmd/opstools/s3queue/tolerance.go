@@ -0,0 +1,154 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+)
+
+// minErrorRateFiles is the number of files sent or failed before a percentage threshold is checked, so that the
+// first failures of a run do not exceed it
+const minErrorRateFiles = 1000
+
+// ErrorThreshold is how many files may fail to send before a run stops, a count or a percentage of the files
+// sent or failed. The zero value stops a run at the first failure.
+type ErrorThreshold struct {
+	Count   uint64
+	Percent float64
+}
+
+// ParseErrorThreshold parses a count (e.g. 100) or a percentage (e.g. 0.5%), the zero threshold if s is empty
+func ParseErrorThreshold(s string) (ErrorThreshold, error) {
+	var threshold ErrorThreshold
+	err := threshold.UnmarshalText([]byte(s))
+	return threshold, err
+}
+
+func (t ErrorThreshold) String() string {
+	if t.Percent > 0 {
+		return strconv.FormatFloat(t.Percent, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatUint(t.Count, 10)
+}
+
+// MarshalText writes the threshold as it is parsed, profiles have it as a string
+func (t ErrorThreshold) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *ErrorThreshold) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	*t = ErrorThreshold{}
+	if s == "" {
+		return nil
+	}
+	if percent := strings.TrimSuffix(s, "%"); percent != s {
+		value, err := strconv.ParseFloat(percent, 64)
+		if err != nil || value < 0 || value > 100 {
+			return errors.Errorf("error threshold %q is not a percentage between 0%% and 100%%", s)
+		}
+		t.Percent = value
+		return nil
+	}
+	value, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return errors.Errorf("error threshold %q is neither a count nor a percentage", s)
+	}
+	t.Count = value
+	return nil
+}
+
+// exceeded returns true if the failed files are more than the threshold
+func (t ErrorThreshold) exceeded(numFailed, numSent uint64) bool {
+	if t.Percent > 0 {
+		numFiles := numFailed + numSent
+		return numFiles >= minErrorRateFiles && float64(numFailed) > t.Percent/100*float64(numFiles)
+	}
+	return numFailed > t.Count
+}
+
+// errorTolerance counts the files of the batches sent and failed, the run goes on past failed batches until the
+// threshold is exceeded. The files of failed batches are written to the failed keys if not nil. It is safe for
+// concurrent use.
+type errorTolerance struct {
+	threshold ErrorThreshold
+	keys      *FailedKeys
+	stats     *Stats
+
+	mu        sync.Mutex
+	numSent   uint64
+	numFailed uint64
+	errs      MultiError // the failures until the stop, counted by message
+	stopped   bool       // the threshold was exceeded
+}
+
+func (e *errorTolerance) sent(numFiles int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.numSent += uint64(numFiles)
+}
+
+// failed records a failed batch, it returns an error stopping the run if the threshold is exceeded and nil otherwise
+func (e *errorTolerance) failed(objects []backfill.Object, err error) error {
+	e.stats.NumFailedFiles.Add(uint64(len(objects)))
+	return e.fail(objects, err)
+}
+
+// unverified records a batch not sent as its files could not be verified, it counts towards the threshold as a
+// failed batch does
+func (e *errorTolerance) unverified(objects []backfill.Object, err error) error {
+	e.stats.NumVerifyFailed.Add(uint64(len(objects)))
+	return e.fail(objects, err)
+}
+
+func (e *errorTolerance) fail(objects []backfill.Object, err error) error {
+	e.keys.AddObjects(objects, err)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.numFailed += uint64(len(objects))
+	if e.stopped {
+		return err // e.g. a batch interrupted by the stop, the errors returned before do not change
+	}
+	e.errs.Add(err)
+	if !e.threshold.exceeded(e.numFailed, e.numSent) {
+		return nil
+	}
+	e.stopped = true
+	if e.threshold == (ErrorThreshold{}) {
+		return err // the default stops at the first failure, as is
+	}
+	return errors.Wrapf(e.errs.Err(), "%d files failed to send and %d were sent, more than the error threshold %s",
+		e.numFailed, e.numSent, e.threshold)
+}
+
+// result returns the failures tolerated by a run that went on to the end, nil if there were none
+func (e *errorTolerance) result() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stopped || e.numFailed == 0 {
+		return nil
+	}
+	return errors.Wrapf(e.errs.Err(), "%d files failed to send and %d were sent", e.numFailed, e.numSent)
+}
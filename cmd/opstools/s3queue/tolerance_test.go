@@ -0,0 +1,117 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+)
+
+func TestParseErrorThreshold(t *testing.T) {
+	for s, expected := range map[string]ErrorThreshold{
+		"":     {},
+		"0":    {},
+		"100":  {Count: 100},
+		"0.5%": {Percent: 0.5},
+		" 1% ": {Percent: 1},
+	} {
+		threshold, err := ParseErrorThreshold(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, expected, threshold, s)
+	}
+	for _, s := range []string{"-1", "ten", "101%", "%"} {
+		_, err := ParseErrorThreshold(s)
+		assert.Error(t, err, s)
+	}
+	assert.Equal(t, "0.5%", ErrorThreshold{Percent: 0.5}.String())
+	assert.Equal(t, "100", ErrorThreshold{Count: 100}.String())
+}
+
+func TestErrorThresholdExceeded(t *testing.T) {
+	assert.True(t, ErrorThreshold{}.exceeded(1, 0))
+	assert.False(t, ErrorThreshold{Count: 10}.exceeded(10, 0))
+	assert.True(t, ErrorThreshold{Count: 10}.exceeded(11, 1000))
+	// a percentage is not checked for the first files
+	assert.False(t, ErrorThreshold{Percent: 1}.exceeded(100, 0))
+	assert.False(t, ErrorThreshold{Percent: 1}.exceeded(10, 990))
+	assert.True(t, ErrorThreshold{Percent: 1}.exceeded(11, 990))
+}
+
+// fails the batches with a key
+type keyFailingDestination struct {
+	backfill.RecordingDestination
+	key string
+}
+
+func (d *keyFailingDestination) Send(ctx context.Context, batch []*backfill.Notification) error {
+	for _, notification := range batch {
+		for _, record := range notification.Event.Records {
+			if record.S3.Object.Key == d.key {
+				return errors.New("bad key")
+			}
+		}
+	}
+	return d.RecordingDestination.Send(ctx, batch)
+}
+
+func TestS3QueueErrorThreshold(t *testing.T) {
+	s3Client := testS3(25)
+	newDestination := func() *keyFailingDestination {
+		return &keyFailingDestination{
+			RecordingDestination: backfill.RecordingDestination{BatchSize: 5},
+			key:                  s3Client.Spec.Key(7),
+		}
+	}
+
+	// the run goes on past the failed batch and fails at the end
+	destination := newDestination()
+	profile := &Profile{ErrorThreshold: &ErrorThreshold{Count: 5}}
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), destination, profile, 1, Limit{}, nil, nil, nil, stats)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrPublish))
+	assert.Contains(t, err.Error(), "5 files failed to send and 20 were sent: failed to send 5 of 5 notifications: bad key")
+	assert.Contains(t, err.Error(), "bad key")
+	assert.Len(t, destination.Notifications(), 20)
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(5), snapshot.Counter("numFailedFiles"))
+	assert.Equal(t, uint64(1), snapshot.Counter("numFailedBatches"))
+
+	// beyond the threshold the run stops
+	destination = newDestination()
+	profile = &Profile{ErrorThreshold: &ErrorThreshold{Count: 4}}
+	err = S3QueueTo(context.Background(), "run", testSources(s3Client), destination, profile, 1, Limit{}, nil, nil, nil, NewStats())
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrPublish))
+	assert.Contains(t, err.Error(), "5 files failed to send and 5 were sent, more than the error threshold 4")
+	assert.Less(t, len(destination.Notifications()), 20)
+
+	// by default the first failure stops the run, its error is as is
+	destination = newDestination()
+	err = S3QueueTo(context.Background(), "run", testSources(s3Client), destination, nil, 1, Limit{}, nil, nil, nil, NewStats())
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrPublish))
+	assert.NotContains(t, err.Error(), "files failed to send")
+}
@@ -0,0 +1,118 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/awsutils"
+)
+
+// CheckTopic fails fast before a run to a topic that does not exist or that the caller cannot read,
+// instead of the first publish failing once the listing is well under way. It also fails if a subscription of the
+// topic has a filter policy that can never match the notifications, the subscriber would not get them.
+func CheckTopic(snsClient snsiface.SNSAPI, topicARN string) error {
+	_, err := snsClient.GetTopicAttributes(&sns.GetTopicAttributesInput{TopicArn: &topicARN})
+	switch {
+	case err == nil:
+		return checkFilterPolicies(snsClient, topicARN)
+	case awsutils.IsAnyError(err, sns.ErrCodeNotFoundException):
+		return errors.Errorf("topic %s does not exist", topicARN)
+	case awsutils.IsAnyError(err, sns.ErrCodeAuthorizationErrorException):
+		return errors.Wrapf(err, "not allowed to use topic %s, check the permissions of the caller", topicARN)
+	default:
+		return errors.Wrapf(err, "failed to check topic %s", topicARN)
+	}
+}
+
+// checks the filter policies of the subscriptions of a topic with notify.ValidateFilterPolicy. The subscriptions
+// the caller cannot read are not checked, e.g. a caller of another account allowed to publish only.
+func checkFilterPolicies(snsClient snsiface.SNSAPI, topicARN string) error {
+	input := &sns.ListSubscriptionsByTopicInput{TopicArn: &topicARN}
+	for {
+		page, err := snsClient.ListSubscriptionsByTopic(input)
+		if awsutils.IsAnyError(err, sns.ErrCodeAuthorizationErrorException) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to list the subscriptions of %s", topicARN)
+		}
+		for _, subscription := range page.Subscriptions {
+			if err := checkFilterPolicy(snsClient, subscription); err != nil {
+				return errors.Wrapf(err, "subscription of %s by %s", topicARN, aws.StringValue(subscription.Endpoint))
+			}
+		}
+		if page.NextToken == nil {
+			return nil
+		}
+		input.NextToken = page.NextToken
+	}
+}
+
+func checkFilterPolicy(snsClient snsiface.SNSAPI, subscription *sns.Subscription) error {
+	subscriptionARN := aws.StringValue(subscription.SubscriptionArn)
+	if !arn.IsARN(subscriptionARN) {
+		return nil // "PendingConfirmation", the subscription has no attributes yet
+	}
+	output, err := snsClient.GetSubscriptionAttributes(&sns.GetSubscriptionAttributesInput{SubscriptionArn: &subscriptionARN})
+	switch {
+	case awsutils.IsAnyError(err, sns.ErrCodeAuthorizationErrorException, sns.ErrCodeNotFoundException):
+		return nil // not readable by the caller or deleted since the listing
+	case err != nil:
+		return errors.Wrapf(err, "failed to read subscription %s", subscriptionARN)
+	}
+	policy := aws.StringValue(output.Attributes["FilterPolicy"])
+	if policy == "" {
+		return nil // the subscriber gets every notification
+	}
+	return notify.ValidateFilterPolicy(policy, nil)
+}
+
+// PublishCanary publishes an s3:TestEvent to a topic to check the caller can publish to it. S3 sends these events to
+// new notification configurations, the log processor and other S3 subscribers ignore them.
+// The request ID of the event is the run ID, so that the canary of a run can be told apart.
+func PublishCanary(snsClient snsiface.SNSAPI, topicARN, runID string) error {
+	message, err := jsoniter.MarshalToString(&events.S3TestEvent{
+		Service:   "Amazon S3",
+		Event:     "s3:TestEvent",
+		Time:      time.Now().UTC(),
+		RequestID: runID,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the canary")
+	}
+	input := &sns.PublishInput{TopicArn: &topicARN, Message: &message}
+	if strings.HasSuffix(topicARN, ".fifo") {
+		input.MessageGroupId, input.MessageDeduplicationId = aws.String("canary"), aws.String(runID)
+	}
+	if _, err := snsClient.Publish(input); err != nil {
+		return errors.Wrapf(err, "failed to publish a canary to %s", topicARN)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sns"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
+)
+
+// an SNS fake with the attributes of some topics
+type fakeTopics struct {
+	awsfake.SNSSink
+	topics map[string]error // the error reading the attributes of a topic by ARN
+	// policies are the filter policies of the subscriptions of the topics by subscription ARN, one per page
+	policies map[string]string
+}
+
+func (f *fakeTopics) ListSubscriptionsByTopic(input *sns.ListSubscriptionsByTopicInput) (
+	*sns.ListSubscriptionsByTopicOutput, error) {
+
+	var subscriptionARNs []string
+	for subscriptionARN := range f.policies {
+		subscriptionARNs = append(subscriptionARNs, subscriptionARN)
+	}
+	sort.Strings(subscriptionARNs)
+	page := 0
+	if input.NextToken != nil {
+		page, _ = strconv.Atoi(*input.NextToken)
+	}
+	output := &sns.ListSubscriptionsByTopicOutput{}
+	if page < len(subscriptionARNs) {
+		output.Subscriptions = []*sns.Subscription{{
+			SubscriptionArn: aws.String(subscriptionARNs[page]),
+			TopicArn:        input.TopicArn,
+			Endpoint:        aws.String("arn:aws:sqs:us-east-1:" + testAccount + ":subscriber"),
+		}}
+	}
+	if page+1 < len(subscriptionARNs) {
+		output.NextToken = aws.String(strconv.Itoa(page + 1))
+	}
+	return output, nil
+}
+
+func (f *fakeTopics) GetSubscriptionAttributes(input *sns.GetSubscriptionAttributesInput) (
+	*sns.GetSubscriptionAttributesOutput, error) {
+
+	policy := f.policies[aws.StringValue(input.SubscriptionArn)]
+	if policy == "denied" {
+		return nil, awserr.New(sns.ErrCodeAuthorizationErrorException, "not authorized", nil)
+	}
+	attributes := map[string]*string{"SubscriptionArn": input.SubscriptionArn}
+	if policy != "" {
+		attributes["FilterPolicy"] = aws.String(policy)
+	}
+	return &sns.GetSubscriptionAttributesOutput{Attributes: attributes}, nil
+}
+
+func (f *fakeTopics) GetTopicAttributes(input *sns.GetTopicAttributesInput) (*sns.GetTopicAttributesOutput, error) {
+	err, ok := f.topics[aws.StringValue(input.TopicArn)]
+	if !ok {
+		return nil, awserr.New(sns.ErrCodeNotFoundException, "Topic does not exist", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sns.GetTopicAttributesOutput{Attributes: map[string]*string{"TopicArn": input.TopicArn}}, nil
+}
+
+func TestCheckTopic(t *testing.T) {
+	const topicARN = "arn:aws:sns:us-east-1:" + testAccount + ":topic"
+	const deniedARN = "arn:aws:sns:us-east-1:" + testAccount + ":denied"
+	snsClient := &fakeTopics{topics: map[string]error{
+		topicARN:  nil,
+		deniedARN: awserr.New(sns.ErrCodeAuthorizationErrorException, "not authorized", nil),
+	}}
+
+	require.NoError(t, CheckTopic(snsClient, topicARN))
+	err := CheckTopic(snsClient, "arn:aws:sns:us-east-1:"+testAccount+":tpoic")
+	require.Error(t, err)
+	assert.Equal(t, "topic arn:aws:sns:us-east-1:"+testAccount+":tpoic does not exist", err.Error())
+	err = CheckTopic(snsClient, deniedARN)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not allowed to use topic "+deniedARN)
+	assert.Zero(t, snsClient.Calls()) // nothing is published
+}
+
+func TestCheckTopicFilterPolicies(t *testing.T) {
+	const topicARN = "arn:aws:sns:us-east-1:" + testAccount + ":topic"
+	subscriptionARN := func(id string) string {
+		return topicARN + ":" + id
+	}
+	snsClient := &fakeTopics{
+		topics: map[string]error{topicARN: nil},
+		policies: map[string]string{
+			subscriptionARN("a"):  "",
+			subscriptionARN("b"):  `{"panther.replay":["true"],"panther.signature":[{"exists":true}]}`,
+			subscriptionARN("c"):  "denied", // not checked
+			"PendingConfirmation": "",
+		},
+	}
+	require.NoError(t, CheckTopic(snsClient, topicARN))
+
+	// a policy on an attribute that is never set drops every notification
+	snsClient.policies[subscriptionARN("d")] = `{"panther:replay":["true"]}`
+	err := CheckTopic(snsClient, topicARN)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "subscription of "+topicARN+" by arn:aws:sqs:us-east-1:"+testAccount+":subscriber")
+	assert.Contains(t, err.Error(), `attribute "panther:replay" is never set on notifications`)
+
+	snsClient.policies[subscriptionARN("d")] = `{"panther.replay":[true]}` // a boolean never matches a string attribute
+	err = CheckTopic(snsClient, topicARN)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `attribute "panther.replay" value true can never match`)
+}
+
+func TestPublishCanary(t *testing.T) {
+	const topicARN = "arn:aws:sns:us-east-1:" + testAccount + ":topic.fifo"
+	snsClient := &awsfake.SNSSink{}
+	require.NoError(t, PublishCanary(snsClient, topicARN, "run"))
+	published := snsClient.Published()
+	require.Len(t, published, 1)
+	assert.Equal(t, topicARN, aws.StringValue(published[0].TopicArn))
+	assert.Equal(t, "run", aws.StringValue(published[0].MessageDeduplicationId))
+	assert.NotEmpty(t, aws.StringValue(published[0].MessageGroupId))
+	var event events.S3TestEvent
+	require.NoError(t, jsoniter.UnmarshalFromString(aws.StringValue(published[0].Message), &event))
+	assert.Equal(t, "s3:TestEvent", event.Event) // ignored by the log processor
+	assert.Equal(t, "run", event.RequestID)
+
+	snsClient = &awsfake.SNSSink{Failures: awsfake.Failures{Err: awserr.New("AuthorizationError", "not authorized", nil)}}
+	err := PublishCanary(snsClient, topicARN, "run")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to publish a canary to "+topicARN)
+}
@@ -0,0 +1,60 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/lambdalogger"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+// Verifier heads the files of every batch before it is sent, so that the files deleted since they were listed
+// (e.g. by a lifecycle rule) are not notified. It doubles the requests of a run to s3.
+type Verifier struct {
+	Clients *S3Clients
+}
+
+// verify returns the objects that still exist with the size, ETag and last modified time of their heads. The files
+// not found are counted as missing, the batch fails if a file cannot be headed.
+func (v *Verifier) verify(ctx context.Context, objects []backfill.Object, stats *Stats) ([]backfill.Object, error) {
+	verified := make([]backfill.Object, 0, len(objects))
+	for _, object := range objects {
+		var headed s3.Object
+		_, found, err := v.Clients.head(ctx, s3path.Path{Bucket: object.Bucket, Key: object.Key}, &headed)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			lambdalogger.FromContext(ctx).Debug("skipping file deleted since it was listed",
+				zap.String("bucket", object.Bucket), zap.String("key", object.Key))
+			stats.NumVerifyMissing.Inc()
+			continue
+		}
+		headed.Key = &object.Key
+		record := backfill.NewObject(object.Bucket, &headed)
+		record.Region = object.Region
+		verified = append(verified, record)
+	}
+	return verified, nil
+}
@@ -0,0 +1,86 @@
+package s3queue
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
+)
+
+func TestS3QueueVerify(t *testing.T) {
+	s3Client := testS3(5)
+	// the first 3 files are left, with other sizes than listed
+	headClient := awsfake.NewS3(awsfake.ListingSpec{
+		Bucket:         testBucket,
+		Prefix:         testKey + "/",
+		Start:          time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Hours:          1,
+		ObjectsPerHour: 3,
+		MinSize:        2000,
+		MaxSize:        3000,
+	})
+	profile := &Profile{
+		Verifier: &Verifier{
+			Clients: newS3Clients(
+				func(string) (string, error) { return "us-east-1", nil },
+				func(string) s3iface.S3API { return headClient },
+			),
+		},
+	}
+	destination := &backfill.RecordingDestination{BatchSize: 2}
+	stats := NewStats()
+	err := S3QueueTo(context.Background(), "run", testSources(s3Client), destination, profile, 1, Limit{}, nil, nil, nil, stats)
+	require.NoError(t, err)
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 3)
+	for i, notification := range notifications {
+		object := notification.Event.Records[0].S3.Object
+		assert.Equal(t, headClient.Spec.Key(i), object.Key)
+		assert.Equal(t, *headClient.Spec.Object(i).Size, object.Size) // the size of the head
+	}
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(2), snapshot.Counter("numVerifyMissing"))
+	assert.Equal(t, uint64(3), snapshot.Counter("numSentFiles"))
+	assert.Equal(t, uint64(0), snapshot.Counter("numFailedFiles"))
+
+	// files that cannot be headed are not sent
+	profile.Verifier.Clients = newS3Clients(
+		func(string) (string, error) { return "", errors.New("no region") },
+		func(string) s3iface.S3API { return headClient },
+	)
+	destination = &backfill.RecordingDestination{BatchSize: 2}
+	stats = NewStats()
+	err = S3QueueTo(context.Background(), "run", testSources(s3Client), destination, profile, 1, Limit{}, nil, nil, nil, stats)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrVerify))
+	assert.False(t, errors.Is(err, ErrPublish))
+	assert.Empty(t, destination.Notifications())
+	snapshot = stats.Snapshot()
+	assert.NotZero(t, snapshot.Counter("numVerifyFailed"))
+	assert.Equal(t, uint64(0), snapshot.Counter("numFailedFiles"))
+}
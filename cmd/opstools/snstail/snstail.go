@@ -0,0 +1,316 @@
+package snstail
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/google/uuid"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/awssqs"
+)
+
+const (
+	// QueueNamePrefix is the name prefix of the temporary queues, leaked queues are found by it
+	QueueNamePrefix = "panther-snstail-"
+
+	waitTimeSeconds        = 20
+	messageRetentionPeriod = 300 // seconds, notifications are deleted after they are printed
+)
+
+// Tail is a temporary queue subscribed to a topic
+type Tail struct {
+	sqsClient       sqsiface.SQSAPI
+	snsClient       snsiface.SNSAPI
+	TopicARN        string
+	QueueURL        string
+	QueueARN        string
+	SubscriptionARN string
+}
+
+// Setup creates a temporary queue and subscribes it to the topic with an optional filter policy.
+// If it fails after creating the queue, the created resources are removed.
+func Setup(sqsClient sqsiface.SQSAPI, snsClient snsiface.SNSAPI, topicARN, filterPolicy string) (_ *Tail, err error) {
+	policy, err := jsoniter.MarshalToString(&awssqs.SqsPolicy{
+		Version: "2012-10-17",
+		Statements: []awssqs.SqsPolicyStatement{
+			{
+				SID:       "AllowTopic",
+				Effect:    "Allow",
+				Principal: map[string]string{"Service": "sns.amazonaws.com"},
+				Action:    "sqs:SendMessage",
+				Resource:  "*",
+				Condition: map[string]interface{}{
+					"ArnEquals": map[string]string{
+						"aws:SourceArn": topicARN,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal queue policy")
+	}
+
+	tail := &Tail{
+		sqsClient: sqsClient,
+		snsClient: snsClient,
+		TopicARN:  topicARN,
+	}
+	queueName := QueueNamePrefix + uuid.New().String()
+	createOutput, err := sqsClient.CreateQueue(&sqs.CreateQueueInput{
+		QueueName: aws.String(queueName),
+		Attributes: map[string]*string{
+			awssqs.PolicyAttributeName:                   aws.String(policy),
+			sqs.QueueAttributeNameMessageRetentionPeriod: aws.String(strconv.Itoa(messageRetentionPeriod)),
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create queue %s", queueName)
+	}
+	tail.QueueURL = aws.StringValue(createOutput.QueueUrl)
+	defer func() {
+		if err != nil { // the returned tail is nil, the one created is removed
+			err = multierr.Append(err, tail.Cleanup())
+		}
+	}()
+
+	attributesOutput, err := sqsClient.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       createOutput.QueueUrl,
+		AttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameQueueArn}),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get arn of queue %s", queueName)
+	}
+	tail.QueueARN = aws.StringValue(attributesOutput.Attributes[sqs.QueueAttributeNameQueueArn])
+
+	subscribeInput := &sns.SubscribeInput{
+		TopicArn:              aws.String(topicARN),
+		Protocol:              aws.String("sqs"),
+		Endpoint:              aws.String(tail.QueueARN),
+		ReturnSubscriptionArn: aws.Bool(true),
+	}
+	if filterPolicy != "" {
+		subscribeInput.Attributes = map[string]*string{
+			"FilterPolicy": aws.String(filterPolicy),
+		}
+	}
+	subscribeOutput, err := snsClient.Subscribe(subscribeInput)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to subscribe queue %s to %s", queueName, topicARN)
+	}
+	tail.SubscriptionARN = aws.StringValue(subscribeOutput.SubscriptionArn)
+	return tail, nil
+}
+
+// Cleanup unsubscribes and deletes the queue, it is safe to call more than once
+func (t *Tail) Cleanup() (err error) {
+	if t.SubscriptionARN != "" {
+		_, unsubscribeErr := t.snsClient.Unsubscribe(&sns.UnsubscribeInput{
+			SubscriptionArn: aws.String(t.SubscriptionARN),
+		})
+		if unsubscribeErr != nil {
+			err = multierr.Append(err, errors.Wrapf(unsubscribeErr, "failed to unsubscribe %s", t.SubscriptionARN))
+		} else {
+			t.SubscriptionARN = ""
+		}
+	}
+	if t.QueueURL != "" {
+		_, deleteErr := t.sqsClient.DeleteQueue(&sqs.DeleteQueueInput{
+			QueueUrl: aws.String(t.QueueURL),
+		})
+		if deleteErr != nil {
+			err = multierr.Append(err, errors.Wrapf(deleteErr, "failed to delete queue %s", t.QueueURL))
+		} else {
+			t.QueueURL = ""
+		}
+	}
+	return err
+}
+
+// Options control what is printed
+type Options struct {
+	// Raw prints the message bodies as received
+	Raw bool
+	// Attributes must all match the message attributes for a message to be printed
+	Attributes map[string]string
+	// MaxMessages stops the tail after printing this many messages if non-zero
+	MaxMessages uint64
+}
+
+// Run prints the notifications received until the context is done or the max messages are printed.
+// It returns the number of printed messages.
+func (t *Tail) Run(ctx context.Context, opts *Options, w io.Writer) (uint64, error) {
+	var numPrinted uint64
+	for opts.MaxMessages == 0 || numPrinted < opts.MaxMessages {
+		output, err := t.sqsClient.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(t.QueueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(waitTimeSeconds),
+		})
+		if err != nil {
+			if ctx.Err() != nil { // stopped by the caller
+				return numPrinted, nil
+			}
+			return numPrinted, errors.Wrapf(err, "failed to receive from %s", t.QueueURL)
+		}
+		if len(output.Messages) == 0 {
+			continue
+		}
+
+		deleteInput := &sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(t.QueueURL),
+		}
+		for i, message := range output.Messages {
+			deleteInput.Entries = append(deleteInput.Entries, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+			if opts.MaxMessages != 0 && numPrinted >= opts.MaxMessages {
+				continue
+			}
+			printed, err := printMessage(w, message, opts)
+			if err != nil {
+				return numPrinted, err
+			}
+			if printed {
+				numPrinted++
+			}
+		}
+		if _, err := t.sqsClient.DeleteMessageBatch(deleteInput); err != nil {
+			return numPrinted, errors.Wrapf(err, "failed to delete messages from %s", t.QueueURL)
+		}
+	}
+	return numPrinted, nil
+}
+
+func printMessage(w io.Writer, message *sqs.Message, opts *Options) (bool, error) {
+	var entity events.SNSEntity
+	if err := jsoniter.UnmarshalFromString(aws.StringValue(message.Body), &entity); err != nil {
+		_, err = fmt.Fprintf(w, "--- %s: not an SNS notification (%s)\n%s\n",
+			aws.StringValue(message.MessageId), err, aws.StringValue(message.Body))
+		return err == nil, err
+	}
+	attributes := stringAttributes(entity.MessageAttributes)
+	for name, value := range opts.Attributes {
+		if attributes[name] != value {
+			return false, nil
+		}
+	}
+
+	if opts.Raw {
+		_, err := fmt.Fprintln(w, aws.StringValue(message.Body))
+		return err == nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s %s\n", entity.MessageID, entity.Timestamp.UTC().Format("2006-01-02T15:04:05.000Z"))
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %s=%s\n", name, attributes[name])
+	}
+	notification, err := notify.ParseNotification([]byte(entity.Message))
+	if err != nil {
+		fmt.Fprintf(&b, "  not a Panther S3 notification (%s)\n  %s\n", err, entity.Message)
+	} else {
+		for _, record := range notification.Records {
+			fmt.Fprintf(&b, "  s3://%s/%s (%d bytes)\n", record.S3.Bucket.Name, record.S3.Object.Key, record.S3.Object.Size)
+		}
+	}
+	_, err = io.WriteString(w, b.String())
+	return err == nil, err
+}
+
+// stringAttributes returns the values of the attributes of an SNS notification by name
+func stringAttributes(attributes map[string]interface{}) map[string]string {
+	values := make(map[string]string, len(attributes))
+	for name, attribute := range attributes {
+		// attributes are {"Type": "String", "Value": "..."}
+		if attribute, ok := attribute.(map[string]interface{}); ok {
+			values[name] = fmt.Sprint(attribute["Value"])
+		}
+	}
+	return values
+}
+
+// CleanupLeaked removes the subscriptions to the topic and the queues left by tails that were not cleaned up.
+// It must not run while other tails are running, their queues would be removed as well.
+func CleanupLeaked(sqsClient sqsiface.SQSAPI, snsClient snsiface.SNSAPI, topicARN string) (numRemoved int, err error) {
+	listInput := &sns.ListSubscriptionsByTopicInput{
+		TopicArn: aws.String(topicARN),
+	}
+	for {
+		output, listErr := snsClient.ListSubscriptionsByTopic(listInput)
+		if listErr != nil {
+			return numRemoved, multierr.Append(err, errors.Wrapf(listErr, "failed to list subscriptions of %s", topicARN))
+		}
+		for _, subscription := range output.Subscriptions {
+			// the endpoint is the queue arn, the name is its last part
+			endpoint := aws.StringValue(subscription.Endpoint)
+			if aws.StringValue(subscription.Protocol) != "sqs" || !strings.Contains(endpoint, ":"+QueueNamePrefix) {
+				continue
+			}
+			_, unsubscribeErr := snsClient.Unsubscribe(&sns.UnsubscribeInput{SubscriptionArn: subscription.SubscriptionArn})
+			if unsubscribeErr != nil {
+				err = multierr.Append(err, errors.Wrapf(unsubscribeErr, "failed to unsubscribe %s",
+					aws.StringValue(subscription.SubscriptionArn)))
+				continue
+			}
+			numRemoved++
+		}
+		if output.NextToken == nil {
+			break
+		}
+		listInput.NextToken = output.NextToken
+	}
+
+	queues, listErr := sqsClient.ListQueues(&sqs.ListQueuesInput{
+		QueueNamePrefix: aws.String(QueueNamePrefix),
+	})
+	if listErr != nil {
+		return numRemoved, multierr.Append(err, errors.Wrap(listErr, "failed to list queues"))
+	}
+	for _, queueURL := range queues.QueueUrls {
+		if _, deleteErr := sqsClient.DeleteQueue(&sqs.DeleteQueueInput{QueueUrl: queueURL}); deleteErr != nil {
+			err = multierr.Append(err, errors.Wrapf(deleteErr, "failed to delete queue %s", aws.StringValue(queueURL)))
+			continue
+		}
+		numRemoved++
+	}
+	return numRemoved, err
+}
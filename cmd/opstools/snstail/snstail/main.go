@@ -0,0 +1,144 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/snstail"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+)
+
+func main() {
+	opstools.SetUsage("prints the notifications of an SNS topic using a temporary SQS queue subscribed to it")
+	opts := struct {
+		Topic        *string
+		FilterPolicy *string
+		Attributes   *string
+		Raw          *bool
+		MaxMessages  *uint64
+		Duration     *time.Duration
+		Cleanup      *bool
+		Debug        *bool
+		Region       *string
+	}{
+		Topic:        flag.String("topic", "", "The SNS topic to tail (name, ARN or console URL)"),
+		FilterPolicy: flag.String("filter-policy", "", "An optional SNS filter policy (JSON) for the subscription"),
+		Attributes: flag.String("attributes", "",
+			"Comma separated list of <name>=<value> message attributes, only messages with all of them are printed"),
+		Raw:         flag.Bool("raw", false, "Print the messages as received"),
+		MaxMessages: flag.Uint64("max-messages", 0, "If non-zero, stop after printing this many messages"),
+		Duration:    flag.Duration("duration", 0, "If non-zero, stop after this duration (e.g. 5m)"),
+		Cleanup: flag.Bool("cleanup", false,
+			"Remove the queues and subscriptions left by previous runs instead of tailing (must not run while other tails run)"),
+		Debug:  flag.Bool("debug", false, "Enable additional logging"),
+		Region: flag.String("region", "", "Set the AWS region to run on"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+
+	if *opts.Topic == "" {
+		flag.Usage()
+		log.Fatal("-topic not set")
+	}
+	tailOpts := &snstail.Options{
+		Raw:         *opts.Raw,
+		MaxMessages: *opts.MaxMessages,
+		Attributes:  make(map[string]string),
+	}
+	if *opts.Attributes != "" {
+		for _, attribute := range strings.Split(*opts.Attributes, ",") {
+			nameValue := strings.SplitN(attribute, "=", 2)
+			if len(nameValue) != 2 {
+				log.Fatalf("attribute %q is not <name>=<value>", attribute)
+			}
+			tailOpts.Attributes[nameValue[0]] = nameValue[1]
+		}
+	}
+	if *opts.FilterPolicy != "" {
+		if err := notify.ValidateFilterPolicy(*opts.FilterPolicy, nil); err != nil {
+			log.Warnf("filter policy may not match Panther notifications: %s", err)
+		}
+	}
+
+	if opstools.ReadOnly() {
+		log.Fatal("snstail subscribes a temporary queue to the topic, it cannot run read-only")
+	}
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region: opts.Region,
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+	*opts.Topic = opstools.MustResolveTopicARN(sess, log, "topic", *opts.Topic, "")
+	sqsClient, snsClient := sqs.New(sess), sns.New(sess)
+
+	if *opts.Cleanup {
+		numRemoved, err := snstail.CleanupLeaked(sqsClient, snsClient, *opts.Topic)
+		log.Infof("removed %d leaked queues and subscriptions", numRemoved)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ctx := context.Background()
+	if *opts.Duration > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, *opts.Duration)
+		defer cancelTimeout()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		caught := <-sig
+		log.Infof("caught %v, cleaning up", caught)
+		cancel() // the tail stops and cleans up below
+	}()
+
+	tail, err := snstail.Setup(sqsClient, snsClient, *opts.Topic, *opts.FilterPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("tailing %s with %s", *opts.Topic, tail.QueueURL)
+
+	numPrinted, runErr := tail.Run(ctx, tailOpts, os.Stdout)
+	if err := tail.Cleanup(); err != nil {
+		log.Errorf("failed to clean up, run with -cleanup to remove leaked resources: %s", err)
+	}
+	if runErr != nil {
+		log.Fatal(runErr)
+	}
+	log.Infof("printed %d messages", numPrinted)
+}
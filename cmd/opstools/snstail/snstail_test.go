@@ -0,0 +1,171 @@
+package snstail
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+const (
+	topicARN = "arn:aws:sns:us-east-1:123456789012:panther-processed-data-notifications"
+	queueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/panther-snstail-x"
+	queueARN = "arn:aws:sqs:us-east-1:123456789012:panther-snstail-x"
+)
+
+func TestSetupAndCleanup(t *testing.T) {
+	sqsClient := &testutils.SqsMock{}
+	snsClient := &testutils.SnsMock{}
+	sqsClient.On("CreateQueue", mock.MatchedBy(func(input *sqs.CreateQueueInput) bool {
+		return strings.HasPrefix(aws.StringValue(input.QueueName), QueueNamePrefix) &&
+			strings.Contains(aws.StringValue(input.Attributes["Policy"]), topicARN)
+	})).Return(&sqs.CreateQueueOutput{QueueUrl: aws.String(queueURL)}, nil).Once()
+	sqsClient.On("GetQueueAttributes", mock.Anything).Return(&sqs.GetQueueAttributesOutput{
+		Attributes: map[string]*string{sqs.QueueAttributeNameQueueArn: aws.String(queueARN)},
+	}, nil).Once()
+	snsClient.On("Subscribe", &sns.SubscribeInput{
+		TopicArn:              aws.String(topicARN),
+		Protocol:              aws.String("sqs"),
+		Endpoint:              aws.String(queueARN),
+		ReturnSubscriptionArn: aws.Bool(true),
+		Attributes:            map[string]*string{"FilterPolicy": aws.String(`{"type":["LogData"]}`)},
+	}).Return(&sns.SubscribeOutput{SubscriptionArn: aws.String(topicARN + ":sub")}, nil).Once()
+
+	tail, err := Setup(sqsClient, snsClient, topicARN, `{"type":["LogData"]}`)
+	require.NoError(t, err)
+	assert.Equal(t, queueURL, tail.QueueURL)
+	assert.Equal(t, topicARN+":sub", tail.SubscriptionARN)
+
+	snsClient.On("Unsubscribe", &sns.UnsubscribeInput{SubscriptionArn: aws.String(topicARN + ":sub")}).
+		Return(&sns.UnsubscribeOutput{}, nil).Once()
+	sqsClient.On("DeleteQueue", &sqs.DeleteQueueInput{QueueUrl: aws.String(queueURL)}).
+		Return(&sqs.DeleteQueueOutput{}, nil).Once()
+	require.NoError(t, tail.Cleanup())
+	require.NoError(t, tail.Cleanup()) // nothing left to remove
+	sqsClient.AssertExpectations(t)
+	snsClient.AssertExpectations(t)
+}
+
+func TestSetupFailureRemovesQueue(t *testing.T) {
+	sqsClient := &testutils.SqsMock{}
+	snsClient := &testutils.SnsMock{}
+	sqsClient.On("CreateQueue", mock.Anything).Return(&sqs.CreateQueueOutput{QueueUrl: aws.String(queueURL)}, nil).Once()
+	sqsClient.On("GetQueueAttributes", mock.Anything).Return(&sqs.GetQueueAttributesOutput{
+		Attributes: map[string]*string{sqs.QueueAttributeNameQueueArn: aws.String(queueARN)},
+	}, nil).Once()
+	snsClient.On("Subscribe", mock.Anything).Return((*sns.SubscribeOutput)(nil), errors.New("denied")).Once()
+	sqsClient.On("DeleteQueue", &sqs.DeleteQueueInput{QueueUrl: aws.String(queueURL)}).
+		Return(&sqs.DeleteQueueOutput{}, nil).Once()
+
+	tail, err := Setup(sqsClient, snsClient, topicARN, "")
+	require.Error(t, err)
+	assert.Nil(t, tail)
+	sqsClient.AssertExpectations(t)
+	snsClient.AssertExpectations(t)
+}
+
+func TestRun(t *testing.T) {
+	notification := func(id, logType, key string) *sqs.Message {
+		body := `{"Type":"Notification","MessageId":"` + id + `","TopicArn":"` + topicARN + `",` +
+			`"Message":"{\"Records\":[{\"s3\":{\"bucket\":{\"name\":\"bucket\"},\"object\":{\"key\":\"` + key + `\",\"size\":10}}}]}",` +
+			`"Timestamp":"2020-11-01T00:00:00.000Z",` +
+			`"MessageAttributes":{"id":{"Type":"String","Value":"` + logType + `"},"type":{"Type":"String","Value":"LogData"}}}`
+		return &sqs.Message{MessageId: aws.String(id), ReceiptHandle: aws.String("handle-" + id), Body: aws.String(body)}
+	}
+
+	sqsClient := &testutils.SqsMock{}
+	sqsClient.On("ReceiveMessageWithContext", mock.Anything, mock.Anything, mock.Anything).Return(&sqs.ReceiveMessageOutput{
+		Messages: []*sqs.Message{
+			notification("1", "AWS.CloudTrail", "a"),
+			notification("2", "AWS.VPCFlow", "b"),
+			notification("3", "AWS.CloudTrail", "c"),
+			notification("4", "AWS.CloudTrail", "d"),
+		},
+	}, nil).Once()
+	sqsClient.On("DeleteMessageBatch", mock.MatchedBy(func(input *sqs.DeleteMessageBatchInput) bool {
+		return len(input.Entries) == 4 // all received messages are removed, printed or not
+	})).Return(&sqs.DeleteMessageBatchOutput{}, nil).Once()
+
+	tail := &Tail{sqsClient: sqsClient, QueueURL: queueURL}
+	var out strings.Builder
+	numPrinted, err := tail.Run(context.Background(), &Options{
+		Attributes:  map[string]string{"id": "AWS.CloudTrail"},
+		MaxMessages: 2,
+	}, &out)
+	require.NoError(t, err)
+	sqsClient.AssertExpectations(t)
+	assert.Equal(t, uint64(2), numPrinted)
+	assert.Equal(t, `--- 1 2020-11-01T00:00:00.000Z
+  id=AWS.CloudTrail
+  type=LogData
+  s3://bucket/a (10 bytes)
+--- 3 2020-11-01T00:00:00.000Z
+  id=AWS.CloudTrail
+  type=LogData
+  s3://bucket/c (10 bytes)
+`, out.String())
+
+	// stopping the context is not an error
+	sqsClient.On("ReceiveMessageWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return((*sqs.ReceiveMessageOutput)(nil), context.Canceled).Once()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	numPrinted, err = tail.Run(ctx, &Options{}, &out)
+	require.NoError(t, err)
+	assert.Zero(t, numPrinted)
+}
+
+func TestCleanupLeaked(t *testing.T) {
+	sqsClient := &testutils.SqsMock{}
+	snsClient := &testutils.SnsMock{}
+	snsClient.On("ListSubscriptionsByTopic", &sns.ListSubscriptionsByTopicInput{TopicArn: aws.String(topicARN)}).
+		Return(&sns.ListSubscriptionsByTopicOutput{
+			Subscriptions: []*sns.Subscription{
+				{Protocol: aws.String("sqs"), Endpoint: aws.String(queueARN), SubscriptionArn: aws.String("leaked")},
+				{
+					Protocol:        aws.String("sqs"),
+					Endpoint:        aws.String("arn:aws:sqs:us-east-1:123456789012:panther-input-data-notifications-queue"),
+					SubscriptionArn: aws.String("kept"),
+				},
+			},
+		}, nil).Once()
+	snsClient.On("Unsubscribe", &sns.UnsubscribeInput{SubscriptionArn: aws.String("leaked")}).
+		Return(&sns.UnsubscribeOutput{}, nil).Once()
+	sqsClient.On("ListQueues", &sqs.ListQueuesInput{QueueNamePrefix: aws.String(QueueNamePrefix)}).
+		Return(&sqs.ListQueuesOutput{QueueUrls: aws.StringSlice([]string{queueURL})}, nil).Once()
+	sqsClient.On("DeleteQueue", &sqs.DeleteQueueInput{QueueUrl: aws.String(queueURL)}).
+		Return(&sqs.DeleteQueueOutput{}, nil).Once()
+
+	numRemoved, err := CleanupLeaked(sqsClient, snsClient, topicARN)
+	require.NoError(t, err)
+	assert.Equal(t, 2, numRemoved)
+	sqsClient.AssertExpectations(t)
+	snsClient.AssertExpectations(t)
+}
@@ -0,0 +1,182 @@
+package sourcehealth
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/pkg/genericapi"
+)
+
+const (
+	sourceAPIFunctionName = "panther-source-api"
+
+	colorRed     = "\x1b[31m"
+	colorGreen   = "\x1b[32m"
+	colorDefault = "\x1b[39m"
+	colorReset   = "\x1b[0m"
+)
+
+// Filter selects the integrations to check, empty fields match all integrations
+type Filter struct {
+	// Types are integration types (e.g. aws-s3)
+	Types []string
+	// Label is a case insensitive substring of the integration label
+	Label string
+}
+
+func (f *Filter) Match(integration *models.SourceIntegration) bool {
+	if len(f.Types) > 0 {
+		var found bool
+		for _, typ := range f.Types {
+			if typ == integration.IntegrationType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return strings.Contains(strings.ToLower(integration.IntegrationLabel), strings.ToLower(f.Label))
+}
+
+// Result is the health of an integration
+type Result struct {
+	IntegrationID    string   `json:"integrationId"`
+	IntegrationLabel string   `json:"integrationLabel"`
+	IntegrationType  string   `json:"integrationType"`
+	Healthy          bool     `json:"healthy"`
+	Failures         []string `json:"failures,omitempty"`
+}
+
+// Audit checks the health of the integrations matching the filter with the source api
+func Audit(lambdaClient lambdaiface.LambdaAPI, filter *Filter) ([]*Result, error) {
+	var integrations []*models.SourceIntegration
+	input := &models.LambdaInput{
+		ListIntegrations: &models.ListIntegrationsInput{},
+	}
+	if err := genericapi.Invoke(lambdaClient, sourceAPIFunctionName, input, &integrations); err != nil {
+		return nil, err
+	}
+
+	var results []*Result
+	for _, integration := range integrations {
+		if !filter.Match(integration) {
+			continue
+		}
+		result := &Result{
+			IntegrationID:    integration.IntegrationID,
+			IntegrationLabel: integration.IntegrationLabel,
+			IntegrationType:  integration.IntegrationType,
+		}
+		var health models.SourceIntegrationHealth
+		input := &models.LambdaInput{
+			CheckIntegration: CheckInput(integration),
+		}
+		if err := genericapi.Invoke(lambdaClient, sourceAPIFunctionName, input, &health); err != nil {
+			// a failed check is reported with the source, the other sources are still checked
+			result.Failures = []string{fmt.Sprintf("health check failed: %s", err)}
+		} else {
+			result.Failures = Failures(&health)
+			result.Healthy = len(result.Failures) == 0
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// CheckInput returns the health check input for the configuration of an integration
+func CheckInput(integration *models.SourceIntegration) *models.CheckIntegrationInput {
+	return &models.CheckIntegrationInput{
+		AWSAccountID:      integration.AWSAccountID,
+		IntegrationType:   integration.IntegrationType,
+		IntegrationLabel:  integration.IntegrationLabel,
+		EnableCWESetup:    integration.CWEEnabled,
+		EnableRemediation: integration.RemediationEnabled,
+		S3Bucket:          integration.S3Bucket,
+		S3Prefix:          integration.S3Prefix,
+		KmsKey:            integration.KmsKey,
+		SqsConfig:         integration.SqsConfig,
+	}
+}
+
+// Failures returns the reasons an integration is unhealthy
+func Failures(health *models.SourceIntegrationHealth) (failures []string) {
+	check := func(name string, status *models.SourceIntegrationItemStatus) {
+		if status.Healthy {
+			return
+		}
+		failure := name + ": " + status.Message
+		if status.ErrorMessage != "" {
+			failure += " (" + status.ErrorMessage + ")"
+		}
+		failures = append(failures, failure)
+	}
+	switch health.IntegrationType {
+	case models.IntegrationTypeAWSScan:
+		check("audit role", &health.AuditRoleStatus)
+		check("cwe role", &health.CWERoleStatus)
+		check("remediation role", &health.RemediationRoleStatus)
+	case models.IntegrationTypeAWS3:
+		check("processing role", &health.ProcessingRoleStatus)
+		check("s3 bucket", &health.S3BucketStatus)
+		check("kms key", &health.KMSKeyStatus)
+	case models.IntegrationTypeSqs:
+		check("sqs queue", &health.SqsStatus)
+	default:
+		failures = append(failures, fmt.Sprintf("unknown integration type %q", health.IntegrationType))
+	}
+	return failures
+}
+
+// PrintTable writes the results as a table with a row per failure
+func PrintTable(w io.Writer, results []*Result, color bool) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	// every cell of the status column has the same number of invisible characters so the columns still align
+	colored := func(status, statusColor string) string {
+		if !color {
+			return status
+		}
+		return statusColor + status + colorReset
+	}
+	fmt.Fprintf(table, "%s\tTYPE\tLABEL\tID\tREASON\n", colored("STATUS", colorDefault))
+	for _, result := range results {
+		status := colored("OK", colorGreen)
+		if !result.Healthy {
+			status = colored("FAIL", colorRed)
+		}
+		reasons := result.Failures
+		if len(reasons) == 0 {
+			reasons = []string{""}
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", status, result.IntegrationType, result.IntegrationLabel,
+			result.IntegrationID, reasons[0])
+		for _, reason := range reasons[1:] {
+			fmt.Fprintf(table, "%s\t\t\t\t%s\n", colored("", colorDefault), reason)
+		}
+	}
+	return table.Flush()
+}
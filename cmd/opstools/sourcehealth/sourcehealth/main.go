@@ -0,0 +1,90 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/sourcehealth"
+)
+
+func main() {
+	opstools.SetUsage("checks the health of all sources and exits non-zero if any source is unhealthy")
+	opts := struct {
+		Types   *string
+		Label   *string
+		JSON    *bool
+		NoColor *bool
+		Debug   *bool
+		Region  *string
+	}{
+		Types:   flag.String("type", "", "Comma separated list of integration types to check (e.g. aws-s3,aws-sqs)"),
+		Label:   flag.String("label", "", "Only check integrations with labels containing this (case insensitive)"),
+		JSON:    flag.Bool("json", false, "Print the results as JSON"),
+		NoColor: flag.Bool("no-color", false, "Disable colors in the table"),
+		Debug:   flag.Bool("debug", false, "Enable additional logging"),
+		Region:  flag.String("region", "", "Set the AWS region to run on"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+
+	filter := &sourcehealth.Filter{
+		Label: *opts.Label,
+	}
+	if *opts.Types != "" {
+		filter.Types = strings.Split(*opts.Types, ",")
+	}
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region: opts.Region,
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+
+	results, err := sourcehealth.Audit(lambda.New(sess), filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *opts.JSON {
+		encoder := jsoniter.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(results)
+	} else {
+		err = sourcehealth.PrintTable(os.Stdout, results, !*opts.NoColor)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, result := range results {
+		if !result.Healthy {
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package sourcehealth
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+func newIntegration(id, label, typ string) *models.SourceIntegration {
+	return &models.SourceIntegration{
+		SourceIntegrationMetadata: models.SourceIntegrationMetadata{
+			IntegrationID:    id,
+			IntegrationLabel: label,
+			IntegrationType:  typ,
+			S3Bucket:         "bucket-" + id,
+		},
+	}
+}
+
+func invokePayload(t *testing.T, input *models.LambdaInput) interface{} {
+	payload, err := jsoniter.Marshal(input)
+	require.NoError(t, err)
+	return &lambda.InvokeInput{
+		FunctionName: aws.String(sourceAPIFunctionName),
+		Payload:      payload,
+	}
+}
+
+func invokeOutput(t *testing.T, output interface{}) *lambda.InvokeOutput {
+	payload, err := jsoniter.Marshal(output)
+	require.NoError(t, err)
+	return &lambda.InvokeOutput{Payload: payload}
+}
+
+func TestFilter(t *testing.T) {
+	integration := newIntegration("a", "Prod CloudTrail", models.IntegrationTypeAWS3)
+	assert.True(t, (&Filter{}).Match(integration))
+	assert.True(t, (&Filter{Label: "cloudtrail"}).Match(integration))
+	assert.False(t, (&Filter{Label: "dev"}).Match(integration))
+	assert.True(t, (&Filter{Types: []string{models.IntegrationTypeSqs, models.IntegrationTypeAWS3}}).Match(integration))
+	assert.False(t, (&Filter{Types: []string{models.IntegrationTypeSqs}}).Match(integration))
+}
+
+func TestFailures(t *testing.T) {
+	health := &models.SourceIntegrationHealth{
+		IntegrationType:      models.IntegrationTypeAWS3,
+		ProcessingRoleStatus: models.SourceIntegrationItemStatus{Healthy: true},
+		S3BucketStatus:       models.SourceIntegrationItemStatus{Message: "cannot read bucket", ErrorMessage: "AccessDenied"},
+		KMSKeyStatus:         models.SourceIntegrationItemStatus{Healthy: true},
+		SqsStatus:            models.SourceIntegrationItemStatus{}, // not checked for s3 sources
+	}
+	assert.Equal(t, []string{"s3 bucket: cannot read bucket (AccessDenied)"}, Failures(health))
+
+	health.S3BucketStatus.Healthy = true
+	assert.Empty(t, Failures(health))
+}
+
+func TestAudit(t *testing.T) {
+	healthy := newIntegration("a", "healthy", models.IntegrationTypeAWS3)
+	unhealthy := newIntegration("b", "unhealthy", models.IntegrationTypeAWS3)
+	failed := newIntegration("c", "failed", models.IntegrationTypeAWS3)
+	filtered := newIntegration("d", "filtered", models.IntegrationTypeSqs)
+
+	lambdaClient := &testutils.LambdaMock{}
+	lambdaClient.On("Invoke", invokePayload(t, &models.LambdaInput{ListIntegrations: &models.ListIntegrationsInput{}})).
+		Return(invokeOutput(t, []*models.SourceIntegration{healthy, unhealthy, failed, filtered}), nil).Once()
+	lambdaClient.On("Invoke", invokePayload(t, &models.LambdaInput{CheckIntegration: CheckInput(healthy)})).
+		Return(invokeOutput(t, &models.SourceIntegrationHealth{
+			IntegrationType:      models.IntegrationTypeAWS3,
+			ProcessingRoleStatus: models.SourceIntegrationItemStatus{Healthy: true},
+			S3BucketStatus:       models.SourceIntegrationItemStatus{Healthy: true},
+			KMSKeyStatus:         models.SourceIntegrationItemStatus{Healthy: true},
+		}), nil).Once()
+	lambdaClient.On("Invoke", invokePayload(t, &models.LambdaInput{CheckIntegration: CheckInput(unhealthy)})).
+		Return(invokeOutput(t, &models.SourceIntegrationHealth{
+			IntegrationType:      models.IntegrationTypeAWS3,
+			ProcessingRoleStatus: models.SourceIntegrationItemStatus{Message: "cannot assume role"},
+			S3BucketStatus:       models.SourceIntegrationItemStatus{Healthy: true},
+			KMSKeyStatus:         models.SourceIntegrationItemStatus{Healthy: true},
+		}), nil).Once()
+	lambdaClient.On("Invoke", invokePayload(t, &models.LambdaInput{CheckIntegration: CheckInput(failed)})).
+		Return((*lambda.InvokeOutput)(nil), errors.New("throttled")).Once()
+
+	results, err := Audit(lambdaClient, &Filter{Types: []string{models.IntegrationTypeAWS3}})
+	require.NoError(t, err)
+	lambdaClient.AssertExpectations(t)
+	require.Len(t, results, 3)
+	assert.Equal(t, &Result{
+		IntegrationID:    "a",
+		IntegrationLabel: "healthy",
+		IntegrationType:  models.IntegrationTypeAWS3,
+		Healthy:          true,
+	}, results[0])
+	assert.False(t, results[1].Healthy)
+	assert.Equal(t, []string{"processing role: cannot assume role"}, results[1].Failures)
+	assert.False(t, results[2].Healthy)
+	require.Len(t, results[2].Failures, 1)
+	assert.Contains(t, results[2].Failures[0], "throttled")
+
+	var out strings.Builder
+	require.NoError(t, PrintTable(&out, results, false))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 4)
+	assert.True(t, strings.HasPrefix(lines[1], "OK "))
+	assert.True(t, strings.HasPrefix(lines[2], "FAIL "))
+	assert.Contains(t, lines[2], "processing role: cannot assume role")
+}
@@ -0,0 +1,100 @@
+package sourcemap
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// SourceLogTypes is an entry of a sources file, the part of a source that resolves the log types of its files.
+// A sources file lets tools resolve log types offline, without invoking the source API.
+type SourceLogTypes struct {
+	IntegrationID    string   `json:"integrationId" yaml:"integrationId"`
+	IntegrationLabel string   `json:"integrationLabel,omitempty" yaml:"integrationLabel,omitempty"`
+	S3Bucket         string   `json:"s3Bucket,omitempty" yaml:"s3Bucket,omitempty"`
+	S3Prefix         string   `json:"s3Prefix,omitempty" yaml:"s3Prefix,omitempty"`
+	LogTypes         []string `json:"logTypes" yaml:"logTypes"`
+}
+
+// ReadSourcesFile reads the sources of a sources file, YAML if its extension is .yml or .yaml and JSON otherwise
+func ReadSourcesFile(path string) ([]*Source, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read sources file")
+	}
+	var entries []*SourceLogTypes
+	if isYAML(path) {
+		err = yaml.UnmarshalStrict(data, &entries)
+	} else {
+		err = jsoniter.Unmarshal(data, &entries)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse sources file %s", path)
+	}
+	sources := make([]*Source, 0, len(entries))
+	for i, entry := range entries {
+		if entry.IntegrationID == "" || len(entry.LogTypes) == 0 {
+			return nil, errors.Errorf("source %d of %s needs an integrationId and logTypes", i+1, path)
+		}
+		sources = append(sources, &Source{
+			IntegrationID:    entry.IntegrationID,
+			IntegrationLabel: entry.IntegrationLabel,
+			S3Bucket:         entry.S3Bucket,
+			S3Prefix:         entry.S3Prefix,
+			LogTypes:         entry.LogTypes,
+			Tables:           logTypeTables(entry.LogTypes),
+		})
+	}
+	return sources, nil
+}
+
+// WriteSourcesFile writes the log types of sources to a sources file, in the format of ReadSourcesFile
+func WriteSourcesFile(path string, sources []*Source) error {
+	entries := make([]*SourceLogTypes, 0, len(sources))
+	for _, source := range sources {
+		entries = append(entries, &SourceLogTypes{
+			IntegrationID:    source.IntegrationID,
+			IntegrationLabel: source.IntegrationLabel,
+			S3Bucket:         source.S3Bucket,
+			S3Prefix:         source.S3Prefix,
+			LogTypes:         source.LogTypes,
+		})
+	}
+	var data []byte
+	var err error
+	if isYAML(path) {
+		data, err = yaml.Marshal(entries)
+	} else {
+		data, err = jsoniter.MarshalIndent(entries, "", "  ")
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal sources")
+	}
+	return errors.Wrap(ioutil.WriteFile(path, data, 0600), "failed to write sources file")
+}
+
+func isYAML(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".yml" || ext == ".yaml"
+}
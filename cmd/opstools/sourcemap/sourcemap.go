@@ -0,0 +1,321 @@
+package sourcemap
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/glue/glueiface"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/cmd/opstools/lakemigrate"
+	"github.com/panther-labs/panther/cmd/opstools/sourcehealth"
+	"github.com/panther-labs/panther/internal/log_analysis/awsglue"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+	"github.com/panther-labs/panther/pkg/awsretry"
+	"github.com/panther-labs/panther/pkg/genericapi"
+	"github.com/panther-labs/panther/pkg/s3path"
+)
+
+const sourceAPIFunctionName = "panther-source-api"
+
+// sourceAPIRetryer retries the throttled and transient failures of the source API, so that a run resolving log types
+// does not fail on a blip at its start
+var sourceAPIRetryer = &awsretry.Retryer{MaxElapsedTime: time.Minute, Classify: classifySourceAPIError}
+
+// the message of the error payload of a Lambda invocation that timed out
+const lambdaTimeoutMessage = "Task timed out"
+
+// classifies the failures of the source API, an invocation timing out (e.g. on a cold start) is retried as transient.
+// A timeout is not an error of the Lambda API, it is the FunctionError payload of the invocation.
+func classifySourceAPIError(err error) awsretry.Class {
+	var lambdaErr *genericapi.LambdaError
+	if errors.As(err, &lambdaErr) && strings.Contains(aws.StringValue(lambdaErr.ErrorMessage), lambdaTimeoutMessage) {
+		return awsretry.Transient
+	}
+	return awsretry.Classify(err)
+}
+
+// Databases are the databases with tables of log types
+var Databases = []string{
+	pantherdb.LogProcessingDatabase,
+	pantherdb.RuleMatchDatabase,
+	pantherdb.RuleErrorsDatabase,
+	pantherdb.CloudSecurityDatabase,
+}
+
+// latestPartitionLookbacks are the growing windows scanned for the latest partition of a table,
+// so that tables with recent data are resolved without listing all their partitions.
+var latestPartitionLookbacks = []time.Duration{
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+	31 * 24 * time.Hour,
+	366 * 24 * time.Hour,
+}
+
+// Source is an integration and the locations of its data
+type Source struct {
+	IntegrationID    string   `json:"integrationId"`
+	IntegrationLabel string   `json:"integrationLabel"`
+	IntegrationType  string   `json:"integrationType"`
+	S3Bucket         string   `json:"s3Bucket,omitempty"`
+	S3Prefix         string   `json:"s3Prefix,omitempty"`
+	LogTypes         []string `json:"logTypes"`
+	Tables           []*Table `json:"tables"`
+	// CreatedAtTime and LastEventReceived tell sources that are too recent to have data from idle sources
+	CreatedAtTime     time.Time  `json:"createdAtTime"`
+	LastEventReceived *time.Time `json:"lastEventReceived,omitempty"`
+	// BackfillHistory are the back-fills of the source, the most recent first, only listed if verbose
+	BackfillHistory []*models.BackfillRecord `json:"backfillHistory,omitempty"`
+}
+
+// Table is a table a source writes to
+type Table struct {
+	lakemigrate.Table
+	// LatestPartition is the hour of the most recent partition in the catalog, nil if the table has no partitions
+	LatestPartition *time.Time `json:"latestPartition,omitempty"`
+}
+
+// NewSource returns the locations of an integration
+func NewSource(integration *models.SourceIntegration) *Source {
+	source := &Source{
+		IntegrationID:     integration.IntegrationID,
+		IntegrationLabel:  integration.IntegrationLabel,
+		IntegrationType:   integration.IntegrationType,
+		S3Bucket:          integration.RequiredS3Bucket(),
+		S3Prefix:          integration.RequiredS3Prefix(),
+		LogTypes:          integration.RequiredLogTypes(),
+		CreatedAtTime:     integration.CreatedAtTime,
+		LastEventReceived: integration.LastEventReceived,
+		BackfillHistory:   integration.BackfillHistory,
+	}
+	source.Tables = logTypeTables(source.LogTypes)
+	return source
+}
+
+// returns the tables of the log types in all the Databases
+func logTypeTables(logTypes []string) (tables []*Table) {
+	for _, table := range lakemigrate.LogTypeTables(logTypes, Databases) {
+		tables = append(tables, &Table{Table: table})
+	}
+	return tables
+}
+
+// ListSources returns the sources of the integrations matching the filter, with their back-fill history if verbose
+func ListSources(lambdaClient lambdaiface.LambdaAPI, filter *sourcehealth.Filter, verbose bool) ([]*Source, error) {
+	var integrations []*models.SourceIntegration
+	input := &models.LambdaInput{
+		ListIntegrations: &models.ListIntegrationsInput{Verbose: verbose},
+	}
+	err := sourceAPIRetryer.Do(context.Background(), func() error {
+		integrations = nil // a failed response leaves nothing behind
+		return genericapi.Invoke(lambdaClient, sourceAPIFunctionName, input, &integrations)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var sources []*Source
+	for _, integration := range integrations {
+		if filter.Match(integration) {
+			sources = append(sources, NewSource(integration))
+		}
+	}
+	return sources, nil
+}
+
+// Owns returns true if the source reads the S3 object
+func (s *Source) Owns(bucket, key string) bool {
+	return s.S3Bucket == bucket && strings.HasPrefix(key, s.S3Prefix)
+}
+
+// Writes returns true if the source writes to the table, an empty database matches all databases
+func (s *Source) Writes(database, table string) bool {
+	for _, t := range s.Tables {
+		if t.Name == table && (database == "" || t.Database == database) {
+			return true
+		}
+	}
+	return false
+}
+
+// Find returns the sources owning an S3 object (s3://bucket/key) or writing to a table ([database.]table).
+// An object of the data lake matches the sources writing to its table.
+func Find(sources []*Source, query string) ([]*Source, error) {
+	var match func(source *Source) bool
+	if strings.HasPrefix(query, "s3://") {
+		path, err := s3path.Parse(query)
+		if err != nil {
+			return nil, err
+		}
+		match = func(source *Source) bool {
+			return source.Owns(path.Bucket, path.Key)
+		}
+		if partition, err := awsglue.PartitionFromS3Object(path.Bucket, path.Key); err == nil {
+			match = func(source *Source) bool {
+				return source.Writes(partition.GetDatabase(), partition.GetTable())
+			}
+		}
+	} else {
+		database, table := "", query
+		if i := strings.IndexByte(query, '.'); i != -1 {
+			database, table = query[:i], query[i+1:]
+		}
+		if table == "" {
+			return nil, errors.Errorf("invalid table %q", query)
+		}
+		match = func(source *Source) bool {
+			return source.Writes(database, table)
+		}
+	}
+
+	var found []*Source
+	for _, source := range sources {
+		if match(source) {
+			found = append(found, source)
+		}
+	}
+	return found, nil
+}
+
+// SetLatestPartitions looks up the latest partition of the source tables in the catalog.
+// Tables shared by sources are looked up once.
+func SetLatestPartitions(glueClient glueiface.GlueAPI, sources []*Source, now time.Time) error {
+	latest := make(map[lakemigrate.Table]*time.Time)
+	for _, source := range sources {
+		for _, table := range source.Tables {
+			partition, found := latest[table.Table]
+			if !found {
+				var err error
+				if partition, err = LatestPartition(glueClient, table.Database, table.Name, now); err != nil {
+					return err
+				}
+				latest[table.Table] = partition
+			}
+			table.LatestPartition = partition
+		}
+	}
+	return nil
+}
+
+// LatestPartition returns the hour of the most recent partition of a table, nil if it has no partitions
+func LatestPartition(glueClient glueiface.GlueAPI, database, table string, now time.Time) (*time.Time, error) {
+	for _, lookback := range latestPartitionLookbacks {
+		latest, err := latestPartition(glueClient, database, table, awsglue.GlueTableHourly.PartitionsAfter(now.Add(-lookback)))
+		if err != nil || latest != nil {
+			return latest, err
+		}
+	}
+	return latestPartition(glueClient, database, table, "")
+}
+
+func latestPartition(glueClient glueiface.GlueAPI, database, table, expression string) (*time.Time, error) {
+	input := &glue.GetPartitionsInput{
+		DatabaseName: aws.String(database),
+		TableName:    aws.String(table),
+	}
+	if expression != "" {
+		input.Expression = aws.String(expression)
+	}
+	var latest *time.Time
+	for {
+		output, err := glueClient.GetPartitions(input)
+		if err != nil {
+			var awsErr awserr.Error
+			if errors.As(err, &awsErr) && awsErr.Code() == glue.ErrCodeEntityNotFoundException {
+				return nil, nil // the table is created with the first data
+			}
+			return nil, errors.Wrapf(err, "failed to get partitions of %s.%s", database, table)
+		}
+		for _, partition := range output.Partitions {
+			tm, err := awsglue.PartitionTimeFromValues(partition.Values)
+			if err != nil {
+				continue
+			}
+			if latest == nil || tm.After(*latest) {
+				latest = &tm
+			}
+		}
+		if output.NextToken == nil {
+			return latest, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+// PrintTable writes the sources as a table with a row per source table
+func PrintTable(w io.Writer, sources []*Source) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TYPE\tLABEL\tID\tLOCATION\tLOG TYPE\tTABLE\tLATEST PARTITION")
+	for _, source := range sources {
+		location := "s3://" + source.S3Bucket + "/" + source.S3Prefix
+		if source.S3Bucket == "" {
+			location = "-"
+		}
+		if len(source.Tables) == 0 {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t-\t-\t-\n", source.IntegrationType, source.IntegrationLabel,
+				source.IntegrationID, location)
+			continue
+		}
+		for i, t := range source.Tables {
+			latest := "-"
+			if t.LatestPartition != nil {
+				latest = t.LatestPartition.Format("2006-01-02T15")
+			}
+			if i == 0 {
+				fmt.Fprintf(table, "%s\t%s\t%s\t%s\t", source.IntegrationType, source.IntegrationLabel,
+					source.IntegrationID, location)
+			} else {
+				fmt.Fprint(table, "\t\t\t\t")
+			}
+			fmt.Fprintf(table, "%s\t%s.%s\t%s\n", t.LogType, t.Database, t.Name, latest)
+		}
+	}
+	return table.Flush()
+}
+
+// PrintBackfillHistory writes the back-fills of the sources as a table with a row per back-fill
+func PrintBackfillHistory(w io.Writer, sources []*Source) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "LABEL\tID\tRUN ID\tSTART\tEND\tSTATUS\tFILES\tBY")
+	for _, source := range sources {
+		for _, record := range source.BackfillHistory {
+			end := "-"
+			if record.EndTime != nil {
+				end = record.EndTime.Format(time.RFC3339)
+			}
+			actor := record.Actor
+			if actor == "" {
+				actor = "-"
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", source.IntegrationLabel, source.IntegrationID,
+				record.RunID, record.StartTime.Format(time.RFC3339), end, record.Status, record.NumFiles, actor)
+		}
+	}
+	return table.Flush()
+}
@@ -0,0 +1,113 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/sourcehealth"
+	"github.com/panther-labs/panther/cmd/opstools/sourcemap"
+)
+
+func main() {
+	opstools.SetUsage("lists sources with the S3 locations they read and the tables they write")
+	opts := struct {
+		Find         *string
+		Types        *string
+		Label        *string
+		JSON         *bool
+		NoPartitions *bool
+		Verbose      *bool
+		Debug        *bool
+		Region       *string
+	}{
+		Find: flag.String("find", "",
+			"Only list the sources owning an S3 object (s3://bucket/key) or writing to a table ([database.]table)"),
+		Types:        flag.String("type", "", "Comma separated list of integration types to list (e.g. aws-s3,aws-sqs)"),
+		Label:        flag.String("label", "", "Only list integrations with labels containing this (case insensitive)"),
+		JSON:         flag.Bool("json", false, "Print the sources as JSON"),
+		NoPartitions: flag.Bool("no-partitions", false, "Do not look up the latest partition of the tables"),
+		Verbose:      flag.Bool("verbose", false, "List the back-fill history of the sources too"),
+		Debug:        flag.Bool("debug", false, "Enable additional logging"),
+		Region:       flag.String("region", "", "Set the AWS region to run on"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+
+	filter := &sourcehealth.Filter{
+		Label: *opts.Label,
+	}
+	if *opts.Types != "" {
+		filter.Types = strings.Split(*opts.Types, ",")
+	}
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region: opts.Region,
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+
+	sources, err := sourcemap.ListSources(lambda.New(sess), filter, *opts.Verbose)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *opts.Find != "" {
+		if sources, err = sourcemap.Find(sources, *opts.Find); err != nil {
+			log.Fatal(err)
+		}
+		if len(sources) == 0 {
+			log.Warnf("no source owns %s", *opts.Find)
+		}
+	}
+	if !*opts.NoPartitions {
+		if err := sourcemap.SetLatestPartitions(glue.New(sess), sources, time.Now()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *opts.JSON {
+		if sources == nil {
+			sources = []*sourcemap.Source{} // consumers expect an array
+		}
+		encoder := jsoniter.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(sources)
+	} else {
+		err = sourcemap.PrintTable(os.Stdout, sources)
+		if err == nil && *opts.Verbose {
+			fmt.Println()
+			err = sourcemap.PrintBackfillHistory(os.Stdout, sources)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
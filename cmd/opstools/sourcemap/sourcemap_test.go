@@ -0,0 +1,348 @@
+package sourcemap
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/cmd/opstools/lakemigrate"
+	"github.com/panther-labs/panther/cmd/opstools/sourcehealth"
+	"github.com/panther-labs/panther/internal/log_analysis/awsglue"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+	"github.com/panther-labs/panther/pkg/awsretry"
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+var testNow = time.Date(2020, 11, 10, 12, 30, 0, 0, time.UTC)
+
+func s3Integration(id, bucket, prefix string, logTypes ...string) *models.SourceIntegration {
+	return &models.SourceIntegration{
+		SourceIntegrationMetadata: models.SourceIntegrationMetadata{
+			IntegrationID:    id,
+			IntegrationLabel: "label-" + id,
+			IntegrationType:  models.IntegrationTypeAWS3,
+			S3Bucket:         bucket,
+			S3Prefix:         prefix,
+			LogTypes:         logTypes,
+		},
+	}
+}
+
+func sqsIntegration(id string, logTypes ...string) *models.SourceIntegration {
+	return &models.SourceIntegration{
+		SourceIntegrationMetadata: models.SourceIntegrationMetadata{
+			IntegrationID:    id,
+			IntegrationLabel: "label-" + id,
+			IntegrationType:  models.IntegrationTypeSqs,
+			SqsConfig: &models.SqsConfig{
+				LogTypes: logTypes,
+				S3Bucket: "panther-input",
+			},
+		},
+	}
+}
+
+func testSources() []*Source {
+	return []*Source{
+		NewSource(s3Integration("trail", "logs-bucket", "cloudtrail/", "AWS.CloudTrail")),
+		NewSource(s3Integration("access", "logs-bucket", "access/", "AWS.S3ServerAccess", "AWS.CloudTrail")),
+		NewSource(sqsIntegration("queue", "Apache.AccessCombined")),
+	}
+}
+
+func ids(sources []*Source) (ids []string) {
+	for _, source := range sources {
+		ids = append(ids, source.IntegrationID)
+	}
+	return ids
+}
+
+func partitions(hours ...time.Time) *glue.GetPartitionsOutput {
+	output := &glue.GetPartitionsOutput{}
+	for _, hour := range hours {
+		output.Partitions = append(output.Partitions, &glue.Partition{
+			Values: awsglue.GlueTableHourly.PartitionValuesFromTime(hour),
+		})
+	}
+	return output
+}
+
+func TestNewSource(t *testing.T) {
+	source := NewSource(s3Integration("trail", "logs-bucket", "cloudtrail/", "AWS.CloudTrail"))
+	assert.Equal(t, &Source{
+		IntegrationID:    "trail",
+		IntegrationLabel: "label-trail",
+		IntegrationType:  models.IntegrationTypeAWS3,
+		S3Bucket:         "logs-bucket",
+		S3Prefix:         "cloudtrail/",
+		LogTypes:         []string{"AWS.CloudTrail"},
+		Tables: []*Table{
+			{Table: lakemigrate.Table{Database: pantherdb.LogProcessingDatabase, Name: "aws_cloudtrail", LogType: "AWS.CloudTrail"}},
+			{Table: lakemigrate.Table{Database: pantherdb.RuleMatchDatabase, Name: "aws_cloudtrail", LogType: "AWS.CloudTrail"}},
+			{Table: lakemigrate.Table{Database: pantherdb.RuleErrorsDatabase, Name: "aws_cloudtrail", LogType: "AWS.CloudTrail"}},
+		},
+	}, source)
+
+	source = NewSource(sqsIntegration("queue", "Apache.AccessCombined"))
+	assert.Equal(t, "panther-input", source.S3Bucket)
+	assert.Equal(t, "forwarder", source.S3Prefix)
+	assert.Equal(t, []string{"Apache.AccessCombined"}, source.LogTypes)
+	assert.Len(t, source.Tables, 3)
+
+	// the tables of a source are JSON objects with the table fields
+	data, err := jsoniter.MarshalToString(source.Tables[0])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"database":"panther_logs","name":"apache_accesscombined","logType":"Apache.AccessCombined"}`, data)
+}
+
+func TestSourcesFile(t *testing.T) {
+	sources := testSources()
+	for _, name := range []string{"sources.json", "sources.yaml"} {
+		path := filepath.Join(t.TempDir(), name)
+		require.NoError(t, WriteSourcesFile(path, sources))
+		read, err := ReadSourcesFile(path)
+		require.NoError(t, err, name)
+		require.Len(t, read, len(sources))
+		for i, source := range read {
+			assert.Equal(t, sources[i].IntegrationID, source.IntegrationID, name)
+			assert.Equal(t, sources[i].S3Bucket, source.S3Bucket, name)
+			assert.Equal(t, sources[i].S3Prefix, source.S3Prefix, name)
+			assert.Equal(t, sources[i].LogTypes, source.LogTypes, name)
+			assert.Equal(t, sources[i].Tables, source.Tables, name)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "sources.yml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("- integrationId: trail\n  s3Bucket: logs-bucket\n"), 0600))
+	_, err := ReadSourcesFile(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "source 1 of "+path+" needs an integrationId and logTypes")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("- integrationId: trail\n  logtypes: [AWS.CloudTrail]\n"), 0600))
+	_, err = ReadSourcesFile(path)
+	require.Error(t, err) // unknown fields are typos
+}
+
+func TestFind(t *testing.T) {
+	sources := testSources()
+	for _, tc := range []struct {
+		query    string
+		expected []string
+	}{
+		{"s3://logs-bucket/cloudtrail/2020/11/01/object.json.gz", []string{"trail"}},
+		{"s3://logs-bucket/access/object.log", []string{"access"}},
+		{"s3://logs-bucket/other/object.log", nil},
+		{"s3://other-bucket/cloudtrail/object.json.gz", nil},
+		{"s3://panther-input/forwarder/object", []string{"queue"}},
+		// objects of the data lake are matched by table
+		{"s3://processed/logs/aws_cloudtrail/year=2020/month=11/day=01/hour=00/object.json.gz", []string{"trail", "access"}},
+		{"s3://processed/rules/aws_s3serveraccess/year=2020/month=11/day=01/hour=00/object.json.gz", []string{"access"}},
+		{"aws_cloudtrail", []string{"trail", "access"}},
+		{"panther_rule_errors.apache_accesscombined", []string{"queue"}},
+		{"panther_cloudsecurity.aws_cloudtrail", nil},
+		{"unknown_table", nil},
+	} {
+		found, err := Find(sources, tc.query)
+		require.NoError(t, err, tc.query)
+		assert.Equal(t, tc.expected, ids(found), tc.query)
+	}
+
+	_, err := Find(sources, "panther_logs.")
+	assert.Error(t, err)
+	_, err = Find(sources, "s3://")
+	assert.Error(t, err)
+}
+
+func TestListSources(t *testing.T) {
+	lambdaClient := &testutils.LambdaMock{}
+	payload, err := jsoniter.Marshal(&models.LambdaInput{ListIntegrations: &models.ListIntegrationsInput{}})
+	require.NoError(t, err)
+	output, err := jsoniter.Marshal([]*models.SourceIntegration{
+		s3Integration("trail", "logs-bucket", "cloudtrail/", "AWS.CloudTrail"),
+		sqsIntegration("queue", "Apache.AccessCombined"),
+	})
+	require.NoError(t, err)
+	lambdaClient.On("Invoke", &lambda.InvokeInput{
+		FunctionName: aws.String(sourceAPIFunctionName),
+		Payload:      payload,
+	}).Return(&lambda.InvokeOutput{Payload: output}, nil).Once()
+
+	sources, err := ListSources(lambdaClient, &sourcehealth.Filter{Types: []string{models.IntegrationTypeSqs}}, false)
+	require.NoError(t, err)
+	lambdaClient.AssertExpectations(t)
+	assert.Equal(t, []string{"queue"}, ids(sources))
+
+	lambdaClient = &testutils.LambdaMock{}
+	lambdaClient.On("Invoke", mock.Anything).Return((*lambda.InvokeOutput)(nil), errors.New("denied")).Once()
+	_, err = ListSources(lambdaClient, &sourcehealth.Filter{}, false)
+	assert.Error(t, err)
+	lambdaClient.AssertExpectations(t) // not retried
+
+	// a throttled call is retried, the sources of the call that succeeds are returned
+	defer func(retryer *awsretry.Retryer) { sourceAPIRetryer = retryer }(sourceAPIRetryer)
+	sourceAPIRetryer = &awsretry.Retryer{InitialInterval: time.Millisecond, Classify: classifySourceAPIError}
+	lambdaClient = &testutils.LambdaMock{}
+	throttled := awserr.New(lambda.ErrCodeTooManyRequestsException, "Rate exceeded", nil)
+	lambdaClient.On("Invoke", mock.Anything).Return((*lambda.InvokeOutput)(nil), throttled).Once()
+	lambdaClient.On("Invoke", mock.Anything).Return(&lambda.InvokeOutput{Payload: output}, nil).Once()
+	sources, err = ListSources(lambdaClient, &sourcehealth.Filter{}, false)
+	require.NoError(t, err)
+	lambdaClient.AssertExpectations(t)
+	assert.Equal(t, []string{"trail", "queue"}, ids(sources))
+
+	// an invocation timing out on a cold start is retried
+	lambdaClient = &testutils.LambdaMock{}
+	lambdaClient.On("Invoke", mock.Anything).Return(&lambda.InvokeOutput{
+		FunctionError: aws.String("Unhandled"),
+		Payload:       []byte(`{"errorMessage":"2020-11-10T08:00:00.000Z 1234 Task timed out after 10.01 seconds"}`),
+	}, nil).Once()
+	lambdaClient.On("Invoke", mock.Anything).Return(&lambda.InvokeOutput{Payload: output}, nil).Once()
+	sources, err = ListSources(lambdaClient, &sourcehealth.Filter{}, false)
+	require.NoError(t, err)
+	lambdaClient.AssertExpectations(t)
+	assert.Equal(t, []string{"trail", "queue"}, ids(sources))
+
+	// the other errors of the function are not
+	lambdaClient = &testutils.LambdaMock{}
+	lambdaClient.On("Invoke", mock.Anything).Return(&lambda.InvokeOutput{
+		FunctionError: aws.String("Unhandled"),
+		Payload:       []byte(`{"errorMessage":"invalid input","errorType":"InvalidInputError"}`),
+	}, nil).Once()
+	_, err = ListSources(lambdaClient, &sourcehealth.Filter{}, false)
+	assert.Error(t, err)
+	lambdaClient.AssertExpectations(t)
+}
+
+func TestLatestPartition(t *testing.T) {
+	glueClient := &testutils.GlueMock{}
+	expression := func(lookback time.Duration) interface{} {
+		return mock.MatchedBy(func(input *glue.GetPartitionsInput) bool {
+			return aws.StringValue(input.Expression) == awsglue.GlueTableHourly.PartitionsAfter(testNow.Add(-lookback))
+		})
+	}
+	// nothing in the last day, the last week has two pages
+	glueClient.On("GetPartitions", expression(24*time.Hour)).Return(partitions(), nil).Once()
+	glueClient.On("GetPartitions", mock.MatchedBy(func(input *glue.GetPartitionsInput) bool {
+		return aws.StringValue(input.Expression) == awsglue.GlueTableHourly.PartitionsAfter(testNow.Add(-7*24*time.Hour)) &&
+			input.NextToken == nil
+	})).Return(&glue.GetPartitionsOutput{
+		Partitions: partitions(testNow.Add(-30*time.Hour), testNow.Add(-50*time.Hour)).Partitions,
+		NextToken:  aws.String("next"),
+	}, nil).Once()
+	glueClient.On("GetPartitions", mock.MatchedBy(func(input *glue.GetPartitionsInput) bool {
+		return aws.StringValue(input.NextToken) == "next"
+	})).Return(partitions(testNow.Add(-26*time.Hour)), nil).Once()
+
+	latest, err := LatestPartition(glueClient, pantherdb.LogProcessingDatabase, "aws_cloudtrail", testNow)
+	require.NoError(t, err)
+	glueClient.AssertExpectations(t)
+	require.NotNil(t, latest)
+	assert.Equal(t, time.Date(2020, 11, 9, 10, 0, 0, 0, time.UTC), *latest)
+
+	// an empty table is scanned without an expression last
+	glueClient = &testutils.GlueMock{}
+	glueClient.On("GetPartitions", mock.MatchedBy(func(input *glue.GetPartitionsInput) bool {
+		return input.Expression != nil
+	})).Return(partitions(), nil).Times(len(latestPartitionLookbacks))
+	glueClient.On("GetPartitions", mock.MatchedBy(func(input *glue.GetPartitionsInput) bool {
+		return input.Expression == nil
+	})).Return(partitions(), nil).Once()
+	latest, err = LatestPartition(glueClient, pantherdb.LogProcessingDatabase, "aws_cloudtrail", testNow)
+	require.NoError(t, err)
+	glueClient.AssertExpectations(t)
+	assert.Nil(t, latest)
+
+	// a missing table has no partitions, every lookback and the scan without an expression find none
+	glueClient = &testutils.GlueMock{}
+	glueClient.On("GetPartitions", mock.Anything).
+		Return((*glue.GetPartitionsOutput)(nil), awserr.New(glue.ErrCodeEntityNotFoundException, "not found", nil)).
+		Times(len(latestPartitionLookbacks) + 1)
+	latest, err = LatestPartition(glueClient, pantherdb.LogProcessingDatabase, "missing", testNow)
+	require.NoError(t, err)
+	glueClient.AssertExpectations(t)
+	assert.Nil(t, latest)
+}
+
+func TestSetLatestPartitions(t *testing.T) {
+	sources := testSources()[:2]
+	hour := testNow.Truncate(time.Hour)
+	glueClient := &testutils.GlueMock{}
+	// the cloudtrail tables are shared by both sources and looked up once
+	glueClient.On("GetPartitions", mock.MatchedBy(func(input *glue.GetPartitionsInput) bool {
+		return aws.StringValue(input.TableName) == "aws_cloudtrail"
+	})).Return(partitions(hour), nil).Times(3)
+	glueClient.On("GetPartitions", mock.MatchedBy(func(input *glue.GetPartitionsInput) bool {
+		return aws.StringValue(input.TableName) == "aws_s3serveraccess"
+	})).Return(partitions(hour.Add(-time.Hour)), nil).Times(3)
+
+	require.NoError(t, SetLatestPartitions(glueClient, sources, testNow))
+	glueClient.AssertExpectations(t)
+	for _, source := range sources {
+		for _, table := range source.Tables {
+			require.NotNil(t, table.LatestPartition, table.Name)
+			if table.Name == "aws_cloudtrail" {
+				assert.Equal(t, hour, *table.LatestPartition)
+			} else {
+				assert.Equal(t, hour.Add(-time.Hour), *table.LatestPartition)
+			}
+		}
+	}
+
+	var out strings.Builder
+	require.NoError(t, PrintTable(&out, sources))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 1+3+6)
+	assert.Contains(t, lines[1], "s3://logs-bucket/cloudtrail/")
+	assert.Contains(t, lines[1], "panther_logs.aws_cloudtrail")
+	assert.Contains(t, lines[1], "2020-11-10T12")
+	assert.True(t, strings.HasPrefix(lines[2], " "))
+}
+
+func TestPrintBackfillHistory(t *testing.T) {
+	sources := testSources()[:2]
+	end := testNow.Add(time.Hour)
+	sources[0].BackfillHistory = []*models.BackfillRecord{
+		{RunID: "second", StartTime: testNow, Status: models.BackfillStatusRunning},
+		{RunID: "first", StartTime: testNow, EndTime: &end, NumFiles: 10, Status: models.BackfillStatusSucceeded, Actor: "ops"},
+	}
+
+	var out strings.Builder
+	require.NoError(t, PrintBackfillHistory(&out, sources))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 1+2)
+	assert.Contains(t, lines[1], "second")
+	assert.Contains(t, lines[1], models.BackfillStatusRunning)
+	assert.Contains(t, lines[2], end.Format(time.RFC3339))
+	assert.Contains(t, lines[2], "ops")
+}
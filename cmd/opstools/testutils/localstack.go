@@ -0,0 +1,162 @@
+package testutils
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+const (
+	// LocalStackEndpointEnv points the tests to an already running LocalStack instead of starting a container
+	LocalStackEndpointEnv = "LOCALSTACK_ENDPOINT"
+
+	localStackImage   = "localstack/localstack:0.12.3"
+	localStackPort    = "4566/tcp" // edge port serving all services
+	localStackRegion  = "us-east-1"
+	localStackTimeout = 2 * time.Minute
+)
+
+// ErrNoLocalStack is returned by StartLocalStack when there is no endpoint configured and docker is not available,
+// tests should skip on it.
+var ErrNoLocalStack = errors.New("no " + LocalStackEndpointEnv + " set and docker is not available")
+
+// LocalStack is a LocalStack endpoint, either configured with LOCALSTACK_ENDPOINT or a container we started
+type LocalStack struct {
+	Endpoint  string
+	container string
+}
+
+// StartLocalStack starts a LocalStack container with the services (e.g., "s3", "sqs", "sns") unless
+// LOCALSTACK_ENDPOINT is set, and waits until they respond.
+func StartLocalStack(services ...string) (*LocalStack, error) {
+	if endpoint := os.Getenv(LocalStackEndpointEnv); endpoint != "" {
+		localStack := &LocalStack{Endpoint: endpoint}
+		return localStack, localStack.waitReady(services)
+	}
+
+	if _, err := exec.LookPath("docker"); err != nil {
+		return nil, ErrNoLocalStack
+	}
+	if err := exec.Command("docker", "info").Run(); err != nil { // installed but the daemon is not running
+		return nil, ErrNoLocalStack
+	}
+
+	output, err := exec.Command("docker", "run", "--detach", "--rm", "--publish", "127.0.0.1::4566",
+		"--env", "SERVICES="+strings.Join(services, ","), localStackImage).Output()
+	if err != nil {
+		return nil, errors.Wrap(commandError(err), "failed to start localstack")
+	}
+	localStack := &LocalStack{container: strings.TrimSpace(string(output))}
+
+	// docker picked a free port, e.g. "127.0.0.1:49153"
+	output, err = exec.Command("docker", "port", localStack.container, localStackPort).Output()
+	if err != nil {
+		_ = localStack.Stop()
+		return nil, errors.Wrap(commandError(err), "failed to find localstack port")
+	}
+	localStack.Endpoint = "http://" + strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+
+	if err := localStack.waitReady(services); err != nil {
+		_ = localStack.Stop()
+		return nil, err
+	}
+	return localStack, nil
+}
+
+// Session returns a session using the LocalStack endpoint for all services
+func (l *LocalStack) Session() *session.Session {
+	return session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String(localStackRegion),
+		Endpoint:         aws.String(l.Endpoint),
+		Credentials:      credentials.NewStaticCredentials("test", "test", ""),
+		S3ForcePathStyle: aws.Bool(true), // bucket names are not resolvable host names
+		DisableSSL:       aws.Bool(strings.HasPrefix(l.Endpoint, "http://")),
+	}))
+}
+
+// Stop removes the container, it does nothing for a configured endpoint
+func (l *LocalStack) Stop() error {
+	if l.container == "" {
+		return nil
+	}
+	if err := exec.Command("docker", "stop", l.container).Run(); err != nil {
+		return errors.Wrapf(commandError(err), "failed to stop localstack container %s", l.container)
+	}
+	return nil
+}
+
+// The services take a while to start after the container, poll them until they all answer
+func (l *LocalStack) waitReady(services []string) error {
+	if _, err := url.Parse(l.Endpoint); err != nil {
+		return errors.Wrapf(err, "invalid localstack endpoint %q", l.Endpoint)
+	}
+	sess := l.Session()
+	ctx, cancel := context.WithTimeout(context.Background(), localStackTimeout)
+	defer cancel()
+	checks := map[string]func() error{
+		"s3": func() error {
+			_, err := s3.New(sess).ListBucketsWithContext(ctx, &s3.ListBucketsInput{})
+			return err
+		},
+		"sqs": func() error {
+			_, err := sqs.New(sess).ListQueuesWithContext(ctx, &sqs.ListQueuesInput{})
+			return err
+		},
+		"sns": func() error {
+			_, err := sns.New(sess).ListTopicsWithContext(ctx, &sns.ListTopicsInput{})
+			return err
+		},
+	}
+	for _, service := range services {
+		check, ok := checks[service]
+		if !ok {
+			continue // no check for it, the other services being ready is good enough
+		}
+		for err := check(); err != nil; err = check() {
+			select {
+			case <-ctx.Done():
+				return errors.Errorf("localstack %s at %s is not ready after %v: %v", service, l.Endpoint, localStackTimeout, err)
+			case <-time.After(time.Second):
+			}
+		}
+	}
+	return nil
+}
+
+// include the stderr of failed commands, it has the reason
+func commandError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return errors.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err
+}
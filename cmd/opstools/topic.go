@@ -0,0 +1,174 @@
+package opstools
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	topicNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+	accountIDRegexp = regexp.MustCompile(`^[0-9]{12}$`)
+)
+
+// ResolveTopicARN returns the ARN of an SNS topic given as a bare name, a full ARN or a console URL of the topic.
+// A bare name is combined with the account and region. A full ARN is taken as is, in any partition, account
+// or region, so that topics of other accounts and of GovCloud or China can be given.
+func ResolveTopicARN(input, account, region string) (string, error) {
+	input = strings.TrimSpace(input)
+	switch {
+	case input == "":
+		return "", errors.New("no topic")
+	case strings.HasPrefix(input, "https://") || strings.HasPrefix(input, "http://"):
+		topicARN, err := topicARNFromURL(input)
+		if err != nil {
+			return "", err
+		}
+		return checkTopicARN(topicARN)
+	case strings.HasPrefix(input, "arn:"):
+		return checkTopicARN(input)
+	}
+	if err := validateTopicName(input); err != nil {
+		return "", err
+	}
+	if account == "" || region == "" {
+		return "", errors.Errorf("topic name %q needs an account and a region to resolve to an ARN", input)
+	}
+	if !accountIDRegexp.MatchString(account) {
+		return "", errors.Errorf("invalid account %q, expected 12 digits", account)
+	}
+	partition := endpoints.AwsPartitionID
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		partition = p.ID()
+	}
+	return arn.ARN{
+		Partition: partition,
+		Service:   "sns",
+		Region:    region,
+		AccountID: account,
+		Resource:  input,
+	}.String(), nil
+}
+
+// the SNS console links to topics as .../sns/v3/home?region=<region>#/topic/<arn>
+func topicARNFromURL(input string) (string, error) {
+	consoleURL, err := url.Parse(input)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid topic URL %q", input)
+	}
+	for _, part := range []string{consoleURL.Fragment, consoleURL.Path, consoleURL.RawQuery} {
+		unescaped, err := url.QueryUnescape(part)
+		if err != nil {
+			continue
+		}
+		if pos := strings.Index(unescaped, "arn:"); pos >= 0 {
+			topicARN := unescaped[pos:]
+			if end := strings.IndexAny(topicARN, "/?&#"); end >= 0 {
+				topicARN = topicARN[:end]
+			}
+			return topicARN, nil
+		}
+	}
+	return "", errors.Errorf("no topic ARN in URL %q", input)
+}
+
+func checkTopicARN(input string) (string, error) {
+	topicARN, err := arn.Parse(input)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid topic ARN %q, expected arn:<partition>:sns:<region>:<account>:<name>", input)
+	}
+	if !isPartition(topicARN.Partition) {
+		return "", errors.Errorf("unknown partition %q in topic ARN %s, expected one of %s",
+			topicARN.Partition, input, strings.Join(partitionIDs(), ", "))
+	}
+	if partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), topicARN.Region); ok &&
+		partition.ID() != topicARN.Partition {
+
+		return "", errors.Errorf("topic ARN %s is in partition %s, but region %s is in partition %s",
+			input, topicARN.Partition, topicARN.Region, partition.ID())
+	}
+	if topicARN.Service != "sns" {
+		return "", errors.Errorf("%s is not an SNS topic ARN, its service is %q", input, topicARN.Service)
+	}
+	if !accountIDRegexp.MatchString(topicARN.AccountID) {
+		return "", errors.Errorf("invalid account %q in topic ARN %s", topicARN.AccountID, input)
+	}
+	if topicARN.Region == "" {
+		return "", errors.Errorf("no region in topic ARN %s", input)
+	}
+	if strings.Contains(topicARN.Resource, ":") {
+		return "", errors.Errorf("%s is a subscription ARN, expected the ARN of its topic", input)
+	}
+	if err := validateTopicName(topicARN.Resource); err != nil {
+		return "", err
+	}
+	return topicARN.String(), nil
+}
+
+func isPartition(id string) bool {
+	for _, partition := range endpoints.DefaultPartitions() {
+		if partition.ID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+func partitionIDs() (ids []string) {
+	for _, partition := range endpoints.DefaultPartitions() {
+		ids = append(ids, partition.ID())
+	}
+	return ids
+}
+
+func validateTopicName(name string) error {
+	if !topicNameRegexp.MatchString(strings.TrimSuffix(name, ".fifo")) || len(name) > 256 {
+		return errors.Errorf("invalid topic name %q, expected at most 256 letters, digits, - and _", name)
+	}
+	return nil
+}
+
+// MustResolveTopicARN resolves a topic flag in the account and the region of the session, see ResolveTopicARN.
+// The account of the caller is used for bare names if account is empty. It logs the resolved ARN and exits on errors.
+func MustResolveTopicARN(sess *session.Session, log *zap.SugaredLogger, flagName, input, account string) string {
+	region := aws.StringValue(sess.Config.Region)
+	if account == "" && !strings.Contains(input, "arn:") && !strings.Contains(input, "arn%3A") {
+		identity, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		if err != nil {
+			log.Fatalf("failed to get caller identity to resolve -%s: %s", flagName, err)
+		}
+		account = aws.StringValue(identity.Account)
+	}
+	topicARN, err := ResolveTopicARN(input, account, region)
+	if err != nil {
+		log.Fatalf("-%s: %s", flagName, err)
+	}
+	log.Infof("resolved -%s to topic %s", flagName, topicARN)
+	return topicARN
+}
@@ -0,0 +1,81 @@
+package opstools
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveTopicARN(t *testing.T) {
+	const account, region = "123456789012", "us-east-1"
+	const topicARN = "arn:aws:sns:us-east-1:123456789012:my-topic"
+	for _, input := range []string{
+		"my-topic",
+		" " + topicARN + " ",
+		"https://us-east-1.console.aws.amazon.com/sns/v3/home?region=us-east-1#/topic/" + topicARN,
+		"https://console.aws.amazon.com/sns/v3/home?region=us-east-1#/topic/arn%3Aaws%3Asns%3Aus-east-1%3A123456789012%3Amy-topic/edit",
+	} {
+		resolved, err := ResolveTopicARN(input, account, region)
+		require.NoError(t, err, input)
+		assert.Equal(t, topicARN, resolved, input)
+	}
+	fifoARN, err := ResolveTopicARN("my-topic.fifo", account, region)
+	require.NoError(t, err)
+	assert.Equal(t, topicARN+".fifo", fifoARN)
+
+	// the account and region only resolve bare names, an ARN is taken as is
+	for _, otherARN := range []string{
+		"arn:aws:sns:eu-west-1:210987654321:my-topic",
+		"arn:aws-us-gov:sns:us-gov-west-1:210987654321:my-topic",
+	} {
+		resolved, err := ResolveTopicARN(otherARN, account, region)
+		require.NoError(t, err, otherARN)
+		assert.Equal(t, otherARN, resolved)
+	}
+
+	chinaARN, err := ResolveTopicARN("my-topic", account, "cn-north-1")
+	require.NoError(t, err)
+	assert.Equal(t, "arn:aws-cn:sns:cn-north-1:123456789012:my-topic", chinaARN)
+}
+
+func TestResolveTopicARNErrors(t *testing.T) {
+	const account, region = "123456789012", "us-east-1"
+	for _, tc := range []struct {
+		input, account, region, err string
+	}{
+		{"", account, region, "no topic"},
+		{"my topic", account, region, `invalid topic name "my topic"`},
+		{"my-topic", "", region, `topic name "my-topic" needs an account and a region`},
+		{"my-topic", "1234", region, `invalid account "1234"`},
+		{"arn:aws:sns", account, region, `invalid topic ARN "arn:aws:sns"`},
+		{"arn:aws:sqs:us-east-1:123456789012:queue", account, region, "is not an SNS topic ARN"},
+		{"arn:aws:sns:us-east-1:123456789012:my-topic:1f2e", account, region, "is a subscription ARN"},
+		{"arn:aws-gov:sns:us-gov-west-1:123456789012:my-topic", account, region, `unknown partition "aws-gov"`},
+		{"arn:aws:sns:us-gov-west-1:123456789012:my-topic", account, region,
+			"is in partition aws, but region us-gov-west-1 is in partition aws-us-gov"},
+		{"https://console.aws.amazon.com/sns/v3/home?region=us-east-1#/topics", account, region, "no topic ARN in URL"},
+	} {
+		_, err := ResolveTopicARN(tc.input, tc.account, tc.region)
+		require.Error(t, err, tc.input)
+		assert.Contains(t, err.Error(), tc.err, tc.input)
+	}
+}
@@ -0,0 +1,252 @@
+package verifybackfill
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena/athenaiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/panther-labs/panther/internal/log_analysis/awsglue"
+	"github.com/panther-labs/panther/pkg/awsathena"
+	"github.com/panther-labs/panther/pkg/stats"
+)
+
+const (
+	ProblemNoRows      = "no rows in partition with objects"
+	ProblemRowsChanged = "row count differs from baseline"
+	ProblemNoObjects   = "no objects in partition with baseline rows"
+)
+
+// PartitionReport is the verification result for one hourly partition
+type PartitionReport struct {
+	Time         time.Time `json:"time"`
+	Prefix       string    `json:"prefix"`
+	NumObjects   uint64    `json:"numObjects"`
+	NumBytes     uint64    `json:"numBytes"`
+	NumRows      int64     `json:"numRows"`
+	BaselineRows *int64    `json:"baselineRows,omitempty"`
+	Problem      string    `json:"problem,omitempty"`
+}
+
+// Report is the verification result for a table, it can be used as the baseline of a later verification
+type Report struct {
+	Bucket      string             `json:"bucket"`
+	Database    string             `json:"database"`
+	Table       string             `json:"table"`
+	Start       time.Time          `json:"start"`
+	End         time.Time          `json:"end"`
+	Partitions  []*PartitionReport `json:"partitions"`
+	NumProblems int                `json:"numProblems"`
+}
+
+// RowCounter counts the rows of a table partition
+type RowCounter interface {
+	CountRows(ctx context.Context, database, table string, hour time.Time) (int64, error)
+}
+
+type Input struct {
+	Bucket   string
+	Database string
+	Table    string
+	// Start and End (exclusive) are truncated to the hour
+	Start time.Time
+	End   time.Time
+	// Concurrency bounds the number of concurrent partition listings and queries
+	Concurrency int
+	// Baseline is an optional previous report to compare row counts with
+	Baseline *Report
+	// Stats is an optional collector for the partitions, objects, bytes, rows and queries counters
+	Stats *stats.Collector
+}
+
+type counters struct {
+	partitions *stats.Counter
+	objects    *stats.Counter
+	bytes      *stats.Counter
+	rows       *stats.Counter
+	queries    *stats.Counter
+}
+
+func newCounters(collector *stats.Collector) *counters {
+	if collector == nil {
+		collector = stats.NewCollector()
+	}
+	return &counters{
+		partitions: collector.Counter("partitions"),
+		objects:    collector.Counter("objects"),
+		bytes:      collector.Counter("bytes"),
+		rows:       collector.Counter("rows"),
+		queries:    collector.Counter("queries"),
+	}
+}
+
+// Verify lists the objects and counts the rows of every hourly partition of a table in a time range
+func Verify(ctx context.Context, s3Client s3iface.S3API, rowCounter RowCounter, input *Input) (*Report, error) {
+	if input.Concurrency < 1 {
+		return nil, errors.New("concurrency must be at least 1")
+	}
+	start, end := input.Start.UTC().Truncate(time.Hour), input.End.UTC().Truncate(time.Hour)
+	if !start.Before(end) {
+		return nil, errors.Errorf("start %s must be before end %s", start, end)
+	}
+
+	baselineRows := make(map[time.Time]int64)
+	if input.Baseline != nil {
+		if input.Baseline.Database != input.Database || input.Baseline.Table != input.Table {
+			return nil, errors.Errorf("baseline is for %s.%s", input.Baseline.Database, input.Baseline.Table)
+		}
+		for _, partition := range input.Baseline.Partitions {
+			baselineRows[partition.Time.UTC()] = partition.NumRows
+		}
+	}
+
+	report := &Report{
+		Bucket:   input.Bucket,
+		Database: input.Database,
+		Table:    input.Table,
+		Start:    start,
+		End:      end,
+	}
+	for hour := start; hour.Before(end); hour = hour.Add(time.Hour) {
+		report.Partitions = append(report.Partitions, &PartitionReport{
+			Time:   hour,
+			Prefix: awsglue.PartitionPrefix(input.Database, input.Table, awsglue.GlueTableHourly, hour),
+		})
+	}
+
+	// bounded, each partition is a list and (at most) one query
+	counters := newCounters(input.Stats)
+	partitions := make(chan *PartitionReport)
+	group, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < input.Concurrency; i++ {
+		group.Go(func() error {
+			for partition := range partitions {
+				if err := verifyPartition(ctx, s3Client, rowCounter, input, partition, counters); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	group.Go(func() error {
+		defer close(partitions)
+		for _, partition := range report.Partitions {
+			select {
+			case partitions <- partition:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	for _, partition := range report.Partitions {
+		if rows, found := baselineRows[partition.Time]; found {
+			rows := rows
+			partition.BaselineRows = &rows
+		}
+		partition.Problem = problem(partition)
+		if partition.Problem != "" {
+			report.NumProblems++
+		}
+	}
+	return report, nil
+}
+
+func verifyPartition(ctx context.Context, s3Client s3iface.S3API, rowCounter RowCounter,
+	input *Input, partition *PartitionReport, counters *counters) error {
+
+	counters.partitions.Inc()
+	listInput := &s3.ListObjectsV2Input{
+		Bucket: aws.String(input.Bucket),
+		Prefix: aws.String(partition.Prefix),
+	}
+	err := s3Client.ListObjectsV2PagesWithContext(ctx, listInput, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			if aws.Int64Value(object.Size) > 0 {
+				partition.NumObjects++
+				partition.NumBytes += uint64(*object.Size)
+				counters.objects.Inc()
+				counters.bytes.Add(uint64(*object.Size))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to list s3://%s/%s", input.Bucket, partition.Prefix)
+	}
+	if partition.NumObjects == 0 { // nothing to query
+		return nil
+	}
+	counters.queries.Inc()
+	partition.NumRows, err = rowCounter.CountRows(ctx, input.Database, input.Table, partition.Time)
+	if err != nil {
+		return err
+	}
+	counters.rows.Add(uint64(partition.NumRows))
+	return nil
+}
+
+func problem(partition *PartitionReport) string {
+	switch {
+	case partition.NumObjects > 0 && partition.NumRows == 0:
+		return ProblemNoRows
+	case partition.BaselineRows != nil && partition.NumObjects == 0 && *partition.BaselineRows > 0:
+		return ProblemNoObjects
+	case partition.BaselineRows != nil && *partition.BaselineRows != partition.NumRows:
+		return ProblemRowsChanged
+	default:
+		return ""
+	}
+}
+
+// AthenaRowCounter counts rows with Athena queries
+type AthenaRowCounter struct {
+	Client    athenaiface.AthenaAPI
+	Workgroup string
+}
+
+func (c *AthenaRowCounter) CountRows(ctx context.Context, database, table string, hour time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	sql := fmt.Sprintf(`SELECT COUNT(1) FROM "%s"."%s" WHERE year=%d AND month=%d AND day=%d AND hour=%d`,
+		database, table, hour.Year(), hour.Month(), hour.Day(), hour.Hour())
+	output, err := awsathena.RunQuery(c.Client, c.Workgroup, database, sql)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to count rows of %s.%s for %s", database, table, hour.Format(time.RFC3339))
+	}
+	// first row is the header
+	if len(output.ResultSet.Rows) != 2 || len(output.ResultSet.Rows[1].Data) != 1 {
+		return 0, errors.Errorf("unexpected result counting rows of %s.%s for %s", database, table, hour.Format(time.RFC3339))
+	}
+	return strconv.ParseInt(aws.StringValue(output.ResultSet.Rows[1].Data[0].VarCharValue), 10, 64)
+}
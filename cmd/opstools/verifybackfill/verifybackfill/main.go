@@ -0,0 +1,171 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/s3"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/cmd/opstools"
+	"github.com/panther-labs/panther/cmd/opstools/verifybackfill"
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+	"github.com/panther-labs/panther/pkg/stats"
+)
+
+func main() {
+	opstools.SetUsage("verifies back-filled data landed by comparing S3 objects to Athena row counts per hourly partition")
+	opts := struct {
+		Bucket         *string
+		Database       *string
+		LogType        *string
+		Start          *string
+		End            *string
+		Baseline       *string
+		Output         *string
+		Workgroup      *string
+		Concurrency    *int
+		Debug          *bool
+		Region         *string
+		MaxRetries     *int
+		MaxConnections *int
+	}{
+		Bucket:         flag.String("bucket", "", "The Panther processed data bucket"),
+		Database:       flag.String("database", pantherdb.LogProcessingDatabase, "The database of the table"),
+		LogType:        flag.String("log-type", "", "The log type of the table to verify (e.g., AWS.CloudTrail)"),
+		Start:          flag.String("start", "", "Verify partitions from this time (RFC3339 or YYYY-MM-DD)"),
+		End:            flag.String("end", "", "Verify partitions until this time, exclusive (RFC3339 or YYYY-MM-DD)"),
+		Baseline:       flag.String("baseline", "", "A JSON report of a previous run to compare row counts with"),
+		Output:         flag.String("output", "", "Write the JSON report to this file (defaults to stdout)"),
+		Workgroup:      flag.String("workgroup", "Panther", "The Athena workgroup to run queries in"),
+		Concurrency:    flag.Int("concurrency", 4, "The max number of concurrent Athena queries"),
+		Debug:          flag.Bool("debug", false, "Enable additional logging"),
+		Region:         flag.String("region", "", "Set the AWS region to run on"),
+		MaxRetries:     flag.Int("max-retries", 12, "Max retries for AWS requests"),
+		MaxConnections: flag.Int("max-connections", 100, "Max number of connections to AWS"),
+	}
+	flag.Parse()
+
+	log := opstools.MustBuildLogger(*opts.Debug)
+
+	if *opts.Bucket == "" || *opts.LogType == "" || *opts.Start == "" || *opts.End == "" {
+		flag.Usage()
+		log.Fatal("-bucket, -log-type, -start and -end are required")
+	}
+	start, err := parseTime(*opts.Start)
+	if err != nil {
+		log.Fatal(err)
+	}
+	end, err := parseTime(*opts.End)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	input := &verifybackfill.Input{
+		Bucket:      *opts.Bucket,
+		Database:    *opts.Database,
+		Table:       pantherdb.TableName(*opts.LogType),
+		Start:       start,
+		End:         end,
+		Concurrency: *opts.Concurrency,
+		Stats:       stats.NewCollector(),
+	}
+	if *opts.Baseline != "" {
+		data, err := ioutil.ReadFile(*opts.Baseline)
+		if err != nil {
+			log.Fatalf("failed to read baseline: %s", err)
+		}
+		input.Baseline = &verifybackfill.Report{}
+		if err := jsoniter.Unmarshal(data, input.Baseline); err != nil {
+			log.Fatalf("failed to parse baseline %s: %s", *opts.Baseline, err)
+		}
+	}
+
+	sess, err := opstools.NewSession(&aws.Config{
+		Region:     opts.Region,
+		MaxRetries: opts.MaxRetries,
+		HTTPClient: opstools.NewHTTPClient(*opts.MaxConnections, 0),
+	})
+	if err != nil {
+		log.Fatalf("failed to build AWS session: %s", err)
+	}
+
+	rowCounter := &verifybackfill.AthenaRowCounter{
+		Client:    athena.New(sess),
+		Workgroup: *opts.Workgroup,
+	}
+	log.Infof("verifying %s.%s from %s to %s", input.Database, input.Table, start, end)
+	report, err := verifybackfill.Verify(context.Background(), s3.New(sess), rowCounter, input)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	output := os.Stdout
+	if *opts.Output != "" {
+		if output, err = os.Create(*opts.Output); err != nil {
+			log.Fatalf("failed to create %s: %s", *opts.Output, err)
+		}
+		defer output.Close()
+	}
+	data, err := jsoniter.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := fmt.Fprintln(output, string(data)); err != nil {
+		log.Fatalf("failed to write report: %s", err)
+	}
+
+	// human summary
+	for _, partition := range report.Partitions {
+		if partition.Problem != "" {
+			log.Warnf("%s: %s (objects: %d, rows: %d)",
+				partition.Time.Format(time.RFC3339), partition.Problem, partition.NumObjects, partition.NumRows)
+		}
+	}
+	snapshot := input.Stats.Snapshot().WithRates(nil)
+	if data, err := jsoniter.MarshalToString(snapshot); err == nil {
+		log.Debugf("stats: %s", data)
+	}
+	log.Infof("verified %d partitions with %d objects and %d rows in %s, %d problems",
+		snapshot.Counter("partitions"), snapshot.Counter("objects"), snapshot.Counter("rows"),
+		snapshot.Elapsed, report.NumProblems)
+	if report.NumProblems > 0 {
+		os.Exit(1)
+	}
+}
+
+func parseTime(input string) (time.Time, error) {
+	if tm, err := time.Parse(time.RFC3339, input); err == nil {
+		return tm, nil
+	}
+	tm, err := time.Parse("2006-01-02", input)
+	if err != nil {
+		return time.Time{}, errors.Errorf("failed to parse %q as RFC3339 or YYYY-MM-DD", input)
+	}
+	return tm, nil
+}
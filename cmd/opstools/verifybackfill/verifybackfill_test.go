@@ -0,0 +1,126 @@
+package verifybackfill
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/pkg/stats"
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+var testStart = time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+
+type fakeRowCounter map[time.Time]int64
+
+func (f fakeRowCounter) CountRows(_ context.Context, _, _ string, hour time.Time) (int64, error) {
+	return f[hour], nil
+}
+
+func listInput(prefix string) interface{} {
+	return mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return aws.StringValue(input.Prefix) == prefix
+	})
+}
+
+func TestVerify(t *testing.T) {
+	s3Client := &testutils.S3Mock{}
+	page := &s3.ListObjectsV2Output{
+		Contents: []*s3.Object{
+			{Key: aws.String("a"), Size: aws.Int64(10)},
+			{Key: aws.String("b"), Size: aws.Int64(0)}, // ignored
+		},
+	}
+	// hour 0 has data and rows, hour 1 has data but no rows, hour 2 is empty
+	s3Client.On("ListObjectsV2PagesWithContext", mock.Anything,
+		listInput("logs/aws_cloudtrail/year=2020/month=11/day=01/hour=00/"), mock.Anything, mock.Anything).Return(page, nil)
+	s3Client.On("ListObjectsV2PagesWithContext", mock.Anything,
+		listInput("logs/aws_cloudtrail/year=2020/month=11/day=01/hour=01/"), mock.Anything, mock.Anything).Return(page, nil)
+	s3Client.On("ListObjectsV2PagesWithContext", mock.Anything,
+		listInput("logs/aws_cloudtrail/year=2020/month=11/day=01/hour=02/"), mock.Anything, mock.Anything).
+		Return(&s3.ListObjectsV2Output{}, nil)
+	rows := fakeRowCounter{testStart: 100}
+
+	input := &Input{
+		Bucket:      "bucket",
+		Database:    "panther_logs",
+		Table:       "aws_cloudtrail",
+		Start:       testStart,
+		End:         testStart.Add(3 * time.Hour),
+		Concurrency: 2,
+		Stats:       stats.NewCollector(),
+	}
+	report, err := Verify(context.Background(), s3Client, rows, input)
+	require.NoError(t, err)
+	s3Client.AssertExpectations(t)
+	require.Len(t, report.Partitions, 3)
+	assert.Equal(t, 1, report.NumProblems)
+
+	assert.Equal(t, uint64(1), report.Partitions[0].NumObjects)
+	assert.Equal(t, uint64(10), report.Partitions[0].NumBytes)
+	assert.Equal(t, int64(100), report.Partitions[0].NumRows)
+	assert.Empty(t, report.Partitions[0].Problem)
+	assert.Equal(t, ProblemNoRows, report.Partitions[1].Problem)
+	assert.Empty(t, report.Partitions[2].Problem)
+
+	snapshot := input.Stats.Snapshot()
+	assert.Equal(t, uint64(3), snapshot.Counter("partitions"))
+	assert.Equal(t, uint64(2), snapshot.Counter("objects"))
+	assert.Equal(t, uint64(20), snapshot.Counter("bytes"))
+	assert.Equal(t, uint64(100), snapshot.Counter("rows"))
+	assert.Equal(t, uint64(2), snapshot.Counter("queries"))
+
+	// compare with a baseline where hour 0 had more rows and hour 2 had rows
+	baseline := *report
+	baseline.Partitions = []*PartitionReport{
+		{Time: testStart, NumRows: 101},
+		{Time: testStart.Add(2 * time.Hour), NumRows: 5},
+	}
+	input.Baseline = &baseline
+	report, err = Verify(context.Background(), s3Client, rows, input)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.NumProblems)
+	assert.Equal(t, ProblemRowsChanged, report.Partitions[0].Problem)
+	assert.Equal(t, int64(101), *report.Partitions[0].BaselineRows)
+	assert.Equal(t, ProblemNoRows, report.Partitions[1].Problem)
+	assert.Equal(t, ProblemNoObjects, report.Partitions[2].Problem)
+}
+
+func TestVerifyBadInput(t *testing.T) {
+	input := &Input{
+		Start:       testStart,
+		End:         testStart,
+		Concurrency: 1,
+	}
+	_, err := Verify(context.Background(), &testutils.S3Mock{}, fakeRowCounter{}, input)
+	assert.Error(t, err)
+
+	input.End = testStart.Add(time.Hour)
+	input.Concurrency = 0
+	_, err = Verify(context.Background(), &testutils.S3Mock{}, fakeRowCounter{}, input)
+	assert.Error(t, err)
+}
@@ -72,7 +72,7 @@ func Handle(lc *lambdacontext.LambdaContext, batch *events.SQSEvent) (err error)
 	// Since we don't want one bad notification to lose us the rest, we log failures and continue.
 	for _, record := range batch.Records {
 		// Check for a notification from the log processor that there are newly processed CloudTrail logs
-		if id, found := record.MessageAttributes["id"]; found {
+		if id, found := record.MessageAttributes[notify.LogTypeAttributeName]; found {
 			if id.StringValue != nil && *id.StringValue == "AWS.CloudTrail" {
 				if isLogProcessorCloudTrail, err := handleLogProcessorCloudTrail(record.Body, changes); err != nil {
 					return err
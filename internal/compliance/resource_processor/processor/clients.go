@@ -29,6 +29,7 @@ import (
 	"github.com/kelseyhightower/envconfig"
 
 	"github.com/panther-labs/panther/pkg/gatewayapi"
+	"github.com/panther-labs/panther/pkg/lambdainvoke"
 )
 
 const (
@@ -49,6 +50,8 @@ var (
 	analysisClient   gatewayapi.API
 	complianceClient gatewayapi.API
 	resourceClient   gatewayapi.API
+
+	policyEngineClient *lambdainvoke.Client
 )
 
 // Setup parses the environment and initializes AWS and API clients.
@@ -61,4 +64,5 @@ func Setup() {
 	analysisClient = gatewayapi.NewClient(lambdaClient, "panther-analysis-api")
 	complianceClient = gatewayapi.NewClient(lambdaClient, "panther-compliance-api")
 	resourceClient = gatewayapi.NewClient(lambdaClient, "panther-resources-api")
+	policyEngineClient = lambdainvoke.New(lambdaClient)
 }
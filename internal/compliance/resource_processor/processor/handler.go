@@ -20,7 +20,6 @@ package processor
 
 import (
 	"context"
-	"errors"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -30,7 +29,6 @@ import (
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	jsoniter "github.com/json-iterator/go"
 	"go.uber.org/zap"
@@ -74,7 +72,7 @@ func Handle(ctx context.Context, batch *events.SQSEvent) (err error) {
 
 		if policy != nil {
 			// Policy updated - analyze applicable resources now
-			if err = results.analyzeUpdatedPolicy(*policy); err != nil {
+			if err = results.analyzeUpdatedPolicy(ctx, *policy); err != nil {
 				return err
 			}
 		} else if resource != nil {
@@ -93,7 +91,7 @@ func Handle(ctx context.Context, batch *events.SQSEvent) (err error) {
 	}
 
 	// Analyze updated resources with applicable policies
-	if err = results.analyze(resources, nil); err != nil {
+	if err = results.analyze(ctx, resources, nil); err != nil {
 		return err
 	}
 	err = results.deliver()
@@ -135,7 +133,7 @@ func parseQueueMsg(body string) (*resourcemodels.Resource, *analysismodels.Polic
 }
 
 // Analyze all resources related to a single policy (may require several policy-engine invocations).
-func (r *batchResults) analyzeUpdatedPolicy(policy analysismodels.Policy) error {
+func (r *batchResults) analyzeUpdatedPolicy(ctx context.Context, policy analysismodels.Policy) error {
 	// convert policy to policy map
 	policies := policyMap{policy.ID: policy}
 
@@ -148,7 +146,7 @@ func (r *batchResults) analyzeUpdatedPolicy(policy analysismodels.Policy) error
 			return err
 		}
 
-		if err := r.analyze(resources, policies); err != nil {
+		if err := r.analyze(ctx, resources, policies); err != nil {
 			return err
 		}
 		totalPages = pageCount
@@ -160,7 +158,7 @@ func (r *batchResults) analyzeUpdatedPolicy(policy analysismodels.Policy) error
 // Analyze each org in turn and report status entries and alert notifications across the entire batch
 //
 // Policies can either be provided by the caller or else they will be fetched from analysis-api.
-func (r *batchResults) analyze(resources resourceMap, policies policyMap) error {
+func (r *batchResults) analyze(ctx context.Context, resources resourceMap, policies policyMap) error {
 	// If there are no resources to analyze, exit before looking up policies
 	if len(resources) == 0 {
 		return nil
@@ -179,7 +177,7 @@ func (r *batchResults) analyze(resources resourceMap, policies policyMap) error
 	}
 
 	var analysis *enginemodels.PolicyEngineOutput
-	analysis, err = evaluatePolicies(policies, resources)
+	analysis, err = evaluatePolicies(ctx, policies, resources)
 	if err != nil {
 		return err
 	}
@@ -264,7 +262,7 @@ func (r *batchResults) analyze(resources resourceMap, policies policyMap) error
 }
 
 // Invoke the policy engine.
-func evaluatePolicies(policies policyMap, resources resourceMap) (*enginemodels.PolicyEngineOutput, error) {
+func evaluatePolicies(ctx context.Context, policies policyMap, resources resourceMap) (*enginemodels.PolicyEngineOutput, error) {
 	input := enginemodels.PolicyEngineInput{
 		Policies:  make([]enginemodels.Policy, 0, len(policies)),
 		Resources: make([]enginemodels.Resource, 0, len(resources)),
@@ -284,33 +282,14 @@ func evaluatePolicies(policies policyMap, resources resourceMap) (*enginemodels.
 		})
 	}
 
-	body, err := jsoniter.Marshal(&input)
-	if err != nil {
-		zap.L().Error("failed to marshal PolicyEngineInput", zap.Error(err))
-		return nil, err
-	}
-
 	zap.L().Info("invoking policy engine",
 		zap.String("policyEngine", env.PolicyEngine),
 		zap.Int("policyCount", len(input.Policies)),
 		zap.Int("resourceCount", len(input.Resources)),
 	)
-	response, err := lambdaClient.Invoke(&lambda.InvokeInput{FunctionName: &env.PolicyEngine, Payload: body})
-	if err != nil {
-		zap.L().Error("failed to invoke policy engine", zap.Error(err))
-		return nil, err
-	}
-
-	if aws.StringValue(response.FunctionError) != "" {
-		errorMessage := string(response.Payload)
-		zap.L().Error("policy engine returned an error",
-			zap.String("payload", errorMessage))
-		return nil, errors.New("policy engine error: " + errorMessage)
-	}
-
 	var output enginemodels.PolicyEngineOutput
-	if err = jsoniter.Unmarshal(response.Payload, &output); err != nil {
-		zap.L().Error("failed to unmarshal PolicyEngineOutput", zap.Error(err))
+	if err := policyEngineClient.Invoke(ctx, env.PolicyEngine, &input, &output); err != nil {
+		zap.L().Error("failed to invoke policy engine", zap.Error(err))
 		return nil, err
 	}
 
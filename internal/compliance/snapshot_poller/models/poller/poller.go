@@ -35,4 +35,8 @@ type ScanEntry struct {
 	ResourceID    *string `json:"resourceId"`
 	ResourceType  *string `json:"resourceType"`
 	NextPageToken *string `json:"nextPageToken"`
+	// ScanID is set for the scans started with the source-api TriggerScan, they report their progress
+	ScanID *string `json:"scanId,omitempty"`
+	// NumRegions is set by the poller to the number of region scans an all region scan was broken into
+	NumRegions *int `json:"-"`
 }
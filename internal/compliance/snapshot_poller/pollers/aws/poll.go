@@ -230,6 +230,7 @@ func Poll(scanRequest *pollermodels.ScanEntry) (
 					IntegrationID: scanRequest.IntegrationID,
 					Region:        region,
 					ResourceType:  scanRequest.ResourceType,
+					ScanID:        scanRequest.ScanID,
 				},
 			},
 		}, int64(pageRequeueDelayer.Intn(30)+1)) // Delay between 1 & 30 seconds to spread out region scans
@@ -237,6 +238,7 @@ func Poll(scanRequest *pollermodels.ScanEntry) (
 			return nil, err
 		}
 	}
+	scanRequest.NumRegions = aws.Int(len(regions))
 
 	return nil, nil
 }
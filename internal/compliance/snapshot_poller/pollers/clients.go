@@ -21,6 +21,7 @@ package pollers
 import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
 
 	"github.com/panther-labs/panther/pkg/gatewayapi"
 )
@@ -28,4 +29,6 @@ import (
 var (
 	awsSession                = session.Must(session.NewSession())
 	apiClient  gatewayapi.API = gatewayapi.NewClient(lambda.New(awsSession), "panther-resources-api")
+
+	sourceAPIClient lambdaiface.LambdaAPI = lambda.New(awsSession)
 )
@@ -91,9 +91,11 @@ func Handle(ctx context.Context, event events.SQSEvent) (err error) {
 				zap.Int("messageNumber", indx),
 				zap.String("integrationType", "aws"))
 
+			pageToken := entry.NextPageToken
 			resources, pollErr := pollers.Poll(entry)
 			if pollErr != nil {
 				operation.LogError(errors.Wrap(pollErr, "poll failed"), zap.Any("sqsEntry", entry))
+				reportScanProgress(entry, pageToken, pollErr)
 				return pollErr
 			}
 
@@ -115,6 +117,7 @@ func Handle(ctx context.Context, event events.SQSEvent) (err error) {
 					}
 				}
 			}
+			reportScanProgress(entry, pageToken, nil)
 		}
 	}
 
@@ -0,0 +1,63 @@
+package pollers
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"go.uber.org/zap"
+
+	sourcemodels "github.com/panther-labs/panther/api/lambda/source/models"
+	pollermodels "github.com/panther-labs/panther/internal/compliance/snapshot_poller/models/poller"
+	"github.com/panther-labs/panther/pkg/genericapi"
+)
+
+const sourceAPIFunctionName = "panther-source-api"
+
+// reportScanProgress records the progress of a scan started with the source-api TriggerScan.
+//
+// An all region scan reports the number of regions it was broken into and each region scan reports
+// when its last page was polled. Failing to record the progress does not fail the poll.
+func reportScanProgress(entry *pollermodels.ScanEntry, pageToken *string, pollErr error) {
+	if entry.ScanID == nil || entry.ResourceID != nil || entry.ResourceType == nil {
+		return
+	}
+
+	input := &sourcemodels.UpdateScanProgressInput{
+		ScanID:       *entry.ScanID,
+		ResourceType: *entry.ResourceType,
+	}
+	switch {
+	case pollErr != nil:
+		input.ErrorMessage = pollErr.Error()
+	case entry.Region == nil:
+		if entry.NumRegions == nil {
+			return // the scan was not broken into region scans
+		}
+		input.NumRegions = entry.NumRegions
+	case entry.NextPageToken != pageToken:
+		return // the next page was queued, the region is not done yet
+	default:
+		input.RegionDone = true
+	}
+
+	err := genericapi.Invoke(sourceAPIClient, sourceAPIFunctionName,
+		&sourcemodels.LambdaInput{UpdateScanProgress: input}, nil)
+	if err != nil {
+		zap.L().Warn("failed to record scan progress", zap.Any("sqsEntry", entry), zap.Error(err))
+	}
+}
@@ -0,0 +1,79 @@
+package pollers
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	sourcemodels "github.com/panther-labs/panther/api/lambda/source/models"
+	pollermodels "github.com/panther-labs/panther/internal/compliance/snapshot_poller/models/poller"
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+func TestReportScanProgress(t *testing.T) {
+	const scanID = "9a171500-5f4b-4b7f-8ca4-6b6f5b2b1b3e"
+	entry := func(region, pageToken *string) *pollermodels.ScanEntry {
+		return &pollermodels.ScanEntry{
+			AWSAccountID:  aws.String("123456789012"),
+			IntegrationID: aws.String(testIntegrationID),
+			Region:        region,
+			ResourceType:  aws.String("AWS.S3.Bucket"),
+			NextPageToken: pageToken,
+			ScanID:        aws.String(scanID),
+		}
+	}
+	fanOut := entry(nil, nil)
+	fanOut.NumRegions = aws.Int(3)
+	lastPage := entry(aws.String("us-east-1"), aws.String("page"))
+	nextPage := entry(aws.String("us-east-1"), nil)
+	nextPage.NextPageToken = aws.String("next")
+	unscheduled := entry(nil, nil)
+	unscheduled.ScanID = nil
+
+	lambdaMock := &testutils.LambdaMock{}
+	sourceAPIClient = lambdaMock
+	var inputs []*sourcemodels.UpdateScanProgressInput
+	lambdaMock.On("Invoke", mock.Anything).Return(&lambda.InvokeOutput{}, nil).Run(func(args mock.Arguments) {
+		var input sourcemodels.LambdaInput
+		require.NoError(t, jsoniter.Unmarshal(args.Get(0).(*lambda.InvokeInput).Payload, &input))
+		inputs = append(inputs, input.UpdateScanProgress)
+	})
+
+	reportScanProgress(fanOut, nil, nil)
+	reportScanProgress(lastPage, lastPage.NextPageToken, nil)
+	reportScanProgress(nextPage, nil, nil)
+	reportScanProgress(entry(aws.String("us-west-2"), nil), nil, errors.New("throttled"))
+	reportScanProgress(unscheduled, nil, nil)
+
+	expected := []*sourcemodels.UpdateScanProgressInput{
+		{ScanID: scanID, ResourceType: "AWS.S3.Bucket", NumRegions: aws.Int(3)},
+		{ScanID: scanID, ResourceType: "AWS.S3.Bucket", RegionDone: true},
+		{ScanID: scanID, ResourceType: "AWS.S3.Bucket", ErrorMessage: "throttled"},
+	}
+	assert.Equal(t, expected, inputs)
+	lambdaMock.AssertNumberOfCalls(t, "Invoke", 3)
+}
@@ -0,0 +1,129 @@
+package api
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/internal/core/source_api/ddb"
+	"github.com/panther-labs/panther/pkg/genericapi"
+)
+
+const (
+	// maxBackfillHistory is the number of back-fills remembered by an integration, the oldest are dropped
+	maxBackfillHistory = 50
+	// maxBackfillHistoryRetries is how many times a history updated concurrently is read again
+	maxBackfillHistoryRetries = 3
+)
+
+// RecordBackfill adds a back-fill to the history of an integration, or updates the record with the same run ID.
+//
+// It is called by the back-fill jobs and the s3queue ops tool, so that operators can see what was replayed.
+func (API) RecordBackfill(input *models.RecordBackfillInput) error {
+	record := backfillRecordToItem(&input.Record)
+	for i := 0; ; i++ {
+		item, err := getItem(input.IntegrationID)
+		if err != nil {
+			return err
+		}
+		err = dynamoClient.UpdateBackfillHistory(item, appendBackfillRecord(item.BackfillHistory, record))
+		if err == nil {
+			return nil
+		}
+		if err != ddb.ErrBackfillHistoryChanged || i == maxBackfillHistoryRetries {
+			zap.L().Error("failed to update backfill history", zap.String("integrationId", input.IntegrationID), zap.Error(err))
+			return &genericapi.InternalError{Message: "Failed recording the backfill"}
+		}
+	}
+}
+
+// GetBackfillHistory returns the back-fills of an integration, the most recent first.
+func (API) GetBackfillHistory(input *models.GetBackfillHistoryInput) ([]*models.BackfillRecord, error) {
+	item, err := dynamoClient.GetItem(input.IntegrationID)
+	if err != nil {
+		zap.L().Error("failed to get integration", zap.Error(err))
+		return nil, &genericapi.InternalError{Message: "Failed getting the backfill history"}
+	}
+	if item == nil {
+		return nil, &genericapi.DoesNotExistError{Message: fmt.Sprintf("integration %s does not exist", input.IntegrationID)}
+	}
+	return backfillHistory(item), nil
+}
+
+// returns the history with the record of the same run replaced or the record added, at most maxBackfillHistory
+func appendBackfillRecord(history []*ddb.BackfillRecord, record *ddb.BackfillRecord) []*ddb.BackfillRecord {
+	for i, existing := range history {
+		if existing.RunID == record.RunID {
+			updated := append([]*ddb.BackfillRecord(nil), history...)
+			updated[i] = record
+			return updated
+		}
+	}
+	updated := append(history[:len(history):len(history)], record)
+	if len(updated) > maxBackfillHistory {
+		updated = updated[len(updated)-maxBackfillHistory:]
+	}
+	return updated
+}
+
+// returns the back-fills of an integration item, the most recent first
+func backfillHistory(item *ddb.Integration) []*models.BackfillRecord {
+	history := make([]*models.BackfillRecord, 0, len(item.BackfillHistory))
+	for i := len(item.BackfillHistory) - 1; i >= 0; i-- {
+		history = append(history, itemToBackfillRecord(item.BackfillHistory[i]))
+	}
+	return history
+}
+
+func backfillRecordToItem(record *models.BackfillRecord) *ddb.BackfillRecord {
+	return &ddb.BackfillRecord{
+		RunID:          record.RunID,
+		StartTime:      record.StartTime,
+		EndTime:        record.EndTime,
+		Prefixes:       record.Prefixes,
+		ModifiedAfter:  record.ModifiedAfter,
+		ModifiedBefore: record.ModifiedBefore,
+		NumFiles:       record.NumFiles,
+		NumBytes:       record.NumBytes,
+		NumFailed:      record.NumFailed,
+		Status:         record.Status,
+		ErrorMessage:   record.ErrorMessage,
+		Actor:          record.Actor,
+	}
+}
+
+func itemToBackfillRecord(record *ddb.BackfillRecord) *models.BackfillRecord {
+	return &models.BackfillRecord{
+		RunID:          record.RunID,
+		StartTime:      record.StartTime,
+		EndTime:        record.EndTime,
+		Prefixes:       record.Prefixes,
+		ModifiedAfter:  record.ModifiedAfter,
+		ModifiedBefore: record.ModifiedBefore,
+		NumFiles:       record.NumFiles,
+		NumBytes:       record.NumBytes,
+		NumFailed:      record.NumFailed,
+		Status:         record.Status,
+		ErrorMessage:   record.ErrorMessage,
+		Actor:          record.Actor,
+	}
+}
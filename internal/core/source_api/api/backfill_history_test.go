@@ -0,0 +1,129 @@
+package api
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/internal/core/source_api/ddb"
+	"github.com/panther-labs/panther/pkg/genericapi"
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+func backfillIntegrationItem(t *testing.T, version int, history ...*ddb.BackfillRecord) *dynamodb.GetItemOutput {
+	item, err := dynamodbattribute.MarshalMap(&ddb.Integration{
+		IntegrationID:          testIntegrationID,
+		IntegrationType:        models.IntegrationTypeAWS3,
+		BackfillHistory:        history,
+		BackfillHistoryVersion: version,
+	})
+	require.NoError(t, err)
+	return &dynamodb.GetItemOutput{Item: item}
+}
+
+func TestRecordBackfill(t *testing.T) {
+	mockClient := &testutils.DynamoDBMock{}
+	dynamoClient = &ddb.DDB{Client: mockClient, TableName: "test"}
+	start := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	old := &ddb.BackfillRecord{RunID: "old", StartTime: start.Add(-time.Hour), Status: models.BackfillStatusSucceeded}
+	running := &ddb.BackfillRecord{RunID: "run", StartTime: start, Status: models.BackfillStatusRunning}
+
+	// the history was updated concurrently, it is read again
+	mockClient.On("GetItem", mock.Anything).Return(backfillIntegrationItem(t, 0), nil).Once()
+	mockClient.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{},
+		awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "changed", nil)).Once()
+	mockClient.On("GetItem", mock.Anything).Return(backfillIntegrationItem(t, 2, old, running), nil).Once()
+	mockClient.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+
+	input := &models.RecordBackfillInput{
+		IntegrationID: testIntegrationID,
+		Record: models.BackfillRecord{
+			RunID:     "run",
+			StartTime: start,
+			NumFiles:  10,
+			Status:    models.BackfillStatusSucceeded,
+			Actor:     "arn:aws:iam::123456789012:user/ops",
+		},
+	}
+	require.NoError(t, apiTest.RecordBackfill(input))
+	mockClient.AssertExpectations(t)
+
+	first := mockClient.Calls[1].Arguments.Get(0).(*dynamodb.UpdateItemInput)
+	assert.Equal(t, "attribute_exists(#id) AND attribute_not_exists(#version)", aws.StringValue(first.ConditionExpression))
+	update := mockClient.Calls[3].Arguments.Get(0).(*dynamodb.UpdateItemInput)
+	assert.Equal(t, "attribute_exists(#id) AND #version = :version", aws.StringValue(update.ConditionExpression))
+	assert.Equal(t, "2", aws.StringValue(update.ExpressionAttributeValues[":version"].N))
+	assert.Equal(t, "3", aws.StringValue(update.ExpressionAttributeValues[":next"].N))
+	var history []*ddb.BackfillRecord
+	require.NoError(t, dynamodbattribute.Unmarshal(update.ExpressionAttributeValues[":history"], &history))
+	require.Len(t, history, 2) // the record of the run is replaced
+	assert.Equal(t, "old", history[0].RunID)
+	assert.Equal(t, models.BackfillStatusSucceeded, history[1].Status)
+	assert.Equal(t, uint64(10), history[1].NumFiles)
+}
+
+func TestRecordBackfillMissing(t *testing.T) {
+	mockClient := &testutils.DynamoDBMock{}
+	dynamoClient = &ddb.DDB{Client: mockClient, TableName: "test"}
+	mockClient.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{}, nil).Once()
+
+	err := apiTest.RecordBackfill(&models.RecordBackfillInput{IntegrationID: testIntegrationID})
+	assert.IsType(t, &genericapi.DoesNotExistError{}, err)
+	mockClient.AssertExpectations(t)
+}
+
+func TestAppendBackfillRecord(t *testing.T) {
+	var history []*ddb.BackfillRecord
+	for i := 0; i < maxBackfillHistory+5; i++ {
+		history = appendBackfillRecord(history, &ddb.BackfillRecord{RunID: fmt.Sprint(i)})
+	}
+	require.Len(t, history, maxBackfillHistory)
+	assert.Equal(t, "5", history[0].RunID) // the oldest are dropped
+	assert.Equal(t, fmt.Sprint(maxBackfillHistory+4), history[maxBackfillHistory-1].RunID)
+
+	// updates do not modify the history they were given
+	updated := appendBackfillRecord(history, &ddb.BackfillRecord{RunID: "5", Status: models.BackfillStatusFailed})
+	assert.Equal(t, models.BackfillStatusFailed, updated[0].Status)
+	assert.Empty(t, history[0].Status)
+}
+
+func TestGetBackfillHistory(t *testing.T) {
+	mockClient := &testutils.DynamoDBMock{}
+	dynamoClient = &ddb.DDB{Client: mockClient, TableName: "test"}
+	mockClient.On("GetItem", mock.Anything).Return(backfillIntegrationItem(t, 2,
+		&ddb.BackfillRecord{RunID: "first"}, &ddb.BackfillRecord{RunID: "second"}), nil).Once()
+
+	history, err := apiTest.GetBackfillHistory(&models.GetBackfillHistoryInput{IntegrationID: testIntegrationID})
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, "second", history[0].RunID) // the most recent first
+	assert.Equal(t, "first", history[1].RunID)
+	mockClient.AssertExpectations(t)
+}
@@ -24,6 +24,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/internal/core/source_api/ddb"
 	"github.com/panther-labs/panther/pkg/genericapi"
 )
 
@@ -50,7 +51,9 @@ func (API) DeleteIntegration(input *models.DeleteIntegrationInput) error {
 
 	switch integrationItem.IntegrationType {
 	case models.IntegrationTypeAWS3:
-		existingIntegrations, err := dynamoClient.ScanIntegrations(aws.String(models.IntegrationTypeAWS3))
+		existingIntegrations, err := dynamoClient.ScanIntegrations(ddb.IntegrationFilter{
+			IntegrationType: aws.String(models.IntegrationTypeAWS3),
+		})
 		if err != nil {
 			zap.L().Error("failed to scan integration", zap.Error(err))
 			return deleteIntegrationInternalError
@@ -91,6 +94,15 @@ func (API) DeleteIntegration(input *models.DeleteIntegrationInput) error {
 		}
 	}
 
+	// The label is released first, a failed delete leaves the integration without its reservation rather than
+	// a reservation without an integration
+	err = dynamoClient.DeleteLabel(input.IntegrationID, integrationItem.IntegrationType,
+		normalizedLabel(integrationItem.IntegrationLabel))
+	if err != nil {
+		zap.L().Error("failed to delete label", zap.Error(err))
+		return deleteIntegrationInternalError
+	}
+
 	err = dynamoClient.DeleteItem(input.IntegrationID)
 	if err != nil {
 		zap.L().Error("failed to delete item", zap.Error(err))
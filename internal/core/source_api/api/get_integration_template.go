@@ -29,6 +29,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/pkg/genericapi"
 )
 
 const (
@@ -71,55 +72,105 @@ type templateCacheItem struct {
 	Body      string
 }
 
-// GetIntegrationTemplate generates a new satellite account CloudFormation template based on the given parameters.
+// GetIntegrationTemplate generates a new satellite account template based on the given parameters,
+// as CloudFormation (the default) or as a Terraform module.
 func (API) GetIntegrationTemplate(input *models.GetIntegrationTemplateInput) (*models.SourceIntegrationTemplate, error) {
-	zap.L().Debug("constructing source template")
+	zap.L().Debug("constructing source template", zap.String("format", input.TemplateFormat))
 
+	if input.IntegrationType == models.IntegrationTypeSqs && input.IntegrationID == "" {
+		return nil, &genericapi.InvalidInputError{Message: "integrationId is required for aws-sqs templates"}
+	}
+	// both formats are rendered from the same parameters
+	params := newTemplateParameters(input)
+
+	if input.TemplateFormat == models.TemplateFormatTerraform {
+		body, err := terraformTemplate(input.IntegrationType, params)
+		if err != nil {
+			return nil, err
+		}
+		return &models.SourceIntegrationTemplate{Body: body}, nil
+	}
+
+	if input.IntegrationType == models.IntegrationTypeSqs {
+		return nil, &genericapi.InvalidInputError{Message: "aws-sqs templates are only available as terraform"}
+	}
 	// Get the template
 	template, err := getTemplate(input.IntegrationType)
 	if err != nil {
 		return nil, err
 	}
+	return &models.SourceIntegrationTemplate{
+		Body:      cloudFormationTemplate(template, input.IntegrationType, params),
+		StackName: getStackName(input.IntegrationType, input.IntegrationLabel),
+	}, nil
+}
+
+// templateParameters are the values of a satellite account template, whatever its format
+type templateParameters struct {
+	MasterAccountID     string
+	MasterAccountRegion string
+	// aws-scan
+	CWEEnabled         bool
+	RemediationEnabled bool
+	// aws-s3 and aws-sqs
+	RoleSuffix string
+	S3Bucket   string
+	S3Prefix   string
+	KmsKey     string
+	QueueArn   string
+}
+
+func newTemplateParameters(input *models.GetIntegrationTemplateInput) *templateParameters {
+	params := &templateParameters{
+		MasterAccountID:     input.AWSAccountID,
+		MasterAccountRegion: *awsSession.Config.Region,
+		RoleSuffix:          normalizedLabel(input.IntegrationLabel),
+		S3Bucket:            input.S3Bucket,
+		S3Prefix:            input.S3Prefix,
+		KmsKey:              input.KmsKey,
+	}
+	switch input.IntegrationType {
+	case models.IntegrationTypeAWSScan:
+		params.CWEEnabled = aws.BoolValue(input.CWEEnabled)
+		params.RemediationEnabled = aws.BoolValue(input.RemediationEnabled)
+	case models.IntegrationTypeSqs:
+		params.QueueArn = SourceSqsQueueArn(input.IntegrationID)
+	}
+	// If no S3Prefix is specified, add as default '*'
+	if len(params.S3Prefix) == 0 {
+		params.S3Prefix = "*"
+	}
+	return params
+}
 
-	// Format the template with the user's input
+// Format the template with the user's input
+func cloudFormationTemplate(template, integrationType string, params *templateParameters) string {
 	formattedTemplate := strings.Replace(template, accountIDFind,
-		fmt.Sprintf(accountIDReplace, input.AWSAccountID), 1)
+		fmt.Sprintf(accountIDReplace, params.MasterAccountID), 1)
 
 	// Cloud Security replacements
-	if input.IntegrationType == models.IntegrationTypeAWSScan {
+	if integrationType == models.IntegrationTypeAWSScan {
 		formattedTemplate = strings.Replace(formattedTemplate, regionFind,
-			fmt.Sprintf(regionReplace, *awsSession.Config.Region), 1)
+			fmt.Sprintf(regionReplace, params.MasterAccountRegion), 1)
 		formattedTemplate = strings.Replace(formattedTemplate, cweFind,
-			fmt.Sprintf(cweReplace, aws.BoolValue(input.CWEEnabled)), 1)
+			fmt.Sprintf(cweReplace, params.CWEEnabled), 1)
 		formattedTemplate = strings.Replace(formattedTemplate, remediationFind,
-			fmt.Sprintf(remediationReplace, aws.BoolValue(input.RemediationEnabled)), 1)
-	} else {
-		// Log Analysis replacements
-		formattedTemplate = strings.Replace(formattedTemplate, roleSuffixIDFind,
-			fmt.Sprintf(roleSuffixReplace, normalizedLabel(input.IntegrationLabel)), 1)
-
-		formattedTemplate = strings.Replace(formattedTemplate, s3BucketFind,
-			fmt.Sprintf(s3BucketReplace, input.S3Bucket), 1)
-
-		if len(input.S3Prefix) > 0 {
-			formattedTemplate = strings.Replace(formattedTemplate, s3PrefixFind,
-				fmt.Sprintf(s3PrefixReplace, input.S3Prefix), 1)
-		} else {
-			// If no S3Prefix is specified, add as default '*'
-			formattedTemplate = strings.Replace(formattedTemplate, s3PrefixFind,
-				fmt.Sprintf(s3PrefixReplace, "*"), 1)
-		}
-
-		if len(input.KmsKey) > 0 {
-			formattedTemplate = strings.Replace(formattedTemplate, kmsKeyFind,
-				fmt.Sprintf(kmsKeyReplace, input.KmsKey), 1)
-		}
+			fmt.Sprintf(remediationReplace, params.RemediationEnabled), 1)
+		return formattedTemplate
 	}
 
-	return &models.SourceIntegrationTemplate{
-		Body:      formattedTemplate,
-		StackName: getStackName(input.IntegrationType, input.IntegrationLabel),
-	}, nil
+	// Log Analysis replacements
+	formattedTemplate = strings.Replace(formattedTemplate, roleSuffixIDFind,
+		fmt.Sprintf(roleSuffixReplace, params.RoleSuffix), 1)
+	formattedTemplate = strings.Replace(formattedTemplate, s3BucketFind,
+		fmt.Sprintf(s3BucketReplace, params.S3Bucket), 1)
+	formattedTemplate = strings.Replace(formattedTemplate, s3PrefixFind,
+		fmt.Sprintf(s3PrefixReplace, params.S3Prefix), 1)
+	if len(params.KmsKey) > 0 {
+		formattedTemplate = strings.Replace(formattedTemplate, kmsKeyFind,
+			fmt.Sprintf(kmsKeyReplace, params.KmsKey), 1)
+	}
+	return formattedTemplate
 }
 
 func getTemplate(integrationType string) (string, error) {
@@ -21,6 +21,7 @@ package api
 import (
 	"bytes"
 	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -31,6 +32,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/pkg/genericapi"
 	"github.com/panther-labs/panther/pkg/testutils"
 )
 
@@ -65,6 +67,11 @@ func TestCloudSecTemplate(t *testing.T) {
 func TestLogAnalysisTemplate(t *testing.T) {
 	s3Mock := &testutils.S3Mock{}
 	templateS3Client = s3Mock
+	awsSession = &session.Session{
+		Config: &aws.Config{
+			Region: aws.String(endpoints.UsEast1RegionID),
+		},
+	}
 	input := &models.GetIntegrationTemplateInput{
 		AWSAccountID:     "123456789012",
 		IntegrationType:  models.IntegrationTypeAWS3,
@@ -85,3 +92,80 @@ func TestLogAnalysisTemplate(t *testing.T) {
 	require.YAMLEq(t, string(expectedTemplate), result.Body)
 	require.Equal(t, "panther-log-analysis-setup-testlabel-", result.StackName)
 }
+
+func TestTerraformTemplate(t *testing.T) {
+	templateS3Client = &testutils.S3Mock{} // terraform templates are not downloaded
+	awsSession = &session.Session{
+		Config: &aws.Config{
+			Region: aws.String(endpoints.UsEast1RegionID),
+		},
+	}
+	env.AccountID = "111122223333"
+	const kmsKey = "arn:aws:kms:us-east-1:123456789012:key/key-id"
+
+	testCases := map[string]*models.GetIntegrationTemplateInput{
+		"aws-scan": {
+			IntegrationType:    models.IntegrationTypeAWSScan,
+			CWEEnabled:         aws.Bool(true),
+			RemediationEnabled: aws.Bool(true),
+		},
+		"aws-scan-minimal": {
+			IntegrationType: models.IntegrationTypeAWSScan,
+		},
+		"aws-s3": {
+			IntegrationType: models.IntegrationTypeAWS3,
+			S3Bucket:        "test-bucket",
+			S3Prefix:        "prefix",
+			KmsKey:          kmsKey,
+		},
+		"aws-s3-no-kms": {
+			IntegrationType: models.IntegrationTypeAWS3,
+			S3Bucket:        "test-bucket",
+		},
+		"aws-sqs": {
+			IntegrationType: models.IntegrationTypeSqs,
+			IntegrationID:   "45c378a7-2e36-4b12-8e16-2d3c49ff1371",
+			KmsKey:          kmsKey,
+		},
+		"aws-sqs-no-kms": {
+			IntegrationType: models.IntegrationTypeSqs,
+			IntegrationID:   "45c378a7-2e36-4b12-8e16-2d3c49ff1371",
+		},
+	}
+	for name, input := range testCases {
+		input := input
+		t.Run(name, func(t *testing.T) {
+			input.AWSAccountID = "123456789012"
+			input.IntegrationLabel = "TestLabel-"
+			input.TemplateFormat = models.TemplateFormatTerraform
+
+			result, err := API{}.GetIntegrationTemplate(input)
+			require.NoError(t, err)
+			expectedTemplate, err := ioutil.ReadFile("./testdata/terraform/" + name + ".tf")
+			require.NoError(t, err)
+			// the snapshots have the license header of the repository
+			expected := string(expectedTemplate)
+			expected = expected[strings.Index(expected, "# Generated by Panther"):]
+			require.Equal(t, expected, result.Body)
+			require.Empty(t, result.StackName)
+		})
+	}
+}
+
+func TestSqsTemplateFormats(t *testing.T) {
+	input := &models.GetIntegrationTemplateInput{
+		AWSAccountID:     "123456789012",
+		IntegrationType:  models.IntegrationTypeSqs,
+		IntegrationLabel: "TestLabel-",
+		TemplateFormat:   models.TemplateFormatTerraform,
+	}
+	_, err := API{}.GetIntegrationTemplate(input)
+	require.Error(t, err)
+	require.IsType(t, &genericapi.InvalidInputError{}, err) // the integration is required
+
+	input.IntegrationID = "45c378a7-2e36-4b12-8e16-2d3c49ff1371"
+	input.TemplateFormat = models.TemplateFormatCloudFormation
+	_, err = API{}.GetIntegrationTemplate(input)
+	require.Error(t, err)
+	require.IsType(t, &genericapi.InvalidInputError{}, err)
+}
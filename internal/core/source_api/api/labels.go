@@ -0,0 +1,54 @@
+package api
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/internal/core/source_api/ddb"
+)
+
+// reserveLabels reserves the labels of the integrations created before the labels were reserved, on a cold start.
+//
+// The reservations are idempotent, so concurrent cold starts do not conflict. Integrations that already share a
+// label keep it, only the first one listed reserves it. Failures are logged: the scans of PutIntegration and
+// UpdateIntegrationSettings still reject the labels in use, and the next cold start tries again.
+func reserveLabels() {
+	integrations, err := dynamoClient.ScanIntegrations(ddb.IntegrationFilter{})
+	if err != nil {
+		zap.L().Error("failed to list integrations to reserve their labels", zap.Error(err))
+		return
+	}
+	for _, integration := range integrations {
+		label := normalizedLabel(integration.IntegrationLabel)
+		err := dynamoClient.ReserveLabel(integration.IntegrationID, integration.IntegrationType, label)
+		if err == ddb.ErrLabelTaken {
+			zap.L().Warn("integration shares its label with another integration",
+				zap.String("integrationId", integration.IntegrationID),
+				zap.String("integrationLabel", integration.IntegrationLabel))
+			continue
+		}
+		if err != nil {
+			zap.L().Error("failed to reserve integration label",
+				zap.String("integrationId", integration.IntegrationID),
+				zap.Error(err))
+			return
+		}
+	}
+}
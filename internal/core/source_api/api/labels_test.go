@@ -0,0 +1,72 @@
+package api
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/internal/core/source_api/ddb"
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+func TestReserveLabels(t *testing.T) {
+	mockClient := &testutils.DynamoDBMock{}
+	dynamoClient = &ddb.DDB{Client: mockClient, TableName: "test"}
+
+	integration := func(id, label string) map[string]*dynamodb.AttributeValue {
+		return map[string]*dynamodb.AttributeValue{
+			"integrationId":    {S: aws.String(id)},
+			"integrationType":  {S: aws.String(models.IntegrationTypeAWSScan)},
+			"integrationLabel": {S: aws.String(label)},
+		}
+	}
+	mockClient.On("Scan", mock.Anything).Return(&dynamodb.ScanOutput{Items: []map[string]*dynamodb.AttributeValue{
+		integration("first", "Prod AWS"),
+		integration("second", "prod-aws"), // created before the labels were reserved
+		integration("third", "dev"),
+	}}, nil).Once()
+	mockClient.On("PutItem", mock.Anything).Return(&dynamodb.PutItemOutput{}, nil).Once()
+	mockClient.On("PutItem", mock.Anything).Return((*dynamodb.PutItemOutput)(nil),
+		awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "held", nil)).Once()
+	mockClient.On("PutItem", mock.Anything).Return(&dynamodb.PutItemOutput{}, nil).Once()
+
+	// the integrations sharing a label do not stop the others from reserving theirs
+	reserveLabels()
+	mockClient.AssertExpectations(t)
+	var reserved []string
+	for _, call := range mockClient.Calls[1:] {
+		input := call.Arguments.Get(0).(*dynamodb.PutItemInput)
+		require.NotNil(t, input.ConditionExpression)
+		reserved = append(reserved, aws.StringValue(input.Item["integrationId"].S)+" "+
+			aws.StringValue(input.Item["labelOf"].S))
+	}
+	assert.Equal(t, []string{
+		"label/aws-scan/prod-aws first",
+		"label/aws-scan/prod-aws second",
+		"label/aws-scan/dev third",
+	}, reserved)
+}
@@ -19,24 +19,73 @@ package api
  */
 
 import (
+	"encoding/base64"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	jsoniter "github.com/json-iterator/go"
 	"go.uber.org/zap"
 
 	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/internal/core/source_api/ddb"
 	"github.com/panther-labs/panther/pkg/genericapi"
 )
 
+// defaultIntegrationsPageSize is the page size of ListIntegrationsPage if the input does not set one
+const defaultIntegrationsPageSize = 1000
+
 var genericListError = &genericapi.InternalError{Message: "Failed to list integrations"}
 
-// ListIntegrations returns all enabled integrations.
+// ListIntegrations returns all enabled integrations, with their back-fill history if verbose.
+// The page size and pagination token of the input are ignored, see ListIntegrationsPage.
 func (API) ListIntegrations(
 	input *models.ListIntegrationsInput) ([]*models.SourceIntegration, error) {
 
-	integrationItems, err := dynamoClient.ScanIntegrations(input.IntegrationType)
+	integrationItems, err := dynamoClient.ScanIntegrations(integrationFilter(input))
+	if err != nil {
+		zap.L().Error("failed to list integrations", zap.Error(err))
+		return nil, genericListError
+	}
+	return itemsToIntegrations(integrationItems, input.Verbose), nil
+}
+
+// ListIntegrationsPage returns a page of the enabled integrations, with their back-fill history if verbose.
+// The pagination token of the output gets the next page, it is not set on the last page.
+func (API) ListIntegrationsPage(input *models.ListIntegrationsInput) (*models.ListIntegrationsOutput, error) {
+	startKey, err := decodePaginationToken(input.PaginationToken)
+	if err != nil {
+		return nil, &genericapi.InvalidInputError{Message: "invalid paginationToken"}
+	}
+	pageSize := input.PageSize
+	if pageSize == 0 {
+		pageSize = defaultIntegrationsPageSize
+	}
+
+	integrationItems, lastKey, err := dynamoClient.ScanIntegrationsPage(integrationFilter(input), pageSize, startKey)
 	if err != nil {
 		zap.L().Error("failed to list integrations", zap.Error(err))
 		return nil, genericListError
 	}
+	token, err := encodePaginationToken(lastKey)
+	if err != nil {
+		zap.L().Error("failed to encode the pagination token", zap.Error(err))
+		return nil, genericListError
+	}
+	return &models.ListIntegrationsOutput{
+		Integrations:    itemsToIntegrations(integrationItems, input.Verbose),
+		PaginationToken: token,
+	}, nil
+}
 
+// the integrations of the input type and log type, both must match if both are set
+func integrationFilter(input *models.ListIntegrationsInput) ddb.IntegrationFilter {
+	return ddb.IntegrationFilter{
+		IntegrationType: input.IntegrationType,
+		LogType:         input.LogType,
+	}
+}
+
+// converts the items of a page to integrations, an empty list is returned instead of null
+func itemsToIntegrations(integrationItems []*ddb.Integration, verbose bool) []*models.SourceIntegration {
 	result := make([]*models.SourceIntegration, len(integrationItems))
 	for i, item := range integrationItems {
 		integ := itemToIntegration(item)
@@ -49,7 +98,38 @@ func (API) ListIntegrations(
 				integ.LogProcessingRole = env.InputDataRoleArn
 			}
 		}
+		if verbose {
+			integ.BackfillHistory = backfillHistory(item)
+		}
 		result[i] = integ
 	}
-	return result, nil
+	return result
+}
+
+// The pagination token is the key the next page starts after, base64 encoded so that it is opaque to callers
+func encodePaginationToken(key map[string]*dynamodb.AttributeValue) (*string, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	data, err := jsoniter.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(data)
+	return &token, nil
+}
+
+func decodePaginationToken(token *string) (map[string]*dynamodb.AttributeValue, error) {
+	if token == nil || *token == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(*token)
+	if err != nil {
+		return nil, err
+	}
+	var key map[string]*dynamodb.AttributeValue
+	if err := jsoniter.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+	return key, nil
 }
@@ -19,18 +19,22 @@ package api
  */
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/panther-labs/panther/api/lambda/source/models"
 	"github.com/panther-labs/panther/internal/core/source_api/ddb"
 	"github.com/panther-labs/panther/internal/core/source_api/ddb/modelstest"
+	"github.com/panther-labs/panther/pkg/genericapi"
 )
 
 func TestListIntegrations(t *testing.T) {
@@ -116,3 +120,129 @@ func TestHandleListIntegrationsScanError(t *testing.T) {
 	require.NotNil(t, err)
 	assert.Nil(t, out)
 }
+
+// pagedScanClient scans its items in order of integrationId, at most maxPage items per scan as-if the rest were
+// beyond the 1MB limit of a scan
+type pagedScanClient struct {
+	dynamodbiface.DynamoDBAPI
+	items     []map[string]*dynamodb.AttributeValue
+	maxPage   int
+	lastInput *dynamodb.ScanInput
+}
+
+func (c *pagedScanClient) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	c.lastInput = input
+	start := 0
+	if input.ExclusiveStartKey != nil {
+		for i, item := range c.items {
+			if aws.StringValue(item["integrationId"].S) == aws.StringValue(input.ExclusiveStartKey["integrationId"].S) {
+				start = i + 1
+			}
+		}
+	}
+	end := start + c.maxPage
+	if input.Limit != nil && start+int(*input.Limit) < end {
+		end = start + int(*input.Limit)
+	}
+	if end >= len(c.items) {
+		return &dynamodb.ScanOutput{Items: c.items[start:]}, nil
+	}
+	return &dynamodb.ScanOutput{
+		Items:            c.items[start:end],
+		LastEvaluatedKey: map[string]*dynamodb.AttributeValue{"integrationId": c.items[end-1]["integrationId"]},
+	}, nil
+}
+
+func newPagedScanClient(numItems, maxPage int) *pagedScanClient {
+	client := &pagedScanClient{maxPage: maxPage}
+	for i := 0; i < numItems; i++ {
+		client.items = append(client.items, map[string]*dynamodb.AttributeValue{
+			"integrationId":   {S: aws.String(fmt.Sprintf("integration-%d", i))},
+			"integrationType": {S: aws.String(models.IntegrationTypeAWS3)},
+		})
+	}
+	return client
+}
+
+func TestListIntegrationsPage(t *testing.T) {
+	dynamoClient = &ddb.DDB{Client: newPagedScanClient(5, 10), TableName: "test"}
+
+	var ids []string
+	var token *string
+	for _, expected := range []int{2, 2, 1} {
+		out, err := apiTest.ListIntegrationsPage(&models.ListIntegrationsInput{PageSize: 2, PaginationToken: token})
+		require.NoError(t, err)
+		require.Len(t, out.Integrations, expected)
+		for _, integration := range out.Integrations {
+			ids = append(ids, integration.IntegrationID)
+		}
+		token = out.PaginationToken
+	}
+	assert.Nil(t, token) // the last page
+	assert.Equal(t, []string{"integration-0", "integration-1", "integration-2", "integration-3", "integration-4"}, ids)
+
+	// a page is filled from several scans, and the default page size gets everything
+	dynamoClient = &ddb.DDB{Client: newPagedScanClient(5, 2), TableName: "test"}
+	out, err := apiTest.ListIntegrationsPage(&models.ListIntegrationsInput{PageSize: 3})
+	require.NoError(t, err)
+	assert.Len(t, out.Integrations, 3)
+	assert.NotNil(t, out.PaginationToken)
+	out, err = apiTest.ListIntegrationsPage(&models.ListIntegrationsInput{})
+	require.NoError(t, err)
+	assert.Len(t, out.Integrations, 5)
+	assert.Nil(t, out.PaginationToken)
+
+	_, err = apiTest.ListIntegrationsPage(&models.ListIntegrationsInput{PaginationToken: aws.String("not a token")})
+	assert.IsType(t, &genericapi.InvalidInputError{}, err)
+}
+
+// The unpaginated call reads every page of the scan
+func TestListIntegrationsAllPages(t *testing.T) {
+	dynamoClient = &ddb.DDB{Client: newPagedScanClient(5, 2), TableName: "test"}
+
+	out, err := apiTest.ListIntegrations(&models.ListIntegrationsInput{PageSize: 1})
+	require.NoError(t, err)
+	assert.Len(t, out, 5)
+}
+
+func TestListIntegrationsFilters(t *testing.T) {
+	client := newPagedScanClient(1, 10)
+	dynamoClient = &ddb.DDB{Client: client, TableName: "test"}
+	filter := func() (expression string, names, values []string) {
+		for _, name := range client.lastInput.ExpressionAttributeNames {
+			names = append(names, aws.StringValue(name))
+		}
+		for _, value := range client.lastInput.ExpressionAttributeValues {
+			values = append(values, aws.StringValue(value.S))
+		}
+		return aws.StringValue(client.lastInput.FilterExpression), names, values
+	}
+
+	// the items reserving the labels of the integrations are always skipped
+	_, err := apiTest.ListIntegrations(&models.ListIntegrationsInput{})
+	require.NoError(t, err)
+	expression, names, values := filter()
+	assert.Contains(t, expression, "attribute_not_exists")
+	assert.Equal(t, []string{"labelOf"}, names)
+	assert.Empty(t, values)
+
+	// the log type is looked up in both the log types of the integration and those of its sqs config
+	_, err = apiTest.ListIntegrations(&models.ListIntegrationsInput{LogType: aws.String("AWS.CloudTrail")})
+	require.NoError(t, err)
+	expression, names, values = filter()
+	assert.Contains(t, expression, " OR ")
+	assert.Equal(t, 2, strings.Count(expression, "contains"))
+	assert.ElementsMatch(t, []string{"labelOf", "logTypes", "sqsConfig"}, names)
+	assert.ElementsMatch(t, []string{"AWS.CloudTrail", "AWS.CloudTrail"}, values)
+
+	// both filters must match
+	_, err = apiTest.ListIntegrationsPage(&models.ListIntegrationsInput{
+		IntegrationType: aws.String(models.IntegrationTypeAWS3),
+		LogType:         aws.String("AWS.CloudTrail"),
+	})
+	require.NoError(t, err)
+	expression, names, values = filter()
+	assert.Contains(t, expression, " AND ")
+	assert.ElementsMatch(t, []string{"labelOf", "integrationType", "logTypes", "sqsConfig"}, names)
+	assert.ElementsMatch(t, []string{models.IntegrationTypeAWS3, "AWS.CloudTrail", "AWS.CloudTrail"}, values)
+}
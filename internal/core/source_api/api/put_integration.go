@@ -34,6 +34,7 @@ import (
 	"github.com/panther-labs/panther/api/lambda/source/models"
 	pollermodels "github.com/panther-labs/panther/internal/compliance/snapshot_poller/models/poller"
 	awspoller "github.com/panther-labs/panther/internal/compliance/snapshot_poller/pollers/aws"
+	"github.com/panther-labs/panther/internal/core/source_api/ddb"
 	"github.com/panther-labs/panther/internal/log_analysis/datacatalog_updater/datacatalog"
 	"github.com/panther-labs/panther/pkg/awsbatch/sqsbatch"
 	"github.com/panther-labs/panther/pkg/genericapi"
@@ -45,6 +46,10 @@ var (
 
 // PutIntegration adds a set of new integrations in a batch.
 func (api API) PutIntegration(input *models.PutIntegrationInput) (newIntegration *models.SourceIntegration, err error) {
+	if err := models.ValidateIntegrationLabel(input.IntegrationLabel); err != nil {
+		return nil, &genericapi.InvalidInputError{Message: err.Error()}
+	}
+
 	if err := api.validateIntegration(input); err != nil {
 		zap.L().Error("failed to put integration", zap.Error(err))
 		return nil, err
@@ -74,8 +79,11 @@ func (api API) PutIntegration(input *models.PutIntegrationInput) (newIntegration
 		return nil, putIntegrationInternalError
 	}
 
-	// Write to DynamoDB
-	if err = dynamoClient.PutItem(item); err != nil {
+	// Write to DynamoDB, the label is reserved with the integration in case another one took it since the check
+	if err = dynamoClient.PutItemWithLabel(item, normalizedLabel(item.IntegrationLabel), ""); err != nil {
+		if err == ddb.ErrLabelTaken {
+			return nil, labelConflictError(input.IntegrationLabel)
+		}
 		zap.L().Error("failed to store source integration in DDB", zap.Error(err))
 		return nil, putIntegrationInternalError
 	}
@@ -159,12 +167,11 @@ func (api API) integrationAlreadyExists(input *models.PutIntegrationInput) error
 						Message: fmt.Sprintf("Source account %s already onboarded", input.AWSAccountID),
 					}
 				}
-				return nil
 			case models.IntegrationTypeAWS3:
 				if existingIntegration.AWSAccountID == input.AWSAccountID &&
 					existingIntegration.IntegrationLabel == input.IntegrationLabel {
 					// Log sources for same account need to have different labels
-					return &genericapi.InvalidInputError{
+					return &genericapi.AlreadyExistsError{
 						Message: fmt.Sprintf("Log source for account %s with label %s already onboarded",
 							input.AWSAccountID,
 							input.IntegrationLabel),
@@ -176,13 +183,9 @@ func (api API) integrationAlreadyExists(input *models.PutIntegrationInput) error
 						Message: "An S3 integration with the same S3 bucket and prefix already exists.",
 					}
 				}
-			case models.IntegrationTypeSqs:
-				if existingIntegration.IntegrationLabel == input.IntegrationLabel {
-					// Sqs sources need to have different labels
-					return &genericapi.InvalidInputError{
-						Message: fmt.Sprintf("Integration with label %s already exists", input.IntegrationLabel),
-					}
-				}
+			}
+			if normalizedLabel(existingIntegration.IntegrationLabel) == normalizedLabel(input.IntegrationLabel) {
+				return labelConflictError(input.IntegrationLabel)
 			}
 		}
 	}
@@ -190,14 +193,29 @@ func (api API) integrationAlreadyExists(input *models.PutIntegrationInput) error
 	return nil
 }
 
+// labelConflictError is returned when another integration of the same type has the label.
+//
+// Labels are compared once normalized, they name the stacks and the roles of the integrations.
+func labelConflictError(label string) error {
+	return &genericapi.AlreadyExistsError{
+		Message: fmt.Sprintf("Integration with label %s already exists", label),
+	}
+}
+
 // FullScan schedules scans for each Resource type for each integration.
 //
 // Each Resource type is sent within its own SQS message.
 func (api API) FullScan(input *models.FullScanInput) error {
+	return scheduleScans(input.Integrations, nil)
+}
+
+// scheduleScans sends the ScanMsg of each Resource type for each integration.
+// The scans report their progress if they have a scanID.
+func scheduleScans(integrations []*models.SourceIntegrationMetadata, scanID *string) error {
 	var sqsEntries []*sqs.SendMessageBatchRequestEntry
 
 	// For each integration, add a ScanMsg to the queue per service
-	for _, integration := range input.Integrations {
+	for _, integration := range integrations {
 		for resourceType := range awspoller.ServicePollers {
 			scanMsg := &pollermodels.ScanMsg{
 				Entries: []*pollermodels.ScanEntry{
@@ -205,6 +223,7 @@ func (api API) FullScan(input *models.FullScanInput) error {
 						AWSAccountID:  &integration.AWSAccountID,
 						IntegrationID: &integration.IntegrationID,
 						ResourceType:  aws.String(resourceType),
+						ScanID:        scanID,
 					},
 				},
 			}
@@ -38,6 +38,7 @@ import (
 	awspoller "github.com/panther-labs/panther/internal/compliance/snapshot_poller/pollers/aws"
 	"github.com/panther-labs/panther/internal/core/source_api/ddb"
 	"github.com/panther-labs/panther/internal/core/source_api/ddb/modelstest"
+	"github.com/panther-labs/panther/pkg/genericapi"
 	"github.com/panther-labs/panther/pkg/testutils"
 )
 
@@ -206,6 +207,94 @@ func TestPutCloudSecIntegrationExists(t *testing.T) {
 	assert.Equal(t, "Source account 123456789012 already onboarded", err.Error())
 }
 
+func TestPutIntegrationLabelExists(t *testing.T) {
+	evaluateIntegrationFunc = func(_ API, _ *models.CheckIntegrationInput) (string, bool, error) { return "", true, nil }
+
+	dynamoClient = &ddb.DDB{
+		Client: &modelstest.MockDDBClient{
+			MockScanAttributes: []map[string]*dynamodb.AttributeValue{
+				{
+					"integrationId":    {S: aws.String(testIntegrationID)},
+					"integrationType":  {S: aws.String(models.IntegrationTypeSqs)},
+					"integrationLabel": {S: aws.String("My Queue")},
+					"sqsConfig": {M: map[string]*dynamodb.AttributeValue{
+						"queueUrl": {S: aws.String("https://sqs.us-east-1.amazonaws.com/123456789012/my-queue")},
+					}},
+				},
+			},
+		},
+		TableName: "test",
+	}
+
+	// labels differing in case and spacing conflict
+	out, err := apiTest.PutIntegration(&models.PutIntegrationInput{
+		PutIntegrationSettings: models.PutIntegrationSettings{
+			IntegrationLabel: "my-queue",
+			IntegrationType:  models.IntegrationTypeSqs,
+			UserID:           testUserID,
+		},
+	})
+	require.Error(t, err)
+	require.Empty(t, out)
+	assert.IsType(t, &genericapi.AlreadyExistsError{}, err)
+	assert.Equal(t, "Integration with label my-queue already exists", err.Error())
+}
+
+// A label taken between the check and the write is a conflict too
+func TestPutIntegrationLabelTaken(t *testing.T) {
+	mockClient := &testutils.DynamoDBMock{}
+	dynamoClient = &ddb.DDB{Client: mockClient, TableName: "test"}
+	mockSQS := &testutils.SqsMock{}
+	sqsClient = mockSQS
+	evaluateIntegrationFunc = func(_ API, _ *models.CheckIntegrationInput) (string, bool, error) { return "", true, nil }
+
+	canceled := &dynamodb.TransactionCanceledException{
+		CancellationReasons: []*dynamodb.CancellationReason{
+			{Code: aws.String("None")},
+			{Code: aws.String("ConditionalCheckFailed")},
+		},
+	}
+	mockClient.On("Scan", mock.Anything).Return(&dynamodb.ScanOutput{}, nil)
+	mockClient.On("TransactWriteItems", mock.Anything).Return(&dynamodb.TransactWriteItemsOutput{}, canceled).Once()
+	mockSQS.On("SendMessageWithContext", mock.Anything, mock.Anything).Return(&sqs.SendMessageOutput{}, nil)
+
+	out, err := apiTest.PutIntegration(&models.PutIntegrationInput{
+		PutIntegrationSettings: models.PutIntegrationSettings{
+			AWSAccountID:     testAccountID,
+			IntegrationLabel: testIntegrationLabel,
+			IntegrationType:  models.IntegrationTypeAWSScan,
+			ScanIntervalMins: 60,
+			UserID:           testUserID,
+		},
+	})
+	require.Error(t, err)
+	require.Empty(t, out)
+	assert.IsType(t, &genericapi.AlreadyExistsError{}, err)
+	mockClient.AssertExpectations(t)
+
+	// the label is reserved along with the integration
+	input := mockClient.Calls[1].Arguments.Get(0).(*dynamodb.TransactWriteItemsInput)
+	require.Len(t, input.TransactItems, 2)
+	labelItem := input.TransactItems[1].Put.Item
+	assert.Equal(t, "label/aws-scan/prodaws", aws.StringValue(labelItem["integrationId"].S))
+	assert.Equal(t, input.TransactItems[0].Put.Item["integrationId"], labelItem["labelOf"])
+}
+
+func TestPutIntegrationInvalidLabel(t *testing.T) {
+	out, err := apiTest.PutIntegration(&models.PutIntegrationInput{
+		PutIntegrationSettings: models.PutIntegrationSettings{
+			AWSAccountID:     testAccountID,
+			IntegrationLabel: "Prod_AWS",
+			IntegrationType:  models.IntegrationTypeAWS3,
+			UserID:           testUserID,
+		},
+	})
+	require.Error(t, err)
+	require.Empty(t, out)
+	assert.IsType(t, &genericapi.InvalidInputError{}, err)
+	assert.Contains(t, err.Error(), "letters, digits, dashes or spaces")
+}
+
 func TestPutIntegrationValidInput(t *testing.T) {
 	validator, err := models.Validator()
 	require.NoError(t, err)
@@ -0,0 +1,161 @@
+package api
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	awspoller "github.com/panther-labs/panther/internal/compliance/snapshot_poller/pollers/aws"
+	"github.com/panther-labs/panther/internal/core/source_api/ddb"
+	"github.com/panther-labs/panther/pkg/genericapi"
+)
+
+const (
+	// scanCooldown is the minimum time between the start of two triggered scans of an integration
+	scanCooldown = 15 * time.Minute
+	// scanRecordRetention is how long the progress of a triggered scan is kept
+	scanRecordRetention = 30 * 24 * time.Hour
+)
+
+// TriggerScan starts a full scan of an aws-scan integration and returns its ID to follow its progress.
+//
+// A scan is not started if the last one started less than scanCooldown ago.
+func (API) TriggerScan(input *models.TriggerScanInput) (*models.TriggerScanOutput, error) {
+	item, err := getItem(input.IntegrationID)
+	if err != nil {
+		return nil, err
+	}
+	if item.IntegrationType != models.IntegrationTypeAWSScan {
+		return nil, &genericapi.InvalidInputError{
+			Message: fmt.Sprintf("integration %s is not an %s integration", input.IntegrationID, models.IntegrationTypeAWSScan),
+		}
+	}
+
+	now := time.Now().UTC()
+	if item.LastScanStartTime != nil && now.Sub(*item.LastScanStartTime) < scanCooldown {
+		return nil, &genericapi.InUseError{
+			Message: fmt.Sprintf("a scan of integration %s started at %s, the next one can start at %s",
+				input.IntegrationID, item.LastScanStartTime.Format(time.RFC3339),
+				item.LastScanStartTime.Add(scanCooldown).Format(time.RFC3339)),
+		}
+	}
+
+	record := newScanRecord(uuid.New().String(), item.IntegrationID, now)
+	if err = dynamoClient.PutScan(record); err != nil {
+		zap.L().Error("failed to put scan record", zap.Error(err))
+		return nil, &genericapi.InternalError{Message: "Failed recording the scan"}
+	}
+	item.LastScanStartTime = &now
+	if err = dynamoClient.PutItem(item); err != nil {
+		return nil, &genericapi.InternalError{Message: "Failed updating the integration last scan start"}
+	}
+
+	integration := itemToIntegration(item)
+	if err = scheduleScans([]*models.SourceIntegrationMetadata{&integration.SourceIntegrationMetadata}, &record.ScanID); err != nil {
+		zap.L().Error("failed to schedule scan", zap.String("scanId", record.ScanID), zap.Error(err))
+		return nil, &genericapi.InternalError{Message: "Failed scheduling the scan"}
+	}
+
+	zap.L().Info("triggered scan", zap.String("integrationId", item.IntegrationID), zap.String("scanId", record.ScanID))
+	return &models.TriggerScanOutput{ScanID: record.ScanID}, nil
+}
+
+// GetScanStatus returns the progress of a scan started with TriggerScan.
+func (API) GetScanStatus(input *models.GetScanStatusInput) (*models.ScanStatus, error) {
+	record, err := dynamoClient.GetScan(input.ScanID)
+	if err != nil {
+		zap.L().Error("failed to get scan record", zap.Error(err))
+		return nil, &genericapi.InternalError{Message: "Failed getting the scan"}
+	}
+	if record == nil {
+		return nil, &genericapi.DoesNotExistError{Message: fmt.Sprintf("scan %s does not exist", input.ScanID)}
+	}
+	return scanStatus(record), nil
+}
+
+// UpdateScanProgress records the progress of a scan, it is called by the snapshot pollers.
+func (API) UpdateScanProgress(input *models.UpdateScanProgressInput) error {
+	found, err := dynamoClient.UpdateScan(input.ScanID, &ddb.ScanProgress{
+		ResourceType: input.ResourceType,
+		NumRegions:   input.NumRegions,
+		ErrorMessage: input.ErrorMessage,
+		RegionDone:   input.RegionDone,
+	})
+	if err != nil {
+		zap.L().Error("failed to update scan record", zap.Error(err))
+		return &genericapi.InternalError{Message: "Failed updating the scan progress"}
+	}
+	if !found {
+		return &genericapi.DoesNotExistError{Message: fmt.Sprintf("scan %s does not exist", input.ScanID)}
+	}
+	return nil
+}
+
+func newScanRecord(scanID, integrationID string, now time.Time) *ddb.ScanRecord {
+	record := &ddb.ScanRecord{
+		ScanID:        scanID,
+		IntegrationID: integrationID,
+		StartTime:     now,
+		ExpiresAt:     now.Add(scanRecordRetention).Unix(),
+		NumRegions:    map[string]int{},
+		RegionsDone:   map[string]int{},
+		Errors:        map[string]string{},
+	}
+	// The resource types being scanned are the keys of RegionsDone
+	for resourceType := range awspoller.ServicePollers {
+		record.RegionsDone[resourceType] = 0
+	}
+	return record
+}
+
+// scanStatus summarizes a scan record, a resource type is completed once all its region scans are done
+func scanStatus(record *ddb.ScanRecord) *models.ScanStatus {
+	status := &models.ScanStatus{
+		ScanID:                 record.ScanID,
+		IntegrationID:          record.IntegrationID,
+		StartTime:              record.StartTime,
+		ResourceTypes:          make([]string, 0, len(record.RegionsDone)),
+		CompletedResourceTypes: []string{},
+		Errors:                 record.Errors,
+	}
+	for resourceType, numDone := range record.RegionsDone {
+		status.ResourceTypes = append(status.ResourceTypes, resourceType)
+		if numRegions, ok := record.NumRegions[resourceType]; ok && numDone >= numRegions {
+			status.CompletedResourceTypes = append(status.CompletedResourceTypes, resourceType)
+		}
+	}
+	sort.Strings(status.ResourceTypes)
+	sort.Strings(status.CompletedResourceTypes)
+
+	switch {
+	case len(status.CompletedResourceTypes) < len(status.ResourceTypes):
+		status.Status = models.StatusScanning
+	case len(status.Errors) > 0:
+		status.Status = models.StatusError
+	default:
+		status.Status = models.StatusOK
+	}
+	return status
+}
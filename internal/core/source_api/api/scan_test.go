@@ -0,0 +1,134 @@
+package api
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	pollermodels "github.com/panther-labs/panther/internal/compliance/snapshot_poller/models/poller"
+	awspoller "github.com/panther-labs/panther/internal/compliance/snapshot_poller/pollers/aws"
+	"github.com/panther-labs/panther/internal/core/source_api/ddb"
+	"github.com/panther-labs/panther/pkg/genericapi"
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+func scanIntegrationItem(lastScanStart time.Time) *dynamodb.GetItemOutput {
+	return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+		"integrationId":     {S: aws.String(testIntegrationID)},
+		"integrationType":   {S: aws.String(models.IntegrationTypeAWSScan)},
+		"awsAccountId":      {S: aws.String(testAccountID)},
+		"lastScanStartTime": {S: aws.String(lastScanStart.Format(time.RFC3339Nano))},
+	}}
+}
+
+func TestTriggerScan(t *testing.T) {
+	env.SnapshotPollersQueueURL = "test-url"
+	mockClient := &testutils.DynamoDBMock{}
+	dynamoClient = &ddb.DDB{Client: mockClient, TableName: "test", ScanTableName: "test-scans"}
+	mockSQS := &testutils.SqsMock{}
+	sqsClient = mockSQS
+
+	mockClient.On("GetItem", mock.Anything).Return(scanIntegrationItem(time.Now().Add(-time.Hour)), nil).Once()
+	mockClient.On("PutItem", mock.Anything).Return(&dynamodb.PutItemOutput{}, nil).Twice()
+	// the messages are sent in batches of at most 10
+	var entries []*sqs.SendMessageBatchRequestEntry
+	mockSQS.On("SendMessageBatch", mock.Anything).Return(&sqs.SendMessageBatchOutput{}, nil).Run(func(args mock.Arguments) {
+		entries = append(entries, args.Get(0).(*sqs.SendMessageBatchInput).Entries...)
+	})
+
+	out, err := apiTest.TriggerScan(&models.TriggerScanInput{IntegrationID: testIntegrationID})
+	require.NoError(t, err)
+	require.NotEmpty(t, out.ScanID)
+	mockClient.AssertExpectations(t)
+
+	// the scan record is put before the integration is updated
+	putScan := mockClient.Calls[1].Arguments.Get(0).(*dynamodb.PutItemInput)
+	assert.Equal(t, "test-scans", aws.StringValue(putScan.TableName))
+	assert.Equal(t, out.ScanID, aws.StringValue(putScan.Item["scanId"].S))
+	assert.Len(t, putScan.Item["regionsDone"].M, len(awspoller.ServicePollers))
+
+	// every scan reports its progress
+	require.Len(t, entries, len(awspoller.ServicePollers))
+	for _, entry := range entries {
+		var msg pollermodels.ScanMsg
+		require.NoError(t, jsoniter.UnmarshalFromString(aws.StringValue(entry.MessageBody), &msg))
+		assert.Equal(t, out.ScanID, aws.StringValue(msg.Entries[0].ScanID))
+	}
+}
+
+func TestTriggerScanCooldown(t *testing.T) {
+	mockClient := &testutils.DynamoDBMock{}
+	dynamoClient = &ddb.DDB{Client: mockClient, TableName: "test", ScanTableName: "test-scans"}
+	mockClient.On("GetItem", mock.Anything).Return(scanIntegrationItem(time.Now().Add(-time.Minute)), nil).Once()
+
+	out, err := apiTest.TriggerScan(&models.TriggerScanInput{IntegrationID: testIntegrationID})
+	assert.Nil(t, out)
+	assert.IsType(t, &genericapi.InUseError{}, err)
+	mockClient.AssertExpectations(t)
+}
+
+func TestUpdateScanProgress(t *testing.T) {
+	mockClient := &testutils.DynamoDBMock{}
+	dynamoClient = &ddb.DDB{Client: mockClient, TableName: "test", ScanTableName: "test-scans"}
+	mockClient.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+	mockClient.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{},
+		awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "no scan", nil)).Once()
+
+	input := &models.UpdateScanProgressInput{ScanID: testIntegrationID, ResourceType: "AWS.S3.Bucket", RegionDone: true}
+	require.NoError(t, apiTest.UpdateScanProgress(input))
+	update := mockClient.Calls[0].Arguments.Get(0).(*dynamodb.UpdateItemInput)
+	assert.Equal(t, "SET #regionsDone.#resourceType = if_not_exists(#regionsDone.#resourceType, :zero) + :one",
+		aws.StringValue(update.UpdateExpression))
+	assert.Equal(t, "AWS.S3.Bucket", aws.StringValue(update.ExpressionAttributeNames["#resourceType"]))
+
+	err := apiTest.UpdateScanProgress(input)
+	assert.IsType(t, &genericapi.DoesNotExistError{}, err)
+	mockClient.AssertExpectations(t)
+}
+
+func TestScanStatus(t *testing.T) {
+	record := newScanRecord("scan", testIntegrationID, time.Now())
+	record.RegionsDone = map[string]int{"AWS.EC2.Volume": 1, "AWS.IAM.Role": 1, "AWS.S3.Bucket": 0}
+	record.NumRegions = map[string]int{"AWS.EC2.Volume": 2, "AWS.IAM.Role": 1}
+
+	status := scanStatus(record)
+	assert.Equal(t, models.StatusScanning, status.Status)
+	assert.Equal(t, []string{"AWS.EC2.Volume", "AWS.IAM.Role", "AWS.S3.Bucket"}, status.ResourceTypes)
+	assert.Equal(t, []string{"AWS.IAM.Role"}, status.CompletedResourceTypes)
+
+	record.RegionsDone["AWS.EC2.Volume"] = 2
+	record.NumRegions["AWS.S3.Bucket"] = 0 // not in any region
+	assert.Equal(t, models.StatusOK, scanStatus(record).Status)
+
+	record.Errors["AWS.EC2.Volume"] = "throttled"
+	status = scanStatus(record)
+	assert.Equal(t, models.StatusError, status.Status)
+	assert.Equal(t, map[string]string{"AWS.EC2.Volume": "throttled"}, status.Errors)
+}
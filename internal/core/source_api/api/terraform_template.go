@@ -0,0 +1,488 @@
+package api
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// The Terraform templates mirror the CloudFormation templates in deployments/auxiliary/cloudformation,
+// the resources they create must stay the same.
+var terraformTemplates = template.Must(template.New("terraform").Funcs(template.FuncMap{
+	"hcl": hclString,
+}).Parse(terraformHeader + terraformCloudSec + terraformLogAnalysis + terraformSqs))
+
+// Renders the Terraform module of an integration type
+func terraformTemplate(integrationType string, params *templateParameters) (string, error) {
+	var body strings.Builder
+	if err := terraformTemplates.ExecuteTemplate(&body, integrationType, params); err != nil {
+		return "", errors.Wrapf(err, "failed to render %s terraform template", integrationType)
+	}
+	return body.String(), nil
+}
+
+// Quotes a value as an HCL string, without template sequences
+func hclString(value string) string {
+	quoted := strconv.Quote(value)
+	quoted = strings.ReplaceAll(quoted, "${", "$${")
+	return strings.ReplaceAll(quoted, "%{", "%%{")
+}
+
+const terraformHeader = `{{define "header"}}# Generated by Panther, DO NOT EDIT the values of the locals.
+
+variable "aws_partition" {
+  type    = string
+  default = "aws"
+}
+
+{{end}}{{define "trust"}}
+  assume_role_policy = jsonencode({
+    Version : "2012-10-17",
+    Statement : [
+      {
+        Effect : "Allow",
+        Principal : {
+          AWS : "arn:${var.aws_partition}:iam::${local.master_account_id}:root"
+        },
+        Action : "sts:AssumeRole",
+        Condition : {
+          Bool : { "aws:SecureTransport" : true }
+        }
+      }
+    ]
+  })
+{{end}}`
+
+const terraformCloudSec = `{{define "aws-scan"}}{{template "header"}}locals {
+  master_account_id     = {{hcl .MasterAccountID}}
+  master_account_region = {{hcl .MasterAccountRegion}}
+}
+
+##### IAM roles for an account being scanned by Panther #####
+
+resource "aws_iam_role" "panther_audit" {
+  name        = "PantherAuditRole-${local.master_account_region}"
+  description = "The Panther master account assumes this role for read-only security scanning"
+{{template "trust"}}
+  tags = {
+    Application = "Panther"
+  }
+}
+
+resource "aws_iam_role_policy_attachment" "security_audit" {
+  role       = aws_iam_role.panther_audit.id
+  policy_arn = "arn:${var.aws_partition}:iam::aws:policy/SecurityAudit"
+}
+
+resource "aws_iam_role_policy" "panther_cloud_formation_stack_drift_detection" {
+  name = "CloudFormationStackDriftDetection"
+  role = aws_iam_role.panther_audit.id
+
+  policy = jsonencode({
+    Version : "2012-10-17",
+    Statement : [
+      {
+        Effect : "Allow",
+        Action : [
+          "cloudformation:DetectStackDrift",
+          "cloudformation:DetectStackResourceDrift"
+        ],
+        Resource : "*"
+      }
+    ]
+  })
+}
+
+resource "aws_iam_role_policy" "panther_cloud_formation_stack_drift_detection_supplements" {
+  name = "CloudFormationStackDriftDetectionSupplements"
+  role = aws_iam_role.panther_audit.id
+
+  policy = jsonencode({
+    Version : "2012-10-17",
+    Statement : [
+      {
+        Effect : "Allow",
+        Action : [
+          "sns:ListTagsForResource",
+          "lambda:GetFunction",
+          "apigateway:GET"
+        ],
+        Resource : "*"
+      }
+    ]
+  })
+}
+
+resource "aws_iam_role_policy" "panther_get_waf_acls" {
+  name = "GetWAFACLs"
+  role = aws_iam_role.panther_audit.id
+
+  policy = jsonencode({
+    Version : "2012-10-17",
+    Statement : [
+      {
+        Effect : "Allow",
+        Action : [
+          "waf:GetRule",
+          "waf:GetWebACL",
+          "waf-regional:GetRule",
+          "waf-regional:GetWebACL",
+          "waf-regional:GetWebACLForResource"
+        ],
+        Resource : "*"
+      }
+    ]
+  })
+}
+
+resource "aws_iam_role_policy" "panther_get_tags" {
+  name = "GetTags"
+  role = aws_iam_role.panther_audit.id
+
+  policy = jsonencode({
+    Version : "2012-10-17",
+    Statement : [
+      {
+        Effect : "Allow",
+        Action : [
+          "dynamodb:ListTagsOfResource",
+          "kms:ListResourceTags",
+          "waf:ListTagsForResource",
+          "waf-regional:ListTagsForResource"
+        ],
+        Resource : "*"
+      }
+    ]
+  })
+}
+
+resource "aws_iam_role_policy" "panther_eks_fargate_profile" {
+  name = "EKSFargateProfile"
+  role = aws_iam_role.panther_audit.id
+
+  policy = jsonencode({
+    Version : "2012-10-17",
+    Statement : [
+      {
+        Effect : "Allow",
+        Action : [
+          "eks:ListFargateProfiles",
+          "eks:DescribeFargateProfile"
+        ],
+        Resource : "*"
+      }
+    ]
+  })
+}
+
+output "panther_audit_role_arn" {
+  value       = aws_iam_role.panther_audit.arn
+  description = "The ARN of the Panther Audit IAM Role"
+}
+{{if .CWEEnabled}}
+resource "aws_iam_role" "panther_cloud_formation_stackset_execution" {
+  name        = "PantherCloudFormationStackSetExecutionRole-${local.master_account_region}"
+  description = "CloudFormation assumes this role to execute a stack set"
+
+  assume_role_policy = jsonencode({
+    Version : "2012-10-17",
+    Statement : [
+      {
+        Effect : "Allow",
+        Principal : {
+          AWS : "arn:${var.aws_partition}:iam::${local.master_account_id}:root"
+        },
+        Action : "sts:AssumeRole"
+      }
+    ]
+  })
+
+  tags = {
+    Application = "Panther"
+  }
+}
+
+resource "aws_iam_role_policy" "panther_manage_cloud_formation_stack" {
+  name = "ManageCloudFormationStack"
+  role = aws_iam_role.panther_cloud_formation_stackset_execution.id
+
+  policy = jsonencode({
+    Version : "2012-10-17",
+    Statement : [
+      {
+        Effect : "Allow",
+        Action : "cloudformation:*",
+        Resource : "*"
+      }
+    ]
+  })
+}
+
+resource "aws_iam_role_policy" "panther_setup_realtime_events" {
+  name = "PantherSetupRealTimeEvents"
+  role = aws_iam_role.panther_cloud_formation_stackset_execution.id
+
+  policy = jsonencode({
+    Version : "2012-10-17",
+    Statement : [
+      {
+        Effect : "Allow",
+        Action : [
+          "events:*",
+          "sns:*"
+        ],
+        Resource : "*"
+      }
+    ]
+  })
+}
+
+output "panther_cloud_formation_stackset_execution_role_arn" {
+  value       = aws_iam_role.panther_cloud_formation_stackset_execution.arn
+  description = "The ARN of the CloudFormation StackSet Execution IAM Role"
+}
+{{end}}{{if .RemediationEnabled}}
+resource "aws_iam_role" "panther_remediation" {
+  name                 = "PantherRemediationRole-${local.master_account_region}"
+  description          = "The Panther master account assumes this role for automatic remediation of policy violations"
+  max_session_duration = 3600 # 1 hour
+{{template "trust"}}
+  tags = {
+    Application = "Panther"
+  }
+}
+
+resource "aws_iam_role_policy" "panther_allow_remediative_actions" {
+  name = "AllowRemediativeActions"
+  role = aws_iam_role.panther_remediation.id
+
+  policy = jsonencode({
+    Version : "2012-10-17",
+    Statement : [
+      {
+        Effect : "Allow",
+        Action : [
+          "cloudtrail:CreateTrail",
+          "cloudtrail:StartLogging",
+          "cloudtrail:UpdateTrail",
+          "dynamodb:UpdateTable",
+          "ec2:CreateFlowLogs",
+          "ec2:ModifyImageAttribute",
+          "ec2:StopInstances",
+          "ec2:TerminateInstances",
+          "guardduty:CreateDetector",
+          "iam:CreateAccessKey",
+          "iam:CreateServiceLinkedRole",
+          "iam:DeleteAccessKey",
+          "iam:UpdateAccessKey",
+          "iam:UpdateAccountPasswordPolicy",
+          "kms:EnableKeyRotation",
+          "logs:CreateLogDelivery",
+          "rds:ModifyDBInstance",
+          "rds:ModifyDBSnapshotAttribute",
+          "s3:PutBucketAcl",
+          "s3:PutBucketLogging",
+          "s3:PutBucketPublicAccessBlock",
+          "s3:PutBucketVersioning",
+          "s3:PutEncryptionConfiguration"
+        ],
+        Resource : "*"
+      }
+    ]
+  })
+}
+
+output "panther_remediation_role_arn" {
+  value       = aws_iam_role.panther_remediation.arn
+  description = "The ARN of the Panther Auto Remediation IAM Role"
+}
+{{end}}{{end}}`
+
+const terraformLogAnalysis = `{{define "aws-s3"}}{{template "header"}}variable "enable_bucket_notifications" {
+  type        = bool
+  description = "Notify Panther of new objects through an SNS topic, it replaces the notifications of the bucket"
+  default     = false
+}
+
+locals {
+  master_account_id     = {{hcl .MasterAccountID}}
+  master_account_region = {{hcl .MasterAccountRegion}}
+  role_suffix           = {{hcl .RoleSuffix}}
+  s3_bucket_name        = {{hcl .S3Bucket}}
+  s3_prefix             = {{hcl .S3Prefix}}{{if .KmsKey}}
+  kms_key_arn           = {{hcl .KmsKey}}{{end}}
+}
+
+##### IAM roles for log ingestion from an S3 bucket #####
+
+resource "aws_iam_role" "log_processing" {
+  name                 = "PantherLogProcessingRole-${local.role_suffix}"
+  max_session_duration = 3600 # 1 hour
+{{template "trust"}}
+  tags = {
+    Application = "Panther"
+  }
+}
+
+resource "aws_iam_role_policy" "log_processing" {
+  name = "ReadData"
+  role = aws_iam_role.log_processing.id
+
+  policy = jsonencode({
+    Version : "2012-10-17",
+    Statement : [
+      {
+        Effect : "Allow",
+        Action : "s3:GetBucketLocation",
+        Resource : "arn:aws:s3:::${local.s3_bucket_name}"
+      },
+      {
+        Effect : "Allow",
+        Action : "s3:GetObject",
+        Resource : "arn:aws:s3:::${local.s3_bucket_name}/${local.s3_prefix}*"
+      }{{if .KmsKey}},
+      {
+        Effect : "Allow",
+        Action : [
+          "kms:Decrypt",
+          "kms:DescribeKey"
+        ],
+        Resource : local.kms_key_arn
+      }{{end}}
+    ]
+  })
+}
+
+output "log_processing_role_arn" {
+  value       = aws_iam_role.log_processing.arn
+  description = "The ARN of the Panther Log Processing IAM Role"
+}
+
+##### Optional notifications of new objects to Panther #####
+
+resource "aws_sns_topic" "notifications" {
+  count = var.enable_bucket_notifications ? 1 : 0
+  name  = "panther-notifications-${local.role_suffix}"
+}
+
+resource "aws_sns_topic_policy" "notifications" {
+  count = var.enable_bucket_notifications ? 1 : 0
+  arn   = aws_sns_topic.notifications[0].arn
+
+  policy = jsonencode({
+    Version : "2012-10-17",
+    Statement : [
+      {
+        Sid : "AllowS3EventNotifications",
+        Effect : "Allow",
+        Principal : {
+          Service : "s3.amazonaws.com"
+        },
+        Action : "sns:Publish",
+        Resource : aws_sns_topic.notifications[0].arn
+      },
+      {
+        Sid : "AllowSubscriptionToPanther",
+        Effect : "Allow",
+        Principal : {
+          AWS : "arn:${var.aws_partition}:iam::${local.master_account_id}:root"
+        },
+        Action : "sns:Subscribe",
+        Resource : aws_sns_topic.notifications[0].arn
+      }
+    ]
+  })
+}
+
+locals {
+  queue_name = "panther-input-data-notifications-queue"
+}
+
+resource "aws_sns_topic_subscription" "notifications" {
+  count                = var.enable_bucket_notifications ? 1 : 0
+  endpoint             = "arn:${var.aws_partition}:sqs:${local.master_account_region}:${local.master_account_id}:${local.queue_name}"
+  protocol             = "sqs"
+  raw_message_delivery = false
+  topic_arn            = aws_sns_topic.notifications[0].arn
+}
+
+resource "aws_s3_bucket_notification" "notifications" {
+  count  = var.enable_bucket_notifications ? 1 : 0
+  bucket = local.s3_bucket_name
+
+  topic {
+    topic_arn     = aws_sns_topic.notifications[0].arn
+    events        = ["s3:ObjectCreated:*"]
+    filter_prefix = trimsuffix(local.s3_prefix, "*")
+  }
+
+  depends_on = [aws_sns_topic_policy.notifications]
+}
+{{end}}`
+
+const terraformSqs = `{{define "aws-sqs"}}{{template "header"}}locals {
+  role_suffix = {{hcl .RoleSuffix}}
+  queue_arn   = {{hcl .QueueArn}}{{if .KmsKey}}
+  kms_key_arn = {{hcl .KmsKey}}{{end}}
+}
+
+##### IAM policy for sending data to a Panther SQS source #####
+
+# Attach the policy to the senders, their ARNs must be allowed principals of the source
+resource "aws_iam_policy" "send_data" {
+  name        = "PantherSendData-${local.role_suffix}"
+  description = "Allows sending data to the Panther SQS source ${local.role_suffix}"
+
+  policy = jsonencode({
+    Version : "2012-10-17",
+    Statement : [
+      {
+        Effect : "Allow",
+        Action : [
+          "sqs:GetQueueUrl",
+          "sqs:SendMessage"
+        ],
+        Resource : local.queue_arn
+      }{{if .KmsKey}},
+      {
+        Effect : "Allow",
+        Action : [
+          "kms:Decrypt",
+          "kms:GenerateDataKey"
+        ],
+        Resource : local.kms_key_arn
+      }{{end}}
+    ]
+  })
+}
+
+output "send_data_policy_arn" {
+  value       = aws_iam_policy.send_data.arn
+  description = "The ARN of the IAM policy allowing to send data to Panther"
+}
+
+output "queue_arn" {
+  value       = local.queue_arn
+  description = "The ARN of the Panther SQS source queue"
+}
+{{end}}`
@@ -45,6 +45,13 @@ func (api API) UpdateIntegrationSettings(input *models.UpdateIntegrationSettings
 		return nil, err
 	}
 
+	// Integrations keep the labels they were created with until they are renamed
+	if input.IntegrationLabel != existingIntegrationItem.IntegrationLabel {
+		if err = models.ValidateIntegrationLabel(input.IntegrationLabel); err != nil {
+			return nil, &genericapi.InvalidInputError{Message: err.Error()}
+		}
+	}
+
 	if err = api.validateUniqueConstraints(existingIntegrationItem, input); err != nil {
 		return nil, err
 	}
@@ -83,12 +90,23 @@ func (api API) UpdateIntegrationSettings(input *models.UpdateIntegrationSettings
 		return nil, updateIntegrationInternalError
 	}
 
+	previousLabel := normalizedLabel(existingIntegrationItem.IntegrationLabel)
 	if err := normalizeIntegration(existingIntegrationItem, input); err != nil {
 		zap.L().Error("failed to normalize integration", zap.Error(err))
 		return nil, err
 	}
 
-	if err := dynamoClient.PutItem(existingIntegrationItem); err != nil {
+	// The label is only reserved again if it changed, the integration holds its label since it was created or
+	// since the labels of the existing integrations were reserved, see reserveLabels
+	if label := normalizedLabel(existingIntegrationItem.IntegrationLabel); label != previousLabel {
+		err = dynamoClient.PutItemWithLabel(existingIntegrationItem, label, previousLabel)
+	} else {
+		err = dynamoClient.PutItem(existingIntegrationItem)
+	}
+	if err != nil {
+		if err == ddb.ErrLabelTaken {
+			return nil, labelConflictError(existingIntegrationItem.IntegrationLabel)
+		}
 		zap.L().Error("failed to put item in ddb", zap.Error(err))
 		return nil, updateIntegrationInternalError
 	}
@@ -104,6 +122,7 @@ func (api API) validateUniqueConstraints(existingIntegrationItem *ddb.Integratio
 		zap.L().Error("failed to fetch integrations", zap.Error(errors.WithStack(err)))
 		return updateIntegrationInternalError
 	}
+	labelChanged := normalizedLabel(input.IntegrationLabel) != normalizedLabel(existingIntegrationItem.IntegrationLabel)
 	for _, existingIntegration := range existingIntegrations {
 		if existingIntegration.IntegrationType == existingIntegrationItem.IntegrationType &&
 			existingIntegration.IntegrationID != existingIntegrationItem.IntegrationID {
@@ -113,7 +132,7 @@ func (api API) validateUniqueConstraints(existingIntegrationItem *ddb.Integratio
 				if existingIntegration.AWSAccountID == existingIntegrationItem.AWSAccountID &&
 					existingIntegration.IntegrationLabel == input.IntegrationLabel {
 					// Log sources for same account need to have different labels
-					return &genericapi.InvalidInputError{
+					return &genericapi.AlreadyExistsError{
 						Message: fmt.Sprintf("Log source for account %s with label %s already onboarded",
 							existingIntegrationItem.AWSAccountID,
 							input.IntegrationLabel),
@@ -125,13 +144,10 @@ func (api API) validateUniqueConstraints(existingIntegrationItem *ddb.Integratio
 						Message: "An S3 integration with the same S3 bucket and prefix already exists.",
 					}
 				}
-			case models.IntegrationTypeSqs:
-				if existingIntegration.IntegrationLabel == input.IntegrationLabel {
-					// Sqs sources need to have different labels
-					return &genericapi.InvalidInputError{
-						Message: fmt.Sprintf("Integration with label %s already exists", input.IntegrationLabel),
-					}
-				}
+			}
+			// integrations sharing a label since before the labels were reserved can still be updated
+			if labelChanged && normalizedLabel(existingIntegration.IntegrationLabel) == normalizedLabel(input.IntegrationLabel) {
+				return labelConflictError(input.IntegrationLabel)
 			}
 		}
 	}
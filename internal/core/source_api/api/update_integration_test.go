@@ -32,6 +32,7 @@ import (
 
 	"github.com/panther-labs/panther/api/lambda/source/models"
 	"github.com/panther-labs/panther/internal/core/source_api/ddb"
+	"github.com/panther-labs/panther/pkg/genericapi"
 	"github.com/panther-labs/panther/pkg/testutils"
 )
 
@@ -50,7 +51,7 @@ func TestUpdateIntegrationSettingsAwsScanType(t *testing.T) {
 		"integrationType": {S: aws.String(models.IntegrationTypeAWSScan)},
 	}}
 	mockClient.On("GetItem", mock.Anything).Return(getResponse, nil).Once()
-	mockClient.On("PutItem", mock.Anything).Return(&dynamodb.PutItemOutput{}, nil).Once()
+	mockClient.On("TransactWriteItems", mock.Anything).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Once()
 	mockClient.On("Scan", mock.Anything).Return(&dynamodb.ScanOutput{}, nil).Once()
 	mockSQS.On("SendMessageWithContext", mock.Anything, mock.Anything).Return(&sqs.SendMessageOutput{}, nil)
 
@@ -157,6 +158,121 @@ func TestUpdateIntegrationSameLogtypes(t *testing.T) {
 	mockClient.AssertExpectations(t)
 }
 
+func TestUpdateIntegrationLabel(t *testing.T) {
+	mockClient := &testutils.DynamoDBMock{}
+	dynamoClient = &ddb.DDB{Client: mockClient, TableName: "test"}
+	evaluateIntegrationFunc = func(_ API, _ *models.CheckIntegrationInput) (string, bool, error) {
+		return "", true, nil
+	}
+
+	getResponse := &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+		"integrationId":    {S: aws.String(testIntegrationID)},
+		"integrationType":  {S: aws.String(models.IntegrationTypeAWSScan)},
+		"integrationLabel": {S: aws.String("old-label")},
+	}}
+	scanResult := &dynamodb.ScanOutput{Items: []map[string]*dynamodb.AttributeValue{
+		getResponse.Item,
+		{
+			"integrationId":    {S: aws.String("other-integration")},
+			"integrationType":  {S: aws.String(models.IntegrationTypeAWSScan)},
+			"integrationLabel": {S: aws.String("Taken Label")},
+		},
+	}}
+	mockClient.On("GetItem", mock.Anything).Return(getResponse, nil)
+	mockClient.On("Scan", mock.Anything).Return(scanResult, nil)
+	mockClient.On("TransactWriteItems", mock.Anything).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Once()
+
+	_, err := apiTest.UpdateIntegrationSettings(&models.UpdateIntegrationSettingsInput{
+		IntegrationID:    testIntegrationID,
+		IntegrationLabel: "taken-label",
+	})
+	require.Error(t, err)
+	assert.IsType(t, &genericapi.AlreadyExistsError{}, err)
+
+	// the integration keeps its own label, the new one is reserved and the old one released
+	_, err = apiTest.UpdateIntegrationSettings(&models.UpdateIntegrationSettingsInput{
+		IntegrationID:    testIntegrationID,
+		IntegrationLabel: "New Label",
+	})
+	require.NoError(t, err)
+	mockClient.AssertExpectations(t)
+
+	input := mockClient.Calls[len(mockClient.Calls)-1].Arguments.Get(0).(*dynamodb.TransactWriteItemsInput)
+	require.Len(t, input.TransactItems, 3)
+	assert.Equal(t, "label/aws-scan/new-label", aws.StringValue(input.TransactItems[1].Put.Item["integrationId"].S))
+	assert.Equal(t, "label/aws-scan/old-label", aws.StringValue(input.TransactItems[2].Delete.Key["integrationId"].S))
+}
+
+// Integrations sharing a label since before the labels were reserved can be updated if they keep it
+func TestUpdateIntegrationSharedLabel(t *testing.T) {
+	mockClient := &testutils.DynamoDBMock{}
+	dynamoClient = &ddb.DDB{Client: mockClient, TableName: "test"}
+	evaluateIntegrationFunc = func(_ API, _ *models.CheckIntegrationInput) (string, bool, error) {
+		return "", true, nil
+	}
+
+	getResponse := &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+		"integrationId":    {S: aws.String(testIntegrationID)},
+		"integrationType":  {S: aws.String(models.IntegrationTypeAWSScan)},
+		"integrationLabel": {S: aws.String("shared-label")},
+	}}
+	scanResult := &dynamodb.ScanOutput{Items: []map[string]*dynamodb.AttributeValue{
+		getResponse.Item,
+		{
+			"integrationId":    {S: aws.String("other-integration")},
+			"integrationType":  {S: aws.String(models.IntegrationTypeAWSScan)},
+			"integrationLabel": {S: aws.String("Shared Label")},
+		},
+	}}
+	mockClient.On("GetItem", mock.Anything).Return(getResponse, nil)
+	mockClient.On("Scan", mock.Anything).Return(scanResult, nil)
+	mockClient.On("PutItem", mock.Anything).Return(&dynamodb.PutItemOutput{}, nil).Once()
+
+	result, err := apiTest.UpdateIntegrationSettings(&models.UpdateIntegrationSettingsInput{
+		IntegrationID:    testIntegrationID,
+		IntegrationLabel: "shared-label",
+		ScanIntervalMins: 1440,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1440, result.ScanIntervalMins)
+	mockClient.AssertExpectations(t)
+	mockClient.AssertNotCalled(t, "TransactWriteItems", mock.Anything) // the label is not reserved again
+}
+
+// Integrations stored with labels that are no longer valid can be updated until they are renamed
+func TestUpdateIntegrationInvalidStoredLabel(t *testing.T) {
+	mockClient := &testutils.DynamoDBMock{}
+	dynamoClient = &ddb.DDB{Client: mockClient, TableName: "test"}
+	evaluateIntegrationFunc = func(_ API, _ *models.CheckIntegrationInput) (string, bool, error) {
+		return "", true, nil
+	}
+
+	getResponse := &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+		"integrationId":    {S: aws.String(testIntegrationID)},
+		"integrationType":  {S: aws.String(models.IntegrationTypeAWSScan)},
+		"integrationLabel": {S: aws.String("Prod_AWS")},
+	}}
+	mockClient.On("GetItem", mock.Anything).Return(getResponse, nil)
+	mockClient.On("Scan", mock.Anything).Return(&dynamodb.ScanOutput{}, nil).Once()
+	mockClient.On("PutItem", mock.Anything).Return(&dynamodb.PutItemOutput{}, nil).Once()
+
+	result, err := apiTest.UpdateIntegrationSettings(&models.UpdateIntegrationSettingsInput{
+		IntegrationID:    testIntegrationID,
+		IntegrationLabel: "Prod_AWS",
+		ScanIntervalMins: 1440,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1440, result.ScanIntervalMins)
+
+	_, err = apiTest.UpdateIntegrationSettings(&models.UpdateIntegrationSettingsInput{
+		IntegrationID:    testIntegrationID,
+		IntegrationLabel: "Prod_AWS_2",
+	})
+	require.Error(t, err)
+	assert.IsType(t, &genericapi.InvalidInputError{}, err)
+	mockClient.AssertExpectations(t)
+}
+
 func TestUpdateIntegrationValidTime(t *testing.T) {
 	now := time.Now()
 	validator, err := models.Validator()
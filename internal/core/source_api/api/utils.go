@@ -102,6 +102,9 @@ func itemToIntegration(item *ddb.Integration) *models.SourceIntegration {
 		integration.LastScanErrorMessage = item.LastScanErrorMessage
 		integration.StackName = item.StackName
 	case models.IntegrationTypeSqs:
+		if item.SqsConfig == nil {
+			break // an item without its config, e.g. written by hand
+		}
 		integration.SqsConfig = &models.SqsConfig{
 			S3Bucket:             item.SqsConfig.S3Bucket,
 			LogProcessingRole:    item.SqsConfig.LogProcessingRole,
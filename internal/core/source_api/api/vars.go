@@ -62,6 +62,7 @@ type envConfig struct {
 	InputDataRoleArn           string `required:"true" split_words:"true"`
 	InputDataBucketName        string `required:"true" split_words:"true"`
 	InputDataTopicArn          string `required:"true" split_words:"true"`
+	ScanTableName              string `required:"true" split_words:"true"`
 	SnapshotPollersQueueURL    string `required:"true" split_words:"true"`
 	TableName                  string `required:"true" split_words:"true"`
 	Version                    string `required:"true" split_words:"true"`
@@ -74,9 +75,11 @@ func Setup() {
 
 	awsSession = session.Must(session.NewSession())
 	dynamoClient = ddb.New(awsSession, env.TableName)
+	dynamoClient.ScanTableName = env.ScanTableName
 	sqsClient = sqs.New(awsSession)
 	templateS3Client = s3.New(awsSession, aws.NewConfig().WithRegion(templateBucketRegion))
 	lambdaClient = lambda.New(awsSession)
+	reserveLabels()
 }
 
 // API provides receiver methods for each route handler.
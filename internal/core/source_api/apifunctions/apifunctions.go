@@ -45,3 +45,54 @@ func ListLogTypes(_ context.Context, lambdaClient lambdaiface.LambdaAPI) ([]stri
 
 	return listLogTypesOutput.LogTypes, nil
 }
+
+// TriggerScan starts a full scan of an aws-scan integration and returns the scan ID
+func TriggerScan(_ context.Context, lambdaClient lambdaiface.LambdaAPI, integrationID string) (string, error) {
+	var output models.TriggerScanOutput
+	input := &models.LambdaInput{
+		TriggerScan: &models.TriggerScanInput{IntegrationID: integrationID},
+	}
+	if err := genericapi.Invoke(lambdaClient, api.LambdaName, input, &output); err != nil {
+		return "", errors.Wrapf(err, "error calling source-api to trigger a scan of %s", integrationID)
+	}
+
+	return output.ScanID, nil
+}
+
+// GetScanStatus gets the progress of a scan started with TriggerScan
+func GetScanStatus(_ context.Context, lambdaClient lambdaiface.LambdaAPI, scanID string) (*models.ScanStatus, error) {
+	var output models.ScanStatus
+	input := &models.LambdaInput{
+		GetScanStatus: &models.GetScanStatusInput{ScanID: scanID},
+	}
+	if err := genericapi.Invoke(lambdaClient, api.LambdaName, input, &output); err != nil {
+		return nil, errors.Wrapf(err, "error calling source-api to get the status of scan %s", scanID)
+	}
+
+	return &output, nil
+}
+
+// RecordBackfill adds a back-fill to the history of an integration, or updates the record with the same run ID
+func RecordBackfill(_ context.Context, lambdaClient lambdaiface.LambdaAPI, integrationID string,
+	record *models.BackfillRecord) error {
+
+	input := &models.LambdaInput{
+		RecordBackfill: &models.RecordBackfillInput{IntegrationID: integrationID, Record: *record},
+	}
+	if err := genericapi.Invoke(lambdaClient, api.LambdaName, input, nil); err != nil {
+		return errors.Wrapf(err, "error calling source-api to record backfill %s of %s", record.RunID, integrationID)
+	}
+	return nil
+}
+
+// GetBackfillHistory returns the back-fills of an integration, the most recent first
+func GetBackfillHistory(_ context.Context, lambdaClient lambdaiface.LambdaAPI, integrationID string) ([]*models.BackfillRecord, error) {
+	var output []*models.BackfillRecord
+	input := &models.LambdaInput{
+		GetBackfillHistory: &models.GetBackfillHistoryInput{IntegrationID: integrationID},
+	}
+	if err := genericapi.Invoke(lambdaClient, api.LambdaName, input, &output); err != nil {
+		return nil, errors.Wrapf(err, "error calling source-api to get the backfill history of %s", integrationID)
+	}
+	return output, nil
+}
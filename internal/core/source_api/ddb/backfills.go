@@ -0,0 +1,96 @@
+package ddb
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/pkg/errors"
+)
+
+// BackfillRecord is a back-fill of an integration, as it is stored in the backfillHistory of the integration item.
+type BackfillRecord struct {
+	RunID          string     `json:"runId"`
+	StartTime      time.Time  `json:"startTime"`
+	EndTime        *time.Time `json:"endTime,omitempty"`
+	Prefixes       []string   `json:"prefixes,omitempty"`
+	ModifiedAfter  *time.Time `json:"modifiedAfter,omitempty"`
+	ModifiedBefore *time.Time `json:"modifiedBefore,omitempty"`
+	NumFiles       uint64     `json:"numFiles"`
+	NumBytes       uint64     `json:"numBytes"`
+	NumFailed      uint64     `json:"numFailed,omitempty"`
+	Status         string     `json:"status"`
+	ErrorMessage   string     `json:"errorMessage,omitempty"`
+	Actor          string     `json:"actor,omitempty"`
+}
+
+// ErrBackfillHistoryChanged is returned by UpdateBackfillHistory if the history was updated since it was read
+var ErrBackfillHistoryChanged = errors.New("backfill history changed")
+
+// UpdateBackfillHistory replaces the back-fill history of an integration item read with GetItem.
+//
+// The history is versioned, it is only replaced if it was not updated since the item was read,
+// otherwise ErrBackfillHistoryChanged is returned and the caller reads the item again.
+func (ddb *DDB) UpdateBackfillHistory(item *Integration, history []*BackfillRecord) error {
+	historyValue, err := dynamodbattribute.Marshal(history)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal backfill history")
+	}
+	condition := "attribute_exists(#id) AND #version = :version"
+	if item.BackfillHistoryVersion == 0 {
+		condition = "attribute_exists(#id) AND attribute_not_exists(#version)"
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":history": historyValue,
+		":next":    {N: aws.String(strconv.Itoa(item.BackfillHistoryVersion + 1))},
+	}
+	if item.BackfillHistoryVersion != 0 {
+		values[":version"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(item.BackfillHistoryVersion))}
+	}
+
+	_, err = ddb.Client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: &ddb.TableName,
+		Key: map[string]*dynamodb.AttributeValue{
+			hashKey: {S: &item.IntegrationID},
+		},
+		UpdateExpression:    aws.String("SET #history = :history, #version = :next"),
+		ConditionExpression: &condition,
+		ExpressionAttributeNames: map[string]*string{
+			"#id":      aws.String(hashKey),
+			"#history": aws.String("backfillHistory"),
+			"#version": aws.String("backfillHistoryVersion"),
+		},
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrBackfillHistoryChanged
+		}
+		return errors.Wrap(err, "failed to update backfill history")
+	}
+	item.BackfillHistory = history
+	item.BackfillHistoryVersion++
+	return nil
+}
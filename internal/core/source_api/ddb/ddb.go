@@ -26,13 +26,16 @@ import (
 )
 
 const (
-	hashKey = "integrationId"
+	hashKey     = "integrationId"
+	scanHashKey = "scanId"
 )
 
 // DDB is a struct containing the DynamoDB client, and the table name to retrieve data.
 type DDB struct {
 	Client    dynamodbiface.DynamoDBAPI
 	TableName string
+	// ScanTableName is the table of the records of the scans started with TriggerScan
+	ScanTableName string
 }
 
 // New instantiates a new client.
@@ -46,6 +46,11 @@ type Integration struct {
 	LogProcessingRole string   `json:"logProcessingRole,omitempty"`
 
 	SqsConfig *SqsConfig `json:"sqsConfig,omitempty"`
+
+	// BackfillHistory are the most recent back-fills of the integration, the oldest first.
+	// BackfillHistoryVersion is incremented on every update of the history.
+	BackfillHistory        []*BackfillRecord `json:"backfillHistory,omitempty"`
+	BackfillHistoryVersion int               `json:"backfillHistoryVersion,omitempty"`
 }
 
 type IntegrationStatus struct {
@@ -0,0 +1,146 @@
+package ddb
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/pkg/errors"
+)
+
+// The labels of the integrations are reserved with items of the integrations table keyed by the integration type
+// and the label. The items point to the integration holding the label, the scans of the integrations skip them.
+const (
+	labelKeyPrefix = "label/"
+	labelOfAttr    = "labelOf"
+	// the label is free or already held by the integration
+	labelFreeCondition = "attribute_not_exists(" + hashKey + ") OR " + labelOfAttr + " = :integrationId"
+)
+
+// ErrLabelTaken is returned when another integration of the same type holds the label
+var ErrLabelTaken = errors.New("integration label is taken")
+
+// PutItemWithLabel adds or replaces a source integration, reserving its label among the integrations of its type.
+//
+// The label is stored as given, callers normalize it so that labels differing in case or spacing conflict.
+// The previous label of the integration is released if it changed, it is empty for new integrations.
+// The integration and its label are written in a single transaction, so concurrent writes cannot take the same label.
+func (ddb *DDB) PutItemWithLabel(input *Integration, label, previousLabel string) error {
+	item, err := dynamodbattribute.MarshalMap(input)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal integration metadata")
+	}
+
+	integrationID := map[string]*dynamodb.AttributeValue{
+		":integrationId": {S: &input.IntegrationID},
+	}
+	labelItem := labelKey(input.IntegrationType, label)
+	labelItem[labelOfAttr] = &dynamodb.AttributeValue{S: &input.IntegrationID}
+	transactItems := []*dynamodb.TransactWriteItem{
+		{
+			Put: &dynamodb.Put{
+				TableName: &ddb.TableName,
+				Item:      item,
+			},
+		},
+		{
+			Put: &dynamodb.Put{
+				TableName:                 &ddb.TableName,
+				Item:                      labelItem,
+				ConditionExpression:       aws.String(labelFreeCondition),
+				ExpressionAttributeValues: integrationID,
+			},
+		},
+	}
+	if previousLabel != "" && previousLabel != label {
+		transactItems = append(transactItems, &dynamodb.TransactWriteItem{
+			Delete: &dynamodb.Delete{
+				TableName:                 &ddb.TableName,
+				Key:                       labelKey(input.IntegrationType, previousLabel),
+				ConditionExpression:       aws.String(labelFreeCondition),
+				ExpressionAttributeValues: integrationID,
+			},
+		})
+	}
+
+	_, err = ddb.Client.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: transactItems,
+	})
+	if err != nil {
+		// The reasons are in the order of the items, the second one reserves the label
+		if txErr, ok := err.(*dynamodb.TransactionCanceledException); ok && len(txErr.CancellationReasons) > 1 &&
+			aws.StringValue(txErr.CancellationReasons[1].Code) == "ConditionalCheckFailed" {
+
+			return ErrLabelTaken
+		}
+		return errors.Wrap(err, "failed to put item with label")
+	}
+	return nil
+}
+
+// ReserveLabel reserves the label of an existing integration, e.g. one created before the labels were reserved.
+//
+// It returns ErrLabelTaken if another integration of the same type holds the label, it does nothing if the
+// integration already holds it.
+func (ddb *DDB) ReserveLabel(integrationID, integrationType, label string) error {
+	labelItem := labelKey(integrationType, label)
+	labelItem[labelOfAttr] = &dynamodb.AttributeValue{S: &integrationID}
+	_, err := ddb.Client.PutItem(&dynamodb.PutItemInput{
+		TableName:           &ddb.TableName,
+		Item:                labelItem,
+		ConditionExpression: aws.String(labelFreeCondition),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":integrationId": {S: &integrationID},
+		},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrLabelTaken
+		}
+		return errors.Wrap(err, "failed to put label in DDB")
+	}
+	return nil
+}
+
+// DeleteLabel releases the label held by an integration. It does nothing if another integration holds the label.
+func (ddb *DDB) DeleteLabel(integrationID, integrationType, label string) error {
+	_, err := ddb.Client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           &ddb.TableName,
+		Key:                 labelKey(integrationType, label),
+		ConditionExpression: aws.String(labelFreeCondition),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":integrationId": {S: &integrationID},
+		},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil
+		}
+		return errors.Wrap(err, "failed to delete label from DDB")
+	}
+	return nil
+}
+
+func labelKey(integrationType, label string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		hashKey: {S: aws.String(labelKeyPrefix + integrationType + "/" + label)},
+	}
+}
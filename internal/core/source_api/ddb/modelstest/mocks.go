@@ -80,6 +80,17 @@ func (client *MockDDBClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.Ge
 	return args.Get(0).(*dynamodb.GetItemOutput), args.Error(1)
 }
 
+// TransactWriteItems is a mock DynamoDB TransactWriteItems request.
+func (client *MockDDBClient) TransactWriteItems(
+	input *dynamodb.TransactWriteItemsInput,
+) (*dynamodb.TransactWriteItemsOutput, error) {
+
+	if client.TestErr {
+		return nil, errors.New("fake dynamodb.TransactWriteItems error")
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
 // BatchWriteItem is a mock DynamoDB BatchWriteItem request.
 func (client *MockDDBClient) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
 	if client.TestErr {
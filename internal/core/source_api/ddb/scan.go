@@ -19,38 +19,100 @@ package ddb
  */
 
 import (
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
 	"github.com/pkg/errors"
 )
 
-// ScanIntegrations returns all enabled integrations based on type (if type is specified).
-// It performs a DDB scan of the entire table with a filter expression.
-func (ddb *DDB) ScanIntegrations(integrationType *string) ([]*Integration, error) {
-	scanInput := &dynamodb.ScanInput{
-		TableName: &ddb.TableName,
+// IntegrationFilter selects the integrations of a scan, the conditions that are set must all match
+type IntegrationFilter struct {
+	IntegrationType *string
+	// LogType matches the integrations with the log type in their LogTypes or in the LogTypes of their SqsConfig
+	LogType *string
+}
+
+// returns the condition of the filter, it always skips the items reserving the labels of the integrations
+func (f *IntegrationFilter) condition() expression.ConditionBuilder {
+	conditions := []expression.ConditionBuilder{
+		expression.AttributeNotExists(expression.Name(labelOfAttr)),
+	}
+	if f.IntegrationType != nil {
+		conditions = append(conditions, expression.Name("integrationType").Equal(expression.Value(f.IntegrationType)))
+	}
+	if f.LogType != nil {
+		conditions = append(conditions, expression.Or(
+			expression.Name("logTypes").Contains(*f.LogType),
+			expression.Name("sqsConfig.logTypes").Contains(*f.LogType),
+		))
+	}
+	if len(conditions) == 1 {
+		return conditions[0]
 	}
-	if integrationType != nil {
-		filterExpression := expression.Name("integrationType").Equal(expression.Value(integrationType))
-		expr, err := expression.NewBuilder().WithFilter(filterExpression).Build()
+	return expression.And(conditions[0], conditions[1], conditions[2:]...)
+}
+
+// ScanIntegrations returns all enabled integrations selected by the filter.
+// It performs a DDB scan of the entire table with a filter expression, reading every page of it.
+func (ddb *DDB) ScanIntegrations(filter IntegrationFilter) ([]*Integration, error) {
+	var integrations []*Integration
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		page, lastKey, err := ddb.ScanIntegrationsPage(filter, 0, startKey)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to build filter expression")
+			return nil, err
 		}
-		scanInput.FilterExpression = expr.Filter()
-		scanInput.ExpressionAttributeNames = expr.Names()
-		scanInput.ExpressionAttributeValues = expr.Values()
+		integrations = append(integrations, page...)
+		if lastKey == nil {
+			return integrations, nil
+		}
+		startKey = lastKey
 	}
+}
+
+// ScanIntegrationsPage returns up to pageSize enabled integrations selected by the filter, starting after startKey
+// if it is not nil. A pageSize of 0 reads a single page of the scan.
+// The key of the last integration is returned if the scan has more, the next page starts after it.
+func (ddb *DDB) ScanIntegrationsPage(
+	filter IntegrationFilter, pageSize int, startKey map[string]*dynamodb.AttributeValue,
+) ([]*Integration, map[string]*dynamodb.AttributeValue, error) {
 
-	output, err := ddb.Client.Scan(scanInput)
+	expr, err := expression.NewBuilder().WithFilter(filter.condition()).Build()
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to scan table")
+		return nil, nil, errors.Wrap(err, "failed to build filter expression")
+	}
+	scanInput := &dynamodb.ScanInput{
+		TableName:                 &ddb.TableName,
+		ExclusiveStartKey:         startKey,
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
 	}
 
 	var integrations []*Integration
-	if err := dynamodbattribute.UnmarshalListOfMaps(output.Items, &integrations); err != nil {
-		return nil, errors.Wrap(err, "failed to unmarshal scan results")
-	}
+	for {
+		// The limit applies before the filter, the scan goes on until the page is full or the table is read
+		if pageSize > 0 {
+			scanInput.Limit = aws.Int64(int64(pageSize - len(integrations)))
+		}
+		output, err := ddb.Client.Scan(scanInput)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to scan table")
+		}
 
-	return integrations, nil
+		var page []*Integration
+		if err := dynamodbattribute.UnmarshalListOfMaps(output.Items, &page); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to unmarshal scan results")
+		}
+		integrations = append(integrations, page...)
+
+		if len(output.LastEvaluatedKey) == 0 {
+			return integrations, nil, nil
+		}
+		if pageSize == 0 || len(integrations) >= pageSize {
+			return integrations, output.LastEvaluatedKey, nil
+		}
+		scanInput.ExclusiveStartKey = output.LastEvaluatedKey
+	}
 }
@@ -0,0 +1,149 @@
+package ddb
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/pkg/genericapi"
+)
+
+// ScanRecord is the progress of a scan started with TriggerScan, as it is stored in DynamoDB.
+//
+// The maps are keyed by resource type. They are updated by the snapshot pollers with nested
+// attribute paths, so they are always stored, even when empty.
+type ScanRecord struct {
+	ScanID        string    `json:"scanId"`
+	IntegrationID string    `json:"integrationId"`
+	StartTime     time.Time `json:"startTime"`
+	// ExpiresAt is the DynamoDB TTL of the record, in seconds since the epoch
+	ExpiresAt int64 `json:"expiresAt"`
+	// NumRegions is the number of region scans of a resource type, set once they are all queued
+	NumRegions map[string]int `json:"numRegions"`
+	// RegionsDone counts the region scans of a resource type that polled their last page
+	RegionsDone map[string]int `json:"regionsDone"`
+	// Errors is the last poll error of a resource type
+	Errors map[string]string `json:"errors"`
+}
+
+// PutScan adds the record of a new scan
+func (ddb *DDB) PutScan(record *ScanRecord) error {
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal scan record")
+	}
+
+	_, err = ddb.Client.PutItem(&dynamodb.PutItemInput{
+		TableName:           &ddb.ScanTableName,
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(" + scanHashKey + ")"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to put scan record")
+	}
+	return nil
+}
+
+// GetScan returns the record of a scan, or nil if there is none
+func (ddb *DDB) GetScan(scanID string) (*ScanRecord, error) {
+	output, err := ddb.Client.GetItem(&dynamodb.GetItemInput{
+		TableName: &ddb.ScanTableName,
+		Key: map[string]*dynamodb.AttributeValue{
+			scanHashKey: {S: &scanID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, &genericapi.AWSError{Err: err, Method: "Dynamodb.GetItem"}
+	}
+	if output.Item == nil {
+		return nil, nil
+	}
+
+	var record ScanRecord
+	if err := dynamodbattribute.UnmarshalMap(output.Item, &record); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal scan record")
+	}
+	return &record, nil
+}
+
+// ScanProgress is a progress update of a resource type of a scan
+type ScanProgress struct {
+	ResourceType string
+	NumRegions   *int
+	ErrorMessage string
+	RegionDone   bool
+}
+
+// UpdateScan records the progress of a resource type of a scan.
+//
+// It returns false if there is no record of the scan.
+func (ddb *DDB) UpdateScan(scanID string, progress *ScanProgress) (bool, error) {
+	// Resource types contain dots, so the nested paths are written by hand instead of with the expression builder.
+	// ADD only supports top level attributes, so the region scans are counted with SET.
+	var set []string
+	names := map[string]*string{"#resourceType": &progress.ResourceType}
+	values := map[string]*dynamodb.AttributeValue{}
+	if progress.NumRegions != nil {
+		names["#numRegions"] = aws.String("numRegions")
+		set = append(set, "#numRegions.#resourceType = :numRegions")
+		values[":numRegions"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(*progress.NumRegions))}
+	}
+	if progress.ErrorMessage != "" {
+		names["#errors"] = aws.String("errors")
+		set = append(set, "#errors.#resourceType = :errorMessage")
+		values[":errorMessage"] = &dynamodb.AttributeValue{S: aws.String(progress.ErrorMessage)}
+	}
+	if progress.RegionDone {
+		names["#regionsDone"] = aws.String("regionsDone")
+		set = append(set, "#regionsDone.#resourceType = if_not_exists(#regionsDone.#resourceType, :zero) + :one")
+		values[":zero"] = &dynamodb.AttributeValue{N: aws.String("0")}
+		values[":one"] = &dynamodb.AttributeValue{N: aws.String("1")}
+	}
+	if len(set) == 0 {
+		return true, nil
+	}
+
+	_, err := ddb.Client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: &ddb.ScanTableName,
+		Key: map[string]*dynamodb.AttributeValue{
+			scanHashKey: {S: &scanID},
+		},
+		UpdateExpression:          aws.String("SET " + strings.Join(set, ", ")),
+		ConditionExpression:       aws.String("attribute_exists(" + scanHashKey + ")"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "failed to update scan record")
+	}
+	return true, nil
+}
@@ -0,0 +1,415 @@
+package backfill
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/google/uuid"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/pkg/genericapi"
+	"github.com/panther-labs/panther/pkg/lambdalogger"
+)
+
+const (
+	LambdaName            = "panther-backfill-api"
+	sourceAPIFunctionName = "panther-source-api"
+
+	// Time reserved at the end of an invocation to publish the last batch, save progress and continue the job
+	gracefulExitTimeout = time.Minute
+	// Guards against a job continuing forever, 1000 chunks of 5 minutes is more than 3 days
+	maxInvocations = 1000
+)
+
+// A job runs in chunks of one Lambda invocation each, the listing of a chunk stops after chunkDuration
+// so that progress is saved and cancel requests are checked regularly.
+var chunkDuration = 5 * time.Minute
+
+// API runs back-fill jobs server-side, it is the shared listing and publishing of the s3queue ops tool
+// run in chunks by a Lambda invoking itself.
+type API struct {
+	Jobs         JobStore
+	LambdaClient lambdaiface.LambdaAPI
+	SQS          sqsiface.SQSAPI
+	// FunctionName is the Lambda running the API, it invokes itself to run the next chunk of a job
+	FunctionName string
+	// QueueURL is the default queue of the notifications
+	QueueURL string
+	// NewS3Client returns a client able to list the objects of a job
+	NewS3Client func(spec *JobSpec) (s3iface.S3API, error)
+}
+
+type SubmitBackfillInput struct {
+	JobSpec
+}
+
+// SubmitBackfill validates and stores a new job and starts running it
+func (api *API) SubmitBackfill(ctx context.Context, input *SubmitBackfillInput) (*Job, error) {
+	spec := input.JobSpec
+	if err := api.resolveSpec(ctx, &spec); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        uuid.New().String(),
+		CreatedAt: now,
+		Spec:      spec,
+		Progress: Progress{
+			State:     StatePending,
+			UpdatedAt: now,
+		},
+	}
+	if err := api.Jobs.CreateJob(ctx, job); err != nil {
+		return nil, err
+	}
+	lambdalogger.FromContext(ctx).Info("submitted backfill", zap.String("jobId", job.ID), zap.Any("spec", &job.Spec))
+	if err := api.continueJob(ctx, job.ID, 0); err != nil {
+		job.Progress.State = StateFailed
+		job.Progress.Error = err.Error()
+		job.Progress.UpdatedAt = time.Now().UTC()
+		if _, updateErr := api.Jobs.UpdateProgress(ctx, job.ID, &job.Progress); updateErr != nil {
+			lambdalogger.FromContext(ctx).Error("failed to update job", zap.String("jobId", job.ID), zap.Error(updateErr))
+		}
+		api.recordHistory(ctx, job)
+		return nil, err
+	}
+	api.recordHistory(ctx, job)
+	return job, nil
+}
+
+// resolveSpec fills in the source details of an integration and the defaults of a job
+func (api *API) resolveSpec(ctx context.Context, spec *JobSpec) error {
+	if spec.IntegrationID != "" {
+		source, err := api.findIntegration(ctx, spec.IntegrationID)
+		if err != nil {
+			return err
+		}
+		sourcePrefix := source.RequiredS3Prefix()
+		if spec.Prefix != "" && !strings.HasPrefix(spec.Prefix, sourcePrefix) {
+			return errors.Errorf("prefix %q is not under the prefix %q of integration %s", spec.Prefix, sourcePrefix, spec.IntegrationID)
+		}
+		if spec.Bucket != "" && spec.Bucket != source.RequiredS3Bucket() {
+			return errors.Errorf("bucket %q is not the bucket of integration %s", spec.Bucket, spec.IntegrationID)
+		}
+		spec.Bucket = source.RequiredS3Bucket()
+		if spec.Prefix == "" {
+			spec.Prefix = sourcePrefix
+		}
+		if spec.AccountID == "" {
+			spec.AccountID = source.AWSAccountID
+		}
+		if spec.RoleARN == "" {
+			spec.RoleARN = source.RequiredLogProcessingRole()
+		}
+	}
+	if spec.Bucket == "" {
+		return errors.New("either an integration id or a bucket is required")
+	}
+	if spec.AccountID == "" {
+		return errors.New("the account id of the source is required")
+	}
+	if _, err := spec.Filter.Matcher(); err != nil {
+		return err
+	}
+	if spec.QueueURL == "" {
+		spec.QueueURL = api.QueueURL
+	}
+	return nil
+}
+
+func (api *API) findIntegration(ctx context.Context, id string) (*models.SourceIntegration, error) {
+	input := &models.LambdaInput{
+		ListIntegrations: &models.ListIntegrationsInput{},
+	}
+	var integrations []*models.SourceIntegration
+	if err := genericapi.Invoke(api.LambdaClient, sourceAPIFunctionName, input, &integrations); err != nil {
+		return nil, errors.Wrap(err, "failed to list integrations")
+	}
+	for _, integration := range integrations {
+		if integration.IntegrationID == id {
+			return integration, nil
+		}
+	}
+	return nil, errors.Errorf("integration %s not found", id)
+}
+
+type GetBackfillInput struct {
+	ID string `json:"id" validate:"required"`
+}
+
+// GetBackfill returns a job with its progress
+func (api *API) GetBackfill(ctx context.Context, input *GetBackfillInput) (*Job, error) {
+	job, err := api.Jobs.GetJob(ctx, input.ID)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil {
+		return nil, errors.Errorf("backfill job %q not found", input.ID)
+	}
+	return job, nil
+}
+
+type CancelBackfillInput struct {
+	ID string `json:"id" validate:"required"`
+}
+
+// CancelBackfill requests a job to stop, it is canceled before its next chunk
+func (api *API) CancelBackfill(ctx context.Context, input *CancelBackfillInput) (*Job, error) {
+	job, err := api.Jobs.RequestCancel(ctx, input.ID)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil {
+		return nil, errors.Errorf("backfill job %q not found", input.ID)
+	}
+	return job, nil
+}
+
+type RunBackfillInput struct {
+	ID string `json:"id" validate:"required"`
+	// Invocation is the number of chunks already run, it discards duplicate invocations
+	Invocation int `json:"invocation"`
+}
+
+// RunBackfill runs the next chunk of a job and invokes the Lambda again to continue it
+func (api *API) RunBackfill(ctx context.Context, input *RunBackfillInput) error {
+	logger := lambdalogger.FromContext(ctx).With(zap.String("jobId", input.ID), zap.Int("invocation", input.Invocation))
+	job, err := api.Jobs.GetJob(ctx, input.ID)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return errors.Errorf("backfill job %q not found", input.ID)
+	}
+	if job.Progress.Done() || job.Progress.NumInvocations != input.Invocation {
+		logger.Warn("ignoring stale invocation", zap.String("state", job.Progress.State),
+			zap.Int("numInvocations", job.Progress.NumInvocations))
+		return nil
+	}
+
+	progress := job.Progress
+	progress.NumInvocations++
+	if !job.CancelRequested {
+		progress.State = StateRunning
+		done, err := api.runChunk(ctx, job, &progress)
+		switch {
+		case err != nil:
+			progress.State = StateFailed
+			progress.Error = err.Error()
+		case done:
+			progress.State = StateSucceeded
+		case progress.NumInvocations >= maxInvocations:
+			progress.State = StateFailed
+			progress.Error = fmt.Sprintf("backfill did not complete after %d invocations", progress.NumInvocations)
+		}
+	} else {
+		progress.State = StateCanceled
+	}
+	progress.UpdatedAt = time.Now().UTC()
+	job, err = api.Jobs.UpdateProgress(ctx, input.ID, &progress)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return errors.Errorf("backfill job %q not found", input.ID)
+	}
+	logger.Info("backfill progress", zap.Any("progress", &job.Progress))
+	api.recordHistory(ctx, job)
+	if job.Progress.Done() {
+		return nil
+	}
+	// a cancel request during the chunk is handled by the next invocation, so that the state is updated once
+	return api.continueJob(ctx, job.ID, job.Progress.NumInvocations)
+}
+
+// runChunk lists and publishes the objects of a job after the last key of the progress until the chunk duration
+// is over. It returns true if the listing is complete.
+func (api *API) runChunk(ctx context.Context, job *Job, progress *Progress) (bool, error) {
+	spec := &job.Spec
+	match, err := spec.Filter.Matcher()
+	if err != nil {
+		return false, err
+	}
+	s3Client, err := api.NewS3Client(spec)
+	if err != nil {
+		return false, err
+	}
+	publisher := &Publisher{
+		Destination: &SQSDestination{
+			SQS:      api.SQS,
+			QueueURL: spec.QueueURL,
+			TopicARN: FakeTopicARN(spec.AccountID),
+		},
+		RunID: job.ID,
+	}
+
+	// the listing stops at the end of the chunk, the publishing of the last batch uses the remaining time
+	chunkCtx, cancel := context.WithTimeout(ctx, chunkDuration)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) > gracefulExitTimeout {
+		chunkCtx, cancel = context.WithDeadline(chunkCtx, deadline.Add(-gracefulExitTimeout))
+		defer cancel()
+	}
+
+	batch := make([]*events.S3Event, 0, SendBatchSize)
+	var batchBytes uint64
+	publish := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := publisher.Publish(ctx, batch); err != nil {
+			progress.NumFailed += uint64(len(batch))
+			return err
+		}
+		progress.NumPublished += uint64(len(batch))
+		progress.NumBytes += batchBytes
+		// only published objects move the position, so that a failed chunk can be resumed
+		progress.LastKey = batch[len(batch)-1].Records[0].S3.Object.Key
+		batch, batchBytes = batch[:0], 0
+		return nil
+	}
+
+	var publishErr error
+	limitReached := false
+	listInput := &ListInput{
+		Bucket:     spec.Bucket,
+		Prefix:     spec.Prefix,
+		StartAfter: progress.LastKey,
+		Match:      match,
+	}
+	listErr := List(chunkCtx, s3Client, listInput, func(object *s3.Object) bool {
+		if spec.Limit > 0 && progress.NumListed >= spec.Limit {
+			limitReached = true
+			return false
+		}
+		if chunkCtx.Err() != nil {
+			return false
+		}
+		progress.NumListed++
+		batch = append(batch, NewNotification(spec.Bucket, object))
+		batchBytes += uint64(aws.Int64Value(object.Size))
+		if len(batch) == SendBatchSize {
+			publishErr = publish()
+		}
+		return publishErr == nil
+	})
+	if publishErr != nil {
+		return false, publishErr
+	}
+	if err := publish(); err != nil {
+		return false, err
+	}
+	switch {
+	case limitReached:
+		return true, nil
+	case chunkCtx.Err() != nil && ctx.Err() == nil:
+		return false, nil // the chunk is over, continue in the next invocation
+	case listErr != nil:
+		return false, listErr
+	default:
+		return true, nil
+	}
+}
+
+// recordHistory adds or updates the record of a job in the back-fill history of its integration.
+// The history is informational, failures to record it are only logged.
+func (api *API) recordHistory(ctx context.Context, job *Job) {
+	if job.Spec.IntegrationID == "" {
+		return
+	}
+	input := &models.LambdaInput{
+		RecordBackfill: &models.RecordBackfillInput{
+			IntegrationID: job.Spec.IntegrationID,
+			Record:        *historyRecord(job),
+		},
+	}
+	if err := genericapi.Invoke(api.LambdaClient, sourceAPIFunctionName, input, nil); err != nil {
+		lambdalogger.FromContext(ctx).Warn("failed to record backfill history", zap.String("jobId", job.ID), zap.Error(err))
+	}
+}
+
+// historyRecord returns the back-fill history record of a job
+func historyRecord(job *Job) *models.BackfillRecord {
+	record := &models.BackfillRecord{
+		RunID:        job.ID,
+		StartTime:    job.CreatedAt,
+		Prefixes:     []string{"s3://" + job.Spec.Bucket + "/" + job.Spec.Prefix},
+		NumFiles:     job.Progress.NumPublished,
+		NumBytes:     job.Progress.NumBytes,
+		NumFailed:    job.Progress.NumFailed,
+		Status:       job.Progress.State,
+		ErrorMessage: job.Progress.Error,
+		Actor:        job.Spec.Actor,
+	}
+	if record.Actor == "" {
+		record.Actor = LambdaName
+	}
+	filter := &job.Spec.Filter
+	if !filter.ModifiedAfter.IsZero() {
+		record.ModifiedAfter = &filter.ModifiedAfter
+	}
+	if !filter.ModifiedBefore.IsZero() {
+		record.ModifiedBefore = &filter.ModifiedBefore
+	}
+	switch {
+	case job.Progress.Done():
+		record.EndTime = &job.Progress.UpdatedAt
+	case job.Progress.State == StatePending:
+		record.Status = models.BackfillStatusRunning // the history does not tell pending and running jobs apart
+	}
+	return record
+}
+
+// continueJob invokes the Lambda asynchronously to run the next chunk of a job
+func (api *API) continueJob(ctx context.Context, id string, invocation int) error {
+	payload, err := jsoniter.Marshal(struct {
+		RunBackfill *RunBackfillInput
+	}{
+		RunBackfill: &RunBackfillInput{
+			ID:         id,
+			Invocation: invocation,
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal payload")
+	}
+	input := &lambda.InvokeInput{
+		FunctionName:   aws.String(api.FunctionName),
+		InvocationType: aws.String(lambda.InvocationTypeEvent),
+		Payload:        payload,
+	}
+	if _, err := api.LambdaClient.InvokeWithContext(ctx, input); err != nil {
+		return errors.Wrapf(err, "failed to continue backfill job %q", id)
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package backfill
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/api/lambda/source/models"
+	"github.com/panther-labs/panther/pkg/testutils"
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
+)
+
+// memJobs is an in-memory JobStore
+type memJobs struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+func (m *memJobs) CreateJob(_ context.Context, job *Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.jobs == nil {
+		m.jobs = make(map[string]Job)
+	}
+	if _, exists := m.jobs[job.ID]; exists {
+		return errors.New("job exists")
+	}
+	m.jobs[job.ID] = *job
+	return nil
+}
+
+func (m *memJobs) GetJob(_ context.Context, id string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, nil
+	}
+	return &job, nil
+}
+
+func (m *memJobs) UpdateProgress(_ context.Context, id string, progress *Progress) (*Job, error) {
+	return m.update(id, func(job *Job) {
+		job.Progress = *progress
+	})
+}
+
+func (m *memJobs) RequestCancel(_ context.Context, id string) (*Job, error) {
+	return m.update(id, func(job *Job) {
+		job.CancelRequested = true
+	})
+}
+
+func (m *memJobs) update(id string, fn func(job *Job)) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, nil
+	}
+	fn(&job)
+	m.jobs[id] = job
+	return &job, nil
+}
+
+type testAPI struct {
+	*API
+	jobs      *memJobs
+	lambda    *testutils.LambdaMock
+	sqsClient *awsfake.SQSSink
+	s3Client  *awsfake.S3
+}
+
+func newTestAPI(s3Client *awsfake.S3) *testAPI {
+	api := &testAPI{
+		jobs:      &memJobs{},
+		lambda:    &testutils.LambdaMock{},
+		sqsClient: &awsfake.SQSSink{},
+		s3Client:  s3Client,
+	}
+	api.API = &API{
+		Jobs:         api.jobs,
+		LambdaClient: api.lambda,
+		SQS:          api.sqsClient,
+		FunctionName: LambdaName,
+		QueueURL:     testQueue,
+		NewS3Client: func(spec *JobSpec) (s3iface.S3API, error) {
+			return s3Client, nil
+		},
+	}
+	return api
+}
+
+// expectContinue expects the API to invoke itself to run a chunk of a job
+func (api *testAPI) expectContinue(invocation int) {
+	api.lambda.On("InvokeWithContext", mock.Anything, mock.MatchedBy(func(input *lambda.InvokeInput) bool {
+		var payload struct {
+			RunBackfill RunBackfillInput
+		}
+		return aws.StringValue(input.FunctionName) == LambdaName &&
+			aws.StringValue(input.InvocationType) == lambda.InvocationTypeEvent &&
+			jsoniter.Unmarshal(input.Payload, &payload) == nil &&
+			payload.RunBackfill.Invocation == invocation
+	}), mock.Anything).Return(&lambda.InvokeOutput{}, nil).Once()
+}
+
+func (api *testAPI) submit(t *testing.T, spec JobSpec) *Job {
+	api.expectContinue(0)
+	job, err := api.SubmitBackfill(context.Background(), &SubmitBackfillInput{JobSpec: spec})
+	require.NoError(t, err)
+	return job
+}
+
+func TestSubmitAndRun(t *testing.T) {
+	api := newTestAPI(testS3(3, 10))
+	job := api.submit(t, JobSpec{
+		Bucket:    testBucket,
+		Prefix:    testPrefix,
+		AccountID: testAccount,
+		Filter:    Filter{ModifiedBefore: testStart.Add(2 * time.Hour)},
+	})
+	assert.Equal(t, StatePending, job.Progress.State)
+	assert.Equal(t, testQueue, job.Spec.QueueURL) // default target
+
+	err := api.RunBackfill(context.Background(), &RunBackfillInput{ID: job.ID})
+	require.NoError(t, err)
+	api.lambda.AssertExpectations(t) // no continuation
+
+	job, err = api.GetBackfill(context.Background(), &GetBackfillInput{ID: job.ID})
+	require.NoError(t, err)
+	assert.Equal(t, StateSucceeded, job.Progress.State)
+	assert.Equal(t, uint64(20), job.Progress.NumListed)
+	assert.Equal(t, uint64(20), job.Progress.NumPublished)
+	assert.Zero(t, job.Progress.NumFailed)
+	assert.Equal(t, api.s3Client.Spec.Key(19), job.Progress.LastKey)
+	assert.Equal(t, 1, job.Progress.NumInvocations)
+	assert.Len(t, api.sqsClient.Messages(), 20)
+	assert.Equal(t, 2, api.sqsClient.Calls()) // batches of 10
+
+	// a duplicate invocation does nothing
+	err = api.RunBackfill(context.Background(), &RunBackfillInput{ID: job.ID})
+	require.NoError(t, err)
+	assert.Len(t, api.sqsClient.Messages(), 20)
+}
+
+func TestRunBackfillChunks(t *testing.T) {
+	api := newTestAPI(testS3(1, 25))
+	job := api.submit(t, JobSpec{Bucket: testBucket, AccountID: testAccount, Limit: 15})
+
+	// the chunk is over before anything is listed, the job continues in the next invocation
+	defer func(duration time.Duration) {
+		chunkDuration = duration
+	}(chunkDuration)
+	chunkDuration = 0
+	api.expectContinue(1)
+	require.NoError(t, api.RunBackfill(context.Background(), &RunBackfillInput{ID: job.ID}))
+	api.lambda.AssertExpectations(t)
+	job, err := api.GetBackfill(context.Background(), &GetBackfillInput{ID: job.ID})
+	require.NoError(t, err)
+	assert.Equal(t, StateRunning, job.Progress.State)
+	assert.Equal(t, 1, job.Progress.NumInvocations)
+	assert.Empty(t, api.sqsClient.Messages())
+
+	// resume after the last published key
+	job.Progress.NumListed, job.Progress.NumPublished = 5, 5
+	job.Progress.LastKey = api.s3Client.Spec.Key(4)
+	_, err = api.jobs.UpdateProgress(context.Background(), job.ID, &job.Progress)
+	require.NoError(t, err)
+	chunkDuration = time.Minute
+	require.NoError(t, api.RunBackfill(context.Background(), &RunBackfillInput{ID: job.ID, Invocation: 1}))
+	job, err = api.GetBackfill(context.Background(), &GetBackfillInput{ID: job.ID})
+	require.NoError(t, err)
+	assert.Equal(t, StateSucceeded, job.Progress.State)
+	assert.Equal(t, uint64(15), job.Progress.NumPublished) // limited
+	assert.Equal(t, api.s3Client.Spec.Key(14), job.Progress.LastKey)
+	messages := api.sqsClient.Messages()
+	require.Len(t, messages, 10)
+}
+
+func TestCancelBackfill(t *testing.T) {
+	api := newTestAPI(testS3(1, 10))
+	job := api.submit(t, JobSpec{Bucket: testBucket, AccountID: testAccount})
+
+	job, err := api.CancelBackfill(context.Background(), &CancelBackfillInput{ID: job.ID})
+	require.NoError(t, err)
+	assert.True(t, job.CancelRequested)
+
+	require.NoError(t, api.RunBackfill(context.Background(), &RunBackfillInput{ID: job.ID}))
+	api.lambda.AssertExpectations(t)
+	job, err = api.GetBackfill(context.Background(), &GetBackfillInput{ID: job.ID})
+	require.NoError(t, err)
+	assert.Equal(t, StateCanceled, job.Progress.State)
+	assert.Zero(t, api.sqsClient.Calls())
+
+	_, err = api.CancelBackfill(context.Background(), &CancelBackfillInput{ID: "missing"})
+	assert.Error(t, err)
+}
+
+func TestRunBackfillPublishFailure(t *testing.T) {
+	api := newTestAPI(testS3(1, 15))
+	api.sqsClient.Failures.Err = errors.New("send failed")
+	job := api.submit(t, JobSpec{Bucket: testBucket, AccountID: testAccount})
+
+	require.NoError(t, api.RunBackfill(context.Background(), &RunBackfillInput{ID: job.ID}))
+	api.lambda.AssertExpectations(t)
+	job, err := api.GetBackfill(context.Background(), &GetBackfillInput{ID: job.ID})
+	require.NoError(t, err)
+	assert.Equal(t, StateFailed, job.Progress.State)
+	assert.Contains(t, job.Progress.Error, "send failed")
+	assert.Equal(t, uint64(10), job.Progress.NumFailed)
+	assert.Zero(t, job.Progress.NumPublished)
+	assert.Empty(t, job.Progress.LastKey)
+}
+
+func TestSubmitBackfillIntegration(t *testing.T) {
+	api := newTestAPI(testS3(1, 1))
+	integrations, err := jsoniter.Marshal([]*models.SourceIntegration{{
+		SourceIntegrationMetadata: models.SourceIntegrationMetadata{
+			AWSAccountID:      testAccount,
+			IntegrationID:     "integration",
+			IntegrationType:   models.IntegrationTypeAWS3,
+			S3Bucket:          testBucket,
+			S3Prefix:          "logs/",
+			LogProcessingRole: "arn:aws:iam::123456789012:role/log-processing",
+		},
+	}})
+	require.NoError(t, err)
+	api.lambda.On("Invoke", mock.Anything).Return(&lambda.InvokeOutput{Payload: integrations}, nil)
+
+	job := api.submit(t, JobSpec{IntegrationID: "integration", Prefix: "logs/year=2020/"})
+	assert.Equal(t, testBucket, job.Spec.Bucket)
+	assert.Equal(t, "logs/year=2020/", job.Spec.Prefix)
+	assert.Equal(t, testAccount, job.Spec.AccountID)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/log-processing", job.Spec.RoleARN)
+
+	// outside of the integration
+	_, err = api.SubmitBackfill(context.Background(), &SubmitBackfillInput{
+		JobSpec: JobSpec{IntegrationID: "integration", Prefix: "other/"},
+	})
+	assert.Error(t, err)
+	_, err = api.SubmitBackfill(context.Background(), &SubmitBackfillInput{
+		JobSpec: JobSpec{IntegrationID: "missing"},
+	})
+	assert.Error(t, err)
+	// a bucket needs an account
+	_, err = api.SubmitBackfill(context.Background(), &SubmitBackfillInput{
+		JobSpec: JobSpec{Bucket: testBucket},
+	})
+	assert.Error(t, err)
+}
+
+func TestBackfillHistory(t *testing.T) {
+	api := newTestAPI(testS3(1, 5))
+	integrations, err := jsoniter.Marshal([]*models.SourceIntegration{{
+		SourceIntegrationMetadata: models.SourceIntegrationMetadata{
+			AWSAccountID:    testAccount,
+			IntegrationID:   "integration",
+			IntegrationType: models.IntegrationTypeAWS3,
+			S3Bucket:        testBucket,
+			S3Prefix:        testPrefix,
+		},
+	}})
+	require.NoError(t, err)
+	var records []*models.RecordBackfillInput
+	api.lambda.On("Invoke", mock.Anything).Return(&lambda.InvokeOutput{Payload: integrations}, nil).Run(func(args mock.Arguments) {
+		var input models.LambdaInput
+		require.NoError(t, jsoniter.Unmarshal(args.Get(0).(*lambda.InvokeInput).Payload, &input))
+		if input.RecordBackfill != nil {
+			records = append(records, input.RecordBackfill)
+		}
+	})
+
+	job := api.submit(t, JobSpec{
+		IntegrationID: "integration",
+		Filter:        Filter{ModifiedAfter: testStart},
+		Actor:         "ops",
+	})
+	require.Len(t, records, 1)
+	assert.Equal(t, "integration", records[0].IntegrationID)
+	assert.Equal(t, job.ID, records[0].Record.RunID)
+	assert.Equal(t, models.BackfillStatusRunning, records[0].Record.Status)
+	assert.Equal(t, []string{"s3://" + testBucket + "/" + testPrefix}, records[0].Record.Prefixes)
+	assert.True(t, testStart.Equal(*records[0].Record.ModifiedAfter))
+	assert.Nil(t, records[0].Record.ModifiedBefore)
+	assert.Equal(t, "ops", records[0].Record.Actor)
+	assert.Nil(t, records[0].Record.EndTime)
+
+	require.NoError(t, api.RunBackfill(context.Background(), &RunBackfillInput{ID: job.ID}))
+	require.Len(t, records, 2)
+	assert.Equal(t, job.ID, records[1].Record.RunID)
+	assert.Equal(t, models.BackfillStatusSucceeded, records[1].Record.Status)
+	assert.Equal(t, uint64(5), records[1].Record.NumFiles)
+	assert.NotNil(t, records[1].Record.EndTime)
+
+	// jobs of a bucket are not recorded
+	api.submit(t, JobSpec{Bucket: testBucket, AccountID: testAccount})
+	assert.Len(t, records, 2)
+}
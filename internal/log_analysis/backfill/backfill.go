@@ -0,0 +1,567 @@
+package backfill
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/awsretry"
+	"github.com/panther-labs/panther/pkg/stats"
+)
+
+// The listing and publishing of back-fills is shared by the s3queue ops tool and the back-fill jobs API,
+// so that a back-fill behaves the same wherever it runs.
+
+const (
+	// SendBatchSize is the max number of notifications sent in one batch.
+	// There is 1 file per notification to limit the blast radius in case of failure.
+	SendBatchSize = 10
+
+	fakeTopicARNTemplate = "arn:aws:sns:us-east-1:%s:panther-fake-s3queue-topic"
+	sendBatchTimeout     = time.Minute
+)
+
+// FakeTopicARN returns the topic ARN of back-fill notifications.
+// The log processor takes the account of the source from it to assume role for reading.
+func FakeTopicARN(accountID string) string {
+	return fmt.Sprintf(fakeTopicARNTemplate, accountID)
+}
+
+// Filter selects the objects to back-fill, the zero value selects all objects
+type Filter struct {
+	// ModifiedAfter and ModifiedBefore (exclusive) bound the last modified time of objects, ignored if zero
+	ModifiedAfter  time.Time `json:"modifiedAfter,omitempty"`
+	ModifiedBefore time.Time `json:"modifiedBefore,omitempty"`
+	// KeyPattern is a regular expression the keys must match, ignored if empty
+	KeyPattern string `json:"keyPattern,omitempty"`
+}
+
+// Matcher returns a function selecting the objects of the filter. Empty objects are never selected.
+func (f *Filter) Matcher() (func(object *s3.Object) bool, error) {
+	if !f.ModifiedAfter.IsZero() && !f.ModifiedBefore.IsZero() && !f.ModifiedAfter.Before(f.ModifiedBefore) {
+		return nil, errors.Errorf("modifiedAfter %s must be before modifiedBefore %s", f.ModifiedAfter, f.ModifiedBefore)
+	}
+	var keyRegexp *regexp.Regexp
+	if f.KeyPattern != "" {
+		var err error
+		if keyRegexp, err = regexp.Compile(f.KeyPattern); err != nil {
+			return nil, errors.Wrapf(err, "invalid key pattern %q", f.KeyPattern)
+		}
+	}
+	after, before := f.ModifiedAfter, f.ModifiedBefore
+	return func(object *s3.Object) bool {
+		if aws.Int64Value(object.Size) <= 0 { // we only care about objects with size
+			return false
+		}
+		modified := aws.TimeValue(object.LastModified)
+		if !after.IsZero() && modified.Before(after) {
+			return false
+		}
+		if !before.IsZero() && !modified.Before(before) {
+			return false
+		}
+		return keyRegexp == nil || keyRegexp.MatchString(aws.StringValue(object.Key))
+	}, nil
+}
+
+// ListInput is the range of objects to list
+type ListInput struct {
+	Bucket string
+	Prefix string
+	// StartAfter is the key to resume a listing after
+	StartAfter string
+	// Until if set is the last key listed, the listing stops at the keys after it. It does not go with Shuffle.
+	Until string
+	// Delimiter if set lists only the objects at the level of Prefix, not the ones under its common prefixes
+	Delimiter string
+	// RequestPayer is set to s3.RequestPayerRequester to list a requester-pays bucket at the expense of the caller
+	RequestPayer string
+	// ExpectedBucketOwner if set is the account the bucket must belong to, s3 denies the listing otherwise
+	ExpectedBucketOwner string
+	// Match selects the objects passed to fn, if nil all non-empty objects are selected
+	Match func(object *s3.Object) bool
+	// Shuffle if set reorders the objects of every page before they are matched, e.g. rand.Shuffle
+	Shuffle func(n int, swap func(i, j int))
+}
+
+// List calls fn with the selected objects in key order until fn returns false, the listing fails or ctx is done.
+// No page is listed once ctx is done. The objects of a page are in the order of input.Shuffle if set.
+func List(ctx context.Context, s3Client s3iface.S3API, input *ListInput, fn func(object *s3.Object) bool) error {
+	match := input.Match
+	if match == nil {
+		match = func(object *s3.Object) bool {
+			return aws.Int64Value(object.Size) > 0
+		}
+	}
+	listInput := &s3.ListObjectsV2Input{ // pages of 1000 keys, the max of s3
+		Bucket: aws.String(input.Bucket),
+		Prefix: aws.String(input.Prefix),
+	}
+	if input.StartAfter != "" {
+		listInput.StartAfter = aws.String(input.StartAfter)
+	}
+	if input.Delimiter != "" {
+		listInput.Delimiter = aws.String(input.Delimiter)
+	}
+	if input.RequestPayer != "" {
+		listInput.RequestPayer = aws.String(input.RequestPayer)
+	}
+	if input.ExpectedBucketOwner != "" {
+		listInput.ExpectedBucketOwner = aws.String(input.ExpectedBucketOwner)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := s3Client.ListObjectsV2PagesWithContext(ctx, listInput, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		if ctx.Err() != nil {
+			return false // the objects of a page listed as ctx was done are dropped
+		}
+		if input.Shuffle != nil {
+			input.Shuffle(len(page.Contents), func(i, j int) {
+				page.Contents[i], page.Contents[j] = page.Contents[j], page.Contents[i]
+			})
+		}
+		for _, object := range page.Contents {
+			if input.Until != "" && aws.StringValue(object.Key) > input.Until {
+				return false
+			}
+			if match(object) && !fn(object) {
+				return false // "To stop iterating, return false from the fn function."
+			}
+		}
+		return true
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to list s3://%s/%s", input.Bucket, input.Prefix)
+	}
+	return nil
+}
+
+// Object is the compact record of an object to notify, so that listings of millions of objects queue little memory.
+// Its notification is only built when it is published. The objects of a listing share the bucket and region strings.
+type Object struct {
+	Bucket       string
+	Key          string
+	ETag         string
+	Size         int64
+	LastModified time.Time
+	// Region is the region of the bucket, the notification has no region if empty
+	Region string
+}
+
+// NewObject returns the record of a listed object
+func NewObject(bucket string, object *s3.Object) Object {
+	return Object{
+		Bucket:       bucket,
+		Key:          aws.StringValue(object.Key),
+		ETag:         notify.NormalizeETag(aws.StringValue(object.ETag)),
+		Size:         aws.Int64Value(object.Size),
+		LastModified: aws.TimeValue(object.LastModified),
+	}
+}
+
+// Notification returns an S3 notification for the object, as-if it was just written
+func (o *Object) Notification() *events.S3Event {
+	return &events.S3Event{
+		Records: []events.S3EventRecord{
+			{
+				EventTime: o.LastModified,
+				AWSRegion: o.Region,
+				S3: events.S3Entity{
+					Bucket: events.S3Bucket{
+						Name: o.Bucket,
+					},
+					Object: events.S3Object{
+						Key:  o.Key,
+						Size: o.Size,
+						ETag: o.ETag,
+					},
+				},
+			},
+		},
+	}
+}
+
+// NewNotification returns an S3 notification for an object, as-if it was just written
+func NewNotification(bucket string, object *s3.Object) *events.S3Event {
+	record := NewObject(bucket, object)
+	return record.Notification()
+}
+
+// ValidateKey returns an error if an object key cannot be sent in a notification, e.g. it has control characters
+// that the log processor would not read back
+func ValidateKey(key string) error {
+	if !utf8.ValidString(key) {
+		return errors.Errorf("key %q is not valid UTF-8", key)
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return errors.Errorf("key %q has the control character %U", key, r)
+		}
+	}
+	return nil
+}
+
+// PublishStats count what a Publisher sent, they are safe for concurrent use
+type PublishStats struct {
+	NumSent    *stats.Counter
+	NumBatches *stats.Counter
+	NumBytes   *stats.Counter // total Size of the notifications sent
+	NumRetries *stats.Counter // throttled or transient send failures that were retried
+	NumRetried *stats.Counter // sends that succeeded after being retried
+}
+
+// NewPublishStats registers the publish counters in a collector, counters of the same name are shared
+func NewPublishStats(collector *stats.Collector) *PublishStats {
+	return &PublishStats{
+		NumSent:    collector.Counter("numSent"),
+		NumBatches: collector.Counter("numSentBatches"),
+		NumBytes:   collector.Counter("numSentBytes"),
+		NumRetries: collector.Counter("numRetries"),
+		NumRetried: collector.Counter("numRetriedBatches"),
+	}
+}
+
+// Publisher sends notifications to a destination, marked as replays of a back-fill run.
+// It splits batches to the limits of the destination, retries throttled and transient failures and counts
+// what was sent, so that every destination behaves the same.
+type Publisher struct {
+	Destination Destination
+	// RunID identifies the notifications of the back-fill downstream
+	RunID string
+	// Retryer retries throttled and transient send failures, the zero value is used if nil
+	Retryer *awsretry.Retryer
+	// Stats are updated if not nil
+	Stats *PublishStats
+	// Throttle if not nil limits the rate of sends
+	Throttle Throttle
+	// NotificationThrottle if not nil limits the rate of notifications, it is called with the number of
+	// notifications of every send. Both throttles are shared by the concurrent publishes of the publisher.
+	NotificationThrottle Throttle
+	// Signer if not nil signs the message of every notification
+	Signer *notify.Signer
+	// PackRecords is the max number of S3 records packed into a notification, a notification per object if below 2.
+	// Packed notifications are limited to the payload limit of the destination.
+	PackRecords int
+	// PackGroup if set only packs the records of consecutive objects of the same group, e.g. of the same log type,
+	// so that the attributes of a packed notification hold for all of its records
+	PackGroup func(bucket, key string) string
+	// NoAttributes sends the notifications without the replay hints as message attributes,
+	// for subscribers that expect plain S3 notifications
+	NoAttributes bool
+	// CompressAbove if positive compresses the messages larger than this many bytes with notify.CompressNotification
+	// and marks them with the compressed schema version, for subscribers that read them with notify.ParseNotification
+	CompressAbove int
+}
+
+// Throttle limits the rate of sends, it is called with the size of every send, e.g. its payload bytes
+type Throttle interface {
+	Wait(ctx context.Context, size int64) error
+}
+
+// Publish sends a batch of notifications in as many sends as the destination limits require,
+// only the notifications not yet sent are retried
+func (p *Publisher) Publish(ctx context.Context, batch []*events.S3Event) error {
+	notifications := make([]*Notification, 0, len(batch))
+	for _, s3Notification := range batch {
+		notification, err := p.newNotification(s3Notification)
+		if err != nil {
+			return err
+		}
+		notifications = append(notifications, notification)
+	}
+	return p.publish(ctx, notifications)
+}
+
+// PublishObjects is Publish for object records, their notifications are built as they are sent.
+// The notifications are the same as the ones of Publish for the notifications of the objects.
+func (p *Publisher) PublishObjects(ctx context.Context, batch []Object) error {
+	notifications := make([]*Notification, 0, len(batch))
+	for i := range batch {
+		notification, err := p.newNotification(batch[i].Notification())
+		if err != nil {
+			return err
+		}
+		notifications = append(notifications, notification)
+	}
+	return p.publish(ctx, notifications)
+}
+
+func (p *Publisher) newNotification(s3Notification *events.S3Event) (*Notification, error) {
+	zap.L().Debug("sending file",
+		zap.String("bucket", s3Notification.Records[0].S3.Bucket.Name),
+		zap.String("key", s3Notification.Records[0].S3.Object.Key))
+
+	// the message has the keys encoded as in the notifications of S3, the event keeps the keys as listed
+	encoded := *s3Notification
+	encoded.Records = make([]events.S3EventRecord, len(s3Notification.Records))
+	for i := range s3Notification.Records {
+		record := s3Notification.Records[i]
+		if err := ValidateKey(record.S3.Object.Key); err != nil {
+			return nil, err
+		}
+		record.S3.Object.Key = notify.EncodeObjectKey(record.S3.Object.Key)
+		encoded.Records[i] = record
+	}
+	// the marshal buffers are pooled by jsoniter, only the message is allocated
+	message, err := jsoniter.MarshalToString(&encoded)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal %#v", s3Notification)
+	}
+	notification := &Notification{
+		Event:   s3Notification,
+		Message: message,
+	}
+	if !p.NoAttributes {
+		hints := &notify.ReplayHints{
+			Replay:            true,
+			OriginalEventTime: s3Notification.Records[0].EventTime,
+			BackfillRunID:     p.RunID,
+		}
+		notification.Attributes = hints.StringAttributes()
+	}
+	p.sign(notification)
+	return notification, nil
+}
+
+func (p *Publisher) sign(notification *Notification) {
+	if p.Signer == nil {
+		return
+	}
+	if notification.Attributes == nil {
+		notification.Attributes = make(map[string]string, 1)
+	}
+	notification.Attributes[notify.SignatureAttributeName] = p.Signer.Sign(notification.Message)
+}
+
+func (p *Publisher) compress(notification *Notification) (bool, error) {
+	if p.CompressAbove <= 0 {
+		return false, nil
+	}
+	message, compressed, err := notify.CompressNotification([]byte(notification.Message), p.CompressAbove)
+	if err != nil || !compressed {
+		return false, err
+	}
+	notification.Message = string(message)
+	if notification.Attributes == nil {
+		notification.Attributes = make(map[string]string, 1)
+	}
+	notification.Attributes[notify.SchemaVersionAttributeName] = notify.SchemaVersionCompressed
+	return true, nil
+}
+
+func (p *Publisher) publish(ctx context.Context, notifications []*Notification) error {
+	packed := p.PackRecords > 1
+	if packed {
+		var err error
+		notifications, err = packRecords(notifications, p.PackRecords, p.Destination.MaxPayloadBytes(), p.PackGroup)
+		if err != nil {
+			return err
+		}
+	}
+	for _, notification := range notifications {
+		compressed, err := p.compress(notification)
+		if err != nil {
+			return err
+		}
+		if packed || compressed {
+			p.sign(notification) // the new message replaces the signed one, signatures are of the same size
+		}
+	}
+	return p.PublishNotifications(ctx, notifications)
+}
+
+// PublishNotifications sends notifications as they are, e.g. read back from the dead letters of a run, they are not
+// packed or signed again. They are split, throttled, retried and counted as the ones of Publish.
+func (p *Publisher) PublishNotifications(ctx context.Context, notifications []*Notification) error {
+	sends, err := splitBatch(notifications, p.Destination.MaxBatchSize(), p.Destination.MaxPayloadBytes())
+	if err != nil {
+		return err
+	}
+	for _, send := range sends {
+		if err := p.send(ctx, send); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Publisher) send(ctx context.Context, batch []*Notification) error {
+	if p.Throttle != nil {
+		if err := p.Throttle.Wait(ctx, int64(batchSize(batch))); err != nil {
+			return err
+		}
+	}
+	if p.NotificationThrottle != nil {
+		if err := p.NotificationThrottle.Wait(ctx, int64(len(batch))); err != nil {
+			return err
+		}
+	}
+	var retryer awsretry.Retryer
+	if p.Retryer != nil {
+		retryer = *p.Retryer
+	}
+	retried := false
+	if p.Stats != nil {
+		onRetry := retryer.OnRetry
+		retryer.OnRetry = func(err error, class awsretry.Class, wait time.Duration) {
+			retried = true
+			p.Stats.NumRetries.Inc()
+			if onRetry != nil {
+				onRetry(err, class, wait)
+			}
+		}
+	}
+	pending := batch
+	err := retryer.Do(ctx, func() error {
+		err := p.Destination.Send(ctx, pending)
+		var unsent *UnsentError
+		if errors.As(err, &unsent) {
+			pending = unsent.Unsent // only resend what was not sent
+		}
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to send %d of %d notifications", len(pending), len(batch))
+	}
+	if p.Stats != nil {
+		p.Stats.NumSent.Add(uint64(len(batch)))
+		p.Stats.NumBatches.Inc()
+		p.Stats.NumBytes.Add(uint64(batchSize(batch)))
+		if retried {
+			p.Stats.NumRetried.Inc()
+		}
+	}
+	return nil
+}
+
+// splitBatch splits notifications in order into batches within the limits of a destination
+func splitBatch(notifications []*Notification, maxBatchSize, maxPayloadBytes int) ([][]*Notification, error) {
+	var batches [][]*Notification
+	var batch []*Notification
+	payloadBytes := 0
+	for _, notification := range notifications {
+		size := notification.Size()
+		if size > maxPayloadBytes {
+			return nil, errors.Errorf("notification of %d bytes is above the destination limit of %d bytes", size, maxPayloadBytes)
+		}
+		if len(batch) == maxBatchSize || payloadBytes+size > maxPayloadBytes {
+			batches = append(batches, batch)
+			batch, payloadBytes = nil, 0
+		}
+		batch = append(batch, notification)
+		payloadBytes += size
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+// packRecords packs the records of consecutive notifications with a notify.Batcher into notifications of up to
+// maxRecords records and maxPayloadBytes, attributes included. If group is not nil a pack only has the records of
+// one group. The attributes of a pack are the ones of its first record, the attributes of the notifications of a
+// pack are of the same size, e.g. replay hints.
+func packRecords(notifications []*Notification, maxRecords, maxPayloadBytes int,
+	group func(bucket, key string) string) ([]*Notification, error) {
+
+	var packed []*Notification
+	var batcher *notify.Batcher
+	var pending []*Notification // the notifications of the records added to the batcher and not yet packed
+	var packGroup string
+	pack := func(batch *notify.NotificationBatch) {
+		if batch == nil {
+			return
+		}
+		records := pending[:len(batch.Records)]
+		pending = pending[len(batch.Records):]
+		notification := &Notification{
+			Event:      &events.S3Event{},
+			Message:    string(batch.Payload),
+			Attributes: make(map[string]string, len(records[0].Attributes)),
+		}
+		for name, value := range records[0].Attributes {
+			notification.Attributes[name] = value
+		}
+		for _, record := range records {
+			notification.Event.Records = append(notification.Event.Records, record.Event.Records[0])
+		}
+		packed = append(packed, notification)
+	}
+	flush := func() {
+		if batcher != nil {
+			pack(batcher.Flush())
+			batcher = nil
+		}
+	}
+	for _, notification := range notifications {
+		if len(notification.Event.Records) != 1 {
+			flush()
+			packed = append(packed, notification) // not an object notification, sent as is
+			continue
+		}
+		record := notification.Event.Records[0]
+		var recordGroup string
+		if group != nil {
+			recordGroup = group(record.S3.Bucket.Name, record.S3.Object.Key)
+		}
+		if batcher != nil && recordGroup != packGroup {
+			flush()
+		}
+		if batcher == nil {
+			attributesSize := notification.Size() - len(notification.Message)
+			batcher = notify.NewBatcher(maxRecords, maxPayloadBytes-attributesSize)
+			packGroup = recordGroup
+		}
+		// the message has the key encoded as in the notifications of S3, the event keeps it as listed
+		record.S3.Object.Key = notify.EncodeObjectKey(record.S3.Object.Key)
+		pending = append(pending, notification)
+		batch, err := batcher.Add(record)
+		if err != nil {
+			return nil, err
+		}
+		pack(batch)
+	}
+	flush()
+	return packed, nil
+}
+
+func batchSize(batch []*Notification) (size int) {
+	for _, notification := range batch {
+		size += notification.Size()
+	}
+	return size
+}
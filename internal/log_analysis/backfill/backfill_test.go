@@ -0,0 +1,344 @@
+package backfill
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/testutils/awsfake"
+)
+
+const (
+	testBucket  = "bucket"
+	testPrefix  = "logs/"
+	testAccount = "123456789012"
+	testQueue   = "https://sqs.us-east-1.amazonaws.com/123456789012/queue"
+)
+
+var testStart = time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+
+func testS3(hours, objectsPerHour int) *awsfake.S3 {
+	return awsfake.NewS3(awsfake.ListingSpec{
+		Bucket:         testBucket,
+		Prefix:         testPrefix,
+		Start:          testStart,
+		Hours:          hours,
+		ObjectsPerHour: objectsPerHour,
+		MinSize:        1,
+		MaxSize:        1024,
+		PageSize:       7,
+	})
+}
+
+func TestFilterMatcher(t *testing.T) {
+	object := func(key string, size int64, modified time.Time) *s3.Object {
+		return &s3.Object{Key: aws.String(key), Size: aws.Int64(size), LastModified: aws.Time(modified)}
+	}
+	filter := Filter{
+		ModifiedAfter:  testStart,
+		ModifiedBefore: testStart.Add(time.Hour),
+		KeyPattern:     `\.json\.gz$`,
+	}
+	match, err := filter.Matcher()
+	require.NoError(t, err)
+	assert.True(t, match(object("a.json.gz", 1, testStart)))
+	assert.False(t, match(object("a.json.gz", 0, testStart)))                           // empty
+	assert.False(t, match(object("a.json", 1, testStart)))                              // key
+	assert.False(t, match(object("a.json.gz", 1, testStart.Add(-time.Second))))         // before
+	assert.False(t, match(object("a.json.gz", 1, testStart.Add(time.Hour))))            // end is exclusive
+	assert.True(t, match(object("a.json.gz", 1, testStart.Add(time.Hour-time.Second)))) // last second
+
+	match, err = (&Filter{}).Matcher()
+	require.NoError(t, err)
+	assert.True(t, match(object("anything", 1, time.Time{})))
+
+	_, err = (&Filter{KeyPattern: "("}).Matcher()
+	assert.Error(t, err)
+	_, err = (&Filter{ModifiedAfter: testStart, ModifiedBefore: testStart}).Matcher()
+	assert.Error(t, err)
+}
+
+func TestList(t *testing.T) {
+	s3Client := testS3(2, 10)
+	var keys []string
+	input := &ListInput{
+		Bucket:     testBucket,
+		Prefix:     testPrefix,
+		StartAfter: s3Client.Spec.Key(4),
+	}
+	err := List(context.Background(), s3Client, input, func(object *s3.Object) bool {
+		keys = append(keys, aws.StringValue(object.Key))
+		return len(keys) < 12
+	})
+	require.NoError(t, err)
+	require.Len(t, keys, 12)
+	for i, key := range keys {
+		assert.Equal(t, s3Client.Spec.Key(i+5), key) // resumed after the start key, in order across pages
+	}
+
+	// the listing stops after the until key
+	keys = nil
+	input.Until = s3Client.Spec.Key(14)
+	err = List(context.Background(), s3Client, input, func(object *s3.Object) bool {
+		keys = append(keys, aws.StringValue(object.Key))
+		return true
+	})
+	require.NoError(t, err)
+	require.Len(t, keys, 10)
+	for i, key := range keys {
+		assert.Equal(t, s3Client.Spec.Key(i+5), key)
+	}
+}
+
+func TestListShuffle(t *testing.T) {
+	s3Client := testS3(2, 10)
+	s3Client.Spec.PageSize = 20 // a single page, the pages are shuffled one at a time
+	var keys []string
+	input := &ListInput{
+		Bucket: testBucket,
+		Prefix: testPrefix,
+		Shuffle: func(n int, swap func(i, j int)) {
+			for i := 0; i < n/2; i++ {
+				swap(i, n-1-i)
+			}
+		},
+	}
+	err := List(context.Background(), s3Client, input, func(object *s3.Object) bool {
+		keys = append(keys, aws.StringValue(object.Key))
+		return true
+	})
+	require.NoError(t, err)
+	require.Len(t, keys, 20)
+	for i, key := range keys {
+		assert.Equal(t, s3Client.Spec.Key(19-i), key) // the page in the order of the shuffle
+	}
+}
+
+func TestListFailure(t *testing.T) {
+	s3Client := testS3(1, 10)
+	s3Client.Spec.FailAtPage = 2
+	err := List(context.Background(), s3Client, &ListInput{Bucket: testBucket}, func(*s3.Object) bool {
+		return true
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to list s3://bucket/")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = List(ctx, testS3(1, 10), &ListInput{Bucket: testBucket}, func(*s3.Object) bool {
+		return true
+	})
+	assert.Equal(t, context.Canceled, err)
+
+	// the pages after ctx is done are not listed
+	ctx, cancel = context.WithCancel(context.Background())
+	numListed := 0
+	err = List(ctx, testS3(1, 10), &ListInput{Bucket: testBucket}, func(*s3.Object) bool {
+		numListed++
+		cancel()
+		return true
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 7, numListed) // the first page
+}
+
+func TestPublisher(t *testing.T) {
+	s3Client := testS3(1, 2)
+	// the first call succeeds, the second is throttled and retried
+	sqsClient := &awsfake.SQSSink{Failures: awsfake.Failures{ThrottleEvery: 2}}
+	publisher := &Publisher{
+		Destination: &SQSDestination{
+			SQS:      sqsClient,
+			QueueURL: testQueue,
+			TopicARN: FakeTopicARN(testAccount),
+		},
+		RunID: "run",
+	}
+	for i := 0; i < 2; i++ {
+		batch := []*events.S3Event{NewNotification(testBucket, s3Client.Spec.Object(i))}
+		require.NoError(t, publisher.Publish(context.Background(), batch))
+	}
+	assert.Equal(t, 3, sqsClient.Calls())
+
+	messages := sqsClient.Messages()
+	require.Len(t, messages, 2)
+	for i, message := range messages {
+		var snsEntity events.SNSEntity
+		require.NoError(t, jsoniter.UnmarshalFromString(aws.StringValue(message.MessageBody), &snsEntity))
+		assert.Equal(t, "arn:aws:sns:us-east-1:123456789012:panther-fake-s3queue-topic", snsEntity.TopicArn)
+		notification, err := notify.ParseNotification([]byte(snsEntity.Message))
+		require.NoError(t, err)
+		require.Len(t, notification.Records, 1)
+		assert.Equal(t, notify.EncodeObjectKey(s3Client.Spec.Key(i)), notification.Records[0].S3.Object.Key)
+		assert.Equal(t, testBucket, notification.Records[0].S3.Bucket.Name)
+		assert.Equal(t, "true", aws.StringValue(message.MessageAttributes[notify.ReplayAttributeName].StringValue))
+		assert.Equal(t, "run", aws.StringValue(message.MessageAttributes[notify.BackfillRunIDAttributeName].StringValue))
+	}
+}
+
+func TestPublishObjects(t *testing.T) {
+	s3Client := testS3(1, 10)
+	var objects []Object
+	var s3Notifications []*events.S3Event
+	for i := 0; i < 10; i++ {
+		object := s3Client.Spec.Object(i)
+		objects = append(objects, NewObject(testBucket, object))
+		// the notification as it was built before the objects were queued as records
+		s3Notifications = append(s3Notifications, &events.S3Event{
+			Records: []events.S3EventRecord{
+				{
+					EventTime: aws.TimeValue(object.LastModified),
+					S3: events.S3Entity{
+						Bucket: events.S3Bucket{Name: testBucket},
+						Object: events.S3Object{
+							Key:  aws.StringValue(object.Key),
+							Size: aws.Int64Value(object.Size),
+							ETag: notify.NormalizeETag(aws.StringValue(object.ETag)),
+						},
+					},
+				},
+			},
+		})
+	}
+
+	fromObjects := &RecordingDestination{BatchSize: 4}
+	publisher := &Publisher{Destination: fromObjects, RunID: "run"}
+	require.NoError(t, publisher.PublishObjects(context.Background(), objects))
+	fromEvents := &RecordingDestination{BatchSize: 4}
+	publisher = &Publisher{Destination: fromEvents, RunID: "run"}
+	require.NoError(t, publisher.Publish(context.Background(), s3Notifications))
+
+	assert.Len(t, fromObjects.Batches(), 3)
+	sent := fromObjects.Notifications()
+	expected := fromEvents.Notifications()
+	require.Len(t, sent, 10)
+	require.Len(t, expected, 10)
+	for i := range sent {
+		assert.Equal(t, expected[i].Message, sent[i].Message) // byte for byte
+		assert.Equal(t, expected[i].Attributes, sent[i].Attributes)
+	}
+}
+
+func TestPublisherEncodesKeys(t *testing.T) {
+	keys := []string{"logs/a b.json", "logs/a+b.json", "logs/événement/日志.json", "logs/year=2020/100%.json"}
+	var batch []*events.S3Event
+	for _, key := range keys {
+		batch = append(batch, NewNotification(testBucket, &s3.Object{Key: aws.String(key), Size: aws.Int64(1)}))
+	}
+	destination := &RecordingDestination{}
+	publisher := &Publisher{Destination: destination, NoAttributes: true}
+	require.NoError(t, publisher.Publish(context.Background(), batch))
+
+	notifications := destination.Notifications()
+	require.Len(t, notifications, len(keys))
+	assert.Contains(t, notifications[0].Message, `"key":"logs/a+b.json"`)
+	assert.Contains(t, notifications[1].Message, `"key":"logs/a%2Bb.json"`)
+	for i, notification := range notifications {
+		// the event keeps the key as listed, the message has it as S3 sends it
+		assert.Equal(t, keys[i], notification.Event.Records[0].S3.Object.Key)
+		var s3Notification events.S3Event
+		require.NoError(t, jsoniter.UnmarshalFromString(notification.Message, &s3Notification))
+		key, err := notify.DecodeObjectKey(s3Notification.Records[0].S3.Object.Key)
+		require.NoError(t, err)
+		assert.Equal(t, keys[i], key)
+	}
+}
+
+func TestPublisherRejectsControlCharacters(t *testing.T) {
+	for _, key := range []string{"logs/a\nb.json", "logs/a\x00.json", "logs/a\x7f.json", "logs/\xff.json"} {
+		batch := []*events.S3Event{NewNotification(testBucket, &s3.Object{Key: aws.String(key), Size: aws.Int64(1)})}
+		destination := &RecordingDestination{}
+		publisher := &Publisher{Destination: destination}
+		err := publisher.Publish(context.Background(), batch)
+		require.Error(t, err, key)
+		assert.Contains(t, err.Error(), "key", key)
+		assert.Empty(t, destination.Notifications())
+	}
+	assert.NoError(t, ValidateKey("logs/a b+c/日志.json"))
+	assert.EqualError(t, ValidateKey("logs/a\tb.json"), `key "logs/a\tb.json" has the control character U+0009`)
+}
+
+// the memory allocated per million objects queued and marshaled, and the memory held by a full queue,
+// with the objects queued as S3 notifications and as object records
+func BenchmarkQueuedObjects(b *testing.B) {
+	const (
+		numQueued  = 1000 // the capacity of the s3queue channel
+		numObjects = 1000
+	)
+	s3Client := testS3(1, numObjects)
+	objects := make([]*s3.Object, numObjects)
+	for i := range objects {
+		objects[i] = s3Client.Spec.Object(i)
+	}
+	memStats := func() *runtime.MemStats {
+		var m runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		return &m
+	}
+	report := func(b *testing.B, before *runtime.MemStats) {
+		after := memStats()
+		perObject := 1.0 / float64(b.N)
+		b.ReportMetric(float64(after.Mallocs-before.Mallocs)*perObject*1e6, "allocs/1M-objects")
+		b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)*perObject*1e6/(1<<20), "MB/1M-objects")
+		if b.N >= numQueued {
+			b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/numQueued, "B/queued-object")
+		}
+	}
+
+	b.Run("events", func(b *testing.B) {
+		queue := make([]*events.S3Event, numQueued)
+		before := memStats()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			queue[i%numQueued] = NewNotification(testBucket, objects[i%numObjects])
+			if _, err := jsoniter.MarshalToString(queue[i%numQueued]); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		report(b, before)
+		runtime.KeepAlive(queue)
+	})
+	b.Run("objects", func(b *testing.B) {
+		queue := make([]Object, numQueued)
+		before := memStats()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			queue[i%numQueued] = NewObject(testBucket, objects[i%numObjects])
+			if _, err := jsoniter.MarshalToString(queue[i%numQueued].Notification()); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		report(b, before)
+		runtime.KeepAlive(queue)
+	})
+}
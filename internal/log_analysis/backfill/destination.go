@@ -0,0 +1,708 @@
+package backfill
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/awsbatch/sqsbatch"
+)
+
+// Destination kinds selected by DestinationOptions
+const (
+	DestinationSQS         = "sqs"
+	DestinationSNS         = "sns"
+	DestinationEventBridge = "eventbridge"
+	DestinationLambda      = "lambda"
+	DestinationProcessor   = "processor"
+	DestinationDryRun      = "dry-run"
+)
+
+// LogProcessorFunction is the default target of the processor destination
+const LogProcessorFunction = "panther-log-processor"
+
+const (
+	// maxAWSPayloadBytes is the max size of an SQS batch, an SNS message, an EventBridge PutEvents call
+	// and an asynchronous Lambda invocation
+	maxAWSPayloadBytes = 256 * 1024
+	// overheadBytes is reserved per notification for what a destination adds to it (envelope fields, attribute types)
+	overheadBytes = 1024
+	// JSON escaping grows a message at most 6 times (\u00XX), the envelope escapes the message it wraps
+	maxEscapedGrowth = 6
+	// wrappedPayloadBytes is the payload limit of destinations wrapping notifications in an SNS envelope
+	wrappedPayloadBytes = (maxAWSPayloadBytes - SendBatchSize*overheadBytes) / maxEscapedGrowth
+
+	eventBridgeSource     = "panther.backfill"
+	eventBridgeDetailType = "S3 Notification"
+)
+
+// Notification is an S3 notification with its message attributes, as sent to a destination
+type Notification struct {
+	Event *events.S3Event
+	// Message is the JSON of Event
+	Message string
+	// Attributes are the replay hints and signature of the notification
+	Attributes map[string]string
+}
+
+// Size is the size of the message and attributes, the unit of the payload limit of destinations
+func (n *Notification) Size() int {
+	size := len(n.Message)
+	for name, value := range n.Attributes {
+		size += len(name) + len(value)
+	}
+	return size
+}
+
+// Destination sends batches of notifications over a transport. Implementations only send, the Publisher
+// splits batches to their limits, retries throttled and transient failures and counts what was sent.
+type Destination interface {
+	// Send sends at most MaxBatchSize notifications of at most MaxPayloadBytes in total.
+	// If only some notifications were sent it returns an *UnsentError, so that only the rest is retried.
+	Send(ctx context.Context, batch []*Notification) error
+	// MaxBatchSize is the max number of notifications of a Send
+	MaxBatchSize() int
+	// MaxPayloadBytes is the max total Size of the notifications of a Send. It leaves room for the encoding of
+	// the destination, so that what is sent is within the AWS limits.
+	MaxPayloadBytes() int
+}
+
+// UnsentError is returned by Send when some notifications of a batch were not sent
+type UnsentError struct {
+	Unsent []*Notification
+	Err    error
+}
+
+func (e *UnsentError) Error() string {
+	return fmt.Sprintf("%d notifications not sent: %s", len(e.Unsent), e.Err)
+}
+
+// Unwrap returns the cause, it decides whether the unsent notifications are retried
+func (e *UnsentError) Unwrap() error {
+	return e.Err
+}
+
+// DestinationOptions select the destination of a back-fill
+type DestinationOptions struct {
+	// Kind is one of sqs, sns, eventbridge, lambda, processor or dry-run
+	Kind string
+	// Target is the queue name, topic ARN, event bus name or function name of the destination, ignored by dry-run.
+	// The processor destination defaults to LogProcessorFunction.
+	Target string
+	// AccountID is the account of the objects, the log processor assumes role in it to read them
+	AccountID string
+	// GroupID returns the message group of a file for FIFO topics, notify.PrefixMessageGroupID if nil
+	GroupID func(bucket, key string) string
+}
+
+// NewDestination returns the destination selected by the options. SQS queues are resolved by name unless the target
+// is a queue URL, which is sent to in its region, e.g. a queue of another account subscribed by a loader.
+// SNS topics are published to in the region of their ARN.
+func NewDestination(sess client.ConfigProvider, opts *DestinationOptions) (Destination, error) {
+	if opts.Kind == DestinationProcessor && opts.Target == "" {
+		opts.Target = LogProcessorFunction
+	}
+	if opts.Kind != DestinationDryRun && opts.Target == "" {
+		return nil, errors.Errorf("no target for the %s destination", opts.Kind)
+	}
+	switch opts.Kind {
+	case DestinationSQS:
+		return newSQSDestination(sess, opts)
+	case DestinationSNS:
+		return &SNSDestination{SNS: sns.New(sess, topicConfig(opts.Target)), TopicARN: opts.Target, GroupID: opts.GroupID}, nil
+	case DestinationEventBridge:
+		return &EventBridgeDestination{EventBridge: eventbridge.New(sess), EventBusName: opts.Target}, nil
+	case DestinationLambda:
+		return &LambdaDestination{
+			Lambda:       lambda.New(sess),
+			FunctionName: opts.Target,
+			TopicARN:     FakeTopicARN(opts.AccountID),
+		}, nil
+	case DestinationProcessor:
+		return &LambdaDestination{
+			Lambda:       lambda.New(sess),
+			FunctionName: opts.Target,
+			TopicARN:     FakeTopicARN(opts.AccountID),
+			Synchronous:  true,
+		}, nil
+	case DestinationDryRun:
+		return &RecordingDestination{}, nil
+	default:
+		return nil, errors.Errorf("unknown destination %q, expected one of sqs, sns, eventbridge, lambda, processor or dry-run",
+			opts.Kind)
+	}
+}
+
+// returns the config of an SNS client in the region of a topic ARN, the session region if it has none
+func topicConfig(topicARN string) *aws.Config {
+	if parsed, err := arn.Parse(topicARN); err == nil && parsed.Region != "" {
+		return &aws.Config{Region: aws.String(parsed.Region)}
+	}
+	return &aws.Config{}
+}
+
+func newSQSDestination(sess client.ConfigProvider, opts *DestinationOptions) (*SQSDestination, error) {
+	destination := &SQSDestination{TopicARN: FakeTopicARN(opts.AccountID)}
+	if region, ok := queueURLRegion(opts.Target); ok {
+		destination.SQS, destination.QueueURL = sqs.New(sess, &aws.Config{Region: region}), opts.Target
+		return destination, nil
+	}
+	sqsClient := sqs.New(sess)
+	output, err := sqsClient.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String(opts.Target)})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get queue url for %s", opts.Target)
+	}
+	destination.SQS, destination.QueueURL = sqsClient, aws.StringValue(output.QueueUrl)
+	return destination, nil
+}
+
+// queueURLRegion returns the region of a queue URL (e.g. https://sqs.us-west-2.amazonaws.com/012345678912/queue),
+// nil for other hosts (e.g. LocalStack), and false if target is a queue name
+func queueURLRegion(target string) (*string, bool) {
+	queueURL, err := url.Parse(target)
+	if err != nil || queueURL.Host == "" {
+		return nil, false
+	}
+	labels := strings.Split(queueURL.Hostname(), ".")
+	if len(labels) > 2 && labels[0] == "sqs" {
+		return &labels[1], true
+	}
+	return nil, true
+}
+
+// SQSDestination sends notifications to a queue as-if they were delivered by an SNS subscription
+type SQSDestination struct {
+	SQS      sqsiface.SQSAPI
+	QueueURL string
+	// TopicARN is set in the SNS envelope, the log processor takes the account of the objects from it
+	TopicARN string
+}
+
+func (d *SQSDestination) MaxBatchSize() int {
+	return SendBatchSize
+}
+
+func (d *SQSDestination) MaxPayloadBytes() int {
+	return wrappedPayloadBytes
+}
+
+func (d *SQSDestination) Send(_ context.Context, batch []*Notification) error {
+	input := &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(d.QueueURL),
+		Entries:  make([]*sqs.SendMessageBatchRequestEntry, 0, len(batch)),
+	}
+	for i, notification := range batch {
+		message, err := snsEnvelope(d.TopicARN, notification.Message)
+		if err != nil {
+			return err
+		}
+		input.Entries = append(input.Entries, &sqs.SendMessageBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			MessageBody:       &message,
+			MessageAttributes: sqsMessageAttributes(notification.Attributes),
+		})
+	}
+	unsentEntries, err := sqsbatch.SendMessageBatch(d.SQS, sendBatchTimeout, input)
+	if err == nil {
+		return nil
+	}
+	unsent := make([]*Notification, 0, len(unsentEntries))
+	for _, entry := range unsentEntries {
+		i, _ := strconv.Atoi(aws.StringValue(entry.Id))
+		unsent = append(unsent, batch[i])
+	}
+	return &UnsentError{Unsent: unsent, Err: err}
+}
+
+// SNSDestination publishes notifications to a topic, subscribers receive the topic ARN of the SNS envelope.
+// SNS has no batch API in this SDK, the notifications of a batch are published one at a time.
+// Notifications to a FIFO topic (.fifo) get the message group of their first file and a deduplication ID
+// of their files, so that a file sent twice within the deduplication interval is delivered once.
+type SNSDestination struct {
+	SNS      snsiface.SNSAPI
+	TopicARN string
+	// GroupID returns the message group of a file for FIFO topics, notify.PrefixMessageGroupID if nil
+	GroupID func(bucket, key string) string
+}
+
+// FIFO message group strategies, see FIFOGroupIDs
+const (
+	GroupByPrefix = "prefix"
+	GroupByBucket = "bucket"
+	GroupByTable  = "table"
+)
+
+// FIFOGroupIDs are the message group strategies of FIFO topics by name
+var FIFOGroupIDs = map[string]func(bucket, key string) string{
+	GroupByPrefix: notify.PrefixMessageGroupID,
+	GroupByBucket: notify.BucketMessageGroupID,
+	GroupByTable:  notify.MessageGroupID,
+}
+
+func (d *SNSDestination) MaxBatchSize() int {
+	return SendBatchSize
+}
+
+func (d *SNSDestination) MaxPayloadBytes() int {
+	return maxAWSPayloadBytes - overheadBytes
+}
+
+func (d *SNSDestination) Send(ctx context.Context, batch []*Notification) error {
+	fifo := strings.HasSuffix(d.TopicARN, ".fifo")
+	groupID := d.GroupID
+	if groupID == nil {
+		groupID = notify.PrefixMessageGroupID
+	}
+	for i, notification := range batch {
+		input := &sns.PublishInput{
+			TopicArn:          aws.String(d.TopicARN),
+			Message:           aws.String(notification.Message),
+			MessageAttributes: snsMessageAttributes(notification.Attributes),
+		}
+		if fifo && len(notification.Event.Records) > 0 {
+			s3Object := &notification.Event.Records[0].S3
+			input.MessageGroupId = aws.String(groupID(s3Object.Bucket.Name, s3Object.Object.Key))
+			input.MessageDeduplicationId = aws.String(notify.EventDeduplicationID(notification.Event))
+		}
+		_, err := d.SNS.PublishWithContext(ctx, input)
+		if err != nil {
+			return &UnsentError{Unsent: batch[i:], Err: err}
+		}
+	}
+	return nil
+}
+
+// EventBridgeDestination puts notifications on an event bus, the detail of the events is an eventBridgeDetail
+type EventBridgeDestination struct {
+	EventBridge  eventbridgeiface.EventBridgeAPI
+	EventBusName string
+}
+
+type eventBridgeDetail struct {
+	Notification jsoniter.RawMessage `json:"notification"`
+	Attributes   map[string]string   `json:"attributes,omitempty"`
+}
+
+func (d *EventBridgeDestination) MaxBatchSize() int {
+	return SendBatchSize
+}
+
+func (d *EventBridgeDestination) MaxPayloadBytes() int {
+	return maxAWSPayloadBytes - SendBatchSize*overheadBytes
+}
+
+func (d *EventBridgeDestination) Send(ctx context.Context, batch []*Notification) error {
+	input := &eventbridge.PutEventsInput{
+		Entries: make([]*eventbridge.PutEventsRequestEntry, 0, len(batch)),
+	}
+	for _, notification := range batch {
+		detail, err := jsoniter.MarshalToString(&eventBridgeDetail{
+			Notification: jsoniter.RawMessage(notification.Message),
+			Attributes:   notification.Attributes,
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal event detail")
+		}
+		input.Entries = append(input.Entries, &eventbridge.PutEventsRequestEntry{
+			EventBusName: aws.String(d.EventBusName),
+			Source:       aws.String(eventBridgeSource),
+			DetailType:   aws.String(eventBridgeDetailType),
+			Detail:       aws.String(detail),
+		})
+	}
+	output, err := d.EventBridge.PutEventsWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(output.FailedEntryCount) == 0 {
+		return nil
+	}
+	// the result entries are in the order of the request entries
+	var unsent []*Notification
+	var failure error
+	for i, entry := range output.Entries {
+		if entry.ErrorCode == nil || i >= len(batch) {
+			continue
+		}
+		if failure == nil {
+			failure = awserr.New(aws.StringValue(entry.ErrorCode), aws.StringValue(entry.ErrorMessage), nil)
+		}
+		unsent = append(unsent, batch[i])
+	}
+	if failure == nil {
+		failure = errors.Errorf("%d entries failed", aws.Int64Value(output.FailedEntryCount))
+		unsent = batch
+	}
+	return &UnsentError{Unsent: unsent, Err: failure}
+}
+
+// LambdaDestination invokes a function asynchronously with the SQS event it would receive from the log processor
+// queue, so that notifications are processed without going through the queue
+type LambdaDestination struct {
+	Lambda       lambdaiface.LambdaAPI
+	FunctionName string
+	// TopicARN is set in the SNS envelope, the log processor takes the account of the objects from it
+	TopicARN string
+	// Synchronous waits for the function to process each batch, so that a function error fails the send with the
+	// files of the batch. Notifications then reach no other subscriber of the log processor topic.
+	Synchronous bool
+}
+
+func (d *LambdaDestination) MaxBatchSize() int {
+	return SendBatchSize
+}
+
+func (d *LambdaDestination) MaxPayloadBytes() int {
+	return wrappedPayloadBytes
+}
+
+func (d *LambdaDestination) Send(ctx context.Context, batch []*Notification) error {
+	sqsEvent := events.SQSEvent{
+		Records: make([]events.SQSMessage, 0, len(batch)),
+	}
+	for i, notification := range batch {
+		body, err := snsEnvelope(d.TopicARN, notification.Message)
+		if err != nil {
+			return err
+		}
+		attributes := make(map[string]events.SQSMessageAttribute, len(notification.Attributes))
+		for name, value := range notification.Attributes {
+			value := value
+			attributes[name] = events.SQSMessageAttribute{DataType: "String", StringValue: &value}
+		}
+		sqsEvent.Records = append(sqsEvent.Records, events.SQSMessage{
+			MessageId:         strconv.Itoa(i),
+			Body:              body,
+			MessageAttributes: attributes,
+			EventSource:       "aws:sqs",
+		})
+	}
+	payload, err := jsoniter.Marshal(&sqsEvent)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal lambda payload")
+	}
+	invocationType := lambda.InvocationTypeEvent
+	if d.Synchronous {
+		invocationType = lambda.InvocationTypeRequestResponse
+	}
+	output, err := d.Lambda.InvokeWithContext(ctx, &lambda.InvokeInput{
+		FunctionName:   aws.String(d.FunctionName),
+		InvocationType: aws.String(invocationType),
+		Payload:        payload,
+	})
+	if err != nil {
+		return err
+	}
+	if output.FunctionError != nil {
+		return errors.Errorf("%s failed to process %s: %s", d.FunctionName, batchFiles(batch), functionError(output))
+	}
+	return nil
+}
+
+// returns the message of a function error, the payload of a failed synchronous invocation has it
+func functionError(output *lambda.InvokeOutput) string {
+	var payload struct {
+		ErrorType    string `json:"errorType"`
+		ErrorMessage string `json:"errorMessage"`
+	}
+	if err := jsoniter.Unmarshal(output.Payload, &payload); err != nil || payload.ErrorMessage == "" {
+		return aws.StringValue(output.FunctionError)
+	}
+	if payload.ErrorType == "" {
+		return payload.ErrorMessage
+	}
+	return payload.ErrorType + ": " + payload.ErrorMessage
+}
+
+// describes the files of a batch for errors, e.g. "s3://bucket/key and 9 more files"
+func batchFiles(batch []*Notification) string {
+	var first string
+	numFiles := 0
+	for _, notification := range batch {
+		for _, record := range notification.Event.Records {
+			if numFiles == 0 {
+				first = "s3://" + record.S3.Bucket.Name + "/" + record.S3.Object.Key
+			}
+			numFiles++
+		}
+	}
+	switch numFiles {
+	case 0:
+		return "no files"
+	case 1:
+		return first
+	case 2:
+		return first + " and 1 more file"
+	default:
+		return fmt.Sprintf("%s and %d more files", first, numFiles-1)
+	}
+}
+
+// FanOutDestination sends every notification to all of its destinations, e.g. to the input topics of two deployments
+// during a migration. A notification is only sent once all the destinations accepted it, the retries of the Publisher
+// send it again only to the destinations that did not. It is safe for concurrent use.
+type FanOutDestination struct {
+	Destinations []Destination
+	// Targets name the destinations in errors and Failures, e.g. their topic ARNs
+	Targets []string
+
+	mu       sync.Mutex
+	accepted map[*Notification][]bool // by destination, for the notifications not yet accepted by all
+	failures []uint64                 // by destination
+}
+
+// MaxBatchSize is the smallest of the destinations
+func (d *FanOutDestination) MaxBatchSize() int {
+	size := d.Destinations[0].MaxBatchSize()
+	for _, destination := range d.Destinations[1:] {
+		if destination.MaxBatchSize() < size {
+			size = destination.MaxBatchSize()
+		}
+	}
+	return size
+}
+
+// MaxPayloadBytes is the smallest of the destinations
+func (d *FanOutDestination) MaxPayloadBytes() int {
+	size := d.Destinations[0].MaxPayloadBytes()
+	for _, destination := range d.Destinations[1:] {
+		if destination.MaxPayloadBytes() < size {
+			size = destination.MaxPayloadBytes()
+		}
+	}
+	return size
+}
+
+// Send sends the batch to the destinations that did not accept it yet. If any failed it returns an *UnsentError
+// with the notifications not accepted by all and the error of the first destination that failed.
+func (d *FanOutDestination) Send(ctx context.Context, batch []*Notification) error {
+	var firstErr error
+	failed := make(map[*Notification]bool)
+	for i, destination := range d.Destinations {
+		pending := d.pending(i, batch)
+		if len(pending) == 0 {
+			continue
+		}
+		err := destination.Send(ctx, pending)
+		unsent := pending
+		if err == nil {
+			unsent = nil
+		} else {
+			var unsentErr *UnsentError
+			if errors.As(err, &unsentErr) {
+				unsent = unsentErr.Unsent
+			}
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "failed to send to %s", d.Targets[i])
+			}
+		}
+		for _, notification := range unsent {
+			failed[notification] = true
+		}
+		d.accept(i, pending, unsent)
+	}
+	if firstErr == nil {
+		return nil
+	}
+	unsent := make([]*Notification, 0, len(failed))
+	for _, notification := range batch {
+		if failed[notification] {
+			unsent = append(unsent, notification)
+		}
+	}
+	return &UnsentError{Unsent: unsent, Err: firstErr}
+}
+
+// returns the notifications of the batch the destination did not accept yet
+func (d *FanOutDestination) pending(destination int, batch []*Notification) []*Notification {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pending := make([]*Notification, 0, len(batch))
+	for _, notification := range batch {
+		if accepted := d.accepted[notification]; accepted == nil || !accepted[destination] {
+			pending = append(pending, notification)
+		}
+	}
+	return pending
+}
+
+// records the notifications sent to a destination but the unsent ones, forgetting those accepted by all
+func (d *FanOutDestination) accept(destination int, sent, unsent []*Notification) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.accepted == nil {
+		d.accepted = make(map[*Notification][]bool)
+		d.failures = make([]uint64, len(d.Destinations))
+	}
+	d.failures[destination] += uint64(len(unsent))
+	isUnsent := make(map[*Notification]bool, len(unsent))
+	for _, notification := range unsent {
+		isUnsent[notification] = true
+	}
+	for _, notification := range sent {
+		if isUnsent[notification] {
+			continue
+		}
+		accepted := d.accepted[notification]
+		if accepted == nil {
+			accepted = make([]bool, len(d.Destinations))
+			d.accepted[notification] = accepted
+		}
+		accepted[destination] = true
+		if allAccepted(accepted) {
+			delete(d.accepted, notification)
+		}
+	}
+}
+
+func allAccepted(accepted []bool) bool {
+	for _, ok := range accepted {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Failures returns the number of notifications each target failed to accept by target, counting every failed attempt
+// of the notifications that were retried
+func (d *FanOutDestination) Failures() map[string]uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	failures := make(map[string]uint64, len(d.Targets))
+	for i, target := range d.Targets {
+		failures[target] = 0
+		if d.failures != nil { // nothing was sent yet otherwise
+			failures[target] = d.failures[i]
+		}
+	}
+	return failures
+}
+
+// RecordingDestination records the batches it is sent instead of sending them, it is used by dry runs and tests.
+// The zero value has the limits of SQS. It is safe for concurrent use.
+type RecordingDestination struct {
+	// BatchSize and PayloadBytes override the limits of the zero value if set
+	BatchSize    int
+	PayloadBytes int
+
+	mu      sync.Mutex
+	batches [][]*Notification
+}
+
+func (d *RecordingDestination) MaxBatchSize() int {
+	if d.BatchSize > 0 {
+		return d.BatchSize
+	}
+	return SendBatchSize
+}
+
+func (d *RecordingDestination) MaxPayloadBytes() int {
+	if d.PayloadBytes > 0 {
+		return d.PayloadBytes
+	}
+	return wrappedPayloadBytes
+}
+
+func (d *RecordingDestination) Send(_ context.Context, batch []*Notification) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.batches = append(d.batches, append([]*Notification(nil), batch...))
+	return nil
+}
+
+// Batches returns the batches sent, in order
+func (d *RecordingDestination) Batches() [][]*Notification {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([][]*Notification(nil), d.batches...)
+}
+
+// Notifications returns the notifications sent, in order
+func (d *RecordingDestination) Notifications() []*Notification {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var notifications []*Notification
+	for _, batch := range d.batches {
+		notifications = append(notifications, batch...)
+	}
+	return notifications
+}
+
+// snsEnvelope makes a message look like an SNS notification delivered to a queue
+func snsEnvelope(topicARN, message string) (string, error) {
+	snsNotification := events.SNSEntity{
+		Type:     "Notification",
+		TopicArn: topicARN,
+		Message:  message,
+	}
+	envelope, err := jsoniter.MarshalToString(snsNotification)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to marshal %#v", snsNotification)
+	}
+	return envelope, nil
+}
+
+func sqsMessageAttributes(attributes map[string]string) map[string]*sqs.MessageAttributeValue {
+	sqsAttributes := make(map[string]*sqs.MessageAttributeValue, len(attributes))
+	for name, value := range attributes {
+		sqsAttributes[name] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+	return sqsAttributes
+}
+
+func snsMessageAttributes(attributes map[string]string) map[string]*sns.MessageAttributeValue {
+	snsAttributes := make(map[string]*sns.MessageAttributeValue, len(attributes))
+	for name, value := range attributes {
+		if name == notify.SchemaVersionAttributeName {
+			notify.SetSchemaVersion(snsAttributes, value) // as the publishers of notify mark their messages
+			continue
+		}
+		snsAttributes[name] = &sns.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+	return snsAttributes
+}
@@ -0,0 +1,683 @@
+package backfill
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+	"github.com/panther-labs/panther/pkg/awsretry"
+	"github.com/panther-labs/panther/pkg/stats"
+)
+
+// awsCall is the number of entries and the payload size of a call made by a destination
+type awsCall struct {
+	entries int
+	bytes   int
+}
+
+// The fakes record the size of every call as AWS counts it against its limits
+
+type fakeSQS struct {
+	sqsiface.SQSAPI
+	mu    sync.Mutex
+	calls []awsCall
+}
+
+func (f *fakeSQS) SendMessageBatch(input *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	call := awsCall{entries: len(input.Entries)}
+	output := &sqs.SendMessageBatchOutput{}
+	for _, entry := range input.Entries {
+		call.bytes += len(aws.StringValue(entry.MessageBody))
+		for name, value := range entry.MessageAttributes {
+			call.bytes += len(name) + len(aws.StringValue(value.DataType)) + len(aws.StringValue(value.StringValue))
+		}
+		output.Successful = append(output.Successful, &sqs.SendMessageBatchResultEntry{Id: entry.Id})
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+	return output, nil
+}
+
+type fakeSNS struct {
+	snsiface.SNSAPI
+	mu     sync.Mutex
+	calls  []awsCall
+	inputs []*sns.PublishInput
+}
+
+func (f *fakeSNS) PublishWithContext(_ aws.Context, input *sns.PublishInput, _ ...request.Option) (*sns.PublishOutput, error) {
+	call := awsCall{entries: 1, bytes: len(aws.StringValue(input.Message))}
+	for name, value := range input.MessageAttributes {
+		call.bytes += len(name) + len(aws.StringValue(value.DataType)) + len(aws.StringValue(value.StringValue))
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+	f.inputs = append(f.inputs, input)
+	return &sns.PublishOutput{}, nil
+}
+
+type fakeEventBridge struct {
+	eventbridgeiface.EventBridgeAPI
+	// failures are the error codes of the entries of the first call
+	failures map[int]string
+	mu       sync.Mutex
+	calls    []awsCall
+	details  []string
+}
+
+func (f *fakeEventBridge) PutEventsWithContext(_ aws.Context, input *eventbridge.PutEventsInput,
+	_ ...request.Option) (*eventbridge.PutEventsOutput, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	call := awsCall{entries: len(input.Entries)}
+	output := &eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0)}
+	for i, entry := range input.Entries {
+		call.bytes += len(aws.StringValue(entry.Detail)) + len(aws.StringValue(entry.DetailType)) + len(aws.StringValue(entry.Source))
+		if code, ok := f.failures[i]; ok && len(f.calls) == 0 {
+			*output.FailedEntryCount++
+			output.Entries = append(output.Entries, &eventbridge.PutEventsResultEntry{
+				ErrorCode:    aws.String(code),
+				ErrorMessage: aws.String("failed"),
+			})
+			continue
+		}
+		f.details = append(f.details, aws.StringValue(entry.Detail))
+		output.Entries = append(output.Entries, &eventbridge.PutEventsResultEntry{EventId: aws.String("id")})
+	}
+	f.calls = append(f.calls, call)
+	return output, nil
+}
+
+type fakeLambda struct {
+	lambdaiface.LambdaAPI
+	mu              sync.Mutex
+	calls           []awsCall
+	payloads        [][]byte
+	invocationTypes []string
+	// functionError fails the invocations with this error payload if set
+	functionError string
+}
+
+func (f *fakeLambda) InvokeWithContext(_ aws.Context, input *lambda.InvokeInput, _ ...request.Option) (*lambda.InvokeOutput, error) {
+	var sqsEvent events.SQSEvent
+	if err := jsoniter.Unmarshal(input.Payload, &sqsEvent); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, awsCall{entries: len(sqsEvent.Records), bytes: len(input.Payload)})
+	f.payloads = append(f.payloads, input.Payload)
+	f.invocationTypes = append(f.invocationTypes, aws.StringValue(input.InvocationType))
+	if f.functionError != "" {
+		return &lambda.InvokeOutput{StatusCode: aws.Int64(200), FunctionError: aws.String("Unhandled"),
+			Payload: []byte(f.functionError)}, nil
+	}
+	return &lambda.InvokeOutput{StatusCode: aws.Int64(202)}, nil
+}
+
+// limitedDestination fails the test if a send is above the limits declared by the destination
+type limitedDestination struct {
+	Destination
+	t     *testing.T
+	sends int
+}
+
+func (d *limitedDestination) Send(ctx context.Context, batch []*Notification) error {
+	d.sends++
+	assert.NotEmpty(d.t, batch)
+	assert.LessOrEqual(d.t, len(batch), d.MaxBatchSize())
+	assert.LessOrEqual(d.t, batchSize(batch), d.MaxPayloadBytes())
+	return d.Destination.Send(ctx, batch)
+}
+
+// testNotifications returns notifications of objects with keys of the given size. The keys are made of characters
+// JSON escapes, a message is about 4 times the key size and the envelopes of the destinations double that.
+func testNotifications(n, keySize int) []*events.S3Event {
+	notifications := make([]*events.S3Event, 0, n)
+	for i := 0; i < n; i++ {
+		notifications = append(notifications, NewNotification(testBucket, &s3.Object{
+			Key:          aws.String(strings.Repeat("<\"", keySize/2)),
+			Size:         aws.Int64(1),
+			LastModified: aws.Time(testStart),
+		}))
+	}
+	return notifications
+}
+
+func TestDestinationLimits(t *testing.T) {
+	type testCase struct {
+		destination Destination
+		calls       func() []awsCall
+		// maxEntries is the AWS limit of entries per call
+		maxEntries int
+	}
+	testCases := map[string]func() testCase{
+		"sqs": func() testCase {
+			fake := &fakeSQS{}
+			return testCase{
+				destination: &SQSDestination{SQS: fake, QueueURL: testQueue, TopicARN: FakeTopicARN(testAccount)},
+				calls:       func() []awsCall { return fake.calls },
+				maxEntries:  10,
+			}
+		},
+		"sns": func() testCase {
+			fake := &fakeSNS{}
+			return testCase{
+				destination: &SNSDestination{SNS: fake, TopicARN: "topic"},
+				calls:       func() []awsCall { return fake.calls },
+				maxEntries:  1,
+			}
+		},
+		"eventbridge": func() testCase {
+			fake := &fakeEventBridge{}
+			return testCase{
+				destination: &EventBridgeDestination{EventBridge: fake, EventBusName: "bus"},
+				calls:       func() []awsCall { return fake.calls },
+				maxEntries:  10,
+			}
+		},
+		"lambda": func() testCase {
+			fake := &fakeLambda{}
+			return testCase{
+				destination: &LambdaDestination{Lambda: fake, FunctionName: "function", TopicARN: FakeTopicARN(testAccount)},
+				calls:       func() []awsCall { return fake.calls },
+				maxEntries:  10,
+			}
+		},
+	}
+	for name, newTestCase := range testCases {
+		name, newTestCase := name, newTestCase
+		t.Run(name, func(t *testing.T) {
+			tc := newTestCase()
+			limits := tc.destination.MaxPayloadBytes()
+			// small notifications fill batches, large ones fill payloads, the largest fills a payload alone
+			for _, keySize := range []int{10, limits / 16, (limits - 2048) / 4} {
+				destination := &limitedDestination{Destination: tc.destination, t: t}
+				publisher := &Publisher{Destination: destination, Stats: NewPublishStats(stats.NewCollector())}
+				numCalls := len(tc.calls())
+				require.NoError(t, publisher.Publish(context.Background(), testNotifications(25, keySize)))
+				assert.Equal(t, uint64(25), publisher.Stats.NumSent.Value())
+				assert.Equal(t, uint64(destination.sends), publisher.Stats.NumBatches.Value())
+
+				numEntries := 0
+				for _, call := range tc.calls()[numCalls:] {
+					numEntries += call.entries
+					assert.LessOrEqual(t, call.entries, tc.maxEntries)
+					assert.LessOrEqual(t, call.bytes, maxAWSPayloadBytes)
+				}
+				assert.Equal(t, 25, numEntries)
+			}
+		})
+	}
+}
+
+func TestPublisherSplitsBatches(t *testing.T) {
+	destination := &RecordingDestination{BatchSize: 3}
+	publisher := &Publisher{Destination: destination, RunID: "run"}
+	require.NoError(t, publisher.Publish(context.Background(), testNotifications(7, 10)))
+	batches := destination.Batches()
+	require.Len(t, batches, 3)
+	assert.Len(t, batches[0], 3)
+	assert.Len(t, batches[2], 1)
+
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 7)
+	assert.Equal(t, "run", notifications[0].Attributes[notify.BackfillRunIDAttributeName])
+	assert.Equal(t, testStart.Format(time.RFC3339), notifications[0].Attributes[notify.OriginalEventTimeAttributeName])
+
+	destination = &RecordingDestination{PayloadBytes: 100}
+	publisher = &Publisher{Destination: destination}
+	err := publisher.Publish(context.Background(), testNotifications(1, 10))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "above the destination limit of 100 bytes")
+	assert.Empty(t, destination.Batches())
+}
+
+func TestPublishNotifications(t *testing.T) {
+	recorded := &RecordingDestination{}
+	require.NoError(t, (&Publisher{Destination: recorded, RunID: "run"}).Publish(context.Background(), testNotifications(5, 10)))
+	publishStats := NewPublishStats(stats.NewCollector())
+	destination := &RecordingDestination{BatchSize: 2}
+	// sent as they are, neither packed nor stamped with the run of the publisher
+	publisher := &Publisher{Destination: destination, RunID: "redrive", PackRecords: 5, Stats: publishStats}
+	require.NoError(t, publisher.PublishNotifications(context.Background(), recorded.Notifications()))
+	assert.Equal(t, recorded.Notifications(), destination.Notifications())
+	assert.Len(t, destination.Batches(), 3)
+	assert.Equal(t, uint64(5), publishStats.NumSent.Value())
+}
+
+func TestPublisherPacksRecords(t *testing.T) {
+	destination := &RecordingDestination{BatchSize: 2}
+	publisher := &Publisher{Destination: destination, RunID: "run", PackRecords: 4}
+	require.NoError(t, publisher.Publish(context.Background(), testNotifications(10, 10)))
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 3)
+	var numRecords []int
+	for _, notification := range notifications {
+		parsed, err := notify.ParseNotification([]byte(notification.Message))
+		require.NoError(t, err)
+		require.Len(t, parsed.Records, len(notification.Event.Records))
+		assert.Equal(t, testBucket, parsed.Records[0].S3.Bucket.Name)
+		assert.Equal(t, "run", notification.Attributes[notify.BackfillRunIDAttributeName])
+		numRecords = append(numRecords, len(parsed.Records))
+	}
+	assert.Equal(t, []int{4, 4, 2}, numRecords)
+	assert.Len(t, destination.Batches(), 2)
+
+	// packed notifications stay below the payload limit
+	pair := &RecordingDestination{}
+	require.NoError(t, (&Publisher{Destination: pair, PackRecords: 2}).Publish(context.Background(), testNotifications(2, 10)))
+	limit := pair.Notifications()[0].Size()
+	destination = &RecordingDestination{PayloadBytes: limit}
+	publisher = &Publisher{Destination: destination, PackRecords: 100}
+	require.NoError(t, publisher.Publish(context.Background(), testNotifications(6, 10)))
+	notifications = destination.Notifications()
+	require.Len(t, notifications, 3)
+	for _, notification := range notifications {
+		assert.LessOrEqual(t, notification.Size(), limit)
+		assert.Len(t, notification.Event.Records, 2)
+	}
+}
+
+// Packed messages are the payloads of a notify.Batcher, with the keys encoded as in unpacked ones
+func TestPublisherPacksBatcherPayloads(t *testing.T) {
+	var batch []*events.S3Event
+	for _, key := range []string{"year=2020/a b.gz", "year=2020/c+d.gz"} {
+		batch = append(batch, NewNotification(testBucket, &s3.Object{Key: aws.String(key), Size: aws.Int64(1)}))
+	}
+	destination := &RecordingDestination{}
+	require.NoError(t, (&Publisher{Destination: destination, PackRecords: 2}).Publish(context.Background(), batch))
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 1)
+
+	var encoded []events.S3EventRecord
+	for _, event := range batch {
+		record := event.Records[0]
+		record.S3.Object.Key = notify.EncodeObjectKey(record.S3.Object.Key)
+		encoded = append(encoded, record)
+	}
+	payloads, err := notify.BatchRecords(encoded, 2, destination.MaxPayloadBytes())
+	require.NoError(t, err)
+	require.Len(t, payloads, 1)
+	assert.Equal(t, string(payloads[0].Payload), notifications[0].Message)
+	assert.Equal(t, "year=2020/a b.gz", notifications[0].Event.Records[0].S3.Object.Key)
+}
+
+func TestPublisherPacksGroups(t *testing.T) {
+	var batch []*events.S3Event
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1", "a/4"} {
+		batch = append(batch, NewNotification(testBucket, &s3.Object{Key: aws.String(key), Size: aws.Int64(1)}))
+	}
+	destination := &RecordingDestination{}
+	publisher := &Publisher{
+		Destination: destination,
+		PackRecords: 2,
+		PackGroup: func(_, key string) string {
+			return strings.SplitN(key, "/", 2)[0]
+		},
+	}
+	require.NoError(t, publisher.Publish(context.Background(), batch))
+	var packs [][]string
+	for _, notification := range destination.Notifications() {
+		var keys []string
+		for _, record := range notification.Event.Records {
+			keys = append(keys, record.S3.Object.Key)
+		}
+		packs = append(packs, keys)
+	}
+	assert.Equal(t, [][]string{{"a/1", "a/2"}, {"a/3"}, {"b/1"}, {"a/4"}}, packs)
+}
+
+func TestPublisherNoAttributes(t *testing.T) {
+	destination := &RecordingDestination{}
+	publisher := &Publisher{Destination: destination, RunID: "run", NoAttributes: true}
+	require.NoError(t, publisher.Publish(context.Background(), testNotifications(2, 10)))
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 2)
+	assert.Empty(t, notifications[0].Attributes)
+	parsed, err := notify.ParseNotification([]byte(notifications[0].Message))
+	require.NoError(t, err)
+	assert.Equal(t, testBucket, parsed.Records[0].S3.Bucket.Name)
+}
+
+func TestPublisherSigns(t *testing.T) {
+	key := notify.SigningKey{Version: "v1", Secret: []byte("secret")}
+	verifier := &notify.Verifier{Keys: []notify.SigningKey{key}}
+	for _, publisher := range []*Publisher{
+		{RunID: "run"},
+		{RunID: "run", NoAttributes: true},
+		{RunID: "run", PackRecords: 3},
+	} {
+		destination := &RecordingDestination{}
+		publisher.Destination = destination
+		publisher.Signer = &notify.Signer{Key: key}
+		require.NoError(t, publisher.Publish(context.Background(), testNotifications(5, 10)))
+		for _, notification := range destination.Notifications() {
+			signature := notification.Attributes[notify.SignatureAttributeName]
+			require.NotEmpty(t, signature)
+			assert.NoError(t, verifier.Verify(notification.Message, signature))
+		}
+	}
+}
+
+func TestPublisherCompresses(t *testing.T) {
+	key := notify.SigningKey{Version: "v1", Secret: []byte("secret")}
+	verifier := &notify.Verifier{Keys: []notify.SigningKey{key}}
+	destination := &RecordingDestination{}
+	publisher := &Publisher{
+		Destination:   destination,
+		RunID:         "run",
+		PackRecords:   5,
+		Signer:        &notify.Signer{Key: key},
+		CompressAbove: 1000,
+	}
+	require.NoError(t, publisher.Publish(context.Background(), testNotifications(6, 10)))
+	notifications := destination.Notifications()
+	require.Len(t, notifications, 2)
+
+	// the pack of 5 is compressed, the single record is below the threshold and sent as is
+	var numRecords []int
+	for _, notification := range notifications {
+		parsed, err := notify.ParseNotification([]byte(notification.Message))
+		require.NoError(t, err)
+		require.Len(t, parsed.Records, len(notification.Event.Records))
+		for i := range parsed.Records {
+			assert.Equal(t, notify.EncodeObjectKey(notification.Event.Records[i].S3.Object.Key), parsed.Records[i].S3.Object.Key)
+		}
+		numRecords = append(numRecords, len(parsed.Records))
+		assert.NoError(t, verifier.Verify(notification.Message, notification.Attributes[notify.SignatureAttributeName]))
+	}
+	assert.Equal(t, []int{5, 1}, numRecords)
+	assert.Equal(t, notify.SchemaVersionCompressed, notifications[0].Attributes[notify.SchemaVersionAttributeName])
+	assert.Contains(t, notifications[0].Message, notify.ContentEncodingGzip)
+	assert.NotContains(t, notifications[1].Attributes, notify.SchemaVersionAttributeName)
+
+	attributes := snsMessageAttributes(notifications[0].Attributes)
+	assert.Equal(t, notify.SchemaVersionCompressed, aws.StringValue(attributes[notify.SchemaVersionAttributeName].StringValue))
+}
+
+type countingThrottle struct {
+	sizes []int64
+}
+
+func (c *countingThrottle) Wait(_ context.Context, size int64) error {
+	c.sizes = append(c.sizes, size)
+	return nil
+}
+
+func TestPublisherThrottle(t *testing.T) {
+	throttle := &countingThrottle{}
+	destination := &RecordingDestination{BatchSize: 3}
+	publisher := &Publisher{Destination: destination, Throttle: throttle}
+	require.NoError(t, publisher.Publish(context.Background(), testNotifications(7, 10)))
+	require.Len(t, throttle.sizes, 3)
+	var size int64
+	for _, notification := range destination.Notifications() {
+		size += int64(notification.Size())
+	}
+	assert.Equal(t, size, throttle.sizes[0]+throttle.sizes[1]+throttle.sizes[2])
+}
+
+func TestPublisherNotificationThrottle(t *testing.T) {
+	throttle := &countingThrottle{}
+	destination := &RecordingDestination{BatchSize: 3}
+	publisher := &Publisher{Destination: destination, NotificationThrottle: throttle}
+	require.NoError(t, publisher.Publish(context.Background(), testNotifications(7, 10)))
+	assert.Equal(t, []int64{3, 3, 1}, throttle.sizes)
+}
+
+func TestPublisherRetriesUnsent(t *testing.T) {
+	fake := &fakeEventBridge{failures: map[int]string{1: "ThrottlingException", 3: "ThrottlingException"}}
+	var retries []awsretry.Class
+	publisher := &Publisher{
+		Destination: &EventBridgeDestination{EventBridge: fake, EventBusName: "bus"},
+		Retryer: &awsretry.Retryer{
+			InitialInterval: time.Millisecond,
+			OnRetry: func(_ error, class awsretry.Class, _ time.Duration) {
+				retries = append(retries, class)
+			},
+		},
+		Stats: NewPublishStats(stats.NewCollector()),
+	}
+	require.NoError(t, publisher.Publish(context.Background(), testNotifications(5, 10)))
+	assert.Equal(t, []awsretry.Class{awsretry.Throttled}, retries)
+	assert.Equal(t, uint64(1), publisher.Stats.NumRetries.Value())
+	assert.Equal(t, uint64(1), publisher.Stats.NumRetried.Value())
+	assert.Equal(t, uint64(5), publisher.Stats.NumSent.Value())
+	require.Len(t, fake.calls, 2)
+	assert.Equal(t, 2, fake.calls[1].entries) // only the failed entries are resent
+	assert.Len(t, fake.details, 5)
+
+	var detail eventBridgeDetail
+	require.NoError(t, jsoniter.UnmarshalFromString(fake.details[0], &detail))
+	notification, err := notify.ParseNotification(detail.Notification)
+	require.NoError(t, err)
+	assert.Equal(t, testBucket, notification.Records[0].S3.Bucket.Name)
+	assert.Equal(t, "true", detail.Attributes[notify.ReplayAttributeName])
+}
+
+func TestFanOutDestination(t *testing.T) {
+	fake := &fakeEventBridge{failures: map[int]string{1: "ThrottlingException", 3: "ThrottlingException"}}
+	recording := &RecordingDestination{}
+	fanOut := &FanOutDestination{
+		Destinations: []Destination{recording, &EventBridgeDestination{EventBridge: fake, EventBusName: "bus"}},
+		Targets:      []string{"recording", "bus"},
+	}
+	assert.Equal(t, 10, fanOut.MaxBatchSize())
+	publisher := &Publisher{
+		Destination: fanOut,
+		Retryer:     &awsretry.Retryer{InitialInterval: time.Millisecond},
+		Stats:       NewPublishStats(stats.NewCollector()),
+	}
+	require.NoError(t, publisher.Publish(context.Background(), testNotifications(5, 10)))
+	assert.Equal(t, uint64(5), publisher.Stats.NumSent.Value())
+	assert.Equal(t, uint64(1), publisher.Stats.NumRetried.Value())
+	// the retry only sends to the destination that failed
+	assert.Len(t, recording.Notifications(), 5)
+	require.Len(t, fake.calls, 2)
+	assert.Equal(t, 2, fake.calls[1].entries)
+	assert.Len(t, fake.details, 5)
+	assert.Equal(t, map[string]uint64{"recording": 0, "bus": 2}, fanOut.Failures())
+	assert.Empty(t, fanOut.accepted)
+
+	// a permanent failure is of the destination that failed
+	fake = &fakeEventBridge{failures: map[int]string{0: "AccessDeniedException"}}
+	fanOut.Destinations[1] = &EventBridgeDestination{EventBridge: fake, EventBusName: "bus"}
+	err := publisher.Publish(context.Background(), testNotifications(2, 10))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to send to bus")
+	var unsent *UnsentError
+	require.True(t, errors.As(err, &unsent))
+	assert.Len(t, unsent.Unsent, 1)
+	assert.Len(t, recording.Notifications(), 7)
+}
+
+func TestPublisherPermanentFailure(t *testing.T) {
+	fake := &fakeEventBridge{failures: map[int]string{0: "AccessDeniedException"}}
+	publisher := &Publisher{Destination: &EventBridgeDestination{EventBridge: fake, EventBusName: "bus"}}
+	err := publisher.Publish(context.Background(), testNotifications(2, 10))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to send 1 of 2 notifications")
+	assert.Len(t, fake.calls, 1)
+	var unsent *UnsentError
+	require.True(t, errors.As(err, &unsent))
+	assert.Len(t, unsent.Unsent, 1)
+	assert.Equal(t, awsretry.Permanent, awsretry.Classify(err))
+}
+
+func TestLambdaDestination(t *testing.T) {
+	fake := &fakeLambda{}
+	publisher := &Publisher{
+		Destination: &LambdaDestination{Lambda: fake, FunctionName: "function", TopicARN: FakeTopicARN(testAccount)},
+		RunID:       "run",
+	}
+	require.NoError(t, publisher.Publish(context.Background(), testNotifications(2, 10)))
+	require.Len(t, fake.payloads, 1)
+	var sqsEvent events.SQSEvent
+	require.NoError(t, jsoniter.Unmarshal(fake.payloads[0], &sqsEvent))
+	require.Len(t, sqsEvent.Records, 2)
+	attributes := notify.ParseSQSMessageAttributes(sqsEvent.Records[0].MessageAttributes)
+	assert.True(t, attributes.Replay)
+	assert.Equal(t, "run", attributes.BackfillRunID)
+	var snsEntity events.SNSEntity
+	require.NoError(t, jsoniter.UnmarshalFromString(sqsEvent.Records[0].Body, &snsEntity))
+	assert.Equal(t, FakeTopicARN(testAccount), snsEntity.TopicArn)
+	assert.Equal(t, []string{lambda.InvocationTypeEvent}, fake.invocationTypes)
+}
+
+func TestLambdaDestinationSynchronous(t *testing.T) {
+	fake := &fakeLambda{functionError: `{"errorType":"errorString","errorMessage":"AccessDenied"}`}
+	destination := &LambdaDestination{Lambda: fake, FunctionName: "function", TopicARN: FakeTopicARN(testAccount), Synchronous: true}
+	batch := []*Notification{
+		{Event: NewNotification(testBucket, &s3.Object{Key: aws.String("a"), Size: aws.Int64(1)}), Message: "{}"},
+		{Event: NewNotification(testBucket, &s3.Object{Key: aws.String("b"), Size: aws.Int64(1)}), Message: "{}"},
+	}
+	err := destination.Send(context.Background(), batch)
+	require.Error(t, err)
+	assert.Equal(t, "function failed to process s3://"+testBucket+"/a and 1 more file: errorString: AccessDenied", err.Error())
+	assert.Equal(t, []string{lambda.InvocationTypeRequestResponse}, fake.invocationTypes)
+
+	// without an error payload the function error is reported as is
+	fake.functionError = "not json"
+	err = destination.Send(context.Background(), batch[1:])
+	require.Error(t, err)
+	assert.Equal(t, "function failed to process s3://"+testBucket+"/b: Unhandled", err.Error())
+}
+
+func TestSNSDestinationFIFO(t *testing.T) {
+	notification := func(key, etag string) *Notification {
+		object := &s3.Object{Key: aws.String(key), Size: aws.Int64(1), ETag: aws.String(etag)}
+		return &Notification{Event: NewNotification(testBucket, object), Message: "{}"}
+	}
+	batch := []*Notification{
+		notification("AWSLogs/1/a.gz", "1"),
+		notification("AWSLogs/1/a.gz", "1"),
+		notification("AWSLogs/1/a.gz", "2"),
+		notification("b.gz", "1"),
+	}
+
+	fake := &fakeSNS{}
+	destination := &SNSDestination{SNS: fake, TopicARN: "arn:aws:sns:us-east-1:" + testAccount + ":topic.fifo"}
+	require.NoError(t, destination.Send(context.Background(), batch))
+	require.Len(t, fake.inputs, 4)
+	assert.Equal(t, testBucket+"/AWSLogs", aws.StringValue(fake.inputs[0].MessageGroupId))
+	assert.Equal(t, testBucket, aws.StringValue(fake.inputs[3].MessageGroupId))
+	// the same file is deduplicated with the id of notify, the file written again is not
+	assert.Equal(t, notify.DeduplicationID(testBucket, "AWSLogs/1/a.gz", "1"), aws.StringValue(fake.inputs[0].MessageDeduplicationId))
+	assert.Equal(t, fake.inputs[0].MessageDeduplicationId, fake.inputs[1].MessageDeduplicationId)
+	assert.NotEqual(t, fake.inputs[0].MessageDeduplicationId, fake.inputs[2].MessageDeduplicationId)
+
+	fake = &fakeSNS{}
+	destination.SNS, destination.GroupID = fake, FIFOGroupIDs[GroupByBucket]
+	require.NoError(t, destination.Send(context.Background(), batch[:1]))
+	assert.Equal(t, testBucket, aws.StringValue(fake.inputs[0].MessageGroupId))
+
+	fake = &fakeSNS{}
+	destination.SNS, destination.GroupID = fake, FIFOGroupIDs[GroupByTable]
+	require.NoError(t, destination.Send(context.Background(), []*Notification{notification("logs/aws_cloudtrail/a.gz", "1")}))
+	assert.Equal(t, "aws_cloudtrail", aws.StringValue(fake.inputs[0].MessageGroupId))
+
+	// standard topics are unchanged
+	fake = &fakeSNS{}
+	destination = &SNSDestination{SNS: fake, TopicARN: "arn:aws:sns:us-east-1:" + testAccount + ":topic"}
+	require.NoError(t, destination.Send(context.Background(), batch[:1]))
+	assert.Nil(t, fake.inputs[0].MessageGroupId)
+	assert.Nil(t, fake.inputs[0].MessageDeduplicationId)
+}
+
+func TestNewDestination(t *testing.T) {
+	destination, err := NewDestination(nil, &DestinationOptions{Kind: DestinationDryRun})
+	require.NoError(t, err)
+	assert.IsType(t, &RecordingDestination{}, destination)
+
+	_, err = NewDestination(nil, &DestinationOptions{Kind: DestinationSNS})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no target for the sns destination")
+
+	_, err = NewDestination(nil, &DestinationOptions{Kind: "kinesis", Target: "stream"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unknown destination "kinesis"`)
+
+	// the processor destination invokes the log processor unless told otherwise
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+	destination, err = NewDestination(sess, &DestinationOptions{Kind: DestinationProcessor, AccountID: testAccount})
+	require.NoError(t, err)
+	require.IsType(t, &LambdaDestination{}, destination)
+	assert.Equal(t, LogProcessorFunction, destination.(*LambdaDestination).FunctionName)
+	assert.True(t, destination.(*LambdaDestination).Synchronous)
+
+	// a queue URL is not resolved, it is sent to in its region
+	sess = session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+	queueURL := "https://sqs.us-west-2.amazonaws.com/" + testAccount + "/loader"
+	destination, err = NewDestination(sess, &DestinationOptions{Kind: DestinationSQS, Target: queueURL, AccountID: testAccount})
+	require.NoError(t, err)
+	require.IsType(t, &SQSDestination{}, destination)
+	sqsDestination := destination.(*SQSDestination)
+	assert.Equal(t, queueURL, sqsDestination.QueueURL)
+	assert.Equal(t, "us-west-2", aws.StringValue(sqsDestination.SQS.(*sqs.SQS).Config.Region))
+	assert.Equal(t, FakeTopicARN(testAccount), sqsDestination.TopicARN)
+
+	// a topic is published to in its region
+	topicARN := "arn:aws:sns:eu-west-1:210987654321:loader"
+	destination, err = NewDestination(sess, &DestinationOptions{Kind: DestinationSNS, Target: topicARN})
+	require.NoError(t, err)
+	require.IsType(t, &SNSDestination{}, destination)
+	snsDestination := destination.(*SNSDestination)
+	assert.Equal(t, topicARN, snsDestination.TopicARN)
+	assert.Equal(t, "eu-west-1", aws.StringValue(snsDestination.SNS.(*sns.SNS).Config.Region))
+}
+
+func TestQueueURLRegion(t *testing.T) {
+	region, ok := queueURLRegion("https://sqs.eu-west-1.amazonaws.com/012345678912/queue")
+	assert.True(t, ok)
+	assert.Equal(t, "eu-west-1", aws.StringValue(region))
+
+	region, ok = queueURLRegion("http://localhost:4566/000000000000/queue")
+	assert.True(t, ok)
+	assert.Nil(t, region) // the region of the session
+
+	_, ok = queueURLRegion("panther-input-data-notifications-queue")
+	assert.False(t, ok)
+}
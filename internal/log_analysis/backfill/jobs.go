@@ -0,0 +1,198 @@
+package backfill
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/pkg/errors"
+)
+
+// The states of a back-fill job
+const (
+	StatePending   = "pending"
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+	StateCanceled  = "canceled"
+)
+
+// JobSpec is what a back-fill job lists and where it publishes the notifications
+type JobSpec struct {
+	// IntegrationID is the source to back-fill, its bucket, prefix, account and role are used if not set
+	IntegrationID string `json:"integrationId,omitempty"`
+	Bucket        string `json:"bucket,omitempty"`
+	Prefix        string `json:"prefix,omitempty"`
+	// AccountID is the account of the source, the log processor assumes its role to read the objects
+	AccountID string `json:"accountId,omitempty" validate:"omitempty,len=12,numeric"`
+	// RoleARN is assumed to list the objects, if empty the objects are listed with the role of the API
+	RoleARN string `json:"roleArn,omitempty"`
+	Filter  Filter `json:"filter"`
+	// Limit is the max number of objects to publish, 0 means no limit
+	Limit uint64 `json:"limit,omitempty"`
+	// QueueURL is the queue the notifications are sent to, defaults to the log processor queue
+	QueueURL string `json:"queueUrl,omitempty"`
+	// Actor is who submitted the job, it is recorded in the back-fill history of the integration
+	Actor string `json:"actor,omitempty"`
+}
+
+// Progress is the status of a back-fill job, it is updated after every chunk of the listing
+type Progress struct {
+	State        string `json:"state"`
+	NumListed    uint64 `json:"numListed"`
+	NumPublished uint64 `json:"numPublished"`
+	NumFailed    uint64 `json:"numFailed"`
+	NumBytes     uint64 `json:"numBytes"`
+	// LastKey is the current key position, the listing resumes after it
+	LastKey string `json:"lastKey,omitempty"`
+	// NumInvocations is the number of chunks run so far
+	NumInvocations int       `json:"numInvocations"`
+	Error          string    `json:"error,omitempty"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// Done returns true if the job will not run anymore
+func (p *Progress) Done() bool {
+	switch p.State {
+	case StateSucceeded, StateFailed, StateCanceled:
+		return true
+	default:
+		return false
+	}
+}
+
+// Job is a back-fill run server-side
+type Job struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Spec      JobSpec   `json:"spec"`
+	Progress  Progress  `json:"progress"`
+	// CancelRequested stops the job before its next chunk
+	CancelRequested bool `json:"cancelRequested,omitempty"`
+}
+
+// JobStore persists back-fill jobs. The progress and the cancel request are updated separately, so that
+// the worker updating the progress never overwrites a cancel request.
+type JobStore interface {
+	// CreateJob stores a new job, it fails if a job with the same id exists
+	CreateJob(ctx context.Context, job *Job) error
+	// GetJob returns a job or nil if it does not exist
+	GetJob(ctx context.Context, id string) (*Job, error)
+	// UpdateProgress replaces the progress of a job and returns the updated job or nil if it does not exist
+	UpdateProgress(ctx context.Context, id string, progress *Progress) (*Job, error)
+	// RequestCancel marks a job to be canceled and returns the updated job or nil if it does not exist
+	RequestCancel(ctx context.Context, id string) (*Job, error)
+}
+
+// DynamoDBJobs stores back-fill jobs in a table with the job id as hash key
+type DynamoDBJobs struct {
+	DB        dynamodbiface.DynamoDBAPI
+	TableName string
+}
+
+var _ JobStore = (*DynamoDBJobs)(nil)
+
+func (d *DynamoDBJobs) CreateJob(ctx context.Context, job *Job) error {
+	item, err := dynamodbattribute.MarshalMap(job)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal job")
+	}
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String(d.TableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	}
+	if _, err := d.DB.PutItemWithContext(ctx, input); err != nil {
+		return errors.Wrapf(err, "failed to create job %q", job.ID)
+	}
+	return nil
+}
+
+func (d *DynamoDBJobs) GetJob(ctx context.Context, id string) (*Job, error) {
+	input := &dynamodb.GetItemInput{
+		TableName:      aws.String(d.TableName),
+		Key:            jobKey(id),
+		ConsistentRead: aws.Bool(true),
+	}
+	output, err := d.DB.GetItemWithContext(ctx, input)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get job %q", id)
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+	return unmarshalJob(output.Item)
+}
+
+func (d *DynamoDBJobs) UpdateProgress(ctx context.Context, id string, progress *Progress) (*Job, error) {
+	value, err := dynamodbattribute.Marshal(progress)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal progress")
+	}
+	return d.update(ctx, id, "progress", value)
+}
+
+func (d *DynamoDBJobs) RequestCancel(ctx context.Context, id string) (*Job, error) {
+	return d.update(ctx, id, "cancelRequested", &dynamodb.AttributeValue{BOOL: aws.Bool(true)})
+}
+
+// update sets one attribute of an existing job
+func (d *DynamoDBJobs) update(ctx context.Context, id, attribute string, value *dynamodb.AttributeValue) (*Job, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(d.TableName),
+		Key:                 jobKey(id),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		UpdateExpression:    aws.String("SET #attribute = :value"),
+		ExpressionAttributeNames: map[string]*string{
+			"#attribute": aws.String(attribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":value": value,
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	}
+	output, err := d.DB.UpdateItemWithContext(ctx, input)
+	if err != nil {
+		if e, ok := err.(awserr.Error); ok && e.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to update job %q", id)
+	}
+	return unmarshalJob(output.Attributes)
+}
+
+func jobKey(id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id": {S: aws.String(id)},
+	}
+}
+
+func unmarshalJob(item map[string]*dynamodb.AttributeValue) (*Job, error) {
+	job := Job{}
+	if err := dynamodbattribute.UnmarshalMap(item, &job); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal job")
+	}
+	return &job, nil
+}
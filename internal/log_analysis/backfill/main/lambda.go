@@ -0,0 +1,108 @@
+package main
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	lambdaclient "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/pkg/errors"
+	"gopkg.in/go-playground/validator.v9"
+
+	"github.com/panther-labs/panther/internal/log_analysis/backfill"
+	"github.com/panther-labs/panther/pkg/lambdalogger"
+	"github.com/panther-labs/panther/pkg/x/lambdamux"
+)
+
+// The panther-backfill-api lambda runs back-fill jobs, invoking itself to continue a job in chunks.
+
+var config = struct {
+	Debug             bool
+	BackfillTableName string `required:"true" split_words:"true"`
+	QueueURL          string `required:"true" split_words:"true"`
+}{}
+
+func main() {
+	envconfig.MustProcess("", &config)
+
+	logger := lambdalogger.Config{
+		Debug:     config.Debug,
+		Namespace: "log_analysis",
+		Component: "backfill_api",
+	}.MustBuild()
+
+	sess := session.Must(session.NewSession())
+	api := &backfill.API{
+		Jobs: &backfill.DynamoDBJobs{
+			DB:        dynamodb.New(sess),
+			TableName: config.BackfillTableName,
+		},
+		LambdaClient: lambdaclient.New(sess),
+		SQS:          sqs.New(sess),
+		FunctionName: lambdacontext.FunctionName,
+		QueueURL:     config.QueueURL,
+		NewS3Client: func(spec *backfill.JobSpec) (s3iface.S3API, error) {
+			return newS3Client(sess, spec)
+		},
+	}
+
+	validate := validator.New()
+	mux := lambdamux.Mux{
+		// use case-insensitive route matching
+		RouteName: lambdamux.IgnoreCase,
+		Validate:  validate.Struct,
+	}
+	mux.MustHandleMethods(api)
+
+	// Adds logger to lambda context with a Lambda request ID field and debug output
+	handler := lambdalogger.Wrap(logger, &mux)
+
+	lambda.StartHandler(handler)
+}
+
+// newS3Client returns a client in the region of the bucket, assuming the role of the job if set
+func newS3Client(sess *session.Session, spec *backfill.JobSpec) (s3iface.S3API, error) {
+	awsConfig := aws.NewConfig()
+	if spec.RoleARN != "" {
+		// Use regional STS endpoints as per AWS recommendation https://docs.aws.amazon.com/general/latest/gr/sts.html
+		credsSession := sess.Copy(aws.NewConfig().WithSTSRegionalEndpoint(endpoints.RegionalSTSEndpoint))
+		awsConfig.WithCredentials(stscreds.NewCredentials(credsSession, spec.RoleARN))
+	}
+	location, err := s3.New(sess, awsConfig).GetBucketLocation(&s3.GetBucketLocationInput{
+		Bucket: aws.String(spec.Bucket),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find bucket region for %s", spec.Bucket)
+	}
+	// The location is nil for us-east-1, https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketLocation.html
+	region := endpoints.UsEast1RegionID
+	if location.LocationConstraint != nil {
+		region = *location.LocationConstraint
+	}
+	return s3.New(sess, awsConfig.WithRegion(region)), nil
+}
@@ -0,0 +1,111 @@
+package backfill
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"crypto/rand"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Run IDs are ULIDs (https://github.com/ulid/spec): 48 bits of milliseconds since the epoch and 80 random bits,
+// in 26 characters of Crockford's base32. They sort by start time and the start of a run can be read back from them.
+
+const (
+	runIDLength   = 26
+	runIDAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+// externally supplied run IDs are used in object keys and file names
+var validRunID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]{0,127}$`)
+
+// NewRunID returns a new run ID for a run starting now
+func NewRunID() string {
+	return newRunID(time.Now(), rand.Reader)
+}
+
+func newRunID(now time.Time, entropy io.Reader) string {
+	var id [16]byte
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		id[i] = byte(ms)
+		ms >>= 8
+	}
+	if _, err := io.ReadFull(entropy, id[6:]); err != nil {
+		panic(errors.Wrap(err, "failed to read random bits")) // crypto/rand does not fail on supported platforms
+	}
+	// 128 bits are encoded 5 bits at a time, starting with the 3 most significant bits
+	encoded := make([]byte, runIDLength)
+	var acc uint32
+	bits := 2 // the padding bits before the first byte
+	pos := 0
+	for _, b := range id {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			encoded[pos] = runIDAlphabet[acc>>uint(bits)&0x1f]
+			pos++
+		}
+	}
+	return string(encoded)
+}
+
+// RunIDTime returns the start time of a run from its ID, false if the ID is not a ULID (e.g. an external ID)
+func RunIDTime(id string) (time.Time, bool) {
+	if len(id) != runIDLength {
+		return time.Time{}, false
+	}
+	// the first 10 characters are the 48 bits of the time, the first character holds only 3 bits
+	var ms uint64
+	for i := 0; i < 10; i++ {
+		value := decodeRunIDChar(id[i])
+		if value < 0 || i == 0 && value > 7 {
+			return time.Time{}, false
+		}
+		ms = ms<<5 | uint64(value)
+	}
+	for i := 10; i < runIDLength; i++ {
+		if decodeRunIDChar(id[i]) < 0 {
+			return time.Time{}, false
+		}
+	}
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC(), true
+}
+
+func decodeRunIDChar(c byte) int {
+	for i := 0; i < len(runIDAlphabet); i++ {
+		if runIDAlphabet[i] == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// ValidateRunID checks an externally supplied run ID, so that orchestrated jobs can use their own IDs.
+// IDs start with a letter or digit and have at most 128 letters, digits and _ . : - characters.
+func ValidateRunID(id string) error {
+	if !validRunID.MatchString(id) {
+		return errors.Errorf("invalid run id %q, expected at most 128 letters, digits and _ . : - characters", id)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package backfill
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunID(t *testing.T) {
+	// the example of the ULID spec
+	start := time.Unix(0, 1469918176385*int64(time.Millisecond)).UTC()
+	id := newRunID(start, bytes.NewReader(make([]byte, 10)))
+	assert.Equal(t, "01ARYZ6S410000000000000000", id)
+	id = newRunID(start, bytes.NewReader(bytes.Repeat([]byte{0xff}, 10)))
+	assert.Equal(t, "01ARYZ6S41ZZZZZZZZZZZZZZZZ", id)
+
+	startTime, ok := RunIDTime(id)
+	require.True(t, ok)
+	assert.Equal(t, start, startTime)
+	require.NoError(t, ValidateRunID(id))
+
+	first := NewRunID()
+	time.Sleep(2 * time.Millisecond)
+	assert.Less(t, first, NewRunID()) // sorted by start time
+}
+
+func TestRunIDTimeExternal(t *testing.T) {
+	for _, id := range []string{"", "job-1", "81ARYZ6S410000000000000000", "01ARYZ6S41000000000000000U"} {
+		_, ok := RunIDTime(id)
+		assert.False(t, ok, id)
+	}
+}
+
+func TestValidateRunID(t *testing.T) {
+	for _, id := range []string{"job-1", "airflow:backfill_2020.12.01", "01ARYZ6S410000000000000000"} {
+		assert.NoError(t, ValidateRunID(id), id)
+	}
+	for _, id := range []string{"", "../etc", "-flag", "a/b", "a b", string(bytes.Repeat([]byte{'a'}, 129))} {
+		assert.Error(t, ValidateRunID(id), id)
+	}
+}
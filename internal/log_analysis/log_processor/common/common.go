@@ -28,6 +28,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sns/snsiface"
 	"github.com/aws/aws-sdk-go/service/sqs"
@@ -36,6 +37,7 @@ import (
 
 	"github.com/panther-labs/panther/api/lambda/source/models"
 	"github.com/panther-labs/panther/internal/log_analysis/log_processor/processor/logstream"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
 	"github.com/panther-labs/panther/pkg/awsretry"
 )
 
@@ -53,6 +55,10 @@ var (
 	SqsClient    sqsiface.SQSAPI
 	SnsClient    snsiface.SNSAPI
 
+	// NotificationSigner signs the notifications of processed data if a signing secret is configured.
+	// The key is loaded on cold start, after a rotation it is the previous key which subscribers still accept.
+	NotificationSigner *notify.Signer
+
 	Config EnvConfig
 )
 
@@ -62,6 +68,8 @@ type EnvConfig struct {
 	SqsQueueURL                 string `required:"true" split_words:"true"`
 	SqsBatchSize                int64  `required:"true" split_words:"true"`
 	SnsTopicARN                 string `required:"true" split_words:"true"`
+	// NotificationSigningSecret is the Secrets Manager secret whose current key signs the notifications, if set
+	NotificationSigningSecret string `split_words:"true"`
 }
 
 func Setup() {
@@ -80,6 +88,12 @@ func Setup() {
 	if err != nil {
 		panic(err)
 	}
+	if Config.NotificationSigningSecret != "" {
+		NotificationSigner, err = notify.LoadSigner(secretsmanager.New(clientsSession), Config.NotificationSigningSecret)
+		if err != nil {
+			panic(err)
+		}
+	}
 }
 
 // DataStream represents a data stream that read by the processor
@@ -90,4 +104,6 @@ type DataStream struct {
 	S3ObjectKey  string
 	S3Bucket     string
 	S3ObjectSize int64
+	// Replay is set for the streams of replayed (back-filled) data, see notify.ReplayAttributeName
+	Replay bool
 }
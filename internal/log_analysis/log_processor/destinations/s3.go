@@ -82,6 +82,7 @@ func CreateS3Destination(jsonAPI jsoniter.API) Destination {
 		snsClient:           common.SnsClient,
 		s3Bucket:            common.Config.ProcessedDataBucket,
 		snsTopicArn:         common.Config.SnsTopicARN,
+		signer:              common.NotificationSigner,
 		maxBufferedMemBytes: maxS3BufferMemUsageBytes(common.Config.AwsLambdaFunctionMemorySize),
 		maxBufferSize:       uploaderBufferMaxSizeBytes,
 		maxDuration:         maxDuration,
@@ -115,6 +116,8 @@ type S3Destination struct {
 	// snsTopic is the SNS Topic ARN where we will send the notification
 	// when we store new data in S3
 	snsTopicArn string
+	// signer if not nil signs the notifications
+	signer *notify.Signer
 	// thresholds for ejection
 	maxBufferedMemBytes uint64 // max will hold in buffers before ejection
 	maxBufferSize       int
@@ -286,6 +289,13 @@ func (d *S3Destination) sendSNSNotification(key string, buffer *s3EventBuffer) e
 		Message:           &marshalledNotification,
 		MessageAttributes: notify.NewLogAnalysisSNSMessageAttributes(dataType, buffer.logType),
 	}
+	if buffer.replay {
+		// the rules engine tells rules about replayed events
+		notify.SetReplayHints(input.MessageAttributes, &notify.ReplayHints{Replay: true})
+	}
+	if d.signer != nil {
+		d.signer.SetSignature(input.MessageAttributes, marshalledNotification)
+	}
 	if _, err = d.snsClient.Publish(input); err != nil {
 		err = errors.Wrap(err, "failed to send notification to topic")
 		return err
@@ -307,7 +317,8 @@ func getS3ObjectKey(buf *s3EventBuffer) string {
 	return path.Join(partitionPrefix, filename)
 }
 
-// s3BufferSet is a group of buffers associated with hour time bins, pointing to maps logtype->s3EventBuffer
+// s3BufferSet is a group of buffers associated with hour time bins, pointing to maps logtype->s3EventBuffer,
+// replayed events of a log type have their own buffer (see bufferKey)
 type s3EventBufferSet struct {
 	totalBufferedMemBytes   uint64 // managed by addEvent() and removeBuffer()
 	set                     map[time.Time]map[string]*s3EventBuffer
@@ -413,10 +424,12 @@ func (bs *s3EventBufferSet) getBuffer(event *parsers.Result) *s3EventBuffer {
 	}
 
 	logType := event.PantherLogType
-	buffer, ok := logTypeToBuffer[logType]
+	key := bufferKey(logType, event.Replay)
+	buffer, ok := logTypeToBuffer[key]
 	if !ok {
 		buffer = newS3EventBuffer(logType, hour)
-		logTypeToBuffer[logType] = buffer
+		buffer.replay = event.Replay
+		logTypeToBuffer[key] = buffer
 		bs.numBuffers++
 		bs.sizePriorityQueue.Insert(buffer, 0.0)
 
@@ -433,10 +446,10 @@ func (bs *s3EventBufferSet) removeBuffer(buffer *s3EventBuffer) {
 	if !ok {
 		return
 	}
-	if _, ok := logTypeToBuffer[buffer.logType]; !ok {
+	if _, ok := logTypeToBuffer[buffer.key()]; !ok {
 		return
 	}
-	delete(logTypeToBuffer, buffer.logType)
+	delete(logTypeToBuffer, buffer.key())
 	bs.totalBufferedMemBytes -= (uint64)(buffer.bytes)
 	bs.numBuffers--
 	bs.sizePriorityQueue.Remove(buffer)
@@ -487,6 +500,7 @@ func (bs *s3EventBufferSet) apply(f func(buffer *s3EventBuffer) (bool, error)) e
 // that will be stored in the same S3 object
 type s3EventBuffer struct {
 	logType    string
+	replay     bool // replayed events are kept apart so that their notification has the replay hint
 	buffer     *bytes.Buffer
 	writer     *gzip.Writer
 	bytes      int
@@ -507,6 +521,18 @@ func newS3EventBuffer(logType string, hour time.Time) *s3EventBuffer {
 	}
 }
 
+func (b *s3EventBuffer) key() string {
+	return bufferKey(b.logType, b.replay)
+}
+
+// bufferKey is the key of the buffer of a log type in an hour bin, replayed events have their own buffers
+func bufferKey(logType string, replay bool) string {
+	if replay {
+		return logType + "/replay"
+	}
+	return logType
+}
+
 // addEvent adds new data to the s3EventBuffer, return bytes added and error
 func (b *s3EventBuffer) addEvent(data []byte) (int, error) {
 	// FIXME: To have proper JSONL data in the buffers we need to write "\n" *before* writing the JSON if startBufferSize is zero
@@ -325,6 +325,40 @@ func TestSendDataToS3FromMultipleLogTypesBeforeTerminating(t *testing.T) {
 	destination.mockSns.AssertExpectations(t)
 }
 
+func TestSendDataReplay(t *testing.T) {
+	t.Parallel()
+
+	destination := mockDestination()
+
+	eventChannel := make(chan *parsers.Result, 3)
+	eventChannel <- newSimpleTestEvent().Result()
+	for i := 0; i < 2; i++ {
+		replayed := newSimpleTestEvent().Result()
+		replayed.Replay = true
+		eventChannel <- replayed
+	}
+	close(eventChannel)
+
+	// the replayed events of the log type are sent in their own file
+	destination.mockS3Uploader.On("Upload", mock.Anything, mock.Anything).Return(&s3manager.UploadOutput{}, nil).Twice()
+	destination.mockSns.On("Publish", mock.Anything).Return(&sns.PublishOutput{}, nil).Twice()
+
+	assert.NoError(t, runDestination(destination, eventChannel))
+	destination.mockS3Uploader.AssertExpectations(t)
+	destination.mockSns.AssertExpectations(t)
+
+	numReplayed := 0
+	for _, call := range destination.mockSns.Calls {
+		attributes := call.Arguments.Get(0).(*sns.PublishInput).MessageAttributes
+		assert.Equal(t, testLogType, aws.StringValue(attributes[notify.LogTypeAttributeName].StringValue))
+		if replay, ok := attributes[notify.ReplayAttributeName]; ok {
+			assert.Equal(t, "true", aws.StringValue(replay.StringValue))
+			numReplayed++
+		}
+	}
+	assert.Equal(t, 1, numReplayed)
+}
+
 func TestSendDataToS3FromSameHourBeforeTerminating(t *testing.T) {
 	t.Parallel()
 
@@ -522,6 +556,30 @@ func TestSendDataToCloudSecurity(t *testing.T) {
 	assert.Equal(t, expectedMessageAttributes, publishInput.MessageAttributes)
 }
 
+func TestSendDataSigned(t *testing.T) {
+	t.Parallel()
+
+	key := notify.SigningKey{Version: "v1", Secret: []byte("secret")}
+	destination := mockDestination()
+	destination.signer = &notify.Signer{Key: key}
+
+	eventChannel := make(chan *parsers.Result, 1)
+	eventChannel <- newSimpleTestEvent().Result()
+	close(eventChannel)
+
+	destination.mockS3Uploader.On("Upload", mock.Anything, mock.Anything).Return(&s3manager.UploadOutput{}, nil).Once()
+	destination.mockSns.On("Publish", mock.Anything).Return(&sns.PublishOutput{}, nil).Once()
+
+	assert.NoError(t, runDestination(destination, eventChannel))
+	destination.mockSns.AssertExpectations(t)
+
+	publishInput := destination.mockSns.Calls[0].Arguments.Get(0).(*sns.PublishInput)
+	signature := publishInput.MessageAttributes[notify.SignatureAttributeName]
+	require.NotNil(t, signature)
+	verifier := &notify.Verifier{Keys: []notify.SigningKey{key}}
+	assert.NoError(t, verifier.Verify(aws.StringValue(publishInput.Message), aws.StringValue(signature.StringValue)))
+}
+
 // Runs the destination "SendEvents" function in a goroutine and returns the errors
 // reported by it
 func runDestination(destination Destination, events chan *parsers.Result) error {
@@ -35,6 +35,9 @@ type Result struct {
 	// to avoid duplicate panther fields in resulting JSON.
 	// FIXME: Remove this field once all parsers are ported to the new method.
 	EventIncludesPantherFields bool
+	// Replay is set on the results of replayed (back-filled) data, it is not part of the event JSON.
+	// The destination sends the notifications of replayed results with the notify.ReplayAttributeName hint.
+	Replay bool
 	// Collected indicator values for this result.
 	// This field is normally nil throughout the lifetime of results.
 	// It is populated temporarily by the custom jsoniter encoder for *Result to collect all indicator field values.
@@ -231,6 +231,7 @@ func (p *Processor) processLogLine(ctx context.Context, line string, outputChan
 		return
 	}
 	for _, event := range result.Events {
+		event.Replay = p.input.Replay
 		select {
 		case outputChan <- event:
 		case <-ctx.Done():
@@ -131,6 +131,39 @@ func TestProcess(t *testing.T) {
 	assert.True(t, dataStream.Closer.(*dummyCloser).closed)
 }
 
+func TestProcessReplay(t *testing.T) {
+	var numReplayed uint64
+	destination := &testDestination{}
+	destination.On("SendEvents", mock.Anything, mock.Anything).Return().Run(func(args mock.Arguments) {
+		for result := range args.Get(0).(chan *parsers.Result) {
+			if result.Replay {
+				numReplayed++
+			}
+		}
+	})
+
+	dataStream := makeDataStream()
+	dataStream.Replay = true
+	p, err := NewFactory(testResolver)(dataStream)
+	require.NoError(t, err)
+	mockClassifier := &testClassifier{}
+	mockClassifier.On("Classify", mock.Anything).Return(&classification.ClassifierResult{
+		Events:  []*parsers.Result{newTestLog()},
+		Matched: true,
+	}, nil)
+	mockClassifier.On("Stats", mock.Anything).Return(&classification.ClassifierStats{})
+	mockClassifier.On("ParserStats", mock.Anything).Return(map[string]*classification.ParserStats{})
+	p.classifier = mockClassifier
+
+	streamChan := make(chan *common.DataStream, 1)
+	streamChan <- dataStream
+	close(streamChan)
+	err = Process(context.Background(), streamChan, destination, func(*common.DataStream) (*Processor, error) { return p, nil })
+	require.NoError(t, err)
+	// the results of a replayed stream are marked for the destination
+	assert.Equal(t, testLogLines, numReplayed)
+}
+
 func TestProcessDataStreamError(t *testing.T) {
 	logs := mockLogger()
 
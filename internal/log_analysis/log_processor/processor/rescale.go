@@ -147,10 +147,12 @@ func processingScaleUp(ctx context.Context, lambdaClient lambdaiface.LambdaAPI,
 			Payload:        []byte(`{"tick": true}`),
 			InvocationType: box.String(lambda.InvocationTypeEvent), // don't wait for response
 		})
-		if err != nil && !awsutils.IsAnyError(err, request.CanceledErrorCode) {
-			zap.L().Error("scaling up failed to invoke log processor",
-				zap.Error(errors.WithStack(err)))
-			return
+		if err != nil {
+			if !awsutils.IsAnyError(err, request.CanceledErrorCode) {
+				zap.L().Error("scaling up failed to invoke log processor",
+					zap.Error(errors.WithStack(err)))
+			}
+			return // the output of a failed invocation is not read, it can be nil
 		}
 		if resp.FunctionError != nil {
 			zap.L().Error("scaling up failed to invoke log processor",
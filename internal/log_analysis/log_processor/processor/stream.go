@@ -22,6 +22,7 @@ import (
 	"context"
 	"io"
 	"runtime"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -36,6 +37,7 @@ import (
 	"github.com/panther-labs/panther/internal/log_analysis/log_processor/destinations"
 	"github.com/panther-labs/panther/internal/log_analysis/log_processor/logtypes"
 	"github.com/panther-labs/panther/internal/log_analysis/log_processor/sources"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
 	"github.com/panther-labs/panther/pkg/awsbatch/sqsbatch"
 	"github.com/panther-labs/panther/pkg/awsutils"
 )
@@ -143,6 +145,8 @@ func pollEvents(
 				}
 
 				for _, s := range dataStreams {
+					// the hint of a message sent to the queue directly, SNS notifications carry it in their envelope
+					s.Replay = s.Replay || isReplay(msg)
 					select {
 					case streamChan <- s:
 					case <-ctx.Done():
@@ -186,6 +190,8 @@ func receiveFromSqs(ctx context.Context, sqsClient sqsiface.SQSAPI) ([]*sqs.Mess
 		WaitTimeSeconds:     aws.Int64(0),
 		MaxNumberOfMessages: aws.Int64(common.Config.SqsBatchSize),
 		QueueUrl:            &common.Config.SqsQueueURL,
+		// back-fills sending to the queue directly mark the messages of replayed data
+		MessageAttributeNames: aws.StringSlice([]string{notify.ReplayAttributeName}),
 	}
 	output, err := sqsClient.ReceiveMessageWithContext(ctx, input)
 
@@ -197,6 +203,16 @@ func receiveFromSqs(ctx context.Context, sqsClient sqsiface.SQSAPI) ([]*sqs.Mess
 	return output.Messages, nil
 }
 
+// isReplay checks if a message has the replay hint of back-fills
+func isReplay(msg *sqs.Message) bool {
+	attribute, ok := msg.MessageAttributes[notify.ReplayAttributeName]
+	if !ok {
+		return false
+	}
+	replay, _ := strconv.ParseBool(aws.StringValue(attribute.StringValue))
+	return replay
+}
+
 func kickOffReaders(ctx context.Context, streams []*common.DataStream) error {
 	grp, _ := errgroup.WithContext(ctx)
 	for _, s := range streams {
@@ -36,6 +36,7 @@ import (
 
 	"github.com/panther-labs/panther/internal/log_analysis/log_processor/common"
 	"github.com/panther-labs/panther/internal/log_analysis/log_processor/destinations"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
 	"github.com/panther-labs/panther/pkg/testutils"
 )
 
@@ -76,6 +77,47 @@ func TestStreamEvents(t *testing.T) {
 	sqsMock.AssertExpectations(t)
 }
 
+func TestStreamEventsReplay(t *testing.T) {
+	t.Parallel()
+	sqsMock := &testutils.SqsMock{}
+	sqsMock.On("ReceiveMessageWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return(&sqs.ReceiveMessageOutput{Messages: []*sqs.Message{
+			{
+				Body:          aws.String("{}"),
+				ReceiptHandle: aws.String("replayed"),
+				MessageAttributes: map[string]*sqs.MessageAttributeValue{
+					notify.ReplayAttributeName: {DataType: aws.String("String"), StringValue: aws.String("true")},
+				},
+			},
+			{
+				Body:          aws.String("{}"),
+				ReceiptHandle: aws.String("live"),
+			},
+		}}, nil).Once()
+	sqsMock.On("ReceiveMessageWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return(&sqs.ReceiveMessageOutput{}, nil).Once()
+	sqsMock.On("DeleteMessageBatch", mock.Anything).
+		Return(&sqs.DeleteMessageBatchOutput{}, nil).Once()
+
+	var replays []bool
+	processFunc := func(streamChan <-chan *common.DataStream, _ destinations.Destination) error {
+		for stream := range streamChan {
+			replays = append(replays, stream.Replay)
+		}
+		return nil
+	}
+	ctx, cancel := testContext()
+	defer cancel()
+	count, err := pollEvents(ctx, sqsMock, processFunc, noopGenerateDataStream)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, []bool{true, false}, replays)
+
+	sqsMock.AssertExpectations(t)
+	input := sqsMock.Calls[0].Arguments.Get(1).(*sqs.ReceiveMessageInput)
+	assert.Equal(t, []string{notify.ReplayAttributeName}, aws.StringValueSlice(input.MessageAttributeNames))
+}
+
 func TestStreamEventsProcessingTimeLimitExceeded(t *testing.T) {
 	t.Parallel()
 	sqsMock := &testutils.SqsMock{}
@@ -20,7 +20,6 @@ package sources
 
 import (
 	"context"
-	"net/url"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -36,6 +35,7 @@ import (
 	"github.com/panther-labs/panther/internal/log_analysis/log_processor/common"
 	"github.com/panther-labs/panther/internal/log_analysis/log_processor/processor/logstream"
 	"github.com/panther-labs/panther/internal/log_analysis/log_processor/s3pipe"
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
 )
 
 const (
@@ -102,6 +102,8 @@ func handleNotificationMessage(ctx context.Context, notification *SnsNotificatio
 	if err != nil {
 		return nil, err
 	}
+	// back-fills mark the notifications of replayed data
+	replay := notify.ParseSNSEntityAttributes(notification.MessageAttributes).Replay
 	for _, s3Object := range s3Objects {
 		if shouldIgnoreS3Object(s3Object) {
 			continue
@@ -112,6 +114,7 @@ func handleNotificationMessage(ctx context.Context, notification *SnsNotificatio
 			return
 		}
 		if dataStream != nil {
+			dataStream.Replay = replay
 			result = append(result, dataStream)
 		}
 	}
@@ -232,7 +235,8 @@ func parseS3Event(message string) (result []*S3ObjectInfo) {
 		return nil
 	}
 	for _, record := range notification.Records {
-		urlDecodedKey, err := url.PathUnescape(record.S3.Object.Key)
+		// S3 encodes keys as form values, e.g. spaces are +
+		urlDecodedKey, err := notify.DecodeObjectKey(record.S3.Object.Key)
 		if err != nil {
 			return nil
 		}
@@ -0,0 +1,128 @@
+package notify
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+
+	"github.com/aws/aws-lambda-go/events"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+var (
+	batchPrefix    = []byte(`{"Records":[`)
+	batchSeparator = []byte(`,`)
+	batchSuffix    = []byte(`]}`)
+)
+
+// NotificationBatch is a marshalled S3Notification and the records it contains
+type NotificationBatch struct {
+	Payload []byte
+	Records []events.S3EventRecord
+}
+
+// Batcher packs S3 event records into the largest S3Notification payloads that fit the limits.
+// Records are never re-ordered. It is not safe for concurrent use.
+type Batcher struct {
+	maxRecords int
+	maxBytes   int
+	records    []events.S3EventRecord
+	buffer     bytes.Buffer // the payload of the pending records without the suffix
+}
+
+// NewBatcher returns a Batcher creating payloads of at most maxRecords records and maxBytes bytes
+func NewBatcher(maxRecords, maxBytes int) *Batcher {
+	if maxRecords < 1 {
+		maxRecords = 1
+	}
+	return &Batcher{
+		maxRecords: maxRecords,
+		maxBytes:   maxBytes,
+	}
+}
+
+// Add adds a record, returning the pending batch if it is complete because the record did not fit in it.
+// A record that does not fit in a payload on its own is an error.
+func (b *Batcher) Add(record events.S3EventRecord) (*NotificationBatch, error) {
+	recordJSON, err := jsoniter.Marshal(&record)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal record")
+	}
+	if len(batchPrefix)+len(recordJSON)+len(batchSuffix) > b.maxBytes {
+		return nil, errors.Errorf("record for s3://%s/%s is %d bytes which exceeds the %d byte limit",
+			record.S3.Bucket.Name, record.S3.Object.Key, len(recordJSON), b.maxBytes)
+	}
+
+	var full *NotificationBatch
+	if len(b.records) > 0 {
+		size := b.buffer.Len() + len(batchSeparator) + len(recordJSON) + len(batchSuffix)
+		if len(b.records) == b.maxRecords || size > b.maxBytes {
+			full = b.Flush()
+		}
+	}
+
+	if len(b.records) == 0 {
+		b.buffer.Write(batchPrefix)
+	} else {
+		b.buffer.Write(batchSeparator)
+	}
+	b.buffer.Write(recordJSON)
+	b.records = append(b.records, record)
+	return full, nil
+}
+
+// Flush returns the pending batch (nil if there are no pending records) and resets the Batcher
+func (b *Batcher) Flush() *NotificationBatch {
+	if len(b.records) == 0 {
+		return nil
+	}
+	b.buffer.Write(batchSuffix)
+	batch := &NotificationBatch{
+		Payload: append([]byte(nil), b.buffer.Bytes()...),
+		Records: b.records,
+	}
+	b.buffer.Reset()
+	b.records = nil
+	return batch
+}
+
+// Len returns the number of pending records
+func (b *Batcher) Len() int {
+	return len(b.records)
+}
+
+// BatchRecords packs all records into payloads
+func BatchRecords(records []events.S3EventRecord, maxRecords, maxBytes int) ([]*NotificationBatch, error) {
+	batcher := NewBatcher(maxRecords, maxBytes)
+	var batches []*NotificationBatch
+	for _, record := range records {
+		batch, err := batcher.Add(record)
+		if err != nil {
+			return nil, err
+		}
+		if batch != nil {
+			batches = append(batches, batch)
+		}
+	}
+	if batch := batcher.Flush(); batch != nil {
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
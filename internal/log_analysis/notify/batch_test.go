@@ -0,0 +1,121 @@
+package notify
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRecords(n int) (records []events.S3EventRecord) {
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("logs/table/year=2020/month=01/day=01/hour=00/file-%d.json.gz", i)
+		records = append(records, NewS3ObjectPutNotification("bucket", key, 1).Records...)
+	}
+	return records
+}
+
+func marshalNotification(t *testing.T, records []events.S3EventRecord) []byte {
+	payload, err := jsoniter.Marshal(&S3Notification{Records: records})
+	require.NoError(t, err)
+	return payload
+}
+
+func TestBatcherPayloadMatchesMarshalledNotification(t *testing.T) {
+	records := testRecords(3)
+	batches, err := BatchRecords(records, 10, 256*1024)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	assert.Equal(t, string(marshalNotification(t, records)), string(batches[0].Payload))
+	assert.Equal(t, records, batches[0].Records)
+
+	// must parse back
+	var notification S3Notification
+	require.NoError(t, jsoniter.Unmarshal(batches[0].Payload, &notification))
+	assert.Equal(t, records, notification.Records)
+}
+
+func TestBatcherMaxRecords(t *testing.T) {
+	records := testRecords(7)
+	batches, err := BatchRecords(records, 3, 256*1024)
+	require.NoError(t, err)
+	require.Len(t, batches, 3)
+	assert.Equal(t, records[0:3], batches[0].Records)
+	assert.Equal(t, records[3:6], batches[1].Records)
+	assert.Equal(t, records[6:], batches[2].Records)
+	for _, batch := range batches {
+		assert.Equal(t, string(marshalNotification(t, batch.Records)), string(batch.Payload))
+	}
+}
+
+func TestBatcherExactByteLimit(t *testing.T) {
+	records := testRecords(3)
+	twoRecordsSize := len(marshalNotification(t, records[:2]))
+
+	// exactly fits 2 records
+	batches, err := BatchRecords(records, 10, twoRecordsSize)
+	require.NoError(t, err)
+	require.Len(t, batches, 2)
+	assert.Equal(t, records[:2], batches[0].Records)
+	assert.Len(t, batches[0].Payload, twoRecordsSize)
+	assert.Equal(t, records[2:], batches[1].Records)
+
+	// one byte less and only 1 record fits per payload
+	batches, err = BatchRecords(records, 10, twoRecordsSize-1)
+	require.NoError(t, err)
+	require.Len(t, batches, 3)
+	for i, batch := range batches {
+		assert.Equal(t, records[i:i+1], batch.Records)
+		assert.LessOrEqual(t, len(batch.Payload), twoRecordsSize-1)
+	}
+}
+
+func TestBatcherRecordTooLarge(t *testing.T) {
+	records := testRecords(1)
+	size := len(marshalNotification(t, records))
+
+	batches, err := BatchRecords(records, 10, size)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+
+	_, err = BatchRecords(records, 10, size-1)
+	require.Error(t, err)
+}
+
+func TestBatcherFlush(t *testing.T) {
+	batcher := NewBatcher(10, 256*1024)
+	assert.Nil(t, batcher.Flush())
+	records := testRecords(2)
+	for _, record := range records {
+		batch, err := batcher.Add(record)
+		require.NoError(t, err)
+		assert.Nil(t, batch)
+	}
+	assert.Equal(t, 2, batcher.Len())
+	batch := batcher.Flush()
+	require.NotNil(t, batch)
+	assert.Equal(t, records, batch.Records)
+	assert.Equal(t, 0, batcher.Len())
+	assert.Nil(t, batcher.Flush())
+}
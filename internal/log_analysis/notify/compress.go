@@ -0,0 +1,112 @@
+package notify
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ContentEncodingGzip marks envelopes with a gzip compressed, base64 encoded payload
+	ContentEncodingGzip = "gzip"
+
+	// SchemaVersionCompressed is the schema version attribute value of messages with a compressed envelope
+	SchemaVersionCompressed = "2"
+
+	// maxDecompressedBytes guards ParseNotification against decompression bombs
+	maxDecompressedBytes = 16 * 1024 * 1024
+)
+
+// compressedEnvelope wraps a compressed notification payload
+type compressedEnvelope struct {
+	ContentEncoding string `json:"contentEncoding"`
+	Payload         string `json:"payload"`
+}
+
+// CompressNotification wraps the payload in a compressed envelope if it is larger than threshold bytes,
+// otherwise the payload is returned as is. Publishers using it must mark compressed messages
+// with the SchemaVersionAttributeName attribute set to SchemaVersionCompressed, e.g. with SetSchemaVersion,
+// so subscribers can filter them.
+func CompressNotification(payload []byte, threshold int) (message []byte, compressed bool, err error) {
+	if len(payload) <= threshold {
+		return payload, false, nil
+	}
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err = writer.Write(payload); err != nil {
+		return nil, false, errors.Wrap(err, "failed to compress notification")
+	}
+	if err = writer.Close(); err != nil {
+		return nil, false, errors.Wrap(err, "failed to compress notification")
+	}
+	message, err = jsoniter.Marshal(&compressedEnvelope{
+		ContentEncoding: ContentEncodingGzip,
+		Payload:         base64.StdEncoding.EncodeToString(buffer.Bytes()),
+	})
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to marshal compressed notification")
+	}
+	return message, true, nil
+}
+
+// ParseNotification parses a notification message, decompressing it if needed
+func ParseNotification(message []byte) (*S3Notification, error) {
+	var envelope struct {
+		compressedEnvelope
+		S3Notification
+	}
+	if err := jsoniter.Unmarshal(message, &envelope); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal notification")
+	}
+	switch envelope.ContentEncoding {
+	case "":
+		return &envelope.S3Notification, nil
+	case ContentEncodingGzip:
+	default:
+		return nil, errors.Errorf("unsupported notification content encoding %q", envelope.ContentEncoding)
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode compressed notification")
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress notification")
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(reader, maxDecompressedBytes+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress notification")
+	}
+	if len(payload) > maxDecompressedBytes {
+		return nil, errors.Errorf("decompressed notification exceeds %d bytes", maxDecompressedBytes)
+	}
+	notification := &S3Notification{}
+	if err := jsoniter.Unmarshal(payload, notification); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal decompressed notification")
+	}
+	return notification, nil
+}
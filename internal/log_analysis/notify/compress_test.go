@@ -0,0 +1,69 @@
+package notify
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strings"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressNotificationBelowThreshold(t *testing.T) {
+	payload, err := jsoniter.Marshal(NewS3ObjectPutNotification("bucket", "key", 1))
+	require.NoError(t, err)
+	message, compressed, err := CompressNotification(payload, len(payload))
+	require.NoError(t, err)
+	assert.False(t, compressed)
+	assert.Equal(t, payload, message)
+
+	notification, err := ParseNotification(message)
+	require.NoError(t, err)
+	assert.Equal(t, "key", notification.Records[0].S3.Object.Key)
+}
+
+func TestCompressNotification(t *testing.T) {
+	batches, err := BatchRecords(testRecords(100), 100, 1024*1024)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	payload := batches[0].Payload
+
+	message, compressed, err := CompressNotification(payload, len(payload)-1)
+	require.NoError(t, err)
+	assert.True(t, compressed)
+	assert.Less(t, len(message), len(payload))
+	assert.True(t, strings.HasPrefix(string(message), `{"contentEncoding":"gzip","payload":"`))
+
+	notification, err := ParseNotification(message)
+	require.NoError(t, err)
+	assert.Equal(t, batches[0].Records, notification.Records)
+}
+
+func TestParseNotificationErrors(t *testing.T) {
+	_, err := ParseNotification([]byte(`not json`))
+	assert.Error(t, err)
+	_, err = ParseNotification([]byte(`{"contentEncoding":"br","payload":""}`))
+	assert.Error(t, err)
+	_, err = ParseNotification([]byte(`{"contentEncoding":"gzip","payload":"not base64!"}`))
+	assert.Error(t, err)
+	_, err = ParseNotification([]byte(`{"contentEncoding":"gzip","payload":"bm90IGd6aXA="}`)) // "not gzip"
+	assert.Error(t, err)
+}
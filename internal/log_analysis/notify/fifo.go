@@ -0,0 +1,101 @@
+package notify
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const maxFIFOIDLength = 128
+
+// DeduplicationID returns a stable id for the notification of an object suitable for use
+// as an SNS/SQS FIFO MessageDeduplicationId (at most 128 characters).
+// NOTE: the ids are persisted by consumers, changing how they are computed defeats deduplication!
+func DeduplicationID(bucket, key, versionID string) string {
+	// NUL cannot appear in bucket names or keys so the fields cannot run into each other
+	sum := sha256.Sum256([]byte(bucket + "\x00" + key + "\x00" + versionID))
+	return hex.EncodeToString(sum[:])
+}
+
+// RecordDeduplicationID returns the DeduplicationID of the object of a record. Objects of unversioned buckets
+// are told apart by their ETag, so that an object written again is not deduplicated.
+func RecordDeduplicationID(record *events.S3EventRecord) string {
+	version := record.S3.Object.VersionID
+	if version == "" {
+		version = record.S3.Object.ETag
+	}
+	return DeduplicationID(record.S3.Bucket.Name, record.S3.Object.Key, version)
+}
+
+// EventDeduplicationID returns the deduplication id of a notification, the RecordDeduplicationID of its record
+// or, for notifications packing several records, a hash of the ids of its records.
+func EventDeduplicationID(event *events.S3Event) string {
+	if len(event.Records) == 1 {
+		return RecordDeduplicationID(&event.Records[0])
+	}
+	hash := sha256.New()
+	for i := range event.Records {
+		_, _ = hash.Write([]byte(RecordDeduplicationID(&event.Records[i])))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// MessageGroupID returns the FIFO MessageGroupId for the notification of an object.
+// Objects are grouped by the table segment of Panther keys (e.g., logs/<table>/year=...),
+// keys that do not follow that layout are grouped by bucket.
+func MessageGroupID(bucket, key string) string {
+	// the first segment is the database prefix, the second the table name
+	segments := strings.SplitN(key, "/", 3)
+	if len(segments) == 3 && segments[0] != "" && segments[1] != "" && len(segments[1]) <= maxFIFOIDLength {
+		return segments[1]
+	}
+	return bucket
+}
+
+// PrefixMessageGroupID returns the FIFO MessageGroupId grouping the objects of a bucket by the top-level prefix
+// of their keys, e.g. bucket/AWSLogs. The objects at the root of a bucket are grouped by bucket.
+func PrefixMessageGroupID(bucket, key string) string {
+	if pos := strings.IndexByte(key, '/'); pos > 0 {
+		return validMessageGroupID(bucket + "/" + key[:pos])
+	}
+	return validMessageGroupID(bucket)
+}
+
+// BucketMessageGroupID returns the FIFO MessageGroupId grouping the objects by bucket
+func BucketMessageGroupID(bucket, _ string) string {
+	return validMessageGroupID(bucket)
+}
+
+// validMessageGroupID returns a valid message group id, at most 128 characters of ASCII letters, digits and punctuation
+func validMessageGroupID(id string) string {
+	valid := []byte(id)
+	for i, c := range valid {
+		if c < '!' || c > '~' {
+			valid[i] = '_'
+		}
+	}
+	if len(valid) > maxFIFOIDLength {
+		valid = valid[:maxFIFOIDLength]
+	}
+	return string(valid)
+}
@@ -0,0 +1,89 @@
+package notify
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPantherKey = "logs/aws_cloudtrail/year=2020/month=11/day=01/hour=00/20201101T000000Z-abc.json.gz"
+
+// These are golden values, if this test fails the ids changed which will break deduplication for consumers!
+func TestDeduplicationID(t *testing.T) {
+	assert.Equal(t, "59974f58766dd1de3daafa654634ce8a8095920e9197ee6fab15ce1ebfa541a0",
+		DeduplicationID("panther-processed-data", testPantherKey, ""))
+	assert.Equal(t, "27db1cd434ba359cef983a313b3372ad2cff34420c3eea31d27df7f63fe5b15b",
+		DeduplicationID("panther-processed-data", testPantherKey, "3HL4kqtJlcpXroDTDmJ"))
+	assert.Equal(t, "e11cf603c31a575635e38fd5b9db03a8d1a620c1813c775ae897753b595dde59",
+		DeduplicationID("bucket", "key", ""))
+}
+
+func TestDeduplicationIDLength(t *testing.T) {
+	id := DeduplicationID("bucket", strings.Repeat("k", 1024), strings.Repeat("v", 1024))
+	assert.LessOrEqual(t, len(id), 128)
+}
+
+func TestDeduplicationIDFieldsDoNotRunTogether(t *testing.T) {
+	assert.NotEqual(t, DeduplicationID("bucket", "key", ""), DeduplicationID("bucketk", "ey", ""))
+	assert.NotEqual(t, DeduplicationID("bucket", "key", ""), DeduplicationID("bucket", "", "key"))
+}
+
+func TestMessageGroupID(t *testing.T) {
+	assert.Equal(t, "aws_cloudtrail", MessageGroupID("bucket", testPantherKey))
+	assert.Equal(t, "aws_cloudtrail", MessageGroupID("bucket", "rules/aws_cloudtrail/year=2020/file.json.gz"))
+	// no table segment
+	assert.Equal(t, "bucket", MessageGroupID("bucket", "file.json.gz"))
+	assert.Equal(t, "bucket", MessageGroupID("bucket", "logs/file.json.gz"))
+	assert.Equal(t, "bucket", MessageGroupID("bucket", "logs//file.json.gz"))
+	assert.Equal(t, "bucket", MessageGroupID("bucket", ""))
+}
+
+func TestRecordDeduplicationID(t *testing.T) {
+	record := events.S3EventRecord{}
+	record.S3.Bucket.Name, record.S3.Object.Key = "bucket", "key"
+	assert.Equal(t, DeduplicationID("bucket", "key", ""), RecordDeduplicationID(&record))
+	// unversioned objects written again differ by their ETag
+	record.S3.Object.ETag = "etag"
+	assert.Equal(t, DeduplicationID("bucket", "key", "etag"), RecordDeduplicationID(&record))
+	record.S3.Object.VersionID = "version"
+	assert.Equal(t, DeduplicationID("bucket", "key", "version"), RecordDeduplicationID(&record))
+}
+
+func TestEventDeduplicationID(t *testing.T) {
+	first, second := events.S3EventRecord{}, events.S3EventRecord{}
+	first.S3.Bucket.Name, first.S3.Object.Key = "bucket", "a"
+	second.S3.Bucket.Name, second.S3.Object.Key = "bucket", "b"
+	// a notification of one object has the id of the object, whatever path it is sent by
+	assert.Equal(t, RecordDeduplicationID(&first), EventDeduplicationID(&events.S3Event{Records: []events.S3EventRecord{first}}))
+	packed := EventDeduplicationID(&events.S3Event{Records: []events.S3EventRecord{first, second}})
+	assert.Len(t, packed, 64)
+	assert.NotEqual(t, packed, EventDeduplicationID(&events.S3Event{Records: []events.S3EventRecord{second, first}}))
+}
+
+func TestPrefixMessageGroupID(t *testing.T) {
+	assert.Equal(t, "bucket/logs", PrefixMessageGroupID("bucket", "logs/aws_cloudtrail/file.gz"))
+	assert.Equal(t, "bucket", PrefixMessageGroupID("bucket", "/file.gz"))
+	assert.Equal(t, "bucket/my_logs", PrefixMessageGroupID("bucket", "my logs/file.gz"))
+	assert.Len(t, PrefixMessageGroupID("bucket", strings.Repeat("k", 200)+"/file.gz"), 128)
+	assert.Equal(t, "bucket", BucketMessageGroupID("bucket", "logs/file.gz"))
+}
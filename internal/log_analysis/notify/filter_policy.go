@@ -0,0 +1,151 @@
+package notify
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"sort"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+)
+
+// dataTypes are all the values of the data type attribute
+var dataTypes = []pantherdb.DataType{
+	pantherdb.LogData,
+	pantherdb.RuleData,
+	pantherdb.RuleErrors,
+	pantherdb.CloudSecurity,
+}
+
+// NewFilterPolicy returns an SNS subscription filter policy document matching notifications for
+// the given data types and log types. Empty lists do not filter on the corresponding attribute.
+// See https://docs.aws.amazon.com/sns/latest/dg/sns-subscription-filter-policies.html
+func NewFilterPolicy(types []pantherdb.DataType, logTypes []string) (string, error) {
+	policy := make(map[string][]string)
+	for _, dataType := range types {
+		if !isDataType(string(dataType)) {
+			return "", errors.Errorf("unknown data type %q", dataType)
+		}
+		policy[DataTypeAttributeName] = append(policy[DataTypeAttributeName], string(dataType))
+	}
+	for _, logType := range logTypes {
+		if logType == "" {
+			return "", errors.New("empty log type")
+		}
+		policy[LogTypeAttributeName] = append(policy[LogTypeAttributeName], logType)
+	}
+	if len(policy) == 0 {
+		return "", errors.New("filter policy must filter on at least one attribute")
+	}
+	for _, values := range policy {
+		sort.Strings(values) // make the document stable
+	}
+	return jsoniter.MarshalToString(policy)
+}
+
+// ValidateFilterPolicy checks an SNS subscription filter policy against the attributes set on notifications
+// and returns an error describing each attribute or value that can never match.
+// If knownLogTypes is empty, the values of the log type attribute are not checked.
+func ValidateFilterPolicy(policy string, knownLogTypes []string) (err error) {
+	var document map[string][]interface{}
+	if err := jsoniter.UnmarshalFromString(policy, &document); err != nil {
+		return errors.Wrap(err, "invalid filter policy")
+	}
+	// sort to report issues in a stable order
+	attributes := make([]string, 0, len(document))
+	for attribute := range document {
+		attributes = append(attributes, attribute)
+	}
+	sort.Strings(attributes)
+	for _, attribute := range attributes {
+		var vocabulary []string
+		switch attribute {
+		case DataTypeAttributeName:
+			for _, dataType := range dataTypes {
+				vocabulary = append(vocabulary, string(dataType))
+			}
+		case LogTypeAttributeName:
+			vocabulary = knownLogTypes
+		case SchemaVersionAttributeName:
+			vocabulary = []string{SchemaVersionCompressed}
+		case ReplayAttributeName:
+			vocabulary = []string{"true"}
+		case OriginalEventTimeAttributeName, BackfillRunIDAttributeName, SignatureAttributeName:
+			vocabulary = nil // any value
+		default:
+			err = multierr.Append(err, errors.Errorf("attribute %q is never set on notifications", attribute))
+			continue
+		}
+		for _, value := range document[attribute] {
+			if !canMatch(value, vocabulary) {
+				err = multierr.Append(err, errors.Errorf("attribute %q value %v can never match", attribute, value))
+			}
+		}
+	}
+	return err
+}
+
+// canMatch checks if a filter policy value could match any of the vocabulary, an empty vocabulary matches anything
+func canMatch(value interface{}, vocabulary []string) bool {
+	switch value := value.(type) {
+	case string:
+		return len(vocabulary) == 0 || contains(vocabulary, value)
+	case map[string]interface{}:
+		// https://docs.aws.amazon.com/sns/latest/dg/sns-subscription-filter-policies.html#attribute-key-matching
+		if prefix, ok := value["prefix"].(string); ok {
+			if len(vocabulary) == 0 {
+				return true
+			}
+			for _, word := range vocabulary {
+				if strings.HasPrefix(word, prefix) {
+					return true
+				}
+			}
+			return false
+		}
+		if _, ok := value["numeric"]; ok { // all attributes are strings
+			return false
+		}
+		return true // other operators (e.g., anything-but, exists) can match strings
+	default: // numbers, booleans and null never match string attributes
+		return false
+	}
+}
+
+func isDataType(value string) bool {
+	for _, dataType := range dataTypes {
+		if string(dataType) == value {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
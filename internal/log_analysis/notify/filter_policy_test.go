@@ -0,0 +1,75 @@
+package notify
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+)
+
+func TestNewFilterPolicy(t *testing.T) {
+	policy, err := NewFilterPolicy([]pantherdb.DataType{pantherdb.LogData}, []string{"AWS.VPCFlow", "AWS.CloudTrail"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":["LogData"],"id":["AWS.CloudTrail","AWS.VPCFlow"]}`, policy)
+	require.NoError(t, ValidateFilterPolicy(policy, []string{"AWS.CloudTrail", "AWS.VPCFlow"}))
+
+	policy, err = NewFilterPolicy([]pantherdb.DataType{pantherdb.RuleData, pantherdb.RuleErrors}, nil)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":["RuleErrors","RuleMatches"]}`, policy)
+}
+
+func TestNewFilterPolicyErrors(t *testing.T) {
+	_, err := NewFilterPolicy(nil, nil)
+	assert.Error(t, err)
+	_, err = NewFilterPolicy([]pantherdb.DataType{"LogDatas"}, nil)
+	assert.Error(t, err)
+	_, err = NewFilterPolicy(nil, []string{""})
+	assert.Error(t, err)
+}
+
+func TestValidateFilterPolicy(t *testing.T) {
+	knownLogTypes := []string{"AWS.CloudTrail", "AWS.VPCFlow"}
+	// the policies used in our deployments
+	assert.NoError(t, ValidateFilterPolicy(`{"type":["LogData","RuleMatches","RuleErrors","CloudSecurity"]}`, knownLogTypes))
+	assert.NoError(t, ValidateFilterPolicy(`{"type":["LogData"],"id":["AWS.CloudTrail"]}`, knownLogTypes))
+	// operators
+	assert.NoError(t, ValidateFilterPolicy(`{"id":[{"prefix":"AWS."}]}`, knownLogTypes))
+	assert.NoError(t, ValidateFilterPolicy(`{"id":[{"anything-but":"AWS.VPCFlow"}]}`, knownLogTypes))
+	// unknown log types are not checked without a vocabulary
+	assert.NoError(t, ValidateFilterPolicy(`{"id":["Custom.Foo"]}`, nil))
+
+	assert.Error(t, ValidateFilterPolicy(`not json`, knownLogTypes))
+	assert.Error(t, ValidateFilterPolicy(`{"types":["LogData"]}`, knownLogTypes))
+	assert.Error(t, ValidateFilterPolicy(`{"type":["logdata"]}`, knownLogTypes))
+	assert.Error(t, ValidateFilterPolicy(`{"type":[1]}`, knownLogTypes))
+	assert.Error(t, ValidateFilterPolicy(`{"id":["AWS.Cloudtrail"]}`, knownLogTypes))
+	assert.Error(t, ValidateFilterPolicy(`{"id":[{"prefix":"GCP."}]}`, knownLogTypes))
+	assert.Error(t, ValidateFilterPolicy(`{"id":[{"numeric":["=",1]}]}`, knownLogTypes))
+}
+
+func TestValidateFilterPolicyReportsAllIssues(t *testing.T) {
+	err := ValidateFilterPolicy(`{"typo":["LogData"],"type":["LogData","Bad"]}`, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `attribute "typo" is never set`)
+	assert.Contains(t, err.Error(), `attribute "type" value Bad can never match`)
+}
@@ -0,0 +1,119 @@
+package notify
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// Processing hint attributes are optional, they are only set on notifications for replayed (back-filled) data
+const (
+	// ReplayAttributeName is set to "true" on notifications for replayed data
+	ReplayAttributeName = "panther.replay"
+	// OriginalEventTimeAttributeName is the time (RFC3339) the replayed data was originally written
+	OriginalEventTimeAttributeName = "panther.original-event-time"
+	// BackfillRunIDAttributeName identifies the back-fill run that sent the notification
+	BackfillRunIDAttributeName = "panther.backfill-run-id"
+)
+
+// ReplayHints allow downstream components to treat replayed data differently (e.g., not alert on old events)
+type ReplayHints struct {
+	Replay            bool
+	OriginalEventTime time.Time
+	BackfillRunID     string
+}
+
+// StringAttributes returns the hints as message attribute values, hints that are not set are omitted
+func (hints *ReplayHints) StringAttributes() map[string]string {
+	attributes := make(map[string]string)
+	if hints.Replay {
+		attributes[ReplayAttributeName] = strconv.FormatBool(hints.Replay)
+	}
+	if !hints.OriginalEventTime.IsZero() {
+		attributes[OriginalEventTimeAttributeName] = hints.OriginalEventTime.UTC().Format(time.RFC3339)
+	}
+	if hints.BackfillRunID != "" {
+		attributes[BackfillRunIDAttributeName] = hints.BackfillRunID
+	}
+	return attributes
+}
+
+// SetReplayHints adds the hints to the attributes of an SNS message
+func SetReplayHints(attributes map[string]*sns.MessageAttributeValue, hints *ReplayHints) {
+	for name, value := range hints.StringAttributes() {
+		value := value
+		attributes[name] = &sns.MessageAttributeValue{
+			StringValue: &value,
+			DataType:    &messageAttributeDataType,
+		}
+	}
+}
+
+// MessageAttributes are the attributes of a notification as received by subscribers
+type MessageAttributes struct {
+	DataType      string
+	LogType       string
+	SchemaVersion string
+	// Signature is the signature of the message, see Verifier
+	Signature string
+	ReplayHints
+}
+
+// ParseSQSMessageAttributes reads the notification attributes of a message delivered to an SQS subscriber.
+// Attributes that are missing or malformed are left empty.
+func ParseSQSMessageAttributes(attributes map[string]events.SQSMessageAttribute) *MessageAttributes {
+	stringValue := func(name string) string {
+		if attribute, ok := attributes[name]; ok && attribute.StringValue != nil {
+			return *attribute.StringValue
+		}
+		return ""
+	}
+	return parseMessageAttributes(stringValue)
+}
+
+// ParseSNSEntityAttributes reads the notification attributes of an SNS envelope, as delivered to SQS subscribers
+// without raw message delivery. Attributes that are missing or malformed are left empty.
+func ParseSNSEntityAttributes(attributes map[string]interface{}) *MessageAttributes {
+	stringValue := func(name string) string {
+		// the envelope has the attributes as {"Type": "String", "Value": "..."}
+		if attribute, ok := attributes[name].(map[string]interface{}); ok {
+			value, _ := attribute["Value"].(string)
+			return value
+		}
+		return ""
+	}
+	return parseMessageAttributes(stringValue)
+}
+
+func parseMessageAttributes(stringValue func(name string) string) *MessageAttributes {
+	parsed := &MessageAttributes{
+		DataType:      stringValue(DataTypeAttributeName),
+		LogType:       stringValue(LogTypeAttributeName),
+		SchemaVersion: stringValue(SchemaVersionAttributeName),
+		Signature:     stringValue(SignatureAttributeName),
+	}
+	parsed.Replay, _ = strconv.ParseBool(stringValue(ReplayAttributeName))
+	parsed.OriginalEventTime, _ = time.Parse(time.RFC3339, stringValue(OriginalEventTimeAttributeName))
+	parsed.BackfillRunID = stringValue(BackfillRunIDAttributeName)
+	return parsed
+}
@@ -0,0 +1,118 @@
+package notify
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+)
+
+func TestReplayHints(t *testing.T) {
+	hints := &ReplayHints{
+		Replay:            true,
+		OriginalEventTime: time.Date(2020, 11, 1, 12, 30, 0, 0, time.UTC),
+		BackfillRunID:     "run",
+	}
+	attributes := NewLogAnalysisSNSMessageAttributes(pantherdb.LogData, "AWS.CloudTrail")
+	SetReplayHints(attributes, hints)
+	require.Len(t, attributes, 5)
+	assert.Equal(t, "true", aws.StringValue(attributes[ReplayAttributeName].StringValue))
+	assert.Equal(t, "2020-11-01T12:30:00Z", aws.StringValue(attributes[OriginalEventTimeAttributeName].StringValue))
+	assert.Equal(t, "run", aws.StringValue(attributes[BackfillRunIDAttributeName].StringValue))
+
+	// as delivered to an SQS subscriber
+	parsed := ParseSQSMessageAttributes(toSQSMessageAttributes(attributes))
+	assert.Equal(t, &MessageAttributes{
+		DataType:    "LogData",
+		LogType:     "AWS.CloudTrail",
+		ReplayHints: *hints,
+	}, parsed)
+}
+
+// SQS and SNS reject message attribute names outside of this charset
+var attributeNameCharset = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func TestValidAttributeNamesCharset(t *testing.T) {
+	for _, name := range ValidAttributeNames() {
+		assert.Regexp(t, attributeNameCharset, name)
+	}
+}
+
+func TestReplayHintsNotSet(t *testing.T) {
+	attributes := NewLogAnalysisSNSMessageAttributes(pantherdb.LogData, "AWS.CloudTrail")
+	SetReplayHints(attributes, &ReplayHints{})
+	require.Len(t, attributes, 2)
+
+	parsed := ParseSQSMessageAttributes(toSQSMessageAttributes(attributes))
+	assert.False(t, parsed.Replay)
+	assert.True(t, parsed.OriginalEventTime.IsZero())
+	assert.Empty(t, parsed.BackfillRunID)
+}
+
+func TestParseSQSMessageAttributesMalformed(t *testing.T) {
+	parsed := ParseSQSMessageAttributes(map[string]events.SQSMessageAttribute{
+		ReplayAttributeName:            {StringValue: aws.String("yes please")},
+		OriginalEventTimeAttributeName: {StringValue: aws.String("yesterday")},
+		LogTypeAttributeName:           {}, // no value
+	})
+	assert.Equal(t, &MessageAttributes{}, parsed)
+}
+
+func TestParseSNSEntityAttributes(t *testing.T) {
+	var entity events.SNSEntity
+	require.NoError(t, jsoniter.UnmarshalFromString(`{
+		"Type": "Notification",
+		"MessageAttributes": {
+			"id": {"Type": "String", "Value": "AWS.CloudTrail"},
+			"panther.replay": {"Type": "String", "Value": "true"},
+			"panther.backfill-run-id": {"Type": "String", "Value": "run"}
+		}
+	}`, &entity))
+	parsed := ParseSNSEntityAttributes(entity.MessageAttributes)
+	assert.Equal(t, &MessageAttributes{
+		LogType:     "AWS.CloudTrail",
+		ReplayHints: ReplayHints{Replay: true, BackfillRunID: "run"},
+	}, parsed)
+
+	assert.Equal(t, &MessageAttributes{}, ParseSNSEntityAttributes(nil))
+	assert.Equal(t, &MessageAttributes{}, ParseSNSEntityAttributes(map[string]interface{}{
+		ReplayAttributeName: "true", // not an attribute object
+	}))
+}
+
+func toSQSMessageAttributes(attributes map[string]*sns.MessageAttributeValue) map[string]events.SQSMessageAttribute {
+	sqsAttributes := make(map[string]events.SQSMessageAttribute)
+	for name, value := range attributes {
+		sqsAttributes[name] = events.SQSMessageAttribute{
+			StringValue: value.StringValue,
+			DataType:    aws.StringValue(value.DataType),
+		}
+	}
+	return sqsAttributes
+}
@@ -0,0 +1,95 @@
+package notifytest
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/notify"
+)
+
+// AssertValidAttributeNames parses the (non test) Go files in dir and fails if any string literal is used as a
+// key of something named MessageAttributes that is not one of notify.ValidAttributeNames().
+// Consumers of notifications call it from their tests to catch typos in attribute names.
+func AssertValidAttributeNames(t *testing.T, dir string) {
+	valid := make(map[string]bool)
+	for _, name := range notify.ValidAttributeNames() {
+		valid[name] = true
+	}
+
+	fileSet := token.NewFileSet()
+	notTests := func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}
+	packages, err := parser.ParseDir(fileSet, dir, notTests, 0)
+	require.NoError(t, err)
+
+	check := func(expr ast.Expr) {
+		literal, ok := expr.(*ast.BasicLit)
+		if !ok || literal.Kind != token.STRING {
+			return
+		}
+		name, err := strconv.Unquote(literal.Value)
+		require.NoError(t, err)
+		if !valid[name] {
+			t.Errorf("%s: unknown notification attribute name %q (valid names are %v)",
+				fileSet.Position(literal.Pos()), name, notify.ValidAttributeNames())
+		}
+	}
+	for _, pkg := range packages {
+		ast.Inspect(pkg, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.IndexExpr: // record.MessageAttributes["id"]
+				if isMessageAttributes(node.X) {
+					check(node.Index)
+				}
+			case *ast.KeyValueExpr: // MessageAttributes: map[string]*sns.MessageAttributeValue{"id": ...}
+				if isMessageAttributes(node.Key) {
+					if literal, ok := node.Value.(*ast.CompositeLit); ok {
+						for _, element := range literal.Elts {
+							if keyValue, ok := element.(*ast.KeyValueExpr); ok {
+								check(keyValue.Key)
+							}
+						}
+					}
+				}
+			}
+			return true
+		})
+	}
+}
+
+func isMessageAttributes(expr ast.Expr) bool {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return expr.Name == "MessageAttributes"
+	case *ast.SelectorExpr:
+		return expr.Sel.Name == "MessageAttributes"
+	default:
+		return false
+	}
+}
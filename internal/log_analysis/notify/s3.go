@@ -18,7 +18,13 @@ package notify
  * along with this program.  If not, see <https://www.gnu.org/licenses/>.
  */
 
-import "github.com/aws/aws-lambda-go/events"
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
 
 // S3Notification is sent when new data is available in S3
 type S3Notification struct {
@@ -26,28 +32,75 @@ type S3Notification struct {
 	Records []events.S3EventRecord
 }
 
+// S3ObjectDetails are optional object properties included in a notification when they are known.
+// Consumers must not rely on them being present (they serialize as empty strings when unset).
+type S3ObjectDetails struct {
+	// ETag as returned by S3 (surrounding quotes are removed, multipart ETags keep their "-N" suffix)
+	ETag string
+	// Sequencer is only known for notifications derived from real S3 events
+	Sequencer string
+	// VersionID is set when the object was found by a version-aware listing
+	VersionID string
+	// EventTime is when the object was written, e.g. the LastModified of a listing
+	EventTime time.Time
+	// Region is the region of the bucket
+	Region string
+}
+
 func NewS3ObjectPutNotification(bucket, key string, nbytes int) *S3Notification {
+	return NewS3ObjectPutNotificationWithDetails(bucket, key, nbytes, nil)
+}
+
+// NewS3ObjectPutNotificationWithDetails builds a notification that also carries the optional object details
+func NewS3ObjectPutNotificationWithDetails(bucket, key string, nbytes int, details *S3ObjectDetails) *S3Notification {
 	const (
 		eventVersion = "2.0"
 		eventSource  = "aws:s3"
 		eventName    = "ObjectCreated:Put"
 	)
-	return &S3Notification{
-		Records: []events.S3EventRecord{
-			{
-				EventVersion: eventVersion,
-				EventSource:  eventSource,
-				EventName:    eventName,
-				S3: events.S3Entity{
-					Bucket: events.S3Bucket{
-						Name: bucket,
-					},
-					Object: events.S3Object{
-						Key:  key,
-						Size: int64(nbytes), // this is very important to include because some subscribers will ignore 0 length files
-					},
-				},
+	object := events.S3Object{
+		Key:  key,
+		Size: int64(nbytes), // this is very important to include because some subscribers will ignore 0 length files
+	}
+	record := events.S3EventRecord{
+		EventVersion: eventVersion,
+		EventSource:  eventSource,
+		EventName:    eventName,
+		S3: events.S3Entity{
+			Bucket: events.S3Bucket{
+				Name: bucket,
 			},
 		},
 	}
+	if details != nil {
+		object.ETag = NormalizeETag(details.ETag)
+		object.Sequencer = details.Sequencer
+		object.VersionID = details.VersionID
+		record.EventTime = details.EventTime
+		record.AWSRegion = details.Region
+	}
+	record.S3.Object = object
+	return &S3Notification{
+		Records: []events.S3EventRecord{record},
+	}
+}
+
+// EncodeObjectKey URL-encodes an object key as S3 does in event notifications, e.g. "year=2020/a b+c.gz" is
+// "year%3D2020/a+b%2Bc.gz". The slashes of the key are kept.
+func EncodeObjectKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i := range segments {
+		segments[i] = url.QueryEscape(segments[i])
+	}
+	return strings.Join(segments, "/")
+}
+
+// DecodeObjectKey returns the key of an object from the key of an S3 event notification, see EncodeObjectKey
+func DecodeObjectKey(key string) (string, error) {
+	return url.QueryUnescape(key)
+}
+
+// NormalizeETag strips the quotes S3 API responses put around ETags so the value matches real S3 events
+func NormalizeETag(etag string) string {
+	return strings.Trim(etag, `"`)
 }
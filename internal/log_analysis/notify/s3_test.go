@@ -0,0 +1,101 @@
+package notify
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewS3ObjectPutNotification(t *testing.T) {
+	notification := NewS3ObjectPutNotification("bucket", "key", 42)
+	require.Len(t, notification.Records, 1)
+	object := notification.Records[0].S3.Object
+	assert.Equal(t, "key", object.Key)
+	assert.Equal(t, int64(42), object.Size)
+	assert.Empty(t, object.ETag)
+	assert.Empty(t, object.Sequencer)
+	assert.Empty(t, object.VersionID)
+	assert.True(t, notification.Records[0].EventTime.IsZero())
+	assert.Empty(t, notification.Records[0].AWSRegion)
+}
+
+func TestNewS3ObjectPutNotificationWithDetails(t *testing.T) {
+	details := &S3ObjectDetails{
+		ETag:      `"d41d8cd98f00b204e9800998ecf8427e-12"`, // multipart upload, as returned by ListObjectsV2
+		Sequencer: "0055AED6DCD90281E5",
+		VersionID: "3HL4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY+MTRCxf3vjVBH40Nrjfkd",
+		EventTime: time.Date(2020, 12, 1, 10, 30, 0, 0, time.UTC),
+		Region:    "eu-west-1",
+	}
+	notification := NewS3ObjectPutNotificationWithDetails("bucket", "key", 42, details)
+	require.Len(t, notification.Records, 1)
+	object := notification.Records[0].S3.Object
+	assert.Equal(t, "d41d8cd98f00b204e9800998ecf8427e-12", object.ETag)
+	assert.Equal(t, details.Sequencer, object.Sequencer)
+	assert.Equal(t, details.VersionID, object.VersionID)
+	assert.Equal(t, details.EventTime, notification.Records[0].EventTime)
+	assert.Equal(t, "eu-west-1", notification.Records[0].AWSRegion)
+
+	// field names must match real S3 events
+	payload, err := jsoniter.MarshalToString(notification)
+	require.NoError(t, err)
+	assert.Contains(t, payload, `"eTag":"d41d8cd98f00b204e9800998ecf8427e-12"`)
+	assert.Contains(t, payload, `"sequencer":"0055AED6DCD90281E5"`)
+	assert.Contains(t, payload, `"versionId":"3HL4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY+MTRCxf3vjVBH40Nrjfkd"`)
+	assert.Contains(t, payload, `"eventTime":"2020-12-01T10:30:00Z"`)
+	assert.Contains(t, payload, `"awsRegion":"eu-west-1"`)
+}
+
+func TestParseS3NotificationWithoutDetails(t *testing.T) {
+	// consumers must tolerate notifications without the optional fields
+	const payload = `{"Records":[{"s3":{"bucket":{"name":"bucket"},"object":{"key":"key","size":42}}}]}`
+	notification := &S3Notification{}
+	require.NoError(t, jsoniter.UnmarshalFromString(payload, notification))
+	require.Len(t, notification.Records, 1)
+	assert.Equal(t, "key", notification.Records[0].S3.Object.Key)
+	assert.Empty(t, notification.Records[0].S3.Object.ETag)
+}
+
+func TestNormalizeETag(t *testing.T) {
+	assert.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", NormalizeETag(`"d41d8cd98f00b204e9800998ecf8427e"`))
+	assert.Equal(t, "d41d8cd98f00b204e9800998ecf8427e-2", NormalizeETag(`"d41d8cd98f00b204e9800998ecf8427e-2"`))
+	assert.Equal(t, "d41d8cd98f00b204e9800998ecf8427e-2", NormalizeETag("d41d8cd98f00b204e9800998ecf8427e-2"))
+	assert.Empty(t, NormalizeETag(""))
+}
+
+func TestEncodeObjectKey(t *testing.T) {
+	for key, encoded := range map[string]string{
+		"logs/year=2020/file.json.gz": "logs/year%3D2020/file.json.gz",
+		"with space/a+b.gz":           "with+space/a%2Bb.gz",
+		"ünïcode/日本.gz":               "%C3%BCn%C3%AFcode/%E6%97%A5%E6%9C%AC.gz",
+		"100%/x?y&z":                  "100%25/x%3Fy%26z",
+	} {
+		assert.Equal(t, encoded, EncodeObjectKey(key))
+		decoded, err := DecodeObjectKey(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, key, decoded)
+	}
+	_, err := DecodeObjectKey("bad%zz")
+	assert.Error(t, err)
+}
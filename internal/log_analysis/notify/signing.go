@@ -0,0 +1,171 @@
+package notify
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/pkg/errors"
+)
+
+// SignatureAttributeName is the attribute with the signature of the message of a notification.
+// Its value is <key version>:<base64 HMAC-SHA256 of the message bytes as published>.
+// Signing is optional, subscribers that verify signatures must accept unsigned messages until every publisher signs.
+const SignatureAttributeName = "panther.signature"
+
+// The version stages of the signing key secret, the current key signs and both keys verify
+// so that the key can be rotated without rejecting the messages in flight.
+const (
+	currentKeyStage  = "AWSCURRENT"
+	previousKeyStage = "AWSPREVIOUS"
+)
+
+// ErrInvalidSignature is returned for messages with a signature that does not match any accepted key
+var ErrInvalidSignature = errors.New("invalid notification signature")
+
+// SigningKey is a version of the HMAC key of notification signatures
+type SigningKey struct {
+	Version string
+	Secret  []byte
+}
+
+// Signer signs the messages of notifications
+type Signer struct {
+	Key SigningKey
+}
+
+// Sign returns the signature attribute value of a message
+func (s *Signer) Sign(message string) string {
+	return s.Key.Version + ":" + base64.StdEncoding.EncodeToString(computeSignature(s.Key.Secret, message))
+}
+
+// SetSignature adds the signature of a message to the attributes of its SNS notification
+func (s *Signer) SetSignature(attributes map[string]*sns.MessageAttributeValue, message string) {
+	signature := s.Sign(message)
+	attributes[SignatureAttributeName] = &sns.MessageAttributeValue{
+		StringValue: &signature,
+		DataType:    &messageAttributeDataType,
+	}
+}
+
+// Verifier checks the signatures of notifications against the accepted key versions
+type Verifier struct {
+	Keys []SigningKey
+}
+
+// Verify checks the signature attribute value of a message.
+// Messages without a signature pass, messages with a malformed signature or one that does not match
+// an accepted key version fail with ErrInvalidSignature.
+func (v *Verifier) Verify(message, signature string) error {
+	if signature == "" {
+		return nil
+	}
+	pos := strings.LastIndexByte(signature, ':')
+	if pos == -1 {
+		return errors.Wrap(ErrInvalidSignature, "malformed signature")
+	}
+	version := signature[:pos]
+	mac, err := base64.StdEncoding.DecodeString(signature[pos+1:])
+	if err != nil {
+		return errors.Wrap(ErrInvalidSignature, "malformed signature")
+	}
+	for _, key := range v.Keys {
+		if key.Version != version {
+			continue
+		}
+		if hmac.Equal(mac, computeSignature(key.Secret, message)) {
+			return nil
+		}
+		return ErrInvalidSignature
+	}
+	return errors.Wrapf(ErrInvalidSignature, "key version %q is not accepted", version)
+}
+
+func computeSignature(secret []byte, message string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// LoadSigner returns a signer with the current version of the signing key secret
+func LoadSigner(client secretsmanageriface.SecretsManagerAPI, secretID string) (*Signer, error) {
+	key, err := getSigningKey(client, secretID, currentKeyStage)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{Key: *key}, nil
+}
+
+// LoadVerifier returns a verifier accepting the current and, during a rotation, the previous version
+// of the signing key secret
+func LoadVerifier(client secretsmanageriface.SecretsManagerAPI, secretID string) (*Verifier, error) {
+	current, err := getSigningKey(client, secretID, currentKeyStage)
+	if err != nil {
+		return nil, err
+	}
+	verifier := &Verifier{
+		Keys: []SigningKey{*current},
+	}
+	previous, err := getSigningKey(client, secretID, previousKeyStage)
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+			return verifier, nil // never rotated
+		}
+		return nil, err
+	}
+	verifier.Keys = append(verifier.Keys, *previous)
+	return verifier, nil
+}
+
+func getSigningKey(client secretsmanageriface.SecretsManagerAPI, secretID, stage string) (*SigningKey, error) {
+	output, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId:     &secretID,
+		VersionStage: &stage,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the %s signing key of %s", stage, secretID)
+	}
+	secret := output.SecretBinary
+	if secret == nil {
+		secret = []byte(aws.StringValue(output.SecretString))
+	}
+	if len(secret) == 0 {
+		return nil, errors.Errorf("the %s signing key of %s is empty", stage, secretID)
+	}
+	return &SigningKey{
+		Version: aws.StringValue(output.VersionId),
+		Secret:  secret,
+	}, nil
+}
+
+// VerifySQSMessage checks the signature of a notification delivered to an SQS subscriber with raw message delivery,
+// the body of the message is the message that was signed.
+func (v *Verifier) VerifySQSMessage(message *events.SQSMessage) error {
+	return v.Verify(message.Body, ParseSQSMessageAttributes(message.MessageAttributes).Signature)
+}
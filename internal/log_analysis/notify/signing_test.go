@@ -0,0 +1,125 @@
+package notify
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
+)
+
+const testMessage = `{"Records":[{"s3":{"bucket":{"name":"foo"},"object":{"key":"bar"}}}]}`
+
+func TestVerify(t *testing.T) {
+	current := SigningKey{Version: "v2", Secret: []byte("current")}
+	previous := SigningKey{Version: "v1", Secret: []byte("previous")}
+	verifier := &Verifier{Keys: []SigningKey{current, previous}}
+
+	signer := &Signer{Key: current}
+	require.NoError(t, verifier.Verify(testMessage, signer.Sign(testMessage)))
+	// messages in flight during a rotation
+	signer = &Signer{Key: previous}
+	require.NoError(t, verifier.Verify(testMessage, signer.Sign(testMessage)))
+	// unsigned messages pass while publishers migrate
+	require.NoError(t, verifier.Verify(testMessage, ""))
+
+	invalid := map[string]string{
+		"tampered":      signer.Sign(testMessage + " "),
+		"wrong key":     (&Signer{Key: SigningKey{Version: "v1", Secret: []byte("other")}}).Sign(testMessage),
+		"unknown key":   (&Signer{Key: SigningKey{Version: "v0", Secret: []byte("previous")}}).Sign(testMessage),
+		"no version":    "c2lnbmF0dXJl",
+		"not base64":    "v1:!!!",
+		"empty version": ":" + signer.Sign(testMessage)[len("v1:"):],
+	}
+	for name, signature := range invalid {
+		err := verifier.Verify(testMessage, signature)
+		assert.True(t, errors.Is(err, ErrInvalidSignature), "%s: %v", name, err)
+	}
+}
+
+func TestVerifySQSMessage(t *testing.T) {
+	key := SigningKey{Version: "v1", Secret: []byte("secret")}
+	attributes := NewLogAnalysisSNSMessageAttributes(pantherdb.LogData, "AWS.CloudTrail")
+	(&Signer{Key: key}).SetSignature(attributes, testMessage)
+
+	message := &events.SQSMessage{
+		Body:              testMessage,
+		MessageAttributes: toSQSMessageAttributes(attributes),
+	}
+	verifier := &Verifier{Keys: []SigningKey{key}}
+	require.NoError(t, verifier.VerifySQSMessage(message))
+	message.Body += " "
+	require.Error(t, verifier.VerifySQSMessage(message))
+}
+
+// a secret with a version per stage
+type fakeSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	stages map[string]*secretsmanager.GetSecretValueOutput
+}
+
+func (f *fakeSecretsManager) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	output, ok := f.stages[aws.StringValue(input.VersionStage)]
+	if !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "no version", nil)
+	}
+	return output, nil
+}
+
+func TestLoadSigningKeys(t *testing.T) {
+	client := &fakeSecretsManager{
+		stages: map[string]*secretsmanager.GetSecretValueOutput{
+			"AWSCURRENT": {VersionId: aws.String("v2"), SecretString: aws.String("current")},
+		},
+	}
+	signer, err := LoadSigner(client, "secret")
+	require.NoError(t, err)
+	assert.Equal(t, SigningKey{Version: "v2", Secret: []byte("current")}, signer.Key)
+	verifier, err := LoadVerifier(client, "secret")
+	require.NoError(t, err)
+	assert.Len(t, verifier.Keys, 1) // never rotated
+
+	client.stages["AWSPREVIOUS"] = &secretsmanager.GetSecretValueOutput{VersionId: aws.String("v1"), SecretBinary: []byte("previous")}
+	verifier, err = LoadVerifier(client, "secret")
+	require.NoError(t, err)
+	assert.Equal(t, []SigningKey{signer.Key, {Version: "v1", Secret: []byte("previous")}}, verifier.Keys)
+
+	delete(client.stages, "AWSCURRENT")
+	_, err = LoadSigner(client, "secret")
+	require.Error(t, err)
+	_, err = LoadVerifier(client, "secret")
+	require.Error(t, err)
+}
+
+func TestSetSignature(t *testing.T) {
+	attributes := map[string]*sns.MessageAttributeValue{}
+	(&Signer{Key: SigningKey{Version: "v1", Secret: []byte("secret")}}).SetSignature(attributes, testMessage)
+	require.Len(t, attributes, 1)
+	assert.Regexp(t, `^v1:[A-Za-z0-9+/]{43}=$`, aws.StringValue(attributes[SignatureAttributeName].StringValue))
+}
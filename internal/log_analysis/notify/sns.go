@@ -24,24 +24,51 @@ import (
 	"github.com/panther-labs/panther/internal/log_analysis/pantherdb"
 )
 
+// The names of the message attributes set on notifications, subscribers filter on these so they must never change!
 const (
-	logDataTypeAttributeName = "type"
-	logTypeAttributeName     = "id"
+	// DataTypeAttributeName is the attribute with the pantherdb.DataType of the data
+	DataTypeAttributeName = "type"
+	// LogTypeAttributeName is the attribute with the log type of the data
+	LogTypeAttributeName = "id"
+	// SchemaVersionAttributeName is only set on messages whose payload is not a plain S3Notification,
+	// absent means version 1
+	SchemaVersionAttributeName = "schemaVersion"
 )
 
+// ValidAttributeNames returns the names of all the message attributes that can be set on notifications
+func ValidAttributeNames() []string {
+	return []string{
+		DataTypeAttributeName,
+		LogTypeAttributeName,
+		SchemaVersionAttributeName,
+		ReplayAttributeName,
+		OriginalEventTimeAttributeName,
+		BackfillRunIDAttributeName,
+		SignatureAttributeName,
+	}
+}
+
 var (
 	messageAttributeDataType = "String"
 )
 
 func NewLogAnalysisSNSMessageAttributes(dataType pantherdb.DataType, logType string) map[string]*sns.MessageAttributeValue {
 	return map[string]*sns.MessageAttributeValue{
-		logDataTypeAttributeName: {
+		DataTypeAttributeName: {
 			StringValue: (*string)(&dataType),
 			DataType:    &messageAttributeDataType,
 		},
-		logTypeAttributeName: {
+		LogTypeAttributeName: {
 			StringValue: &logType,
 			DataType:    &messageAttributeDataType,
 		},
 	}
 }
+
+// SetSchemaVersion marks the message with the schema version of its payload
+func SetSchemaVersion(attributes map[string]*sns.MessageAttributeValue, version string) {
+	attributes[SchemaVersionAttributeName] = &sns.MessageAttributeValue{
+		StringValue: &version,
+		DataType:    &messageAttributeDataType,
+	}
+}
@@ -31,6 +31,13 @@ _LOGGER = get_logger()
 
 _RULES_ENGINE = Engine(AnalysisAPIClient())
 
+# The message attribute holding the log type, notify.LogTypeAttributeName in the Go publishers
+_LOG_TYPE_ATTRIBUTE = 'id'
+# The message attribute the log processor sets on notifications of replayed data, notify.ReplayAttributeName
+_REPLAY_ATTRIBUTE = 'panther.replay'
+# Added to replayed events so rules can opt out of alerting on them
+_REPLAY_FIELD = 'p_replay'
+
 
 #  pylint: disable=unsubscriptable-object
 def lambda_handler(event: Dict[str, Any], unused_context: Any) -> Optional[Dict[str, Any]]:
@@ -68,13 +75,15 @@ def log_analysis(event: Dict[str, Any]) -> None:
     matches = 0
     output_buffer = MatchedEventsBuffer()
     for log_type, data_streams in log_type_to_data.items():
-        for data_stream in data_streams:
+        for data_stream, replay in data_streams:
             for data in data_stream:
                 try:  # Bad json data can cause exceptions to be thrown. Best effort: log and continue
                     json_data = json.loads(data)
                 except Exception as err:  # pylint: disable=broad-except
                     _LOGGER.error("data is not valid JSON %s", err)  # do not log data!
                     continue
+                if replay:
+                    json_data[_REPLAY_FIELD] = True
 
                 for analysis_result in _RULES_ENGINE.analyze(log_type, json_data):
                     # The analysis results can be either a. Rule matches b. Rule errors
@@ -86,18 +95,26 @@ def log_analysis(event: Dict[str, Any]) -> None:
     _LOGGER.info("Matched %d events in %s seconds", matches, end - start)
 
 
-# Reads lambda events wrapping s3 notifications, returns dictionary containing mapping from log type to list of TextIOWrapper's
-def _load_event(event: Dict[str, Any]) -> Dict[str, List[TextIOWrapper]]:
-    log_type_to_data: Dict[str, List[TextIOWrapper]] = collections.defaultdict(list)
+# Reads lambda events wrapping s3 notifications, returns dictionary containing mapping from log type to list of
+# TextIOWrapper's and whether they hold replayed data
+def _load_event(event: Dict[str, Any]) -> Dict[str, List[Tuple[TextIOWrapper, bool]]]:
+    log_type_to_data: Dict[str, List[Tuple[TextIOWrapper, bool]]] = collections.defaultdict(list)
     for record in event['Records']:
         record_body = json.loads(record['body'])
-        log_type = record['messageAttributes']['id']['stringValue']  # id attr holds log type
+        log_type = record['messageAttributes'][_LOG_TYPE_ATTRIBUTE]['stringValue']
+        replay = _is_replay(record)
         for bucket, object_key in _load_s3_notifications(record_body['Records']):
             _LOGGER.debug("loading object from S3, bucket [%s], key [%s]", bucket, object_key)
-            log_type_to_data[log_type].append(_load_contents(bucket, object_key))
+            log_type_to_data[log_type].append((_load_contents(bucket, object_key), replay))
     return log_type_to_data
 
 
+# Returns True if the notification is for replayed (back-filled) data
+def _is_replay(record: Dict[str, Any]) -> bool:
+    attribute = record.get('messageAttributes', {}).get(_REPLAY_ATTRIBUTE, {})
+    return attribute.get('stringValue') == 'true'
+
+
 # Reads S3 notifications and returns tuples of (bucket, key)
 def _load_s3_notifications(records: List[Dict[str, Any]]) -> List[Tuple[str, str]]:
     events: List[Tuple[str, str]] = []
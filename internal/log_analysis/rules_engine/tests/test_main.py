@@ -17,6 +17,7 @@
 import io
 import json
 import os
+import re
 from typing import Any, Dict
 from unittest import TestCase, mock
 
@@ -59,7 +60,11 @@ _ENV_VARIABLES_MOCK = {
 }
 with mock.patch.dict(os.environ, _ENV_VARIABLES_MOCK), \
      mock.patch.object(boto3, 'client', side_effect=mock_to_return):
-    from ..src.main import lambda_handler, _load_s3_notifications
+    from ..src.main import lambda_handler, _load_s3_notifications, _is_replay, _LOG_TYPE_ATTRIBUTE, _REPLAY_ATTRIBUTE
+
+# The Go source of the attribute names of the notifications read by the rules engine
+_NOTIFY_ATTRIBUTES_SOURCE = os.path.join(os.path.dirname(__file__), '..', '..', 'notify', 'sns.go')
+_NOTIFY_HINTS_SOURCE = os.path.join(os.path.dirname(__file__), '..', '..', 'notify', 'hints.go')
 
 
 class TestMainDirectAnalysis(TestCase):
@@ -601,3 +606,30 @@ class TestMainLoadS3Notifications(TestCase):
         ]
         expected_response = [('mybucket', 'mykey'), ('mybucket2', 'mykey2')]
         self.assertEqual(expected_response, _load_s3_notifications(notifications))
+
+
+class TestMainAttributeNames(TestCase):
+
+    def test_log_type_attribute(self) -> None:
+        with open(_NOTIFY_ATTRIBUTES_SOURCE) as source:
+            match = re.search(r'LogTypeAttributeName\s*=\s*"([^"]*)"', source.read())
+        self.assertIsNotNone(match, 'notify.LogTypeAttributeName not found')
+        self.assertEqual(match.group(1), _LOG_TYPE_ATTRIBUTE)  # type: ignore
+
+    def test_replay_attribute(self) -> None:
+        with open(_NOTIFY_HINTS_SOURCE) as source:
+            match = re.search(r'ReplayAttributeName\s*=\s*"([^"]*)"', source.read())
+        self.assertIsNotNone(match, 'notify.ReplayAttributeName not found')
+        self.assertEqual(match.group(1), _REPLAY_ATTRIBUTE)  # type: ignore
+
+
+class TestMainReplay(TestCase):
+
+    def test_is_replay(self) -> None:
+        record = {'messageAttributes': {'id': {'stringValue': 'AWS.CloudTrail'}, 'panther.replay': {'stringValue': 'true'}}}
+        self.assertTrue(_is_replay(record))
+
+    def test_is_not_replay(self) -> None:
+        self.assertFalse(_is_replay({'messageAttributes': {'id': {'stringValue': 'AWS.CloudTrail'}}}))
+        self.assertFalse(_is_replay({'messageAttributes': {'panther.replay': {'stringValue': 'false'}}}))
+        self.assertFalse(_is_replay({}))
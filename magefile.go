@@ -120,6 +120,11 @@ func (Test) Integration() error {
 	return test.Integration()
 }
 
+// Run the LocalStack tests, skipped if docker is not available
+func (Test) Localstack() error {
+	return test.Localstack()
+}
+
 // Test and lint Python source
 func (Test) Python() error {
 	return test.Python()
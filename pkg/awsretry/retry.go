@@ -0,0 +1,183 @@
+package awsretry
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/pkg/errors"
+
+	"github.com/panther-labs/panther/pkg/awsutils"
+)
+
+// DefaultMaxElapsedTime is the retry budget of a Retryer without MaxElapsedTime and a context without deadline
+const DefaultMaxElapsedTime = time.Minute
+
+// Class is the kind of failure of an AWS call, it decides whether the call is retried
+type Class int
+
+const (
+	// Permanent errors are not retried (validation, access denied, not found, canceled ...)
+	Permanent Class = iota
+	// Throttled calls are retried with backoff
+	Throttled
+	// Transient errors (network, server side) are retried with backoff
+	Transient
+)
+
+func (c Class) String() string {
+	switch c {
+	case Throttled:
+		return "throttled"
+	case Transient:
+		return "transient"
+	default:
+		return "permanent"
+	}
+}
+
+// throttling codes not known to request.IsErrorThrottle
+var extraThrottleCodes = []string{
+	"SlowDown",      // S3
+	"Throttled",     // SNS
+	"KMSThrottling", // SNS with encrypted topics
+	"KmsThrottled",  // SQS with encrypted queues
+}
+
+// server side failures that are not in the request.IsErrorRetryable codes
+var transientCodes = []string{
+	"InternalError",
+	"InternalErrorException",
+	"InternalFailure",
+	"ServiceUnavailable",
+}
+
+// Classify returns the class of an error returned by the AWS SDK. Errors that are not AWS errors are permanent,
+// except for connection resets.
+func Classify(err error) Class {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return Permanent
+	}
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		if isConnectionReset(err) {
+			return Transient
+		}
+		return Permanent
+	}
+	if awsErr.Code() == request.CanceledErrorCode {
+		return Permanent
+	}
+	var failure awserr.RequestFailure
+	hasStatus := errors.As(err, &failure)
+	if request.IsErrorThrottle(awsErr) || awsutils.IsAnyError(awsErr, extraThrottleCodes...) ||
+		hasStatus && failure.StatusCode() == http.StatusTooManyRequests {
+
+		return Throttled
+	}
+	if request.IsErrorRetryable(awsErr) || awsutils.IsAnyError(awsErr, transientCodes...) || isConnectionReset(awsErr) ||
+		hasStatus && failure.StatusCode() >= http.StatusInternalServerError {
+
+		return Transient
+	}
+	return Permanent
+}
+
+func isConnectionReset(err error) bool {
+	return strings.Contains(err.Error(), "connection reset by peer")
+}
+
+// Retryer retries operations failing with throttled or transient errors with exponential backoff and jitter.
+// The zero value uses the backoff package defaults and DefaultMaxElapsedTime.
+//
+// Unlike the SDK retryers in this package it wraps a whole operation, e.g. a batch call whose failed entries are resent.
+type Retryer struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	// MaxElapsedTime is the retry budget, a context deadline that comes first takes precedence
+	MaxElapsedTime time.Duration
+	// MaxAttempts if positive limits the calls of an operation, including the first one
+	MaxAttempts int
+	// OnRetry is called before waiting for each retry, e.g. to count retries into stats or metrics
+	OnRetry func(err error, class Class, wait time.Duration)
+	// Classify if set classifies the errors instead of Classify, e.g. to retry the failures of an operation that are
+	// not AWS errors
+	Classify func(err error) Class
+}
+
+// Do calls op until it succeeds, fails with a permanent error, the budget is spent or ctx is done.
+// It returns the last error of op.
+func (r *Retryer) Do(ctx context.Context, op func() error) error {
+	config := backoff.NewExponentialBackOff() // intervals are randomized by +/-50%
+	if r.InitialInterval > 0 {
+		config.InitialInterval = r.InitialInterval
+	}
+	if r.MaxInterval > 0 {
+		config.MaxInterval = r.MaxInterval
+	}
+	config.MaxElapsedTime = r.budget(ctx)
+
+	classify := r.Classify
+	if classify == nil {
+		classify = Classify
+	}
+	var class Class
+	operation := func() error {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		if class = classify(err); class == Permanent {
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+	notify := func(err error, wait time.Duration) {
+		if r.OnRetry != nil {
+			r.OnRetry(err, class, wait)
+		}
+	}
+	var policy backoff.BackOff = config
+	if r.MaxAttempts > 0 {
+		policy = backoff.WithMaxRetries(config, uint64(r.MaxAttempts-1))
+	}
+	return backoff.RetryNotify(operation, backoff.WithContext(policy, ctx), notify)
+}
+
+func (r *Retryer) budget(ctx context.Context) time.Duration {
+	budget := r.MaxElapsedTime
+	if budget <= 0 {
+		budget = DefaultMaxElapsedTime
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if untilDeadline := time.Until(deadline); untilDeadline < budget {
+			budget = untilDeadline
+		}
+	}
+	if budget <= 0 { // a zero budget means no limit for the backoff package
+		budget = time.Nanosecond
+	}
+	return budget
+}
@@ -0,0 +1,198 @@
+package awsretry
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedSQS fails SendMessageBatch with the scripted errors in order, then succeeds
+type scriptedSQS struct {
+	sqsiface.SQSAPI
+	errs  []error
+	calls int
+}
+
+func (s *scriptedSQS) SendMessageBatch(*sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	s.calls++
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return nil, err
+	}
+	return &sqs.SendMessageBatchOutput{}, nil
+}
+
+func (s *scriptedSQS) send() error {
+	_, err := s.SendMessageBatch(&sqs.SendMessageBatchInput{QueueUrl: aws.String("url")})
+	return err
+}
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		class Class
+	}{
+		{nil, Permanent},
+		{errors.New("failed to marshal"), Permanent},
+		{context.Canceled, Permanent},
+		{awserr.New("RequestCanceled", "request context canceled", context.Canceled), Permanent},
+		{awserr.New(sqs.ErrCodeQueueDoesNotExist, "no queue", nil), Permanent},
+		{awserr.New("AccessDenied", "denied", nil), Permanent},
+		{awserr.New("ValidationError", "bad input", nil), Permanent},
+		{awserr.NewRequestFailure(awserr.New("BadRequest", "bad", nil), http.StatusBadRequest, "id"), Permanent},
+		{awserr.New("Throttling", "rate exceeded", nil), Throttled},
+		{awserr.New("ThrottlingException", "rate exceeded", nil), Throttled},
+		{awserr.New("RequestThrottled", "rate exceeded", nil), Throttled},
+		{awserr.New("SlowDown", "reduce your request rate", nil), Throttled},
+		{awserr.New("Throttled", "sns rate exceeded", nil), Throttled},
+		{awserr.New("KMSThrottling", "kms rate exceeded", nil), Throttled},
+		{awserr.New("KmsThrottled", "kms rate exceeded", nil), Throttled},
+		{awserr.NewRequestFailure(awserr.New("Unknown", "too many", nil), http.StatusTooManyRequests, "id"), Throttled},
+		{awserr.New("RequestError", "send request failed", errors.New("read: connection reset by peer")), Transient},
+		{awserr.New("InternalError", "we encountered an internal error", nil), Transient},
+		{awserr.NewRequestFailure(awserr.New("Unknown", "oops", nil), http.StatusInternalServerError, "id"), Transient},
+		{awserr.NewRequestFailure(awserr.New("Unknown", "oops", nil), http.StatusServiceUnavailable, "id"), Transient},
+		{errors.New("write tcp: connection reset by peer"), Transient},
+	} {
+		assert.Equal(t, tc.class, Classify(tc.err), "%v", tc.err)
+	}
+}
+
+func TestRetryerThrottled(t *testing.T) {
+	client := &scriptedSQS{errs: []error{
+		awserr.New("RequestThrottled", "rate exceeded", nil),
+		awserr.New("InternalError", "internal error", nil),
+	}}
+	var retries []Class
+	retryer := &Retryer{
+		InitialInterval: time.Millisecond,
+		OnRetry: func(err error, class Class, wait time.Duration) {
+			retries = append(retries, class)
+		},
+	}
+	require.NoError(t, retryer.Do(context.Background(), client.send))
+	assert.Equal(t, 3, client.calls)
+	assert.Equal(t, []Class{Throttled, Transient}, retries)
+}
+
+func TestRetryerPermanent(t *testing.T) {
+	notFound := awserr.New(sqs.ErrCodeQueueDoesNotExist, "no queue", nil)
+	client := &scriptedSQS{errs: []error{notFound}}
+	retryer := &Retryer{
+		InitialInterval: time.Millisecond,
+		OnRetry: func(error, Class, time.Duration) {
+			t.Error("permanent errors are not retried")
+		},
+	}
+	assert.Equal(t, notFound, retryer.Do(context.Background(), client.send))
+	assert.Equal(t, 1, client.calls)
+}
+
+func TestRetryerClassify(t *testing.T) {
+	coldStart := errors.New("task timed out")
+	client := &scriptedSQS{errs: []error{coldStart}}
+	var retries []Class
+	retryer := &Retryer{
+		InitialInterval: time.Millisecond,
+		OnRetry: func(_ error, class Class, _ time.Duration) {
+			retries = append(retries, class)
+		},
+		Classify: func(err error) Class {
+			if err == coldStart {
+				return Transient
+			}
+			return Classify(err)
+		},
+	}
+	require.NoError(t, retryer.Do(context.Background(), client.send))
+	assert.Equal(t, 2, client.calls)
+	assert.Equal(t, []Class{Transient}, retries)
+}
+
+func TestRetryerBudget(t *testing.T) {
+	throttled := awserr.New("Throttling", "rate exceeded", nil)
+	client := &scriptedSQS{}
+	for i := 0; i < 1000; i++ {
+		client.errs = append(client.errs, throttled)
+	}
+	retryer := &Retryer{
+		InitialInterval: time.Millisecond,
+		MaxInterval:     5 * time.Millisecond,
+		MaxElapsedTime:  50 * time.Millisecond,
+	}
+	start := time.Now()
+	assert.Equal(t, throttled, retryer.Do(context.Background(), client.send))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Greater(t, client.calls, 1)
+}
+
+func TestRetryerMaxAttempts(t *testing.T) {
+	throttled := awserr.New("Throttling", "rate exceeded", nil)
+	client := &scriptedSQS{errs: []error{throttled, throttled, throttled, throttled}}
+	retryer := &Retryer{
+		InitialInterval: time.Millisecond,
+		MaxAttempts:     3,
+	}
+	assert.Equal(t, throttled, retryer.Do(context.Background(), client.send))
+	assert.Equal(t, 3, client.calls)
+
+	// a single attempt is not retried
+	client = &scriptedSQS{errs: []error{throttled}}
+	retryer.MaxAttempts = 1
+	assert.Equal(t, throttled, retryer.Do(context.Background(), client.send))
+	assert.Equal(t, 1, client.calls)
+}
+
+func TestRetryerBudgetFromDeadline(t *testing.T) {
+	retryer := &Retryer{MaxElapsedTime: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	budget := retryer.budget(ctx)
+	assert.True(t, budget <= time.Minute && budget > 50*time.Second, budget)
+
+	assert.Equal(t, time.Hour, retryer.budget(context.Background()))
+	assert.Equal(t, DefaultMaxElapsedTime, (&Retryer{}).budget(context.Background()))
+}
+
+func TestRetryerCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	throttled := awserr.New("Throttling", "rate exceeded", nil)
+	client := &scriptedSQS{errs: []error{throttled, throttled, throttled}}
+	retryer := &Retryer{
+		InitialInterval: time.Hour, // only the cancellation ends the wait
+		OnRetry: func(error, Class, time.Duration) {
+			cancel()
+		},
+	}
+	err := retryer.Do(ctx, client.send)
+	require.Error(t, err)
+	assert.Equal(t, 1, client.calls)
+}
@@ -43,6 +43,11 @@ func (e *AWSError) Error() string {
 	return e.Err.Error()
 }
 
+// Unwrap returns the error of the AWS SDK, so that it can be classified for retries
+func (e *AWSError) Unwrap() error {
+	return e.Err
+}
+
 // DoesNotExistError is raised if the item being retrieved or modified does not exist.
 type DoesNotExistError struct {
 	Route   string
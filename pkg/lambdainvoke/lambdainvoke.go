@@ -0,0 +1,165 @@
+package lambdainvoke
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/cenkalti/backoff/v4"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/panther-labs/panther/pkg/awsutils"
+)
+
+const (
+	// MaxPayloadSize is the Lambda limit for the payload of a synchronous invocation
+	MaxPayloadSize = 6 * 1024 * 1024
+
+	// DefaultMaxElapsedTime bounds the retries of an invocation when Client.MaxElapsedTime is not set
+	DefaultMaxElapsedTime = 30 * time.Second
+
+	initialInterval = 100 * time.Millisecond
+)
+
+// FunctionError is returned when the function was invoked but failed, either with an error returned
+// by the handler or because of a timeout, panic, out of memory etc.
+type FunctionError struct {
+	FunctionName string `json:"-"`
+	// Kind is the X-Amz-Function-Error header, "Handled" or "Unhandled"
+	Kind         string `json:"-"`
+	ErrorType    string `json:"errorType"`
+	ErrorMessage string `json:"errorMessage"`
+	// Payload is the raw error payload, kept for payloads that are not the usual error document
+	Payload []byte `json:"-"`
+}
+
+func (e *FunctionError) Error() string {
+	switch {
+	case e.ErrorMessage == "":
+		return fmt.Sprintf("%s failed (%s): %s", e.FunctionName, e.Kind, string(e.Payload))
+	case e.ErrorType == "":
+		return fmt.Sprintf("%s failed: %s", e.FunctionName, e.ErrorMessage)
+	default:
+		return fmt.Sprintf("%s failed: %s: %s", e.FunctionName, e.ErrorType, e.ErrorMessage)
+	}
+}
+
+// PayloadTooLargeError is returned without invoking the function when the request is over MaxPayloadSize
+type PayloadTooLargeError struct {
+	FunctionName string
+	Size         int
+}
+
+func (e *PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("request payload for %s is %d bytes (max %d)", e.FunctionName, e.Size, MaxPayloadSize)
+}
+
+// Client invokes Lambda functions synchronously with JSON requests and responses
+type Client struct {
+	Lambda lambdaiface.LambdaAPI
+	// MaxElapsedTime bounds the retries of throttled or transient failures
+	MaxElapsedTime time.Duration
+}
+
+// New returns a client with the default retry settings
+func New(client lambdaiface.LambdaAPI) *Client {
+	return &Client{Lambda: client}
+}
+
+// Invoke marshals the request, invokes the function and unmarshals its output into response (ignored if nil).
+// Throttling and transient errors are retried. A failure of the function itself is returned as *FunctionError
+// and is not retried, since the function may have had side effects.
+func (c *Client) Invoke(ctx context.Context, functionName string, request, response interface{}) error {
+	payload, err := jsoniter.Marshal(request)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal request for %s", functionName)
+	}
+	if len(payload) > MaxPayloadSize {
+		return &PayloadTooLargeError{FunctionName: functionName, Size: len(payload)}
+	}
+
+	input := &lambda.InvokeInput{
+		FunctionName: aws.String(functionName),
+		Payload:      payload,
+	}
+	var output *lambda.InvokeOutput
+	invoke := func() error {
+		var invokeErr error
+		output, invokeErr = c.Lambda.InvokeWithContext(ctx, input)
+		if invokeErr == nil {
+			return nil
+		}
+		if !isRetryable(invokeErr) {
+			return backoff.Permanent(invokeErr)
+		}
+		zap.L().Warn("retrying lambda invocation", zap.String("function", functionName), zap.Error(invokeErr))
+		return invokeErr
+	}
+
+	config := backoff.NewExponentialBackOff()
+	config.InitialInterval = initialInterval
+	config.MaxElapsedTime = c.MaxElapsedTime
+	if config.MaxElapsedTime == 0 {
+		config.MaxElapsedTime = DefaultMaxElapsedTime
+	}
+	if err := backoff.Retry(invoke, backoff.WithContext(config, ctx)); err != nil {
+		// the output of a failed invocation is never looked at, it can be nil
+		return errors.Wrapf(err, "failed to invoke %s", functionName)
+	}
+
+	if output.FunctionError != nil {
+		return newFunctionError(functionName, output)
+	}
+	if response == nil {
+		return nil
+	}
+	if err := jsoniter.Unmarshal(output.Payload, response); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal response of %s", functionName)
+	}
+	return nil
+}
+
+func newFunctionError(functionName string, output *lambda.InvokeOutput) *FunctionError {
+	functionErr := &FunctionError{}
+	if err := jsoniter.Unmarshal(output.Payload, functionErr); err != nil {
+		functionErr = &FunctionError{} // not an error document, the raw payload is reported
+	}
+	functionErr.FunctionName = functionName
+	functionErr.Kind = aws.StringValue(output.FunctionError)
+	functionErr.Payload = output.Payload
+	return functionErr
+}
+
+func isRetryable(err error) bool {
+	return request.IsErrorThrottle(err) || request.IsErrorRetryable(err) || awsutils.IsAnyError(err,
+		lambda.ErrCodeTooManyRequestsException,
+		lambda.ErrCodeServiceException,
+		lambda.ErrCodeEC2ThrottledException,
+		lambda.ErrCodeResourceNotReadyException,
+		lambda.ErrCodeResourceConflictException, // the function is being updated
+	)
+}
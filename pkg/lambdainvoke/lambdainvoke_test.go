@@ -0,0 +1,175 @@
+package lambdainvoke
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/panther-labs/panther/pkg/testutils"
+)
+
+const testFunction = "panther-test-api"
+
+type testRequest struct {
+	Name string `json:"name"`
+}
+
+type testResponse struct {
+	Greeting string `json:"greeting"`
+}
+
+func TestInvoke(t *testing.T) {
+	lambdaClient := &testutils.LambdaMock{}
+	lambdaClient.On("InvokeWithContext", mock.Anything, &lambda.InvokeInput{
+		FunctionName: aws.String(testFunction),
+		Payload:      []byte(`{"name":"panther"}`),
+	}, mock.Anything).Return(&lambda.InvokeOutput{Payload: []byte(`{"greeting":"hello panther"}`)}, nil).Once()
+
+	var response testResponse
+	err := New(lambdaClient).Invoke(context.Background(), testFunction, &testRequest{Name: "panther"}, &response)
+	require.NoError(t, err)
+	assert.Equal(t, "hello panther", response.Greeting)
+	lambdaClient.AssertExpectations(t)
+}
+
+func TestInvokeNilResponse(t *testing.T) {
+	lambdaClient := &testutils.LambdaMock{}
+	lambdaClient.On("InvokeWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return(&lambda.InvokeOutput{Payload: []byte(`not json`)}, nil).Once()
+
+	require.NoError(t, New(lambdaClient).Invoke(context.Background(), testFunction, &testRequest{}, nil))
+	lambdaClient.AssertExpectations(t)
+}
+
+func TestInvokeRetry(t *testing.T) {
+	lambdaClient := &testutils.LambdaMock{}
+	throttled := awserr.New(lambda.ErrCodeTooManyRequestsException, "rate exceeded", nil)
+	lambdaClient.On("InvokeWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return((*lambda.InvokeOutput)(nil), throttled).Twice()
+	lambdaClient.On("InvokeWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return(&lambda.InvokeOutput{Payload: []byte(`{"greeting":"hi"}`)}, nil).Once()
+
+	var response testResponse
+	err := New(lambdaClient).Invoke(context.Background(), testFunction, &testRequest{}, &response)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", response.Greeting)
+	lambdaClient.AssertExpectations(t)
+}
+
+func TestInvokeRetryGivesUp(t *testing.T) {
+	lambdaClient := &testutils.LambdaMock{}
+	throttled := awserr.New(lambda.ErrCodeTooManyRequestsException, "rate exceeded", nil)
+	lambdaClient.On("InvokeWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return((*lambda.InvokeOutput)(nil), throttled) // a failed invocation has no output, it must not be read
+
+	client := &Client{Lambda: lambdaClient, MaxElapsedTime: 300 * time.Millisecond}
+	err := client.Invoke(context.Background(), testFunction, &testRequest{}, &testResponse{})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, throttled))
+}
+
+func TestInvokePermanentError(t *testing.T) {
+	lambdaClient := &testutils.LambdaMock{}
+	notFound := awserr.New(lambda.ErrCodeResourceNotFoundException, "function not found", nil)
+	lambdaClient.On("InvokeWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return((*lambda.InvokeOutput)(nil), notFound).Once()
+
+	err := New(lambdaClient).Invoke(context.Background(), testFunction, &testRequest{}, &testResponse{})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, notFound))
+	assert.Equal(t, "failed to invoke panther-test-api: ResourceNotFoundException: function not found", err.Error())
+	lambdaClient.AssertExpectations(t) // not retried
+}
+
+func TestInvokeCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	lambdaClient := &testutils.LambdaMock{}
+	canceled := awserr.New("RequestCanceled", "request context canceled", context.Canceled)
+	lambdaClient.On("InvokeWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return((*lambda.InvokeOutput)(nil), canceled).Once()
+
+	err := New(lambdaClient).Invoke(ctx, testFunction, &testRequest{}, &testResponse{})
+	require.Error(t, err)
+	lambdaClient.AssertExpectations(t)
+}
+
+func TestInvokeFunctionError(t *testing.T) {
+	lambdaClient := &testutils.LambdaMock{}
+	payload := []byte(`{"errorMessage":"name is required","errorType":"InvalidInputError"}`)
+	lambdaClient.On("InvokeWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return(&lambda.InvokeOutput{FunctionError: aws.String("Handled"), Payload: payload}, nil).Once()
+
+	response := testResponse{Greeting: "unchanged"}
+	err := New(lambdaClient).Invoke(context.Background(), testFunction, &testRequest{}, &response)
+	require.Error(t, err)
+	var functionErr *FunctionError
+	require.True(t, errors.As(err, &functionErr))
+	assert.Equal(t, &FunctionError{
+		FunctionName: testFunction,
+		Kind:         "Handled",
+		ErrorType:    "InvalidInputError",
+		ErrorMessage: "name is required",
+		Payload:      payload,
+	}, functionErr)
+	assert.Equal(t, "panther-test-api failed: InvalidInputError: name is required", err.Error())
+	assert.Equal(t, "unchanged", response.Greeting)
+	lambdaClient.AssertExpectations(t) // not retried
+}
+
+func TestInvokeFunctionErrorRawPayload(t *testing.T) {
+	lambdaClient := &testutils.LambdaMock{}
+	lambdaClient.On("InvokeWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return(&lambda.InvokeOutput{FunctionError: aws.String("Unhandled"), Payload: []byte(`out of memory`)}, nil).Once()
+
+	err := New(lambdaClient).Invoke(context.Background(), testFunction, &testRequest{}, nil)
+	var functionErr *FunctionError
+	require.True(t, errors.As(err, &functionErr))
+	assert.Empty(t, functionErr.ErrorMessage)
+	assert.Equal(t, "panther-test-api failed (Unhandled): out of memory", err.Error())
+}
+
+func TestInvokePayloadTooLarge(t *testing.T) {
+	lambdaClient := &testutils.LambdaMock{}
+	request := &testRequest{Name: strings.Repeat("x", MaxPayloadSize)}
+
+	err := New(lambdaClient).Invoke(context.Background(), testFunction, request, nil)
+	var tooLarge *PayloadTooLargeError
+	require.True(t, errors.As(err, &tooLarge))
+	assert.Equal(t, MaxPayloadSize+len(`{"name":""}`), tooLarge.Size)
+	lambdaClient.AssertNotCalled(t, "InvokeWithContext", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestInvokeMarshalError(t *testing.T) {
+	lambdaClient := &testutils.LambdaMock{}
+	err := New(lambdaClient).Invoke(context.Background(), testFunction, make(chan int), nil)
+	require.Error(t, err)
+	lambdaClient.AssertNotCalled(t, "InvokeWithContext", mock.Anything, mock.Anything, mock.Anything)
+}
@@ -0,0 +1,194 @@
+package progress
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultInterval is used when no interval is set
+const DefaultInterval = 10 * time.Second
+
+// Report is a snapshot of the progress passed to an Output
+type Report struct {
+	Name    string
+	Done    uint64
+	Total   uint64 // 0 if unknown
+	Elapsed time.Duration
+	Rate    float64       // items per second since the start
+	ETA     time.Duration // 0 if the total or the rate is unknown
+	Final   bool          // the last report, written by Stop
+	// Interval is the time since the previous periodic report, 0 for the first one and the final report.
+	// CurrentRate is the items per second over it, to see the effect of changes during a run.
+	Interval    time.Duration
+	CurrentRate float64
+}
+
+func (r Report) String() string {
+	if r.Total == 0 {
+		return fmt.Sprintf("%s: %d in %v (%s)", r.Name, r.Done, r.Elapsed.Round(time.Second), r.rates())
+	}
+	percent := 100 * float64(r.Done) / float64(r.Total)
+	if r.Final || r.ETA == 0 {
+		return fmt.Sprintf("%s: %d/%d (%.1f%%) in %v (%s)",
+			r.Name, r.Done, r.Total, percent, r.Elapsed.Round(time.Second), r.rates())
+	}
+	return fmt.Sprintf("%s: %d/%d (%.1f%%) in %v (%s), eta %v",
+		r.Name, r.Done, r.Total, percent, r.Elapsed.Round(time.Second), r.rates(), r.ETA.Round(time.Second))
+}
+
+// since sets the current rate of a report over the time since the previous periodic report
+func (r Report) since(previous Report) Report {
+	if interval := r.Elapsed - previous.Elapsed; previous.Elapsed > 0 && interval > 0 {
+		r.Interval = interval
+		r.CurrentRate = float64(r.Done-previous.Done) / interval.Seconds()
+	}
+	return r
+}
+
+func (r Report) rates() string {
+	if r.Interval == 0 {
+		return fmt.Sprintf("%.1f/s", r.Rate)
+	}
+	return fmt.Sprintf("%.1f/s, now %.1f/s", r.Rate, r.CurrentRate)
+}
+
+// Output receives the reports, it is called from the reporting goroutine and from Stop
+type Output func(Report)
+
+// ZapOutput logs reports at info level
+func ZapOutput(logger *zap.Logger) Output {
+	return func(report Report) {
+		logger.Info(report.String())
+	}
+}
+
+// WriterOutput writes a line per report
+func WriterOutput(w io.Writer) Output {
+	return func(report Report) {
+		fmt.Fprintln(w, report.String())
+	}
+}
+
+// Reporter periodically reports the progress of a counter. Add is safe to call from hot loops in any goroutine.
+type Reporter struct {
+	// 64bit fields first for atomic alignment on 32bit platforms
+	done  uint64
+	total uint64
+
+	name     string
+	interval time.Duration
+	output   Output
+	now      func() time.Time
+	start    time.Time
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+// New returns a reporter, total is 0 if unknown. Reports are written only after Start.
+func New(name string, total uint64, interval time.Duration, output Output) *Reporter {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Reporter{
+		total:    total,
+		name:     name,
+		interval: interval,
+		output:   output,
+		now:      time.Now,
+		start:    time.Now(),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Add counts n more items done
+func (r *Reporter) Add(n uint64) {
+	atomic.AddUint64(&r.done, n)
+}
+
+// SetTotal sets the total once it is known
+func (r *Reporter) SetTotal(total uint64) {
+	atomic.StoreUint64(&r.total, total)
+}
+
+// Start writes a report every interval until Stop is called. The elapsed time is measured from the first Start.
+func (r *Reporter) Start() {
+	r.startOnce.Do(func() {
+		r.start = r.now()
+		go r.run()
+	})
+}
+
+// Stop writes a final report. It can be deferred and called more than once, only the first call reports.
+func (r *Reporter) Stop() {
+	r.stopOnce.Do(func() {
+		r.startOnce.Do(func() { // never started, there is no goroutine to wait for
+			close(r.stopped)
+		})
+		close(r.stop)
+		<-r.stopped
+		report := r.Report()
+		report.Final = true
+		r.output(report)
+	})
+}
+
+// Report returns the current progress
+func (r *Reporter) Report() Report {
+	report := Report{
+		Name:    r.name,
+		Done:    atomic.LoadUint64(&r.done),
+		Total:   atomic.LoadUint64(&r.total),
+		Elapsed: r.now().Sub(r.start),
+	}
+	if report.Elapsed > 0 {
+		report.Rate = float64(report.Done) / report.Elapsed.Seconds()
+	}
+	if report.Rate > 0 && report.Total > report.Done {
+		report.ETA = time.Duration(float64(report.Total-report.Done) / report.Rate * float64(time.Second))
+	}
+	return report
+}
+
+func (r *Reporter) run() {
+	defer close(r.stopped)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	var previous Report
+	for {
+		select {
+		case <-ticker.C:
+			report := r.Report().since(previous)
+			r.output(report)
+			previous = report
+		case <-r.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package progress
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReport(t *testing.T) {
+	reporter := New("copied", 1000, time.Minute, func(Report) {})
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	reporter.start = now
+	reporter.now = func() time.Time { return now.Add(10 * time.Second) }
+
+	reporter.Add(100)
+	reporter.Add(150)
+	report := reporter.Report()
+	assert.Equal(t, Report{
+		Name:    "copied",
+		Done:    250,
+		Total:   1000,
+		Elapsed: 10 * time.Second,
+		Rate:    25,
+		ETA:     30 * time.Second,
+	}, report)
+	assert.Equal(t, "copied: 250/1000 (25.0%) in 10s (25.0/s), eta 30s", report.String())
+
+	reporter.SetTotal(0)
+	report = reporter.Report()
+	assert.Zero(t, report.ETA)
+	assert.Equal(t, "copied: 250 in 10s (25.0/s)", report.String())
+}
+
+func TestReportSince(t *testing.T) {
+	previous := Report{Name: "sent", Done: 100, Elapsed: 10 * time.Second, Rate: 10}
+	report := Report{Name: "sent", Done: 400, Elapsed: 20 * time.Second, Rate: 20}.since(previous)
+	assert.Equal(t, 10*time.Second, report.Interval)
+	assert.Equal(t, float64(30), report.CurrentRate)
+	assert.Equal(t, "sent: 400 in 20s (20.0/s, now 30.0/s)", report.String())
+
+	// the first report has no current rate
+	report = Report{Name: "sent", Done: 100, Elapsed: 10 * time.Second, Rate: 10}.since(Report{})
+	assert.Zero(t, report.Interval)
+	assert.Equal(t, "sent: 100 in 10s (10.0/s)", report.String())
+}
+
+func TestReportNoProgress(t *testing.T) {
+	reporter := New("copied", 10, time.Minute, func(Report) {})
+	report := reporter.Report()
+	assert.Zero(t, report.ETA)
+	assert.Contains(t, report.String(), "copied: 0/10 (0.0%)")
+}
+
+func TestReporterStop(t *testing.T) {
+	var reports []Report
+	reporter := New("sent", 0, time.Hour, func(report Report) {
+		reports = append(reports, report)
+	})
+	reporter.Start()
+	reporter.Add(3)
+	reporter.Stop()
+	reporter.Stop() // deferred stops after an explicit one are harmless
+	require.Len(t, reports, 1)
+	assert.True(t, reports[0].Final)
+	assert.Equal(t, uint64(3), reports[0].Done)
+}
+
+func TestReporterStopNotStarted(t *testing.T) {
+	var buf bytes.Buffer
+	reporter := New("sent", 2, time.Hour, WriterOutput(&buf))
+	reporter.Add(2)
+	reporter.Stop()
+	reporter.Start() // does nothing after Stop
+	assert.Regexp(t, `^sent: 2/2 \(100.0%\) in \d+s \(\d+\.\d/s\)\n$`, buf.String())
+}
+
+func TestReporterInterval(t *testing.T) {
+	reports := make(chan Report, 100)
+	reporter := New("received", 0, time.Millisecond, func(report Report) {
+		select {
+		case reports <- report:
+		default:
+		}
+	})
+	reporter.Start()
+	defer reporter.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				reporter.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	report := <-reports
+	assert.False(t, report.Final)
+	assert.Equal(t, "received", report.Name)
+	assert.Equal(t, uint64(4000), reporter.Report().Done)
+}
@@ -0,0 +1,142 @@
+package s3path
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Scheme is the prefix of s3 paths
+const Scheme = "s3://"
+
+const maxKeyLength = 1024 // bytes
+
+// Path is a parsed s3 path (e.g., s3://mybucket/myprefix)
+type Path struct {
+	Bucket string
+	// Key is the object key or prefix without the leading slash, a trailing slash is kept.
+	// It is taken literally, percent encoded characters are not decoded and '?' or '#' are part of the key.
+	Key string
+}
+
+// Parse parses an s3 path of the form s3://<bucket>/<key or prefix>, the key can be empty
+func Parse(s string) (Path, error) {
+	if s == "" {
+		return Path{}, errors.New("empty s3 path (expecting s3://<bucket>/<prefix>)")
+	}
+	if !strings.HasPrefix(s, Scheme) {
+		if i := strings.Index(s, "://"); i >= 0 {
+			return Path{}, errors.Errorf("s3 path %q has scheme %q (expecting s3://)", s, s[:i])
+		}
+		return Path{}, errors.Errorf("s3 path %q does not start with s3://", s)
+	}
+
+	bucket, key := s[len(Scheme):], ""
+	if i := strings.IndexByte(bucket, '/'); i >= 0 {
+		bucket, key = bucket[:i], bucket[i+1:]
+	}
+	if bucket == "" {
+		return Path{}, errors.Errorf("s3 path %q has no bucket", s)
+	}
+	if err := ValidateBucketName(bucket); err != nil {
+		return Path{}, errors.WithMessagef(err, "s3 path %q", s)
+	}
+	if err := validateKey(key); err != nil {
+		return Path{}, errors.WithMessagef(err, "s3 path %q", s)
+	}
+	return Path{Bucket: bucket, Key: key}, nil
+}
+
+// String returns the path as s3://<bucket>/<key>
+func (p Path) String() string {
+	return Scheme + p.Bucket + "/" + p.Key
+}
+
+// Join appends elements to the key, separated by exactly one slash. A trailing slash of the last element is kept.
+func (p Path) Join(elem ...string) Path {
+	key := p.Key
+	for _, e := range elem {
+		if e == "" {
+			continue
+		}
+		if key != "" {
+			key = strings.TrimRight(key, "/") + "/"
+		}
+		key += strings.TrimLeft(e, "/")
+	}
+	return Path{Bucket: p.Bucket, Key: key}
+}
+
+// IsPrefix returns true if the path is a bucket or ends with a slash
+func (p Path) IsPrefix() bool {
+	return p.Key == "" || strings.HasSuffix(p.Key, "/")
+}
+
+// ValidateBucketName checks the S3 bucket naming rules
+// https://docs.aws.amazon.com/AmazonS3/latest/dev/BucketRestrictions.html
+func ValidateBucketName(name string) error {
+	if len(name) < 3 || len(name) > 63 {
+		return errors.Errorf("bucket %q must be between 3 and 63 characters long", name)
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '-':
+		case c >= 'A' && c <= 'Z':
+			return errors.Errorf("bucket %q must not have uppercase letters", name)
+		default:
+			return errors.Errorf("bucket %q has invalid character %q", name, c)
+		}
+	}
+	if !isAlphanumeric(name[0]) || !isAlphanumeric(name[len(name)-1]) {
+		return errors.Errorf("bucket %q must begin and end with a letter or number", name)
+	}
+	if strings.Contains(name, "..") {
+		return errors.Errorf("bucket %q must not have adjacent periods", name)
+	}
+	if net.ParseIP(name) != nil {
+		return errors.Errorf("bucket %q must not be formatted as an IP address", name)
+	}
+	if strings.HasPrefix(name, "xn--") {
+		return errors.Errorf("bucket %q must not start with xn--", name)
+	}
+	return nil
+}
+
+func validateKey(key string) error {
+	if len(key) > maxKeyLength {
+		return errors.Errorf("key is longer than %d bytes", maxKeyLength)
+	}
+	if !utf8.ValidString(key) {
+		return errors.New("key is not valid UTF-8")
+	}
+	for _, c := range key {
+		if c < 0x20 || c == 0x7f {
+			return errors.Errorf("key has control character %q", c)
+		}
+	}
+	return nil
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
@@ -0,0 +1,123 @@
+package s3path
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		path  Path
+	}{
+		{"s3://bucket", Path{Bucket: "bucket"}},
+		{"s3://bucket/", Path{Bucket: "bucket"}},
+		{"s3://bucket/prefix", Path{Bucket: "bucket", Key: "prefix"}},
+		{"s3://bucket/prefix/", Path{Bucket: "bucket", Key: "prefix/"}},
+		{"s3://my.bucket-1/a/b/c.json.gz", Path{Bucket: "my.bucket-1", Key: "a/b/c.json.gz"}},
+		{"s3://bucket/year=2020/month=11/", Path{Bucket: "bucket", Key: "year=2020/month=11/"}},
+		// keys are literal
+		{"s3://bucket/a%20b", Path{Bucket: "bucket", Key: "a%20b"}},
+		{"s3://bucket/a b", Path{Bucket: "bucket", Key: "a b"}},
+		{"s3://bucket/a?b#c", Path{Bucket: "bucket", Key: "a?b#c"}},
+		{"s3://bucket/a+b", Path{Bucket: "bucket", Key: "a+b"}},
+		{"s3://bucket//a", Path{Bucket: "bucket", Key: "/a"}},
+		{"s3://bucket/ünïcode", Path{Bucket: "bucket", Key: "ünïcode"}},
+	} {
+		tc := tc
+		t.Run(tc.input, func(t *testing.T) {
+			path, err := Parse(tc.input)
+			require.NoError(t, err)
+			assert.Equal(t, tc.path, path)
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		err   string
+	}{
+		{"", "empty s3 path"},
+		{"bucket/prefix", "does not start with s3://"},
+		{"/bucket/prefix", "does not start with s3://"},
+		{"s3:/bucket/prefix", "does not start with s3://"},
+		{"s3:bucket/prefix", "does not start with s3://"},
+		{" s3://bucket/prefix", "has scheme \" s3\""},
+		{"S3://bucket/prefix", "has scheme \"S3\""},
+		{"s3a://bucket/prefix", "has scheme \"s3a\""},
+		{"https://bucket.s3.amazonaws.com/prefix", "has scheme \"https\""},
+		{"s3://", "has no bucket"},
+		{"s3:///prefix", "has no bucket"},
+		{"s3://ab", "between 3 and 63 characters"},
+		{"s3://" + strings.Repeat("a", 64), "between 3 and 63 characters"},
+		{"s3://Bucket/prefix", "must not have uppercase letters"},
+		{"s3://my_bucket/prefix", "invalid character '_'"},
+		{"s3://bucket:443/prefix", "invalid character ':'"},
+		{"s3://user@bucket/prefix", "invalid character '@'"},
+		{"s3://bucket?x=1", "invalid character '?'"},
+		{"s3://-bucket/prefix", "must begin and end with a letter or number"},
+		{"s3://bucket./prefix", "must begin and end with a letter or number"},
+		{"s3://my..bucket/prefix", "must not have adjacent periods"},
+		{"s3://192.168.1.1/prefix", "must not be formatted as an IP address"},
+		{"s3://xn--bucket/prefix", "must not start with xn--"},
+		{"s3://bucket/" + strings.Repeat("a", 1025), "key is longer than 1024 bytes"},
+		{"s3://bucket/a\nb", "key has control character"},
+		{"s3://bucket/a\tb", "key has control character"},
+		{"s3://bucket/\xff", "key is not valid UTF-8"},
+	} {
+		tc := tc
+		t.Run(tc.input, func(t *testing.T) {
+			_, err := Parse(tc.input)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	for _, input := range []string{"s3://bucket/", "s3://bucket/prefix", "s3://bucket/prefix/", "s3://bucket/a%20b"} {
+		path, err := Parse(input)
+		require.NoError(t, err)
+		assert.Equal(t, input, path.String())
+	}
+	// the bucket alone is a prefix
+	assert.Equal(t, "s3://bucket/", Path{Bucket: "bucket"}.String())
+}
+
+func TestJoin(t *testing.T) {
+	bucket := Path{Bucket: "bucket"}
+	assert.Equal(t, Path{Bucket: "bucket", Key: "a/b"}, bucket.Join("a", "b"))
+	assert.Equal(t, Path{Bucket: "bucket", Key: "a/b/"}, bucket.Join("a/", "/b/"))
+	assert.Equal(t, Path{Bucket: "bucket", Key: "a/b"}, bucket.Join("", "a", "", "b"))
+	assert.Equal(t, Path{Bucket: "bucket", Key: "logs/table/year=2020/"},
+		Path{Bucket: "bucket", Key: "logs/"}.Join("table", "year=2020/"))
+	assert.Equal(t, Path{Bucket: "bucket", Key: "logs/"}, Path{Bucket: "bucket", Key: "logs/"}.Join())
+}
+
+func TestIsPrefix(t *testing.T) {
+	assert.True(t, Path{Bucket: "bucket"}.IsPrefix())
+	assert.True(t, Path{Bucket: "bucket", Key: "a/"}.IsPrefix())
+	assert.False(t, Path{Bucket: "bucket", Key: "a"}.IsPrefix())
+}
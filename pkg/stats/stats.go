@@ -0,0 +1,201 @@
+package stats
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Counter is a monotonic count, it is safe for concurrent use
+type Counter struct {
+	value uint64 // first for atomic alignment on 32bit platforms
+	name  string
+}
+
+// Inc counts one
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add counts n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value is the current count
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) Name() string {
+	return c.name
+}
+
+// Gauge is a value that goes up and down, it is safe for concurrent use
+type Gauge struct {
+	value int64 // first for atomic alignment on 32bit platforms
+	name  string
+}
+
+// Set replaces the value
+func (g *Gauge) Set(value int64) {
+	atomic.StoreInt64(&g.value, value)
+}
+
+// Add changes the value by delta (which can be negative)
+func (g *Gauge) Add(delta int64) {
+	atomic.AddInt64(&g.value, delta)
+}
+
+// Value is the current value
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+func (g *Gauge) Name() string {
+	return g.name
+}
+
+// Collector holds named counters and gauges. Registering is synchronized, updates are lock free.
+type Collector struct {
+	mu       sync.Mutex
+	counters map[string]*Counter
+	gauges   map[string]*Gauge
+	start    time.Time
+	now      func() time.Time
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		counters: make(map[string]*Counter),
+		gauges:   make(map[string]*Gauge),
+		start:    time.Now(),
+		now:      time.Now,
+	}
+}
+
+// Counter returns the counter with this name, registering it if needed
+func (c *Collector) Counter(name string) *Counter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counter, ok := c.counters[name]
+	if !ok {
+		counter = &Counter{name: name}
+		c.counters[name] = counter
+	}
+	return counter
+}
+
+// Gauge returns the gauge with this name, registering it if needed
+func (c *Collector) Gauge(name string) *Gauge {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	gauge, ok := c.gauges[name]
+	if !ok {
+		gauge = &Gauge{name: name}
+		c.gauges[name] = gauge
+	}
+	return gauge
+}
+
+// Snapshot reads all the values. Values are read one at a time, updates during the snapshot can be partially included.
+func (c *Collector) Snapshot() *Snapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	snapshot := &Snapshot{
+		Time:     now,
+		Elapsed:  now.Sub(c.start),
+		Counters: make(map[string]uint64, len(c.counters)),
+	}
+	for name, counter := range c.counters {
+		snapshot.Counters[name] = counter.Value()
+	}
+	if len(c.gauges) > 0 {
+		snapshot.Gauges = make(map[string]int64, len(c.gauges))
+		for name, gauge := range c.gauges {
+			snapshot.Gauges[name] = gauge.Value()
+		}
+	}
+	return snapshot
+}
+
+// Snapshot is a point-in-time copy of the values of a collector.
+// Its JSON has the keys in sorted order, so that snapshots of the same collector can be diffed.
+type Snapshot struct {
+	Time     time.Time         `json:"time"`
+	Elapsed  time.Duration     `json:"elapsed"` // since the collector was created
+	Counters map[string]uint64 `json:"counters"`
+	Gauges   map[string]int64  `json:"gauges,omitempty"`
+	// Rates are set by WithRates
+	Rates map[string]float64 `json:"rates,omitempty"`
+}
+
+// MarshalJSON sorts the map keys like encoding/json, the default jsoniter configuration does not
+func (s *Snapshot) MarshalJSON() ([]byte, error) {
+	type snapshot Snapshot // without the MarshalJSON method
+	return jsoniter.ConfigCompatibleWithStandardLibrary.Marshal((*snapshot)(s))
+}
+
+// Counter returns the value of a counter, 0 if it is not in the snapshot
+func (s *Snapshot) Counter(name string) uint64 {
+	return s.Counters[name]
+}
+
+// Gauge returns the value of a gauge, 0 if it is not in the snapshot
+func (s *Snapshot) Gauge(name string) int64 {
+	return s.Gauges[name]
+}
+
+// Names returns the counter names in sorted order
+func (s *Snapshot) Names() []string {
+	names := make([]string, 0, len(s.Counters))
+	for name := range s.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithRates sets the per second rates of the counters since a previous snapshot.
+// If previous is nil, the rates are since the collector was created.
+func (s *Snapshot) WithRates(previous *Snapshot) *Snapshot {
+	elapsed := s.Elapsed
+	if previous != nil {
+		elapsed = s.Time.Sub(previous.Time)
+	}
+	s.Rates = make(map[string]float64, len(s.Counters))
+	for name, value := range s.Counters {
+		var base uint64
+		if previous != nil {
+			base = previous.Counters[name]
+		}
+		if elapsed > 0 && value >= base {
+			s.Rates[name] = float64(value-base) / elapsed.Seconds()
+		} else {
+			s.Rates[name] = 0
+		}
+	}
+	return s
+}
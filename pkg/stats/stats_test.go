@@ -0,0 +1,134 @@
+package stats
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testStart = time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestCollector(now *time.Time) *Collector {
+	collector := NewCollector()
+	collector.start = testStart
+	collector.now = func() time.Time { return *now }
+	return collector
+}
+
+func TestCollector(t *testing.T) {
+	now := testStart.Add(10 * time.Second)
+	collector := newTestCollector(&now)
+	files := collector.Counter("numFiles")
+	assert.Same(t, files, collector.Counter("numFiles"))
+	assert.Equal(t, "numFiles", files.Name())
+	files.Inc()
+	files.Add(9)
+	collector.Counter("numBytes").Add(1000)
+	collector.Gauge("inFlight").Set(5)
+	collector.Gauge("inFlight").Add(-2)
+
+	snapshot := collector.Snapshot()
+	assert.Equal(t, &Snapshot{
+		Time:     now,
+		Elapsed:  10 * time.Second,
+		Counters: map[string]uint64{"numFiles": 10, "numBytes": 1000},
+		Gauges:   map[string]int64{"inFlight": 3},
+	}, snapshot)
+	assert.Equal(t, uint64(10), snapshot.Counter("numFiles"))
+	assert.Equal(t, uint64(0), snapshot.Counter("missing"))
+	assert.Equal(t, int64(3), snapshot.Gauge("inFlight"))
+	assert.Equal(t, []string{"numBytes", "numFiles"}, snapshot.Names())
+
+	// snapshots are copies
+	files.Inc()
+	assert.Equal(t, uint64(10), snapshot.Counter("numFiles"))
+	assert.Equal(t, uint64(11), collector.Snapshot().Counter("numFiles"))
+}
+
+func TestSnapshotJSON(t *testing.T) {
+	now := testStart.Add(time.Second)
+	collector := newTestCollector(&now)
+	for _, name := range []string{"c", "a", "b", "e", "d"} {
+		collector.Counter(name).Inc()
+	}
+	expected := `{"time":"2020-11-01T00:00:01Z","elapsed":1000000000,"counters":{"a":1,"b":1,"c":1,"d":1,"e":1}}`
+	for i := 0; i < 10; i++ { // map order is random, the keys must be sorted every time
+		data, err := jsoniter.MarshalToString(collector.Snapshot())
+		require.NoError(t, err)
+		assert.Equal(t, expected, data)
+	}
+
+	var snapshot Snapshot
+	require.NoError(t, jsoniter.UnmarshalFromString(expected, &snapshot))
+	assert.Equal(t, uint64(1), snapshot.Counter("e"))
+}
+
+func TestWithRates(t *testing.T) {
+	now := testStart.Add(10 * time.Second)
+	collector := newTestCollector(&now)
+	counter := collector.Counter("numFiles")
+	counter.Add(100)
+	first := collector.Snapshot().WithRates(nil)
+	assert.Equal(t, map[string]float64{"numFiles": 10}, first.Rates)
+
+	now = now.Add(5 * time.Second)
+	counter.Add(50)
+	collector.Counter("numBytes").Add(10)
+	second := collector.Snapshot().WithRates(first)
+	assert.Equal(t, map[string]float64{"numFiles": 10, "numBytes": 2}, second.Rates)
+
+	// no time between snapshots
+	assert.Equal(t, map[string]float64{"numFiles": 0, "numBytes": 0}, collector.Snapshot().WithRates(second).Rates)
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	collector := NewCollector()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				collector.Counter("count").Inc()
+				collector.Gauge("level").Add(1)
+				collector.Gauge("level").Add(-1)
+				_ = collector.Snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+	snapshot := collector.Snapshot()
+	assert.Equal(t, uint64(8000), snapshot.Counter("count"))
+	assert.Equal(t, int64(0), snapshot.Gauge("level"))
+}
+
+func BenchmarkCounterInc(b *testing.B) {
+	counter := NewCollector().Counter("count")
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			counter.Inc()
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package awsfake
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSpec = ListingSpec{
+	Bucket:         "bucket",
+	Prefix:         "logs/",
+	Start:          time.Date(2020, 12, 31, 22, 30, 0, 0, time.UTC),
+	Hours:          3,
+	ObjectsPerHour: 5,
+	MinSize:        10,
+	MaxSize:        20,
+	PageSize:       4,
+}
+
+func listAll(t *testing.T, client *S3, input *s3.ListObjectsV2Input) (keys []string) {
+	err := client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+		return true
+	})
+	require.NoError(t, err)
+	return keys
+}
+
+func TestS3Listing(t *testing.T) {
+	client := NewS3(testSpec)
+	keys := listAll(t, client, &s3.ListObjectsV2Input{Bucket: aws.String("bucket")})
+	require.Len(t, keys, 15)
+	assert.Equal(t, 4, client.Pages())
+	assert.Equal(t, "logs/year=2020/month=12/day=31/hour=22/000000.json.gz", keys[0])
+	assert.Equal(t, "logs/year=2021/month=01/day=01/hour=00/000004.json.gz", keys[14])
+	assert.True(t, sort.StringsAreSorted(keys))
+
+	for i := 0; i < testSpec.NumObjects(); i++ {
+		object := testSpec.Object(i)
+		assert.Equal(t, testSpec.Object(i), object) // deterministic
+		assert.GreaterOrEqual(t, *object.Size, testSpec.MinSize)
+		assert.LessOrEqual(t, *object.Size, testSpec.MaxSize)
+	}
+}
+
+func TestS3ListingPrefix(t *testing.T) {
+	client := NewS3(testSpec)
+	keys := listAll(t, client, &s3.ListObjectsV2Input{
+		Bucket: aws.String("bucket"),
+		Prefix: aws.String("logs/year=2020/month=12/day=31/hour=23/"),
+	})
+	require.Len(t, keys, 5)
+	assert.Equal(t, "logs/year=2020/month=12/day=31/hour=23/000000.json.gz", keys[0])
+
+	keys = listAll(t, client, &s3.ListObjectsV2Input{
+		Bucket:     aws.String("bucket"),
+		Prefix:     aws.String("logs/year=2021/"),
+		StartAfter: aws.String("logs/year=2021/month=01/day=01/hour=00/000002.json.gz"),
+	})
+	assert.Equal(t, []string{
+		"logs/year=2021/month=01/day=01/hour=00/000003.json.gz",
+		"logs/year=2021/month=01/day=01/hour=00/000004.json.gz",
+	}, keys)
+
+	assert.Empty(t, listAll(t, client, &s3.ListObjectsV2Input{Bucket: aws.String("bucket"), Prefix: aws.String("other/")}))
+}
+
+func TestS3ListingDelimiter(t *testing.T) {
+	client := NewS3(testSpec)
+	var prefixes []string
+	err := client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String("bucket"),
+		Prefix:    aws.String("logs/"),
+		Delimiter: aws.String("/"),
+		MaxKeys:   aws.Int64(1),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		assert.Empty(t, page.Contents)
+		for _, prefix := range page.CommonPrefixes {
+			prefixes = append(prefixes, aws.StringValue(prefix.Prefix))
+		}
+		return true
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"logs/year=2020/", "logs/year=2021/"}, prefixes)
+	assert.Equal(t, 2, client.Pages())
+
+	page, err := client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:    aws.String("bucket"),
+		Prefix:    aws.String("logs/year=2020/month=12/day=31/"),
+		Delimiter: aws.String("/"),
+	})
+	require.NoError(t, err)
+	require.Len(t, page.CommonPrefixes, 2)
+	assert.Equal(t, "logs/year=2020/month=12/day=31/hour=23/", aws.StringValue(page.CommonPrefixes[1].Prefix))
+	assert.Empty(t, page.Contents)
+
+	// objects directly under the prefix
+	keys := listAll(t, client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String("bucket"),
+		Prefix:    aws.String("logs/year=2020/month=12/day=31/hour=22/"),
+		Delimiter: aws.String("/"),
+	})
+	assert.Len(t, keys, 5)
+}
+
+func TestS3ListingFailure(t *testing.T) {
+	spec := testSpec
+	spec.FailAtPage = 2
+	spec.FailErr = errors.New("injected")
+	client := NewS3(spec)
+	pages := 0
+	err := client.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String("bucket")},
+		func(*s3.ListObjectsV2Output, bool) bool {
+			pages++
+			return true
+		})
+	assert.Equal(t, spec.FailErr, err)
+	assert.Equal(t, 1, pages)
+
+	_, err = client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String("missing")})
+	assert.Error(t, err)
+}
+
+func TestS3HeadObject(t *testing.T) {
+	client := NewS3(testSpec)
+	object := testSpec.Object(7)
+	output, err := client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: object.Key})
+	require.NoError(t, err)
+	assert.Equal(t, object.Size, output.ContentLength)
+	assert.Equal(t, object.ETag, output.ETag)
+	assert.Equal(t, object.LastModified, output.LastModified)
+
+	_, err = client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("logs/missing")})
+	var failure awserr.RequestFailure
+	require.True(t, errors.As(err, &failure))
+	assert.Equal(t, http.StatusNotFound, failure.StatusCode())
+}
+
+func TestS3RequesterPays(t *testing.T) {
+	spec := testSpec
+	spec.RequesterPays = true
+	client := NewS3(spec)
+	_, err := client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String("bucket")})
+	var failure awserr.RequestFailure
+	require.True(t, errors.As(err, &failure))
+	assert.Equal(t, http.StatusForbidden, failure.StatusCode())
+	_, err = client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: spec.Object(0).Key})
+	require.True(t, errors.As(err, &failure))
+	assert.Equal(t, http.StatusForbidden, failure.StatusCode())
+
+	output, err := client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:       aws.String("bucket"),
+		RequestPayer: aws.String(s3.RequestPayerRequester),
+	})
+	require.NoError(t, err)
+	assert.NotEmpty(t, output.Contents)
+	_, err = client.HeadObject(&s3.HeadObjectInput{
+		Bucket:       aws.String("bucket"),
+		Key:          spec.Object(0).Key,
+		RequestPayer: aws.String(s3.RequestPayerRequester),
+	})
+	require.NoError(t, err)
+}
+
+func TestSQSSink(t *testing.T) {
+	sink := &SQSSink{Failures: Failures{ThrottleEvery: 2}}
+	input := &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String("url"),
+		Entries:  []*sqs.SendMessageBatchRequestEntry{{Id: aws.String("0"), MessageBody: aws.String("a")}},
+	}
+	_, err := sink.SendMessageBatch(input)
+	require.NoError(t, err)
+	_, err = sink.SendMessageBatch(input)
+	require.Error(t, err) // throttled
+	_, err = sink.SendMessage(&sqs.SendMessageInput{MessageBody: aws.String("b")})
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, sink.Calls())
+	messages := sink.Messages()
+	require.Len(t, messages, 2)
+	assert.Equal(t, "a", *messages[0].MessageBody)
+	assert.Equal(t, "b", *messages[1].MessageBody)
+}
+
+func TestSNSSink(t *testing.T) {
+	failure := errors.New("down")
+	sink := &SNSSink{}
+	_, err := sink.Publish(&sns.PublishInput{Message: aws.String("a")})
+	require.NoError(t, err)
+	sink.Failures.Err = failure
+	_, err = sink.Publish(&sns.PublishInput{Message: aws.String("b")})
+	assert.Equal(t, failure, err)
+
+	assert.Equal(t, 2, sink.Calls())
+	require.Len(t, sink.Published(), 1)
+	assert.Equal(t, "a", *sink.Published()[0].Message)
+}
@@ -0,0 +1,285 @@
+package awsfake
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const defaultPageSize = 1000
+
+// ListingSpec describes a synthetic bucket. Keys are laid out by hour like the log processor output,
+// e.g. <Prefix>year=2020/month=01/day=02/hour=03/000042.json.gz
+// Everything is derived from the spec, so the same spec always lists the same objects.
+type ListingSpec struct {
+	Bucket string
+	Prefix string
+	// Start is the hour of the first objects, Hours the number of hours with ObjectsPerHour objects each
+	Start          time.Time
+	Hours          int
+	ObjectsPerHour int
+	// Object sizes are uniformly distributed between MinSize and MaxSize, Seed changes the draw
+	MinSize int64
+	MaxSize int64
+	Seed    uint64
+	// StorageClasses sets the storage class of the objects with these indexes, the others are STANDARD
+	StorageClasses map[int]string
+	// KeySuffixes are appended to the keys of the objects with these indexes, e.g. to list special characters
+	KeySuffixes map[int]string
+	// PageSize is the number of keys per page when MaxKeys is not set (default 1000)
+	PageSize int
+	// FailAtPage makes the listing of the page with this number (1 based, counted across calls) fail with FailErr
+	FailAtPage int
+	FailErr    error
+	// RequesterPays denies the list and head calls without RequestPayer=requester, as s3 does for requester-pays buckets
+	RequesterPays bool
+	// Owner is the account of the bucket, the calls with another ExpectedBucketOwner are denied
+	Owner string
+}
+
+// returns the 403 of s3 to the requests of a requester-pays bucket that are not billed to the caller,
+// and to the requests expecting another owner
+func (spec *ListingSpec) checkAccess(requestPayer, expectedOwner *string) error {
+	notBilled := spec.RequesterPays && aws.StringValue(requestPayer) != s3.RequestPayerRequester
+	otherOwner := expectedOwner != nil && *expectedOwner != spec.Owner
+	if notBilled || otherOwner {
+		return awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "")
+	}
+	return nil
+}
+
+// NumObjects is the number of objects in the bucket
+func (spec *ListingSpec) NumObjects() int {
+	return spec.Hours * spec.ObjectsPerHour
+}
+
+// Key returns the key of the i-th object, keys sort in index order
+func (spec *ListingSpec) Key(i int) string {
+	hour := spec.Start.Truncate(time.Hour).Add(time.Duration(i/spec.ObjectsPerHour) * time.Hour)
+	return fmt.Sprintf("%syear=%d/month=%02d/day=%02d/hour=%02d/%06d.json.gz%s",
+		spec.Prefix, hour.Year(), hour.Month(), hour.Day(), hour.Hour(), i%spec.ObjectsPerHour, spec.KeySuffixes[i])
+}
+
+// Object returns the i-th object
+func (spec *ListingSpec) Object(i int) *s3.Object {
+	hash := splitmix64(spec.Seed ^ uint64(i))
+	size := spec.MinSize
+	if spec.MaxSize > spec.MinSize {
+		size += int64(hash % uint64(spec.MaxSize-spec.MinSize+1))
+	}
+	hour := spec.Start.Truncate(time.Hour).Add(time.Duration(i/spec.ObjectsPerHour) * time.Hour)
+	storageClass, ok := spec.StorageClasses[i]
+	if !ok {
+		storageClass = s3.ObjectStorageClassStandard
+	}
+	return &s3.Object{
+		Key:          aws.String(spec.Key(i)),
+		Size:         aws.Int64(size),
+		ETag:         aws.String(fmt.Sprintf(`"%016x%016x"`, hash, splitmix64(hash))),
+		LastModified: aws.Time(hour.Add(time.Duration(i%spec.ObjectsPerHour) * time.Second)),
+		StorageClass: aws.String(storageClass),
+	}
+}
+
+// S3 is an s3iface.S3API listing the objects of a ListingSpec. It is safe for concurrent use.
+type S3 struct {
+	s3iface.S3API
+	Spec ListingSpec
+
+	mu    sync.Mutex
+	pages int
+}
+
+// NewS3 returns a fake listing the spec
+func NewS3(spec ListingSpec) *S3 {
+	return &S3{Spec: spec}
+}
+
+// Pages returns the number of pages listed so far
+func (s *S3) Pages() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pages
+}
+
+func (s *S3) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	s.mu.Lock()
+	s.pages++
+	page := s.pages
+	s.mu.Unlock()
+
+	bucket := aws.StringValue(input.Bucket)
+	if bucket != s.Spec.Bucket {
+		return nil, awserr.New(s3.ErrCodeNoSuchBucket, "The specified bucket does not exist: "+bucket, nil)
+	}
+	if err := s.Spec.checkAccess(input.RequestPayer, input.ExpectedBucketOwner); err != nil {
+		return nil, err
+	}
+	if page == s.Spec.FailAtPage {
+		err := s.Spec.FailErr
+		if err == nil {
+			err = awserr.New("InternalError", "injected failure", nil)
+		}
+		return nil, err
+	}
+
+	prefix := aws.StringValue(input.Prefix)
+	maxKeys := int(aws.Int64Value(input.MaxKeys))
+	if maxKeys <= 0 {
+		maxKeys = s.Spec.PageSize
+	}
+	if maxKeys <= 0 {
+		maxKeys = defaultPageSize
+	}
+
+	numObjects := s.Spec.NumObjects()
+	// keys sort in index order, so the first candidate is found by binary search
+	start := sort.Search(numObjects, func(i int) bool {
+		return s.Spec.Key(i) >= prefix && s.Spec.Key(i) > aws.StringValue(input.StartAfter)
+	})
+	if token := aws.StringValue(input.ContinuationToken); token != "" {
+		next, err := strconv.Atoi(token)
+		if err != nil {
+			return nil, awserr.New("InvalidArgument", "The continuation token provided is incorrect", err)
+		}
+		start = next
+	}
+
+	output := &s3.ListObjectsV2Output{
+		Name:              input.Bucket,
+		Prefix:            input.Prefix,
+		MaxKeys:           aws.Int64(int64(maxKeys)),
+		ContinuationToken: input.ContinuationToken,
+		IsTruncated:       aws.Bool(false),
+	}
+	delimiter := aws.StringValue(input.Delimiter)
+	i := start
+	for numKeys := 0; i < numObjects && numKeys < maxKeys; numKeys++ {
+		key := s.Spec.Key(i)
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if pos := strings.Index(key[len(prefix):], delimiter); delimiter != "" && pos != -1 {
+			// the keys of a common prefix are contiguous, they are rolled up into a single entry
+			commonPrefix := key[:len(prefix)+pos+len(delimiter)]
+			output.CommonPrefixes = append(output.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(commonPrefix)})
+			i = sort.Search(numObjects, func(j int) bool {
+				key := s.Spec.Key(j)
+				return key > commonPrefix && !strings.HasPrefix(key, commonPrefix)
+			})
+			continue
+		}
+		output.Contents = append(output.Contents, s.Spec.Object(i))
+		i++
+	}
+	output.KeyCount = aws.Int64(int64(len(output.Contents) + len(output.CommonPrefixes)))
+	if i < numObjects && strings.HasPrefix(s.Spec.Key(i), prefix) {
+		output.IsTruncated = aws.Bool(true)
+		output.NextContinuationToken = aws.String(strconv.Itoa(i))
+	}
+	return output, nil
+}
+
+func (s *S3) ListObjectsV2WithContext(
+	_ aws.Context, input *s3.ListObjectsV2Input, _ ...request.Option) (*s3.ListObjectsV2Output, error) {
+
+	return s.ListObjectsV2(input)
+}
+
+func (s *S3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	return s.ListObjectsV2PagesWithContext(aws.BackgroundContext(), input, fn)
+}
+
+func (s *S3) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input,
+	fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+
+	pageInput := *input
+	for {
+		if err := ctx.Err(); err != nil {
+			return awserr.New(request.CanceledErrorCode, "request context canceled", err)
+		}
+		page, err := s.ListObjectsV2(&pageInput)
+		if err != nil {
+			return err
+		}
+		lastPage := !aws.BoolValue(page.IsTruncated)
+		if !fn(page, lastPage) || lastPage {
+			return nil
+		}
+		pageInput.ContinuationToken = page.NextContinuationToken
+	}
+}
+
+func (s *S3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	bucket, key := aws.StringValue(input.Bucket), aws.StringValue(input.Key)
+	if bucket != s.Spec.Bucket {
+		return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "")
+	}
+	if err := s.Spec.checkAccess(input.RequestPayer, input.ExpectedBucketOwner); err != nil {
+		return nil, err
+	}
+	numObjects := s.Spec.NumObjects()
+	i := sort.Search(numObjects, func(i int) bool {
+		return s.Spec.Key(i) >= key
+	})
+	if i == numObjects || s.Spec.Key(i) != key {
+		return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "")
+	}
+	object := s.Spec.Object(i)
+	return &s3.HeadObjectOutput{
+		ContentLength: object.Size,
+		ETag:          object.ETag,
+		LastModified:  object.LastModified,
+		StorageClass:  object.StorageClass,
+	}, nil
+}
+
+func (s *S3) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	if aws.StringValue(input.Bucket) != s.Spec.Bucket {
+		return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "")
+	}
+	if err := s.Spec.checkAccess(nil, input.ExpectedBucketOwner); err != nil {
+		return nil, err
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (s *S3) HeadObjectWithContext(_ aws.Context, input *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	return s.HeadObject(input)
+}
+
+// splitmix64 is a cheap deterministic hash, seeding a rand.Rand per object would dominate large listings
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
@@ -0,0 +1,151 @@
+package awsfake
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// Failures decides which calls of a sink fail. The zero value never fails.
+type Failures struct {
+	// ThrottleEvery makes every n-th call fail with a throttling error
+	ThrottleEvery int
+	// Err makes every call fail with this error
+	Err error
+}
+
+func (f *Failures) check(call int, throttleCode string) error {
+	if f.Err != nil {
+		return f.Err
+	}
+	if f.ThrottleEvery > 0 && call%f.ThrottleEvery == 0 {
+		return awserr.New(throttleCode, "Rate exceeded", nil)
+	}
+	return nil
+}
+
+// SQSSink is an sqsiface.SQSAPI recording the messages sent to any queue. It is safe for concurrent use.
+type SQSSink struct {
+	sqsiface.SQSAPI
+	Failures Failures
+
+	mu       sync.Mutex
+	calls    int
+	messages []*sqs.SendMessageBatchRequestEntry
+}
+
+// Calls returns the number of send calls, including failed ones
+func (s *SQSSink) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// Messages returns the messages sent successfully, in order
+func (s *SQSSink) Messages() []*sqs.SendMessageBatchRequestEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*sqs.SendMessageBatchRequestEntry(nil), s.messages...)
+}
+
+// nolint (golint)
+func (s *SQSSink) GetQueueUrl(input *sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput, error) {
+	return &sqs.GetQueueUrlOutput{
+		QueueUrl: aws.String("https://sqs.us-east-1.amazonaws.com/123456789012/" + aws.StringValue(input.QueueName)),
+	}, nil
+}
+
+func (s *SQSSink) SendMessageBatch(input *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if err := s.Failures.check(s.calls, "RequestThrottled"); err != nil {
+		return nil, err
+	}
+	output := &sqs.SendMessageBatchOutput{}
+	for _, entry := range input.Entries {
+		s.messages = append(s.messages, entry)
+		output.Successful = append(output.Successful, &sqs.SendMessageBatchResultEntry{
+			Id:        entry.Id,
+			MessageId: aws.String(strconv.Itoa(len(s.messages))),
+		})
+	}
+	return output, nil
+}
+
+func (s *SQSSink) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if err := s.Failures.check(s.calls, "RequestThrottled"); err != nil {
+		return nil, err
+	}
+	s.messages = append(s.messages, &sqs.SendMessageBatchRequestEntry{
+		Id:                     aws.String(strconv.Itoa(len(s.messages))),
+		MessageBody:            input.MessageBody,
+		MessageAttributes:      input.MessageAttributes,
+		MessageGroupId:         input.MessageGroupId,
+		MessageDeduplicationId: input.MessageDeduplicationId,
+		DelaySeconds:           input.DelaySeconds,
+	})
+	return &sqs.SendMessageOutput{MessageId: aws.String(strconv.Itoa(len(s.messages)))}, nil
+}
+
+// SNSSink is an snsiface.SNSAPI recording the messages published to any topic. It is safe for concurrent use.
+type SNSSink struct {
+	snsiface.SNSAPI
+	Failures Failures
+
+	mu        sync.Mutex
+	calls     int
+	published []*sns.PublishInput
+}
+
+// Calls returns the number of publish calls, including failed ones
+func (s *SNSSink) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// Published returns the messages published successfully, in order
+func (s *SNSSink) Published() []*sns.PublishInput {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*sns.PublishInput(nil), s.published...)
+}
+
+func (s *SNSSink) Publish(input *sns.PublishInput) (*sns.PublishOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if err := s.Failures.check(s.calls, "Throttled"); err != nil {
+		return nil, err
+	}
+	s.published = append(s.published, input)
+	return &sns.PublishOutput{MessageId: aws.String(strconv.Itoa(len(s.published)))}, nil
+}
@@ -25,6 +25,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/athena"
 	"github.com/aws/aws-sdk-go/service/athena/athenaiface"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/service/eventbridge"
@@ -81,6 +83,41 @@ func (m *S3Mock) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput,
 	return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
 }
 
+func (m *S3Mock) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput,
+	options ...request.Option) (*s3.CopyObjectOutput, error) {
+
+	args := m.Called(ctx, input, options)
+	return args.Get(0).(*s3.CopyObjectOutput), args.Error(1)
+}
+
+func (m *S3Mock) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput,
+	options ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+
+	args := m.Called(ctx, input, options)
+	return args.Get(0).(*s3.CreateMultipartUploadOutput), args.Error(1)
+}
+
+func (m *S3Mock) UploadPartCopyWithContext(ctx aws.Context, input *s3.UploadPartCopyInput,
+	options ...request.Option) (*s3.UploadPartCopyOutput, error) {
+
+	args := m.Called(ctx, input, options)
+	return args.Get(0).(*s3.UploadPartCopyOutput), args.Error(1)
+}
+
+func (m *S3Mock) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput,
+	options ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+
+	args := m.Called(ctx, input, options)
+	return args.Get(0).(*s3.CompleteMultipartUploadOutput), args.Error(1)
+}
+
+func (m *S3Mock) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput,
+	options ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+
+	args := m.Called(ctx, input, options)
+	return args.Get(0).(*s3.AbortMultipartUploadOutput), args.Error(1)
+}
+
 func (m *S3Mock) GetBucketLocation(input *s3.GetBucketLocationInput) (*s3.GetBucketLocationOutput, error) {
 	args := m.Called(input)
 	return args.Get(0).(*s3.GetBucketLocationOutput), args.Error(1)
@@ -163,6 +200,11 @@ func (m *DynamoDBMock) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.De
 	return args.Get(0).(*dynamodb.DeleteItemOutput), args.Error(1)
 }
 
+func (m *DynamoDBMock) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*dynamodb.TransactWriteItemsOutput), args.Error(1)
+}
+
 func (m *DynamoDBMock) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
 	args := m.Called(input)
 	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
@@ -246,6 +288,33 @@ func (m *SqsMock) DeleteQueue(input *sqs.DeleteQueueInput) (*sqs.DeleteQueueOutp
 	return args.Get(0).(*sqs.DeleteQueueOutput), args.Error(1)
 }
 
+func (m *SqsMock) ListQueues(input *sqs.ListQueuesInput) (*sqs.ListQueuesOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*sqs.ListQueuesOutput), args.Error(1)
+}
+
+// nolint (golint)
+func (m *SqsMock) GetQueueUrl(input *sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*sqs.GetQueueUrlOutput), args.Error(1)
+}
+
+func (m *SqsMock) PurgeQueueWithContext(
+	ctx aws.Context,
+	input *sqs.PurgeQueueInput,
+	options ...request.Option) (*sqs.PurgeQueueOutput, error) {
+
+	args := m.Called(ctx, input, options)
+	return args.Get(0).(*sqs.PurgeQueueOutput), args.Error(1)
+}
+
+func (m *SqsMock) ChangeMessageVisibilityBatch(
+	input *sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+
+	args := m.Called(input)
+	return args.Get(0).(*sqs.ChangeMessageVisibilityBatchOutput), args.Error(1)
+}
+
 type EventBridgeMock struct {
 	eventbridgeiface.EventBridgeAPI
 	mock.Mock
@@ -336,6 +405,11 @@ func (m *GlueMock) UpdatePartition(input *glue.UpdatePartitionInput) (*glue.Upda
 	return args.Get(0).(*glue.UpdatePartitionOutput), args.Error(1)
 }
 
+func (m *GlueMock) DeletePartition(input *glue.DeletePartitionInput) (*glue.DeletePartitionOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*glue.DeletePartitionOutput), args.Error(1)
+}
+
 // nolint:lll
 func (m *GlueMock) GetTablesPagesWithContext(
 	ctx aws.Context,
@@ -386,6 +460,23 @@ func (m *SnsMock) ConfirmSubscription(input *sns.ConfirmSubscriptionInput) (*sns
 	return args.Get(0).(*sns.ConfirmSubscriptionOutput), args.Error(1)
 }
 
+func (m *SnsMock) Subscribe(input *sns.SubscribeInput) (*sns.SubscribeOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*sns.SubscribeOutput), args.Error(1)
+}
+
+func (m *SnsMock) Unsubscribe(input *sns.UnsubscribeInput) (*sns.UnsubscribeOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*sns.UnsubscribeOutput), args.Error(1)
+}
+
+func (m *SnsMock) ListSubscriptionsByTopic(
+	input *sns.ListSubscriptionsByTopicInput) (*sns.ListSubscriptionsByTopicOutput, error) {
+
+	args := m.Called(input)
+	return args.Get(0).(*sns.ListSubscriptionsByTopicOutput), args.Error(1)
+}
+
 type FirehoseMock struct {
 	firehoseiface.FirehoseAPI
 	mock.Mock
@@ -399,3 +490,17 @@ func (m *FirehoseMock) PutRecordBatchWithContext(
 	args := m.Called(ctx, input, options)
 	return args.Get(0).(*firehose.PutRecordBatchOutput), args.Error(1)
 }
+
+type CloudWatchMock struct {
+	cloudwatchiface.CloudWatchAPI
+	mock.Mock
+}
+
+func (m *CloudWatchMock) GetMetricStatisticsWithContext(
+	ctx aws.Context,
+	input *cloudwatch.GetMetricStatisticsInput,
+	options ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+
+	args := m.Called(ctx, input, options)
+	return args.Get(0).(*cloudwatch.GetMetricStatisticsOutput), args.Error(1)
+}
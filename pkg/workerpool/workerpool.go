@@ -0,0 +1,187 @@
+package workerpool
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+)
+
+// Policy decides what happens to the remaining work when an item fails
+type Policy int
+
+const (
+	// FailFast stops the pool on the first error, items that have not started are skipped
+	FailFast Policy = iota
+	// ContinueOnError runs every item and collects all errors
+	ContinueOnError
+)
+
+// ErrStopped is returned by Submit when the pool no longer accepts work
+var ErrStopped = errors.New("worker pool stopped")
+
+// PanicError is the error of an item that panicked, the panic fails the item instead of crashing the process
+type PanicError struct {
+	Value interface{}
+	Stack []byte // of the goroutine that panicked
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("work item panicked: %v", e.Value)
+}
+
+// Func is a unit of work, it should return promptly once ctx is done
+type Func func(ctx context.Context) error
+
+// Stats counts the items that went through the pool
+type Stats struct {
+	Submitted uint64
+	Succeeded uint64
+	Failed    uint64
+	Skipped   uint64 // submitted after the pool stopped, never run
+}
+
+// Pool runs submitted work on a bounded number of goroutines and aggregates the errors.
+// Submit can be called from several goroutines but not after Wait. An item that panics fails with a PanicError.
+type Pool struct {
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	policy Policy
+	slots  chan struct{}
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	err     error
+	stopped bool // a FailFast item failed
+	stats   Stats
+}
+
+// New returns a pool running at most size items at a time. Canceling ctx stops the pool.
+func New(ctx context.Context, size int, policy Policy) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	poolCtx, cancel := context.WithCancel(ctx)
+	return &Pool{
+		parent: ctx,
+		ctx:    poolCtx,
+		cancel: cancel,
+		policy: policy,
+		slots:  make(chan struct{}, size),
+	}
+}
+
+// Context is passed to every item, it is done when the parent context is canceled or when a FailFast pool fails.
+// Producers feeding the pool should stop when it is done.
+func (p *Pool) Context() context.Context {
+	return p.ctx
+}
+
+// Submit runs fn as soon as a worker is free, blocking until then.
+// It returns ErrStopped without running fn if the pool stopped while waiting.
+func (p *Pool) Submit(fn Func) error {
+	p.mu.Lock()
+	p.stats.Submitted++
+	p.mu.Unlock()
+
+	select {
+	case p.slots <- struct{}{}:
+		// select picks at random when both are ready, do not start work on a stopped pool
+		if p.ctx.Err() != nil {
+			<-p.slots
+			p.skip()
+			return ErrStopped
+		}
+	case <-p.ctx.Done():
+		p.skip()
+		return ErrStopped
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.slots
+			p.wg.Done()
+		}()
+		p.complete(p.run(fn))
+	}()
+	return nil
+}
+
+// run calls fn, a panic is returned as a PanicError so that the slot and the wait group are always released
+func (p *Pool) run(fn Func) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return fn(p.ctx)
+}
+
+// Wait waits for the running items and returns all their errors combined.
+// If items were skipped because the parent context was canceled its error is included.
+func (p *Pool) Wait() error {
+	p.wg.Wait()
+	p.cancel() // release the context
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stats.Skipped > 0 && p.parent.Err() != nil {
+		return multierr.Append(p.err, p.parent.Err())
+	}
+	return p.err
+}
+
+// Stats returns a snapshot of the counters, it is safe to call while the pool is running
+func (p *Pool) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+func (p *Pool) skip() {
+	p.mu.Lock()
+	p.stats.Skipped++
+	p.mu.Unlock()
+}
+
+func (p *Pool) complete(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		p.stats.Succeeded++
+		return
+	}
+	p.stats.Failed++
+	// items interrupted because another item failed only echo the first failure
+	if p.stopped && errors.Is(err, context.Canceled) {
+		return
+	}
+	p.err = multierr.Append(p.err, err)
+	if p.policy == FailFast {
+		p.stopped = true
+		p.cancel()
+	}
+}
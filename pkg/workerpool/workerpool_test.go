@@ -0,0 +1,173 @@
+package workerpool
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/multierr"
+)
+
+func TestPoolBounded(t *testing.T) {
+	const size = 3
+	pool := New(context.Background(), size, FailFast)
+	var running, maxRunning int32
+	for i := 0; i < 20; i++ {
+		require.NoError(t, pool.Submit(func(ctx context.Context) error {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return nil
+		}))
+	}
+	require.NoError(t, pool.Wait())
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxRunning), int32(size))
+	assert.Equal(t, Stats{Submitted: 20, Succeeded: 20}, pool.Stats())
+}
+
+func TestPoolContinueOnError(t *testing.T) {
+	pool := New(context.Background(), 2, ContinueOnError)
+	for i := 0; i < 10; i++ {
+		i := i
+		require.NoError(t, pool.Submit(func(ctx context.Context) error {
+			if i%2 == 0 {
+				return errors.New("failed")
+			}
+			return nil
+		}))
+	}
+	err := pool.Wait()
+	require.Error(t, err)
+	assert.Len(t, multierr.Errors(err), 5)
+	assert.Equal(t, Stats{Submitted: 10, Succeeded: 5, Failed: 5}, pool.Stats())
+}
+
+func TestPoolFailFast(t *testing.T) {
+	pool := New(context.Background(), 2, FailFast)
+	failure := errors.New("failed")
+	blocked := make(chan struct{})
+	// one item waits on the context until the other fails
+	require.NoError(t, pool.Submit(func(ctx context.Context) error {
+		close(blocked)
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	<-blocked
+	require.NoError(t, pool.Submit(func(ctx context.Context) error {
+		return failure
+	}))
+
+	<-pool.Context().Done()
+	assert.Equal(t, ErrStopped, pool.Submit(func(ctx context.Context) error {
+		t.Error("item ran after the pool stopped")
+		return nil
+	}))
+
+	err := pool.Wait()
+	assert.Equal(t, failure, err) // the interrupted item does not add its cancellation
+	assert.Equal(t, Stats{Submitted: 3, Failed: 2, Skipped: 1}, pool.Stats())
+}
+
+func TestPoolPanic(t *testing.T) {
+	pool := New(context.Background(), 2, FailFast)
+	blocked := make(chan struct{})
+	require.NoError(t, pool.Submit(func(ctx context.Context) error {
+		close(blocked)
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	<-blocked
+	require.NoError(t, pool.Submit(func(ctx context.Context) error {
+		var attributes map[string]string
+		attributes["panther:type"] = "LogData" // assignment to a nil map
+		return nil
+	}))
+	<-pool.Context().Done() // the panic stops the pool like a failure
+
+	err := pool.Wait()
+	var panicErr *PanicError
+	require.True(t, errors.As(err, &panicErr))
+	assert.Equal(t, "work item panicked: assignment to entry in nil map", err.Error())
+	assert.Contains(t, string(panicErr.Stack), "TestPoolPanic")
+	assert.Equal(t, Stats{Submitted: 2, Failed: 2}, pool.Stats())
+}
+
+func TestPoolCancelMidStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := New(ctx, 4, ContinueOnError)
+
+	var ran int32
+	producerDone := make(chan error)
+	go func() { // a producer that keeps submitting until the pool stops
+		for {
+			err := pool.Submit(func(ctx context.Context) error {
+				atomic.AddInt32(&ran, 1)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(time.Millisecond):
+					return nil
+				}
+			})
+			if err != nil {
+				producerDone <- err
+				return
+			}
+		}
+	}()
+
+	for atomic.LoadInt32(&ran) < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assert.Equal(t, ErrStopped, <-producerDone)
+
+	err := pool.Wait()
+	assert.Contains(t, multierr.Errors(err), context.Canceled)
+
+	stats := pool.Stats()
+	assert.Equal(t, uint64(1), stats.Skipped)
+	assert.Equal(t, stats.Submitted, stats.Succeeded+stats.Failed+stats.Skipped)
+	assert.Equal(t, uint64(atomic.LoadInt32(&ran)), stats.Succeeded+stats.Failed)
+}
+
+func TestPoolCanceledBeforeSubmit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pool := New(ctx, 1, FailFast)
+	assert.Equal(t, ErrStopped, pool.Submit(func(ctx context.Context) error {
+		t.Error("item ran on a canceled pool")
+		return nil
+	}))
+	assert.Equal(t, context.Canceled, pool.Wait())
+	assert.Equal(t, Stats{Submitted: 1, Skipped: 1}, pool.Stats())
+}
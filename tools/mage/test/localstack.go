@@ -0,0 +1,51 @@
+package test
+
+/**
+ * Panther is a Cloud-Native SIEM for the Modern Security Team.
+ * Copyright (C) 2020 Panther Labs Inc
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/magefile/mage/mg"
+	"github.com/magefile/mage/sh"
+
+	"github.com/panther-labs/panther/tools/mage/logger"
+)
+
+// Run the LocalStack tests (build tag "localstack"), these start a LocalStack container unless LOCALSTACK_ENDPOINT is set
+func Localstack() error {
+	log = logger.Build("[test:localstack]")
+	if os.Getenv("LOCALSTACK_ENDPOINT") == "" {
+		if _, err := exec.LookPath("docker"); err != nil {
+			log.Warn("docker is not available and LOCALSTACK_ENDPOINT is not set, skipping LocalStack tests")
+			return nil
+		}
+	}
+
+	pkg := os.Getenv("PKG") // optionally run the tests of a single package
+	if pkg == "" {
+		pkg = "./..."
+	}
+	// -count 1 is the idiomatic way to disable test caching
+	args := []string{"test", "-tags", "localstack", "-run", "TestLocalStack", "-p", "1", "-count", "1", pkg}
+	if mg.Verbose() {
+		args = append(args, "-v")
+	}
+	return sh.RunV("go", args...)
+}